@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Authentication handshake, mirrored by the host in pkg/agent. With a key,
+// a connection gets nothing but pings answered until it has asked for a
+// challenge and returned the challenge's HMAC under the key.
+const (
+	methodAuthChallenge = "auth_challenge"
+	methodAuthenticate  = "authenticate"
+
+	// authContext is mixed into the HMAC, as on the host.
+	authContext = "fc-agent-auth:"
+
+	// errCodeUnauthenticated rejects requests on unauthenticated
+	// connections.
+	errCodeUnauthenticated = -32001
+)
+
+// connAuth tracks the handshake of one connection.
+type connAuth struct {
+	authenticated bool
+	nonce         string
+}
+
+// handshake handles a request on a connection that hasn't authenticated
+// yet. It returns nil for requests that need no authentication, and
+// otherwise the response and whether to close the connection after it.
+func (a *Agent) handshake(auth *connAuth, req *Request) (*Response, bool) {
+	resp := &Response{ID: req.ID}
+
+	switch req.Method {
+	case "ping":
+		return nil, false
+
+	case methodAuthChallenge:
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: "failed to create challenge"}
+			return resp, true
+		}
+		auth.nonce = hex.EncodeToString(nonce)
+		resp.Result = map[string]string{"nonce": auth.nonce}
+		return resp, false
+
+	case methodAuthenticate:
+		// Each challenge can only be answered once
+		nonce := auth.nonce
+		auth.nonce = ""
+
+		got, _ := req.Params["mac"].(string)
+		mac, err := hex.DecodeString(got)
+		if nonce == "" || err != nil || !hmac.Equal(mac, authMAC(a.config.AuthKey, nonce)) {
+			a.log.Error("Rejected connection with a bad authentication response")
+			resp.Error = &ResponseError{Code: errCodeUnauthenticated, Message: "authentication failed"}
+			return resp, true
+		}
+		auth.authenticated = true
+		resp.Result = map[string]string{"status": "ok"}
+		return resp, false
+
+	default:
+		a.log.Error("Rejected unauthenticated request", "method", req.Method)
+		resp.Error = &ResponseError{Code: errCodeUnauthenticated, Message: "unauthenticated"}
+		return resp, true
+	}
+}
+
+// authMAC returns the expected response to a challenge.
+func authMAC(key []byte, nonce string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(authContext + nonce))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// A VM restored from a snapshot resumes with the wall clock it had when the
+// snapshot was taken, which can be days old and breaks TLS and token
+// expiry checks. The host sends its time right after resuming the VM and
+// the agent steps the guest clock to it.
+
+// setClock sets the system wall clock. Tests replace it.
+var setClock = func(t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	return syscall.Settimeofday(&tv)
+}
+
+// syncTime sets the guest wall clock to the host time in params, given as
+// seconds and nanoseconds since the epoch. JSON numbers can't carry
+// nanoseconds since the epoch exactly, hence the split. It returns how far
+// the guest clock was off, positive when it was behind.
+func (a *Agent) syncTime(params map[string]interface{}) (map[string]int64, error) {
+	if a.config.DevSocket != "" {
+		return nil, errDevMode("setting the clock")
+	}
+
+	host, err := hostTime(params)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := time.Until(host)
+	if err := setClock(host); err != nil {
+		return nil, fmt.Errorf("failed to set clock: %w", err)
+	}
+
+	if offset > time.Second || offset < -time.Second {
+		a.log.Info("Clock stepped", "offset", offset.String())
+	} else {
+		a.log.Debug("Clock synchronized", "offset", offset.String())
+	}
+	return map[string]int64{"offset_ns": int64(offset)}, nil
+}
+
+// hostTime returns the time given as seconds and nanos in params.
+func hostTime(params map[string]interface{}) (time.Time, error) {
+	seconds, _ := params["seconds"].(float64)
+	nanos, _ := params["nanos"].(float64)
+	if seconds <= 0 || nanos < 0 || nanos >= float64(time.Second) {
+		return time.Time{}, fmt.Errorf("invalid host time %v.%09v", seconds, nanos)
+	}
+	return time.Unix(int64(seconds), int64(nanos)), nil
+}
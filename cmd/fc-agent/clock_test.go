@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]interface{}
+		want    time.Time
+		wantErr bool
+	}{
+		{"seconds and nanos", map[string]interface{}{"seconds": 1700000000.0, "nanos": 250000000.0}, time.Unix(1700000000, 250000000), false},
+		{"seconds only", map[string]interface{}{"seconds": 1700000000.0}, time.Unix(1700000000, 0), false},
+		{"no seconds", map[string]interface{}{"nanos": 5.0}, time.Time{}, true},
+		{"seconds as a string", map[string]interface{}{"seconds": "1700000000"}, time.Time{}, true},
+		{"negative seconds", map[string]interface{}{"seconds": -1.0}, time.Time{}, true},
+		{"negative nanos", map[string]interface{}{"seconds": 1700000000.0, "nanos": -1.0}, time.Time{}, true},
+		{"a whole second of nanos", map[string]interface{}{"seconds": 1700000000.0, "nanos": 1e9}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := hostTime(tt.params)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("%s: hostTime() = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// fakeClock replaces setClock, recording the time it is set to.
+func fakeClock(t *testing.T, err error) *time.Time {
+	t.Helper()
+	var set time.Time
+	old := setClock
+	setClock = func(t time.Time) error {
+		set = t
+		return err
+	}
+	t.Cleanup(func() { setClock = old })
+	return &set
+}
+
+func newClockAgent() *Agent {
+	log := NewLogger("test", levelDebug)
+	log.out = io.Discard
+	return &Agent{log: log}
+}
+
+func TestSyncTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		ahead   time.Duration // how far the host is ahead of the guest
+		wantMsg string
+	}{
+		{"restored from an old snapshot", 72 * time.Hour, "Clock stepped"},
+		{"guest ahead", -10 * time.Second, "Clock stepped"},
+		{"nearly in sync", 200 * time.Millisecond, "Clock synchronized"},
+	}
+	for _, tt := range tests {
+		set := fakeClock(t, nil)
+		a := newClockAgent()
+
+		host := time.Now().Add(tt.ahead)
+		got, err := a.syncTime(map[string]interface{}{
+			"seconds": float64(host.Unix()),
+			"nanos":   float64(host.Nanosecond()),
+		})
+		if err != nil {
+			t.Fatalf("%s: syncTime() error = %v", tt.name, err)
+		}
+		if !set.Equal(host) {
+			t.Errorf("%s: clock set to %v, want %v", tt.name, *set, host)
+		}
+		// The offset is measured just before the clock is set, so it is at
+		// most a little short of how far the host was ahead
+		offset := time.Duration(got["offset_ns"])
+		if offset > tt.ahead || offset < tt.ahead-time.Second/10 {
+			t.Errorf("%s: offset = %v, want about %v", tt.name, offset, tt.ahead)
+		}
+
+		entries, _, _ := a.log.Since(0)
+		if len(entries) != 1 || entries[0].Msg != tt.wantMsg {
+			t.Errorf("%s: logged %+v, want %q", tt.name, entries, tt.wantMsg)
+		}
+	}
+}
+
+func TestSyncTime_Errors(t *testing.T) {
+	valid := map[string]interface{}{"seconds": float64(time.Now().Unix())}
+
+	set := fakeClock(t, errors.New("operation not permitted"))
+	a := newClockAgent()
+	if _, err := a.syncTime(valid); err == nil || !strings.Contains(err.Error(), "failed to set clock") {
+		t.Errorf("syncTime() when the clock can't be set = %v", err)
+	}
+
+	*set = time.Time{}
+	if _, err := a.syncTime(map[string]interface{}{"seconds": 0.0}); err == nil || !strings.Contains(err.Error(), "invalid host time") {
+		t.Errorf("syncTime() without a time = %v, want invalid host time", err)
+	}
+	if !set.IsZero() {
+		t.Error("syncTime() set the clock to an invalid time")
+	}
+
+	// A dev agent runs on the host, whose clock it must not touch
+	a.config.DevSocket = "/tmp/agent.sock"
+	if _, err := a.syncTime(valid); err == nil || !strings.Contains(err.Error(), "dev mode") {
+		t.Errorf("syncTime() in dev mode = %v, want it refused", err)
+	}
+	if !set.IsZero() {
+		t.Error("syncTime() set the clock in dev mode")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kernel command line parameters the host configures the agent with, so
+// changing host settings doesn't need a new rootfs build.
+const (
+	cmdlinePort              = "fcagent.port"
+	cmdlineHeartbeatPort     = "fcagent.heartbeat_port"
+	cmdlineHeartbeatInterval = "fcagent.heartbeat_interval"
+	cmdlineNotifyPort        = "fcagent.notify_port"
+	cmdlineLogLevel          = "fcagent.loglevel"
+	cmdlineContainerRoot     = "fcagent.container_root"
+	cmdlineAuthKey           = "fcagent.auth_key"
+	cmdlineOverlay           = "fcagent.overlay"
+	cmdlineRuntime           = "fcagent.runtime"
+	cmdlineRuntimeArgs       = "fcagent.runtime_args"
+)
+
+// minAuthKeySize is the smallest key accepted for authenticating the host.
+const minAuthKeySize = 16
+
+// minHeartbeatInterval is the shortest heartbeat interval accepted, so a
+// typo can't have the agent flood the host.
+const minHeartbeatInterval = 10 * time.Millisecond
+
+// Log levels, from most to least verbose.
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+// AgentConfig holds the agent's settings.
+type AgentConfig struct {
+	// Port is the vsock port the agent listens on.
+	Port uint32
+
+	// HeartbeatPort and NotifyPort are the host vsock ports heartbeats and
+	// container notifications are sent to.
+	HeartbeatPort uint32
+	NotifyPort    uint32
+
+	// HeartbeatInterval is how often heartbeats are sent; the host expects
+	// them at the interval it passes.
+	HeartbeatInterval time.Duration
+
+	// LogLevel is "debug", "info" or "error".
+	LogLevel string
+
+	// ContainerRoot holds the bundles of the containers the agent runs.
+	ContainerRoot string
+
+	// AuthKey is the key connections must authenticate with (see
+	// handshake). nil accepts every connection.
+	AuthKey []byte
+
+	// Overlay is the writable drive the root is overlaid with when it's a
+	// read-only image (see setupOverlay). "" for writable roots.
+	Overlay string
+
+	// Runtime is the OCI runtime containers run with, a path or a name
+	// such as "crun". "" uses runc, or crun if the guest has no runc.
+	Runtime string
+
+	// RuntimeArgs are global options passed to the runtime before each
+	// command, e.g. "--debug".
+	RuntimeArgs []string
+
+	// DevSocket is the Unix socket the agent listens on when it runs as a
+	// host process instead of in a VM (see devSocketEnv). "" in a VM.
+	DevSocket string
+}
+
+// defaultAgentConfig returns the settings used when the host passes none.
+func defaultAgentConfig() AgentConfig {
+	return AgentConfig{
+		Port:          vsockPort,
+		HeartbeatPort: heartbeatPort,
+		NotifyPort:    notifyPort,
+		LogLevel:      "info",
+		ContainerRoot: containerRoot,
+
+		HeartbeatInterval: heartbeatInterval,
+	}
+}
+
+// readCmdline returns the kernel command line, or "" if it can't be read.
+// In dev mode the host passes it in the environment instead.
+func readCmdline() string {
+	if devSocket() != "" {
+		return os.Getenv(devCmdlineEnv)
+	}
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// parseAgentCmdline applies the agent parameters on a kernel command line
+// to config. Invalid values are skipped and returned as errors, so a typo
+// leaves the default in place rather than stopping the agent.
+func parseAgentCmdline(cmdline string, config *AgentConfig) []error {
+	var errs []error
+	for _, field := range strings.Fields(cmdline) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || !strings.HasPrefix(key, "fcagent.") {
+			continue
+		}
+
+		var err error
+		switch key {
+		case cmdlinePort:
+			err = parsePort(value, &config.Port)
+		case cmdlineHeartbeatPort:
+			err = parsePort(value, &config.HeartbeatPort)
+		case cmdlineNotifyPort:
+			err = parsePort(value, &config.NotifyPort)
+		case cmdlineHeartbeatInterval:
+			if d, parseErr := time.ParseDuration(value); parseErr == nil && d >= minHeartbeatInterval {
+				config.HeartbeatInterval = d
+			} else {
+				err = fmt.Errorf("invalid heartbeat interval %q (must be at least %s)", value, minHeartbeatInterval)
+			}
+		case cmdlineLogLevel:
+			if _, valid := logLevels[value]; valid {
+				config.LogLevel = value
+			} else {
+				err = fmt.Errorf("unknown log level %q", value)
+			}
+		case cmdlineContainerRoot:
+			if strings.HasPrefix(value, "/") {
+				config.ContainerRoot = value
+			} else {
+				err = fmt.Errorf("container root %q is not an absolute path", value)
+			}
+		case cmdlineOverlay:
+			if strings.HasPrefix(value, "/dev/") {
+				config.Overlay = value
+			} else {
+				err = fmt.Errorf("overlay drive %q is not a device", value)
+			}
+		case cmdlineRuntime:
+			if value != "" && !strings.ContainsAny(value, ",") {
+				config.Runtime = value
+			} else {
+				err = fmt.Errorf("invalid runtime %q", value)
+			}
+		case cmdlineRuntimeArgs:
+			args := splitList(value)
+			for _, arg := range args {
+				if !strings.HasPrefix(arg, "-") {
+					err = fmt.Errorf("runtime option %q is not a flag", arg)
+				}
+			}
+			if err == nil {
+				config.RuntimeArgs = args
+			}
+		case cmdlineAuthKey:
+			key, decodeErr := hex.DecodeString(value)
+			if decodeErr != nil || len(key) < minAuthKeySize {
+				// Fail closed: with a key no one holds, nobody gets in.
+				// Never log the value.
+				config.AuthKey = make([]byte, minAuthKeySize*2)
+				_, _ = rand.Read(config.AuthKey)
+				err = fmt.Errorf("invalid key, rejecting all connections")
+			} else {
+				config.AuthKey = key
+			}
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return errs
+}
+
+// logLevels maps log level names to levels.
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"error": levelError,
+}
+
+// parsePort parses a vsock port.
+func parsePort(value string, port *uint32) error {
+	p, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || p == 0 {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	*port = uint32(p)
+	return nil
+}
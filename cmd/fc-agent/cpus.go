@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cpuSysfsDir is where the kernel exposes CPU hotplug controls.
+const cpuSysfsDir = "/sys/devices/system/cpu"
+
+// setOnlineCPUs keeps the first "count" CPUs online and takes the others
+// offline. Firecracker can't hot-unplug vCPUs, so this is how a VM booted
+// with more vCPUs than its workload asked for is sized down. CPU 0 always
+// stays online.
+func (a *Agent) setOnlineCPUs(params map[string]interface{}) (map[string]int, error) {
+	if a.config.DevSocket != "" {
+		return nil, errDevMode("changing online CPUs")
+	}
+	count, _ := params["count"].(float64)
+	if count < 1 {
+		return nil, fmt.Errorf("count must be at least 1")
+	}
+
+	cpus, err := hotplugCPUs(cpuSysfsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	online := 1 // CPU 0
+	for _, cpu := range cpus {
+		state := "0"
+		if cpu < int(count) {
+			state = "1"
+			online++
+		}
+		path := filepath.Join(cpuSysfsDir, fmt.Sprintf("cpu%d", cpu), "online")
+		if err := os.WriteFile(path, []byte(state), 0644); err != nil {
+			return nil, fmt.Errorf("failed to set cpu%d online=%s: %w", cpu, state, err)
+		}
+	}
+
+	a.log.Info("Online CPUs set", "online", online, "total", len(cpus)+1)
+	return map[string]int{"online": online, "total": len(cpus) + 1}, nil
+}
+
+// hotplugCPUs returns the numbers of the CPUs that can be taken offline,
+// in order.
+func hotplugCPUs(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CPUs: %w", err)
+	}
+
+	var cpus []int
+	for _, entry := range entries {
+		n, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "cpu"))
+		if err != nil || !strings.HasPrefix(entry.Name(), "cpu") || n == 0 {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "online")); err != nil {
+			return nil, fmt.Errorf("kernel does not support CPU hotplug")
+		}
+		cpus = append(cpus, n)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/mdlayher/vsock"
+)
+
+// Dev mode runs the agent as a plain host process in place of a VM, for
+// developing the runtime on machines without KVM. The host's VM manager
+// starts it with these set; the agent then serves on a Unix socket at the
+// VM's vsock path and reaches the host through the sockets Firecracker
+// would forward guest connections to.
+const (
+	// devSocketEnv is the Unix socket the agent listens on.
+	devSocketEnv = "FC_AGENT_DEV_SOCKET"
+
+	// devCmdlineEnv stands in for the kernel command line.
+	devCmdlineEnv = "FC_AGENT_CMDLINE"
+)
+
+// devSocket returns the socket the agent listens on in dev mode, or "" when
+// it runs in a VM.
+func devSocket() string {
+	return os.Getenv(devSocketEnv)
+}
+
+// listen listens for host connections: on vsock in a VM, on the dev socket
+// in dev mode.
+func (a *Agent) listen() (net.Listener, error) {
+	if a.config.DevSocket == "" {
+		return vsock.Listen(a.config.Port, nil)
+	}
+	_ = os.Remove(a.config.DevSocket)
+	return net.Listen("unix", a.config.DevSocket)
+}
+
+// dialHost connects to a host port. In dev mode it dials the socket
+// Firecracker would forward the guest's connections to that port to.
+func (a *Agent) dialHost(port uint32) (net.Conn, error) {
+	if a.config.DevSocket == "" {
+		return vsock.Dial(vsock.Host, port, nil)
+	}
+	return net.Dial("unix", fmt.Sprintf("%s_%d", a.config.DevSocket, port))
+}
+
+// errDevMode refuses requests that would change the host in dev mode.
+func errDevMode(what string) error {
+	return fmt.Errorf("%s is not supported in dev mode", what)
+}
+
+// removeContainers removes every container on shutdown. In a VM they die
+// with it; in dev mode they would outlive the agent on the host.
+func (a *Agent) removeContainers() {
+	a.mu.RLock()
+	ids := make([]string, 0, len(a.containers))
+	for id := range a.containers {
+		ids = append(ids, id)
+	}
+	a.mu.RUnlock()
+
+	for _, id := range ids {
+		if err := a.removeContainer(map[string]interface{}{"id": id}); err != nil {
+			a.log.Error("Failed to remove container", "id", id, "error", err)
+		}
+	}
+}
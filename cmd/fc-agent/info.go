@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is the agent's release, set at build time.
+var version = "dev"
+
+// protocolVersion is the version of the agent protocol, "major.minor". The
+// host refuses agents of another major version. Minor versions only add
+// methods, which are announced as features.
+const protocolVersion = "1.0"
+
+// agentFeatures are the optional parts of the protocol this agent speaks.
+var agentFeatures = []string{
+	"auth",
+	"heartbeat",
+	"notifications",
+	"agent_logs",
+	"guest_settings",
+	"online_cpus",
+	"routes",
+	"pod_stats",
+	"volumes",
+	"time_sync",
+	"secret_env",
+	"shutdown",
+	"configure_network",
+	"dns_search",
+	"interfaces",
+	"kernel_features",
+}
+
+// startedAt is when the agent started, the boot time if the kernel's can't
+// be read.
+var startedAt = time.Now()
+
+// getInfo describes the agent, so the host can check it speaks a
+// compatible protocol before relying on it.
+func (a *Agent) getInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version":          version,
+		"protocol_version": protocolVersion,
+		"features":         agentFeatures,
+		"boot_time":        bootTime().UTC().Format(time.RFC3339),
+		"dev_mode":         a.config.DevSocket != "",
+		"runtime":          a.runtime.Name,
+		"runtime_version":  a.runtime.Version,
+	}
+}
+
+// bootTime returns when the guest kernel booted, from the btime line of
+// /proc/stat.
+func bootTime() time.Time {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return startedAt
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			if secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				return time.Unix(secs, 0)
+			}
+		}
+	}
+	return startedAt
+}
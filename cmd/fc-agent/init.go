@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Images converted with boot files baked in boot fc-agent as init, through
+// the /sbin/fc-init link, instead of a base image's init. The agent then
+// mounts the filesystems an init would before anything reads them.
+
+// initMount is a filesystem mounted when the agent runs as init.
+type initMount struct {
+	source, target, fstype string
+	flags                  uintptr
+	data                   string
+}
+
+var initMounts = []initMount{
+	{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	{"devtmpfs", "/dev", "devtmpfs", syscall.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+	{"tmpfs", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=1777"},
+	{"tmpfs", "/run", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=0755"},
+	{"cgroup2", "/sys/fs/cgroup", "cgroup2", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+}
+
+// initPath is the PATH the agent runs with as init; the kernel passes init
+// none.
+const initPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// runningAsInit reports whether the agent is the VM's init.
+func runningAsInit() bool {
+	return os.Getpid() == 1 && devSocket() == ""
+}
+
+// setupInit mounts the filesystems of initMounts that aren't mounted yet.
+// Failures are returned rather than fatal, so the agent still starts and
+// can report them.
+func setupInit() []error {
+	if os.Getenv("PATH") == "" {
+		os.Setenv("PATH", initPath)
+	}
+
+	var errs []error
+	for _, m := range initMounts {
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if mountPoint(m.target) {
+			continue // The kernel mounts devtmpfs itself if built to
+		}
+		if err := syscall.Mount(m.source, m.target, m.fstype, m.flags, m.data); err != nil {
+			errs = append(errs, fmt.Errorf("failed to mount %s on %s: %w", m.fstype, m.target, err))
+		}
+	}
+	return errs
+}
+
+// mountPoint reports whether something is mounted on dir, which is then on
+// another device than its parent.
+func mountPoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The host checks the first VM booted from each kernel for the features the
+// runtime needs, so a misbuilt kernel is rejected before pooled VMs boot
+// from it. A feature built as a module that isn't loaded yet is loaded with
+// modprobe before the agent reports it missing.
+
+// kernelFeature is a kernel feature the host may require, and the module
+// that provides it when it isn't built in.
+type kernelFeature struct {
+	name    string
+	module  string
+	present func() bool
+}
+
+var kernelFeatureChecks = []kernelFeature{
+	{"virtio_blk", "virtio_blk", virtioDriver("virtio_blk")},
+	{"virtio_net", "virtio_net", virtioDriver("virtio_net")},
+	{"vsock", "vmw_vsock_virtio_transport", virtioDriver("vmw_vsock_virtio_transport")},
+	{"overlay", "overlay", filesystem("overlay")},
+}
+
+// getKernelFeatures returns the guest kernel's release and which of
+// kernelFeatureChecks it has.
+func (a *Agent) getKernelFeatures() map[string]interface{} {
+	features := []string{}
+	for _, f := range kernelFeatureChecks {
+		if !f.present() {
+			// Built as a module nothing has loaded yet
+			if err := exec.Command("modprobe", f.module).Run(); err != nil || !f.present() {
+				continue
+			}
+		}
+		features = append(features, f.name)
+	}
+	release, _ := os.ReadFile("/proc/sys/kernel/osrelease")
+	return map[string]interface{}{
+		"release":  strings.TrimSpace(string(release)),
+		"features": features,
+	}
+}
+
+// virtioDriver reports whether a virtio driver is registered.
+func virtioDriver(name string) func() bool {
+	return func() bool {
+		_, err := os.Stat("/sys/bus/virtio/drivers/" + name)
+		return err == nil
+	}
+}
+
+// filesystem reports whether the kernel supports a filesystem type.
+func filesystem(name string) func() bool {
+	return func() bool {
+		file, err := os.Open("/proc/filesystems")
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 0 && fields[len(fields)-1] == name {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// logBufferSize is how many recent log entries are kept for the host
+	// to pull with stream_agent_logs.
+	logBufferSize = 1024
+
+	// logKeepalive is how often a following log stream is sent an empty
+	// batch, so streams whose host went away are noticed.
+	logKeepalive = 30 * time.Second
+)
+
+// levelNames maps levels to their names.
+var levelNames = map[int]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelError: "error",
+}
+
+// LogEntry is a log record. Entries are numbered so the host can resume a
+// stream where it left off.
+type LogEntry struct {
+	Seq    uint64                 `json:"seq"`
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Logger writes structured JSON logs to stderr and keeps the most recent
+// entries in memory for the host. The level can be changed while running.
+type Logger struct {
+	component string
+	level     atomic.Int32
+	out       io.Writer
+
+	mu      sync.Mutex
+	entries []LogEntry // ring buffer of the last logBufferSize entries
+	next    uint64     // sequence number of the next entry
+	added   chan struct{}
+}
+
+// NewLogger creates a logger at the given level.
+func NewLogger(component string, level int) *Logger {
+	l := &Logger{
+		component: component,
+		out:       os.Stderr,
+		added:     make(chan struct{}),
+		next:      1,
+	}
+	l.level.Store(int32(level))
+	return l
+}
+
+// Level returns the name of the current level.
+func (l *Logger) Level() string {
+	return levelNames[int(l.level.Load())]
+}
+
+// SetLevel changes the level by name.
+func (l *Logger) SetLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	l.level.Store(int32(level))
+	return nil
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(levelDebug, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(levelInfo, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(levelError, msg, fields...)
+}
+
+// log records an entry given as alternating keys and values.
+func (l *Logger) log(level int, msg string, fields ...interface{}) {
+	if int32(level) < l.level.Load() {
+		return
+	}
+
+	entry := LogEntry{
+		Time:  time.Now().UTC(),
+		Level: levelNames[level],
+		Msg:   msg,
+	}
+	if len(fields) > 0 {
+		entry.Fields = make(map[string]interface{}, len(fields)/2+1)
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			if i+1 >= len(fields) {
+				entry.Fields["extra"] = fieldValue(fields[i])
+				break
+			}
+			entry.Fields[key] = fieldValue(fields[i+1])
+		}
+	}
+
+	l.mu.Lock()
+	entry.Seq = l.next
+	l.next++
+	if len(l.entries) < logBufferSize {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[(entry.Seq-1)%logBufferSize] = entry
+	}
+	added := l.added
+	l.added = make(chan struct{})
+	l.write(entry)
+	l.mu.Unlock()
+
+	close(added)
+}
+
+// write prints an entry as a single JSON line, with its fields alongside
+// time, level and msg. Must be called with l.mu held.
+func (l *Logger) write(entry LogEntry) {
+	line := make(map[string]interface{}, len(entry.Fields)+4)
+	for key, value := range entry.Fields {
+		line[key] = value
+	}
+	line["time"] = entry.Time.Format(time.RFC3339Nano)
+	line["level"] = entry.Level
+	line["msg"] = entry.Msg
+	line["component"] = l.component
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","msg":"unencodable log entry: %v"}`, err))
+	}
+	_, _ = l.out.Write(append(data, '\n'))
+}
+
+// fieldValue makes a log field value JSON friendly.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return v
+}
+
+// Since returns the buffered entries after seq, oldest first, and how many
+// entries after seq were dropped from the buffer before they could be read.
+// The channel is closed when the next entry is added.
+func (l *Logger) Since(seq uint64) ([]LogEntry, uint64, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := l.next - uint64(len(l.entries))
+	var dropped uint64
+	if seq+1 < oldest {
+		dropped = oldest - seq - 1
+		seq = oldest - 1
+	}
+
+	var entries []LogEntry
+	for s := seq + 1; s < l.next; s++ {
+		entries = append(entries, l.entries[(s-1)%logBufferSize])
+	}
+	return entries, dropped, l.added
+}
+
+// logBatch is a stream_agent_logs response.
+type logBatch struct {
+	Entries []LogEntry `json:"entries"`
+	Dropped uint64     `json:"dropped,omitempty"`
+}
+
+// streamLogs answers a stream_agent_logs request. Without follow, it sends
+// the buffered entries after "since" in one response. With follow, it
+// keeps sending new entries as they are logged, all under the request's
+// ID, until the connection fails or ctx is done; the connection carries
+// nothing else from then on.
+func (a *Agent) streamLogs(ctx context.Context, req *Request, encoder *json.Encoder) error {
+	var since uint64
+	if v, ok := req.Params["since"].(float64); ok && v > 0 {
+		since = uint64(v)
+	}
+	follow, _ := req.Params["follow"].(bool)
+
+	for {
+		entries, dropped, added := a.log.Since(since)
+		if len(entries) > 0 {
+			since = entries[len(entries)-1].Seq
+		}
+		resp := &Response{ID: req.ID, Result: logBatch{Entries: entries, Dropped: dropped}}
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-added:
+		case <-time.After(logKeepalive):
+		}
+	}
+}
+
+// setLogLevel changes the agent's log level.
+func (a *Agent) setLogLevel(params map[string]interface{}) (map[string]string, error) {
+	name, _ := params["level"].(string)
+	previous := a.log.Level()
+	if err := a.log.SetLevel(name); err != nil {
+		return nil, err
+	}
+	a.log.Info("Log level changed", "from", previous, "to", name)
+	return map[string]string{"level": name, "previous": previous}, nil
+}
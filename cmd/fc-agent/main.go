@@ -5,14 +5,19 @@
 // - No runtime dependencies
 // - Minimal memory footprint
 //
-// It communicates with the host via vsock and manages containers using runc.
+// It communicates with the host via vsock and manages containers using an
+// OCI runtime, runc or crun.
 //
 // Build: CGO_ENABLED=0 go build -ldflags="-s -w" -o fc-agent ./cmd/fc-agent
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -20,24 +25,60 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/mdlayher/vsock"
+	"github.com/pipeops/firecracker-cri/pkg/cgroup"
 )
 
 const (
+	// Defaults for settings the host can override on the kernel command
+	// line (see AgentConfig).
 	vsockPort     = 1024
-	runcBinary    = "/usr/bin/runc"
 	containerRoot = "/run/fc-agent/containers"
+
+	// heartbeatPort is the host vsock port heartbeats are sent to.
+	heartbeatPort     = 1025
+	heartbeatInterval = time.Second // Unless the host sets another
+
+	// notifyPort is the host vsock port container exits and OOM kills are
+	// reported to.
+	notifyPort = 1026
+
+	// oomPollInterval is how often container memory events are checked for
+	// OOM kills.
+	oomPollInterval = time.Second
+
+	// kmsgPath is the kernel log, which records every OOM kill.
+	kmsgPath = "/dev/kmsg"
+
+	// prSetChildSubreaper makes orphaned container processes reparent to
+	// the agent so it can collect their exit status.
+	prSetChildSubreaper = 36
 )
 
 // Agent manages containers inside the VM.
 type Agent struct {
 	mu         sync.RWMutex
 	containers map[string]*Container
+	config     AgentConfig
+	runtime    *ociRuntime
 	log        *Logger
+
+	// overlayRoot is the writable overlay over a read-only root, "" if
+	// the root is writable
+	overlayRoot string
+
+	// shuttingDown is set once the host asked the agent to get the VM
+	// ready for power-off; no new containers are created after that
+	shuttingDown bool
+
+	// Notifications not yet delivered to the host, oldest first
+	pending     []Notification
+	notifyReady chan struct{}
 }
 
 // Container represents a managed container.
@@ -47,41 +88,97 @@ type Container struct {
 	PID     int
 	Status  string
 	Created time.Time
-}
 
-// Logger is a simple structured logger.
-type Logger struct {
-	prefix string
-}
+	// Set once the container's init process has exited
+	ExitCode  int
+	OOMKilled bool
+	ExitedAt  time.Time
 
-func (l *Logger) Info(msg string, fields ...interface{}) {
-	l.log("INFO", msg, fields...)
+	// OOM kills in the container's cgroup already reported to the host
+	oomKills uint64
 }
 
-func (l *Logger) Error(msg string, fields ...interface{}) {
-	l.log("ERROR", msg, fields...)
-}
+func main() {
+	// Workloads in the guest read the sandbox metadata through the agent
+	if len(os.Args) > 1 && os.Args[1] == "metadata" {
+		os.Exit(runMetadata(os.Args[2:]))
+	}
 
-func (l *Logger) log(level, msg string, fields ...interface{}) {
-	fmt.Fprintf(os.Stderr, "[%s] %s %s %v\n", level, l.prefix, msg, fields)
-}
+	// Booted as init from an image with boot files baked in
+	var initErrs []error
+	if runningAsInit() {
+		initErrs = setupInit()
+	}
 
-func main() {
-	log := &Logger{prefix: "fc-agent"}
-	log.Info("Starting fc-agent")
+	// Settings from the host come on the kernel command line
+	cmdline := readCmdline()
+	config := defaultAgentConfig()
+	configErrs := parseAgentCmdline(cmdline, &config)
+	config.DevSocket = devSocket()
+
+	log := NewLogger("fc-agent", logLevels[config.LogLevel])
+	log.Info("Starting fc-agent", "version", version, "protocol", protocolVersion, "port", config.Port, "log_level", config.LogLevel)
+	if config.DevSocket != "" {
+		log.Info("Running in dev mode, outside a VM", "socket", config.DevSocket)
+	}
+	for _, err := range configErrs {
+		log.Error("Ignoring invalid kernel command line parameter", "error", err)
+	}
+	for _, err := range initErrs {
+		log.Error("Failed to set up the VM as init", "error", err)
+	}
+
+	// Containers run with the runtime the host asked for, or the one the
+	// guest has
+	oci, findErr := findRuntime(config.Runtime, config.RuntimeArgs)
+	if findErr != nil {
+		log.Error("Failed to find OCI runtime, containers can't be created", "error", findErr)
+		oci = &ociRuntime{Path: "runc", Name: "runc", Args: config.RuntimeArgs}
+		if config.Runtime != "" {
+			oci.Path, oci.Name = config.Runtime, filepath.Base(config.Runtime)
+		}
+	} else {
+		log.Info("Using OCI runtime", "runtime", oci.Name, "version", oci.Version, "path", oci.Path)
+	}
+	cgroupScopePrefix = oci.Name
 
 	// Ensure required directories exist
-	for _, dir := range []string{containerRoot, "/run/runc"} {
+	for _, dir := range []string{config.ContainerRoot, oci.stateDir()} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Error("Failed to create directory", "dir", dir, "error", err)
 			os.Exit(1)
 		}
 	}
 
+	// The runtime's create detaches the container init; adopt it so we can reap it
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		log.Error("Failed to become child subreaper", "error", errno)
+	}
+
+	// In dev mode the agent shares the host's network and kernel log
+	if config.DevSocket == "" {
+		setupNetwork(log, cmdline)
+		setupMMDS(log, cmdline)
+	}
+
 	// Create agent
 	agent := &Agent{
-		containers: make(map[string]*Container),
-		log:        log,
+		containers:  make(map[string]*Container),
+		config:      config,
+		runtime:     oci,
+		log:         log,
+		notifyReady: make(chan struct{}, 1),
+	}
+
+	// A read-only root is written through an overlay
+	if config.Overlay != "" && config.DevSocket == "" {
+		root, err := setupOverlay(config.Overlay)
+		if err != nil {
+			log.Error("Failed to set up rootfs overlay, containers can't write to the root", "device", config.Overlay, "error", err)
+		} else {
+			agent.overlayRoot = root
+			log.Info("Root is read-only, writing through overlay", "device", config.Overlay, "path", root)
+		}
 	}
 
 	// Handle signals
@@ -98,7 +195,19 @@ func main() {
 		cancel()
 	}()
 
-	if err := agent.serve(ctx); err != nil && ctx.Err() == nil {
+	// Let the host know we're alive even if nobody is calling us
+	go agent.heartbeat(ctx)
+	go agent.notify(ctx)
+	go agent.watchOOM(ctx)
+	if config.DevSocket == "" {
+		go agent.watchKernelOOM(ctx)
+	}
+
+	err := agent.serve(ctx)
+	if config.DevSocket != "" {
+		agent.removeContainers()
+	}
+	if err != nil && ctx.Err() == nil {
 		log.Error("Server error", "error", err)
 		os.Exit(1)
 	}
@@ -106,13 +215,19 @@ func main() {
 
 func (a *Agent) serve(ctx context.Context) error {
 	// Listen on vsock
-	listener, err := vsock.Listen(vsockPort, nil)
+	listener, err := a.listen()
 	if err != nil {
 		return fmt.Errorf("failed to listen on vsock: %w", err)
 	}
 	defer listener.Close()
 
-	a.log.Info("Listening on vsock", "port", vsockPort)
+	// Unblock Accept on shutdown
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	a.log.Info("Listening on vsock", "port", a.config.Port)
 
 	for {
 		select {
@@ -124,6 +239,9 @@ func (a *Agent) serve(ctx context.Context) error {
 		// Accept connection
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			a.log.Error("Accept error", "error", err)
 			continue
 		}
@@ -138,6 +256,9 @@ func (a *Agent) handleConnection(ctx context.Context, conn net.Conn) {
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
 
+	// Without a key every connection is trusted
+	auth := &connAuth{authenticated: a.config.AuthKey == nil}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -154,6 +275,31 @@ func (a *Agent) handleConnection(ctx context.Context, conn net.Conn) {
 			return
 		}
 
+		if !auth.authenticated {
+			if resp, closeConn := a.handshake(auth, &req); resp != nil {
+				if err := encoder.Encode(resp); err != nil || closeConn {
+					return
+				}
+				continue
+			}
+		}
+
+		// A followed log stream takes over the connection
+		if req.Method == "stream_agent_logs" {
+			if err := a.streamLogs(ctx, &req, encoder); err != nil {
+				a.log.Debug("Log stream ended", "error", err)
+				return
+			}
+			continue
+		}
+		if req.Method == "stream_container_logs" {
+			if err := a.streamContainerLogs(ctx, &req, encoder); err != nil {
+				a.log.Debug("Container log stream ended", "error", err)
+				return
+			}
+			continue
+		}
+
 		resp := a.handleRequest(&req)
 		if err := encoder.Encode(resp); err != nil {
 			a.log.Error("Encode error", "error", err)
@@ -169,6 +315,12 @@ func (a *Agent) handleRequest(req *Request) *Response {
 	case "ping":
 		resp.Result = map[string]string{"status": "ok"}
 
+	case "get_info":
+		resp.Result = a.getInfo()
+
+	case "get_kernel_features":
+		resp.Result = a.getKernelFeatures()
+
 	case "create_container":
 		if err := a.createContainer(req.Params); err != nil {
 			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
@@ -206,6 +358,28 @@ func (a *Agent) handleRequest(req *Request) *Response {
 			resp.Result = result
 		}
 
+	case "container_status":
+		status, err := a.containerStatus(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = status
+		}
+
+	case "set_timezone":
+		if err := a.setTimezone(req.Params); err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = map[string]string{"status": "ok"}
+		}
+
+	case "install_ca_bundle":
+		if err := a.installCABundle(req.Params); err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = map[string]string{"status": "ok"}
+		}
+
 	case "get_stats":
 		stats, err := a.getStats(req.Params)
 		if err != nil {
@@ -214,6 +388,73 @@ func (a *Agent) handleRequest(req *Request) *Response {
 			resp.Result = stats
 		}
 
+	case "pod_stats":
+		resp.Result = a.podStats()
+
+	case "set_log_level":
+		result, err := a.setLogLevel(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "set_online_cpus":
+		result, err := a.setOnlineCPUs(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "configure_network":
+		result, err := a.configureNetwork(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "set_routes":
+		result, err := a.setRoutes(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "get_routes":
+		result, err := a.getRoutes()
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "mount_volume":
+		result, err := a.mountVolume(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "sync_time":
+		result, err := a.syncTime(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
+	case "shutdown":
+		result, err := a.shutdown(req.Params)
+		if err != nil {
+			resp.Error = &ResponseError{Code: 1, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+
 	default:
 		resp.Error = &ResponseError{Code: -32601, Message: "Method not found"}
 	}
@@ -221,6 +462,58 @@ func (a *Agent) handleRequest(req *Request) *Response {
 	return resp
 }
 
+// heartbeat periodically tells the host the agent is alive. The host treats
+// a run of missed beats as a hung guest, so a failed connection is simply
+// retried on the next tick.
+func (a *Agent) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(a.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	var (
+		conn    net.Conn
+		encoder *json.Encoder
+		seq     uint64
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if conn == nil {
+			c, err := a.dialHost(a.config.HeartbeatPort)
+			if err != nil {
+				continue
+			}
+			conn = c
+			encoder = json.NewEncoder(conn)
+		}
+
+		a.mu.RLock()
+		containers := len(a.containers)
+		a.mu.RUnlock()
+
+		seq++
+		beat := Heartbeat{
+			Seq:        seq,
+			Timestamp:  time.Now(),
+			Containers: containers,
+		}
+		if err := encoder.Encode(&beat); err != nil {
+			a.log.Error("Heartbeat failed", "error", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
 // =============================================================================
 // Container Operations
 // =============================================================================
@@ -232,29 +525,57 @@ func (a *Agent) createContainer(params map[string]interface{}) error {
 	if id == "" {
 		return fmt.Errorf("container ID required")
 	}
+	bundle = a.writablePath(bundle)
+	env, err := secretEnv(params)
+	if err != nil {
+		return err
+	}
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	if a.shuttingDown {
+		return errShuttingDown()
+	}
 	if _, exists := a.containers[id]; exists {
 		return fmt.Errorf("container %s already exists", id)
 	}
 
 	// Create container directory
-	containerDir := filepath.Join(containerRoot, id)
+	containerDir := filepath.Join(a.config.ContainerRoot, id)
 	if err := os.MkdirAll(containerDir, 0755); err != nil {
 		return fmt.Errorf("failed to create container dir: %w", err)
 	}
 
-	// Run runc create
-	cmd := exec.Command(runcBinary, "create",
-		"--bundle", bundle,
+	// Secrets reach the runtime through a bundle of their own
+	runcBundle := bundle
+	if len(env) > 0 {
+		dir, finish, err := launchBundle(bundle, containerDir, env)
+		if err != nil {
+			return err
+		}
+		defer finish()
+		runcBundle = dir
+	}
+
+	// The container keeps the runtime's stdio, so it gets the output pipes
+	output, err := captureOutput(containerDir)
+	if err != nil {
+		return fmt.Errorf("failed to capture container output: %w", err)
+	}
+	cmd := a.runtime.command("create",
+		"--bundle", runcBundle,
 		"--pid-file", filepath.Join(containerDir, "pid"),
 		id)
+	cmd.Stdout, cmd.Stderr = output.Stdout, output.Stderr
 
-	output, err := cmd.CombinedOutput()
+	err = cmd.Run()
+	output.detach()
 	if err != nil {
-		return fmt.Errorf("runc create failed: %w: %s", err, output)
+		// Nothing else holds the pipes, so the runtime's error is logged
+		output.wait()
+		logged, _ := os.ReadFile(filepath.Join(containerDir, containerLogName))
+		return fmt.Errorf("%s create failed: %w: %s", a.runtime.Name, err, containerLogText(logged))
 	}
 
 	a.containers[id] = &Container{
@@ -264,7 +585,7 @@ func (a *Agent) createContainer(params map[string]interface{}) error {
 		Created: time.Now(),
 	}
 
-	a.log.Info("Container created", "id", id)
+	a.log.Info("Container created", "id", id, "secret_env", len(env))
 	return nil
 }
 
@@ -282,15 +603,14 @@ func (a *Agent) startContainer(params map[string]interface{}) (int, error) {
 		return 0, fmt.Errorf("container %s not found", id)
 	}
 
-	// Run runc start
-	cmd := exec.Command(runcBinary, "start", id)
+	cmd := a.runtime.command("start", id)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return 0, fmt.Errorf("runc start failed: %w: %s", err, output)
+		return 0, fmt.Errorf("%s start failed: %w: %s", a.runtime.Name, err, output)
 	}
 
 	// Read PID
-	pidFile := filepath.Join(containerRoot, id, "pid")
+	pidFile := filepath.Join(a.config.ContainerRoot, id, "pid")
 	pidData, err := os.ReadFile(pidFile)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read pid file: %w", err)
@@ -304,12 +624,101 @@ func (a *Agent) startContainer(params map[string]interface{}) (int, error) {
 	a.mu.Lock()
 	container.PID = pid
 	container.Status = "running"
+	container.ExitCode = 0
+	container.OOMKilled = false
+	container.ExitedAt = time.Time{}
+	container.oomKills, _ = readOOMKills(id)
 	a.mu.Unlock()
 
+	go a.reap(container, pid)
+
 	a.log.Info("Container started", "id", id, "pid", pid)
 	return pid, nil
 }
 
+// reap waits for a container's init process to exit and records how it
+// exited.
+func (a *Agent) reap(container *Container, pid int) {
+	exitCode := 255 // Unknown
+	var ws syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil {
+			switch {
+			case ws.Exited():
+				exitCode = ws.ExitStatus()
+			case ws.Signaled():
+				exitCode = 128 + int(ws.Signal())
+			}
+			break
+		}
+
+		// Not our child (e.g. we couldn't become a subreaper); poll instead
+		for syscall.Kill(pid, 0) == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		break
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if container.PID != pid {
+		// Restarted while we were waiting; the new process has its own reaper
+		return
+	}
+
+	// Report a kill that ended the container ahead of the exit
+	a.checkOOM(container)
+	oomKilled := container.oomKills > 0
+
+	container.Status = "stopped"
+	container.ExitCode = exitCode
+	container.OOMKilled = oomKilled
+	container.ExitedAt = time.Now()
+
+	a.queueNotification(Notification{
+		Type:        "exit",
+		ContainerID: container.ID,
+		PID:         pid,
+		ExitCode:    exitCode,
+		OOMKilled:   oomKilled,
+		Time:        container.ExitedAt,
+	})
+
+	a.log.Info("Container exited", "id", container.ID, "exit_code", exitCode, "oom_killed", oomKilled)
+}
+
+// containerStatus reports whether a container is running and, once it has
+// exited, how.
+func (a *Agent) containerStatus(params map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := params["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("container ID required")
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	container, exists := a.containers[id]
+	if !exists {
+		return nil, fmt.Errorf("container %s not found", id)
+	}
+
+	status := map[string]interface{}{
+		"status": container.Status,
+		"pid":    container.PID,
+	}
+	if !container.ExitedAt.IsZero() {
+		status["exit_code"] = container.ExitCode
+		status["oom_killed"] = container.OOMKilled
+		status["exited_at"] = container.ExitedAt
+	}
+	return status, nil
+}
+
 func (a *Agent) stopContainer(params map[string]interface{}) error {
 	id, _ := params["id"].(string)
 	timeout, _ := params["timeout"].(float64)
@@ -321,8 +730,16 @@ func (a *Agent) stopContainer(params map[string]interface{}) error {
 		return fmt.Errorf("container ID required")
 	}
 
+	a.mu.RLock()
+	container, exists := a.containers[id]
+	exited := exists && !container.ExitedAt.IsZero()
+	a.mu.RUnlock()
+	if exited {
+		return nil
+	}
+
 	// Try graceful stop with SIGTERM
-	cmd := exec.Command(runcBinary, "kill", id, "SIGTERM")
+	cmd := a.runtime.command("kill", id, "SIGTERM")
 	_ = cmd.Run()
 
 	// Wait for container to stop
@@ -336,15 +753,9 @@ func (a *Agent) stopContainer(params map[string]interface{}) error {
 	}
 
 	// Force kill if still running
-	cmd = exec.Command(runcBinary, "kill", id, "SIGKILL")
+	cmd = a.runtime.command("kill", id, "SIGKILL")
 	_ = cmd.Run()
 
-	a.mu.Lock()
-	if container, exists := a.containers[id]; exists {
-		container.Status = "stopped"
-	}
-	a.mu.Unlock()
-
 	a.log.Info("Container stopped", "id", id)
 	return nil
 }
@@ -355,12 +766,11 @@ func (a *Agent) removeContainer(params map[string]interface{}) error {
 		return fmt.Errorf("container ID required")
 	}
 
-	// Run runc delete
-	cmd := exec.Command(runcBinary, "delete", "--force", id)
+	cmd := a.runtime.command("delete", "--force", id)
 	_ = cmd.Run() // Ignore errors
 
 	// Clean up container directory
-	containerDir := filepath.Join(containerRoot, id)
+	containerDir := filepath.Join(a.config.ContainerRoot, id)
 	os.RemoveAll(containerDir)
 
 	a.mu.Lock()
@@ -389,14 +799,14 @@ func (a *Agent) execSync(params map[string]interface{}) (map[string]interface{},
 		args[i], _ = arg.(string)
 	}
 
-	// Build runc exec command
+	// Build the runtime's exec command
 	execArgs := []string{"exec", id}
 	execArgs = append(execArgs, args...)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, runcBinary, execArgs...)
+	cmd := a.runtime.commandContext(ctx, execArgs...)
 	stdout, err := cmd.Output()
 
 	var stderr []byte
@@ -420,30 +830,361 @@ func (a *Agent) execSync(params map[string]interface{}) (map[string]interface{},
 func (a *Agent) getStats(params map[string]interface{}) (map[string]interface{}, error) {
 	id, _ := params["id"].(string)
 	if id == "" {
-		return nil, fmt.Errorf("container ID required")
+		// No container given: report usage of the whole guest
+		return guestStats(), nil
 	}
 
-	// Read cgroup stats
-	// This is simplified - real implementation would read from cgroup fs
+	return containerStats(id), nil
+}
 
-	cgroupPath := fmt.Sprintf("/sys/fs/cgroup/system.slice/runc-%s.scope", id)
+// containerStats reads the usage of a container from its cgroup. CPU times
+// are in microseconds; limits are 0 when unlimited.
+func containerStats(id string) map[string]interface{} {
+	cgroupPath := containerCgroupPath(id)
+	readBytes, writeBytes := cgroup.ReadIOStat(filepath.Join(cgroupPath, "io.stat"))
+	cpu := readCgroupKeyed(filepath.Join(cgroupPath, "cpu.stat"))
+	memory := readCgroupKeyed(filepath.Join(cgroupPath, "memory.stat"))
+	memoryEvents := readCgroupKeyed(filepath.Join(cgroupPath, "memory.events"))
 
-	// CPU usage
-	cpuUsage := readCgroupValue(filepath.Join(cgroupPath, "cpu.stat"), "usage_usec")
+	return map[string]interface{}{
+		"cpu_usage":             cpu["usage_usec"],
+		"cpu_user":              cpu["user_usec"],
+		"cpu_system":            cpu["system_usec"],
+		"cpu_periods":           cpu["nr_periods"],
+		"cpu_throttled_periods": cpu["nr_throttled"],
+		"cpu_throttled":         cpu["throttled_usec"],
+		"memory_usage":          readCgroupValue(filepath.Join(cgroupPath, "memory.current"), ""),
+		"memory_limit":          readCgroupValue(filepath.Join(cgroupPath, "memory.max"), ""),
+		"memory_anon":           memory["anon"],
+		"memory_file":           memory["file"],
+		"memory_inactive_file":  memory["inactive_file"],
+		"page_faults":           memory["pgfault"],
+		"major_page_faults":     memory["pgmajfault"],
+		"oom_events":            memoryEvents["oom"],
+		"oom_kills":             memoryEvents["oom_kill"],
+		"read_bytes":            readBytes,
+		"write_bytes":           writeBytes,
+		"pids":                  readCgroupValue(filepath.Join(cgroupPath, "pids.current"), ""),
+		"pids_limit":            readCgroupValue(filepath.Join(cgroupPath, "pids.max"), ""),
+	}
+}
 
-	// Memory usage
-	memUsage := readCgroupValue(filepath.Join(cgroupPath, "memory.current"), "")
+// readCgroupKeyed reads a flat keyed cgroup file such as cpu.stat, one
+// "key value" pair per line.
+func readCgroupKeyed(path string) map[string]uint64 {
+	values := make(map[string]uint64)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values
+}
+
+// podStats reports the usage of every running container and of the whole
+// guest in one call, so the host can total a pod without a call per
+// container.
+func (a *Agent) podStats() map[string]interface{} {
+	a.mu.RLock()
+	var ids []string
+	for id, container := range a.containers {
+		if container.ExitedAt.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	a.mu.RUnlock()
+
+	containers := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		// The cgroup of a container that just exited is gone
+		if _, err := os.Stat(containerCgroupPath(id)); err == nil {
+			containers[id] = containerStats(id)
+		}
+	}
+
+	stats := guestStats()
+	stats["containers"] = containers
+	return stats
+}
+
+// guestStats reports VM-wide memory usage from /proc/meminfo.
+func guestStats() map[string]interface{} {
+	total := readMeminfoValue("MemTotal")
+	available := readMeminfoValue("MemAvailable")
+
+	var used uint64
+	if total > available {
+		used = total - available
+	}
 
 	return map[string]interface{}{
-		"cpu_usage":    cpuUsage,
-		"memory_usage": memUsage,
-		"read_bytes":   0,
-		"write_bytes":  0,
-	}, nil
+		"memory_usage": used,
+		"memory_total": total,
+	}
+}
+
+// readMeminfoValue returns a /proc/meminfo field in bytes.
+func readMeminfoValue(key string) uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, key+":") {
+			var kb uint64
+			_, _ = fmt.Sscanf(line, key+": %d kB", &kb)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// notify delivers container notifications to the host as they happen. A
+// notification stays queued until it has been written, so events are not
+// lost while the host isn't listening (e.g. while the shim restarts).
+func (a *Agent) notify(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	var (
+		conn    net.Conn
+		encoder *json.Encoder
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.notifyReady:
+		case <-ticker.C:
+		}
+
+		for {
+			a.mu.RLock()
+			if len(a.pending) == 0 {
+				a.mu.RUnlock()
+				break
+			}
+			n := a.pending[0]
+			a.mu.RUnlock()
+
+			if conn == nil {
+				c, err := a.dialHost(a.config.NotifyPort)
+				if err != nil {
+					break
+				}
+				conn = c
+				encoder = json.NewEncoder(conn)
+			}
+
+			if err := encoder.Encode(&n); err != nil {
+				a.log.Error("Notification failed", "type", n.Type, "error", err)
+				conn.Close()
+				conn = nil
+				break
+			}
+
+			a.mu.Lock()
+			a.pending = a.pending[1:]
+			a.mu.Unlock()
+		}
+	}
+}
+
+// queueNotification queues a notification for delivery to the host. Must be
+// called with a.mu held.
+func (a *Agent) queueNotification(n Notification) {
+	a.pending = append(a.pending, n)
+	select {
+	case a.notifyReady <- struct{}{}:
+	default:
+	}
+}
+
+// =============================================================================
+// OOM Detection
+// =============================================================================
+
+// watchOOM polls the memory events of running containers, so OOM kills that
+// don't end the container (e.g. of a worker process) are reported too.
+func (a *Agent) watchOOM(ctx context.Context) {
+	ticker := time.NewTicker(oomPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		for _, container := range a.containers {
+			if container.Status == "running" {
+				a.checkOOM(container)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// checkOOM reports OOM kills in a container's cgroup since the last check.
+// It returns false if the cgroup's memory events can't be read. Must be
+// called with a.mu held.
+func (a *Agent) checkOOM(container *Container) bool {
+	count, ok := readOOMKills(container.ID)
+	if !ok {
+		return false
+	}
+	for ; container.oomKills < count; container.oomKills++ {
+		a.reportOOM(container)
+	}
+	return true
+}
+
+// reportOOM queues an OOM notification for a container. Must be called with
+// a.mu held.
+func (a *Agent) reportOOM(container *Container) {
+	a.queueNotification(Notification{
+		Type:        "oom",
+		ContainerID: container.ID,
+		PID:         container.PID,
+		Time:        time.Now(),
+	})
+	a.log.Info("Container process OOM killed", "id", container.ID)
+}
+
+// watchKernelOOM follows the kernel log for OOM kills. The cgroup counters
+// usually see them first, but the kernel log also catches kills in
+// containers whose memory events can't be read, e.g. when the guest kernel
+// has no cgroup v2 memory controller.
+func (a *Agent) watchKernelOOM(ctx context.Context) {
+	kmsg, err := os.Open(kmsgPath)
+	if err != nil {
+		a.log.Error("Kernel OOM detection disabled", "error", err)
+		return
+	}
+	defer kmsg.Close()
+
+	// Only kills from now on are of interest
+	if _, err := kmsg.Seek(0, io.SeekEnd); err != nil {
+		a.log.Error("Kernel OOM detection disabled", "error", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		kmsg.Close()
+	}()
+
+	// Every read returns exactly one record
+	buf := make([]byte, 8192)
+	for {
+		n, err := kmsg.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.EPIPE) {
+				continue // Records were overwritten before we read them
+			}
+			if ctx.Err() == nil {
+				a.log.Error("Failed to read kernel log", "error", err)
+			}
+			return
+		}
+
+		if cgroup, pid, ok := parseKernelOOM(string(buf[:n])); ok {
+			a.kernelOOM(cgroup, pid)
+		}
+	}
+}
+
+// kernelOOM handles an OOM kill from the kernel log. Kills in containers
+// with readable memory events are left to the cgroup counters so they
+// aren't reported twice.
+func (a *Agent) kernelOOM(cgroup string, pid int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, container := range a.containers {
+		if cgroup != containerCgroup(container.ID) && (pid == 0 || pid != container.PID) {
+			continue
+		}
+		if !a.checkOOM(container) {
+			container.oomKills++
+			a.reportOOM(container)
+		}
+		return
+	}
+}
+
+// parseKernelOOM extracts the victim's cgroup and PID from the summary line
+// the kernel logs for every OOM kill:
+//
+//	oom-kill:constraint=CONSTRAINT_MEMCG,...,task_memcg=/system.slice/runc-abc.scope,task=java,pid=123,uid=0
+func parseKernelOOM(record string) (cgroup string, pid int, ok bool) {
+	// Records are "<prefix>;<message>", followed by continuation lines
+	_, msg, found := strings.Cut(record, ";")
+	if !found {
+		return "", 0, false
+	}
+	msg, _, _ = strings.Cut(msg, "\n")
+
+	fields, found := strings.CutPrefix(msg, "oom-kill:")
+	if !found {
+		return "", 0, false
+	}
+
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "task_memcg":
+			cgroup = value
+		case "pid":
+			pid, _ = strconv.Atoi(value)
+		}
+	}
+	return cgroup, pid, cgroup != "" || pid != 0
+}
+
+// readOOMKills returns the number of OOM kills in a container's cgroup, or
+// false if its memory events can't be read.
+func readOOMKills(id string) (uint64, bool) {
+	path := filepath.Join(containerCgroupPath(id), "memory.events")
+	if _, err := os.Stat(path); err != nil {
+		return 0, false
+	}
+	return readCgroupValue(path, "oom_kill"), true
+}
+
+// cgroupScopePrefix prefixes the systemd scopes the runtime puts containers
+// in, its name.
+var cgroupScopePrefix = "runc"
+
+// containerCgroup returns a container's cgroup, relative to the cgroup root.
+func containerCgroup(id string) string {
+	return fmt.Sprintf("/system.slice/%s-%s.scope", cgroupScopePrefix, id)
+}
+
+// containerCgroupPath returns the directory of a container's cgroup.
+func containerCgroupPath(id string) string {
+	return filepath.Join("/sys/fs/cgroup", containerCgroup(id))
 }
 
 func (a *Agent) getContainerState(id string) (string, error) {
-	cmd := exec.Command(runcBinary, "state", id)
+	cmd := a.runtime.command("state", id)
 	output, err := cmd.Output()
 	if err != nil {
 		return "unknown", err
@@ -472,9 +1213,188 @@ func readCgroupValue(path, key string) uint64 {
 	}
 
 	// Parse key-value format
-	var val uint64
-	_, _ = fmt.Sscanf(string(data), key+" %d", &val)
-	return val
+	for _, line := range strings.Split(string(data), "\n") {
+		var val uint64
+		if n, _ := fmt.Sscanf(line, key+" %d", &val); n == 1 {
+			return val
+		}
+	}
+	return 0
+}
+
+// =============================================================================
+// Guest Settings
+// =============================================================================
+
+// caBundlePaths are where distributions keep their CA bundle, relative to
+// the root filesystem. The first is used if none exists yet.
+var caBundlePaths = []string{
+	"etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine, Arch
+	"etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+	"etc/ssl/ca-bundle.pem",             // openSUSE
+}
+
+// setTimezone installs the given tzdata as the local time of the guest, or
+// of one container if an ID is given.
+func (a *Agent) setTimezone(params map[string]interface{}) error {
+	id, _ := params["id"].(string)
+	name, _ := params["timezone"].(string)
+	encoded, _ := params["tzdata"].(string)
+
+	if name == "" || strings.ContainsAny(name, "\n\x00") {
+		return fmt.Errorf("timezone name required")
+	}
+	tzdata, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || !bytes.HasPrefix(tzdata, []byte("TZif")) {
+		return fmt.Errorf("invalid tzdata for %s", name)
+	}
+
+	root, err := a.settingsRoot(id)
+	if err != nil {
+		return err
+	}
+	if err := writeRootFile(root, "etc/localtime", tzdata); err != nil {
+		return fmt.Errorf("failed to set timezone: %w", err)
+	}
+	if err := writeRootFile(root, "etc/timezone", []byte(name+"\n")); err != nil {
+		return fmt.Errorf("failed to set timezone: %w", err)
+	}
+
+	a.log.Info("Timezone set", "id", id, "timezone", name)
+	return nil
+}
+
+// installCABundle replaces the CA certificate bundle of the guest, or of one
+// container if an ID is given. Processes that already loaded the old bundle
+// keep using it until they restart.
+func (a *Agent) installCABundle(params map[string]interface{}) error {
+	id, _ := params["id"].(string)
+	encoded, _ := params["bundle"].(string)
+
+	bundle, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid CA bundle encoding: %w", err)
+	}
+	certs, err := countCertificates(bundle)
+	if err != nil {
+		return err
+	}
+
+	root, err := a.settingsRoot(id)
+	if err != nil {
+		return err
+	}
+
+	var written int
+	for _, name := range caBundlePaths {
+		if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+			continue
+		}
+		if err := writeRootFile(root, name, bundle); err != nil {
+			return fmt.Errorf("failed to install CA bundle: %w", err)
+		}
+		written++
+	}
+	if written == 0 {
+		if err := writeRootFile(root, caBundlePaths[0], bundle); err != nil {
+			return fmt.Errorf("failed to install CA bundle: %w", err)
+		}
+	}
+
+	a.log.Info("CA bundle installed", "id", id, "certificates", certs)
+	return nil
+}
+
+// settingsRoot returns the root filesystem guest settings apply to: the
+// guest's own, or a container's if an ID is given.
+func (a *Agent) settingsRoot(id string) (string, error) {
+	if id == "" {
+		// The guest's root is the host's in dev mode
+		if a.config.DevSocket != "" {
+			return "", errDevMode("changing guest settings")
+		}
+		return "/", nil
+	}
+
+	a.mu.RLock()
+	container, exists := a.containers[id]
+	a.mu.RUnlock()
+	if !exists {
+		return "", fmt.Errorf("container %s not found", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(container.Bundle, "config.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read container spec: %w", err)
+	}
+	var spec struct {
+		Root struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return "", fmt.Errorf("failed to parse container spec: %w", err)
+	}
+
+	root := spec.Root.Path
+	if root == "" {
+		root = "rootfs"
+	}
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(container.Bundle, root)
+	}
+	return root, nil
+}
+
+// countCertificates checks that a PEM bundle holds only certificates, so a
+// private key can't be shipped into a trust store by mistake.
+func countCertificates(bundle []byte) (int, error) {
+	var count int
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return 0, fmt.Errorf("CA bundle contains a %s block", block.Type)
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("CA bundle contains no certificates")
+	}
+	return count, nil
+}
+
+// writeRootFile atomically replaces a file under a root filesystem. Under a
+// container root, parent directories must not be symlinks, so an image
+// can't redirect the write outside its root.
+func writeRootFile(root, name string, data []byte) error {
+	path := filepath.Join(root, name)
+	dir := filepath.Dir(path)
+
+	if root != "/" {
+		for p := dir; len(p) > len(root); p = filepath.Dir(p) {
+			if info, err := os.Lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("%s: %s is a symlink", name, p)
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Renaming replaces a symlink rather than writing through it
+	tmp := path + ".fc-agent"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
 
 // =============================================================================
@@ -497,3 +1417,20 @@ type ResponseError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
+
+// Notification reports a container exit ("exit") or an OOM kill of one of
+// its processes ("oom") to the host.
+type Notification struct {
+	Type        string    `json:"type"`
+	ContainerID string    `json:"container_id"`
+	PID         int       `json:"pid"`
+	ExitCode    int       `json:"exit_code,omitempty"`
+	OOMKilled   bool      `json:"oom_killed,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+type Heartbeat struct {
+	Seq        uint64    `json:"seq"`
+	Timestamp  time.Time `json:"timestamp"`
+	Containers int       `json:"containers"`
+}
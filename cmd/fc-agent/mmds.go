@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// Kernel parameters the host sets when the VM has MMDS.
+	cmdlineMMDSAddr = "fc_cri.mmds_addr"
+	cmdlineMMDSMAC  = "fc_cri.mmds_mac"
+
+	// mmdsTokenTTL is the lifetime requested for MMDSv2 session tokens.
+	mmdsTokenTTL    = "60"
+	mmdsHTTPTimeout = 5 * time.Second
+)
+
+// parseMMDSCmdline returns the MMDS address and interface MAC from the
+// kernel command line, if the host enabled MMDS.
+func parseMMDSCmdline(cmdline string) (addr, mac string, ok bool) {
+	for _, field := range strings.Fields(cmdline) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case cmdlineMMDSAddr:
+			addr = value
+		case cmdlineMMDSMAC:
+			mac = strings.ToLower(value)
+		}
+	}
+	return addr, mac, addr != "" && mac != ""
+}
+
+// mmdsAddress returns the MMDS address of this VM, or "" without MMDS.
+func mmdsAddress() string {
+	addr, _, _ := parseMMDSCmdline(readCmdline())
+	return addr
+}
+
+// setupMMDS brings up the interface MMDS is reachable through and routes
+// the MMDS address to it. VMs without MMDS are left alone.
+func setupMMDS(log *Logger, cmdline string) {
+	addr, mac, ok := parseMMDSCmdline(cmdline)
+	if !ok {
+		return
+	}
+
+	name, err := interfaceByMAC(mac)
+	if err != nil {
+		log.Error("MMDS interface not found", "mac", mac, "error", err)
+		return
+	}
+	for _, args := range [][]string{
+		{"link", "set", "dev", name, "up"},
+		{"route", "replace", addr + "/32", "dev", name},
+	} {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			log.Error("Failed to configure MMDS interface", "args", args, "error", err, "output", string(output))
+			return
+		}
+	}
+	log.Info("MMDS configured", "interface", name, "address", addr)
+}
+
+// fetchMetadata reads a path from MMDS as JSON. It uses an MMDSv2 session
+// token when the service hands one out, and falls back to MMDSv1.
+func fetchMetadata(ctx context.Context, addr, path string) ([]byte, error) {
+	client := &http.Client{Timeout: mmdsHTTPTimeout}
+	base := "http://" + addr
+
+	token := ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-metadata-token-ttl-seconds", mmdsTokenTTL)
+	if resp, err := client.Do(req); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			token = strings.TrimSpace(string(body))
+		}
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, base+"/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("X-metadata-token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// runMetadata implements "fc-agent metadata [path]", printing the sandbox
+// metadata (or the part of it at path, e.g. "pod/labels") as JSON.
+func runMetadata(args []string) int {
+	addr := mmdsAddress()
+	if addr == "" {
+		fmt.Fprintln(os.Stderr, "metadata service is not enabled for this VM")
+		return 1
+	}
+
+	path := ""
+	if len(args) > 0 {
+		path = args[0]
+	}
+	data, err := fetchMetadata(context.Background(), addr, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read metadata: %v\n", err)
+		return 1
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	return 0
+}
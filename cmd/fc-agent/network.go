@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The host passes the sandbox's address on the kernel command line, so the
+// agent configures the guest interface at boot without a DHCP client, and
+// again through configure_network when the host asks.
+
+const (
+	// Kernel parameters the host sets when the VM has a sandbox network.
+	cmdlineGuestIP  = "fc_cri.ip"     // comma-separated address/prefix, primary first
+	cmdlineGateway  = "fc_cri.gw"     // default gateway
+	cmdlineGuestDNS = "fc_cri.dns"    // comma-separated nameservers
+	cmdlineSearch   = "fc_cri.search" // comma-separated DNS search domains
+
+	// resolvConfPath is where the guest's nameservers are written.
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+// guestNetwork is the static configuration of the sandbox's interface.
+type guestNetwork struct {
+	Interface string   // Found by the MAC on the kernel command line if empty
+	Addresses []string // CIDRs, e.g. 10.88.0.5/16 and fd00:fc::5/64 on dual-stack
+	Gateway   string   // Optional
+	DNS       []string // Optional; resolv.conf is left alone without any
+	Search    []string // Optional; DNS search domains, written with DNS
+}
+
+// splitList returns the non-empty items of a comma-separated list.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNetworkCmdline returns the guest network the host passed on the
+// kernel command line, if it passed one.
+func parseNetworkCmdline(cmdline string) (guestNetwork, bool) {
+	var n guestNetwork
+	for _, field := range strings.Fields(cmdline) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case cmdlineGuestIP:
+			n.Addresses = splitList(value)
+		case cmdlineGateway:
+			n.Gateway = value
+		case cmdlineGuestDNS:
+			n.DNS = splitList(value)
+		case cmdlineSearch:
+			n.Search = splitList(value)
+		}
+	}
+	return n, len(n.Addresses) > 0
+}
+
+// validate checks the addresses before anything in the guest is changed.
+func (n guestNetwork) validate() error {
+	if len(n.Addresses) == 0 {
+		return fmt.Errorf("no address")
+	}
+	for _, address := range n.Addresses {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if n.Gateway != "" && net.ParseIP(n.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %q", n.Gateway)
+	}
+	for _, server := range n.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid nameserver %q", server)
+		}
+	}
+	for _, domain := range n.Search {
+		if domain == "" || strings.ContainsAny(domain, " \t\n#;") {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// apply brings the interface up with the addresses, replaces the default
+// route and writes the nameservers and search domains. Applying the same network twice is a
+// no-op.
+func (n guestNetwork) apply(cmdline string) (string, error) {
+	if err := n.validate(); err != nil {
+		return "", err
+	}
+	dev := n.Interface
+	if dev == "" {
+		var err error
+		if dev, err = sandboxInterface(cmdline); err != nil {
+			return "", err
+		}
+	}
+
+	commands := [][]string{{"link", "set", "dev", dev, "up"}}
+	for _, address := range n.Addresses {
+		args := []string{"addr", "replace", address, "dev", dev}
+		// The host's IPAM owns the address: skip duplicate address
+		// detection, which would hold it back for a second or more
+		if ip, _, _ := net.ParseCIDR(address); ip.To4() == nil {
+			args = append([]string{"-6"}, append(args, "nodad")...)
+		}
+		commands = append(commands, args)
+	}
+	if n.Gateway != "" {
+		args := []string{"route", "replace", "default", "via", n.Gateway, "dev", dev}
+		if net.ParseIP(n.Gateway).To4() == nil {
+			args = append([]string{"-6"}, args...)
+		}
+		commands = append(commands, args)
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+		}
+	}
+
+	if len(n.DNS) > 0 || len(n.Search) > 0 {
+		if err := writeResolvConf(n.DNS, n.Search); err != nil {
+			return "", err
+		}
+	}
+	return dev, nil
+}
+
+// writeResolvConf writes the guest's nameservers and search domains. With
+// only search domains, the nameservers already in resolv.conf are kept.
+func writeResolvConf(servers, search []string) error {
+	if len(servers) == 0 {
+		if data, err := os.ReadFile(resolvConfPath); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "nameserver" {
+					servers = append(servers, fields[1])
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if err := os.WriteFile(resolvConfPath, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", resolvConfPath, err)
+	}
+	return nil
+}
+
+// setupNetwork configures the sandbox's interface from the kernel command
+// line at boot. VMs without a sandbox network are left alone.
+func setupNetwork(log *Logger, cmdline string) {
+	n, ok := parseNetworkCmdline(cmdline)
+	if !ok {
+		return
+	}
+	dev, err := n.apply(cmdline)
+	if err != nil {
+		log.Error("Failed to configure network from kernel command line", "error", err)
+		return
+	}
+	log.Info("Network configured", "interface", dev, "addresses", strings.Join(n.Addresses, ","), "gateway", n.Gateway, "dns", len(n.DNS), "search", len(n.Search))
+}
+
+// configureNetwork applies the static network configuration the host sends,
+// the same as the kernel command line carries.
+func (a *Agent) configureNetwork(params map[string]interface{}) (map[string]string, error) {
+	if a.config.DevSocket != "" {
+		return nil, errDevMode("configuring the network")
+	}
+
+	var n guestNetwork
+	var err error
+	if n.Interface, err = paramInterface(params); err != nil {
+		return nil, err
+	}
+	n.Gateway, _ = params["gateway"].(string)
+	n.Addresses = stringList(params["addresses"])
+	n.DNS = stringList(params["dns"])
+	n.Search = stringList(params["search"])
+
+	dev, err := n.apply(readCmdline())
+	if err != nil {
+		return nil, err
+	}
+	a.log.Info("Network configured", "interface", dev, "addresses", strings.Join(n.Addresses, ","), "gateway", n.Gateway, "dns", len(n.DNS), "search", len(n.Search))
+	return map[string]string{"interface": dev}, nil
+}
+
+// stringList returns the strings of a JSON array parameter.
+func stringList(param interface{}) []string {
+	raw, _ := param.([]interface{})
+	var items []string
+	for _, item := range raw {
+		if s, ok := item.(string); ok {
+			items = append(items, s)
+		}
+	}
+	return items
+}
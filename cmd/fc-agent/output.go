@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A container's stdout and stderr are pipes the agent reads, rather than
+// the runtime's own stdio. Each line is appended to output.log in the
+// container's directory, in the CRI log format, stamped with when it was
+// read, so the host can pull a container's output with
+// stream_container_logs and interleave it with other logs.
+const (
+	// containerLogName is the output log in a container's directory.
+	containerLogName = "output.log"
+
+	// containerLogMaxLine is the longest line logged as one entry; longer
+	// lines are split into partial entries.
+	containerLogMaxLine = 16 << 10
+
+	// containerLogPoll is how often a followed stream checks the logs of
+	// its containers for new lines.
+	containerLogPoll = 250 * time.Millisecond
+)
+
+// containerOutput is where a container's stdout and stderr go.
+type containerOutput struct {
+	// Stdout and Stderr are the write ends given to the runtime.
+	Stdout, Stderr *os.File
+
+	done chan struct{}
+}
+
+// captureOutput starts copying what is written to a new pair of pipes to
+// the output log in containerDir.
+func captureOutput(containerDir string) (*containerOutput, error) {
+	file, err := os.OpenFile(filepath.Join(containerDir, containerLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	out := &containerOutput{Stdout: stdoutW, Stderr: stderrW, done: make(chan struct{})}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for stream, r := range map[string]*os.File{"stdout": stdoutR, "stderr": stderrR} {
+		wg.Add(1)
+		go func(stream string, r *os.File) {
+			defer wg.Done()
+			defer r.Close()
+			copyOutput(r, file, stream, &mu)
+		}(stream, r)
+	}
+	go func() {
+		wg.Wait()
+		file.Close()
+		close(out.done)
+	}()
+	return out, nil
+}
+
+// detach closes the agent's write ends once the runtime holds its own, so
+// the log ends when the container's processes are gone.
+func (o *containerOutput) detach() {
+	o.Stdout.Close()
+	o.Stderr.Close()
+}
+
+// wait waits until everything written has been logged. It only returns
+// once every process holding the write ends has exited.
+func (o *containerOutput) wait() {
+	<-o.done
+}
+
+// copyOutput appends each line read from r to w as a log entry of stream.
+func copyOutput(r io.Reader, w io.Writer, stream string, mu *sync.Mutex) {
+	reader := bufio.NewReaderSize(r, containerLogMaxLine)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			tag := "F"
+			if line[len(line)-1] == '\n' {
+				line = line[:len(line)-1]
+			} else if err == bufio.ErrBufferFull {
+				tag = "P"
+			}
+			mu.Lock()
+			fmt.Fprintf(w, "%s %s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), stream, tag, line)
+			mu.Unlock()
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// containerLogEntry is a line of a container's output.
+type containerLogEntry struct {
+	Container string    `json:"container"`
+	Time      time.Time `json:"time"`
+	Stream    string    `json:"stream"`
+	Partial   bool      `json:"partial,omitempty"`
+	Line      string    `json:"line"`
+}
+
+// parseContainerLogLine parses an entry of an output log.
+func parseContainerLogLine(line string) (containerLogEntry, bool) {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 {
+		return containerLogEntry{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return containerLogEntry{}, false
+	}
+	entry := containerLogEntry{Time: t, Stream: parts[1], Partial: parts[2] == "P"}
+	if len(parts) == 4 {
+		entry.Line = parts[3]
+	}
+	return entry, true
+}
+
+// readContainerLog reads the complete entries of the output log at path
+// from offset on, returning them and the offset after the last.
+func readContainerLog(path string, offset int64) ([]containerLogEntry, int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset
+	}
+
+	var entries []containerLogEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A line being written is read once it's complete
+			return entries, offset
+		}
+		offset += int64(len(line))
+		if entry, ok := parseContainerLogLine(strings.TrimSuffix(line, "\n")); ok {
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// containerLogBatch is a stream_container_logs response.
+type containerLogBatch struct {
+	Entries []containerLogEntry `json:"entries"`
+}
+
+// streamContainerLogs answers a stream_container_logs request, for the
+// container "id" or, without one, every container. The first response has
+// the lines logged since "since" (RFC 3339), the last "tail" of them if
+// set, oldest first. With follow, new lines are sent as they are logged,
+// all under the request's ID, until the connection fails or ctx is done;
+// the connection carries nothing else from then on.
+func (a *Agent) streamContainerLogs(ctx context.Context, req *Request, encoder *json.Encoder) error {
+	id, _ := req.Params["id"].(string)
+	follow, _ := req.Params["follow"].(bool)
+	tail := -1
+	if v, ok := req.Params["tail"].(float64); ok && v >= 0 {
+		tail = int(v)
+	}
+	var since time.Time
+	if v, _ := req.Params["since"].(string); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return encoder.Encode(&Response{ID: req.ID, Error: &ResponseError{Code: 1, Message: fmt.Sprintf("invalid since %q", v)}})
+		}
+		since = t
+	}
+	if id != "" {
+		a.mu.RLock()
+		_, exists := a.containers[id]
+		a.mu.RUnlock()
+		if !exists {
+			return encoder.Encode(&Response{ID: req.ID, Error: &ResponseError{Code: 1, Message: fmt.Sprintf("container %s not found", id)}})
+		}
+	}
+
+	offsets := make(map[string]int64)
+	first := true
+	lastSent := time.Now()
+	for {
+		var entries []containerLogEntry
+		for _, cid := range a.logContainers(id) {
+			read, offset := readContainerLog(filepath.Join(a.config.ContainerRoot, cid, containerLogName), offsets[cid])
+			offsets[cid] = offset
+			for _, entry := range read {
+				if entry.Time.Before(since) {
+					continue
+				}
+				entry.Container = cid
+				entries = append(entries, entry)
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+		if first && tail >= 0 && len(entries) > tail {
+			entries = entries[len(entries)-tail:]
+		}
+
+		// Followed streams are kept alive with an empty batch now and then
+		if first || len(entries) > 0 || time.Since(lastSent) >= logKeepalive {
+			resp := &Response{ID: req.ID, Result: containerLogBatch{Entries: entries}}
+			if err := encoder.Encode(resp); err != nil {
+				return err
+			}
+			lastSent = time.Now()
+		}
+		if !follow {
+			return nil
+		}
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(containerLogPoll):
+		}
+	}
+}
+
+// logContainers returns the containers whose logs a stream for id reads:
+// id itself, or every container if id is empty.
+func (a *Agent) logContainers(id string) []string {
+	if id != "" {
+		return []string{id}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ids := make([]string, 0, len(a.containers))
+	for cid := range a.containers {
+		ids = append(ids, cid)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// containerLogText returns the lines of an output log without their time,
+// stream and tag.
+func containerLogText(data []byte) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if entry, ok := parseContainerLogLine(line); ok {
+			lines = append(lines, entry.Line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// A VM booting a read-only root image (erofs or squashfs) gets a writable
+// ext4 drive from the host, passed as fcagent.overlay. The agent mounts an
+// overlay with that drive as the upper layer over the root, and containers
+// whose bundles are on the root run from the overlay, so they can write.
+const (
+	// overlayDriveDir is where the overlay drive is mounted.
+	overlayDriveDir = "/run/fc-agent/overlay"
+
+	// overlayRootDir is where the writable view of the root is mounted.
+	overlayRootDir = "/run/fc-agent/rootfs"
+)
+
+// setupOverlay mounts the overlay drive and an overlay over the root with
+// it as the upper layer, returning where the overlay is mounted.
+func setupOverlay(device string) (string, error) {
+	if err := os.MkdirAll(overlayDriveDir, 0755); err != nil {
+		return "", err
+	}
+	if err := syscall.Mount(device, overlayDriveDir, "ext4", syscall.MS_NOATIME, ""); err != nil {
+		return "", fmt.Errorf("failed to mount %s: %w", device, err)
+	}
+
+	upper := filepath.Join(overlayDriveDir, "upper")
+	work := filepath.Join(overlayDriveDir, "work")
+	for _, dir := range []string{upper, work, overlayRootDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=/,upperdir=%s,workdir=%s", upper, work)
+	if err := syscall.Mount("overlay", overlayRootDir, "overlay", 0, options); err != nil {
+		return "", fmt.Errorf("failed to mount overlay: %w", err)
+	}
+	return overlayRootDir, nil
+}
+
+// writablePath returns where a path of the root is writable: in the overlay
+// if it's on the read-only root, as is if it's on another filesystem, such
+// as /run, or there is no overlay. The overlay only covers the root
+// filesystem itself, not what is mounted on it.
+func (a *Agent) writablePath(path string) string {
+	if a.overlayRoot == "" || !filepath.IsAbs(path) || strings.HasPrefix(path, a.overlayRoot+"/") {
+		return path
+	}
+
+	var root, st syscall.Stat_t
+	if syscall.Stat("/", &root) != nil || syscall.Stat(path, &st) != nil || st.Dev != root.Dev {
+		return path
+	}
+	return filepath.Join(a.overlayRoot, path)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cmdlineGuestMAC is the kernel parameter the host passes the MAC of
+	// the sandbox's interface in.
+	cmdlineGuestMAC = "fc_cri.eth_mac"
+
+	// defaultRouteInterface is the guest interface routes are installed on
+	// when the host names none and passes no MAC, as older hosts don't.
+	defaultRouteInterface = "eth0"
+)
+
+// Route is a route in the guest's main routing table.
+type Route struct {
+	Dst       string `json:"dst"`
+	GW        string `json:"gw,omitempty"`
+	Interface string `json:"interface"`
+}
+
+// setRoutes installs the routes of the sandbox's CNI result, such as
+// service and node-local CIDRs, on a guest interface. Existing routes to
+// the same destinations are replaced.
+func (a *Agent) setRoutes(params map[string]interface{}) (map[string]int, error) {
+	if a.config.DevSocket != "" {
+		return nil, errDevMode("changing routes")
+	}
+
+	dev, err := paramInterface(params)
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := params["routes"].([]interface{})
+
+	// Validate everything before touching the routing table
+	var commands [][]string
+	for _, item := range raw {
+		r, _ := item.(map[string]interface{})
+		dst, _ := r["dst"].(string)
+		gw, _ := r["gw"].(string)
+		if _, _, err := net.ParseCIDR(dst); err != nil {
+			return nil, fmt.Errorf("invalid route destination %q", dst)
+		}
+		args := []string{"route", "replace", dst}
+		if gw != "" {
+			if net.ParseIP(gw) == nil {
+				return nil, fmt.Errorf("invalid route gateway %q", gw)
+			}
+			args = append(args, "via", gw)
+		}
+		commands = append(commands, append(args, "dev", dev))
+	}
+
+	if output, err := exec.Command("ip", "link", "set", "dev", dev, "up").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to bring up %s: %s", dev, strings.TrimSpace(string(output)))
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to add route %s: %s", args[2], strings.TrimSpace(string(output)))
+		}
+	}
+
+	a.log.Info("Routes set", "interface", dev, "routes", len(commands))
+	return map[string]int{"routes": len(commands)}, nil
+}
+
+// sandboxInterface returns the name of the sandbox's network interface, the
+// one with the MAC on the kernel command line. Depending on the guest's
+// kernel and udev, it may be called eth0, ens3 or something else.
+func sandboxInterface(cmdline string) (string, error) {
+	for _, field := range strings.Fields(cmdline) {
+		if key, value, _ := strings.Cut(field, "="); key == cmdlineGuestMAC && value != "" {
+			return interfaceByMAC(strings.ToLower(value))
+		}
+	}
+	return defaultRouteInterface, nil
+}
+
+// paramInterface returns the interface a request applies to: the one it
+// names, else the one with the MAC it gives, else the sandbox's.
+func paramInterface(params map[string]interface{}) (string, error) {
+	if dev, _ := params["interface"].(string); dev != "" {
+		return dev, nil
+	}
+	if mac, _ := params["mac"].(string); mac != "" {
+		return interfaceByMAC(strings.ToLower(mac))
+	}
+	return sandboxInterface(readCmdline())
+}
+
+// interfaceByMAC returns the name of the interface with a MAC.
+func interfaceByMAC(mac string) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.HardwareAddr.String() == mac {
+			return iface.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no interface with MAC %s", mac)
+}
+
+// getRoutes returns the guest's main routing table.
+func (a *Agent) getRoutes() (map[string]interface{}, error) {
+	routes, err := readIPv4Routes("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	// Guests built without IPv6 have no IPv6 table
+	if v6, err := readIPv6Routes("/proc/net/ipv6_route"); err == nil {
+		routes = append(routes, v6...)
+	}
+	return map[string]interface{}{"routes": routes}, nil
+}
+
+// readIPv4Routes parses /proc/net/route, whose addresses are hex in host
+// byte order: little-endian on every guest architecture we support.
+func readIPv4Routes(path string) ([]Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %w", err)
+	}
+	defer file.Close()
+
+	ipv4 := func(s string) (net.IP, bool) {
+		v, err := strconv.ParseUint(s, 16, 32)
+		if err != nil {
+			return nil, false
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(v))
+		return ip, true
+	}
+
+	var routes []Route
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, ok1 := ipv4(fields[1])
+		gw, ok2 := ipv4(fields[2])
+		mask, ok3 := ipv4(fields[7])
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+		route := Route{
+			Dst:       (&net.IPNet{IP: dst, Mask: net.IPMask(mask)}).String(),
+			Interface: fields[0],
+		}
+		if !gw.IsUnspecified() {
+			route.GW = gw.String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
+
+// readIPv6Routes parses /proc/net/ipv6_route, leaving out the kernel's
+// local and multicast routes.
+func readIPv6Routes(path string) ([]Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	const (
+		rtfUp      = 0x1
+		rtfGateway = 0x2
+		rtfLocal   = 0x80000000
+	)
+
+	var routes []Route
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// dst dst_len src src_len gw metric refcnt use flags iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] == "lo" {
+			continue
+		}
+		dst, err1 := hex.DecodeString(fields[0])
+		prefix, err2 := strconv.ParseUint(fields[1], 16, 8)
+		gw, err3 := hex.DecodeString(fields[4])
+		flags, err4 := strconv.ParseUint(fields[8], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(dst) != 16 || len(gw) != 16 {
+			continue
+		}
+		if flags&rtfUp == 0 || flags&rtfLocal != 0 || net.IP(dst).IsMulticast() {
+			continue
+		}
+		route := Route{
+			Dst:       (&net.IPNet{IP: net.IP(dst), Mask: net.CIDRMask(int(prefix), 128)}).String(),
+			Interface: fields[9],
+		}
+		if flags&rtfGateway != 0 {
+			route.GW = net.IP(gw).String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Environment variables holding secrets come from the host with
+// create_container instead of in the bundle's config.json. runc only takes
+// a container's environment from config.json, so it reads a copy of the
+// spec with the secrets added from a FIFO: the spec passes through a pipe
+// buffer and never exists as a file in the guest. runc exec reads the
+// bundle's spec later, so exec'd processes don't get the secrets.
+
+// launchDir is the directory, under the container's, runc is given as the
+// bundle of a container with secret environment variables.
+const launchDir = "launch"
+
+// secretEnv reads the secret environment variables of create_container,
+// as NAME=value entries.
+func secretEnv(params map[string]interface{}) ([]string, error) {
+	raw, _ := params["secret_env"].([]interface{})
+	env := make([]string, 0, len(raw))
+	for _, item := range raw {
+		entry, _ := item.(string)
+		// Never echo the value
+		name, _, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || strings.ContainsAny(name, "\x00") {
+			return nil, fmt.Errorf("invalid secret environment variable %q", name)
+		}
+		env = append(env, entry)
+	}
+	return env, nil
+}
+
+// launchBundle prepares the bundle runc creates a container with secret
+// environment variables from. It returns the bundle, and a function that
+// serves its config.json to runc and must be called once runc is done.
+func launchBundle(bundle, containerDir string, env []string) (string, func(), error) {
+	spec, err := secretSpec(bundle, env)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir := filepath.Join(containerDir, launchDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create launch bundle: %w", err)
+	}
+	config := filepath.Join(dir, "config.json")
+	_ = os.Remove(config)
+	if err := syscall.Mkfifo(config, 0600); err != nil {
+		return "", nil, fmt.Errorf("failed to create spec FIFO: %w", err)
+	}
+
+	// Opening the FIFO blocks until runc opens it too
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f, err := os.OpenFile(config, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		_, _ = f.Write(spec)
+		f.Close()
+	}()
+
+	finish := func() {
+		// If runc failed before reading the spec, drain it here so the
+		// writer finishes. Opened read-write, the FIFO never blocks the
+		// open and always releases the writer's.
+		if f, err := os.OpenFile(config, os.O_RDWR, 0); err == nil {
+			go func() { _, _ = io.Copy(io.Discard, f) }()
+			<-done
+			f.Close()
+		}
+		<-done
+
+		// runc exec reads config.json from the bundle runc was created
+		// with; it gets the one without secrets
+		_ = os.Remove(config)
+		_ = os.Symlink(filepath.Join(bundle, "config.json"), config)
+	}
+	return dir, finish, nil
+}
+
+// secretSpec returns the OCI spec of a bundle with env added to its
+// process, replacing variables of the same name, and its root made
+// absolute so it resolves from another bundle directory.
+func secretSpec(bundle string, env []string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container spec: %w", err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse container spec: %w", err)
+	}
+
+	process, _ := spec["process"].(map[string]interface{})
+	if process == nil {
+		return nil, fmt.Errorf("container spec has no process")
+	}
+	secret := make(map[string]bool, len(env))
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		secret[name] = true
+	}
+	var merged []interface{}
+	current, _ := process["env"].([]interface{})
+	for _, item := range current {
+		entry, _ := item.(string)
+		if name, _, _ := strings.Cut(entry, "="); !secret[name] {
+			merged = append(merged, entry)
+		}
+	}
+	for _, entry := range env {
+		merged = append(merged, entry)
+	}
+	process["env"] = merged
+
+	root, _ := spec["root"].(map[string]interface{})
+	if root == nil {
+		root = map[string]interface{}{}
+		spec["root"] = root
+	}
+	path, _ := root["path"].(string)
+	if path == "" {
+		path = "rootfs"
+	}
+	if !filepath.IsAbs(path) {
+		root["path"] = filepath.Join(bundle, path)
+	}
+
+	return json.Marshal(spec)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Before powering a VM off, the host asks the agent to shut down: stop the
+// containers the way a pod deletion would and flush the page cache, so
+// writes to attached volumes reach their disks before the VMM goes away.
+
+// terminationGraceAnnotation is the pod's termination grace period, in
+// seconds, as the kubelet annotates containers with it.
+const terminationGraceAnnotation = "io.kubernetes.pod.terminationGracePeriod"
+
+// defaultShutdownTimeout is how long, in seconds, containers get to stop
+// when the host doesn't say.
+const defaultShutdownTimeout = 10
+
+// shutdown stops every running container, each with its pod's grace period
+// but no longer than the timeout in params, syncs filesystems and refuses
+// new containers. Once it returns, the VM can be powered off.
+func (a *Agent) shutdown(params map[string]interface{}) (map[string]interface{}, error) {
+	timeout, _ := params["timeout"].(float64)
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	a.mu.Lock()
+	a.shuttingDown = true
+	var running []*Container
+	for _, container := range a.containers {
+		if container.ExitedAt.IsZero() {
+			running = append(running, container)
+		}
+	}
+	a.mu.Unlock()
+
+	// All at once, so the shutdown takes the longest grace period rather
+	// than their sum
+	var wg sync.WaitGroup
+	for _, container := range running {
+		wg.Add(1)
+		go func(container *Container) {
+			defer wg.Done()
+			grace := containerGrace(container.Bundle, timeout)
+			if grace > timeout {
+				grace = timeout
+			}
+			if err := a.stopContainer(map[string]interface{}{"id": container.ID, "timeout": grace}); err != nil {
+				a.log.Error("Failed to stop container for shutdown", "id", container.ID, "error", err)
+			}
+		}(container)
+	}
+	wg.Wait()
+
+	// The host's page cache in dev mode is none of the agent's business
+	synced := false
+	if a.config.DevSocket == "" {
+		syscall.Sync()
+		synced = true
+	}
+
+	a.log.Info("Ready for power-off", "stopped", len(running), "synced", synced)
+	return map[string]interface{}{
+		"stopped": len(running),
+		"synced":  synced,
+	}, nil
+}
+
+// errShuttingDown refuses new containers once the host asked for shutdown.
+func errShuttingDown() error {
+	return fmt.Errorf("agent is shutting down")
+}
+
+// containerGrace returns the grace period, in seconds, of the pod a
+// container belongs to, or fallback if its bundle doesn't say.
+func containerGrace(bundle string, fallback float64) float64 {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return fallback
+	}
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fallback
+	}
+	grace, err := strconv.ParseFloat(spec.Annotations[terminationGraceAnnotation], 64)
+	if err != nil || grace <= 0 {
+		return fallback
+	}
+	return grace
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Volumes such as secrets and configmaps arrive as hot-attached drives
+// holding a filesystem the host built. Their device names depend on the
+// order drives were attached in, so the host names them by filesystem label
+// instead, and the agent finds the device whose superblock carries it.
+const (
+	// superblockOffset is where ext4 and erofs superblocks start.
+	superblockOffset = 1024
+
+	// ext4MagicOffset and ext4LabelOffset locate the magic number and
+	// volume name in an ext4 superblock.
+	ext4MagicOffset = 0x38
+	ext4LabelOffset = 0x78
+	ext4Magic       = 0xEF53
+
+	// erofsLabelOffset locates the volume name in an erofs superblock,
+	// which starts with its magic number.
+	erofsLabelOffset = 64
+	erofsMagic       = 0xE0F5E1E2
+
+	// labelSize is the size of the volume name of both filesystems.
+	labelSize = 16
+
+	// deviceWaitTimeout is how long a hot-attached drive may take to show
+	// up in the guest.
+	deviceWaitTimeout = 5 * time.Second
+)
+
+// mountVolume mounts the drive with a filesystem label at a mount point.
+// Ownership and modes are those of the files in the image, so the agent
+// doesn't change them.
+func (a *Agent) mountVolume(params map[string]interface{}) (map[string]string, error) {
+	if a.config.DevSocket != "" {
+		return nil, errDevMode("mounting volumes")
+	}
+
+	label, _ := params["label"].(string)
+	mountPoint, _ := params["mount_point"].(string)
+	fsType, _ := params["filesystem"].(string)
+	readOnly, _ := params["read_only"].(bool)
+	if label == "" || len(label) > labelSize {
+		return nil, fmt.Errorf("invalid volume label %q", label)
+	}
+	if !filepath.IsAbs(mountPoint) || filepath.Clean(mountPoint) == "/" {
+		return nil, fmt.Errorf("invalid mount point %q", mountPoint)
+	}
+	switch fsType {
+	case "", "ext4":
+		fsType = "ext4"
+	case "erofs":
+		readOnly = true
+	default:
+		return nil, fmt.Errorf("unsupported volume filesystem %q", fsType)
+	}
+
+	device, err := waitForLabel(label, deviceWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOATIME)
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := syscall.Mount(device, mountPoint, fsType, flags, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount %s at %s: %w", device, mountPoint, err)
+	}
+
+	a.log.Info("Volume mounted", "label", label, "device", device, "mount_point", mountPoint, "read_only", readOnly)
+	return map[string]string{"device": device}, nil
+}
+
+// waitForLabel returns the block device carrying a filesystem label,
+// waiting for a drive that was just attached to appear.
+func waitForLabel(label string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if device := findDeviceByLabel(label); device != "" {
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no drive with label %s", label)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// findDeviceByLabel returns the virtio block device whose ext4 or erofs
+// filesystem carries a label, or "" if none does.
+func findDeviceByLabel(label string) string {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "vd") {
+			continue
+		}
+		device := "/dev/" + entry.Name()
+		if filesystemLabel(device) == label {
+			return device
+		}
+	}
+	return ""
+}
+
+// filesystemLabel returns the label of the ext4 or erofs filesystem on a
+// device, or "" if it has neither.
+func filesystemLabel(device string) string {
+	file, err := os.Open(device)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	sb := make([]byte, ext4LabelOffset+labelSize)
+	if _, err := file.ReadAt(sb, superblockOffset); err != nil {
+		return ""
+	}
+
+	var name []byte
+	switch {
+	case binary.LittleEndian.Uint32(sb) == erofsMagic:
+		name = sb[erofsLabelOffset : erofsLabelOffset+labelSize]
+	case binary.LittleEndian.Uint16(sb[ext4MagicOffset:]) == ext4Magic:
+		name = sb[ext4LabelOffset : ext4LabelOffset+labelSize]
+	default:
+		return ""
+	}
+	return string(bytes.TrimRight(name, "\x00"))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agentLogEntry is a guest agent log record.
+type agentLogEntry struct {
+	Seq    uint64                 `json:"seq"`
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// streamAgentLogs writes the logs buffered by a sandbox's guest agent to w
+// and, with follow, keeps writing new ones until ctx is done.
+func (cli *CLI) streamAgentLogs(ctx context.Context, w io.Writer, vsockPath string, follow bool) error {
+	encoder := json.NewEncoder(w)
+	return readAgentLogs(ctx, vsockPath, follow, func(entries []agentLogEntry, dropped uint64) {
+		if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "(%d older entries were dropped)\n", dropped)
+		}
+		for _, entry := range entries {
+			if cli.output == "json" {
+				_ = encoder.Encode(entry)
+				continue
+			}
+			fmt.Fprintln(w, formatAgentLogEntry(entry))
+		}
+	})
+}
+
+// readAgentLogs calls fn with the logs buffered by a sandbox's guest agent
+// and, with follow, with new ones as they are logged until ctx is done.
+func readAgentLogs(ctx context.Context, vsockPath string, follow bool, fn func(entries []agentLogEntry, dropped uint64)) error {
+	conn, err := dialAgent(vsockPath, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	req := map[string]interface{}{
+		"id":     1,
+		"method": "stream_agent_logs",
+		"params": map[string]interface{}{"follow": follow},
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		if !follow {
+			_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		}
+		var resp struct {
+			Result struct {
+				Entries []agentLogEntry `json:"entries"`
+				Dropped uint64          `json:"dropped"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&resp); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read logs: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("agent error: %s", resp.Error.Message)
+		}
+
+		fn(resp.Result.Entries, resp.Result.Dropped)
+		if !follow {
+			return nil
+		}
+	}
+}
+
+// formatAgentLogEntry renders a log entry as a line of text.
+func formatAgentLogEntry(entry agentLogEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", entry.Time.Local().Format("2006-01-02T15:04:05.000"), strings.ToUpper(entry.Level), entry.Msg)
+
+	keys := make([]string, 0, len(entry.Fields))
+	for key := range entry.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, entry.Fields[key])
+	}
+	return b.String()
+}
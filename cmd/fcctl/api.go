@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/control"
+)
+
+// apiSocket returns the socket of the runtime API (pkg/control).
+func (cli *CLI) apiSocket() string {
+	return getEnvOrDefault("FC_CRI_API_SOCKET", filepath.Join(cli.runDir, "api.sock"))
+}
+
+// apiClient returns a client of the runtime API, or nil if the node's
+// runtime doesn't serve it.
+func (cli *CLI) apiClient(ctx context.Context) (*control.Client, error) {
+	socket := cli.apiSocket()
+	if _, err := os.Stat(socket); err != nil {
+		return nil, nil
+	}
+	return control.Dial(ctx, socket)
+}
+
+// requireAPI returns a client of the runtime API, failing if the runtime
+// doesn't serve it.
+func (cli *CLI) requireAPI(ctx context.Context) (*control.Client, error) {
+	client, err := cli.apiClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, fmt.Errorf("runtime API socket %s not found; is the runtime serving it?", cli.apiSocket())
+	}
+	return client, nil
+}
+
+// poolStatusFromAPI returns the pool's status from the runtime API, or nil
+// if the runtime doesn't serve it.
+func (cli *CLI) poolStatusFromAPI(ctx context.Context) (*PoolStatus, error) {
+	client, err := cli.apiClient(ctx)
+	if err != nil || client == nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	s, err := client.PoolStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolStatus{
+		Available:        s.Available,
+		Warming:          s.Warming,
+		Degraded:         s.Degraded,
+		InUse:            s.InUse,
+		MaxSize:          s.MaxSize,
+		TotalServed:      s.TotalServed,
+		HitRate:          s.HitRate,
+		PoolHits:         s.PoolHits,
+		PoolMisses:       s.PoolMisses,
+		ReservedVCPUs:    s.ReservedVCPUs,
+		ReservedMemoryMB: s.ReservedMemoryMB,
+	}, nil
+}
+
+func (cli *CLI) cmdPoolWarm(ctx context.Context, args []string) error {
+	req := &control.WarmPoolRequest{Count: 1}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--vcpus", "--memory":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", args[i])
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s %q", args[i], args[i+1])
+			}
+			if args[i] == "--vcpus" {
+				req.VCPUs = n
+			} else {
+				req.MemoryMB = n
+			}
+			i++
+		default:
+			count, err := strconv.Atoi(args[i])
+			if err != nil || count <= 0 {
+				return fmt.Errorf("invalid count: %s", args[i])
+			}
+			req.Count = count
+		}
+	}
+
+	client, err := cli.requireAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	resp, err := client.WarmPool(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to warm pool: %w", err)
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(resp)
+	}
+	fmt.Printf("Warmed %d VM(s); %d available, %d in use (max %d)\n",
+		req.Count, resp.Pool.Available, resp.Pool.InUse, resp.Pool.MaxSize)
+	return nil
+}
+
+func (cli *CLI) cmdPoolDrain(ctx context.Context) error {
+	client, err := cli.requireAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	resp, err := client.DrainPool(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to drain pool: %w", err)
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(resp)
+	}
+	fmt.Printf("Drained pool: %d idle VM(s) destroyed, %d released", resp.IdleDestroyed, resp.Released)
+	if len(resp.ForceKilled) > 0 {
+		fmt.Printf(", %d force-killed", len(resp.ForceKilled))
+	}
+	if resp.Errors > 0 {
+		fmt.Printf(", %d error(s)", resp.Errors)
+	}
+	fmt.Println()
+	return nil
+}
+
+// cmdPoolInspect lists the pool's VMs and their states, and with
+// --transitions how each got there.
+func (cli *CLI) cmdPoolInspect(ctx context.Context, args []string) error {
+	transitions := false
+	for _, arg := range args {
+		switch arg {
+		case "--transitions":
+			transitions = true
+		default:
+			return fmt.Errorf("unknown flag: %s", arg)
+		}
+	}
+
+	client, err := cli.requireAPI(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	vms, err := client.InspectPool(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to inspect pool: %w", err)
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(vms)
+	}
+	if len(vms) == 0 {
+		fmt.Println("No VMs in the pool")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tBUCKET\tSTATE\tFOR\tREASON")
+	for _, vm := range vms {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", vm.ID, vm.Bucket, vm.State, formatDuration(time.Since(vm.Since)), vm.Reason)
+		if !transitions {
+			continue
+		}
+		for _, t := range vm.Transitions {
+			from := t.From
+			if from == "" {
+				from = "-"
+			}
+			fmt.Fprintf(w, "\t\t  %s -> %s\t%s\t%s\n", from, t.To, t.At.Format(time.RFC3339), t.Reason)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+)
+
+const (
+	// defaultConfigPath is where the runtime reads its configuration.
+	defaultConfigPath = "/etc/fc-cri/config.toml"
+
+	// defaultBundleMaxMB bounds the content of a support bundle, before
+	// compression.
+	defaultBundleMaxMB = 50
+
+	// defaultBundleMaxFileMB bounds each file in a support bundle. Longer
+	// files keep their end, the most recent lines of a log.
+	defaultBundleMaxFileMB = 5
+
+	// defaultBundleSince is how far back logs and events go.
+	defaultBundleSince = 2 * time.Hour
+
+	// bundleCommandTimeout bounds each command or agent call a bundle runs.
+	bundleCommandTimeout = 10 * time.Second
+)
+
+// BundleManifest describes what a support bundle holds, and what it left
+// out and why.
+type BundleManifest struct {
+	CreatedAt  time.Time    `json:"created_at"`
+	Hostname   string       `json:"hostname"`
+	Version    string       `json:"fcctl_version"`
+	Since      string       `json:"since"`
+	MaxBytes   int64        `json:"max_bytes"`
+	TotalBytes int64        `json:"total_bytes"`
+	Redactions int          `json:"redactions"`
+	Files      []BundleFile `json:"files"`
+}
+
+// BundleFile is a file of a support bundle, or one that couldn't be added.
+type BundleFile struct {
+	Name       string `json:"name"`
+	Bytes      int64  `json:"bytes"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Redactions int    `json:"redactions,omitempty"`
+	Skipped    string `json:"skipped,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// bundleOptions are the flags of the support-bundle command.
+type bundleOptions struct {
+	out         string
+	configPath  string
+	since       time.Duration
+	maxBytes    int64
+	maxFileSize int64
+}
+
+// redaction replaces what a pattern matches in bundle files.
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// redactions scrub credentials and personal data from bundle files. Keys
+// and certificates a sandbox was configured with, and the contents of
+// secrets, must never leave the node.
+var redactions = []redaction{
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`), "[REDACTED PRIVATE KEY]"},
+	{regexp.MustCompile(`(?i)\b((?:authorization|proxy-authorization)["']?\s*[:=]\s*["']?(?:bearer|basic|token)?\s*)[^\s"',}]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|access[_-]?key|agent[_-]?key|auth[_-]?key|credentials?)["']?\s*[:=]\s*["']?)[^\s"',}]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)(://[^/\s:@]+:)[^/\s@]+@`), "${1}[REDACTED]@"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED EMAIL]"},
+	{regexp.MustCompile(`/home/[^/\s"']+`), "/home/[REDACTED]"},
+}
+
+// redact scrubs data, returning the result and how many matches it
+// replaced.
+func redact(data []byte) ([]byte, int) {
+	var count int
+	for _, r := range redactions {
+		data = r.pattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			count++
+			return r.pattern.ReplaceAll(match, []byte(r.replacement))
+		})
+	}
+	return data, count
+}
+
+// bundleWriter adds redacted files to a support bundle tarball, keeping
+// each file and the whole bundle within their limits.
+type bundleWriter struct {
+	tw       *tar.Writer
+	opts     bundleOptions
+	manifest BundleManifest
+}
+
+// add adds a file to the bundle. A file that failed to be collected is
+// recorded in the manifest with its error, along with whatever was read.
+func (b *bundleWriter) add(name string, data []byte, collectErr error) {
+	file := BundleFile{Name: name}
+	if collectErr != nil {
+		file.Error = collectErr.Error()
+	}
+	if len(data) == 0 {
+		if collectErr != nil {
+			b.manifest.Files = append(b.manifest.Files, file)
+		}
+		return
+	}
+
+	if int64(len(data)) > b.opts.maxFileSize {
+		data = data[int64(len(data))-b.opts.maxFileSize:]
+		// Start on a whole line
+		if i := bytes.IndexByte(data, '\n'); i >= 0 && i < len(data)-1 {
+			data = data[i+1:]
+		}
+		file.Truncated = true
+	}
+	data, file.Redactions = redact(data)
+
+	if b.manifest.TotalBytes+int64(len(data)) > b.opts.maxBytes {
+		file.Skipped = "bundle size limit reached"
+		b.manifest.Files = append(b.manifest.Files, file)
+		return
+	}
+	if err := b.write(name, data); err != nil {
+		file.Error = err.Error()
+		b.manifest.Files = append(b.manifest.Files, file)
+		return
+	}
+
+	file.Bytes = int64(len(data))
+	b.manifest.TotalBytes += file.Bytes
+	b.manifest.Redactions += file.Redactions
+	b.manifest.Files = append(b.manifest.Files, file)
+}
+
+// addJSON adds a value as an indented JSON file.
+func (b *bundleWriter) addJSON(name string, v interface{}, collectErr error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.add(name, nil, err)
+		return
+	}
+	b.add(name, append(data, '\n'), collectErr)
+}
+
+// addFile adds a file of the node.
+func (b *bundleWriter) addFile(name, path string) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	b.add(name, data, err)
+}
+
+// addCommand adds the output of a command, if the command exists.
+func (b *bundleWriter) addCommand(ctx context.Context, name string, command string, args ...string) {
+	if _, err := exec.LookPath(command); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, bundleCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	b.add(name, output, err)
+}
+
+func (b *bundleWriter) write(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    "fc-cri-support/" + name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.manifest.CreatedAt,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// cmdSupportBundle gathers the node's diagnostics into a redacted tarball
+// to attach to bug reports.
+func (cli *CLI) cmdSupportBundle(ctx context.Context, args []string) error {
+	opts := bundleOptions{
+		configPath:  defaultConfigPath,
+		since:       defaultBundleSince,
+		maxBytes:    defaultBundleMaxMB << 20,
+		maxFileSize: defaultBundleMaxFileMB << 20,
+	}
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return fmt.Errorf("%s requires a value", args[i])
+		}
+		flag, value := args[i], args[i+1]
+		i++
+		switch flag {
+		case "--out":
+			opts.out = value
+		case "--config":
+			opts.configPath = value
+		case "--since":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid --since %q", value)
+			}
+			opts.since = d
+		case "--max-size", "--max-file-size":
+			mb, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || mb <= 0 {
+				return fmt.Errorf("invalid %s %q (MB)", flag, value)
+			}
+			if flag == "--max-size" {
+				opts.maxBytes = mb << 20
+			} else {
+				opts.maxFileSize = mb << 20
+			}
+		default:
+			return fmt.Errorf("unknown support-bundle flag: %s", flag)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC().Truncate(time.Second)
+	if opts.out == "" {
+		opts.out = fmt.Sprintf("fc-cri-support-%s-%s.tar.gz", hostname, now.Format("20060102-150405"))
+	}
+
+	// "-" writes the bundle to stdout, so it can be fetched with --host
+	var out io.Writer = os.Stdout
+	status := os.Stderr
+	if opts.out != "-" {
+		file, err := os.OpenFile(opts.out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create bundle: %w", err)
+		}
+		defer file.Close()
+		out, status = file, os.Stdout
+	}
+
+	gz := gzip.NewWriter(out)
+	b := &bundleWriter{
+		tw:   tar.NewWriter(gz),
+		opts: opts,
+		manifest: BundleManifest{
+			CreatedAt: now,
+			Hostname:  hostname,
+			Version:   version,
+			Since:     opts.since.String(),
+			MaxBytes:  opts.maxBytes,
+			Files:     []BundleFile{},
+		},
+	}
+
+	cli.collectBundle(ctx, b)
+
+	// The manifest goes last, so it covers everything, and doesn't count
+	// against the limit
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.write("manifest.json", append(manifest, '\n')); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := b.tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	var skipped int
+	for _, f := range b.manifest.Files {
+		if f.Skipped != "" {
+			skipped++
+		}
+	}
+	fmt.Fprintf(status, "Wrote support bundle %s: %d file(s), %s, %d redaction(s)\n",
+		opts.out, len(b.manifest.Files)-skipped, formatBytes(float64(b.manifest.TotalBytes)), b.manifest.Redactions)
+	if skipped > 0 {
+		fmt.Fprintf(status, "%d file(s) left out to stay under %s, see manifest.json\n", skipped, formatBytes(float64(opts.maxBytes)))
+	}
+	return nil
+}
+
+// collectBundle adds the node's diagnostics to a bundle, most useful
+// first, so the size limit leaves out the least useful.
+func (cli *CLI) collectBundle(ctx context.Context, b *bundleWriter) {
+	since := time.Now().Add(-b.opts.since).Format("2006-01-02 15:04:05")
+
+	// Version and health
+	b.add("version.txt", []byte(cli.versionReport(ctx)), nil)
+	b.addJSON("health.json", cli.checkHealth(), nil)
+
+	// Effective configuration: the file with the environment applied
+	cfg, err := config.LoadFromFile(b.opts.configPath)
+	if err == nil {
+		config.LoadFromEnv(cfg)
+		b.addJSON("config/effective.json", cfg, cfg.Validate())
+	} else {
+		b.add("config/effective.json", nil, err)
+	}
+	b.addFile("config/"+filepath.Base(b.opts.configPath), b.opts.configPath)
+
+	// Metrics snapshot
+	client := &http.Client{Timeout: bundleCommandTimeout}
+	if resp, err := client.Get(cli.metricsAddress); err != nil {
+		b.add("metrics.txt", nil, err)
+	} else {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		b.add("metrics.txt", data, err)
+	}
+
+	// Sandboxes, with their VM logs and guest agent logs
+	sandboxes, err := cli.discoverSandboxes()
+	b.addJSON("sandboxes.json", sandboxes, err)
+	for _, sb := range sandboxes {
+		dir := filepath.Join(cli.runDir, sb.ID)
+		prefix := "sandboxes/" + sb.ID + "/"
+		b.addFile(prefix+"metadata.json", filepath.Join(dir, "metadata.json"))
+		for _, name := range []string{"firecracker.log", "vmm.log", "agent.log"} {
+			b.addFile(prefix+name, filepath.Join(dir, name))
+		}
+
+		vsockPath := filepath.Join(dir, "vsock.sock")
+		if _, err := os.Stat(vsockPath); err != nil || sb.State == "dead" {
+			continue
+		}
+		var logs bytes.Buffer
+		agentCtx, cancel := context.WithTimeout(ctx, bundleCommandTimeout)
+		err := cli.streamAgentLogs(agentCtx, &logs, vsockPath, false)
+		cancel()
+		b.add(prefix+"agent-logs.txt", logs.Bytes(), err)
+	}
+
+	// Recent events: the runtime's and kernel's logs, and image conversions
+	b.addCommand(ctx, "events/containerd.log", "journalctl", "--no-pager", "-o", "short-iso", "-u", "containerd", "--since", since)
+	b.addCommand(ctx, "events/kubelet.log", "journalctl", "--no-pager", "-o", "short-iso", "-u", "kubelet", "--since", since)
+	b.addCommand(ctx, "events/kernel.log", "journalctl", "--no-pager", "-o", "short-iso", "-k", "--since", since)
+	b.addFile("events/image-audit.log", filepath.Join(imageCacheDir(), "audit.log"))
+
+	// Resources the runtime left behind, as gc --dry-run reports them
+	report, err := cli.collectGarbage(gcOptions{dryRun: true, snapshotMaxAge: defaultSnapshotMaxAge})
+	b.addJSON("gc.json", report, err)
+	b.addFile("images/"+imageCacheIndex, filepath.Join(imageCacheDir(), imageCacheIndex))
+
+	// Host state
+	b.addFile("host/meminfo", "/proc/meminfo")
+	b.addFile("host/cpuinfo", "/proc/cpuinfo")
+	b.addCommand(ctx, "host/df.txt", "df", "-h")
+	b.addCommand(ctx, "host/ip-addr.txt", "ip", "addr")
+	b.addCommand(ctx, "host/ip-route.txt", "ip", "route")
+}
+
+// versionReport describes the versions of fcctl, the host and the
+// runtime's binaries.
+func (cli *CLI) versionReport(ctx context.Context) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "fcctl: %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if data, err := os.ReadFile("/proc/version"); err == nil {
+		fmt.Fprintf(&b, "kernel: %s", data)
+	}
+	if data, err := os.ReadFile("/etc/os-release"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if name, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+				fmt.Fprintf(&b, "os: %s\n", strings.Trim(name, `"`))
+			}
+		}
+	}
+	for _, binary := range []string{"firecracker", "jailer", "containerd", "runc"} {
+		ctx, cancel := context.WithTimeout(ctx, bundleCommandTimeout)
+		output, err := exec.CommandContext(ctx, binary, "--version").Output()
+		cancel()
+		if err != nil {
+			fmt.Fprintf(&b, "%s: unavailable\n", binary)
+			continue
+		}
+		first, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		fmt.Fprintf(&b, "%s: %s\n", binary, first)
+	}
+	return b.String()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// SandboxDiff is the comparison of two sandboxes' configurations.
+type SandboxDiff struct {
+	A         string      `json:"a"`
+	B         string      `json:"b"`
+	Fields    []DiffEntry `json:"fields"` // Only differing ones, unless --all
+	Differing int         `json:"differing"`
+	Identical int         `json:"identical"`
+	Skipped   []string    `json:"skipped,omitempty"` // Sources that couldn't be read
+}
+
+// DiffEntry is a field of both sandboxes' configurations. A or B is empty
+// if that sandbox doesn't have the field.
+type DiffEntry struct {
+	Field   string `json:"field"`
+	A       string `json:"a"`
+	B       string `json:"b"`
+	Differs bool   `json:"differs"`
+}
+
+// sandboxFacts is a sandbox's configuration flattened into fields, such as
+// "machine-config.vcpu_count" or "drives.rootfs.path_on_host".
+type sandboxFacts struct {
+	fields  map[string]string
+	skipped []string
+}
+
+// cmdDiff compares the VM configuration, kernel arguments, drives, network
+// interfaces and environment of two sandboxes, to find why one replica
+// behaves differently from another.
+func (cli *CLI) cmdDiff(ctx context.Context, args []string) error {
+	var ids []string
+	all := false
+	for _, arg := range args {
+		switch arg {
+		case "--all", "-a":
+			all = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown diff flag: %s", arg)
+			}
+			ids = append(ids, arg)
+		}
+	}
+	if len(ids) != 2 {
+		return fmt.Errorf("usage: fcctl diff <sandbox-a> <sandbox-b> [--all]")
+	}
+
+	a, err := cli.collectSandboxFacts(ids[0])
+	if err != nil {
+		return err
+	}
+	b, err := cli.collectSandboxFacts(ids[1])
+	if err != nil {
+		return err
+	}
+	diff := diffSandboxFacts(ids[0], ids[1], a, b, all)
+
+	if cli.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+
+	for _, skipped := range diff.Skipped {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", skipped)
+	}
+	if diff.Differing == 0 && !all {
+		fmt.Printf("No differences (%d fields compared)\n", diff.Identical)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FIELD\t%s\t%s\n", ids[0], ids[1])
+	for _, entry := range diff.Fields {
+		marker := ""
+		if all && entry.Differs {
+			marker = " *"
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\n", entry.Field, marker, orDash(entry.A), orDash(entry.B))
+	}
+	w.Flush()
+	fmt.Printf("\n%d fields differ, %d are identical\n", diff.Differing, diff.Identical)
+	return nil
+}
+
+// diffSandboxFacts compares two sandboxes' fields. With all, identical
+// fields are listed too.
+func diffSandboxFacts(idA, idB string, a, b *sandboxFacts, all bool) *SandboxDiff {
+	diff := &SandboxDiff{A: idA, B: idB, Fields: []DiffEntry{}}
+	for _, skipped := range a.skipped {
+		diff.Skipped = append(diff.Skipped, idA+": "+skipped)
+	}
+	for _, skipped := range b.skipped {
+		diff.Skipped = append(diff.Skipped, idB+": "+skipped)
+	}
+
+	fields := make(map[string]bool)
+	for field := range a.fields {
+		fields[field] = true
+	}
+	for field := range b.fields {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	for _, field := range names {
+		// Paths and names derived from the sandbox ID always differ
+		valueA := strings.ReplaceAll(a.fields[field], idA, "<id>")
+		valueB := strings.ReplaceAll(b.fields[field], idB, "<id>")
+		differs := valueA != valueB
+		if differs {
+			diff.Differing++
+		} else {
+			diff.Identical++
+		}
+		if differs || all {
+			diff.Fields = append(diff.Fields, DiffEntry{Field: field, A: valueA, B: valueB, Differs: differs})
+		}
+	}
+	return diff
+}
+
+// collectSandboxFacts reads everything diff compares about a sandbox: the
+// VM configuration Firecracker is running with, the shim's record of the
+// sandbox, the container's environment and the guest agent's version.
+// Sources that can't be read are noted rather than failing the diff.
+func (cli *CLI) collectSandboxFacts(id string) (*sandboxFacts, error) {
+	sandboxDir := filepath.Join(cli.runDir, id)
+	if _, err := os.Stat(sandboxDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("sandbox not found: %s", id)
+	}
+	facts := &sandboxFacts{fields: make(map[string]string)}
+	socketPath := filepath.Join(sandboxDir, "firecracker.sock")
+
+	// The configuration the VM actually runs with
+	var vmConfig map[string]interface{}
+	if err := getFirecrackerJSON(socketPath, "/vm/config", &vmConfig); err != nil {
+		facts.skipped = append(facts.skipped, fmt.Sprintf("VM configuration: %v", err))
+	} else {
+		for key, value := range vmConfig {
+			if key == "boot-source" {
+				flattenBootSource(facts.fields, value)
+				continue
+			}
+			flattenFacts(facts.fields, key, value)
+		}
+	}
+	var version struct {
+		Version string `json:"firecracker_version"`
+	}
+	if err := getFirecrackerJSON(socketPath, "/version", &version); err == nil {
+		facts.fields["firecracker.version"] = version.Version
+	}
+
+	// What the shim asked for, including settings Firecracker doesn't know
+	// about, and the container's environment
+	var state struct {
+		Bundle  string `json:"bundle"`
+		Sandbox struct {
+			VMConfig map[string]interface{} `json:"vm_config"`
+			FromPool bool                   `json:"from_pool"`
+		} `json:"sandbox"`
+	}
+	if data, err := os.ReadFile(filepath.Join(sandboxDir, "state.json")); err != nil {
+		facts.skipped = append(facts.skipped, fmt.Sprintf("shim state: %v", err))
+	} else if err := decodeJSON(bytes.NewReader(data), &state); err != nil {
+		facts.skipped = append(facts.skipped, fmt.Sprintf("shim state: %v", err))
+	} else {
+		flattenFacts(facts.fields, "shim", state.Sandbox.VMConfig)
+		facts.fields["shim.FromPool"] = fmt.Sprint(state.Sandbox.FromPool)
+		for name, value := range bundleEnvironment(state.Bundle) {
+			facts.fields["env."+name] = fingerprint([]byte(value))
+		}
+	}
+
+	// Files the VM booted from, by content
+	for _, field := range []string{"boot-source.kernel_image_path", "boot-source.initrd_path"} {
+		if path := facts.fields[field]; path != "" {
+			if digest, err := fileFingerprint(path); err == nil {
+				facts.fields[strings.TrimSuffix(field, "_path")+"_sha256"] = digest
+			}
+		}
+	}
+
+	agent := cli.testAgentConnection(filepath.Join(sandboxDir, "vsock.sock"))
+	facts.fields["agent.connected"] = fmt.Sprint(agent.Connected)
+	if agent.Version != "" {
+		features := append([]string(nil), agent.Features...)
+		sort.Strings(features)
+		facts.fields["agent.version"] = agent.Version
+		facts.fields["agent.protocol"] = agent.Protocol
+		facts.fields["agent.features"] = strings.Join(features, ",")
+	}
+
+	return facts, nil
+}
+
+// getFirecrackerJSON decodes the response to a GET of a VM's Firecracker
+// API.
+func getFirecrackerJSON(socketPath, path string, v interface{}) error {
+	resp, err := firecrackerClient(socketPath).Get("http://localhost" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return decodeJSON(resp.Body, v)
+}
+
+// decodeJSON decodes JSON keeping numbers as written, so large sizes
+// aren't shown in exponent form.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// flattenFacts adds value to fields under prefix. Objects are flattened by
+// key and lists by index, except lists of drives and interfaces, which are
+// keyed by their IDs so reordering them doesn't show up as a difference.
+func flattenFacts(fields map[string]string, prefix string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			flattenFacts(fields, prefix+"."+key, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			key := fmt.Sprint(i)
+			if obj, ok := item.(map[string]interface{}); ok {
+				for _, idKey := range []string{"drive_id", "iface_id"} {
+					if id, ok := obj[idKey].(string); ok && id != "" {
+						key = id
+					}
+				}
+			}
+			flattenFacts(fields, prefix+"."+key, item)
+		}
+	case nil:
+		// Unset fields are compared as absent
+	default:
+		fields[prefix] = fmt.Sprint(v)
+	}
+}
+
+// flattenBootSource adds the boot source to fields, with each kernel
+// argument as its own field so a single differing argument stands out.
+func flattenBootSource(fields map[string]string, value interface{}) {
+	source, _ := value.(map[string]interface{})
+	for key, item := range source {
+		if key != "boot_args" {
+			flattenFacts(fields, "boot-source."+key, item)
+			continue
+		}
+		args, _ := item.(string)
+		for _, arg := range strings.Fields(args) {
+			name, argValue, _ := strings.Cut(arg, "=")
+			// Each VM gets its own random key, a secret, and MACs derived
+			// from its ID; they always differ
+			switch name {
+			case "fcagent.auth_key", "fc_cri.eth_mac", "fc_cri.mmds_mac":
+				continue
+			}
+			fields["kernel.args."+name] = argValue
+		}
+	}
+}
+
+// bundleEnvironment reads the process environment from a bundle's OCI spec.
+func bundleEnvironment(bundle string) map[string]string {
+	if bundle == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil
+	}
+
+	var spec struct {
+		Process struct {
+			Env []string `json:"env"`
+		} `json:"process"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil
+	}
+
+	env := make(map[string]string, len(spec.Process.Env))
+	for _, kv := range spec.Process.Env {
+		if key, value, ok := strings.Cut(kv, "="); ok && key != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// fingerprint identifies data without revealing it, so environment values,
+// which may be secrets, can be compared.
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// fileFingerprint returns the fingerprint of a file's contents.
+func fileFingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:6]), nil
+}
+
+// orDash returns "-" for an empty value, for table output.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
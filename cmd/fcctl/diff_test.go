@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenFacts(t *testing.T) {
+	var config map[string]interface{}
+	err := decodeJSON(strings.NewReader(`{
+		"machine-config": {"vcpu_count": 2, "mem_size_mib": 17179869184, "smt": false, "cpu_template": null},
+		"drives": [
+			{"drive_id": "rootfs", "path_on_host": "/images/a.img", "is_read_only": true},
+			{"drive_id": "", "path_on_host": "/scratch.img"}
+		],
+		"network-interfaces": [{"iface_id": "eth0", "host_dev_name": "tap0"}],
+		"logger": [1, 2]
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]string)
+	for key, value := range config {
+		flattenFacts(fields, key, value)
+	}
+	want := map[string]string{
+		"machine-config.vcpu_count": "2",
+		// Numbers are kept as written, not in exponent form
+		"machine-config.mem_size_mib":           "17179869184",
+		"machine-config.smt":                    "false",
+		"drives.rootfs.path_on_host":            "/images/a.img",
+		"drives.rootfs.is_read_only":            "true",
+		"drives.rootfs.drive_id":                "rootfs",
+		"drives.1.drive_id":                     "",
+		"drives.1.path_on_host":                 "/scratch.img",
+		"network-interfaces.eth0.iface_id":      "eth0",
+		"network-interfaces.eth0.host_dev_name": "tap0",
+		"logger.0":                              "1",
+		"logger.1":                              "2",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("flattenFacts() = %v, want %v", fields, want)
+	}
+}
+
+func TestFlattenBootSource(t *testing.T) {
+	fields := make(map[string]string)
+	flattenBootSource(fields, map[string]interface{}{
+		"kernel_image_path": "/kernels/vmlinux",
+		"boot_args":         "console=ttyS0 quiet fcagent.auth_key=secret fc_cri.eth_mac=02:00:00:00:00:01 init=/sbin/fc-init",
+	})
+	want := map[string]string{
+		"boot-source.kernel_image_path": "/kernels/vmlinux",
+		"kernel.args.console":           "ttyS0",
+		"kernel.args.quiet":             "",
+		"kernel.args.init":              "/sbin/fc-init",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("flattenBootSource() = %v, want %v", fields, want)
+	}
+}
+
+func TestDiffSandboxFacts(t *testing.T) {
+	a := &sandboxFacts{
+		fields: map[string]string{
+			"machine-config.vcpu_count":  "2",
+			"drives.rootfs.path_on_host": "/run/fc-cri/fc-a/rootfs.img",
+			"kernel.args.quiet":          "",
+			"env.ONLY_A":                 "abc",
+		},
+		skipped: []string{"shim state: no such file"},
+	}
+	b := &sandboxFacts{
+		fields: map[string]string{
+			"machine-config.vcpu_count":  "4",
+			"drives.rootfs.path_on_host": "/run/fc-cri/fc-b/rootfs.img",
+			"kernel.args.quiet":          "",
+		},
+	}
+
+	diff := diffSandboxFacts("fc-a", "fc-b", a, b, false)
+	// Paths that only differ by the sandbox ID are the same
+	want := []DiffEntry{
+		{Field: "env.ONLY_A", A: "abc", B: "", Differs: true},
+		{Field: "machine-config.vcpu_count", A: "2", B: "4", Differs: true},
+	}
+	if !reflect.DeepEqual(diff.Fields, want) {
+		t.Errorf("diff fields = %+v, want %+v", diff.Fields, want)
+	}
+	if diff.Differing != 2 || diff.Identical != 2 {
+		t.Errorf("diff counts = %d differing, %d identical, want 2, 2", diff.Differing, diff.Identical)
+	}
+	if !reflect.DeepEqual(diff.Skipped, []string{"fc-a: shim state: no such file"}) {
+		t.Errorf("diff skipped = %q", diff.Skipped)
+	}
+
+	all := diffSandboxFacts("fc-a", "fc-b", a, b, true)
+	if len(all.Fields) != 4 || all.Fields[0].Field != "drives.rootfs.path_on_host" || all.Fields[0].A != "/run/fc-cri/<id>/rootfs.img" || all.Fields[0].Differs {
+		t.Errorf("diff --all fields = %+v", all.Fields)
+	}
+}
+
+func TestBundleEnvironment(t *testing.T) {
+	bundle := t.TempDir()
+	mkfile(t, filepath.Join(bundle, "config.json"), `{"process": {"env": ["PATH=/bin", "EMPTY=", "EQ=a=b", "=nokey", "NOVALUE"]}}`, 0)
+
+	want := map[string]string{"PATH": "/bin", "EMPTY": "", "EQ": "a=b"}
+	if got := bundleEnvironment(bundle); !reflect.DeepEqual(got, want) {
+		t.Errorf("bundleEnvironment() = %v, want %v", got, want)
+	}
+	if got := bundleEnvironment(""); got != nil {
+		t.Errorf("bundleEnvironment() without a bundle = %v", got)
+	}
+	if got := bundleEnvironment(t.TempDir()); got != nil {
+		t.Errorf("bundleEnvironment() without a spec = %v", got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmlinux")
+	mkfile(t, path, "kernel", 0)
+
+	got, err := fileFingerprint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fingerprint([]byte("kernel")); got != want || len(got) != 12 {
+		t.Errorf("fileFingerprint() = %q, want %q", got, want)
+	}
+	if fingerprint([]byte("secret-a")) == fingerprint([]byte("secret-b")) {
+		t.Error("fingerprint() gives different values the same fingerprint")
+	}
+}
+
+// serveFirecracker serves the given JSON responses by path on a
+// Firecracker API socket.
+func serveFirecracker(t *testing.T, socketPath string, responses map[string]string) {
+	t.Helper()
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	})}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Close() })
+}
+
+func TestCollectSandboxFacts(t *testing.T) {
+	runDir := t.TempDir()
+	kernel := filepath.Join(t.TempDir(), "vmlinux")
+	mkfile(t, kernel, "kernel", 0)
+	bundle := t.TempDir()
+	mkfile(t, filepath.Join(bundle, "config.json"), `{"process": {"env": ["TOKEN=hunter2"]}}`, 0)
+
+	dir := filepath.Join(runDir, "fc-a")
+	mkfile(t, filepath.Join(dir, "state.json"), `{"bundle": "`+bundle+`", "sandbox": {"vm_config": {"vcpus": 2}, "from_pool": true}}`, 0)
+	serveFirecracker(t, filepath.Join(dir, "firecracker.sock"), map[string]string{
+		"/vm/config": `{"boot-source": {"kernel_image_path": "` + kernel + `", "boot_args": "quiet"}, "machine-config": {"vcpu_count": 2}}`,
+		"/version":   `{"firecracker_version": "1.7.0"}`,
+	})
+
+	cli := &CLI{runDir: runDir}
+	facts, err := cli.collectSandboxFacts("fc-a")
+	if err != nil {
+		t.Fatalf("collectSandboxFacts() error = %v", err)
+	}
+	want := map[string]string{
+		"boot-source.kernel_image_path":   kernel,
+		"boot-source.kernel_image_sha256": fingerprint([]byte("kernel")),
+		"kernel.args.quiet":               "",
+		"machine-config.vcpu_count":       "2",
+		"firecracker.version":             "1.7.0",
+		"shim.vcpus":                      "2",
+		"shim.FromPool":                   "true",
+		// Environment values are only compared by fingerprint
+		"env.TOKEN":       fingerprint([]byte("hunter2")),
+		"agent.connected": "false",
+	}
+	if !reflect.DeepEqual(facts.fields, want) {
+		t.Errorf("collectSandboxFacts() fields = %v, want %v", facts.fields, want)
+	}
+	if len(facts.skipped) != 0 {
+		t.Errorf("collectSandboxFacts() skipped %q", facts.skipped)
+	}
+}
+
+func TestCollectSandboxFacts_Unreadable(t *testing.T) {
+	runDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(runDir, "fc-stopped"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cli := &CLI{runDir: runDir}
+
+	// A stopped VM and missing state are noted, not fatal
+	facts, err := cli.collectSandboxFacts("fc-stopped")
+	if err != nil {
+		t.Fatalf("collectSandboxFacts() error = %v", err)
+	}
+	if len(facts.skipped) != 2 || !strings.HasPrefix(facts.skipped[0], "VM configuration:") || !strings.HasPrefix(facts.skipped[1], "shim state:") {
+		t.Errorf("collectSandboxFacts() skipped %q, want the VM configuration and shim state", facts.skipped)
+	}
+
+	if _, err := cli.collectSandboxFacts("fc-missing"); err == nil || !strings.Contains(err.Error(), "sandbox not found") {
+		t.Errorf("collectSandboxFacts() of a missing sandbox = %v", err)
+	}
+}
+
+func TestCmdDiff_Args(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{nil, "usage: fcctl diff"},
+		{[]string{"fc-a"}, "usage: fcctl diff"},
+		{[]string{"fc-a", "fc-b", "fc-c"}, "usage: fcctl diff"},
+		{[]string{"fc-a", "fc-b", "--brief"}, "unknown diff flag"},
+		{[]string{"fc-a", "fc-b"}, "sandbox not found: fc-a"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir()}
+		err := cli.cmdDiff(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdDiff(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+)
+
+// fcctl doctor looks past `fcctl health`'s "is it there" checks at whether
+// the node can actually run microVMs: the KVM API and capabilities
+// Firecracker relies on, the kernel modules, cgroup controllers, CNI
+// plugins and versions of the binaries it was configured with. Each check
+// carries a hint on how to fix what it found.
+
+// Doctor check results
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+const (
+	// kvmAPIVersion is the only KVM API version Linux has shipped since 2.6.22
+	kvmAPIVersion = 12
+
+	// KVM ioctls on /dev/kvm
+	kvmGetAPIVersion    = 0xAE00
+	kvmCheckExtension   = 0xAE03
+	minFirecrackerMajor = 1
+	minFirecrackerMinor = 3
+
+	doctorCommandTimeout = 5 * time.Second
+)
+
+// kvmExtensions are the KVM capabilities Firecracker checks for on x86_64
+// before it will start a VM.
+var kvmExtensions = []struct {
+	name string
+	cap  uintptr
+}{
+	{"KVM_CAP_IRQCHIP", 0},
+	{"KVM_CAP_USER_MEMORY", 3},
+	{"KVM_CAP_SET_TSS_ADDR", 4},
+	{"KVM_CAP_EXT_CPUID", 7},
+	{"KVM_CAP_MP_STATE", 14},
+	{"KVM_CAP_IRQFD", 32},
+	{"KVM_CAP_PIT2", 33},
+	{"KVM_CAP_PIT_STATE2", 35},
+	{"KVM_CAP_IOEVENTFD", 36},
+	{"KVM_CAP_ADJUST_CLOCK", 39},
+	{"KVM_CAP_VCPU_EVENTS", 41},
+	{"KVM_CAP_DEBUGREGS", 50},
+	{"KVM_CAP_XSAVE", 55},
+	{"KVM_CAP_XCRS", 56},
+}
+
+// cgroupControllers are the cgroup v2 controllers the runtime limits VMs with.
+var cgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// DoctorCheck is the outcome of one doctor check.
+type DoctorCheck struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// DoctorReport is the outcome of all doctor checks.
+type DoctorReport struct {
+	Healthy   bool          `json:"healthy"`
+	Kernel    string        `json:"kernel"`
+	Arch      string        `json:"arch"`
+	Checks    []DoctorCheck `json:"checks"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+func (r *DoctorReport) add(name, status, detail, remediation string) {
+	if status == doctorFail {
+		r.Healthy = false
+	}
+	r.Checks = append(r.Checks, DoctorCheck{Name: name, Status: status, Detail: detail, Remediation: remediation})
+}
+
+// cmdDoctor runs the deep node diagnostics and fails if any check does.
+func (cli *CLI) cmdDoctor(ctx context.Context, args []string) error {
+	configPath := defaultConfigPath
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--config":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--config requires a value")
+			}
+			i++
+			configPath = args[i]
+		default:
+			return fmt.Errorf("unknown doctor flag: %s", args[i])
+		}
+	}
+
+	cfg, err := config.LoadFromFile(configPath)
+	if err != nil {
+		return err
+	}
+	config.LoadFromEnv(cfg)
+
+	report := runDoctor(ctx, cfg)
+
+	if cli.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printDoctorReport(report)
+	}
+
+	if !report.Healthy {
+		failed := 0
+		for _, check := range report.Checks {
+			if check.Status == doctorFail {
+				failed++
+			}
+		}
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func printDoctorReport(report DoctorReport) {
+	fmt.Printf("Kernel %s (%s)\n\n", report.Kernel, report.Arch)
+	labels := map[string]string{
+		doctorOK:   "[OK]  ",
+		doctorWarn: "[WARN]",
+		doctorFail: "[FAIL]",
+		doctorSkip: "[SKIP]",
+	}
+	for _, check := range report.Checks {
+		fmt.Printf("%s %-22s %s\n", labels[check.Status], check.Name, check.Detail)
+		if check.Remediation != "" && check.Status != doctorOK {
+			fmt.Printf("       %-22s -> %s\n", "", check.Remediation)
+		}
+	}
+	fmt.Println()
+	if report.Healthy {
+		fmt.Println("[OK] Node can run Firecracker VMs")
+	} else {
+		fmt.Println("[ERR] Node cannot run Firecracker VMs until the failed checks are fixed")
+	}
+}
+
+// runDoctor runs every check against the node and the runtime's config.
+func runDoctor(ctx context.Context, cfg *config.Config) DoctorReport {
+	report := DoctorReport{
+		Healthy:   true,
+		Kernel:    kernelRelease(),
+		Arch:      runtime.GOARCH,
+		CheckedAt: time.Now(),
+	}
+
+	checkKVM(&report)
+	checkNested(&report)
+	checkKernelModules(&report)
+	checkCgroups(&report)
+	checkCNI(ctx, &report, cfg.Network)
+	checkTapBridge(ctx, &report)
+	checkVMMVersions(ctx, &report, cfg.Runtime)
+	return report
+}
+
+func kernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// checkKVM checks that /dev/kvm is usable and speaks the API and
+// capabilities Firecracker needs.
+func checkKVM(report *DoctorReport) {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		remediation := "enable virtualization in the BIOS and load kvm_intel or kvm_amd"
+		if os.IsPermission(err) {
+			remediation = "run as root or add the runtime's user to the kvm group"
+		}
+		report.add("kvm_device", doctorFail, err.Error(), remediation)
+		report.add("kvm_api_version", doctorSkip, "/dev/kvm is not usable", "")
+		report.add("kvm_extensions", doctorSkip, "/dev/kvm is not usable", "")
+		return
+	}
+	defer f.Close()
+	report.add("kvm_device", doctorOK, "/dev/kvm is readable and writable", "")
+
+	version, errno := kvmIoctl(f, kvmGetAPIVersion, 0)
+	switch {
+	case errno != 0:
+		report.add("kvm_api_version", doctorFail, fmt.Sprintf("KVM_GET_API_VERSION: %v", errno),
+			"check dmesg for KVM errors")
+	case version != kvmAPIVersion:
+		report.add("kvm_api_version", doctorFail, fmt.Sprintf("API version %d, want %d", version, kvmAPIVersion),
+			"upgrade the host kernel")
+	default:
+		report.add("kvm_api_version", doctorOK, fmt.Sprintf("API version %d", version), "")
+	}
+
+	// Firecracker's capability list is per architecture; only x86_64's is
+	// checked here
+	if runtime.GOARCH != "amd64" {
+		report.add("kvm_extensions", doctorSkip, "capabilities are only checked on x86_64", "")
+		return
+	}
+	var missing []string
+	for _, ext := range kvmExtensions {
+		if ok, errno := kvmIoctl(f, kvmCheckExtension, ext.cap); errno != 0 || ok <= 0 {
+			missing = append(missing, ext.name)
+		}
+	}
+	if len(missing) > 0 {
+		report.add("kvm_extensions", doctorFail, "missing "+strings.Join(missing, ", "),
+			"upgrade the host kernel; on a cloud VM, use an instance type with nested virtualization")
+		return
+	}
+	report.add("kvm_extensions", doctorOK, fmt.Sprintf("all %d required capabilities present", len(kvmExtensions)), "")
+}
+
+func kvmIoctl(f *os.File, req, arg uintptr) (int, syscall.Errno) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, arg)
+	return int(r), errno
+}
+
+// checkNested reports whether the node is itself a VM, which works but
+// slows VM boot and I/O, and whether it lets its own guests use KVM.
+func checkNested(report *DoctorReport) {
+	nested := "nested support unknown"
+	for _, module := range []string{"kvm_intel", "kvm_amd"} {
+		data, err := os.ReadFile("/sys/module/" + module + "/parameters/nested")
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "Y", "1":
+			nested = module + " nested=Y"
+		default:
+			nested = module + " nested=N"
+		}
+	}
+
+	if cpuHasFlag("hypervisor") {
+		report.add("nested_virtualization", doctorWarn,
+			"node is a VM, so microVMs run nested ("+nested+")",
+			"expect slower boots; use bare metal or an instance type with hardware-assisted nested virtualization for production")
+		return
+	}
+	report.add("nested_virtualization", doctorOK, "node is bare metal ("+nested+")", "")
+}
+
+// cpuHasFlag reports whether /proc/cpuinfo lists a CPU flag.
+func cpuHasFlag(flag string) bool {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "flags" {
+			continue
+		}
+		for _, f := range strings.Fields(value) {
+			if f == flag {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// checkKernelModules checks for vsock, which the agent talks over, and
+// tun, which VM network interfaces are backed by.
+func checkKernelModules(report *DoctorReport) {
+	if exists("/dev/vhost-vsock") {
+		report.add("vhost_vsock", doctorOK, "/dev/vhost-vsock present", "")
+	} else if exists("/sys/module/vhost_vsock") {
+		report.add("vhost_vsock", doctorFail, "vhost_vsock is loaded but /dev/vhost-vsock is missing",
+			"create the device node: mknod /dev/vhost-vsock c 10 241")
+	} else {
+		report.add("vhost_vsock", doctorFail, "vhost_vsock module not loaded",
+			"modprobe vhost_vsock && echo vhost_vsock > /etc/modules-load.d/fc-cri.conf")
+	}
+
+	if exists("/dev/net/tun") {
+		report.add("tun", doctorOK, "/dev/net/tun present", "")
+	} else {
+		report.add("tun", doctorFail, "/dev/net/tun missing",
+			"modprobe tun && echo tun >> /etc/modules-load.d/fc-cri.conf")
+	}
+}
+
+// checkCgroups checks for the cgroup v2 controllers VM limits use. Without
+// them VMs still run, unconfined.
+func checkCgroups(report *DoctorReport) {
+	data, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		report.add("cgroup_v2", doctorWarn, "cgroup v2 is not mounted at /sys/fs/cgroup; VMs run without resource limits",
+			"boot with systemd.unified_cgroup_hierarchy=1")
+		return
+	}
+	have := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		have[c] = true
+	}
+	var missing []string
+	for _, c := range cgroupControllers {
+		if !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		report.add("cgroup_v2", doctorWarn, "controllers not available: "+strings.Join(missing, ", "),
+			"enable the controllers on the kernel command line (e.g. cgroup_enable=memory) and in the parent cgroup's cgroup.subtree_control")
+		return
+	}
+	report.add("cgroup_v2", doctorOK, "controllers "+strings.Join(cgroupControllers, ", ")+" available", "")
+}
+
+// cniPlugin is the part of a plugin's VERSION response doctor reads.
+type cniPlugin struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// checkCNI checks that the runtime's CNI network is configured and that
+// every plugin it chains exists and supports its spec version.
+func checkCNI(ctx context.Context, report *DoctorReport, cfg config.NetworkConfig) {
+	conf, err := findCNIConf(cfg.CNIConfDir, cfg.DefaultNetworkName)
+	if err != nil {
+		report.add("cni_config", doctorFail, err.Error(),
+			fmt.Sprintf("install a network config named %q in %s (see docs/index.md, CNI Integration)", cfg.DefaultNetworkName, cfg.CNIConfDir))
+		report.add("cni_plugins", doctorSkip, "no network config", "")
+		return
+	}
+	report.add("cni_config", doctorOK, fmt.Sprintf("%s (cniVersion %s)", conf.path, conf.version), "")
+
+	var problems, found []string
+	for _, plugin := range conf.plugins {
+		bin := filepath.Join(cfg.CNIPluginDir, plugin)
+		if !exists(bin) {
+			problems = append(problems, plugin+" not installed")
+			continue
+		}
+		info, err := cniPluginVersion(ctx, bin)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", plugin, err))
+			continue
+		}
+		supported := false
+		for _, v := range info.SupportedVersions {
+			supported = supported || v == conf.version
+		}
+		if !supported {
+			problems = append(problems, fmt.Sprintf("%s does not support cniVersion %s (supports %s)",
+				plugin, conf.version, strings.Join(info.SupportedVersions, ", ")))
+			continue
+		}
+		found = append(found, fmt.Sprintf("%s %s", plugin, info.CNIVersion))
+	}
+	if len(problems) > 0 {
+		report.add("cni_plugins", doctorFail, strings.Join(problems, "; "),
+			"install the CNI reference plugins (github.com/containernetworking/plugins) into "+cfg.CNIPluginDir)
+		return
+	}
+	report.add("cni_plugins", doctorOK, strings.Join(found, ", "), "")
+}
+
+// cniConf is the network config the runtime attaches VMs with.
+type cniConf struct {
+	path    string
+	version string
+	plugins []string
+}
+
+// findCNIConf finds the .conf or .conflist in dir defining network name.
+func findCNIConf(dir, name string) (*cniConf, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CNI config directory: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if ext != ".conf" && ext != ".conflist" && ext != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var raw struct {
+			Name       string `json:"name"`
+			CNIVersion string `json:"cniVersion"`
+			Type       string `json:"type"`
+			Plugins    []struct {
+				Type string `json:"type"`
+			} `json:"plugins"`
+		}
+		if json.Unmarshal(data, &raw) != nil || raw.Name != name {
+			continue
+		}
+		conf := &cniConf{path: path, version: raw.CNIVersion}
+		if raw.Type != "" {
+			conf.plugins = append(conf.plugins, raw.Type)
+		}
+		for _, p := range raw.Plugins {
+			conf.plugins = append(conf.plugins, p.Type)
+		}
+		if len(conf.plugins) == 0 {
+			return nil, fmt.Errorf("network %q in %s has no plugins", name, path)
+		}
+		return conf, nil
+	}
+	return nil, fmt.Errorf("no CNI config for network %q in %s", name, dir)
+}
+
+// cniPluginVersion asks a plugin which spec versions it supports.
+func cniPluginVersion(ctx context.Context, bin string) (cniPlugin, error) {
+	ctx, cancel := context.WithTimeout(ctx, doctorCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Env = append(os.Environ(), "CNI_COMMAND=VERSION")
+	cmd.Stdin = strings.NewReader("{}")
+	out, err := cmd.Output()
+	if err != nil {
+		return cniPlugin{}, fmt.Errorf("VERSION failed: %w", err)
+	}
+	var info cniPlugin
+	if err := json.Unmarshal(out, &info); err != nil {
+		return cniPlugin{}, fmt.Errorf("invalid VERSION response: %w", err)
+	}
+	return info, nil
+}
+
+// checkTapBridge creates a tap device and a bridge the way VM networking
+// does, inside a throwaway network namespace so the host's is untouched.
+func checkTapBridge(ctx context.Context, report *DoctorReport) {
+	if os.Geteuid() != 0 {
+		report.add("tap_bridge", doctorSkip, "creating devices needs root", "rerun as root")
+		return
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		report.add("tap_bridge", doctorSkip, "ip not found", "install iproute2")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, doctorCommandTimeout)
+	defer cancel()
+	ns := fmt.Sprintf("fc-doctor-%d", os.Getpid())
+	run := func(args ...string) error {
+		out, err := exec.CommandContext(ctx, "ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if err := run("netns", "add", ns); err != nil {
+		report.add("tap_bridge", doctorFail, err.Error(), "check that the runtime may create network namespaces")
+		return
+	}
+	defer func() { _ = exec.Command("ip", "netns", "del", ns).Run() }()
+
+	if err := run("-n", ns, "tuntap", "add", "dev", "fcdoctor0", "mode", "tap"); err != nil {
+		report.add("tap_bridge", doctorFail, err.Error(), "modprobe tun")
+		return
+	}
+	if err := run("-n", ns, "link", "add", "fcdoctorbr0", "type", "bridge"); err != nil {
+		report.add("tap_bridge", doctorFail, err.Error(), "modprobe bridge")
+		return
+	}
+	if err := run("-n", ns, "link", "set", "fcdoctor0", "master", "fcdoctorbr0"); err != nil {
+		report.add("tap_bridge", doctorFail, err.Error(), "check dmesg for bridge errors")
+		return
+	}
+	report.add("tap_bridge", doctorOK, "created a tap device and attached it to a bridge", "")
+}
+
+var vmmVersionPattern = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+
+// checkVMMVersions checks that the configured firecracker is recent enough
+// and, when the jailer is used, that it comes from the same release.
+func checkVMMVersions(ctx context.Context, report *DoctorReport, cfg config.RuntimeConfig) {
+	fc, err := binaryVersion(ctx, cfg.FirecrackerBinary)
+	if err != nil {
+		report.add("firecracker", doctorFail, err.Error(),
+			"install firecracker from github.com/firecracker-microvm/firecracker/releases or set runtime.firecracker_binary")
+		report.add("jailer", doctorSkip, "firecracker version unknown", "")
+		return
+	}
+	if fc[0] < minFirecrackerMajor || fc[0] == minFirecrackerMajor && fc[1] < minFirecrackerMinor {
+		report.add("firecracker", doctorFail, fmt.Sprintf("%s is %s, older than the minimum v%d.%d.0",
+			cfg.FirecrackerBinary, formatVersion(fc), minFirecrackerMajor, minFirecrackerMinor),
+			"upgrade firecracker (see docs/compatibility.md)")
+	} else {
+		report.add("firecracker", doctorOK, fmt.Sprintf("%s %s", cfg.FirecrackerBinary, formatVersion(fc)), "")
+	}
+
+	jailer, err := binaryVersion(ctx, cfg.JailerBinary)
+	status := doctorFail
+	if !cfg.EnableJailer {
+		status = doctorWarn
+	}
+	switch {
+	case err != nil && !cfg.EnableJailer:
+		report.add("jailer", doctorSkip, "jailer disabled", "")
+	case err != nil:
+		report.add("jailer", doctorFail, err.Error(),
+			"install the jailer from the same release as firecracker or set runtime.jailer_binary")
+	case jailer != fc:
+		report.add("jailer", status, fmt.Sprintf("%s is %s but firecracker is %s",
+			cfg.JailerBinary, formatVersion(jailer), formatVersion(fc)),
+			"install firecracker and the jailer from the same release")
+	default:
+		report.add("jailer", doctorOK, fmt.Sprintf("%s %s", cfg.JailerBinary, formatVersion(jailer)), "")
+	}
+}
+
+// binaryVersion runs a firecracker release binary with --version.
+func binaryVersion(ctx context.Context, bin string) ([3]int, error) {
+	var version [3]int
+	ctx, cancel := context.WithTimeout(ctx, doctorCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin, "--version").Output()
+	if err != nil {
+		return version, fmt.Errorf("%s --version: %w", bin, err)
+	}
+	m := vmmVersionPattern.FindStringSubmatch(string(out))
+	if m == nil {
+		return version, fmt.Errorf("%s --version: unrecognized output %q", bin, strings.TrimSpace(string(out)))
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	return version, nil
+}
+
+func formatVersion(v [3]int) string {
+	return fmt.Sprintf("v%d.%d.%d", v[0], v[1], v[2])
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
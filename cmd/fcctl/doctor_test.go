@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+)
+
+// writeScript writes an executable shell script to dir/name.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkStatus returns the status and detail of the named check.
+func checkStatus(t *testing.T, report DoctorReport, name string) (string, string) {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check.Status, check.Detail
+		}
+	}
+	t.Fatalf("report has no %s check: %+v", name, report.Checks)
+	return "", ""
+}
+
+func TestDoctorReportAdd(t *testing.T) {
+	report := DoctorReport{Healthy: true}
+	report.add("a", doctorOK, "", "")
+	report.add("b", doctorWarn, "", "")
+	report.add("c", doctorSkip, "", "")
+	if !report.Healthy {
+		t.Error("warnings and skipped checks made the report unhealthy")
+	}
+	report.add("d", doctorFail, "", "")
+	report.add("e", doctorOK, "", "")
+	if report.Healthy || len(report.Checks) != 5 {
+		t.Errorf("report after a failure = healthy %v with %d checks", report.Healthy, len(report.Checks))
+	}
+}
+
+func TestFindCNIConf(t *testing.T) {
+	dir := t.TempDir()
+	mkfile(t, filepath.Join(dir, "00-other.conflist"), `{"name": "other", "cniVersion": "1.0.0", "plugins": [{"type": "bridge"}]}`, 0)
+	mkfile(t, filepath.Join(dir, "05-broken.conflist"), `{"name": "fc-net", `, 0)
+	mkfile(t, filepath.Join(dir, "10-fc.conflist"), `{"name": "fc-net", "cniVersion": "0.4.0", "plugins": [{"type": "ptp"}, {"type": "tc-redirect-tap"}]}`, 0)
+	mkfile(t, filepath.Join(dir, "20-fc.conflist"), `{"name": "fc-net", "cniVersion": "1.0.0", "plugins": [{"type": "bridge"}]}`, 0)
+	mkfile(t, filepath.Join(dir, "single.conf"), `{"name": "single", "cniVersion": "1.0.0", "type": "macvlan"}`, 0)
+	mkfile(t, filepath.Join(dir, "empty.conflist"), `{"name": "empty", "cniVersion": "1.0.0", "plugins": []}`, 0)
+	mkfile(t, filepath.Join(dir, "notes.txt"), `{"name": "notes", "type": "bridge"}`, 0)
+
+	tests := []struct {
+		name        string
+		wantPath    string
+		wantVersion string
+		wantPlugins string
+		wantErr     string
+	}{
+		// The first file by name wins, past ones that don't parse
+		{"fc-net", "10-fc.conflist", "0.4.0", "ptp,tc-redirect-tap", ""},
+		{"single", "single.conf", "1.0.0", "macvlan", ""},
+		{"empty", "", "", "", "has no plugins"},
+		{"notes", "", "", "", `no CNI config for network "notes"`},
+	}
+	for _, tt := range tests {
+		conf, err := findCNIConf(dir, tt.name)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("findCNIConf(%s) error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("findCNIConf(%s) error = %v", tt.name, err)
+			continue
+		}
+		if filepath.Base(conf.path) != tt.wantPath || conf.version != tt.wantVersion || strings.Join(conf.plugins, ",") != tt.wantPlugins {
+			t.Errorf("findCNIConf(%s) = %+v, want %s, %s, %s", tt.name, conf, tt.wantPath, tt.wantVersion, tt.wantPlugins)
+		}
+	}
+
+	if _, err := findCNIConf(filepath.Join(dir, "missing"), "fc-net"); err == nil {
+		t.Error("findCNIConf() of a missing directory succeeded")
+	}
+}
+
+func TestCheckCNI(t *testing.T) {
+	confDir := t.TempDir()
+	pluginDir := t.TempDir()
+	mkfile(t, filepath.Join(confDir, "10-fc.conflist"), `{"name": "fc-net", "cniVersion": "1.0.0", "plugins": [{"type": "ptp"}, {"type": "old"}, {"type": "broken"}, {"type": "missing"}]}`, 0)
+	writeScript(t, pluginDir, "ptp", `[ "$CNI_COMMAND" = VERSION ] && echo '{"cniVersion": "1.0.0", "supportedVersions": ["0.4.0", "1.0.0"]}'`)
+	writeScript(t, pluginDir, "old", `echo '{"cniVersion": "0.4.0", "supportedVersions": ["0.3.1", "0.4.0"]}'`)
+	writeScript(t, pluginDir, "broken", `echo 'not json'`)
+
+	cfg := config.NetworkConfig{CNIConfDir: confDir, CNIPluginDir: pluginDir, DefaultNetworkName: "fc-net"}
+	report := DoctorReport{Healthy: true}
+	checkCNI(context.Background(), &report, cfg)
+
+	if status, _ := checkStatus(t, report, "cni_config"); status != doctorOK {
+		t.Errorf("cni_config = %s, want ok", status)
+	}
+	status, detail := checkStatus(t, report, "cni_plugins")
+	if status != doctorFail {
+		t.Errorf("cni_plugins = %s, want fail", status)
+	}
+	for _, want := range []string{"old does not support cniVersion 1.0.0", "broken: invalid VERSION response", "missing not installed"} {
+		if !strings.Contains(detail, want) {
+			t.Errorf("cni_plugins detail %q does not mention %q", detail, want)
+		}
+	}
+	if strings.Contains(detail, "ptp") {
+		t.Errorf("cni_plugins detail %q reports the working plugin", detail)
+	}
+
+	// Without a config, the plugins are not checked
+	report = DoctorReport{Healthy: true}
+	cfg.DefaultNetworkName = "other"
+	checkCNI(context.Background(), &report, cfg)
+	if status, _ := checkStatus(t, report, "cni_config"); status != doctorFail {
+		t.Errorf("cni_config without a config = %s, want fail", status)
+	}
+	if status, _ := checkStatus(t, report, "cni_plugins"); status != doctorSkip {
+		t.Errorf("cni_plugins without a config = %s, want skip", status)
+	}
+}
+
+func TestBinaryVersion(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		output  string
+		want    [3]int
+		wantErr bool
+	}{
+		{"Firecracker v1.5.0\n\nSupported snapshot data format versions: v1.0.0", [3]int{1, 5, 0}, false},
+		{"Jailer v1.10.1", [3]int{1, 10, 1}, false},
+		{"firecracker 1.5", [3]int{}, true},
+	}
+	for i, tt := range tests {
+		bin := writeScript(t, dir, "bin"+string(rune('a'+i)), "echo '"+tt.output+"'")
+		got, err := binaryVersion(context.Background(), bin)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("binaryVersion(%q) = %v, %v, want %v", tt.output, got, err, tt.want)
+		}
+	}
+	if _, err := binaryVersion(context.Background(), filepath.Join(dir, "missing")); err == nil {
+		t.Error("binaryVersion() of a missing binary succeeded")
+	}
+}
+
+func TestCheckVMMVersions(t *testing.T) {
+	dir := t.TempDir()
+	current := writeScript(t, dir, "firecracker", "echo 'Firecracker v1.7.0'")
+	old := writeScript(t, dir, "firecracker-old", "echo 'Firecracker v1.2.0'")
+	jailer := writeScript(t, dir, "jailer", "echo 'Jailer v1.7.0'")
+	otherJailer := writeScript(t, dir, "jailer-other", "echo 'Jailer v1.6.0'")
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name          string
+		cfg           config.RuntimeConfig
+		wantFC        string
+		wantJailer    string
+		wantUnhealthy bool
+	}{
+		{"matching release", config.RuntimeConfig{FirecrackerBinary: current, JailerBinary: jailer, EnableJailer: true}, doctorOK, doctorOK, false},
+		{"too old", config.RuntimeConfig{FirecrackerBinary: old, JailerBinary: missing}, doctorFail, doctorSkip, true},
+		{"no firecracker", config.RuntimeConfig{FirecrackerBinary: missing, JailerBinary: jailer, EnableJailer: true}, doctorFail, doctorSkip, true},
+		{"jailer from another release", config.RuntimeConfig{FirecrackerBinary: current, JailerBinary: otherJailer, EnableJailer: true}, doctorOK, doctorFail, true},
+		// A mismatched jailer that isn't used is only a warning
+		{"unused jailer from another release", config.RuntimeConfig{FirecrackerBinary: current, JailerBinary: otherJailer}, doctorOK, doctorWarn, false},
+		{"jailer missing", config.RuntimeConfig{FirecrackerBinary: current, JailerBinary: missing, EnableJailer: true}, doctorOK, doctorFail, true},
+		{"jailer disabled", config.RuntimeConfig{FirecrackerBinary: current, JailerBinary: missing}, doctorOK, doctorSkip, false},
+	}
+	for _, tt := range tests {
+		report := DoctorReport{Healthy: true}
+		checkVMMVersions(context.Background(), &report, tt.cfg)
+		fc, _ := checkStatus(t, report, "firecracker")
+		jailer, _ := checkStatus(t, report, "jailer")
+		if fc != tt.wantFC || jailer != tt.wantJailer || report.Healthy == tt.wantUnhealthy {
+			t.Errorf("%s: firecracker %s, jailer %s, healthy %v, want %s, %s, %v",
+				tt.name, fc, jailer, report.Healthy, tt.wantFC, tt.wantJailer, !tt.wantUnhealthy)
+		}
+	}
+}
+
+func TestCmdDoctor_Flags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--config"}, "--config requires a value"},
+		{[]string{"--fix"}, "unknown doctor flag"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir()}
+		err := cli.cmdDoctor(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdDoctor(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
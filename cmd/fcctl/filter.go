@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output selection for list and inspect. --filter keeps the sandboxes
+// whose fields match every expression; --jsonpath prints fields of the
+// JSON output with a kubectl-style template instead of the table.
+//
+// Both work on the document -o json prints, decoded generically, so any
+// field of it can be used, e.g. state=dead, memory_mb>512, network.ip=10.0.0.5
+// or {range [*]}{.id}{"\t"}{.state}{"\n"}{end}.
+
+// selection holds the --filter and --jsonpath options of a command.
+type selection struct {
+	filters  []filterExpr
+	jsonpath string
+}
+
+// parseSelection takes --filter and --jsonpath off args, returning the
+// remaining arguments.
+func parseSelection(args []string) (*selection, []string, error) {
+	sel := &selection{}
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != "--filter" && name != "--jsonpath" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if name == "--jsonpath" {
+			sel.jsonpath = value
+			continue
+		}
+		filters, err := parseFilters(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		sel.filters = append(sel.filters, filters...)
+	}
+	return sel, rest, nil
+}
+
+// parseFilters parses a comma-separated list of filter expressions.
+func parseFilters(value string) ([]filterExpr, error) {
+	var filters []filterExpr
+	for _, expr := range strings.Split(value, ",") {
+		f, err := parseFilter(strings.TrimSpace(expr))
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// match reports whether v, as its JSON document, matches every filter.
+func (sel *selection) match(v interface{}) (bool, error) {
+	if len(sel.filters) == 0 {
+		return true, nil
+	}
+	doc, err := toDocument(v)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range sel.filters {
+		ok, err := f.match(doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// print writes v through the --jsonpath template, reporting whether there
+// was one.
+func (sel *selection) print(w io.Writer, v interface{}) (bool, error) {
+	if sel.jsonpath == "" {
+		return false, nil
+	}
+	doc, err := toDocument(v)
+	if err != nil {
+		return true, err
+	}
+	out, err := evalJSONPath(sel.jsonpath, doc)
+	if err != nil {
+		return true, fmt.Errorf("invalid --jsonpath: %w", err)
+	}
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	_, err = io.WriteString(w, out)
+	return true, err
+}
+
+// toDocument returns v as -o json prints it, decoded into maps, slices and
+// scalars.
+func toDocument(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+// =============================================================================
+// Filters
+// =============================================================================
+
+// filterExpr is a comparison of a field with a value, e.g. memory_mb>512.
+type filterExpr struct {
+	field []string
+	op    string
+	value string
+}
+
+// filterOps are the comparison operators, longest first so ">=" isn't
+// read as ">".
+var filterOps = []string{"!=", ">=", "<=", "==", "=", ">", "<", "~"}
+
+func parseFilter(expr string) (filterExpr, error) {
+	for _, op := range filterOps {
+		field, value, ok := strings.Cut(expr, op)
+		if !ok || field == "" {
+			continue
+		}
+		if op == "==" {
+			op = "="
+		}
+		// label=app=web compares the pod label app, whose name may have dots
+		if field = strings.TrimSpace(field); field == "label" {
+			key, labelValue, ok := strings.Cut(value, "=")
+			if !ok || key == "" {
+				return filterExpr{}, fmt.Errorf("invalid filter %q (want label%skey=value)", expr, op)
+			}
+			return filterExpr{field: []string{"labels", strings.TrimSpace(key)}, op: op, value: strings.TrimSpace(labelValue)}, nil
+		}
+		return filterExpr{field: strings.Split(strings.TrimSpace(field), "."), op: op, value: strings.TrimSpace(value)}, nil
+	}
+	return filterExpr{}, fmt.Errorf("invalid filter %q (want field=value, !=, >, >=, <, <= or ~)", expr)
+}
+
+// match compares the filter's field of doc with its value: numerically if
+// both are numbers, as strings otherwise. ~ matches a substring. A missing
+// field only matches !=.
+func (f filterExpr) match(doc interface{}) (bool, error) {
+	v, ok := lookupField(doc, f.field)
+	if !ok {
+		return f.op == "!=", nil
+	}
+	actual := formatValue(v)
+
+	if f.op == "~" {
+		return strings.Contains(actual, f.value), nil
+	}
+	a, aErr := strconv.ParseFloat(actual, 64)
+	b, bErr := strconv.ParseFloat(f.value, 64)
+	if aErr == nil && bErr == nil {
+		switch f.op {
+		case "=":
+			return a == b, nil
+		case "!=":
+			return a != b, nil
+		case ">":
+			return a > b, nil
+		case ">=":
+			return a >= b, nil
+		case "<":
+			return a < b, nil
+		case "<=":
+			return a <= b, nil
+		}
+	}
+	switch f.op {
+	case "=":
+		return strings.EqualFold(actual, f.value), nil
+	case "!=":
+		return !strings.EqualFold(actual, f.value), nil
+	}
+	return false, fmt.Errorf("filter %s%s%s compares %q, which is not a number", strings.Join(f.field, "."), f.op, f.value, actual)
+}
+
+// lookupField follows a dotted field path through doc. A name matches a
+// key exactly, or failing that a single key it is the prefix of up to an
+// underscore, so memory finds memory_mb.
+func lookupField(doc interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok := obj[name]; ok {
+			doc = v
+			continue
+		}
+		var matches []string
+		for key := range obj {
+			if strings.HasPrefix(key, name+"_") {
+				matches = append(matches, key)
+			}
+		}
+		if len(matches) != 1 {
+			return nil, false
+		}
+		doc = obj[matches[0]]
+	}
+	return doc, true
+}
+
+// formatValue formats a JSON value for output: strings bare, objects and
+// arrays as JSON.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// =============================================================================
+// JSONPath
+// =============================================================================
+
+// evalJSONPath renders a kubectl-style JSONPath template: text with {}
+// expressions of fields (.a.b), indexes ([0], [*]), string literals
+// ("\n") and {range <path>}...{end} blocks. A template without braces is
+// one expression. The values an expression yields are joined by spaces.
+func evalJSONPath(template string, doc interface{}) (string, error) {
+	if !strings.Contains(template, "{") {
+		template = "{" + template + "}"
+	}
+	nodes, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	body, _, err := parseBlock(nodes, false)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := renderBlock(&out, body, doc); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// templateNode is literal text or the inside of a {} expression.
+type templateNode struct {
+	text string
+	expr bool
+}
+
+func parseTemplate(template string) ([]templateNode, error) {
+	var nodes []templateNode
+	for template != "" {
+		open := strings.Index(template, "{")
+		if open < 0 {
+			nodes = append(nodes, templateNode{text: template})
+			break
+		}
+		if open > 0 {
+			nodes = append(nodes, templateNode{text: template[:open]})
+		}
+		end := closingBrace(template, open)
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in %q", template)
+		}
+		nodes = append(nodes, templateNode{text: strings.TrimSpace(template[open+1 : end]), expr: true})
+		template = template[end+1:]
+	}
+	return nodes, nil
+}
+
+// closingBrace returns the index of the } closing the { at open, skipping
+// braces in string literals.
+func closingBrace(s string, open int) int {
+	quoted := false
+	for i := open + 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '}' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// templateBlock is a parsed template: text, expressions and ranges.
+type templateBlock []templateItem
+
+type templateItem struct {
+	node    templateNode
+	isRange bool
+	over    string        // Path a range iterates over
+	body    templateBlock // Body of a range
+}
+
+// parseBlock parses nodes up to the {end} of a range, if inRange, or to
+// the end of the template.
+func parseBlock(nodes []templateNode, inRange bool) (templateBlock, []templateNode, error) {
+	var block templateBlock
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+		switch {
+		case n.expr && n.text == "end":
+			if !inRange {
+				return nil, nil, fmt.Errorf("{end} without {range}")
+			}
+			return block, nodes, nil
+		case n.expr && strings.HasPrefix(n.text, "range "):
+			body, rest, err := parseBlock(nodes, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			block = append(block, templateItem{isRange: true, over: strings.TrimSpace(strings.TrimPrefix(n.text, "range ")), body: body})
+			nodes = rest
+		default:
+			block = append(block, templateItem{node: n})
+		}
+	}
+	if inRange {
+		return nil, nil, fmt.Errorf("{range} without {end}")
+	}
+	return block, nil, nil
+}
+
+func renderBlock(out *strings.Builder, block templateBlock, doc interface{}) error {
+	for _, item := range block {
+		switch {
+		case item.isRange:
+			values, err := evalPath(item.over, doc)
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				if err := renderBlock(out, item.body, v); err != nil {
+					return err
+				}
+			}
+		case !item.node.expr:
+			out.WriteString(item.node.text)
+		case strings.HasPrefix(item.node.text, `"`):
+			s, err := strconv.Unquote(item.node.text)
+			if err != nil {
+				return fmt.Errorf("invalid string %s", item.node.text)
+			}
+			out.WriteString(s)
+		default:
+			values, err := evalPath(item.node.text, doc)
+			if err != nil {
+				return err
+			}
+			for i, v := range values {
+				if i > 0 {
+					out.WriteString(" ")
+				}
+				out.WriteString(formatValue(v))
+			}
+		}
+	}
+	return nil
+}
+
+// evalPath returns the values a path of fields and indexes selects, e.g.
+// .network.ips[0] or [*].id. "." or "@" is the document itself; missing
+// fields select nothing.
+func evalPath(path string, doc interface{}) ([]interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), "@")
+	values := []interface{}{doc}
+	for path != "" && path != "." {
+		var next []interface{}
+		switch path[0] {
+		case '.':
+			end := strings.IndexAny(path[1:], ".[")
+			if end < 0 {
+				end = len(path) - 1
+			}
+			name := path[1 : end+1]
+			path = path[end+1:]
+			if name == "" {
+				return nil, fmt.Errorf("empty field name")
+			}
+			for _, v := range values {
+				if obj, ok := v.(map[string]interface{}); ok {
+					if field, ok := obj[name]; ok {
+						next = append(next, field)
+					}
+				}
+			}
+		case '[':
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %q", path)
+			}
+			index := path[1:end]
+			path = path[end+1:]
+			for _, v := range values {
+				selected, err := selectIndex(v, index)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, selected...)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q in path", path)
+		}
+		values = next
+	}
+	return values, nil
+}
+
+// selectIndex applies [*], [n] or [-n] to an array, or [*] to an object's
+// values in key order.
+func selectIndex(v interface{}, index string) ([]interface{}, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		if index == "*" {
+			return v, nil
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index [%s]", index)
+		}
+		if i < 0 {
+			i += len(v)
+		}
+		if i < 0 || i >= len(v) {
+			return nil, nil
+		}
+		return []interface{}{v[i]}, nil
+	case map[string]interface{}:
+		if index != "*" {
+			return nil, fmt.Errorf("index [%s] of an object", index)
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			values = append(values, v[key])
+		}
+		return values, nil
+	}
+	return nil, nil
+}
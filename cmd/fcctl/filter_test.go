@@ -0,0 +1,239 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    filterExpr
+		wantErr string
+	}{
+		{"state=dead", filterExpr{field: []string{"state"}, op: "=", value: "dead"}, ""},
+		{"state==dead", filterExpr{field: []string{"state"}, op: "=", value: "dead"}, ""},
+		{"state != dead", filterExpr{field: []string{"state"}, op: "!=", value: "dead"}, ""},
+		// The longest operator wins
+		{"memory_mb>=512", filterExpr{field: []string{"memory_mb"}, op: ">=", value: "512"}, ""},
+		{"memory_mb<=512", filterExpr{field: []string{"memory_mb"}, op: "<=", value: "512"}, ""},
+		{"memory_mb>512", filterExpr{field: []string{"memory_mb"}, op: ">", value: "512"}, ""},
+		{"vcpus<2", filterExpr{field: []string{"vcpus"}, op: "<", value: "2"}, ""},
+		{"id~web", filterExpr{field: []string{"id"}, op: "~", value: "web"}, ""},
+		{"network.ip=10.0.0.5", filterExpr{field: []string{"network", "ip"}, op: "=", value: "10.0.0.5"}, ""},
+		{"state=", filterExpr{field: []string{"state"}, op: "=", value: ""}, ""},
+		// Label names keep their dots
+		{"label=app.kubernetes.io/name=web", filterExpr{field: []string{"labels", "app.kubernetes.io/name"}, op: "=", value: "web"}, ""},
+		{"label!=tier=db", filterExpr{field: []string{"labels", "tier"}, op: "!=", value: "db"}, ""},
+		{"label=app", filterExpr{}, "want label=key=value"},
+		{"label==web", filterExpr{}, "want label=key=value"},
+		{"state", filterExpr{}, "invalid filter"},
+		{"=dead", filterExpr{}, "invalid filter"},
+		{"", filterExpr{}, "invalid filter"},
+	}
+	for _, tt := range tests {
+		got, err := parseFilter(tt.expr)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseFilter(%q) error = %v, want %q", tt.expr, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFilter(%q) = %+v, %v, want %+v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	doc, err := toDocument(map[string]interface{}{
+		"id":        "fc-web-1",
+		"state":     "running",
+		"memory_mb": 512,
+		"vcpus":     2,
+		"network":   map[string]interface{}{"ip": "10.0.0.5"},
+		"labels":    map[string]string{"app.kubernetes.io/name": "web"},
+		"from_pool": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{"state=running", true, false},
+		{"state=RUNNING", true, false},
+		{"state!=dead", true, false},
+		{"state=dead", false, false},
+		{"id~web", true, false},
+		{"id~db", false, false},
+		// Numbers compare numerically
+		{"memory_mb>256", true, false},
+		{"memory_mb>=512", true, false},
+		{"memory_mb<512", false, false},
+		{"vcpus=2.0", true, false},
+		{"vcpus<=1", false, false},
+		// A field name finds the one key it is the prefix of
+		{"memory>256", true, false},
+		{"network.ip=10.0.0.5", true, false},
+		{"from_pool=true", true, false},
+		{"label=app.kubernetes.io/name=web", true, false},
+		// A missing field only matches !=
+		{"missing=x", false, false},
+		{"missing!=x", true, false},
+		{"network.ip.v4=x", false, false},
+		{"state>1", false, true},
+		{"memory_mb>lots", false, true},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("parseFilter(%q) error = %v", tt.expr, err)
+		}
+		got, err := f.match(doc)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: match() = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestLookupField_Ambiguous(t *testing.T) {
+	doc := map[string]interface{}{"memory_mb": 1.0, "memory_limit": 2.0}
+	if v, ok := lookupField(doc, []string{"memory"}); ok {
+		t.Errorf("lookupField(memory) = %v, want no match between memory_mb and memory_limit", v)
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	sel, rest, err := parseSelection([]string{"--filter", "state=running", "-a", "--filter=memory>1, vcpus=2", "--jsonpath={.id}", "fc-1"})
+	if err != nil {
+		t.Fatalf("parseSelection() error = %v", err)
+	}
+	if len(sel.filters) != 3 || sel.filters[2].value != "2" || sel.jsonpath != "{.id}" {
+		t.Errorf("parseSelection() = %+v", sel)
+	}
+	if !reflect.DeepEqual(rest, []string{"-a", "fc-1"}) {
+		t.Errorf("parseSelection() rest = %q, want [-a fc-1]", rest)
+	}
+
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--filter"}, "--filter requires a value"},
+		{[]string{"--jsonpath"}, "--jsonpath requires a value"},
+		{[]string{"--filter", "state"}, `invalid filter "state"`},
+		{[]string{"--filter=state=running,"}, `invalid filter ""`},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseSelection(tt.args); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseSelection(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSelectionMatch(t *testing.T) {
+	type sandbox struct {
+		ID       string `json:"id"`
+		State    string `json:"state"`
+		MemoryMB int    `json:"memory_mb"`
+	}
+	sel, _, err := parseSelection([]string{"--filter", "state=running,memory_mb>256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sandbox sandbox
+		want    bool
+	}{
+		{sandbox{"fc-1", "running", 512}, true},
+		{sandbox{"fc-2", "running", 128}, false},
+		{sandbox{"fc-3", "dead", 512}, false},
+	}
+	for _, tt := range tests {
+		if got, err := sel.match(tt.sandbox); err != nil || got != tt.want {
+			t.Errorf("match(%+v) = %v, %v, want %v", tt.sandbox, got, err, tt.want)
+		}
+	}
+
+	// Without filters everything matches
+	if got, err := (&selection{}).match(sandbox{}); !got || err != nil {
+		t.Errorf("match() without filters = %v, %v", got, err)
+	}
+}
+
+func TestEvalJSONPath(t *testing.T) {
+	doc, err := toDocument([]map[string]interface{}{
+		{"id": "fc-1", "state": "running", "ips": []string{"10.0.0.5", "fd00::5"}},
+		{"id": "fc-2", "state": "dead", "ips": []string{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		template string
+		want     string
+		wantErr  string
+	}{
+		{`{range [*]}{.id}{"\t"}{.state}{"\n"}{end}`, "fc-1\trunning\nfc-2\tdead\n", ""},
+		// A template without braces is one expression
+		{"[*].id", "fc-1 fc-2", ""},
+		{"ids: {[*].id}", "ids: fc-1 fc-2", ""},
+		{"{$[1].id}", "fc-2", ""},
+		{"{@[0].ips[-1]}", "fd00::5", ""},
+		{"{[0].ips[0]}", "10.0.0.5", ""},
+		{"{[5].id}", "", ""},
+		{"{[*].missing}", "", ""},
+		{"{[*].ips}", `["10.0.0.5","fd00::5"] []`, ""},
+		// An object's values in key order
+		{"{[1][*]}", "fc-2 [] dead", ""},
+		{`{range [*]}{range .ips[*]}{@}{","}{end}{end}`, "10.0.0.5,fd00::5,", ""},
+		{`{"}"}`, "}", ""},
+		{`{[0].id`, "", "unclosed {"},
+		{`{[0].id}{end}`, "", "{end} without {range}"},
+		{`{range [*]}{.id}`, "", "{range} without {end}"},
+		{`{[x]}`, "", "invalid index [x]"},
+		{`{[0}`, "", "unclosed ["},
+		{`{..id}`, "", "empty field name"},
+		{`{id}`, "", "unexpected"},
+		{`{[0][0]}`, "", "index [0] of an object"},
+		{`{"\q"}`, "", "invalid string"},
+	}
+	for _, tt := range tests {
+		got, err := evalJSONPath(tt.template, doc)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("evalJSONPath(%q) error = %v, want %q", tt.template, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("evalJSONPath(%q) = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+func TestSelectionPrint(t *testing.T) {
+	v := map[string]string{"id": "fc-1"}
+	var out strings.Builder
+
+	if printed, err := (&selection{}).print(&out, v); printed || err != nil || out.Len() != 0 {
+		t.Errorf("print() without --jsonpath = %v, %v, wrote %q", printed, err, out.String())
+	}
+
+	// Output always ends in a newline
+	if printed, err := (&selection{jsonpath: "{.id}"}).print(&out, v); !printed || err != nil || out.String() != "fc-1\n" {
+		t.Errorf("print() = %v, %v, wrote %q, want fc-1", printed, err, out.String())
+	}
+
+	printed, err := (&selection{jsonpath: "{.id"}).print(&out, v)
+	if !printed || err == nil || !strings.Contains(err.Error(), "invalid --jsonpath") {
+		t.Errorf("print() of a malformed template = %v, %v", printed, err)
+	}
+}
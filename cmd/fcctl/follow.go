@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// followPollInterval is how often a followed file is read when its
+	// directory can't be watched with inotify.
+	followPollInterval = 100 * time.Millisecond
+
+	// followRecheckInterval is how often a watched file is read anyway, for
+	// writes inotify doesn't see, such as ones on network filesystems.
+	followRecheckInterval = 2 * time.Second
+)
+
+// followFile calls emit with the lines of the file at path and, with
+// follow, with the lines appended to it afterwards until ctx is done. The
+// first call comes even if the file is empty, later ones only with lines.
+//
+// Following is by name, like tail -F: inotify on the file's directory says
+// when to read. A file truncated in place is read again from its start, and
+// one rotated away, renamed or removed and created again, is read to its
+// end before the new file at path is followed from its start.
+func followFile(ctx context.Context, path string, follow bool, emit func([]string)) error {
+	t, err := openFileTail(path)
+	if err != nil {
+		return fmt.Errorf("failed to read log file: %w", err)
+	}
+	defer func() { t.file.Close() }()
+
+	emit(t.read(!follow))
+	if !follow {
+		return nil
+	}
+
+	changed := make(chan struct{}, 1)
+	interval := followRecheckInterval
+	mask := uint32(unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO)
+	if stop, err := watchPath(filepath.Dir(path), mask, changed); err == nil {
+		defer stop()
+	} else {
+		interval = followPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-ticker.C:
+		}
+		lines := t.read(false)
+		lines = append(lines, t.sync()...)
+		if len(lines) > 0 {
+			emit(lines)
+		}
+	}
+}
+
+// fileTail reads the lines appended to a file.
+type fileTail struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64  // Bytes read from file
+	partial string // The start of a line still being written
+}
+
+// openFileTail opens the file at path to be read from its start.
+func openFileTail(path string) (*fileTail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTail{path: path, file: file, reader: bufio.NewReader(file)}, nil
+}
+
+// read returns the lines written since the last read. A trailing line
+// without a newline is kept for the next read, unless flush is set.
+func (t *fileTail) read(flush bool) []string {
+	var lines []string
+	for {
+		data, err := t.reader.ReadString('\n')
+		t.offset += int64(len(data))
+		if err != nil {
+			t.partial += data
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", t.path, err)
+			}
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(t.partial+data, "\n"))
+		t.partial = ""
+	}
+	if flush && t.partial != "" {
+		lines = append(lines, t.partial)
+		t.partial = ""
+	}
+	return lines
+}
+
+// sync starts over if the file was truncated, and moves to the file now
+// at the path if it was rotated, returning the last lines of the old one.
+// A file that was removed and not yet replaced is kept.
+func (t *fileTail) sync() []string {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return nil
+	}
+	current, err := t.file.Stat()
+	if err == nil && os.SameFile(info, current) {
+		if current.Size() < t.offset {
+			fmt.Fprintf(os.Stderr, "%s: file truncated\n", t.path)
+			t.restart(t.file)
+		}
+		return nil
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		return nil
+	}
+	// The writer may still have been writing to the old file
+	lines := t.read(true)
+	fmt.Fprintf(os.Stderr, "%s has been replaced; following the new file\n", t.path)
+	t.file.Close()
+	t.restart(file)
+	return append(lines, t.read(false)...)
+}
+
+// restart reads file from its start.
+func (t *fileTail) restart(file *os.File) {
+	_, _ = file.Seek(0, io.SeekStart)
+	t.file = file
+	t.reader.Reset(file)
+	t.offset = 0
+	t.partial = ""
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// followLog follows the file at path until the test ends, returning a
+// channel of the lines it emits.
+func followLog(t *testing.T, path string) <-chan string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := make(chan string, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- followFile(ctx, path, true, func(texts []string) {
+			for _, text := range texts {
+				lines <- text
+			}
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("followFile() error = %v", err)
+		}
+	})
+	return lines
+}
+
+// expectLines waits for the next lines to be followed.
+func expectLines(t *testing.T, lines <-chan string, want ...string) {
+	t.Helper()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-timeout:
+			t.Fatalf("followed %q, want %q", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("followed %q, want %q", got, want)
+	}
+}
+
+// appendFile appends data to the file at path, creating it if needed.
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowFile_NoFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firecracker.log")
+	mkfile(t, path, "one\ntwo\nthree", 0)
+
+	var got [][]string
+	err := followFile(context.Background(), path, false, func(lines []string) {
+		got = append(got, lines)
+	})
+	// A last line without a newline is still shown
+	if err != nil || !reflect.DeepEqual(got, [][]string{{"one", "two", "three"}}) {
+		t.Errorf("followFile() = %q, %v", got, err)
+	}
+
+	if err := followFile(context.Background(), filepath.Join(t.TempDir(), "missing.log"), false, func([]string) {}); err == nil {
+		t.Error("followFile() of a missing file succeeded")
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firecracker.log")
+	mkfile(t, path, "one\n", 0)
+	lines := followLog(t, path)
+	expectLines(t, lines, "one")
+
+	// A line is emitted once it is complete
+	appendFile(t, path, "tw")
+	appendFile(t, path, "o\nthree\n")
+	expectLines(t, lines, "two", "three")
+
+	// Truncated in place, the file is read again from its start
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "four\n")
+	expectLines(t, lines, "four")
+
+	// Rotated, the old file is read to its end before the new one
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "five\n")
+	appendFile(t, path, "six\n")
+	expectLines(t, lines, "five", "six")
+
+	// Removed and created again, the new file is followed
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "seven\n")
+	expectLines(t, lines, "seven")
+
+	appendFile(t, path, "eight\n")
+	expectLines(t, lines, "eight")
+}
+
+func TestFollowFile_Empty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firecracker.log")
+	mkfile(t, path, "", 0)
+
+	// The first call comes even without lines
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := make(chan []string, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- followFile(ctx, path, true, func(lines []string) { calls <- lines })
+	}()
+	select {
+	case lines := <-calls:
+		if len(lines) != 0 {
+			t.Errorf("first call = %q, want no lines", lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("followFile() did not call emit for an empty file")
+	}
+
+	appendFile(t, path, strings.Repeat("x", 10)+"\n")
+	select {
+	case lines := <-calls:
+		if !reflect.DeepEqual(lines, []string{"xxxxxxxxxx"}) {
+			t.Errorf("second call = %q", lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("followFile() did not emit the appended line")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("followFile() error = %v", err)
+	}
+}
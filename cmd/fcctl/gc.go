@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// Where the runtime keeps the resources gc looks at. They match the
+// runtime's defaults.
+const (
+	defaultImageRootDir   = "/var/lib/fc-cri/images"
+	defaultSnapshotDir    = "/var/lib/fc-cri/snapshots"
+	defaultNetNSDir       = "/var/run/netns"
+	hostNetDevicesDir     = "/sys/class/net"
+	imageCacheIndex       = "cache.json"
+	goldenSnapshotName    = "golden-base"
+	defaultSnapshotMaxAge = 7 * 24 * time.Hour
+)
+
+// GCItem is a resource gc found no live sandbox using.
+type GCItem struct {
+	Kind   string `json:"kind"` // sandbox, volume, image, snapshot, netns, tap
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// GCReport is what gc found and, unless it was a dry run, removed.
+type GCReport struct {
+	DryRun         bool     `json:"dry_run"`
+	Items          []GCItem `json:"items"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	Skipped        []string `json:"skipped,omitempty"`
+}
+
+// gcOptions are the flags of the gc command.
+type gcOptions struct {
+	dryRun         bool
+	yes            bool
+	snapshotMaxAge time.Duration
+	kinds          map[string]bool
+}
+
+// cmdGC removes everything the runtime left behind for sandboxes that no
+// longer exist: sandbox directories, volume images, network namespaces and
+// MMDS taps, along with converted images no VM uses and expired snapshots.
+// cleanup only handles sandbox directories.
+func (cli *CLI) cmdGC(ctx context.Context, args []string) error {
+	opts := gcOptions{snapshotMaxAge: defaultSnapshotMaxAge}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--dry-run", "-n":
+			opts.dryRun = true
+		case "--yes", "-y":
+			opts.yes = true
+		case "--snapshot-max-age":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--snapshot-max-age requires a value")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid --snapshot-max-age %q", args[i])
+			}
+			opts.snapshotMaxAge = d
+		case "--only":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--only requires a value")
+			}
+			i++
+			opts.kinds = make(map[string]bool)
+			for _, kind := range strings.Split(args[i], ",") {
+				switch kind = strings.TrimSpace(kind); kind {
+				case "sandbox", "volume", "image", "snapshot", "netns", "tap":
+					opts.kinds[kind] = true
+				default:
+					return fmt.Errorf("unknown resource kind %q (use sandbox, volume, image, snapshot, netns or tap)", kind)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown gc flag: %s", args[i])
+		}
+	}
+	if cli.output == "json" && !opts.dryRun && !opts.yes {
+		return fmt.Errorf("-o json needs --dry-run or --yes, as gc cannot prompt")
+	}
+
+	report, err := cli.collectGarbage(opts)
+	if err != nil {
+		return err
+	}
+	report.DryRun = opts.dryRun
+
+	if cli.output != "json" {
+		cli.printGCReport(report)
+	}
+	if opts.dryRun || len(report.Items) == 0 {
+		if cli.output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(report)
+		}
+		return nil
+	}
+
+	if !opts.yes {
+		fmt.Print("\nRemove these resources? [y/N] ")
+		var response string
+		_, _ = fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Aborted")
+			return nil
+		}
+	}
+
+	report.ReclaimedBytes = 0
+	removed := 0
+	for i := range report.Items {
+		item := &report.Items[i]
+		if err := removeGCItem(item); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		removed++
+		report.ReclaimedBytes += item.Bytes
+	}
+
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	for _, item := range report.Items {
+		if item.Error != "" {
+			fmt.Printf("  Failed to remove %s %s: %s\n", item.Kind, item.Name, item.Error)
+		}
+	}
+	fmt.Printf("Removed %d of %d resource(s), %s reclaimed\n", removed, len(report.Items), formatBytes(float64(report.ReclaimedBytes)))
+	return nil
+}
+
+// collectGarbage finds the resources no live sandbox uses. Its report's
+// ReclaimedBytes is what removing them all would free.
+func (cli *CLI) collectGarbage(opts gcOptions) (*GCReport, error) {
+	sandboxes, err := cli.discoverSandboxes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover sandboxes: %w", err)
+	}
+
+	live := make(map[string]bool)
+	report := &GCReport{Items: []GCItem{}}
+	for _, sb := range sandboxes {
+		if sb.State != "dead" && sb.State != "unknown" {
+			live[sb.ID] = true
+			continue
+		}
+		if opts.wants("sandbox") {
+			path := filepath.Join(cli.runDir, sb.ID)
+			report.add(GCItem{Kind: "sandbox", Name: sb.ID, Path: path, Bytes: diskUsage(path), Reason: "VM " + sb.State})
+		}
+	}
+
+	if opts.wants("volume") {
+		cli.collectVolumes(report, live)
+	}
+	if opts.wants("image") {
+		cli.collectImages(report, sandboxes, live)
+	}
+	if opts.wants("snapshot") {
+		collectSnapshots(report, opts.snapshotMaxAge)
+	}
+	if opts.wants("netns") {
+		collectNetNS(report, live)
+	}
+	if opts.wants("tap") {
+		collectTaps(report, live)
+	}
+	return report, nil
+}
+
+func (o gcOptions) wants(kind string) bool {
+	return o.kinds == nil || o.kinds[kind]
+}
+
+func (r *GCReport) add(item GCItem) {
+	r.Items = append(r.Items, item)
+	r.ReclaimedBytes += item.Bytes
+}
+
+// collectVolumes finds the volume images of sandboxes that are gone.
+func (cli *CLI) collectVolumes(report *GCReport, live map[string]bool) {
+	dir := filepath.Join(cli.runDir, "volumes")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("volumes: %v", err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || live[entry.Name()] {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		report.add(GCItem{Kind: "volume", Name: entry.Name(), Path: path, Bytes: diskUsage(path), Reason: "sandbox gone"})
+	}
+}
+
+// collectImages finds converted images no running VM has attached, and
+// leftovers of interrupted conversions. Images are only collected when the
+// drives of every live VM could be read, so an image in use is never
+// removed.
+func (cli *CLI) collectImages(report *GCReport, sandboxes []SandboxInfo, live map[string]bool) {
+	dir := filepath.Join(getEnvOrDefault("FC_CRI_IMAGE_ROOT_DIR", defaultImageRootDir), "rootfs")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("images: %v", err))
+		}
+		return
+	}
+
+	inUse, err := cli.drivesInUse(sandboxes, live)
+	if err != nil {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("images: %v", err))
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case entry.IsDir() || name == imageCacheIndex:
+			continue
+		case strings.HasPrefix(name, "."):
+			// Partial transfers are renamed into place once complete
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > time.Hour {
+				report.add(GCItem{Kind: "image", Name: name, Path: path, Bytes: diskUsage(path), Reason: "interrupted conversion"})
+			}
+		case strings.HasSuffix(name, ".img") || strings.HasSuffix(name, ".squashfs"):
+			if inUse[path] || inUse[imageStem(name)] {
+				continue
+			}
+			// A fresh conversion may be about to be attached
+			if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < time.Hour {
+				continue
+			}
+			report.add(GCItem{Kind: "image", Name: name, Path: path, Bytes: diskUsage(path), Reason: "no VM uses it"})
+		}
+	}
+}
+
+// drivesInUse returns the drives attached to live VMs. Jailed VMs see
+// their drives at paths inside the jail, so drives are keyed by image name
+// as well as by path.
+func (cli *CLI) drivesInUse(sandboxes []SandboxInfo, live map[string]bool) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	for _, sb := range sandboxes {
+		if !live[sb.ID] {
+			continue
+		}
+		drives, err := getDrivePaths(filepath.Join(cli.runDir, sb.ID, "firecracker.sock"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read drives of %s: %w", sb.ID, err)
+		}
+		for _, path := range drives {
+			inUse[path] = true
+			inUse[imageStem(filepath.Base(path))] = true
+		}
+	}
+	return inUse, nil
+}
+
+// imageStem returns an image's name without its extension, which the rootfs
+// and squashfs of one image share.
+func imageStem(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".img"), ".squashfs")
+}
+
+// getDrivePaths reads the host paths of a VM's drives from its Firecracker
+// configuration.
+func getDrivePaths(socketPath string) ([]string, error) {
+	resp, err := firecrackerClient(socketPath).Get("http://localhost/vm/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /vm/config: %s", resp.Status)
+	}
+
+	var config struct {
+		Drives []struct {
+			PathOnHost string `json:"path_on_host"`
+		} `json:"drives"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(config.Drives))
+	for _, drive := range config.Drives {
+		paths = append(paths, drive.PathOnHost)
+	}
+	return paths, nil
+}
+
+// collectSnapshots finds snapshots older than maxAge, and snapshot
+// directories whose metadata was never written. The golden snapshot is
+// kept, as pools restore from it.
+func collectSnapshots(report *GCReport, maxAge time.Duration) {
+	dir := getEnvOrDefault("FC_CRI_SNAPSHOT_DIR", defaultSnapshotDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("snapshots: %v", err))
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == goldenSnapshotName {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		var snap struct {
+			CreatedAt time.Time `json:"created_at"`
+			IsGolden  bool      `json:"is_golden"`
+		}
+		data, err := os.ReadFile(filepath.Join(path, "metadata.json"))
+		if err == nil {
+			err = json.Unmarshal(data, &snap)
+		}
+		reason := ""
+		switch {
+		case err != nil:
+			// Snapshots being taken have no metadata yet
+			if info, statErr := entry.Info(); statErr == nil && time.Since(info.ModTime()) > time.Hour {
+				reason = "incomplete"
+			}
+		case snap.IsGolden:
+		case maxAge > 0 && time.Since(snap.CreatedAt) > maxAge:
+			reason = fmt.Sprintf("expired (%s old)", formatDuration(time.Since(snap.CreatedAt)))
+		}
+		if reason != "" {
+			report.add(GCItem{Kind: "snapshot", Name: entry.Name(), Path: path, Bytes: diskUsage(path), Reason: reason})
+		}
+	}
+}
+
+// collectNetNS finds the network namespaces of sandboxes that are gone.
+func collectNetNS(report *GCReport, live map[string]bool) {
+	entries, err := os.ReadDir(defaultNetNSDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("netns: %v", err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		// Namespaces are named fc-<sandbox-id>
+		id, ok := strings.CutPrefix(entry.Name(), "fc-")
+		if !ok || live[id] {
+			continue
+		}
+		report.add(GCItem{Kind: "netns", Name: entry.Name(), Path: filepath.Join(defaultNetNSDir, entry.Name()), Reason: "sandbox gone"})
+	}
+}
+
+// collectTaps finds the MMDS taps of sandboxes that are gone.
+func collectTaps(report *GCReport, live map[string]bool) {
+	entries, err := os.ReadDir(hostNetDevicesDir)
+	if err != nil {
+		report.Skipped = append(report.Skipped, fmt.Sprintf("taps: %v", err))
+		return
+	}
+
+	liveTaps := make(map[string]bool)
+	for id := range live {
+		liveTaps[vm.MMDSTapName(id)] = true
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), vm.MMDSTapPrefix) || liveTaps[entry.Name()] {
+			continue
+		}
+		report.add(GCItem{Kind: "tap", Name: entry.Name(), Reason: "sandbox gone"})
+	}
+}
+
+// removeGCItem removes a collected resource.
+func removeGCItem(item *GCItem) error {
+	switch item.Kind {
+	case "sandbox":
+		// The VM may still be hanging around without answering its API
+		var pid int
+		if data, err := os.ReadFile(filepath.Join(item.Path, "firecracker.pid")); err == nil {
+			_, _ = fmt.Sscanf(string(data), "%d", &pid)
+		}
+		if pid > 0 {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+		return os.RemoveAll(item.Path)
+	case "netns":
+		// Namespaces are bind mounts; a plain file means it was never set up
+		_ = syscall.Unmount(item.Path, syscall.MNT_DETACH)
+		return os.Remove(item.Path)
+	case "tap":
+		if output, err := exec.Command("ip", "link", "delete", item.Name).CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	default:
+		return os.RemoveAll(item.Path)
+	}
+}
+
+// diskUsage returns the disk space a file or directory takes up. Sparse
+// images only count their allocated blocks.
+func diskUsage(path string) int64 {
+	var total int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += stat.Blocks * 512
+		} else {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func (cli *CLI) printGCReport(report *GCReport) {
+	for _, skipped := range report.Skipped {
+		fmt.Printf("Skipped %s\n", skipped)
+	}
+	if len(report.Items) == 0 {
+		fmt.Println("No orphaned resources found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tSIZE\tREASON")
+	for _, item := range report.Items {
+		size := "-"
+		if item.Bytes > 0 {
+			size = formatBytes(float64(item.Bytes))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Kind, item.Name, size, item.Reason)
+	}
+	_ = w.Flush()
+
+	if report.DryRun {
+		fmt.Printf("\nDry run - %d resource(s), %s would be reclaimed\n", len(report.Items), formatBytes(float64(report.ReclaimedBytes)))
+	} else {
+		fmt.Printf("\n%d resource(s), %s reclaimable\n", len(report.Items), formatBytes(float64(report.ReclaimedBytes)))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mkfile creates a file with the given content, its directories, and a
+// modification time age ago.
+func mkfile(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// itemNames returns "kind/name" of each item in a report, sorted.
+func itemNames(report *GCReport) []string {
+	var names []string
+	for _, item := range report.Items {
+		names = append(names, item.Kind+"/"+item.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCollectGarbage(t *testing.T) {
+	runDir := t.TempDir()
+	imageDir := t.TempDir()
+	snapshotDir := t.TempDir()
+	t.Setenv("FC_CRI_IMAGE_ROOT_DIR", imageDir)
+	t.Setenv("FC_CRI_SNAPSHOT_DIR", snapshotDir)
+
+	// A sandbox without a VMM, and the volumes of sandboxes that are gone
+	mkfile(t, filepath.Join(runDir, "fc-dead", "config.json"), "{}", 0)
+	mkfile(t, filepath.Join(runDir, "volumes", "fc-gone", "data.img"), "data", 0)
+	mkfile(t, filepath.Join(runDir, "not-a-sandbox", "x"), "", 0)
+
+	rootfs := filepath.Join(imageDir, "rootfs")
+	mkfile(t, filepath.Join(rootfs, "old.img"), "old", 2*time.Hour)
+	mkfile(t, filepath.Join(rootfs, "old.squashfs"), "old", 2*time.Hour)
+	mkfile(t, filepath.Join(rootfs, "fresh.img"), "fresh", 0)
+	mkfile(t, filepath.Join(rootfs, ".partial.img"), "part", 2*time.Hour)
+	mkfile(t, filepath.Join(rootfs, ".converting.img"), "part", 0)
+	mkfile(t, filepath.Join(rootfs, imageCacheIndex), "{}", 2*time.Hour)
+	mkfile(t, filepath.Join(rootfs, "notes.txt"), "", 2*time.Hour)
+
+	mkfile(t, filepath.Join(snapshotDir, goldenSnapshotName, "metadata.json"), `{"created_at": "2020-01-01T00:00:00Z"}`, 0)
+	mkfile(t, filepath.Join(snapshotDir, "expired", "metadata.json"), `{"created_at": "2020-01-01T00:00:00Z"}`, 0)
+	mkfile(t, filepath.Join(snapshotDir, "golden-v2", "metadata.json"), `{"created_at": "2020-01-01T00:00:00Z", "is_golden": true}`, 0)
+	mkfile(t, filepath.Join(snapshotDir, "recent", "metadata.json"), `{"created_at": "`+time.Now().Format(time.RFC3339)+`"}`, 0)
+	mkfile(t, filepath.Join(snapshotDir, "taking", "mem"), "", 0)
+	mkfile(t, filepath.Join(snapshotDir, "abandoned", "mem"), "", 0)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(snapshotDir, "abandoned"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &CLI{runDir: runDir}
+	opts := gcOptions{
+		snapshotMaxAge: defaultSnapshotMaxAge,
+		kinds:          map[string]bool{"sandbox": true, "volume": true, "image": true, "snapshot": true},
+	}
+	report, err := cli.collectGarbage(opts)
+	if err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	got := strings.Join(itemNames(report), " ")
+	want := "image/.partial.img image/old.img image/old.squashfs sandbox/fc-dead snapshot/abandoned snapshot/expired volume/fc-gone"
+	if got != want {
+		t.Errorf("collectGarbage() items = %s, want %s", got, want)
+	}
+	if len(report.Skipped) != 0 {
+		t.Errorf("collectGarbage() skipped %q", report.Skipped)
+	}
+
+	var total int64
+	for _, item := range report.Items {
+		total += item.Bytes
+	}
+	if report.ReclaimedBytes != total {
+		t.Errorf("ReclaimedBytes = %d, want the sum of the items, %d", report.ReclaimedBytes, total)
+	}
+}
+
+func TestCollectGarbage_Only(t *testing.T) {
+	runDir := t.TempDir()
+	mkfile(t, filepath.Join(runDir, "fc-dead", "config.json"), "{}", 0)
+	mkfile(t, filepath.Join(runDir, "volumes", "fc-gone", "data.img"), "data", 0)
+
+	cli := &CLI{runDir: runDir}
+	report, err := cli.collectGarbage(gcOptions{kinds: map[string]bool{"volume": true}})
+	if err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if got := itemNames(report); len(got) != 1 || got[0] != "volume/fc-gone" {
+		t.Errorf("collectGarbage(--only volume) items = %q, want [volume/fc-gone]", got)
+	}
+}
+
+func TestCollectSnapshots_NoMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("FC_CRI_SNAPSHOT_DIR", dir)
+	mkfile(t, filepath.Join(dir, "ancient", "metadata.json"), `{"created_at": "2000-01-01T00:00:00Z"}`, 0)
+
+	report := &GCReport{}
+	collectSnapshots(report, 0)
+	if len(report.Items) != 0 {
+		t.Errorf("collectSnapshots() with no max age collected %q", itemNames(report))
+	}
+}
+
+func TestRemoveGCItem(t *testing.T) {
+	dir := t.TempDir()
+	mkfile(t, filepath.Join(dir, "fc-dead", "firecracker.pid"), "0", 0)
+	mkfile(t, filepath.Join(dir, "old.img"), "old", 0)
+
+	items := []GCItem{
+		{Kind: "sandbox", Name: "fc-dead", Path: filepath.Join(dir, "fc-dead")},
+		{Kind: "image", Name: "old.img", Path: filepath.Join(dir, "old.img")},
+	}
+	for i := range items {
+		if err := removeGCItem(&items[i]); err != nil {
+			t.Errorf("removeGCItem(%s) error = %v", items[i].Name, err)
+		}
+		if _, err := os.Stat(items[i].Path); !os.IsNotExist(err) {
+			t.Errorf("removeGCItem(%s) left %s", items[i].Name, items[i].Path)
+		}
+	}
+}
+
+func TestImageStem(t *testing.T) {
+	tests := map[string]string{
+		"abc123.img":      "abc123",
+		"abc123.squashfs": "abc123",
+		"abc123":          "abc123",
+		"abc.img.tmp":     "abc.img.tmp",
+	}
+	for name, want := range tests {
+		if got := imageStem(name); got != want {
+			t.Errorf("imageStem(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCmdGC_Flags(t *testing.T) {
+	tests := []struct {
+		output  string
+		args    []string
+		wantErr string
+	}{
+		{"table", []string{"--snapshot-max-age"}, "requires a value"},
+		{"table", []string{"--snapshot-max-age", "a week"}, "invalid --snapshot-max-age"},
+		{"table", []string{"--snapshot-max-age", "-1h"}, "invalid --snapshot-max-age"},
+		{"table", []string{"--only", "sandbox,disk"}, `unknown resource kind "disk"`},
+		{"table", []string{"--force"}, "unknown gc flag"},
+		{"json", nil, "needs --dry-run or --yes"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir(), output: tt.output}
+		err := cli.cmdGC(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdGC(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// zoneinfoDir is where timezone data is read from on this node.
+const zoneinfoDir = "/usr/share/zoneinfo"
+
+// cmdGuest changes settings inside a running sandbox's guest, or one of its
+// containers, without rebuilding its image.
+func (cli *CLI) cmdGuest(ctx context.Context, args []string) error {
+	usage := fmt.Errorf("usage: fcctl guest <sandbox-id> timezone <zone> | ca-bundle <pem-file> [--container <id>] | log-level <level>")
+
+	var container string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--container" {
+			if i+1 >= len(args) {
+				return fmt.Errorf("--container requires a value")
+			}
+			i++
+			container = args[i]
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	if len(rest) != 3 {
+		return usage
+	}
+	id, setting, value := rest[0], rest[1], rest[2]
+
+	var (
+		method string
+		params = map[string]interface{}{"id": container}
+	)
+	switch setting {
+	case "timezone", "tz":
+		if !filepath.IsLocal(value) {
+			return fmt.Errorf("invalid timezone %q", value)
+		}
+		tzdata, err := os.ReadFile(filepath.Join(zoneinfoDir, value))
+		if err != nil {
+			return fmt.Errorf("unknown timezone %q: %w", value, err)
+		}
+		method = "set_timezone"
+		params["timezone"] = value
+		params["tzdata"] = tzdata
+	case "ca-bundle":
+		bundle, err := os.ReadFile(value)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		method = "install_ca_bundle"
+		params["bundle"] = bundle
+	case "log-level":
+		if container != "" {
+			return fmt.Errorf("log-level applies to the guest agent, not a container")
+		}
+		method = "set_log_level"
+		params["level"] = value
+	default:
+		return usage
+	}
+
+	vsockPath := filepath.Join(cli.runDir, id, "vsock.sock")
+	if _, err := os.Stat(vsockPath); os.IsNotExist(err) {
+		return fmt.Errorf("vsock not found for sandbox %s", id)
+	}
+	if err := callAgent(vsockPath, method, params); err != nil {
+		return err
+	}
+
+	target := "guest"
+	if container != "" {
+		target = "container " + container
+	}
+	fmt.Printf("Updated %s of %s in sandbox %s\n", setting, target, id)
+	return nil
+}
+
+// callAgent sends one request to a sandbox's guest agent and waits for it
+// to succeed.
+func callAgent(vsockPath, method string, params map[string]interface{}) error {
+	conn, err := dialAgent(vsockPath, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"id":     1,
+		"method": method,
+		"params": params,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var resp struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("agent error: %s", resp.Error.Message)
+	}
+	return nil
+}
+
+// dialAgent connects to a sandbox's guest agent. If the sandbox's agent has
+// a key, stored next to the vsock socket by the runtime, the connection
+// authenticates with it, answering the agent's challenge with its HMAC.
+func dialAgent(vsockPath string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", vsockPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to agent: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(vsockPath), "agent.key"))
+	if os.IsNotExist(err) {
+		return conn, nil
+	}
+	if err == nil {
+		err = authenticateAgent(conn, strings.TrimSpace(string(data)))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate to agent: %w", err)
+	}
+	return conn, nil
+}
+
+// authenticateAgent runs the agent's authentication handshake on conn.
+func authenticateAgent(conn net.Conn, hexKey string) error {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return fmt.Errorf("invalid agent key: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	var resp struct {
+		Result struct {
+			Nonce string `json:"nonce"`
+		} `json:"result"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if err := encoder.Encode(map[string]interface{}{"id": 1, "method": "auth_challenge"}); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		// Agents that predate authentication don't know the method
+		if resp.Error.Code == -32601 {
+			return nil
+		}
+		return errors.New(resp.Error.Message)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("fc-agent-auth:" + resp.Result.Nonce))
+	req := map[string]interface{}{
+		"id":     2,
+		"method": "authenticate",
+		"params": map[string]string{"mac": hex.EncodeToString(mac.Sum(nil))},
+	}
+	if err := encoder.Encode(req); err != nil {
+		return err
+	}
+	resp.Error = nil
+	if err := decoder.Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return errors.New(resp.Error.Message)
+	}
+	return nil
+}
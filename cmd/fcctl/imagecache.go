@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// cachedImage mirrors the fields fcctl shows of image.ConvertedImage, an
+// entry of the converter's cache index.
+type cachedImage struct {
+	Reference    string    `json:"reference"`
+	Digest       string    `json:"digest"`
+	RootfsPath   string    `json:"rootfs_path"`
+	SquashfsPath string    `json:"squashfs_path,omitempty"`
+	SizeBytes    int64     `json:"size_bytes"`
+	Filesystem   string    `json:"filesystem"`
+	ConvertedAt  time.Time `json:"converted_at"`
+	Provenance   *struct {
+		Duration time.Duration `json:"duration"`
+	} `json:"provenance,omitempty"`
+
+	// DiskBytes is the space the images take up, not part of the index.
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+// imageCacheDir returns the directory of converted images and their index.
+func imageCacheDir() string {
+	return filepath.Join(getEnvOrDefault("FC_CRI_IMAGE_ROOT_DIR", defaultImageRootDir), "rootfs")
+}
+
+// readImageCache reads the converter's cache index, keyed by normalized
+// reference. Entries whose rootfs is gone are left out, as the converter
+// does.
+func readImageCache() (map[string]*cachedImage, error) {
+	data, err := os.ReadFile(filepath.Join(imageCacheDir(), imageCacheIndex))
+	if os.IsNotExist(err) {
+		return map[string]*cachedImage{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image cache: %w", err)
+	}
+
+	var cache map[string]*cachedImage
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("invalid image cache: %w", err)
+	}
+	for ref, img := range cache {
+		if img == nil {
+			delete(cache, ref)
+			continue
+		}
+		if _, err := os.Stat(img.RootfsPath); err != nil {
+			delete(cache, ref)
+			continue
+		}
+		img.DiskBytes = diskUsage(img.RootfsPath)
+		if img.SquashfsPath != "" {
+			img.DiskBytes += diskUsage(img.SquashfsPath)
+		}
+	}
+	return cache, nil
+}
+
+// removeCachedImages drops references from the cache index and deletes
+// their images, unless a reference left in the index shares them. It holds
+// the converter's cache lock so no shim rewrites the index meanwhile, and
+// returns the bytes freed.
+func removeCachedImages(refs []string) (int64, error) {
+	dir := imageCacheDir()
+	lockPath := filepath.Join(dir, ".locks", "cache.lock")
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return 0, err
+	}
+	lock, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, fmt.Errorf("failed to lock image cache: %w", err)
+	}
+
+	// Reread under the lock; shims may have added images since
+	cache, err := readImageCache()
+	if err != nil {
+		return 0, err
+	}
+	removed := make(map[string]*cachedImage)
+	for _, ref := range refs {
+		if img, ok := cache[ref]; ok {
+			removed[ref] = img
+			delete(cache, ref)
+		}
+	}
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	indexPath := filepath.Join(dir, imageCacheIndex)
+	if err := os.WriteFile(indexPath+".tmp", data, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write image cache: %w", err)
+	}
+	if err := os.Rename(indexPath+".tmp", indexPath); err != nil {
+		return 0, fmt.Errorf("failed to write image cache: %w", err)
+	}
+
+	shared := make(map[string]bool)
+	for _, img := range cache {
+		shared[img.RootfsPath] = true
+	}
+	var freed int64
+	for _, img := range removed {
+		if shared[img.RootfsPath] {
+			continue
+		}
+		shared[img.RootfsPath] = true // several removed refs may share it
+		_ = os.Remove(img.RootfsPath)
+		if img.SquashfsPath != "" {
+			_ = os.Remove(img.SquashfsPath)
+		}
+		freed += img.DiskBytes
+	}
+	return freed, nil
+}
+
+// normalizeImageRef mirrors the converter's normalization of references,
+// which keys the cache index.
+func normalizeImageRef(imageRef string) string {
+	if !strings.Contains(imageRef, ":") && !strings.Contains(imageRef, "@") {
+		imageRef += ":latest"
+	}
+	if !strings.Contains(imageRef, "/") {
+		imageRef = "library/" + imageRef
+	}
+	return imageRef
+}
+
+// liveDrives returns the drives attached to running VMs (see drivesInUse).
+func (cli *CLI) liveDrives() (map[string]bool, error) {
+	sandboxes, err := cli.discoverSandboxes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover sandboxes: %w", err)
+	}
+	live := make(map[string]bool)
+	for _, sb := range sandboxes {
+		if sb.State != "dead" && sb.State != "unknown" {
+			live[sb.ID] = true
+		}
+	}
+	return cli.drivesInUse(sandboxes, live)
+}
+
+// imageInUse reports whether a running VM has an image attached.
+func imageInUse(img *cachedImage, drives map[string]bool) bool {
+	return drives[img.RootfsPath] || drives[imageStem(filepath.Base(img.RootfsPath))]
+}
+
+func (cli *CLI) listImages() error {
+	cache, err := readImageCache()
+	if err != nil {
+		return err
+	}
+	images := make([]*cachedImage, 0, len(cache))
+	for _, img := range cache {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Reference < images[j].Reference
+	})
+
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(images)
+	}
+
+	if len(images) == 0 {
+		fmt.Println("No converted images")
+		return nil
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REFERENCE\tDIGEST\tFS\tSIZE\tON DISK\tCONVERTED\tTOOK")
+	for _, img := range images {
+		digest := img.Digest
+		if _, hash, ok := strings.Cut(digest, ":"); ok && len(hash) > 12 {
+			digest = hash[:12]
+		}
+		if digest == "" {
+			digest = "-"
+		}
+		took := "-"
+		if img.Provenance != nil && img.Provenance.Duration > 0 {
+			took = formatDuration(img.Provenance.Duration)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s ago\t%s\n",
+			img.Reference, digest, img.Filesystem,
+			formatBytes(float64(img.SizeBytes)), formatBytes(float64(img.DiskBytes)),
+			formatDuration(time.Since(img.ConvertedAt)), took)
+		total += img.DiskBytes
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d image(s), %s on disk\n", len(images), formatBytes(float64(total)))
+	return nil
+}
+
+// removeImage removes one image from the cache. Images attached to running
+// VMs are kept unless force is set; the VM keeps its open file either way.
+func (cli *CLI) removeImage(imageRef string, force bool) error {
+	ref := normalizeImageRef(imageRef)
+	cache, err := readImageCache()
+	if err != nil {
+		return err
+	}
+	img, ok := cache[ref]
+	if !ok {
+		return fmt.Errorf("image %s is not in the cache", ref)
+	}
+
+	if !force {
+		drives, err := cli.liveDrives()
+		if err != nil {
+			return fmt.Errorf("%w (use --force to remove anyway)", err)
+		}
+		if imageInUse(img, drives) {
+			return fmt.Errorf("image %s is used by a running VM (use --force to remove anyway)", ref)
+		}
+	}
+
+	freed, err := removeCachedImages([]string{ref})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s, %s reclaimed\n", ref, formatBytes(float64(freed)))
+	return nil
+}
+
+// pruneImages removes every cached image no running VM uses.
+func (cli *CLI) pruneImages(dryRun, yes bool) error {
+	if cli.output == "json" && !dryRun && !yes {
+		return fmt.Errorf("-o json needs --dry-run or --yes, as prune cannot prompt")
+	}
+
+	cache, err := readImageCache()
+	if err != nil {
+		return err
+	}
+	drives, err := cli.liveDrives()
+	if err != nil {
+		return err
+	}
+
+	var unused []*cachedImage
+	var refs []string
+	var total int64
+	for ref, img := range cache {
+		if !imageInUse(img, drives) {
+			unused = append(unused, img)
+			refs = append(refs, ref)
+			total += img.DiskBytes
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Reference < unused[j].Reference
+	})
+
+	if cli.output == "json" && dryRun {
+		return json.NewEncoder(os.Stdout).Encode(unused)
+	}
+	if cli.output != "json" {
+		if len(unused) == 0 {
+			fmt.Println("No unused images")
+			return nil
+		}
+		for _, img := range unused {
+			fmt.Printf("  %s (%s)\n", img.Reference, formatBytes(float64(img.DiskBytes)))
+		}
+		fmt.Printf("%d unused image(s), %s\n", len(unused), formatBytes(float64(total)))
+	}
+	if dryRun || len(unused) == 0 {
+		return nil
+	}
+
+	if !yes {
+		fmt.Print("\nRemove these images? [y/N] ")
+		var response string
+		_, _ = fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Aborted")
+			return nil
+		}
+	}
+
+	freed, err := removeCachedImages(refs)
+	if err != nil {
+		return err
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"removed":         unused,
+			"reclaimed_bytes": freed,
+		})
+	}
+	fmt.Printf("Removed %d image(s), %s reclaimed\n", len(unused), formatBytes(float64(freed)))
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeImageCache creates the given images in a temporary image root and
+// writes their cache index, keyed by normalized reference.
+func writeImageCache(t *testing.T, images map[string]*cachedImage) string {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("FC_CRI_IMAGE_ROOT_DIR", root)
+	dir := filepath.Join(root, "rootfs")
+	for _, img := range images {
+		if img == nil || img.RootfsPath == "" {
+			continue
+		}
+		img.RootfsPath = filepath.Join(dir, img.RootfsPath)
+		mkfile(t, img.RootfsPath, "rootfs", 0)
+		if img.SquashfsPath != "" {
+			img.SquashfsPath = filepath.Join(dir, img.SquashfsPath)
+			mkfile(t, img.SquashfsPath, "squashfs", 0)
+		}
+	}
+	data, err := json.Marshal(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkfile(t, filepath.Join(dir, imageCacheIndex), string(data), 0)
+	return dir
+}
+
+func TestReadImageCache(t *testing.T) {
+	dir := writeImageCache(t, map[string]*cachedImage{
+		"library/nginx:latest": {Reference: "library/nginx:latest", RootfsPath: "nginx.img", SquashfsPath: "nginx.squashfs"},
+		"library/redis:7":      {Reference: "library/redis:7", RootfsPath: "redis.img"},
+		"library/gone:1":       {Reference: "library/gone:1", RootfsPath: "gone.img"},
+		"library/null:1":       nil,
+	})
+	// The converter removed this rootfs without updating the index
+	if err := os.Remove(filepath.Join(dir, "gone.img")); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := readImageCache()
+	if err != nil {
+		t.Fatalf("readImageCache() error = %v", err)
+	}
+	if len(cache) != 2 || cache["library/nginx:latest"] == nil || cache["library/redis:7"] == nil {
+		t.Fatalf("readImageCache() = %v, want nginx and redis", cache)
+	}
+	// The squashfs of an image counts as well
+	nginx := cache["library/nginx:latest"]
+	if want := diskUsage(nginx.RootfsPath) + diskUsage(nginx.SquashfsPath); nginx.DiskBytes != want {
+		t.Errorf("DiskBytes of nginx = %d, want %d", nginx.DiskBytes, want)
+	}
+}
+
+func TestReadImageCache_Missing(t *testing.T) {
+	t.Setenv("FC_CRI_IMAGE_ROOT_DIR", t.TempDir())
+	cache, err := readImageCache()
+	if err != nil || len(cache) != 0 {
+		t.Errorf("readImageCache() without an index = %v, %v, want an empty cache", cache, err)
+	}
+}
+
+func TestReadImageCache_Invalid(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("FC_CRI_IMAGE_ROOT_DIR", root)
+	mkfile(t, filepath.Join(root, "rootfs", imageCacheIndex), "{", 0)
+	if _, err := readImageCache(); err == nil || !strings.Contains(err.Error(), "invalid image cache") {
+		t.Errorf("readImageCache() error = %v, want invalid image cache", err)
+	}
+}
+
+func TestRemoveCachedImages(t *testing.T) {
+	dir := writeImageCache(t, map[string]*cachedImage{
+		"library/nginx:latest": {Reference: "library/nginx:latest", RootfsPath: "nginx.img", SquashfsPath: "nginx.squashfs"},
+		"library/redis:7":      {Reference: "library/redis:7", RootfsPath: "redis.img"},
+		"library/redis:latest": {Reference: "library/redis:latest", RootfsPath: "redis.img"},
+	})
+
+	if _, err := removeCachedImages([]string{"library/nginx:latest", "library/redis:7", "library/missing:1"}); err != nil {
+		t.Fatalf("removeCachedImages() error = %v", err)
+	}
+
+	for name, wantExists := range map[string]bool{
+		"nginx.img":      false,
+		"nginx.squashfs": false,
+		// Still used by redis:latest
+		"redis.img": true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("%s exists = %v, want %v", name, exists, wantExists)
+		}
+	}
+
+	cache, err := readImageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for ref := range cache {
+		refs = append(refs, ref)
+	}
+	if !reflect.DeepEqual(refs, []string{"library/redis:latest"}) {
+		t.Errorf("index after removal = %q, want [library/redis:latest]", refs)
+	}
+}
+
+func TestRemoveCachedImages_SharedByRemoved(t *testing.T) {
+	dir := writeImageCache(t, map[string]*cachedImage{
+		"library/redis:7":      {Reference: "library/redis:7", RootfsPath: "redis.img"},
+		"library/redis:latest": {Reference: "library/redis:latest", RootfsPath: "redis.img"},
+	})
+
+	freed, err := removeCachedImages([]string{"library/redis:7", "library/redis:latest"})
+	if err != nil {
+		t.Fatalf("removeCachedImages() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "redis.img")); !os.IsNotExist(err) {
+		t.Error("removeCachedImages() kept an image no reference uses")
+	}
+	// The shared image is only counted once
+	if want := diskUsageOf(t, "rootfs"); freed != want {
+		t.Errorf("removeCachedImages() freed %d, want %d", freed, want)
+	}
+}
+
+// diskUsageOf returns the disk usage of a file with the given content.
+func diskUsageOf(t *testing.T, content string) int64 {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "f")
+	mkfile(t, path, content, 0)
+	return diskUsage(path)
+}
+
+func TestNormalizeImageRef(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                       "library/nginx:latest",
+		"nginx:1.25":                  "library/nginx:1.25",
+		"bitnami/redis":               "bitnami/redis:latest",
+		"ghcr.io/org/app:v1":          "ghcr.io/org/app:v1",
+		"alpine@sha256:0123456789abc": "library/alpine@sha256:0123456789abc",
+	}
+	for ref, want := range tests {
+		if got := normalizeImageRef(ref); got != want {
+			t.Errorf("normalizeImageRef(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
+
+func TestImageInUse(t *testing.T) {
+	img := &cachedImage{RootfsPath: "/var/lib/fc-cri/images/rootfs/abc.img"}
+	tests := []struct {
+		name   string
+		drives map[string]bool
+		want   bool
+	}{
+		{"attached by path", map[string]bool{"/var/lib/fc-cri/images/rootfs/abc.img": true}, true},
+		// Jailed VMs see their drives inside the jail
+		{"attached in a jail", map[string]bool{"abc": true}, true},
+		{"not attached", map[string]bool{"/var/lib/fc-cri/images/rootfs/def.img": true, "def": true}, false},
+		{"no VMs", nil, false},
+	}
+	for _, tt := range tests {
+		if got := imageInUse(img, tt.drives); got != tt.want {
+			t.Errorf("%s: imageInUse() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestImageArgs(t *testing.T) {
+	tests := []struct {
+		args      []string
+		wantRef   string
+		wantFlags map[string]bool
+		wantErr   bool
+	}{
+		{nil, "", map[string]bool{}, false},
+		{[]string{"nginx"}, "nginx", map[string]bool{}, false},
+		{[]string{"-f", "nginx"}, "nginx", map[string]bool{"--force": true}, false},
+		{[]string{"nginx", "--force"}, "nginx", map[string]bool{"--force": true}, false},
+		{[]string{"nginx", "redis"}, "", nil, true},
+		{[]string{"nginx", "--all"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		ref, flags, err := imageArgs(tt.args, "-f", "--force")
+		if (err != nil) != tt.wantErr || ref != tt.wantRef || !reflect.DeepEqual(flags, tt.wantFlags) {
+			t.Errorf("imageArgs(%q) = %q, %v, %v, want %q, %v", tt.args, ref, flags, err, tt.wantRef, tt.wantFlags)
+		}
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	dir := writeImageCache(t, map[string]*cachedImage{
+		"library/nginx:latest": {Reference: "library/nginx:latest", RootfsPath: "nginx.img"},
+	})
+	cli := &CLI{runDir: t.TempDir()}
+
+	if err := cli.removeImage("redis", false); err == nil || !strings.Contains(err.Error(), "library/redis:latest is not in the cache") {
+		t.Errorf("removeImage(redis) = %v, want not in the cache", err)
+	}
+	// No VM is running, so nothing uses it
+	if err := cli.removeImage("nginx", false); err != nil {
+		t.Fatalf("removeImage(nginx) error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nginx.img")); !os.IsNotExist(err) {
+		t.Error("removeImage() kept the rootfs")
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	dir := writeImageCache(t, map[string]*cachedImage{
+		"library/nginx:latest": {Reference: "library/nginx:latest", RootfsPath: "nginx.img"},
+		"library/redis:7":      {Reference: "library/redis:7", RootfsPath: "redis.img"},
+	})
+	cli := &CLI{runDir: t.TempDir(), output: "json"}
+
+	if err := cli.pruneImages(false, false); err == nil || !strings.Contains(err.Error(), "needs --dry-run or --yes") {
+		t.Errorf("pruneImages() in JSON without --yes = %v", err)
+	}
+
+	if err := cli.pruneImages(true, false); err != nil {
+		t.Fatalf("pruneImages(--dry-run) error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nginx.img")); err != nil {
+		t.Error("pruneImages(--dry-run) removed an image")
+	}
+
+	if err := cli.pruneImages(false, true); err != nil {
+		t.Fatalf("pruneImages(--yes) error = %v", err)
+	}
+	for _, name := range []string{"nginx.img", "redis.img"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("pruneImages(--yes) kept %s", name)
+		}
+	}
+}
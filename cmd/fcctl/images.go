@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// conversionProgress mirrors image.ConversionProgress, which fcctl doesn't
+// import to stay free of the runtime's dependencies.
+type conversionProgress struct {
+	Image          string    `json:"image"`
+	Phase          string    `json:"phase"`
+	BytesPulled    int64     `json:"bytes_pulled"`
+	LayersTotal    int       `json:"layers_total,omitempty"`
+	LayersUnpacked int       `json:"layers_unpacked"`
+	BytesCopied    int64     `json:"bytes_copied"`
+	BytesToCopy    int64     `json:"bytes_to_copy,omitempty"`
+	RootfsPath     string    `json:"rootfs_path,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// cmdImages manages the converted-image cache, and converts images through
+// the runtime's control socket.
+func (cli *CLI) cmdImages(ctx context.Context, args []string) error {
+	subCmd := "list"
+	if len(args) > 0 {
+		subCmd = args[0]
+		args = args[1:]
+	}
+
+	switch subCmd {
+	case "list", "ls":
+		if len(args) > 0 {
+			return fmt.Errorf("usage: fcctl images list")
+		}
+		return cli.listImages()
+	case "convert":
+		imageRef, flags, err := imageArgs(args, "-w", "--watch")
+		if err != nil || imageRef == "" {
+			return fmt.Errorf("usage: fcctl images convert <image> [--watch]")
+		}
+		return cli.convertImage(ctx, controlClient(cli.controlSocket()), imageRef, flags["--watch"])
+	case "progress":
+		imageRef, _, err := imageArgs(args)
+		if err != nil {
+			return fmt.Errorf("usage: fcctl images progress [<image>]")
+		}
+		client := controlClient(cli.controlSocket())
+		if imageRef != "" {
+			return cli.watchConversion(ctx, client, imageRef)
+		}
+		return cli.listConversions(ctx, client)
+	case "rm", "remove":
+		imageRef, flags, err := imageArgs(args, "-f", "--force")
+		if err != nil || imageRef == "" {
+			return fmt.Errorf("usage: fcctl images rm <image> [--force]")
+		}
+		return cli.removeImage(imageRef, flags["--force"])
+	case "prune":
+		imageRef, flags, err := imageArgs(args, "-n", "--dry-run", "-y", "--yes")
+		if err != nil || imageRef != "" {
+			return fmt.Errorf("usage: fcctl images prune [--dry-run] [--yes]")
+		}
+		return cli.pruneImages(flags["--dry-run"], flags["--yes"])
+	default:
+		return fmt.Errorf("unknown images subcommand: %s (use list, convert, progress, rm or prune)", subCmd)
+	}
+}
+
+// imageArgs splits the arguments of an images subcommand into an optional
+// image reference and flags, given as short and long pairs. Flags are
+// returned by their long name.
+func imageArgs(args []string, flagPairs ...string) (string, map[string]bool, error) {
+	long := make(map[string]string)
+	for i := 0; i+1 < len(flagPairs); i += 2 {
+		long[flagPairs[i]] = flagPairs[i+1]
+		long[flagPairs[i+1]] = flagPairs[i+1]
+	}
+
+	var imageRef string
+	flags := make(map[string]bool)
+	for _, arg := range args {
+		if name, ok := long[arg]; ok {
+			flags[name] = true
+			continue
+		}
+		if strings.HasPrefix(arg, "-") || imageRef != "" {
+			return "", nil, fmt.Errorf("unexpected argument: %s", arg)
+		}
+		imageRef = arg
+	}
+	return imageRef, flags, nil
+}
+
+// controlSocket returns the runtime's control socket.
+func (cli *CLI) controlSocket() string {
+	return getEnvOrDefault("FC_CRI_CONTROL_SOCKET", filepath.Join(cli.runDir, "control.sock"))
+}
+
+// controlClient returns an HTTP client talking to the control socket.
+func controlClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+func (cli *CLI) convertImage(ctx context.Context, client *http.Client, imageRef string, watch bool) error {
+	body, _ := json.Marshal(map[string]interface{}{"image": imageRef, "watch": watch})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://control/v1/images/convert", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := controlDo(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !watch {
+		fmt.Printf("Converting %s (follow with: fcctl images progress %s)\n", imageRef, imageRef)
+		return nil
+	}
+	return cli.printProgress(resp.Body)
+}
+
+func (cli *CLI) watchConversion(ctx context.Context, client *http.Client, imageRef string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://control/v1/images/conversions/watch?image="+url.QueryEscape(imageRef), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := controlDo(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return cli.printProgress(resp.Body)
+}
+
+func (cli *CLI) listConversions(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://control/v1/images/conversions", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := controlDo(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var conversions []conversionProgress
+	if err := json.NewDecoder(resp.Body).Decode(&conversions); err != nil {
+		return fmt.Errorf("invalid control response: %w", err)
+	}
+
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(conversions)
+	}
+
+	if len(conversions) == 0 {
+		fmt.Println("No conversions in progress")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tPHASE\tPROGRESS\tELAPSED")
+	for _, c := range conversions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Image, c.Phase, formatConversion(c),
+			formatDuration(time.Since(c.StartedAt)))
+	}
+	return w.Flush()
+}
+
+// printProgress prints the progress lines of a conversion until it ends,
+// returning its error if it failed.
+func (cli *CLI) printProgress(body io.Reader) error {
+	var last conversionProgress
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if cli.output == "json" {
+			fmt.Println(scanner.Text())
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return fmt.Errorf("invalid progress update: %w", err)
+		}
+		if cli.output != "json" {
+			fmt.Printf("%-8s %s\n", last.Phase, formatConversion(last))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	switch last.Phase {
+	case "done":
+		return nil
+	case "failed":
+		return fmt.Errorf("conversion of %s failed: %s", last.Image, last.Error)
+	default:
+		return fmt.Errorf("lost the conversion of %s in phase %s", last.Image, last.Phase)
+	}
+}
+
+// formatConversion describes how far a conversion's current phase got.
+func formatConversion(c conversionProgress) string {
+	switch c.Phase {
+	case "pull":
+		return formatBytes(float64(c.BytesPulled)) + " pulled"
+	case "unpack":
+		if c.LayersTotal > 0 {
+			return fmt.Sprintf("%d/%d layers", c.LayersUnpacked, c.LayersTotal)
+		}
+		return fmt.Sprintf("%d layers", c.LayersUnpacked)
+	case "stream":
+		if c.LayersTotal > 0 {
+			return fmt.Sprintf("%s pulled, %d/%d layers applied", formatBytes(float64(c.BytesPulled)), c.LayersUnpacked, c.LayersTotal)
+		}
+		return formatBytes(float64(c.BytesPulled)) + " pulled"
+	case "copy":
+		if c.BytesToCopy > 0 {
+			return fmt.Sprintf("%s/%s copied (%d%%)", formatBytes(float64(c.BytesCopied)),
+				formatBytes(float64(c.BytesToCopy)), c.BytesCopied*100/c.BytesToCopy)
+		}
+		return formatBytes(float64(c.BytesCopied)) + " copied"
+	case "done":
+		return c.RootfsPath
+	case "failed":
+		return c.Error
+	default:
+		return "-"
+	}
+}
+
+// controlDo sends a request to the control socket, turning error statuses
+// into errors.
+func controlDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the runtime control socket: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("control socket: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
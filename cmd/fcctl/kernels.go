@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/sirupsen/logrus"
+)
+
+// cmdKernels lists the kernels pods can select, and verifies or pre-fetches
+// them so the first pod using one doesn't pay for the download.
+func (cli *CLI) cmdKernels(ctx context.Context, args []string) error {
+	subCmd := "list"
+	if len(args) > 0 {
+		subCmd = args[0]
+	}
+
+	config := kernel.DefaultConfig()
+	config.Dir = getEnvOrDefault("FC_CRI_VM_KERNELS_DIR", config.Dir)
+	// Only pull may download missing artifacts
+	config.AllowDownload = subCmd == "pull"
+
+	log := logrus.NewEntry(logrus.StandardLogger())
+	if !cli.verbose {
+		log.Logger.SetLevel(logrus.WarnLevel)
+	}
+	store := kernel.NewStore(config, log)
+
+	switch subCmd {
+	case "list", "ls":
+		return cli.listKernels(store)
+	case "verify", "pull":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: fcctl kernels %s <name>", subCmd)
+		}
+		k, err := store.Resolve(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Kernel %s verified\n  kernel: %s\n", k.Name, k.KernelPath)
+		if k.InitrdPath != "" {
+			fmt.Printf("  initrd: %s\n", k.InitrdPath)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown kernels subcommand: %s (use list, verify or pull)", subCmd)
+	}
+}
+
+func (cli *CLI) listKernels(store *kernel.Store) error {
+	infos, err := store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list kernels: %w", err)
+	}
+
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(infos)
+	}
+
+	if len(infos) == 0 {
+		fmt.Println("No kernels found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tINITRD\tPRESENT\tDESCRIPTION")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", info.Name, yesNo(info.HasInitrd), yesNo(info.Present), info.Description)
+	}
+	return w.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	containers "github.com/containerd/containerd/api/services/containers/v1"
+	"github.com/containerd/containerd/namespaces"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// list sorts by --sort, shows the --columns chosen, and with --watch keeps
+// the list on screen, redrawn every --interval and whenever a sandbox
+// directory appears or goes away in the run dir.
+
+const (
+	defaultContainerdSocket = "/run/containerd/containerd.sock"
+	defaultListInterval     = 2 * time.Second
+
+	// Labels containerd's CRI plugin sets on a sandbox container for the
+	// pod it runs
+	labelPodName      = "io.kubernetes.pod.name"
+	labelPodNamespace = "io.kubernetes.pod.namespace"
+)
+
+// listOptions are the flags of the list command other than --filter and
+// --jsonpath.
+type listOptions struct {
+	sortBy   string
+	columns  []string
+	watch    bool
+	interval time.Duration
+}
+
+// listSortKeys order sandboxes for --sort. The default, created, lists the
+// newest first.
+var listSortKeys = map[string]func(a, b SandboxInfo) bool{
+	"created": func(a, b SandboxInfo) bool { return a.CreatedAt.After(b.CreatedAt) },
+	"uptime":  func(a, b SandboxInfo) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"memory":  func(a, b SandboxInfo) bool { return a.MemoryMB > b.MemoryMB },
+	"vcpus":   func(a, b SandboxInfo) bool { return a.VCPUs > b.VCPUs },
+	"id":      func(a, b SandboxInfo) bool { return a.ID < b.ID },
+	"state":   func(a, b SandboxInfo) bool { return a.State < b.State },
+}
+
+// listColumn is a column of the list table.
+type listColumn struct {
+	header string
+	value  func(SandboxInfo) string
+}
+
+var listColumns = map[string]listColumn{
+	"id":        {"ID", func(sb SandboxInfo) string { return sb.ID }},
+	"state":     {"STATE", func(sb SandboxInfo) string { return sb.State }},
+	"pid":       {"PID", func(sb SandboxInfo) string { return strconv.Itoa(sb.PID) }},
+	"vcpus":     {"VCPUs", func(sb SandboxInfo) string { return strconv.Itoa(sb.VCPUs) }},
+	"memory":    {"MEMORY", func(sb SandboxInfo) string { return strconv.Itoa(sb.MemoryMB) + "MB" }},
+	"ip":        {"IP", func(sb SandboxInfo) string { return sb.IP }},
+	"uptime":    {"UPTIME", func(sb SandboxInfo) string { return sb.Uptime }},
+	"socket":    {"SOCKET", func(sb SandboxInfo) string { return boolToStatus(sb.SocketOK) }},
+	"pod":       {"POD", func(sb SandboxInfo) string { return sb.Pod }},
+	"namespace": {"NAMESPACE", func(sb SandboxInfo) string { return sb.Namespace }},
+	"labels":    {"LABELS", formatLabels},
+}
+
+// Columns shown without --columns, for -o table and -o wide.
+var (
+	defaultListColumns = []string{"id", "state", "pid", "uptime", "socket"}
+	wideListColumns    = []string{"id", "state", "pid", "vcpus", "memory", "ip", "uptime", "socket"}
+)
+
+// parseListOptions parses the list flags left after --filter and
+// --jsonpath.
+func parseListOptions(args []string) (listOptions, error) {
+	opts := listOptions{sortBy: "created", interval: defaultListInterval}
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if name == "--watch" || name == "-w" {
+			opts.watch = true
+			continue
+		}
+		if name != "--sort" && name != "--columns" && name != "--interval" {
+			return opts, fmt.Errorf("unknown list flag: %s", args[i])
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "--sort":
+			if _, ok := listSortKeys[value]; !ok {
+				return opts, fmt.Errorf("invalid --sort: %s (must be created, uptime, memory, vcpus, id or state)", value)
+			}
+			opts.sortBy = value
+		case "--columns":
+			opts.columns = nil
+			for _, column := range strings.Split(value, ",") {
+				column = strings.TrimSpace(column)
+				if _, ok := listColumns[column]; !ok {
+					return opts, fmt.Errorf("unknown column %q (use id, state, pid, vcpus, memory, ip, uptime, socket, pod, namespace or labels)", column)
+				}
+				opts.columns = append(opts.columns, column)
+			}
+		case "--interval":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("invalid --interval %q", value)
+			}
+			opts.interval = d
+		}
+	}
+	return opts, nil
+}
+
+// printList prints the sandboxes matching sel, as the output format and
+// opts ask.
+func (cli *CLI) printList(ctx context.Context, sel *selection, opts listOptions) error {
+	all, err := cli.discoverSandboxes()
+	if err != nil {
+		return fmt.Errorf("failed to discover sandboxes: %w", err)
+	}
+	cli.addPodLabels(ctx, all)
+
+	sandboxes := []SandboxInfo{}
+	for _, sb := range all {
+		ok, err := sel.match(sb)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sandboxes = append(sandboxes, sb)
+		}
+	}
+	less := listSortKeys[opts.sortBy]
+	sort.SliceStable(sandboxes, func(i, j int) bool { return less(sandboxes[i], sandboxes[j]) })
+
+	if printed, err := sel.print(os.Stdout, sandboxes); printed {
+		return err
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(sandboxes)
+	}
+
+	if opts.watch {
+		// Clear screen and move cursor home
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("fcctl list - %s, refresh %s, sorted by %s\n\n", time.Now().Format("15:04:05"), opts.interval, opts.sortBy)
+	}
+	if len(sandboxes) == 0 {
+		fmt.Println("No sandboxes found")
+		return nil
+	}
+
+	columns := opts.columns
+	if columns == nil {
+		columns = defaultListColumns
+		if cli.output == "wide" {
+			columns = wideListColumns
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	headers := make([]string, len(columns))
+	for i, column := range columns {
+		headers[i] = listColumns[column].header
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, sb := range sandboxes {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = listColumns[column].value(sb)
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+	w.Flush()
+
+	fmt.Printf("\nTotal: %d sandbox(es)\n", len(sandboxes))
+	return nil
+}
+
+// watchList prints the list again every opts.interval, and as soon as a
+// sandbox directory is added to or removed from the run dir, until ctx is
+// done.
+func (cli *CLI) watchList(ctx context.Context, sel *selection, opts listOptions) error {
+	changed := make(chan struct{}, 1)
+	if stop, err := watchDir(cli.runDir, changed); err == nil {
+		defer stop()
+	} else if cli.verbose {
+		fmt.Fprintf(os.Stderr, "Not watching %s, refreshing every %s: %v\n", cli.runDir, opts.interval, err)
+	}
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	for {
+		if err := cli.printList(ctx, sel, opts); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-changed:
+			// A new sandbox's directory fills in over a moment
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// watchDir signals changed when entries are created in, removed from or
+// renamed in dir, until the returned function is called.
+func watchDir(dir string, changed chan<- struct{}) (func(), error) {
+	return watchPath(dir, unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO, changed)
+}
+
+// watchPath signals changed when inotify reports one of the events in mask
+// for path, until the returned function is called. Events are coalesced:
+// changed gets one signal for however many arrive before it is read.
+func watchPath(path string, mask uint32, changed chan<- struct{}) (func(), error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, path, mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Non-blocking, so closing the file ends a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return func() { file.Close() }, nil
+}
+
+// addPodLabels sets the labels, name and namespace of the pod each sandbox
+// runs, from the sandbox container containerd's CRI plugin created for it;
+// containerd copies the pod's labels onto it. Sandboxes are left without
+// if containerd can't be asked.
+func (cli *CLI) addPodLabels(ctx context.Context, sandboxes []SandboxInfo) {
+	byNamespace := make(map[string]map[string]map[string]string)
+	for i := range sandboxes {
+		sb := &sandboxes[i]
+		if sb.shimID == "" {
+			continue
+		}
+		labels, ok := byNamespace[sb.shimNamespace]
+		if !ok {
+			var err error
+			if labels, err = containerLabels(ctx, getEnvOrDefault("CONTAINERD_ADDRESS", defaultContainerdSocket), sb.shimNamespace); err != nil && cli.verbose {
+				fmt.Fprintf(os.Stderr, "Failed to read pod labels from containerd: %v\n", err)
+			}
+			byNamespace[sb.shimNamespace] = labels
+		}
+		if podLabels := labels[sb.shimID]; len(podLabels) > 0 {
+			sb.Labels = make(map[string]string)
+			for key, value := range podLabels {
+				// containerd's own bookkeeping, not the pod's
+				if !strings.HasPrefix(key, "io.cri-containerd.") {
+					sb.Labels[key] = value
+				}
+			}
+			sb.Pod = podLabels[labelPodName]
+			sb.Namespace = podLabels[labelPodNamespace]
+		}
+	}
+}
+
+// containerLabels returns the labels of the containers in a containerd
+// namespace, by container ID.
+func containerLabels(ctx context.Context, socket, namespace string) (map[string]map[string]string, error) {
+	if _, err := os.Stat(socket); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := containers.NewContainersClient(conn).List(namespaces.WithNamespace(ctx, namespace), &containers.ListContainersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]map[string]string, len(resp.Containers))
+	for _, c := range resp.Containers {
+		labels[c.ID] = c.Labels
+	}
+	return labels, nil
+}
+
+// formatLabels formats a sandbox's pod labels as key=value pairs, leaving
+// out the pod's name and namespace Kubernetes adds to them.
+func formatLabels(sb SandboxInfo) string {
+	var pairs []string
+	for key, value := range sb.Labels {
+		if !strings.HasPrefix(key, "io.kubernetes.") {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// readShimState reads which containerd sandbox a sandbox directory belongs
+// to, and the sandbox's primary IP, from the shim's state.
+func readShimState(sandboxDir string) (shimID, namespace, ip string) {
+	var state struct {
+		ShimID    string `json:"shim_id"`
+		Namespace string `json:"namespace"`
+		Sandbox   struct {
+			IPs []string `json:"ips"`
+		} `json:"sandbox"`
+	}
+	data, err := os.ReadFile(filepath.Join(sandboxDir, "state.json"))
+	if err != nil || json.Unmarshal(data, &state) != nil {
+		return "", "", ""
+	}
+	if len(state.Sandbox.IPs) > 0 {
+		ip, _, _ = strings.Cut(state.Sandbox.IPs[0], "/")
+	}
+	return state.ShimID, state.Namespace, ip
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stdoutCapture collects what is written to os.Stdout while it is active.
+type stdoutCapture struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	w    *os.File
+	old  *os.File
+	done chan struct{}
+}
+
+// captureStdout redirects os.Stdout until close, or the end of the test.
+func captureStdout(t *testing.T) *stdoutCapture {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &stdoutCapture{w: w, old: os.Stdout, done: make(chan struct{})}
+	os.Stdout = w
+	go func() {
+		defer close(c.done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			c.mu.Lock()
+			c.buf.Write(buf[:n])
+			c.mu.Unlock()
+			if err != nil {
+				r.Close()
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { c.close() })
+	return c
+}
+
+// String returns what has been read so far.
+func (c *stdoutCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// close restores os.Stdout and returns everything written to it.
+func (c *stdoutCapture) close() string {
+	if os.Stdout == c.w {
+		os.Stdout = c.old
+		c.w.Close()
+	}
+	<-c.done
+	return c.String()
+}
+
+// mkListSandbox creates a sandbox created age ago whose VM answers its
+// Firecracker API with the given vCPUs and memory, or has no VM if vcpus
+// is 0.
+func mkListSandbox(t *testing.T, runDir, id string, vcpus, memoryMB int, ip string, age time.Duration) {
+	t.Helper()
+	dir := filepath.Join(runDir, id)
+	if ip != "" {
+		mkfile(t, filepath.Join(dir, "state.json"), `{"sandbox": {"ips": ["`+ip+`/24"]}}`, 0)
+	}
+	if vcpus > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		state, _ := json.Marshal(VMState{State: "Running", VCPUs: vcpus, MemoryMB: memoryMB})
+		serveFirecracker(t, filepath.Join(dir, "firecracker.sock"), map[string]string{"/": string(state)})
+	}
+	mkSandbox(t, runDir, id, 0, age)
+}
+
+func TestParseListOptions(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    listOptions
+		wantErr string
+	}{
+		{nil, listOptions{sortBy: "created", interval: defaultListInterval}, ""},
+		{[]string{"--sort", "memory", "-w"}, listOptions{sortBy: "memory", watch: true, interval: defaultListInterval}, ""},
+		{[]string{"--sort=id", "--watch", "--interval=500ms"}, listOptions{sortBy: "id", watch: true, interval: 500 * time.Millisecond}, ""},
+		{[]string{"--columns", "id, pod,labels"}, listOptions{sortBy: "created", columns: []string{"id", "pod", "labels"}, interval: defaultListInterval}, ""},
+		// The last --columns wins
+		{[]string{"--columns=ip", "--columns=id"}, listOptions{sortBy: "created", columns: []string{"id"}, interval: defaultListInterval}, ""},
+		{[]string{"--sort", "pid"}, listOptions{}, "invalid --sort: pid"},
+		{[]string{"--sort"}, listOptions{}, "--sort requires a value"},
+		{[]string{"--columns", "id,disk"}, listOptions{}, `unknown column "disk"`},
+		{[]string{"--columns", ""}, listOptions{}, `unknown column ""`},
+		{[]string{"--interval", "0s"}, listOptions{}, "invalid --interval"},
+		{[]string{"--interval", "often"}, listOptions{}, "invalid --interval"},
+		{[]string{"--all"}, listOptions{}, "unknown list flag: --all"},
+	}
+	for _, tt := range tests {
+		got, err := parseListOptions(tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseListOptions(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListOptions(%q) = %+v, %v, want %+v", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestListSortKeys(t *testing.T) {
+	now := time.Now()
+	older := SandboxInfo{ID: "fc-a", State: "dead", CreatedAt: now.Add(-time.Hour), MemoryMB: 512, VCPUs: 1}
+	newer := SandboxInfo{ID: "fc-b", State: "running", CreatedAt: now, MemoryMB: 256, VCPUs: 2}
+
+	tests := []struct {
+		key           string
+		first, second SandboxInfo
+	}{
+		{"created", newer, older},
+		{"uptime", older, newer},
+		{"memory", older, newer},
+		{"vcpus", newer, older},
+		{"id", older, newer},
+		{"state", older, newer},
+	}
+	for _, tt := range tests {
+		less := listSortKeys[tt.key]
+		if !less(tt.first, tt.second) || less(tt.second, tt.first) {
+			t.Errorf("--sort %s does not put %s first", tt.key, tt.first.ID)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	sb := SandboxInfo{Labels: map[string]string{
+		"tier":                        "web",
+		"app":                         "shop",
+		"io.kubernetes.pod.name":      "shop-1",
+		"io.kubernetes.pod.namespace": "default",
+	}}
+	if got := formatLabels(sb); got != "app=shop,tier=web" {
+		t.Errorf("formatLabels() = %q, want app=shop,tier=web", got)
+	}
+	if got := formatLabels(SandboxInfo{}); got != "" {
+		t.Errorf("formatLabels() without labels = %q", got)
+	}
+}
+
+func TestReadShimState(t *testing.T) {
+	dir := t.TempDir()
+	mkfile(t, filepath.Join(dir, "state.json"), `{"shim_id": "abc", "namespace": "k8s.io", "sandbox": {"ips": ["10.0.0.5/24", "fd00::5/64"]}}`, 0)
+	if id, ns, ip := readShimState(dir); id != "abc" || ns != "k8s.io" || ip != "10.0.0.5" {
+		t.Errorf("readShimState() = %q, %q, %q, want abc, k8s.io, 10.0.0.5", id, ns, ip)
+	}
+	if id, ns, ip := readShimState(t.TempDir()); id != "" || ns != "" || ip != "" {
+		t.Errorf("readShimState() without state = %q, %q, %q", id, ns, ip)
+	}
+}
+
+// tableIDs returns the first column of the rows of a printed table.
+func tableIDs(out string) []string {
+	var ids []string
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "fc-") {
+			ids = append(ids, fields[0])
+		}
+	}
+	return ids
+}
+
+func TestPrintList(t *testing.T) {
+	runDir := t.TempDir()
+	mkListSandbox(t, runDir, "fc-a", 2, 512, "10.0.0.5", time.Hour)
+	mkListSandbox(t, runDir, "fc-b", 4, 256, "", 2*time.Hour)
+	mkListSandbox(t, runDir, "fc-c", 0, 0, "", time.Minute)
+
+	tests := []struct {
+		name        string
+		output      string
+		args        []string
+		wantIDs     []string
+		wantHeaders string
+	}{
+		{"newest first", "table", nil, []string{"fc-c", "fc-a", "fc-b"}, "ID STATE PID UPTIME SOCKET"},
+		{"by memory", "table", []string{"--sort", "memory"}, []string{"fc-a", "fc-b", "fc-c"}, ""},
+		{"by vCPUs", "table", []string{"--sort=vcpus"}, []string{"fc-b", "fc-a", "fc-c"}, ""},
+		{"filtered", "table", []string{"--filter", "vcpus>=2", "--sort", "id"}, []string{"fc-a", "fc-b"}, ""},
+		{"wide", "wide", nil, []string{"fc-c", "fc-a", "fc-b"}, "ID STATE PID VCPUs MEMORY IP UPTIME SOCKET"},
+		{"columns", "wide", []string{"--columns", "id,memory,ip"}, []string{"fc-c", "fc-a", "fc-b"}, "ID MEMORY IP"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: runDir, output: tt.output}
+		sel, rest, err := parseSelection(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := parseListOptions(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := captureStdout(t)
+		err = cli.printList(context.Background(), sel, opts)
+		out := c.close()
+		if err != nil {
+			t.Fatalf("%s: printList() error = %v", tt.name, err)
+		}
+		if got := tableIDs(out); !reflect.DeepEqual(got, tt.wantIDs) {
+			t.Errorf("%s: listed %q, want %q\n%s", tt.name, got, tt.wantIDs, out)
+		}
+		if header := strings.Join(strings.Fields(strings.SplitN(out, "\n", 2)[0]), " "); tt.wantHeaders != "" && header != tt.wantHeaders {
+			t.Errorf("%s: header = %q, want %q", tt.name, header, tt.wantHeaders)
+		}
+		if tt.name == "columns" {
+			if row := strings.Fields(strings.Split(out, "\n")[2]); !reflect.DeepEqual(row, []string{"fc-a", "512MB", "10.0.0.5"}) {
+				t.Errorf("%s: fc-a's row = %q, want its memory and IP", tt.name, row)
+			}
+		}
+	}
+}
+
+func TestPrintList_JSON(t *testing.T) {
+	runDir := t.TempDir()
+	mkListSandbox(t, runDir, "fc-a", 2, 512, "10.0.0.5", time.Hour)
+	cli := &CLI{runDir: runDir, output: "json"}
+
+	c := captureStdout(t)
+	err := cli.printList(context.Background(), &selection{}, listOptions{sortBy: "created"})
+	out := c.close()
+	if err != nil {
+		t.Fatalf("printList() error = %v", err)
+	}
+	var sandboxes []SandboxInfo
+	if err := json.Unmarshal([]byte(out), &sandboxes); err != nil {
+		t.Fatalf("printList() printed invalid JSON: %v\n%s", err, out)
+	}
+	if len(sandboxes) != 1 || sandboxes[0].VCPUs != 2 || sandboxes[0].MemoryMB != 512 || sandboxes[0].IP != "10.0.0.5" {
+		t.Errorf("printList() = %+v", sandboxes)
+	}
+
+	// Nothing matching is an empty list, not null
+	sel, _, _ := parseSelection([]string{"--filter", "state=dead"})
+	c = captureStdout(t)
+	err = cli.printList(context.Background(), sel, listOptions{sortBy: "created"})
+	if out := c.close(); err != nil || strings.TrimSpace(out) != "[]" {
+		t.Errorf("printList() matching nothing = %q, %v, want []", out, err)
+	}
+
+	sel, _, _ = parseSelection([]string{"--jsonpath", "{[*].ip}"})
+	c = captureStdout(t)
+	err = cli.printList(context.Background(), sel, listOptions{sortBy: "created"})
+	if out := c.close(); err != nil || out != "10.0.0.5\n" {
+		t.Errorf("printList(--jsonpath) = %q, %v, want 10.0.0.5", out, err)
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	changed := make(chan struct{}, 1)
+	stop, err := watchDir(dir, changed)
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+	defer stop()
+
+	expect := func(what string) {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no change signalled for %s", what)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "fc-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	expect("a created directory")
+	if err := os.Rename(filepath.Join(dir, "fc-1"), filepath.Join(dir, "fc-2")); err != nil {
+		t.Fatal(err)
+	}
+	expect("a rename")
+	if err := os.Remove(filepath.Join(dir, "fc-2")); err != nil {
+		t.Fatal(err)
+	}
+	expect("a removed directory")
+
+	// Writes to an entry leave the list as it was
+	mkfile(t, filepath.Join(dir, "file"), "", 0)
+	expect("a created file")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("more"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Error("a write to a file signalled a change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchList(t *testing.T) {
+	runDir := t.TempDir()
+	mkListSandbox(t, runDir, "fc-a", 0, 0, "", time.Hour)
+	cli := &CLI{runDir: runDir, output: "table"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := captureStdout(t)
+	done := make(chan error, 1)
+	// The interval is long, so only the new directory redraws the list
+	go func() {
+		done <- cli.watchList(ctx, &selection{}, listOptions{sortBy: "created", watch: true, interval: time.Hour})
+	}()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !strings.Contains(c.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("watchList() never printed %q:\n%s", want, c.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("fc-a")
+	if err := os.Mkdir(filepath.Join(runDir, "fc-new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("fc-new")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchList() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchList() did not stop with its context")
+	}
+	out := c.close()
+	if n := strings.Count(out, "fcctl list - "); n < 2 {
+		t.Errorf("watchList() drew the list %d times, want a redraw for the new sandbox", n)
+	}
+	if !strings.Contains(out, "refresh 1h0m0s, sorted by created") {
+		t.Errorf("watchList() header is missing the interval and sort:\n%s", out)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logs reads a sandbox's logs from the sources --source names: the VMM's
+// log file, the guest agent's log buffer, and the output of the sandbox's
+// containers, which the agent keeps in the guest. Lines of several sources
+// are interleaved by time, each behind the name of its source, and so are
+// those of several sandboxes, each behind the sandbox's ID. --since and
+// --tail apply to the lines of all sources together.
+
+// Log sources of a sandbox.
+const (
+	logSourceVMM       = "vmm"
+	logSourceAgent     = "agent"
+	logSourceContainer = "container"
+)
+
+// vmmLogTimeLayout is how Firecracker stamps its log lines, in local time.
+const vmmLogTimeLayout = "2006-01-02T15:04:05.999999999"
+
+// logsOptions are the flags of the logs command.
+type logsOptions struct {
+	follow    bool
+	tail      int // Lines to show of the past; -1 shows them all
+	since     time.Time
+	sources   []string
+	container string       // Only this container's output
+	selector  []filterExpr // Sandboxes to read, instead of IDs
+}
+
+// logRecord is a log line of any source, as -o json prints it. Agent
+// records keep the fields the agent sends.
+type logRecord struct {
+	Sandbox   string                 `json:"sandbox,omitempty"`
+	Source    string                 `json:"source"`
+	Seq       uint64                 `json:"seq,omitempty"`
+	Time      time.Time              `json:"time"`
+	Level     string                 `json:"level,omitempty"`
+	Container string                 `json:"container,omitempty"`
+	Stream    string                 `json:"stream,omitempty"`
+	Msg       string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// logLine is a line of a log source and how the source alone prints it.
+type logLine struct {
+	record logRecord
+	text   string
+}
+
+// parseLogsOptions parses the arguments of the logs command: the sandbox
+// IDs and the flags.
+func parseLogsOptions(args []string) ([]string, logsOptions, error) {
+	opts := logsOptions{tail: -1, sources: []string{logSourceVMM}}
+	var ids []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch name {
+		case "-f", "--follow":
+			opts.follow = true
+			continue
+		case "--agent":
+			opts.sources = []string{logSourceAgent}
+			continue
+		case "--tail", "--since", "--source", "--container", "--selector", "-l":
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				return nil, opts, fmt.Errorf("unknown flag: %s", args[i])
+			}
+			ids = append(ids, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, opts, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "--tail":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, opts, fmt.Errorf("invalid --tail %q", value)
+			}
+			opts.tail = n
+		case "--since":
+			since, err := parseSince(value)
+			if err != nil {
+				return nil, opts, err
+			}
+			opts.since = since
+		case "--source":
+			opts.sources = nil
+			for _, source := range strings.Split(value, ",") {
+				switch source = strings.TrimSpace(source); source {
+				case logSourceVMM, logSourceAgent, logSourceContainer:
+					opts.sources = append(opts.sources, source)
+				default:
+					return nil, opts, fmt.Errorf("invalid --source %q (must be vmm, agent or container)", source)
+				}
+			}
+		case "--container":
+			opts.container = value
+		case "--selector", "-l":
+			filters, err := parseFilters(value)
+			if err != nil {
+				return nil, opts, err
+			}
+			opts.selector = append(opts.selector, filters...)
+		}
+	}
+	switch {
+	case len(ids) == 0 && len(opts.selector) == 0:
+		return nil, opts, fmt.Errorf("usage: fcctl logs <sandbox-id>... | --selector expr [-f] [--tail N] [--since dur|time] [--source vmm,agent,container] [--container id]")
+	case len(ids) > 0 && len(opts.selector) > 0:
+		return nil, opts, fmt.Errorf("give sandbox IDs or --selector, not both")
+	}
+	// --container implies its output is wanted
+	if opts.container != "" {
+		hasContainer := false
+		for _, source := range opts.sources {
+			hasContainer = hasContainer || source == logSourceContainer
+		}
+		if !hasContainer {
+			opts.sources = append(opts.sources, logSourceContainer)
+		}
+	}
+	return ids, opts, nil
+}
+
+// parseSince parses --since, a duration before now or an RFC 3339 time.
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q (must be a duration such as 10m or an RFC 3339 time)", value)
+}
+
+// logSandboxes returns the sandboxes whose logs to read: the ones named,
+// or those opts.selector matches.
+func (cli *CLI) logSandboxes(ctx context.Context, ids []string, opts logsOptions) ([]string, error) {
+	if len(opts.selector) == 0 {
+		return ids, nil
+	}
+	sandboxes, err := cli.discoverSandboxes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover sandboxes: %w", err)
+	}
+	cli.addPodLabels(ctx, sandboxes)
+	sel := &selection{filters: opts.selector}
+	for _, sb := range sandboxes {
+		ok, err := sel.match(sb)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ids = append(ids, sb.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no sandboxes matched")
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// showLogs prints the logs of the sandboxes ids as opts ask and, with
+// follow, the lines logged afterwards until ctx is done.
+func (cli *CLI) showLogs(ctx context.Context, ids []string, opts logsOptions) error {
+	var printer logPrinter
+	printer.multiplexed = len(opts.sources) > 1
+	if len(ids) > 1 {
+		for _, id := range ids {
+			printer.sandboxWidth = max(printer.sandboxWidth, len(id)+2)
+		}
+	}
+
+	var history []logLine
+	var live []<-chan logLine
+	for _, id := range ids {
+		sandboxDir := filepath.Join(cli.runDir, id)
+		for _, source := range opts.sources {
+			lines, stream, err := cli.openLogSource(ctx, sandboxDir, source, opts)
+			if err != nil {
+				if !printer.multiplexed && len(ids) == 1 {
+					return err
+				}
+				if len(ids) > 1 {
+					fmt.Fprintf(os.Stderr, "Skipping %s logs of %s: %v\n", source, id, err)
+				} else {
+					fmt.Fprintf(os.Stderr, "Skipping %s logs: %v\n", source, err)
+				}
+				continue
+			}
+			history = append(history, lines...)
+			live = append(live, stream)
+		}
+	}
+
+	// The past, oldest first
+	var shown []logLine
+	for _, line := range history {
+		if !line.record.Time.Before(opts.since) {
+			shown = append(shown, line)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool { return shown[i].record.Time.Before(shown[j].record.Time) })
+	if opts.tail >= 0 && len(shown) > opts.tail {
+		shown = shown[len(shown)-opts.tail:]
+	}
+	printer.json = cli.output == "json"
+	printer.encoder = json.NewEncoder(os.Stdout)
+	for _, line := range shown {
+		printer.print(line)
+	}
+	if !opts.follow {
+		return nil
+	}
+
+	// Then lines as they are logged, in the order they come
+	merged := make(chan logLine)
+	var wg sync.WaitGroup
+	for _, stream := range live {
+		wg.Add(1)
+		go func(stream <-chan logLine) {
+			defer wg.Done()
+			for line := range stream {
+				select {
+				case merged <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(stream)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-merged:
+			if !ok {
+				return nil
+			}
+			printer.print(line)
+		}
+	}
+}
+
+// logPrinter prints log lines as text or, with json, as JSON records.
+type logPrinter struct {
+	json    bool
+	encoder *json.Encoder
+
+	// multiplexed puts lines behind their source's name, as the lines of
+	// several sources are interleaved
+	multiplexed bool
+
+	// sandboxWidth, if set, puts lines behind their sandbox's ID, padded
+	// to it, as the lines of several sandboxes are interleaved
+	sandboxWidth int
+}
+
+// print prints a log line.
+func (p *logPrinter) print(line logLine) {
+	if p.json {
+		_ = p.encoder.Encode(line.record)
+		return
+	}
+	var prefix string
+	if p.sandboxWidth > 0 {
+		prefix = fmt.Sprintf("%-*s ", p.sandboxWidth, "["+line.record.Sandbox+"]")
+	}
+	if p.multiplexed {
+		prefix += fmt.Sprintf("%-9s ", line.record.Source)
+	}
+	fmt.Println(prefix + line.text)
+}
+
+// openLogSource returns the lines a sandbox's log source has logged and,
+// with opts.follow, a channel of the lines it logs afterwards, closed when
+// the source ends or ctx is done.
+func (cli *CLI) openLogSource(ctx context.Context, sandboxDir, source string, opts logsOptions) ([]logLine, <-chan logLine, error) {
+	switch source {
+	case logSourceVMM:
+		path := filepath.Join(sandboxDir, "firecracker.log")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// Try alternate log location
+			path = filepath.Join(sandboxDir, "vmm.log")
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("no log file found for sandbox %s", filepath.Base(sandboxDir))
+			}
+		}
+		return streamLogSource(ctx, filepath.Base(sandboxDir), func(emit func([]logLine)) error {
+			return readVMMLog(ctx, path, opts.follow, emit)
+		})
+
+	case logSourceAgent, logSourceContainer:
+		vsockPath := filepath.Join(sandboxDir, "vsock.sock")
+		if _, err := os.Stat(vsockPath); os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("vsock not found for sandbox %s", filepath.Base(sandboxDir))
+		}
+		if source == logSourceContainer {
+			return streamLogSource(ctx, filepath.Base(sandboxDir), func(emit func([]logLine)) error {
+				return readContainerLogs(ctx, vsockPath, opts, emit)
+			})
+		}
+		return streamLogSource(ctx, filepath.Base(sandboxDir), func(emit func([]logLine)) error {
+			return readAgentLogs(ctx, vsockPath, opts.follow, func(entries []agentLogEntry, dropped uint64) {
+				if dropped > 0 {
+					fmt.Fprintf(os.Stderr, "(%d older agent log entries were dropped)\n", dropped)
+				}
+				lines := make([]logLine, len(entries))
+				for i, entry := range entries {
+					lines[i] = logLine{
+						record: logRecord{
+							Source: logSourceAgent,
+							Seq:    entry.Seq,
+							Time:   entry.Time,
+							Level:  entry.Level,
+							Msg:    entry.Msg,
+							Fields: entry.Fields,
+						},
+						text: formatAgentLogEntry(entry),
+					}
+				}
+				emit(lines)
+			})
+		})
+	}
+	return nil, nil, fmt.Errorf("unknown log source %q", source)
+}
+
+// streamLogSource runs read, which calls emit with the lines a source of
+// the sandbox has logged and then with those it logs afterwards. It returns
+// the first batch, and a channel of the later lines closed once read
+// returns.
+func streamLogSource(ctx context.Context, sandbox string, read func(emit func([]logLine)) error) ([]logLine, <-chan logLine, error) {
+	first := make(chan []logLine, 1)
+	failed := make(chan error, 1)
+	live := make(chan logLine, 256)
+	go func() {
+		defer close(live)
+		started := false
+		err := read(func(lines []logLine) {
+			for i := range lines {
+				lines[i].record.Sandbox = sandbox
+			}
+			if !started {
+				started = true
+				first <- lines
+				return
+			}
+			for _, line := range lines {
+				select {
+				case live <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		if !started {
+			if err == nil {
+				first <- nil
+			}
+			failed <- err
+		} else if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Log stream ended: %v\n", err)
+		}
+	}()
+
+	select {
+	case lines := <-first:
+		return lines, live, nil
+	case err := <-failed:
+		return nil, nil, err
+	}
+}
+
+// readVMMLog calls emit with the lines of the VMM log at path and, with
+// follow, with the lines written to it afterwards until ctx is done.
+func readVMMLog(ctx context.Context, path string, follow bool, emit func([]logLine)) error {
+	var last time.Time
+	return followFile(ctx, path, follow, func(texts []string) {
+		lines := make([]logLine, len(texts))
+		for i, text := range texts {
+			// Lines without a time, such as panics, go with the one before
+			if t, ok := vmmLogTime(text); ok {
+				last = t
+			}
+			lines[i] = logLine{
+				record: logRecord{Source: logSourceVMM, Time: last, Msg: text},
+				text:   text,
+			}
+		}
+		emit(lines)
+	})
+}
+
+// vmmLogTime returns the time a Firecracker log line was logged.
+func vmmLogTime(line string) (time.Time, bool) {
+	stamp, _, _ := strings.Cut(line, " ")
+	t, err := time.ParseInLocation(vmmLogTimeLayout, stamp, time.Local)
+	return t, err == nil
+}
+
+// containerLogEntry is a line of a container's output, as the guest agent
+// sends it.
+type containerLogEntry struct {
+	Container string    `json:"container"`
+	Time      time.Time `json:"time"`
+	Stream    string    `json:"stream"`
+	Partial   bool      `json:"partial,omitempty"`
+	Line      string    `json:"line"`
+}
+
+// readContainerLogs calls emit with the output the guest agent has kept of
+// the sandbox's containers, or of opts.container, and with follow, with
+// their output afterwards until ctx is done.
+func readContainerLogs(ctx context.Context, vsockPath string, opts logsOptions, emit func([]logLine)) error {
+	conn, err := dialAgent(vsockPath, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	params := map[string]interface{}{"follow": opts.follow}
+	if opts.container != "" {
+		params["id"] = opts.container
+	}
+	if opts.tail >= 0 {
+		params["tail"] = opts.tail
+	}
+	if !opts.since.IsZero() {
+		params["since"] = opts.since.UTC().Format(time.RFC3339Nano)
+	}
+	req := map[string]interface{}{
+		"id":     1,
+		"method": "stream_container_logs",
+		"params": params,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		if !opts.follow {
+			_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		}
+		var resp struct {
+			Result struct {
+				Entries []containerLogEntry `json:"entries"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&resp); err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read container logs: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("agent error: %s", resp.Error.Message)
+		}
+
+		lines := make([]logLine, len(resp.Result.Entries))
+		for i, entry := range resp.Result.Entries {
+			lines[i] = logLine{
+				record: logRecord{
+					Source:    logSourceContainer,
+					Time:      entry.Time,
+					Container: entry.Container,
+					Stream:    entry.Stream,
+					Msg:       entry.Line,
+				},
+				text: fmt.Sprintf("%s %s %s %s", entry.Time.Local().Format("2006-01-02T15:04:05.000"), shortID(entry.Container), entry.Stream, entry.Line),
+			}
+		}
+		emit(lines)
+		if !opts.follow {
+			return nil
+		}
+	}
+}
+
+// shortID shortens a container ID for display.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration // Before now, for durations
+		wantAt  string        // For times
+		wantErr bool
+	}{
+		{"10m", 10 * time.Minute, "", false},
+		{"1h30m", 90 * time.Minute, "", false},
+		{"0s", 0, "", false},
+		{"2024-01-02T03:04:05Z", 0, "2024-01-02T03:04:05Z", false},
+		{"2024-01-02T03:04:05+02:00", 0, "2024-01-02T01:04:05Z", false},
+		{"-5m", 0, "", true},
+		{"10", 0, "", true},
+		{"2024-01-02", 0, "", true},
+		{"yesterday", 0, "", true},
+		{"", 0, "", true},
+	}
+	for _, tt := range tests {
+		before := time.Now()
+		got, err := parseSince(tt.value)
+		after := time.Now()
+		switch {
+		case tt.wantErr:
+			if err == nil || !strings.Contains(err.Error(), "invalid --since") {
+				t.Errorf("parseSince(%q) = %v, %v, want an error", tt.value, got, err)
+			}
+		case err != nil:
+			t.Errorf("parseSince(%q) error = %v", tt.value, err)
+		case tt.wantAt != "":
+			if want, _ := time.Parse(time.RFC3339, tt.wantAt); !got.Equal(want) {
+				t.Errorf("parseSince(%q) = %v, want %v", tt.value, got, want)
+			}
+		case got.Before(before.Add(-tt.want)) || got.After(after.Add(-tt.want)):
+			t.Errorf("parseSince(%q) = %v, want %v before now", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogsOptions(t *testing.T) {
+	ids, opts, err := parseLogsOptions([]string{"fc-1"})
+	if err != nil || !reflect.DeepEqual(ids, []string{"fc-1"}) || opts.tail != -1 || !opts.since.IsZero() {
+		t.Errorf("parseLogsOptions(fc-1) = %q, %+v, %v, want all lines", ids, opts, err)
+	}
+
+	tests := []struct {
+		args     []string
+		wantTail int
+		wantErr  string
+	}{
+		{[]string{"fc-1", "--tail", "0"}, 0, ""},
+		{[]string{"fc-1", "--tail=25"}, 25, ""},
+		{[]string{"--tail", "1", "fc-1", "--tail", "2"}, 2, ""},
+		{[]string{"fc-1", "--tail", "-1"}, 0, `invalid --tail "-1"`},
+		{[]string{"fc-1", "--tail=all"}, 0, `invalid --tail "all"`},
+		{[]string{"fc-1", "--tail"}, 0, "--tail requires a value"},
+		{[]string{"fc-1", "--since", "soon"}, 0, `invalid --since "soon"`},
+		{[]string{"fc-1", "--since"}, 0, "--since requires a value"},
+	}
+	for _, tt := range tests {
+		_, opts, err := parseLogsOptions(tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseLogsOptions(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || opts.tail != tt.wantTail {
+			t.Errorf("parseLogsOptions(%q) tail = %d, %v, want %d", tt.args, opts.tail, err, tt.wantTail)
+		}
+	}
+
+	_, opts, err = parseLogsOptions([]string{"fc-1", "--since=2024-01-02T03:04:05Z"})
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); err != nil || !opts.since.Equal(want) {
+		t.Errorf("parseLogsOptions(--since) = %v, %v, want %v", opts.since, err, want)
+	}
+}
+
+func TestVMMLogTime(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.Local)
+	if got, ok := vmmLogTime("2024-01-02T03:04:05.123456789 [fc-1:main] Running Firecracker"); !ok || !got.Equal(want) {
+		t.Errorf("vmmLogTime() = %v, %v, want %v", got, ok, want)
+	}
+	if _, ok := vmmLogTime("thread 'main' panicked"); ok {
+		t.Error("vmmLogTime() found a time in a line without one")
+	}
+}
+
+func TestShowLogs_TailSince(t *testing.T) {
+	runDir := t.TempDir()
+	mkfile(t, filepath.Join(runDir, "fc-1", "firecracker.log"), strings.Join([]string{
+		"untimed",
+		"2024-01-02T03:00:00.000000000 [fc-1] one",
+		"2024-01-02T03:01:00.000000000 [fc-1] two",
+		"  continued",
+		"2024-01-02T03:02:00.000000000 [fc-1] three",
+	}, "\n")+"\n", 0)
+	cli := &CLI{runDir: runDir}
+	at := func(minute int) time.Time { return time.Date(2024, 1, 2, 3, minute, 0, 0, time.Local) }
+
+	tests := []struct {
+		name string
+		opts logsOptions
+		want []string
+	}{
+		{"all", logsOptions{tail: -1}, []string{"untimed", "one", "two", "continued", "three"}},
+		{"tail 0", logsOptions{tail: 0}, nil},
+		{"tail 1", logsOptions{tail: 1}, []string{"three"}},
+		{"tail 2", logsOptions{tail: 2}, []string{"continued", "three"}},
+		{"tail all", logsOptions{tail: 5}, []string{"untimed", "one", "two", "continued", "three"}},
+		{"tail more", logsOptions{tail: 100}, []string{"untimed", "one", "two", "continued", "three"}},
+		// A line without a time goes with the one before it
+		{"since a line", logsOptions{tail: -1, since: at(1)}, []string{"two", "continued", "three"}},
+		{"since between", logsOptions{tail: -1, since: at(1).Add(time.Second)}, []string{"three"}},
+		{"since after", logsOptions{tail: -1, since: at(5)}, nil},
+		// --tail counts the lines --since leaves
+		{"since and tail", logsOptions{tail: 2, since: at(0)}, []string{"continued", "three"}},
+		{"since and tail all", logsOptions{tail: 3, since: at(1)}, []string{"two", "continued", "three"}},
+	}
+	for _, tt := range tests {
+		tt.opts.sources = []string{logSourceVMM}
+		c := captureStdout(t)
+		err := cli.showLogs(context.Background(), []string{"fc-1"}, tt.opts)
+		out := c.close()
+		if err != nil {
+			t.Errorf("%s: showLogs() error = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			// The last word tells the lines apart
+			if line != "" {
+				got = append(got, line[strings.LastIndex(line, " ")+1:])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: showLogs() printed %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShowLogs_Missing(t *testing.T) {
+	cli := &CLI{runDir: t.TempDir()}
+	err := cli.showLogs(context.Background(), []string{"fc-missing"}, logsOptions{tail: -1, sources: []string{logSourceVMM}})
+	if err == nil || !strings.Contains(err.Error(), "no log file found") {
+		t.Errorf("showLogs() of a sandbox without logs = %v", err)
+	}
+}
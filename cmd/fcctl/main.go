@@ -11,11 +11,21 @@
 //
 //	fcctl list                    # List all sandboxes
 //	fcctl inspect <sandbox-id>    # Show sandbox details
+//	fcctl diff <id-a> <id-b>      # Compare two sandboxes' configuration
+//	fcctl trace <sandbox-id>      # Show where a sandbox's start spent its time
 //	fcctl pool status             # Show VM pool status
 //	fcctl metrics                 # Show runtime metrics
-//	fcctl logs <sandbox-id>       # Stream sandbox logs
+//	fcctl logs <sandbox-id>       # Show or stream sandbox logs
 //	fcctl exec <sandbox-id> <cmd> # Execute command in VM
 //	fcctl health                  # Check runtime health
+//	fcctl doctor                  # Diagnose whether the node can run VMs
+//	fcctl top                     # Live resource view of sandboxes
+//	fcctl gc --dry-run            # Report orphaned resources
+//	fcctl images                  # List converted images
+//	fcctl images convert <ref> -w # Convert an image, following its progress
+//	fcctl serve                   # Serve the admin API for remote fcctl
+//	fcctl support-bundle          # Collect node diagnostics for a bug report
+//	fcctl --host ssh://node1 list # Run a command on another node
 //
 // Build: go build -o fcctl ./cmd/fcctl
 package main
@@ -23,6 +33,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -36,6 +47,8 @@ import (
 	"syscall"
 	"text/tabwriter"
 	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
 )
 
 const (
@@ -50,6 +63,11 @@ type CLI struct {
 	metricsAddress string
 	verbose        bool
 	output         string // "table", "json", "wide"
+
+	// Remote mode: run commands on another node over SSH or its admin API
+	host       string // ssh://[user@]node[:port]
+	endpoint   string // https://node:9091
+	adminToken string
 }
 
 func main() {
@@ -57,6 +75,9 @@ func main() {
 		runDir:         getEnvOrDefault("FC_CRI_RUN_DIR", defaultRunDir),
 		metricsAddress: getEnvOrDefault("FC_CRI_METRICS_ADDRESS", metricsAddress),
 		output:         "table",
+		host:           os.Getenv("FC_CRI_HOST"),
+		endpoint:       os.Getenv("FC_CRI_ENDPOINT"),
+		adminToken:     os.Getenv("FC_CRI_ADMIN_TOKEN"),
 	}
 
 	if len(os.Args) < 2 {
@@ -83,6 +104,18 @@ func main() {
 			}
 			cli.runDir = args[1]
 			args = args[2:]
+		case "--host":
+			if len(args) < 2 {
+				fatal("--host requires a value")
+			}
+			cli.host = args[1]
+			args = args[2:]
+		case "--endpoint":
+			if len(args) < 2 {
+				fatal("--endpoint requires a value")
+			}
+			cli.endpoint = args[1]
+			args = args[2:]
 		case "-h", "--help":
 			cli.printUsage()
 			os.Exit(0)
@@ -113,12 +146,37 @@ func main() {
 		cancel()
 	}()
 
+	if cli.host != "" && cli.endpoint != "" {
+		fatal("--host and --endpoint are mutually exclusive")
+	}
+
+	remote := cli.host != "" || cli.endpoint != ""
+	if remote && cmd == "serve" {
+		fatal("serve cannot be combined with --host or --endpoint")
+	}
+
 	var err error
+	if remote && cmd != "version" && cmd != "help" {
+		err = cli.runRemote(ctx, cmd, cmdArgs)
+		var exitErr *remoteExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		if err != nil {
+			fatal("%v", err)
+		}
+		return
+	}
+
 	switch cmd {
 	case "list", "ls":
 		err = cli.cmdList(ctx, cmdArgs)
 	case "inspect", "get":
 		err = cli.cmdInspect(ctx, cmdArgs)
+	case "diff":
+		err = cli.cmdDiff(ctx, cmdArgs)
+	case "trace":
+		err = cli.cmdTrace(ctx, cmdArgs)
 	case "pool":
 		err = cli.cmdPool(ctx, cmdArgs)
 	case "metrics":
@@ -129,10 +187,28 @@ func main() {
 		err = cli.cmdExec(ctx, cmdArgs)
 	case "health":
 		err = cli.cmdHealth(ctx, cmdArgs)
+	case "doctor":
+		err = cli.cmdDoctor(ctx, cmdArgs)
+	case "top":
+		err = cli.cmdTop(ctx, cmdArgs)
 	case "kill":
 		err = cli.cmdKill(ctx, cmdArgs)
+	case "restart":
+		err = cli.cmdRestart(ctx, cmdArgs)
+	case "guest":
+		err = cli.cmdGuest(ctx, cmdArgs)
+	case "kernels":
+		err = cli.cmdKernels(ctx, cmdArgs)
+	case "images":
+		err = cli.cmdImages(ctx, cmdArgs)
 	case "cleanup":
 		err = cli.cmdCleanup(ctx, cmdArgs)
+	case "gc":
+		err = cli.cmdGC(ctx, cmdArgs)
+	case "serve":
+		err = cli.cmdServe(ctx, cmdArgs)
+	case "support-bundle":
+		err = cli.cmdSupportBundle(ctx, cmdArgs)
 	case "version":
 		fmt.Printf("fcctl version %s\n", version)
 	case "help":
@@ -153,15 +229,85 @@ Usage:
   fcctl [flags] <command> [args]
 
 Commands:
-  list, ls              List all sandboxes/VMs
-  inspect <id>          Show detailed sandbox information
-  pool [status|warm|drain]  Manage VM pool
+  list, ls [--filter expr] [--jsonpath tmpl] [--sort key] [--columns cols]
+           [--watch [--interval dur]]
+                        List all sandboxes/VMs (--filter: only those matching,
+                        e.g. state=dead, memory>512 or label=app=web;
+                        --jsonpath: print fields, e.g.
+                        '{range [*]}{.id}{"\n"}{end}'; --sort: created,
+                        uptime, memory, vcpus, id or state; --columns: e.g.
+                        id,pod,memory,labels; --watch: redraw as sandboxes
+                        come and go, and every interval, default 2s)
+  inspect <id> [--filter expr] [--jsonpath tmpl]
+                        Show detailed sandbox information (fails if --filter
+                        doesn't match)
+  diff <id-a> <id-b> [--all]
+                        Compare two sandboxes' VM config, kernel args, drives,
+                        network interfaces, agent and environment (--all: list
+                        identical fields too)
+  trace <id> [--all]    Show how long each phase of a sandbox's start took,
+                        from VM creation to container start, as a waterfall
+                        (--all: include phases from warming a pooled VM)
+  pool [status|warm|drain|inspect]  Manage VM pool
+  pool warm [count] [--vcpus n --memory MB]
+                        Add pre-warmed VMs (default shape unless given)
+                        through the runtime API
+  pool inspect [--transitions]
+                        List pooled VMs by state (warming, ready, degraded,
+                        retired) through the runtime API (--transitions:
+                        with their state changes)
+  pool reservation      Show the vCPUs and memory idle pooled VMs hold
+  pool annotate-node [--node name] [--interval dur] [--once]
+                        Keep the pool reservation in annotations on the
+                        Kubernetes node (run in a pod)
   metrics               Show runtime metrics
-  logs <id> [-f]        Show/stream sandbox logs
+  logs <id>... | --selector expr [-f] [--tail N] [--since dur|time]
+          [--source vmm,agent,container] [--container cid] [--agent]
+                        Show/stream sandbox logs: the VMM's (default), the
+                        guest agent's (--agent), or containers' output from
+                        the guest, several interleaved by time (several
+                        sandboxes: each line behind its sandbox's ID;
+                        -f follows rotated and truncated log files)
   exec <id> <cmd>       Execute command in VM via agent
-  health                Check runtime health
-  kill <id>             Force kill a sandbox VM
-  cleanup               Clean up orphaned resources
+  health [--doctor]     Check runtime health (--doctor: same as doctor)
+  doctor [--config path]
+                        Check KVM, kernel modules, cgroups, CNI plugins,
+                        tap/bridge creation and firecracker/jailer versions,
+                        with remediation hints; exits non-zero on failure
+  top [-n secs] [--sort-by key] [-c count]
+                        Live resource view (sort: cpu, mem, guest-mem, disk, net, id)
+  kill <id>... | --all | --selector expr [--dry-run] [--yes]
+                        Force kill sandbox VMs (--selector: those matching,
+                        as list --filter, e.g. state=running; asks before
+                        killing several unless --yes)
+  restart <id> [--dry-run] [--yes] [--timeout dur]
+                        Reboot a sandbox's VM in place and restart its
+                        containers, keeping its IP, MAC and rootfs
+  guest <id> timezone <zone> | ca-bundle <pem-file> [--container <cid>]
+                        Change guest settings without rebuilding the image
+  guest <id> log-level <debug|info|error>
+                        Change the guest agent's log level
+  kernels [list|verify <name>|pull <name>]
+                        List, verify or pre-fetch selectable kernels
+  images [list|rm <ref> [--force]|prune [--dry-run] [--yes]]
+                        Manage the converted-image cache
+  images convert <ref> [--watch] | progress [<ref>]
+                        Convert an image to a rootfs, or follow conversions
+                        in progress, through the runtime control socket
+  cleanup [--dry-run] [--yes] [--older-than dur]
+                        Clean up orphaned sandboxes (--older-than: only
+                        those created at least dur ago)
+  gc [--dry-run] [--yes] [--only kinds] [--snapshot-max-age dur]
+                        Remove orphaned sandboxes, volumes, images, snapshots,
+                        netns and taps, reporting the space reclaimed
+  serve [--listen addr] [--tls-cert f --tls-key f]
+                        Serve the admin API for remote fcctl (default
+                        127.0.0.1:9091; needs FC_CRI_ADMIN_TOKEN, and TLS
+                        on other addresses)
+  support-bundle [--out file|-] [--since dur] [--max-size MB] [--max-file-size MB]
+                 [--config path]
+                        Collect health, config, metrics, sandboxes, logs and
+                        events into a redacted tarball for bug reports
   version               Show version
   help                  Show this help
 
@@ -169,22 +315,48 @@ Flags:
   -v, --verbose         Enable verbose output
   -o, --output <fmt>    Output format: table, json, wide (default: table)
   --run-dir <path>      Runtime directory (default: /run/fc-cri)
+  --host <url>          Run the command on a node over SSH (ssh://[user@]node[:port])
+  --endpoint <url>      Run the command through a node's admin API (https://node:9091)
   -h, --help            Show help
   --version             Show version
 
 Environment:
   FC_CRI_RUN_DIR        Runtime directory
   FC_CRI_METRICS_ADDRESS Metrics endpoint address
+  FC_CRI_HOST           Default for --host
+  FC_CRI_ENDPOINT       Default for --endpoint
+  FC_CRI_ADMIN_TOKEN    Bearer token for the admin API (client and server)
 
 Examples:
   fcctl list
+  fcctl list --filter 'state=running,memory>=512' -o wide
+  fcctl list --filter label=app=web --sort memory --columns id,pod,memory,uptime
+  fcctl list --watch
   fcctl inspect fc-1234567890
+  fcctl inspect fc-1234567890 --jsonpath '{.network.ips[0]}'
+  fcctl diff fc-1234567890 fc-1234567891
+  fcctl trace fc-1234567890
   fcctl pool status
   fcctl metrics
   fcctl logs fc-1234567890 -f
+  fcctl -o json logs fc-1234567890 --agent -f
+  fcctl logs fc-1234567890 --source vmm,agent,container --since 10m --tail 100
+  fcctl logs --selector label=app=web --source container -f
   fcctl exec fc-1234567890 cat /etc/os-release
   fcctl health
+  fcctl top -n 5 --sort-by mem
+  fcctl -o json top         # Stream one JSON snapshot per refresh
   fcctl cleanup --dry-run
+  fcctl cleanup --older-than 1h --yes
+  fcctl kill --selector state=running --dry-run
+  fcctl restart fc-1234567890 --yes
+  fcctl gc --dry-run --snapshot-max-age 72h
+  fcctl guest fc-1234567890 ca-bundle /etc/fc-cri/ca-bundles/corp.pem
+  fcctl kernels pull 6.1-minimal
+  fcctl support-bundle --since 6h
+  fcctl --host ssh://admin@node1 support-bundle --out - > node1.tar.gz
+  fcctl --host ssh://admin@node1 health
+  fcctl --endpoint https://node1:9091 top
 `)
 }
 
@@ -202,48 +374,30 @@ type SandboxInfo struct {
 	IP        string    `json:"ip,omitempty"`
 	Uptime    string    `json:"uptime"`
 	SocketOK  bool      `json:"socket_ok"`
+
+	// The pod the sandbox runs, from containerd (see addPodLabels)
+	Pod       string            `json:"pod,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	// The containerd sandbox and namespace of the shim running it
+	shimID        string
+	shimNamespace string
 }
 
 func (cli *CLI) cmdList(ctx context.Context, args []string) error {
-	sandboxes, err := cli.discoverSandboxes()
+	sel, rest, err := parseSelection(args)
 	if err != nil {
-		return fmt.Errorf("failed to discover sandboxes: %w", err)
-	}
-
-	if cli.output == "json" {
-		return json.NewEncoder(os.Stdout).Encode(sandboxes)
-	}
-
-	if len(sandboxes) == 0 {
-		fmt.Println("No sandboxes found")
-		return nil
+		return err
 	}
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	if cli.output == "wide" {
-		fmt.Fprintln(w, "ID\tSTATE\tPID\tVCPUs\tMEMORY\tIP\tUPTIME\tSOCKET")
-	} else {
-		fmt.Fprintln(w, "ID\tSTATE\tPID\tUPTIME\tSOCKET")
+	opts, err := parseListOptions(rest)
+	if err != nil {
+		return err
 	}
-
-	for _, sb := range sandboxes {
-		socketStatus := "No"
-		if sb.SocketOK {
-			socketStatus = "Yes"
-		}
-
-		if cli.output == "wide" {
-			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%dMB\t%s\t%s\t%s\n",
-				sb.ID, sb.State, sb.PID, sb.VCPUs, sb.MemoryMB, sb.IP, sb.Uptime, socketStatus)
-		} else {
-			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
-				sb.ID, sb.State, sb.PID, sb.Uptime, socketStatus)
-		}
+	if opts.watch {
+		return cli.watchList(ctx, sel, opts)
 	}
-	w.Flush()
-
-	fmt.Printf("\nTotal: %d sandbox(es)\n", len(sandboxes))
-	return nil
+	return cli.printList(ctx, sel, opts)
 }
 
 func (cli *CLI) discoverSandboxes() ([]SandboxInfo, error) {
@@ -257,7 +411,9 @@ func (cli *CLI) discoverSandboxes() ([]SandboxInfo, error) {
 
 	var sandboxes []SandboxInfo
 	for _, entry := range entries {
-		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "fc-") {
+		// Sandboxes in a runtime dir class are links to their directory
+		isDir := entry.IsDir() || entry.Type()&os.ModeSymlink != 0
+		if !isDir || !strings.HasPrefix(entry.Name(), "fc-") {
 			continue
 		}
 
@@ -315,6 +471,8 @@ func (cli *CLI) getSandboxInfo(id string) SandboxInfo {
 		}
 	}
 
+	info.shimID, info.shimNamespace, info.IP = readShimState(sandboxDir)
+
 	// Get directory creation time for uptime
 	if stat, err := os.Stat(sandboxDir); err == nil {
 		info.CreatedAt = stat.ModTime()
@@ -330,8 +488,9 @@ type VMState struct {
 	MemoryMB int    `json:"mem_size_mib"`
 }
 
-func (cli *CLI) getVMState(socketPath string) (*VMState, error) {
-	client := &http.Client{
+// firecrackerClient returns an HTTP client for a VM's Firecracker API socket.
+func firecrackerClient(socketPath string) *http.Client {
+	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				return net.Dial("unix", socketPath)
@@ -339,8 +498,10 @@ func (cli *CLI) getVMState(socketPath string) (*VMState, error) {
 		},
 		Timeout: 2 * time.Second,
 	}
+}
 
-	resp, err := client.Get("http://localhost/")
+func (cli *CLI) getVMState(socketPath string) (*VMState, error) {
+	resp, err := firecrackerClient(socketPath).Get("http://localhost/")
 	if err != nil {
 		return nil, err
 	}
@@ -365,6 +526,8 @@ type DetailedSandboxInfo struct {
 	VsockCID   uint32            `json:"vsock_cid"`
 	Drives     []DriveInfo       `json:"drives,omitempty"`
 	Network    *NetworkInfo      `json:"network,omitempty"`
+	Interfaces []InterfaceInfo   `json:"interfaces,omitempty"`
+	Routes     []RouteInfo       `json:"routes,omitempty"`
 	Agent      *AgentInfo        `json:"agent,omitempty"`
 	Metadata   map[string]string `json:"metadata,omitempty"`
 }
@@ -377,21 +540,121 @@ type DriveInfo struct {
 }
 
 type NetworkInfo struct {
-	IP        string `json:"ip"`
-	Gateway   string `json:"gateway"`
+	IP        string   `json:"ip"`
+	IPs       []string `json:"ips,omitempty"` // Every address, the primary first
+	Gateway   string   `json:"gateway"`
+	Interface string   `json:"interface"`
+	Namespace string   `json:"namespace"`
+
+	// How the sandbox is attached to the node, for correlating its tap
+	// and veth with the pod
+	HostInterface string `json:"host_interface,omitempty"` // CNI interface in Namespace
+	HostMAC       string `json:"host_mac,omitempty"`
+	Tap           string `json:"tap,omitempty"`
+	VethPeer      string `json:"veth_peer,omitempty"`
+	MAC           string `json:"mac,omitempty"` // Of the guest's Interface
+}
+
+// RouteInfo is a route in the guest's routing table.
+type RouteInfo struct {
+	Dst       string `json:"dst"`
+	GW        string `json:"gw,omitempty"`
 	Interface string `json:"interface"`
-	Namespace string `json:"namespace"`
+}
+
+// InterfaceInfo is a VM network interface and its current rate limits.
+type InterfaceInfo struct {
+	ID        string       `json:"id"`
+	HostDev   string       `json:"host_dev"`
+	GuestMAC  string       `json:"guest_mac,omitempty"`
+	RXLimiter *RateLimiter `json:"rx_rate_limiter,omitempty"`
+	TXLimiter *RateLimiter `json:"tx_rate_limiter,omitempty"`
+}
+
+// RateLimiter and TokenBucket mirror the Firecracker API objects.
+type RateLimiter struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+type TokenBucket struct {
+	Size         int64 `json:"size"`
+	RefillTimeMs int64 `json:"refill_time"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+}
+
+// perSecond returns the sustained rate of a bucket.
+func (b *TokenBucket) perSecond() float64 {
+	if b == nil || b.RefillTimeMs <= 0 {
+		return 0
+	}
+	return float64(b.Size) * 1000 / float64(b.RefillTimeMs)
+}
+
+// String formats a rate limiter for display, e.g. "100.0 Mbit/s, 5000 pps".
+func (l *RateLimiter) String() string {
+	if l == nil || (l.Bandwidth == nil && l.Ops == nil) {
+		return "unlimited"
+	}
+	var parts []string
+	if l.Bandwidth != nil {
+		parts = append(parts, fmt.Sprintf("%.1f Mbit/s", l.Bandwidth.perSecond()*8/1e6))
+	}
+	if l.Ops != nil {
+		parts = append(parts, fmt.Sprintf("%.0f pps", l.Ops.perSecond()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// getInterfaces reads a VM's network interfaces from its Firecracker
+// configuration.
+func getInterfaces(socketPath string) ([]InterfaceInfo, error) {
+	resp, err := firecrackerClient(socketPath).Get("http://localhost/vm/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /vm/config: %s", resp.Status)
+	}
+
+	var config struct {
+		Interfaces []struct {
+			ID        string       `json:"iface_id"`
+			HostDev   string       `json:"host_dev_name"`
+			GuestMAC  string       `json:"guest_mac"`
+			RXLimiter *RateLimiter `json:"rx_rate_limiter"`
+			TXLimiter *RateLimiter `json:"tx_rate_limiter"`
+		} `json:"network-interfaces"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]InterfaceInfo, 0, len(config.Interfaces))
+	for _, iface := range config.Interfaces {
+		interfaces = append(interfaces, InterfaceInfo(iface))
+	}
+	return interfaces, nil
 }
 
 type AgentInfo struct {
-	Connected bool   `json:"connected"`
-	Version   string `json:"version,omitempty"`
-	Latency   string `json:"latency,omitempty"`
+	Connected bool     `json:"connected"`
+	Version   string   `json:"version,omitempty"`
+	Protocol  string   `json:"protocol_version,omitempty"`
+	Features  []string `json:"features,omitempty"`
+	BootTime  string   `json:"boot_time,omitempty"`
+	Runtime   string   `json:"runtime,omitempty"`
+	Latency   string   `json:"latency,omitempty"`
 }
 
 func (cli *CLI) cmdInspect(ctx context.Context, args []string) error {
+	sel, args, err := parseSelection(args)
+	if err != nil {
+		return err
+	}
 	if len(args) < 1 {
-		return fmt.Errorf("usage: fcctl inspect <sandbox-id>")
+		return fmt.Errorf("usage: fcctl inspect <sandbox-id> [--filter <expr>] [--jsonpath <template>]")
 	}
 
 	id := args[0]
@@ -413,8 +676,32 @@ func (cli *CLI) cmdInspect(ctx context.Context, args []string) error {
 		_ = json.Unmarshal(data, &info.Metadata)
 	}
 
+	// The sandbox's addresses, as the shim recorded them
+	info.Network = readNetworkInfo(sandboxDir)
+
+	// Read network interfaces and their rate limits
+	if info.SocketOK {
+		if interfaces, err := getInterfaces(info.SocketPath); err == nil {
+			info.Interfaces = interfaces
+		}
+	}
+
 	// Test agent connection
 	info.Agent = cli.testAgentConnection(info.VsockPath)
+	if info.Agent.Connected {
+		info.Routes = queryGuestRoutes(info.VsockPath)
+	}
+
+	// A sandbox the filter rejects fails the command, so scripts can test
+	// it: fcctl inspect <id> --filter state=dead && ...
+	if ok, err := sel.match(info); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("sandbox %s does not match the filter", id)
+	}
+	if printed, err := sel.print(os.Stdout, info); printed {
+		return err
+	}
 
 	if cli.output == "json" {
 		enc := json.NewEncoder(os.Stdout)
@@ -443,14 +730,63 @@ func (cli *CLI) cmdInspect(ctx context.Context, args []string) error {
 		if info.Agent.Latency != "" {
 			fmt.Printf("Latency:     %s\n", info.Agent.Latency)
 		}
+		if info.Agent.Version != "" {
+			fmt.Printf("Version:     %s (protocol %s)\n", info.Agent.Version, info.Agent.Protocol)
+			fmt.Printf("Features:    %s\n", strings.Join(info.Agent.Features, ", "))
+			fmt.Printf("Booted:      %s\n", info.Agent.BootTime)
+			if info.Agent.Runtime != "" {
+				fmt.Printf("Runtime:     %s\n", info.Agent.Runtime)
+			}
+		}
 	}
 
 	if info.Network != nil {
 		fmt.Println()
 		fmt.Println("=== Network ===")
 		fmt.Printf("IP:          %s\n", info.Network.IP)
+		for _, address := range info.Network.IPs[1:] {
+			fmt.Printf("             %s\n", address)
+		}
 		fmt.Printf("Gateway:     %s\n", info.Network.Gateway)
 		fmt.Printf("Interface:   %s\n", info.Network.Interface)
+		if info.Network.MAC != "" {
+			fmt.Printf("MAC:         %s\n", info.Network.MAC)
+		}
+		if info.Network.Namespace != "" {
+			fmt.Printf("Netns:       %s\n", info.Network.Namespace)
+			fmt.Printf("CNI Iface:   %s %s\n", info.Network.HostInterface, info.Network.HostMAC)
+			fmt.Printf("Tap:         %s\n", info.Network.Tap)
+		}
+		if info.Network.VethPeer != "" {
+			fmt.Printf("Veth Peer:   %s\n", info.Network.VethPeer)
+		}
+	}
+
+	if len(info.Interfaces) > 0 {
+		fmt.Println()
+		fmt.Println("=== Network Interfaces ===")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tHOST DEVICE\tGUEST MAC\tRX LIMIT\tTX LIMIT")
+		for _, iface := range info.Interfaces {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				iface.ID, iface.HostDev, iface.GuestMAC, iface.RXLimiter, iface.TXLimiter)
+		}
+		w.Flush()
+	}
+
+	if len(info.Routes) > 0 {
+		fmt.Println()
+		fmt.Println("=== Guest Routes ===")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tGATEWAY\tINTERFACE")
+		for _, route := range info.Routes {
+			gw := route.GW
+			if gw == "" {
+				gw = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", route.Dst, gw, route.Interface)
+		}
+		w.Flush()
 	}
 
 	return nil
@@ -460,7 +796,7 @@ func (cli *CLI) testAgentConnection(vsockPath string) *AgentInfo {
 	info := &AgentInfo{Connected: false}
 
 	// Try to connect to vsock and send ping
-	conn, err := net.DialTimeout("unix", vsockPath, 2*time.Second)
+	conn, err := dialAgent(vsockPath, 2*time.Second)
 	if err != nil {
 		return info
 	}
@@ -487,21 +823,115 @@ func (cli *CLI) testAgentConnection(vsockPath string) *AgentInfo {
 	info.Connected = true
 	info.Latency = time.Since(start).String()
 
+	// Agents that predate get_info answer with an error and no result
+	req["method"] = "get_info"
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return info
+	}
+	var infoResp struct {
+		Result struct {
+			Version        string   `json:"version"`
+			Protocol       string   `json:"protocol_version"`
+			Features       []string `json:"features"`
+			BootTime       string   `json:"boot_time"`
+			Runtime        string   `json:"runtime"`
+			RuntimeVersion string   `json:"runtime_version"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(conn).Decode(&infoResp); err == nil {
+		info.Version = infoResp.Result.Version
+		info.Protocol = infoResp.Result.Protocol
+		info.Features = infoResp.Result.Features
+		info.BootTime = infoResp.Result.BootTime
+		info.Runtime = strings.TrimSpace(infoResp.Result.Runtime + " " + infoResp.Result.RuntimeVersion)
+	}
+
 	return info
 }
 
+// readNetworkInfo returns the addresses and network attachment the shim
+// recorded in a sandbox's state, or nil for sandboxes without a network.
+func readNetworkInfo(sandboxDir string) *NetworkInfo {
+	var state struct {
+		Sandbox struct {
+			IPs     []string `json:"ips"`
+			Gateway string   `json:"gateway"`
+			Network struct {
+				NetNS    string `json:"netns"`
+				IfName   string `json:"ifname"`
+				IfMAC    string `json:"if_mac"`
+				Tap      string `json:"tap"`
+				VethPeer string `json:"veth_peer"`
+				GuestMAC string `json:"guest_mac"`
+			} `json:"network"`
+		} `json:"sandbox"`
+	}
+	data, err := os.ReadFile(filepath.Join(sandboxDir, "state.json"))
+	if err != nil || json.Unmarshal(data, &state) != nil || len(state.Sandbox.IPs) == 0 {
+		return nil
+	}
+	ip, _, _ := strings.Cut(state.Sandbox.IPs[0], "/")
+	n := state.Sandbox.Network
+	return &NetworkInfo{
+		IP:            ip,
+		IPs:           state.Sandbox.IPs,
+		Gateway:       state.Sandbox.Gateway,
+		Interface:     "eth0",
+		Namespace:     n.NetNS,
+		HostInterface: n.IfName,
+		HostMAC:       n.IfMAC,
+		Tap:           n.Tap,
+		VethPeer:      n.VethPeer,
+		MAC:           n.GuestMAC,
+	}
+}
+
+// queryGuestRoutes asks the agent for the guest's routing table. It returns
+// nil if the agent can't be reached or is too old to report routes.
+func queryGuestRoutes(vsockPath string) []RouteInfo {
+	conn, err := dialAgent(vsockPath, 2*time.Second)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"id":     1,
+		"method": "get_routes",
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var resp struct {
+		Result struct {
+			Routes []RouteInfo `json:"routes"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil
+	}
+	return resp.Result.Routes
+}
+
 // =============================================================================
 // Pool Command
 // =============================================================================
 
 type PoolStatus struct {
 	Available   int     `json:"available"`
+	Warming     int     `json:"warming"`
+	Degraded    int     `json:"degraded"`
 	InUse       int     `json:"in_use"`
 	MaxSize     int     `json:"max_size"`
 	TotalServed int64   `json:"total_served"`
 	HitRate     float64 `json:"hit_rate"`
 	PoolHits    int64   `json:"pool_hits"`
 	PoolMisses  int64   `json:"pool_misses"`
+
+	ReservedVCPUs    int64 `json:"reserved_vcpus"`
+	ReservedMemoryMB int64 `json:"reserved_memory_mb"`
 }
 
 func (cli *CLI) cmdPool(ctx context.Context, args []string) error {
@@ -517,38 +947,25 @@ func (cli *CLI) cmdPool(ctx context.Context, args []string) error {
 		return cli.cmdPoolWarm(ctx, args[1:])
 	case "drain":
 		return cli.cmdPoolDrain(ctx)
+	case "inspect":
+		return cli.cmdPoolInspect(ctx, args[1:])
+	case "reservation":
+		return cli.cmdPoolReservation(ctx)
+	case "annotate-node":
+		return cli.cmdPoolAnnotateNode(ctx, args[1:])
 	default:
 		return fmt.Errorf("unknown pool command: %s", subCmd)
 	}
 }
 
 func (cli *CLI) cmdPoolStatus(ctx context.Context) error {
-	// Try to get pool stats from metrics endpoint
-	resp, err := http.Get(cli.metricsAddress)
+	status, err := cli.poolStatusFromAPI(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot connect to metrics endpoint: %w", err)
+		return fmt.Errorf("failed to get pool status: %w", err)
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	metrics := string(body)
-
-	status := PoolStatus{}
-
-	// Parse Prometheus metrics
-	for _, line := range strings.Split(metrics, "\n") {
-		if strings.HasPrefix(line, "fc_cri_pool_available ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_available %d", &status.Available)
-		} else if strings.HasPrefix(line, "fc_cri_pool_in_use ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_in_use %d", &status.InUse)
-		} else if strings.HasPrefix(line, "fc_cri_pool_max_size ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_max_size %d", &status.MaxSize)
-		} else if strings.HasPrefix(line, "fc_cri_pool_hits_total ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_hits_total %d", &status.PoolHits)
-		} else if strings.HasPrefix(line, "fc_cri_pool_misses_total ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_misses_total %d", &status.PoolMisses)
-		} else if strings.HasPrefix(line, "fc_cri_pool_hit_rate ") {
-			_, _ = fmt.Sscanf(line, "fc_cri_pool_hit_rate %f", &status.HitRate)
+	if status == nil {
+		if status, err = cli.poolStatusFromMetrics(); err != nil {
+			return err
 		}
 	}
 
@@ -558,11 +975,16 @@ func (cli *CLI) cmdPoolStatus(ctx context.Context) error {
 
 	fmt.Println("=== VM Pool Status ===")
 	fmt.Printf("Available:    %d\n", status.Available)
+	if status.Warming > 0 || status.Degraded > 0 {
+		fmt.Printf("Warming:      %d\n", status.Warming)
+		fmt.Printf("Degraded:     %d\n", status.Degraded)
+	}
 	fmt.Printf("In Use:       %d\n", status.InUse)
 	fmt.Printf("Max Size:     %d\n", status.MaxSize)
 	fmt.Printf("Hit Rate:     %.1f%%\n", status.HitRate)
 	fmt.Printf("Pool Hits:    %d\n", status.PoolHits)
 	fmt.Printf("Pool Misses:  %d\n", status.PoolMisses)
+	fmt.Printf("Reserved:     %d vCPU, %d MiB\n", status.ReservedVCPUs, status.ReservedMemoryMB)
 
 	// Visual bar
 	if status.MaxSize > 0 {
@@ -580,27 +1002,42 @@ func (cli *CLI) cmdPoolStatus(ctx context.Context) error {
 	return nil
 }
 
-func (cli *CLI) cmdPoolWarm(ctx context.Context, args []string) error {
-	count := 1
-	if len(args) > 0 {
-		var err error
-		count, err = strconv.Atoi(args[0])
-		if err != nil {
-			return fmt.Errorf("invalid count: %s", args[0])
-		}
+// poolStatusFromMetrics reads the pool's status from the metrics endpoint,
+// for runtimes that don't serve the runtime API.
+func (cli *CLI) poolStatusFromMetrics() (*PoolStatus, error) {
+	resp, err := http.Get(cli.metricsAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to metrics endpoint: %w", err)
 	}
+	defer resp.Body.Close()
 
-	fmt.Printf("Warming pool with %d VM(s)...\n", count)
-	fmt.Println("Note: This requires the runtime to be running and is not yet implemented in fcctl.")
-	fmt.Println("Use the runtime's pool configuration to manage warming.")
+	body, _ := io.ReadAll(resp.Body)
+	metrics := string(body)
 
-	return nil
-}
+	status := &PoolStatus{}
 
-func (cli *CLI) cmdPoolDrain(ctx context.Context) error {
-	fmt.Println("Draining pool...")
-	fmt.Println("Note: This requires the runtime to be running and is not yet implemented in fcctl.")
-	return nil
+	// Parse Prometheus metrics
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, "fc_cri_pool_available ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_available %d", &status.Available)
+		} else if strings.HasPrefix(line, "fc_cri_pool_in_use ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_in_use %d", &status.InUse)
+		} else if strings.HasPrefix(line, "fc_cri_pool_max_size ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_max_size %d", &status.MaxSize)
+		} else if strings.HasPrefix(line, "fc_cri_pool_hits_total ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_hits_total %d", &status.PoolHits)
+		} else if strings.HasPrefix(line, "fc_cri_pool_misses_total ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_misses_total %d", &status.PoolMisses)
+		} else if strings.HasPrefix(line, "fc_cri_pool_hit_rate ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_hit_rate %f", &status.HitRate)
+		} else if strings.HasPrefix(line, "fc_cri_pool_reserved_vcpus ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_reserved_vcpus %d", &status.ReservedVCPUs)
+		} else if strings.HasPrefix(line, "fc_cri_pool_reserved_memory_mb ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_reserved_memory_mb %d", &status.ReservedMemoryMB)
+		}
+	}
+
+	return status, nil
 }
 
 // =============================================================================
@@ -618,12 +1055,12 @@ func (cli *CLI) cmdMetrics(ctx context.Context, args []string) error {
 
 	if cli.output == "json" {
 		// Convert Prometheus format to JSON
-		metrics := parsePrometheusMetrics(string(body))
-		return json.NewEncoder(os.Stdout).Encode(metrics)
+		parsed := parsePrometheusMetrics(string(body))
+		return json.NewEncoder(os.Stdout).Encode(parsed)
 	}
 
 	// Pretty print key metrics
-	metrics := string(body)
+	text := string(body)
 
 	fmt.Println("=== Firecracker CRI Metrics ===")
 	fmt.Println()
@@ -641,16 +1078,6 @@ func (cli *CLI) cmdMetrics(ctx context.Context, args []string) error {
 				"fc_cri_pool_hit_rate",
 			},
 		},
-		{
-			title: "Latencies (ms)",
-			metrics: []string{
-				"fc_cri_create_latency_p50_ms",
-				"fc_cri_create_latency_p95_ms",
-				"fc_cri_create_latency_p99_ms",
-				"fc_cri_start_latency_p50_ms",
-				"fc_cri_start_latency_p95_ms",
-			},
-		},
 		{
 			title: "Counters",
 			metrics: []string{
@@ -680,7 +1107,7 @@ func (cli *CLI) cmdMetrics(ctx context.Context, args []string) error {
 	for _, section := range sections {
 		fmt.Printf("--- %s ---\n", section.title)
 		for _, metricName := range section.metrics {
-			value := extractMetricValue(metrics, metricName)
+			value := extractMetricValue(text, metricName)
 			displayName := strings.TrimPrefix(metricName, "fc_cri_")
 			displayName = strings.ReplaceAll(displayName, "_", " ")
 			fmt.Printf("  %-30s %s\n", displayName+":", value)
@@ -688,9 +1115,66 @@ func (cli *CLI) cmdMetrics(ctx context.Context, args []string) error {
 		fmt.Println()
 	}
 
+	fmt.Println("--- In Flight ---")
+	for _, op := range []string{
+		metrics.InFlightCreate, metrics.InFlightStart, metrics.InFlightImageConversion,
+		metrics.InFlightSnapshotRestore, metrics.InFlightAgentRPC,
+	} {
+		value := extractMetricValue(text, `fc_cri_operations_in_flight{operation="`+op+`"}`)
+		fmt.Printf("  %-30s %s\n", strings.ReplaceAll(op, "_", " ")+":", value)
+	}
+	fmt.Println()
+
+	// Latency percentiles are estimated from the histogram buckets
+	fmt.Println("--- Latencies (ms) ---")
+	for _, op := range []string{"create", "start", "stop", "delete"} {
+		bounds, cumulative := extractHistogram(text, "fc_cri_operation_duration_seconds", `operation="`+op+`"`)
+		if len(cumulative) == 0 {
+			fmt.Printf("  %-30s N/A\n", op+":")
+			continue
+		}
+		fmt.Printf("  %-30s p50 %.1f  p95 %.1f  p99 %.1f\n", op+":",
+			metrics.BucketQuantile(0.50, bounds, cumulative)*1000,
+			metrics.BucketQuantile(0.95, bounds, cumulative)*1000,
+			metrics.BucketQuantile(0.99, bounds, cumulative)*1000)
+	}
+	fmt.Println()
+
 	return nil
 }
 
+// extractHistogram returns the finite bucket bounds and cumulative counts
+// (with +Inf last) of a histogram series with the given labels.
+func extractHistogram(body, name, labels string) ([]float64, []uint64) {
+	prefix := name + "_bucket{" + labels + `,le="`
+
+	var bounds []float64
+	var cumulative []uint64
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(line, prefix)
+		le, value, ok := strings.Cut(rest, `"} `)
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		if le != "+Inf" {
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				continue
+			}
+			bounds = append(bounds, bound)
+		}
+		cumulative = append(cumulative, count)
+	}
+	return bounds, cumulative
+}
+
 func parsePrometheusMetrics(body string) map[string]interface{} {
 	result := make(map[string]interface{})
 	for _, line := range strings.Split(body, "\n") {
@@ -722,70 +1206,14 @@ func extractMetricValue(metrics, name string) string {
 // =============================================================================
 
 func (cli *CLI) cmdLogs(ctx context.Context, args []string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("usage: fcctl logs <sandbox-id> [-f]")
-	}
-
-	id := args[0]
-	follow := false
-	if len(args) > 1 && (args[1] == "-f" || args[1] == "--follow") {
-		follow = true
-	}
-
-	sandboxDir := filepath.Join(cli.runDir, id)
-	logFile := filepath.Join(sandboxDir, "firecracker.log")
-
-	if _, err := os.Stat(logFile); os.IsNotExist(err) {
-		// Try alternate log location
-		logFile = filepath.Join(sandboxDir, "vmm.log")
-		if _, err := os.Stat(logFile); os.IsNotExist(err) {
-			return fmt.Errorf("no log file found for sandbox %s", id)
-		}
-	}
-
-	if follow {
-		return cli.tailFile(ctx, logFile)
-	}
-
-	data, err := os.ReadFile(logFile)
-	if err != nil {
-		return fmt.Errorf("failed to read log file: %w", err)
-	}
-
-	fmt.Print(string(data))
-	return nil
-}
-
-func (cli *CLI) tailFile(ctx context.Context, path string) error {
-	file, err := os.Open(path)
+	ids, opts, err := parseLogsOptions(args)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Seek to end
-	_, _ = file.Seek(0, io.SeekEnd)
-
-	buf := make([]byte, 4096)
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
-
-		n, err := file.Read(buf)
-		if n > 0 {
-			os.Stdout.Write(buf[:n])
-		}
-		if err == io.EOF {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-		if err != nil {
-			return err
-		}
+	if ids, err = cli.logSandboxes(ctx, ids, opts); err != nil {
+		return err
 	}
+	return cli.showLogs(ctx, ids, opts)
 }
 
 // =============================================================================
@@ -807,9 +1235,9 @@ func (cli *CLI) cmdExec(ctx context.Context, args []string) error {
 		return fmt.Errorf("vsock not found for sandbox %s", id)
 	}
 
-	conn, err := net.DialTimeout("unix", vsockPath, 5*time.Second)
+	conn, err := dialAgent(vsockPath, 5*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to connect to agent: %w", err)
+		return err
 	}
 	defer conn.Close()
 
@@ -871,10 +1299,61 @@ type HealthStatus struct {
 	Healthy    bool              `json:"healthy"`
 	Components map[string]string `json:"components"`
 	Issues     []string          `json:"issues,omitempty"`
+	Seccomp    map[string]string `json:"seccomp,omitempty"`
 	CheckedAt  time.Time         `json:"checked_at"`
 }
 
 func (cli *CLI) cmdHealth(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] == "--doctor" {
+		return cli.cmdDoctor(ctx, args[1:])
+	}
+	status := cli.checkHealth()
+
+	if cli.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+
+	// Print status
+	if status.Healthy {
+		fmt.Println("[OK] Runtime is healthy")
+	} else {
+		fmt.Println("[ERR] Runtime has issues")
+	}
+	fmt.Println()
+
+	fmt.Println("Components:")
+	for name, state := range status.Components {
+		statusStr := "[OK] "
+		if state != "ok" {
+			statusStr = "[ERR]"
+		}
+		fmt.Printf("  %s %-20s %s\n", statusStr, name, state)
+	}
+
+	if len(status.Issues) > 0 {
+		fmt.Println()
+		fmt.Println("Issues:")
+		for _, issue := range status.Issues {
+			fmt.Printf("  - %s\n", issue)
+		}
+	}
+
+	if len(status.Seccomp) > 0 {
+		fmt.Println()
+		fmt.Println("Seccomp:")
+		for id, level := range status.Seccomp {
+			fmt.Printf("  %s  %s\n", id, level)
+		}
+	}
+
+	return nil
+}
+
+// checkHealth checks the node's runtime prerequisites and the seccomp
+// confinement of its VMs.
+func (cli *CLI) checkHealth() HealthStatus {
 	status := HealthStatus{
 		Healthy:    true,
 		Components: make(map[string]string),
@@ -935,74 +1414,212 @@ func (cli *CLI) cmdHealth(ctx context.Context, args []string) error {
 		status.Components["rootfs"] = "ok"
 	}
 
-	if cli.output == "json" {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(status)
+	// Check each running VM's seccomp level
+	sandboxes, _ := cli.discoverSandboxes()
+	for _, sb := range sandboxes {
+		if sb.PID <= 0 {
+			continue
+		}
+		level, active, err := vmSeccomp(sb.PID)
+		if err != nil {
+			continue
+		}
+		if status.Seccomp == nil {
+			status.Seccomp = make(map[string]string)
+		}
+		status.Seccomp[sb.ID] = level
+		switch {
+		case level == "disabled":
+			status.Issues = append(status.Issues, fmt.Sprintf("VM %s is running without seccomp", sb.ID))
+		case !active:
+			status.Seccomp[sb.ID] = level + ", not enforced"
+			status.Issues = append(status.Issues, fmt.Sprintf("VM %s should be confined by seccomp, but is not", sb.ID))
+			status.Healthy = false
+		}
 	}
 
-	// Print status
-	if status.Healthy {
-		fmt.Println("[OK] Runtime is healthy")
-	} else {
-		fmt.Println("[ERR] Runtime has issues")
+	return status
+}
+
+// vmSeccomp returns the seccomp level a Firecracker process was started
+// with, and whether the kernel is filtering its syscalls.
+func vmSeccomp(pid int) (string, bool, error) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", false, err
 	}
-	fmt.Println()
 
-	fmt.Println("Components:")
-	for name, state := range status.Components {
-		statusStr := "[OK] "
-		if state != "ok" {
-			statusStr = "[ERR]"
+	level := "default"
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	for i, arg := range args {
+		switch {
+		case arg == "--no-seccomp":
+			level = "disabled"
+		case arg == "--seccomp-filter" && i+1 < len(args):
+			level = "custom (" + args[i+1] + ")"
 		}
-		fmt.Printf("  %s %-20s %s\n", statusStr, name, state)
 	}
 
-	if len(status.Issues) > 0 {
-		fmt.Println()
-		fmt.Println("Issues:")
-		for _, issue := range status.Issues {
-			fmt.Printf("  - %s\n", issue)
+	// Seccomp mode 2 is filtering
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return "", false, err
+	}
+	active := false
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Seccomp:") {
+			active = strings.TrimSpace(strings.TrimPrefix(line, "Seccomp:")) == "2"
 		}
 	}
-
-	return nil
+	return level, active, nil
 }
 
 // =============================================================================
 // Kill Command
 // =============================================================================
 
+// cmdKill force kills sandbox VMs: the ones named, every one with --all,
+// or those matching --selector, which takes the expressions of list
+// --filter. Killing more than one sandbox asks first, unless --yes.
 func (cli *CLI) cmdKill(ctx context.Context, args []string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("usage: fcctl kill <sandbox-id>")
+	var ids []string
+	all, yes, dryRun := false, false, false
+	sel := &selection{}
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch name {
+		case "--all", "-a":
+			all = true
+		case "--yes", "-y":
+			yes = true
+		case "--dry-run", "-n":
+			dryRun = true
+		case "--selector", "-l":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return fmt.Errorf("%s requires a value", name)
+				}
+				i++
+				value = args[i]
+			}
+			filters, err := parseFilters(value)
+			if err != nil {
+				return err
+			}
+			sel.filters = append(sel.filters, filters...)
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				return fmt.Errorf("unknown kill flag: %s", args[i])
+			}
+			ids = append(ids, args[i])
+		}
 	}
 
-	id := args[0]
-	sandboxDir := filepath.Join(cli.runDir, id)
-
-	if _, err := os.Stat(sandboxDir); os.IsNotExist(err) {
-		return fmt.Errorf("sandbox not found: %s", id)
+	bulk := all || len(sel.filters) > 0
+	switch {
+	case len(ids) == 0 && !bulk:
+		return fmt.Errorf("usage: fcctl kill <sandbox-id>... | --all | --selector <expr>")
+	case len(ids) > 0 && bulk:
+		return fmt.Errorf("give sandbox IDs, --all or --selector, not several")
+	case all && len(sel.filters) > 0:
+		return fmt.Errorf("--all and --selector are exclusive")
 	}
 
-	info := cli.getSandboxInfo(id)
-
-	if info.PID > 0 {
+	if len(ids) == 1 && !dryRun {
+		id := ids[0]
+		if _, err := os.Stat(filepath.Join(cli.runDir, id)); os.IsNotExist(err) {
+			return fmt.Errorf("sandbox not found: %s", id)
+		}
+		info := cli.getSandboxInfo(id)
+		if info.PID <= 0 {
+			fmt.Println("No running process found for sandbox")
+			return nil
+		}
 		fmt.Printf("Killing sandbox %s (PID %d)...\n", id, info.PID)
-		process, err := os.FindProcess(info.PID)
+		if err := killSandbox(info); err != nil {
+			return err
+		}
+		fmt.Println("Process killed")
+		return nil
+	}
+
+	var targets []SandboxInfo
+	if bulk {
+		sandboxes, err := cli.discoverSandboxes()
 		if err != nil {
-			return fmt.Errorf("failed to find process: %w", err)
+			return fmt.Errorf("failed to discover sandboxes: %w", err)
+		}
+		cli.addPodLabels(ctx, sandboxes)
+		for _, sb := range sandboxes {
+			ok, err := sel.match(sb)
+			if err != nil {
+				return err
+			}
+			if ok {
+				targets = append(targets, sb)
+			}
+		}
+	} else {
+		for _, id := range ids {
+			if _, err := os.Stat(filepath.Join(cli.runDir, id)); os.IsNotExist(err) {
+				return fmt.Errorf("sandbox not found: %s", id)
+			}
+			targets = append(targets, cli.getSandboxInfo(id))
 		}
+	}
 
-		if err := process.Kill(); err != nil {
-			return fmt.Errorf("failed to kill process: %w", err)
+	if len(targets) == 0 {
+		fmt.Println("No sandboxes matched")
+		return nil
+	}
+	fmt.Printf("Found %d sandbox(es) to kill:\n", len(targets))
+	for _, sb := range targets {
+		fmt.Printf("  - %s (state: %s, pid: %d)\n", sb.ID, sb.State, sb.PID)
+	}
+	if dryRun {
+		fmt.Println("\nDry run - no changes made")
+		return nil
+	}
+	if !yes {
+		fmt.Print("\nKill these sandboxes? [y/N] ")
+		var response string
+		_, _ = fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Aborted")
+			return nil
 		}
+	}
 
-		fmt.Println("Process killed")
-	} else {
-		fmt.Println("No running process found for sandbox")
+	killed, failed := 0, 0
+	for _, sb := range targets {
+		if sb.PID <= 0 || sb.State == "dead" {
+			fmt.Printf("  Skipped %s (not running)\n", sb.ID)
+			continue
+		}
+		if err := killSandbox(sb); err != nil {
+			fmt.Printf("  Failed to kill %s: %v\n", sb.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  Killed %s (PID %d)\n", sb.ID, sb.PID)
+		killed++
+	}
+	fmt.Printf("Killed %d of %d sandbox(es)\n", killed, len(targets))
+	if failed > 0 {
+		return fmt.Errorf("failed to kill %d sandbox(es)", failed)
 	}
+	return nil
+}
 
+// killSandbox kills a sandbox's VM process.
+func killSandbox(sb SandboxInfo) error {
+	process, err := os.FindProcess(sb.PID)
+	if err != nil {
+		return fmt.Errorf("failed to find process: %w", err)
+	}
+	if err := process.Kill(); err != nil {
+		return fmt.Errorf("failed to kill process: %w", err)
+	}
 	return nil
 }
 
@@ -1010,11 +1627,34 @@ func (cli *CLI) cmdKill(ctx context.Context, args []string) error {
 // Cleanup Command
 // =============================================================================
 
+// cmdCleanup removes the directories of sandboxes whose VM is dead or
+// unresponsive. --older-than leaves those created more recently alone, so
+// sandboxes still starting after an incident aren't taken for orphans.
 func (cli *CLI) cmdCleanup(ctx context.Context, args []string) error {
-	dryRun := false
-	for _, arg := range args {
-		if arg == "--dry-run" || arg == "-n" {
+	dryRun, yes := false, false
+	var olderThan time.Duration
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch name {
+		case "--dry-run", "-n":
 			dryRun = true
+		case "--yes", "-y":
+			yes = true
+		case "--older-than":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return fmt.Errorf("--older-than requires a value")
+				}
+				i++
+				value = args[i]
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid --older-than %q", value)
+			}
+			olderThan = d
+		default:
+			return fmt.Errorf("unknown cleanup flag: %s", args[i])
 		}
 	}
 
@@ -1027,9 +1667,13 @@ func (cli *CLI) cmdCleanup(ctx context.Context, args []string) error {
 
 	var orphaned []SandboxInfo
 	for _, sb := range sandboxes {
-		if sb.State == "dead" || sb.State == "unknown" {
-			orphaned = append(orphaned, sb)
+		if sb.State != "dead" && sb.State != "unknown" {
+			continue
+		}
+		if olderThan > 0 && time.Since(sb.CreatedAt) < olderThan {
+			continue
 		}
+		orphaned = append(orphaned, sb)
 	}
 
 	if len(orphaned) == 0 {
@@ -1047,14 +1691,16 @@ func (cli *CLI) cmdCleanup(ctx context.Context, args []string) error {
 		return nil
 	}
 
-	fmt.Println()
-	fmt.Print("Clean up these resources? [y/N] ")
+	if !yes {
+		fmt.Println()
+		fmt.Print("Clean up these resources? [y/N] ")
 
-	var response string
-	_, _ = fmt.Scanln(&response)
-	if response != "y" && response != "Y" {
-		fmt.Println("Aborted")
-		return nil
+		var response string
+		_, _ = fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Aborted")
+			return nil
+		}
 	}
 
 	for _, sb := range orphaned {
@@ -1067,7 +1713,10 @@ func (cli *CLI) cmdCleanup(ctx context.Context, args []string) error {
 			}
 		}
 
-		// Remove directory
+		// Remove directory, and the one it links to in a runtime dir class
+		if target, err := os.Readlink(sandboxDir); err == nil {
+			_ = os.RemoveAll(target)
+		}
 		if err := os.RemoveAll(sandboxDir); err != nil {
 			fmt.Printf("  Failed to remove %s: %v\n", sb.ID, err)
 		} else {
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVMM is a stand-in for a sandbox's Firecracker process.
+type fakeVMM struct {
+	pid  int
+	done chan struct{} // Closed when the process exits
+}
+
+// startVMM starts a fake VMM, killed when the test ends.
+func startVMM(t *testing.T) *fakeVMM {
+	t.Helper()
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	vmm := &fakeVMM{pid: cmd.Process.Pid, done: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		close(vmm.done)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-vmm.done
+	})
+	return vmm
+}
+
+// exitedPID returns the PID of a process that has exited.
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// mkSandbox creates a sandbox directory created age ago, with a PID file
+// if pid is set.
+func mkSandbox(t *testing.T, runDir, id string, pid int, age time.Duration) {
+	t.Helper()
+	dir := filepath.Join(runDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if pid > 0 {
+		mkfile(t, filepath.Join(dir, "firecracker.pid"), strconv.Itoa(pid), 0)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(dir, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exited reports whether a fake VMM has exited, waiting briefly for a
+// kill to land.
+func (vmm *fakeVMM) exited() bool {
+	select {
+	case <-vmm.done:
+		return true
+	case <-time.After(500 * time.Millisecond):
+		return false
+	}
+}
+
+func TestCmdKill_Flags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{nil, "usage: fcctl kill"},
+		{[]string{"--yes"}, "usage: fcctl kill"},
+		{[]string{"fc-1", "--all"}, "not several"},
+		{[]string{"fc-1", "--selector", "state=dead"}, "not several"},
+		{[]string{"--all", "--selector", "state=dead"}, "exclusive"},
+		{[]string{"--selector"}, "--selector requires a value"},
+		{[]string{"-l", "state"}, `invalid filter "state"`},
+		{[]string{"--force", "fc-1"}, "unknown kill flag"},
+		{[]string{"fc-missing"}, "sandbox not found: fc-missing"},
+		{[]string{"fc-1", "fc-missing", "--dry-run"}, "sandbox not found: fc-1"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir()}
+		err := cli.cmdKill(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdKill(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCmdKill_Selector(t *testing.T) {
+	runDir := t.TempDir()
+	web := startVMM(t)
+	db := startVMM(t)
+	mkSandbox(t, runDir, "fc-web-1", web.pid, 0)
+	mkSandbox(t, runDir, "fc-db-1", db.pid, 0)
+	mkSandbox(t, runDir, "fc-web-2", exitedPID(t), 0)
+	cli := &CLI{runDir: runDir}
+
+	// A dry run only lists what would be killed
+	if err := cli.cmdKill(context.Background(), []string{"--selector", "id~web", "--dry-run"}); err != nil {
+		t.Fatalf("cmdKill(--dry-run) error = %v", err)
+	}
+	if web.exited() {
+		t.Fatal("cmdKill(--dry-run) killed a sandbox")
+	}
+
+	// The dead sandbox matches too, and is skipped
+	if err := cli.cmdKill(context.Background(), []string{"--selector=id~web", "--yes"}); err != nil {
+		t.Fatalf("cmdKill(--selector) error = %v", err)
+	}
+	if !web.exited() {
+		t.Error("cmdKill(--selector id~web) did not kill fc-web-1")
+	}
+	if db.exited() {
+		t.Error("cmdKill(--selector id~web) killed fc-db-1")
+	}
+
+	if err := cli.cmdKill(context.Background(), []string{"--selector", "id~cache", "--yes"}); err != nil {
+		t.Errorf("cmdKill() matching nothing = %v", err)
+	}
+}
+
+func TestCmdKill_All(t *testing.T) {
+	runDir := t.TempDir()
+	vmms := []*fakeVMM{startVMM(t), startVMM(t)}
+	mkSandbox(t, runDir, "fc-1", vmms[0].pid, 0)
+	mkSandbox(t, runDir, "fc-2", vmms[1].pid, 0)
+	mkSandbox(t, runDir, "fc-3", 0, 0)
+	// Not a sandbox
+	mkSandbox(t, runDir, "volumes", 0, 0)
+	cli := &CLI{runDir: runDir}
+
+	if err := cli.cmdKill(context.Background(), []string{"-a", "-y"}); err != nil {
+		t.Fatalf("cmdKill(--all) error = %v", err)
+	}
+	for i, vmm := range vmms {
+		if !vmm.exited() {
+			t.Errorf("cmdKill(--all) did not kill fc-%d", i+1)
+		}
+	}
+}
+
+func TestCmdKill_IDs(t *testing.T) {
+	runDir := t.TempDir()
+	a, b := startVMM(t), startVMM(t)
+	mkSandbox(t, runDir, "fc-a", a.pid, 0)
+	mkSandbox(t, runDir, "fc-b", b.pid, 0)
+	cli := &CLI{runDir: runDir}
+
+	if err := cli.cmdKill(context.Background(), []string{"fc-a"}); err != nil {
+		t.Fatalf("cmdKill(fc-a) error = %v", err)
+	}
+	if !a.exited() || b.exited() {
+		t.Error("cmdKill(fc-a) did not kill just fc-a")
+	}
+}
+
+func TestCmdCleanup(t *testing.T) {
+	runDir := t.TempDir()
+	vmm := startVMM(t)
+	mkSandbox(t, runDir, "fc-old", exitedPID(t), 2*time.Hour)
+	mkSandbox(t, runDir, "fc-starting", 0, time.Minute)
+	mkSandbox(t, runDir, "fc-running", vmm.pid, 2*time.Hour)
+
+	// A sandbox in a runtime dir class links to its directory
+	classDir := filepath.Join(t.TempDir(), "fc-linked")
+	mkfile(t, filepath.Join(classDir, "rootfs.img"), "rootfs", 0)
+	if err := os.Symlink(classDir, filepath.Join(runDir, "fc-linked")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(classDir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	cli := &CLI{runDir: runDir}
+
+	remaining := func() []string {
+		entries, err := os.ReadDir(runDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	if err := cli.cmdCleanup(context.Background(), []string{"--dry-run"}); err != nil {
+		t.Fatalf("cmdCleanup(--dry-run) error = %v", err)
+	}
+	if got := strings.Join(remaining(), " "); got != "fc-linked fc-old fc-running fc-starting" {
+		t.Errorf("cmdCleanup(--dry-run) left %s", got)
+	}
+
+	// Sandboxes created in the last hour may still be starting
+	if err := cli.cmdCleanup(context.Background(), []string{"--older-than", "1h", "--yes"}); err != nil {
+		t.Fatalf("cmdCleanup(--older-than) error = %v", err)
+	}
+	if got := strings.Join(remaining(), " "); got != "fc-running fc-starting" {
+		t.Errorf("cmdCleanup(--older-than 1h) left %s, want fc-running fc-starting", got)
+	}
+	if _, err := os.Stat(classDir); !os.IsNotExist(err) {
+		t.Error("cmdCleanup() kept the directory a sandbox links to")
+	}
+
+	if err := cli.cmdCleanup(context.Background(), []string{"--older-than=0s", "-y"}); err != nil {
+		t.Fatalf("cmdCleanup() error = %v", err)
+	}
+	if got := strings.Join(remaining(), " "); got != "fc-running" {
+		t.Errorf("cmdCleanup() left %s, want fc-running", got)
+	}
+	if vmm.exited() {
+		t.Error("cmdCleanup() killed a running sandbox")
+	}
+}
+
+func TestCmdCleanup_Flags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--older-than"}, "--older-than requires a value"},
+		{[]string{"--older-than", "a day"}, "invalid --older-than"},
+		{[]string{"--older-than=-1h"}, "invalid --older-than"},
+		{[]string{"--all"}, "unknown cleanup flag"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir()}
+		err := cli.cmdCleanup(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdCleanup(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
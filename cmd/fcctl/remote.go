@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAdminListen is where `fcctl serve` listens by default. Other
+	// nodes can't reach it until it is given another address, with TLS.
+	defaultAdminListen = "127.0.0.1:9091"
+
+	// adminExecPath runs an fcctl command on the node.
+	adminExecPath = "/v1/exec"
+
+	// exitCodeTrailer carries the exit code of a remote command.
+	exitCodeTrailer = "X-Fcctl-Exit-Code"
+)
+
+// AdminExecRequest is the body of an admin API exec request.
+type AdminExecRequest struct {
+	Args []string `json:"args"`
+}
+
+// remoteExitError reports a non-zero exit of a remote command whose error
+// output has already been shown.
+type remoteExitError struct {
+	code int
+}
+
+func (e *remoteExitError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.code)
+}
+
+// forwardedArgs returns the global flags that must travel with a command
+// run on another node. The run directory is the remote node's own.
+func (cli *CLI) forwardedArgs(cmd string, cmdArgs []string) []string {
+	args := []string{"-o", cli.output}
+	if cli.verbose {
+		args = append(args, "-v")
+	}
+	args = append(args, cmd)
+	return append(args, cmdArgs...)
+}
+
+// runRemote runs a command on the node given by --host or --endpoint.
+func (cli *CLI) runRemote(ctx context.Context, cmd string, cmdArgs []string) error {
+	args := cli.forwardedArgs(cmd, cmdArgs)
+	if cli.host != "" {
+		return runSSH(ctx, cli.host, args)
+	}
+	return cli.runEndpoint(ctx, args)
+}
+
+// runSSH runs fcctl on a node over SSH. host is ssh://[user@]node[:port].
+func runSSH(ctx context.Context, host string, args []string) error {
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return fmt.Errorf("invalid --host %q: want ssh://[user@]node[:port]", host)
+	}
+
+	target := u.Hostname()
+	if u.User != nil {
+		target = u.User.Username() + "@" + target
+	}
+
+	sshArgs := []string{}
+	if port := u.Port(); port != "" {
+		sshArgs = append(sshArgs, "-p", port)
+	}
+	// Allocate a TTY so interactive commands (top, logs -f) behave
+	if isTerminal(os.Stdout) {
+		sshArgs = append(sshArgs, "-t")
+	}
+	sshArgs = append(sshArgs, target, "--", remoteBinary())
+	for _, arg := range args {
+		sshArgs = append(sshArgs, shellQuote(arg))
+	}
+
+	c := exec.CommandContext(ctx, getEnvOrDefault("FC_CRI_SSH", "ssh"), sshArgs...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &remoteExitError{code: exitErr.ExitCode()}
+		}
+		return fmt.Errorf("ssh failed: %w", err)
+	}
+	return nil
+}
+
+// runEndpoint runs a command through a node's admin API, streaming its
+// output as it is produced.
+func (cli *CLI) runEndpoint(ctx context.Context, args []string) error {
+	body, err := json.Marshal(AdminExecRequest{Args: args})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(cli.endpoint, "/") + adminExecPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return fmt.Errorf("invalid --endpoint: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cli.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.adminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to read output: %w", err)
+	}
+
+	code, err := strconv.Atoi(resp.Trailer.Get(exitCodeTrailer))
+	if err != nil {
+		return fmt.Errorf("admin API did not report an exit status")
+	}
+	if code != 0 {
+		return &remoteExitError{code: code}
+	}
+	return nil
+}
+
+// =============================================================================
+// Admin API Server
+// =============================================================================
+
+// cmdServe runs the admin API, which executes fcctl commands on this node
+// on behalf of remote clients.
+func (cli *CLI) cmdServe(ctx context.Context, args []string) error {
+	listen := defaultAdminListen
+	var certFile, keyFile string
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--listen":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--listen requires a value")
+			}
+			i++
+			listen = args[i]
+		case "--tls-cert":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--tls-cert requires a value")
+			}
+			i++
+			certFile = args[i]
+		case "--tls-key":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--tls-key requires a value")
+			}
+			i++
+			keyFile = args[i]
+		default:
+			return fmt.Errorf("unknown serve flag: %s", args[i])
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if cli.adminToken == "" {
+		return fmt.Errorf("FC_CRI_ADMIN_TOKEN must be set to serve the admin API")
+	}
+	if certFile == "" && !isLoopbackListen(listen) {
+		return fmt.Errorf("--listen %s is reachable from other hosts: --tls-cert and --tls-key are required", listen)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate fcctl binary: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminExecPath, cli.handleExec(self))
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Admin API listening on %s\n", listen)
+	if certFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// handleExec runs one fcctl command as a child process and streams its
+// combined output, reporting the exit status in a trailer.
+func (cli *CLI) handleExec(self string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !cli.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req AdminExecRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRemoteArgs(req.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := append([]string{"--run-dir", cli.runDir}, req.Args...)
+		c := exec.CommandContext(r.Context(), self, args...)
+		// Clear remote settings so the child runs locally
+		c.Env = append(os.Environ(), "FC_CRI_METRICS_ADDRESS="+cli.metricsAddress, "FC_CRI_HOST=", "FC_CRI_ENDPOINT=")
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Trailer", exitCodeTrailer)
+		w.WriteHeader(http.StatusOK)
+
+		out := &flushWriter{w: w}
+		if f, ok := w.(http.Flusher); ok {
+			out.f = f
+		}
+		c.Stdout, c.Stderr = out, out
+
+		code := 0
+		if err := c.Run(); err != nil {
+			code = 1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+				code = exitErr.ExitCode()
+			}
+		}
+		w.Header().Set(exitCodeTrailer, strconv.Itoa(code))
+	}
+}
+
+// authorized checks the bearer token of an admin request. Without a token
+// configured, no request is.
+func (cli *CLI) authorized(r *http.Request) bool {
+	if cli.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cli.adminToken)) == 1
+}
+
+// isLoopbackListen reports whether a listen address only accepts
+// connections from this host. An address without a host listens on every
+// interface.
+func isLoopbackListen(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateRemoteArgs rejects requests that would redirect the server to
+// another run directory or node, or start another server.
+func validateRemoteArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--run-dir", "--host", "--endpoint":
+			return fmt.Errorf("%s is not allowed in remote commands", args[i])
+		case "-o", "--output":
+			i++
+			continue
+		}
+		if strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		if args[i] == "serve" {
+			return fmt.Errorf("serve is not allowed in remote commands")
+		}
+		return nil
+	}
+	return fmt.Errorf("no command given")
+}
+
+// flushWriter flushes after every write so output streams to the client.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// =============================================================================
+// Helpers
+// =============================================================================
+
+// remoteBinary is the fcctl binary invoked on nodes reached over SSH.
+func remoteBinary() string {
+	return getEnvOrDefault("FC_CRI_REMOTE_FCCTL", "fcctl")
+}
+
+// shellQuote quotes an argument for the remote shell ssh runs it through.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isTerminal reports whether f is a character device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
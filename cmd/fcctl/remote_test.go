@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateRemoteArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"list"}, ""},
+		{[]string{"-o", "json", "-v", "logs", "fc-1", "-f"}, ""},
+		{[]string{"--output", "wide", "list"}, ""},
+		// The value of --output isn't the command
+		{[]string{"-o", "serve", "list"}, ""},
+		// Flags of the command itself aren't global flags
+		{[]string{"logs", "fc-1", "--host", "x"}, ""},
+		{[]string{"--run-dir", "/tmp", "list"}, "--run-dir is not allowed"},
+		{[]string{"-v", "--host", "ssh://node2", "list"}, "--host is not allowed"},
+		{[]string{"--endpoint", "https://node2:9091", "list"}, "--endpoint is not allowed"},
+		{[]string{"serve"}, "serve is not allowed"},
+		{[]string{"-o", "json", "serve", "--listen", ":9092"}, "serve is not allowed"},
+		{nil, "no command given"},
+		{[]string{"-v", "-o", "json"}, "no command given"},
+		{[]string{"-o"}, "no command given"},
+	}
+	for _, tt := range tests {
+		err := validateRemoteArgs(tt.args)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateRemoteArgs(%q) = %v, want nil", tt.args, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateRemoteArgs(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   bool
+	}{
+		{"matching token", "s3cret", "Bearer s3cret", true},
+		{"wrong token", "s3cret", "Bearer s3cre", false},
+		{"token with suffix", "s3cret", "Bearer s3cretx", false},
+		{"no header", "s3cret", "", false},
+		{"bare token", "s3cret", "s3cret", false},
+		{"other scheme", "s3cret", "Basic s3cret", false},
+		{"empty bearer", "s3cret", "Bearer ", false},
+		{"no token configured", "", "Bearer ", false},
+		{"no token configured, no header", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := &CLI{adminToken: tt.token}
+			r := httptest.NewRequest("POST", adminExecPath, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := cli.authorized(r); got != tt.want {
+				t.Errorf("authorized(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"127.0.0.1:9091", true},
+		{"127.0.0.2:9091", true},
+		{"[::1]:9091", true},
+		{"localhost:9091", true},
+		{":9091", false},
+		{"0.0.0.0:9091", false},
+		{"[::]:9091", false},
+		{"10.0.0.5:9091", false},
+		{"node1:9091", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackListen(tt.listen); got != tt.want {
+			t.Errorf("isLoopbackListen(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestCmdServe_Refuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		args    []string
+		wantErr string
+	}{
+		{"without a token", "", nil, "FC_CRI_ADMIN_TOKEN must be set"},
+		{"without a token on loopback", "", []string{"--listen", "127.0.0.1:0"}, "FC_CRI_ADMIN_TOKEN must be set"},
+		{"all interfaces without TLS", "s3cret", []string{"--listen", ":9091"}, "--tls-cert and --tls-key are required"},
+		{"remote address without TLS", "s3cret", []string{"--listen", "10.0.0.5:9091"}, "--tls-cert and --tls-key are required"},
+		{"certificate without key", "s3cret", []string{"--tls-cert", "node1.crt"}, "must be given together"},
+		{"unknown flag", "s3cret", []string{"--insecure"}, "unknown serve flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := &CLI{adminToken: tt.token}
+			err := cli.cmdServe(context.Background(), tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("cmdServe(%q) = %v, want %q", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+// Idle pooled VMs hold CPU and memory that no pod accounts for, so the
+// node looks emptier to schedulers and autoscalers than it is. The pool
+// publishes what its idle VMs hold in the fc_cri_pool_reserved_* metrics,
+// and annotate-node copies it onto the Node object for tools that can't
+// read node metrics.
+
+const (
+	defaultAnnotateInterval = 30 * time.Second
+
+	// In-cluster credentials of the pod fcctl runs in
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// PoolReservation is what the pool's idle VMs hold on the node.
+type PoolReservation struct {
+	VCPUs    int64 `json:"vcpus"`
+	MemoryMB int64 `json:"memory_mb"`
+}
+
+// annotations returns the node annotations describing the reservation.
+// They are also written under the deprecated prefix for tools that still
+// read it.
+func (r PoolReservation) annotations() map[string]string {
+	cpu := strconv.FormatInt(r.VCPUs, 10)
+	memory := fmt.Sprintf("%dMi", r.MemoryMB)
+	return map[string]string{
+		annotation.PoolReservedCPU:                           cpu,
+		annotation.PoolReservedMemory:                        memory,
+		annotation.DeprecatedPrefix + "pool-reserved-cpu":    cpu,
+		annotation.DeprecatedPrefix + "pool-reserved-memory": memory,
+	}
+}
+
+// poolReservation reads the pool's reservation from the metrics endpoint.
+func (cli *CLI) poolReservation(ctx context.Context) (PoolReservation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cli.metricsAddress, nil)
+	if err != nil {
+		return PoolReservation{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return PoolReservation{}, fmt.Errorf("cannot connect to metrics endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return PoolReservation{}, err
+	}
+
+	var r PoolReservation
+	found := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "fc_cri_pool_reserved_vcpus ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_reserved_vcpus %d", &r.VCPUs)
+			found++
+		} else if strings.HasPrefix(line, "fc_cri_pool_reserved_memory_mb ") {
+			_, _ = fmt.Sscanf(line, "fc_cri_pool_reserved_memory_mb %d", &r.MemoryMB)
+			found++
+		}
+	}
+	if found != 2 {
+		return PoolReservation{}, fmt.Errorf("metrics endpoint does not report the pool reservation")
+	}
+	return r, nil
+}
+
+// cmdPoolReservation prints what the pool's idle VMs hold.
+func (cli *CLI) cmdPoolReservation(ctx context.Context) error {
+	r, err := cli.poolReservation(ctx)
+	if err != nil {
+		return err
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	fmt.Printf("Reserved vCPUs:   %d\n", r.VCPUs)
+	fmt.Printf("Reserved Memory:  %d MiB\n", r.MemoryMB)
+	return nil
+}
+
+// cmdPoolAnnotateNode keeps the pool's reservation in annotations on the
+// node, patching them whenever it changes.
+func (cli *CLI) cmdPoolAnnotateNode(ctx context.Context, args []string) error {
+	node := os.Getenv("NODE_NAME")
+	interval := defaultAnnotateInterval
+	once := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--node":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--node requires a value")
+			}
+			i++
+			node = args[i]
+		case "--interval":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--interval requires a value")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid --interval %q", args[i])
+			}
+			interval = d
+		case "--once":
+			once = true
+		default:
+			return fmt.Errorf("unknown annotate-node flag: %s", args[i])
+		}
+	}
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("--node or NODE_NAME required: %w", err)
+		}
+		node = hostname
+	}
+
+	client, err := inClusterClient()
+	if err != nil {
+		return err
+	}
+
+	var last PoolReservation
+	published := false
+	for {
+		r, err := cli.poolReservation(ctx)
+		if err == nil && (!published || r != last) {
+			if err = client.annotateNode(ctx, node, r.annotations()); err == nil {
+				if cli.verbose {
+					fmt.Fprintf(os.Stderr, "Annotated node %s: %d vCPU, %d MiB reserved\n", node, r.VCPUs, r.MemoryMB)
+				}
+				last, published = r, true
+			}
+		}
+		if once {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to annotate node %s: %v\n", node, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// kubeClient talks to the Kubernetes API server with a service account.
+type kubeClient struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// inClusterClient returns a client with the credentials Kubernetes mounts
+// into pods.
+func inClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid cluster CA in %s/ca.crt", serviceAccountDir)
+	}
+
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+	}, nil
+}
+
+// annotateNode sets annotations on a node, leaving its others alone.
+func (c *kubeClient) annotateNode(ctx context.Context, node string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.server+"/api/v1/nodes/"+url.PathEscape(node), bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("patching node %s: %s: %s", node, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
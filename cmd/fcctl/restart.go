@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultRestartTimeout is how long restart waits for the shim, which gives
+// rebooting the VM and restarting its container two minutes.
+const defaultRestartTimeout = 3 * time.Minute
+
+// restartResult is the shim's answer to a restart request.
+type restartResult struct {
+	Error     string   `json:"error,omitempty"`
+	SandboxID string   `json:"sandbox_id,omitempty"`
+	PID       int      `json:"pid,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	GuestMAC  string   `json:"guest_mac,omitempty"`
+	Elapsed   string   `json:"elapsed,omitempty"`
+}
+
+// cmdRestart asks the shim of a sandbox to reboot its VM in place and
+// restart its containers. The sandbox keeps its ID, IP, MAC and rootfs, so
+// a wedged pod recovers without being deleted and rescheduled.
+func (cli *CLI) cmdRestart(ctx context.Context, args []string) error {
+	var id string
+	yes, dryRun := false, false
+	timeout := defaultRestartTimeout
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch name {
+		case "--yes", "-y":
+			yes = true
+		case "--dry-run", "-n":
+			dryRun = true
+		case "--timeout":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return fmt.Errorf("--timeout requires a value")
+				}
+				i++
+				value = args[i]
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid --timeout %q", value)
+			}
+			timeout = d
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				return fmt.Errorf("unknown restart flag: %s", args[i])
+			}
+			if id != "" {
+				return fmt.Errorf("restart takes one sandbox ID")
+			}
+			id = args[i]
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("usage: fcctl restart <sandbox-id> [--dry-run] [--yes] [--timeout dur]")
+	}
+	if cli.output == "json" && !dryRun && !yes {
+		return fmt.Errorf("-o json needs --dry-run or --yes, as restart cannot prompt")
+	}
+
+	sandboxDir := filepath.Join(cli.runDir, id)
+	if _, err := os.Stat(sandboxDir); os.IsNotExist(err) {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	socketPath := filepath.Join(sandboxDir, "shim.sock")
+	if _, err := os.Stat(socketPath); err != nil {
+		return fmt.Errorf("sandbox %s has no shim control socket; its shim predates restarts or is gone", id)
+	}
+
+	info := cli.getSandboxInfo(id)
+	if cli.output != "json" {
+		fmt.Printf("Sandbox %s (state: %s, pid: %d, ip: %s)\n", id, info.State, info.PID, orDash(info.IP))
+		fmt.Println("Its VM will be rebooted in place and its containers restarted; it keeps its IP, MAC and rootfs.")
+	}
+	if dryRun {
+		if cli.output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"sandbox": info, "dry_run": true})
+		}
+		fmt.Println("\nDry run - no changes made")
+		return nil
+	}
+	if !yes {
+		fmt.Print("\nRestart this sandbox? [y/N] ")
+		var response string
+		_, _ = fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Aborted")
+			return nil
+		}
+	}
+
+	if cli.output != "json" {
+		fmt.Printf("Restarting sandbox %s...\n", id)
+	}
+	result, err := requestRestart(ctx, socketPath, timeout)
+	if err != nil {
+		return err
+	}
+	if cli.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+	fmt.Printf("Restarted sandbox %s in %s (pid: %d, ips: %s, mac: %s)\n",
+		result.SandboxID, result.Elapsed, result.PID, orDash(strings.Join(result.IPs, ",")), orDash(result.GuestMAC))
+	return nil
+}
+
+// requestRestart sends a restart request to the shim control socket at
+// socketPath and waits for its answer.
+func requestRestart(ctx context.Context, socketPath string, timeout time.Duration) (*restartResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach shim: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	// Interrupting fcctl doesn't interrupt the shim, but shouldn't hang
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := json.NewEncoder(conn).Encode(map[string]string{"method": "restart"}); err != nil {
+		return nil, fmt.Errorf("failed to send restart request: %w", err)
+	}
+	var result restartResult
+	if err := json.NewDecoder(conn).Decode(&result); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no answer from shim within %s; the restart may still complete", timeout)
+		}
+		return nil, fmt.Errorf("failed to read restart result: %w", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	return &result, nil
+}
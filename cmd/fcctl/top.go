@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of utime/stime in /proc/<pid>/stat.
+// It is 100 on every Linux platform Firecracker supports.
+const clockTicks = 100
+
+// procRoot is where process information is read from.
+var procRoot = "/proc"
+
+// =============================================================================
+// Top Command
+// =============================================================================
+
+// TopSample is one sandbox's resource usage over a refresh interval.
+type TopSample struct {
+	ID            string  `json:"id"`
+	PID           int     `json:"pid"`
+	VCPUs         int     `json:"vcpus"`
+	CPUPercent    float64 `json:"cpu_percent"`
+	RSSBytes      uint64  `json:"rss_bytes"`
+	GuestMemUsed  uint64  `json:"guest_mem_used_bytes"`
+	GuestMemTotal uint64  `json:"guest_mem_total_bytes"`
+	DiskReadBps   float64 `json:"disk_read_bps"`
+	DiskWriteBps  float64 `json:"disk_write_bps"`
+	NetRxBps      float64 `json:"net_rx_bps"`
+	NetTxBps      float64 `json:"net_tx_bps"`
+}
+
+// TopSnapshot is a single refresh of `fcctl top`.
+type TopSnapshot struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Sandboxes []TopSample `json:"sandboxes"`
+}
+
+// procCounters holds the cumulative counters of a VMM process at a point in
+// time; rates are computed from the difference between two readings.
+type procCounters struct {
+	at         time.Time
+	cpuTicks   uint64
+	readBytes  uint64
+	writeBytes uint64
+	rxBytes    uint64
+	txBytes    uint64
+}
+
+var topSortKeys = map[string]func(a, b TopSample) bool{
+	"cpu":       func(a, b TopSample) bool { return a.CPUPercent > b.CPUPercent },
+	"mem":       func(a, b TopSample) bool { return a.RSSBytes > b.RSSBytes },
+	"guest-mem": func(a, b TopSample) bool { return a.GuestMemUsed > b.GuestMemUsed },
+	"disk":      func(a, b TopSample) bool { return a.DiskReadBps+a.DiskWriteBps > b.DiskReadBps+b.DiskWriteBps },
+	"net":       func(a, b TopSample) bool { return a.NetRxBps+a.NetTxBps > b.NetRxBps+b.NetTxBps },
+	"id":        func(a, b TopSample) bool { return a.ID < b.ID },
+}
+
+func (cli *CLI) cmdTop(ctx context.Context, args []string) error {
+	interval := 2 * time.Second
+	sortBy := "cpu"
+	iterations := 0 // 0 = until interrupted
+
+	for len(args) > 0 {
+		switch args[0] {
+		case "-n", "--interval":
+			if len(args) < 2 {
+				return fmt.Errorf("%s requires a value", args[0])
+			}
+			secs, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || secs <= 0 {
+				return fmt.Errorf("invalid interval: %s", args[1])
+			}
+			interval = time.Duration(secs * float64(time.Second))
+			args = args[2:]
+		case "--sort-by":
+			if len(args) < 2 {
+				return fmt.Errorf("--sort-by requires a value")
+			}
+			sortBy = args[1]
+			args = args[2:]
+		case "-c", "--count":
+			if len(args) < 2 {
+				return fmt.Errorf("%s requires a value", args[0])
+			}
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count < 1 {
+				return fmt.Errorf("invalid count: %s", args[1])
+			}
+			iterations = count
+			args = args[2:]
+		default:
+			return fmt.Errorf("unknown top flag: %s", args[0])
+		}
+	}
+
+	less, ok := topSortKeys[sortBy]
+	if !ok {
+		return fmt.Errorf("invalid --sort-by: %s (must be cpu, mem, guest-mem, disk, net or id)", sortBy)
+	}
+
+	// Prime the counters so the first refresh has rates to show
+	prev := cli.readAllCounters()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	encoder := json.NewEncoder(os.Stdout)
+	for i := 0; iterations == 0 || i < iterations; i++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		snapshot, cur := cli.sampleSandboxes(prev)
+		prev = cur
+
+		sort.SliceStable(snapshot.Sandboxes, func(i, j int) bool {
+			return less(snapshot.Sandboxes[i], snapshot.Sandboxes[j])
+		})
+
+		if cli.output == "json" {
+			// One snapshot per line so automation can stream it
+			if err := encoder.Encode(snapshot); err != nil {
+				return err
+			}
+			continue
+		}
+
+		printTop(snapshot, interval, sortBy)
+	}
+
+	return nil
+}
+
+// readAllCounters reads the current counters of every sandbox's VMM.
+func (cli *CLI) readAllCounters() map[string]procCounters {
+	counters := make(map[string]procCounters)
+
+	sandboxes, err := cli.discoverSandboxes()
+	if err != nil {
+		return counters
+	}
+	for _, sb := range sandboxes {
+		if sb.PID > 0 {
+			counters[sb.ID] = readProcCounters(sb.PID)
+		}
+	}
+	return counters
+}
+
+// sampleSandboxes computes per-sandbox usage since the previous reading and
+// returns the new readings for the next round.
+func (cli *CLI) sampleSandboxes(prev map[string]procCounters) (TopSnapshot, map[string]procCounters) {
+	snapshot := TopSnapshot{Timestamp: time.Now()}
+	cur := make(map[string]procCounters)
+
+	sandboxes, err := cli.discoverSandboxes()
+	if err != nil {
+		return snapshot, cur
+	}
+
+	for _, sb := range sandboxes {
+		if sb.PID <= 0 || sb.State == "dead" {
+			continue
+		}
+
+		sample := TopSample{
+			ID:       sb.ID,
+			PID:      sb.PID,
+			VCPUs:    sb.VCPUs,
+			RSSBytes: readRSS(sb.PID),
+		}
+
+		counters := readProcCounters(sb.PID)
+		cur[sb.ID] = counters
+
+		if last, ok := prev[sb.ID]; ok {
+			sample.setRates(counters, last)
+		}
+
+		vsockPath := filepath.Join(cli.runDir, sb.ID, "vsock.sock")
+		sample.GuestMemUsed, sample.GuestMemTotal = queryGuestMemory(vsockPath)
+
+		snapshot.Sandboxes = append(snapshot.Sandboxes, sample)
+	}
+
+	return snapshot, cur
+}
+
+// setRates sets the sample's CPU, disk and network rates from two readings
+// of its VMM's counters. CPU is a percentage of the sandbox's vCPUs.
+func (s *TopSample) setRates(cur, last procCounters) {
+	elapsed := cur.at.Sub(last.at).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	cpuSecs := rate(cur.cpuTicks, last.cpuTicks, elapsed) / clockTicks
+	vcpus := s.VCPUs
+	if vcpus < 1 {
+		vcpus = 1
+	}
+	s.CPUPercent = cpuSecs / float64(vcpus) * 100
+	s.DiskReadBps = rate(cur.readBytes, last.readBytes, elapsed)
+	s.DiskWriteBps = rate(cur.writeBytes, last.writeBytes, elapsed)
+	s.NetRxBps = rate(cur.rxBytes, last.rxBytes, elapsed)
+	s.NetTxBps = rate(cur.txBytes, last.txBytes, elapsed)
+}
+
+func printTop(snapshot TopSnapshot, interval time.Duration, sortBy string) {
+	// Clear screen and move cursor home
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("fcctl top - %s, %d sandbox(es), refresh %s, sorted by %s\n\n",
+		snapshot.Timestamp.Format("15:04:05"), len(snapshot.Sandboxes), interval, sortBy)
+
+	if len(snapshot.Sandboxes) == 0 {
+		fmt.Println("No running sandboxes")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPID\tVCPUs\tCPU%\tRSS\tGUEST MEM\tDISK R/W\tNET RX/TX")
+	for _, s := range snapshot.Sandboxes {
+		guestMem := "N/A"
+		if s.GuestMemTotal > 0 {
+			guestMem = fmt.Sprintf("%s/%s", formatBytes(float64(s.GuestMemUsed)), formatBytes(float64(s.GuestMemTotal)))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s/s / %s/s\t%s/s / %s/s\n",
+			s.ID, s.PID, s.VCPUs, s.CPUPercent, formatBytes(float64(s.RSSBytes)), guestMem,
+			formatBytes(s.DiskReadBps), formatBytes(s.DiskWriteBps),
+			formatBytes(s.NetRxBps), formatBytes(s.NetTxBps))
+	}
+	w.Flush()
+}
+
+// readProcCounters reads CPU, block I/O and network counters for a VMM.
+// Missing files (e.g. a process that just exited) leave counters at zero.
+func readProcCounters(pid int) procCounters {
+	counters := procCounters{at: time.Now()}
+	procDir := filepath.Join(procRoot, strconv.Itoa(pid))
+
+	// utime and stime are fields 14 and 15; comm (field 2) may contain
+	// spaces, so split after its closing paren.
+	if data, err := os.ReadFile(filepath.Join(procDir, "stat")); err == nil {
+		stat := string(data)
+		if idx := strings.LastIndex(stat, ")"); idx >= 0 {
+			fields := strings.Fields(stat[idx+1:])
+			if len(fields) > 12 {
+				utime, _ := strconv.ParseUint(fields[11], 10, 64)
+				stime, _ := strconv.ParseUint(fields[12], 10, 64)
+				counters.cpuTicks = utime + stime
+			}
+		}
+	}
+
+	// Guest disk I/O is performed by the VMM on the backing files
+	if f, err := os.Open(filepath.Join(procDir, "io")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if !ok {
+				continue
+			}
+			n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			switch key {
+			case "read_bytes":
+				counters.readBytes = n
+			case "write_bytes":
+				counters.writeBytes = n
+			}
+		}
+		f.Close()
+	}
+
+	// The VMM's tap device lives in its network namespace
+	if f, err := os.Open(filepath.Join(procDir, "net", "dev")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			iface, stats, ok := strings.Cut(scanner.Text(), ":")
+			if !ok || strings.TrimSpace(iface) == "lo" {
+				continue
+			}
+			fields := strings.Fields(stats)
+			if len(fields) < 9 {
+				continue
+			}
+			rx, _ := strconv.ParseUint(fields[0], 10, 64)
+			tx, _ := strconv.ParseUint(fields[8], 10, 64)
+			counters.rxBytes += rx
+			counters.txBytes += tx
+		}
+		f.Close()
+	}
+
+	return counters
+}
+
+// readRSS returns the resident set size of a process in bytes.
+func readRSS(pid int) uint64 {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "VmRSS:") {
+			var kb uint64
+			_, _ = fmt.Sscanf(line, "VmRSS: %d kB", &kb)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// queryGuestMemory asks the guest agent for VM-wide memory usage.
+// It returns zeros if the agent does not answer in time.
+func queryGuestMemory(vsockPath string) (used, total uint64) {
+	conn, err := dialAgent(vsockPath, 500*time.Millisecond)
+	if err != nil {
+		return 0, 0
+	}
+	defer conn.Close()
+
+	// An empty container ID requests stats for the whole guest
+	req := map[string]interface{}{
+		"id":     1,
+		"method": "get_stats",
+		"params": map[string]interface{}{"id": ""},
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return 0, 0
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	var resp struct {
+		Result struct {
+			MemoryUsage uint64 `json:"memory_usage"`
+			MemoryTotal uint64 `json:"memory_total"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return 0, 0
+	}
+
+	return resp.Result.MemoryUsage, resp.Result.MemoryTotal
+}
+
+func rate(cur, last uint64, elapsed float64) float64 {
+	if cur < last {
+		// Counter reset (e.g. interface recreated)
+		return 0
+	}
+	return float64(cur-last) / elapsed
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0fB", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", b/div, "KMGTPE"[exp])
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeProc writes files of a fake /proc/<pid> and points procRoot at it.
+func writeProc(t *testing.T, pid string, files map[string]string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, pid, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := procRoot
+	procRoot = root
+	t.Cleanup(func() { procRoot = old })
+}
+
+func TestReadProcCounters(t *testing.T) {
+	writeProc(t, "42", map[string]string{
+		// comm may contain spaces and parens
+		"stat": "42 (fire (cracker)) S 1 42 42 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 3 0 1000 0 0\n",
+		"io":   "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\ncancelled_write_bytes: 0\n",
+		"net/dev": "Inter-|   Receive                                                |  Transmit\n" +
+			" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+			"    lo:    9999       1    0    0    0     0          0         0     9999       1    0    0    0     0       0          0\n" +
+			"  tap0:    1000      10    0    0    0     0          0         0      300       3    0    0    0     0       0          0\n" +
+			"  tap1:      24       1    0    0    0     0          0         0       76       1    0    0    0     0       0          0\n",
+	})
+
+	got := readProcCounters(42)
+	if got.cpuTicks != 300 {
+		t.Errorf("cpuTicks = %d, want 300", got.cpuTicks)
+	}
+	if got.readBytes != 4096 || got.writeBytes != 8192 {
+		t.Errorf("disk = %d/%d, want 4096/8192", got.readBytes, got.writeBytes)
+	}
+	// Loopback is not the guest's traffic
+	if got.rxBytes != 1024 || got.txBytes != 376 {
+		t.Errorf("net = %d/%d, want 1024/376", got.rxBytes, got.txBytes)
+	}
+}
+
+func TestReadProcCounters_Missing(t *testing.T) {
+	writeProc(t, "42", nil)
+
+	got := readProcCounters(42)
+	if got.cpuTicks != 0 || got.readBytes != 0 || got.rxBytes != 0 {
+		t.Errorf("readProcCounters() of an exited process = %+v, want zeros", got)
+	}
+	if got.at.IsZero() {
+		t.Error("readProcCounters() did not record the time of the reading")
+	}
+}
+
+func TestReadRSS(t *testing.T) {
+	writeProc(t, "42", map[string]string{
+		"status": "Name:\tfirecracker\nVmPeak:\t  900 kB\nVmRSS:\t  2048 kB\nThreads:\t3\n",
+	})
+	if got := readRSS(42); got != 2048*1024 {
+		t.Errorf("readRSS() = %d, want %d", got, 2048*1024)
+	}
+	if got := readRSS(43); got != 0 {
+		t.Errorf("readRSS() of a missing process = %d, want 0", got)
+	}
+}
+
+func TestSetRates(t *testing.T) {
+	start := time.Unix(1000, 0)
+	last := procCounters{at: start, cpuTicks: 1000, readBytes: 0, writeBytes: 100, rxBytes: 500, txBytes: 50}
+	cur := procCounters{at: start.Add(2 * time.Second), cpuTicks: 1200, readBytes: 4096, writeBytes: 100, rxBytes: 2500, txBytes: 10}
+
+	s := TopSample{VCPUs: 2}
+	s.setRates(cur, last)
+
+	// 200 ticks over 2s is one CPU-second per second, half of two vCPUs
+	if s.CPUPercent != 50 {
+		t.Errorf("CPUPercent = %v, want 50", s.CPUPercent)
+	}
+	if s.DiskReadBps != 2048 || s.DiskWriteBps != 0 {
+		t.Errorf("disk = %v/%v, want 2048/0", s.DiskReadBps, s.DiskWriteBps)
+	}
+	// The TX counter went backwards: the device was recreated
+	if s.NetRxBps != 1000 || s.NetTxBps != 0 {
+		t.Errorf("net = %v/%v, want 1000/0", s.NetRxBps, s.NetTxBps)
+	}
+
+	// A sandbox with unknown vCPUs counts as one
+	s = TopSample{}
+	s.setRates(cur, last)
+	if s.CPUPercent != 100 {
+		t.Errorf("CPUPercent without vCPUs = %v, want 100", s.CPUPercent)
+	}
+
+	// Readings at the same time give no rates
+	s = TopSample{VCPUs: 2}
+	s.setRates(cur, cur)
+	if s.CPUPercent != 0 || s.NetRxBps != 0 {
+		t.Errorf("setRates() without elapsed time = %+v, want zeros", s)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes float64
+		want  string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{1 << 20, "1.0MiB"},
+		{3 << 30, "3.0GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.bytes); got != tt.want {
+			t.Errorf("formatBytes(%v) = %q, want %q", tt.bytes, got, tt.want)
+		}
+	}
+}
+
+func TestTopSortKeys(t *testing.T) {
+	busy := TopSample{ID: "b", CPUPercent: 90, RSSBytes: 1, DiskReadBps: 1, NetTxBps: 1}
+	idle := TopSample{ID: "a", CPUPercent: 1, RSSBytes: 2, DiskWriteBps: 5, NetRxBps: 5}
+
+	tests := []struct {
+		key           string
+		first, second TopSample
+	}{
+		{"cpu", busy, idle},
+		{"mem", idle, busy},
+		{"disk", idle, busy},
+		{"net", idle, busy},
+		{"id", idle, busy},
+	}
+	for _, tt := range tests {
+		less := topSortKeys[tt.key]
+		if !less(tt.first, tt.second) || less(tt.second, tt.first) {
+			t.Errorf("--sort-by %s does not put %s first", tt.key, tt.first.ID)
+		}
+	}
+}
+
+func TestCmdTop_Flags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--interval"}, "requires a value"},
+		{[]string{"-n", "0"}, "invalid interval"},
+		{[]string{"-n", "soon"}, "invalid interval"},
+		{[]string{"-c", "0"}, "invalid count"},
+		{[]string{"--sort-by", "pid"}, "invalid --sort-by"},
+		{[]string{"--watch"}, "unknown top flag"},
+	}
+	for _, tt := range tests {
+		cli := &CLI{runDir: t.TempDir()}
+		err := cli.cmdTop(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("cmdTop(%q) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
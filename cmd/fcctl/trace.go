@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/trace"
+)
+
+// waterfallWidth is the width, in characters, of the trace's waterfall.
+const waterfallWidth = 40
+
+// SandboxTrace is the lifecycle timeline of a sandbox.
+type SandboxTrace struct {
+	ID    string       `json:"id"`
+	Spans []trace.Span `json:"spans"`
+	Total string       `json:"total"`
+
+	// Omitted counts the phases from before the VM was taken from the pool
+	Omitted int `json:"omitted,omitempty"`
+}
+
+// cmdTrace prints when each lifecycle phase of a sandbox ran and how long
+// it took, as a waterfall, to find where a slow pod start spent its time.
+func (cli *CLI) cmdTrace(ctx context.Context, args []string) error {
+	var id string
+	all := false
+	for _, arg := range args {
+		switch arg {
+		case "--all", "-a":
+			all = true
+		default:
+			if strings.HasPrefix(arg, "-") || id != "" {
+				return fmt.Errorf("usage: fcctl trace <sandbox-id> [--all]")
+			}
+			id = arg
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("usage: fcctl trace <sandbox-id> [--all]")
+	}
+
+	sandboxDir := filepath.Join(cli.runDir, id)
+	if _, err := os.Stat(sandboxDir); os.IsNotExist(err) {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	spans, err := trace.Load(sandboxDir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no trace recorded for %s", id)
+	}
+	if err != nil {
+		return err
+	}
+	result := buildTrace(id, spans, all)
+
+	if cli.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	if len(result.Spans) == 0 {
+		fmt.Println("No phases recorded")
+		return nil
+	}
+	origin := result.Spans[0].Start
+	total := traceEnd(result.Spans).Sub(origin)
+
+	fmt.Printf("Sandbox %s, started %s, %s in total\n\n", id, origin.Format(time.RFC3339), result.Total)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tSTART\tDURATION\t")
+	for _, span := range result.Spans {
+		phase := span.Phase
+		if span.Error != "" {
+			phase += " (failed)"
+		}
+		fmt.Fprintf(w, "%s\t+%s\t%s\t%s\n",
+			phase,
+			formatPhaseDuration(span.Start.Sub(origin)),
+			formatPhaseDuration(span.Duration),
+			waterfallBar(span.Start.Sub(origin), span.Duration, total))
+	}
+	w.Flush()
+
+	for _, span := range result.Spans {
+		if span.Error != "" {
+			fmt.Printf("\n%s failed: %s", span.Phase, span.Error)
+		}
+	}
+	if result.Omitted > 0 {
+		fmt.Printf("\n%d phases from when the VM was warmed in the pool are hidden (--all shows them)", result.Omitted)
+	}
+	fmt.Println()
+	return nil
+}
+
+// buildTrace returns a sandbox's timeline. VMs taken from the pool were
+// created and booted long before the workload arrived, so unless all is
+// set the timeline starts at the last time the VM was taken from the pool.
+func buildTrace(id string, spans []trace.Span, all bool) *SandboxTrace {
+	result := &SandboxTrace{ID: id, Spans: []trace.Span{}}
+	from := 0
+	if !all {
+		for i, span := range spans {
+			if span.Phase == trace.PhasePoolAcquire {
+				from = i
+			}
+		}
+	}
+	for i, span := range spans {
+		// Phases nested in the acquisition, like attaching the rootfs,
+		// started after it did but ended before it was recorded
+		if i < from && span.End().Before(spans[from].Start) {
+			result.Omitted++
+			continue
+		}
+		result.Spans = append(result.Spans, span)
+	}
+	if len(result.Spans) > 0 {
+		result.Total = formatPhaseDuration(traceEnd(result.Spans).Sub(result.Spans[0].Start))
+	}
+	return result
+}
+
+// traceEnd returns when the last of spans ended.
+func traceEnd(spans []trace.Span) time.Time {
+	var end time.Time
+	for _, span := range spans {
+		if span.End().After(end) {
+			end = span.End()
+		}
+	}
+	return end
+}
+
+// waterfallBar draws a phase that started offset into a timeline of total
+// length and took duration.
+func waterfallBar(offset, duration, total time.Duration) string {
+	if total <= 0 {
+		return strings.Repeat("█", waterfallWidth)
+	}
+	start := int(int64(offset) * waterfallWidth / int64(total))
+	length := int(int64(duration) * waterfallWidth / int64(total))
+	// Every phase gets at least a tick, however short
+	if length < 1 {
+		length = 1
+	}
+	if start > waterfallWidth-1 {
+		start = waterfallWidth - 1
+	}
+	if start+length > waterfallWidth {
+		length = waterfallWidth - start
+	}
+	return "|" + strings.Repeat(" ", start) + strings.Repeat("█", length) +
+		strings.Repeat(" ", waterfallWidth-start-length) + "|"
+}
+
+// formatPhaseDuration formats a phase's duration to a precision that suits
+// it: 850µs, 42ms, 1.25s.
+func formatPhaseDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	default:
+		return d.Round(10 * time.Millisecond).String()
+	}
+}
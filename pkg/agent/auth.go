@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Authentication handshake. An agent given a key on the kernel command line
+// only answers pings until a connection proves it holds the key: the host
+// asks for a challenge and returns its HMAC. Anything that can reach the
+// vsock socket can otherwise drive the agent.
+const (
+	methodAuthChallenge = "auth_challenge"
+	methodAuthenticate  = "authenticate"
+
+	// authContext is mixed into the HMAC, so it can't be confused with a
+	// MAC of the same nonce made for another purpose.
+	authContext = "fc-agent-auth:"
+
+	// AuthKeyFile is the file in a sandbox's runtime directory holding its
+	// agent's key, readable only by root.
+	AuthKeyFile = "agent.key"
+
+	// errCodeMethodNotFound is returned by agents that predate
+	// authentication.
+	errCodeMethodNotFound = -32601
+
+	authTimeout = 10 * time.Second
+)
+
+// AuthMAC returns the response to an agent's challenge.
+func AuthMAC(key []byte, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(authContext + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReadAuthKey reads the agent key of the sandbox in sandboxDir. It returns
+// nil if the sandbox's agent has no key.
+func ReadAuthKey(sandboxDir string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(sandboxDir, AuthKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent key: %w", err)
+	}
+	key, err := hex.DecodeString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent key: %w", err)
+	}
+	return key, nil
+}
+
+// authenticate proves to the agent on conn that this side holds key. It
+// must run before any other request on the connection. Agents that predate
+// authentication are accepted as they are.
+func authenticate(conn net.Conn, key []byte) error {
+	_ = conn.SetDeadline(time.Now().Add(authTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	roundTrip := func(req *Request, result interface{}) error {
+		if err := encoder.Encode(req); err != nil {
+			return fmt.Errorf("failed to send %s: %w", req.Method, err)
+		}
+		var resp struct {
+			ID     uint64          `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *ResponseError  `json:"error,omitempty"`
+		}
+		if err := decoder.Decode(&resp); err != nil {
+			return fmt.Errorf("failed to read %s response: %w", req.Method, err)
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	err := roundTrip(&Request{Method: methodAuthChallenge}, &challenge)
+	if rerr, ok := err.(*ResponseError); ok && rerr.Code == errCodeMethodNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("agent authentication failed: %w", err)
+	}
+	if challenge.Nonce == "" {
+		return fmt.Errorf("agent authentication failed: empty challenge")
+	}
+
+	req := &Request{
+		Method: methodAuthenticate,
+		Params: map[string]interface{}{
+			"mac": AuthMAC(key, challenge.Nonce),
+		},
+	}
+	if err := roundTrip(req, nil); err != nil {
+		return fmt.Errorf("agent authentication failed: %w", err)
+	}
+	return nil
+}
+
+// Error implements error, so a ResponseError can be returned as one.
+func (e *ResponseError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// fakeAgent answers the handshake like fc-agent, checking responses with
+// key. A nil key plays an agent that predates authentication.
+func fakeAgent(t *testing.T, conn net.Conn, key []byte) {
+	t.Helper()
+	go func() {
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		const nonce = "0123456789abcdef"
+		for {
+			var req Request
+			if err := decoder.Decode(&req); err != nil {
+				return
+			}
+			resp := Response{ID: req.ID}
+			switch {
+			case key == nil:
+				resp.Error = &ResponseError{Code: -32601, Message: "Method not found"}
+			case req.Method == methodAuthChallenge:
+				resp.Result = map[string]string{"nonce": nonce}
+			case req.Method == methodAuthenticate && req.Params["mac"] == AuthMAC(key, nonce):
+				resp.Result = map[string]string{"status": "ok"}
+			default:
+				resp.Error = &ResponseError{Code: -32001, Message: "authentication failed"}
+			}
+			if err := encoder.Encode(resp); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestAuthenticate(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name     string
+		agentKey []byte
+		key      []byte
+		wantErr  bool
+	}{
+		{name: "matching key", agentKey: key, key: key},
+		{name: "wrong key", agentKey: key, key: []byte("fedcba9876543210fedcba9876543210"), wantErr: true},
+		{name: "agent without authentication", agentKey: nil, key: key},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			fakeAgent(t, server, tt.agentKey)
+
+			err := authenticate(client, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthMAC(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	if AuthMAC(key, "a") == AuthMAC(key, "b") {
+		t.Error("AuthMAC is the same for different nonces")
+	}
+	if AuthMAC(key, "a") == AuthMAC([]byte("fedcba9876543210"), "a") {
+		t.Error("AuthMAC is the same for different keys")
+	}
+}
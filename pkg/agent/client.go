@@ -16,6 +16,7 @@ import (
 
 	"github.com/mdlayher/vsock"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,6 +29,20 @@ type Client struct {
 	decoder   *json.Decoder
 	requestID uint64
 
+	// authKey authenticates connections to agents given a key (see
+	// authenticate). nil skips authentication.
+	authKey []byte
+
+	// info is what the agent reported at Connect (see negotiate).
+	info *AgentInfo
+
+	// target is where Connect dialed, for Reconnect.
+	target *dialTarget
+
+	// recorder records calls for replay (see RecordTo). nil records
+	// nothing.
+	recorder *recorder
+
 	log *logrus.Entry
 }
 
@@ -38,6 +53,12 @@ func NewClient(log *logrus.Entry) *Client {
 	}
 }
 
+// SetAuthKey sets the key Connect authenticates to the agent with, the one
+// the sandbox's VM was booted with.
+func (c *Client) SetAuthKey(key []byte) {
+	c.authKey = key
+}
+
 // Connect establishes a connection to the guest agent via vsock.
 func (c *Client) Connect(ctx context.Context, vsockPath string, cid uint32, port uint32) error {
 	c.log.WithFields(logrus.Fields{
@@ -46,19 +67,55 @@ func (c *Client) Connect(ctx context.Context, vsockPath string, cid uint32, port
 		"port":       port,
 	}).Info("Connecting to guest agent")
 
-	// Connect to the vsock Unix socket that Firecracker exposes
-	var conn net.Conn
-	vsockConn, err := vsock.Dial(cid, port, &vsock.Config{})
+	c.mu.Lock()
+	c.target = &dialTarget{vsockPath: vsockPath, cid: cid, port: port}
+	c.mu.Unlock()
+
+	conn, err := dialAuthenticated(vsockPath, cid, port, c.authKey)
 	if err != nil {
-		// Fallback: try Unix socket directly if vsock package fails
-		conn, err = net.DialTimeout("unix", vsockPath, 30*time.Second)
-		if err != nil {
-			return fmt.Errorf("failed to connect to vsock: %w", err)
-		}
-	} else {
-		conn = vsockConn
+		return err
+	}
+	return c.ConnectConn(ctx, conn)
+}
+
+// Reconnect replaces the connection with a new one to where Connect
+// dialed, for an agent whose connection broke or stopped answering.
+func (c *Client) Reconnect(ctx context.Context) error {
+	c.mu.Lock()
+	target := c.target
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
 	}
+	c.mu.Unlock()
+
+	if target == nil {
+		return fmt.Errorf("not connected")
+	}
+	conn, err := dialAuthenticated(target.vsockPath, target.cid, target.port, c.authKey)
+	if err != nil {
+		return err
+	}
+	return c.ConnectConn(ctx, conn)
+}
+
+// Ping checks that the agent answers requests.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.call(ctx, &Request{Method: "ping"})
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("ping failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
 
+// ConnectConn sets up the client on an established, authenticated
+// connection to the agent, such as a Replayer's.
+func (c *Client) ConnectConn(ctx context.Context, conn net.Conn) error {
 	c.mu.Lock()
 	c.conn = conn
 	c.encoder = json.NewEncoder(conn)
@@ -71,15 +128,67 @@ func (c *Client) Connect(ctx context.Context, vsockPath string, cid uint32, port
 		return fmt.Errorf("agent not ready: %w", err)
 	}
 
-	c.log.Info("Connected to guest agent")
+	// Refuse agents that speak an incompatible protocol
+	if err := c.negotiate(ctx); err != nil {
+		conn.Close()
+		return fmt.Errorf("agent negotiation failed: %w", err)
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"agent_version":   c.info.Version,
+		"protocol":        c.info.ProtocolVersion,
+		"runtime":         c.info.Runtime,
+		"runtime_version": c.info.RuntimeVersion,
+	}).Info("Connected to guest agent")
 	return nil
 }
 
+// dialTarget is the address of a guest agent.
+type dialTarget struct {
+	vsockPath string
+	cid       uint32
+	port      uint32
+}
+
+// dial opens a connection to the guest agent.
+func dial(vsockPath string, cid uint32, port uint32) (net.Conn, error) {
+	// Connect to the vsock Unix socket that Firecracker exposes
+	vsockConn, err := vsock.Dial(cid, port, &vsock.Config{})
+	if err == nil {
+		return vsockConn, nil
+	}
+
+	// Fallback: try Unix socket directly if vsock package fails
+	conn, err := net.DialTimeout("unix", vsockPath, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to vsock: %w", err)
+	}
+	return conn, nil
+}
+
+// dialAuthenticated opens a connection to the guest agent and, if key is
+// set, authenticates it.
+func dialAuthenticated(vsockPath string, cid uint32, port uint32, key []byte) (net.Conn, error) {
+	conn, err := dial(vsockPath, cid, port)
+	if err != nil || key == nil {
+		return conn, err
+	}
+	if err := authenticate(conn, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // Close terminates the connection.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.recorder != nil {
+		_ = c.recorder.file.Close()
+		c.recorder = nil
+	}
 	if c.conn != nil {
 		return c.conn.Close()
 	}
@@ -99,6 +208,9 @@ func (c *Client) CreateContainer(ctx context.Context, spec *domain.ContainerSpec
 			"terminal": spec.Terminal,
 		},
 	}
+	if len(spec.SecretEnv) > 0 {
+		req.Params["secret_env"] = spec.SecretEnv
+	}
 
 	resp, err := c.call(ctx, req)
 	if err != nil {
@@ -237,22 +349,123 @@ func (c *Client) GetContainerStats(ctx context.Context, containerID string) (*do
 		return nil, fmt.Errorf("get_stats failed: %s", resp.Error.Message)
 	}
 
+	result, ok := resp.Result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid response format")
+	}
+	return parseContainerStats(result), nil
+}
+
+// GetPodStats retrieves the resource usage of every running container and
+// of the whole guest, in one call. Agents without FeaturePodStats can only
+// report containers one at a time, with GetContainerStats.
+func (c *Client) GetPodStats(ctx context.Context) (*domain.PodStats, error) {
+	req := &Request{
+		Method: "pod_stats",
+		Params: map[string]interface{}{},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, fmt.Errorf("pod_stats failed: %s", resp.Error.Message)
+	}
+
 	result, ok := resp.Result.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("invalid response format")
 	}
 
-	cpuUsage, _ := result["cpu_usage"].(float64)
 	memUsage, _ := result["memory_usage"].(float64)
-	readBytes, _ := result["read_bytes"].(float64)
-	writeBytes, _ := result["write_bytes"].(float64)
+	memTotal, _ := result["memory_total"].(float64)
+	stats := &domain.PodStats{
+		Containers:       make(map[string]*domain.ContainerStats),
+		GuestMemoryUsage: uint64(memUsage),
+		GuestMemoryTotal: uint64(memTotal),
+	}
+	containers, _ := result["containers"].(map[string]interface{})
+	for id, value := range containers {
+		if container, ok := value.(map[string]interface{}); ok {
+			stats.Containers[id] = parseContainerStats(container)
+		}
+	}
+	return stats, nil
+}
+
+// parseContainerStats converts the stats the agent reports for a container.
+// The agent reports CPU times in microseconds. Older agents report only
+// usage, leaving the rest 0.
+func parseContainerStats(result map[string]interface{}) *domain.ContainerStats {
+	value := func(key string) uint64 {
+		n, _ := result[key].(float64)
+		return uint64(n)
+	}
 
 	return &domain.ContainerStats{
-		CPUUsage:    uint64(cpuUsage),
-		MemoryUsage: uint64(memUsage),
-		ReadBytes:   uint64(readBytes),
-		WriteBytes:  uint64(writeBytes),
-	}, nil
+		CPUUsage:            value("cpu_usage") * 1000,
+		CPUUser:             value("cpu_user") * 1000,
+		CPUSystem:           value("cpu_system") * 1000,
+		CPUPeriods:          value("cpu_periods"),
+		CPUThrottledPeriods: value("cpu_throttled_periods"),
+		CPUThrottled:        value("cpu_throttled") * 1000,
+		MemoryUsage:         value("memory_usage"),
+		MemoryLimit:         value("memory_limit"),
+		MemoryAnon:          value("memory_anon"),
+		MemoryFile:          value("memory_file"),
+		MemoryInactiveFile:  value("memory_inactive_file"),
+		PageFaults:          value("page_faults"),
+		MajorPageFaults:     value("major_page_faults"),
+		OOMEvents:           value("oom_events"),
+		OOMKills:            value("oom_kills"),
+		ReadBytes:           value("read_bytes"),
+		WriteBytes:          value("write_bytes"),
+		Pids:                value("pids"),
+		PidsLimit:           value("pids_limit"),
+	}
+}
+
+// GetContainerStatus reports whether a container has exited and how.
+func (c *Client) GetContainerStatus(ctx context.Context, containerID string) (*domain.ContainerStatus, error) {
+	req := &Request{
+		Method: "container_status",
+		Params: map[string]interface{}{
+			"id": containerID,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, fmt.Errorf("container_status failed: %s", resp.Error.Message)
+	}
+
+	result, ok := resp.Result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid response format")
+	}
+
+	state, _ := result["status"].(string)
+	pid, _ := result["pid"].(float64)
+	status := &domain.ContainerStatus{
+		Status: state,
+		PID:    int(pid),
+	}
+	if exitCode, ok := result["exit_code"].(float64); ok {
+		status.Exited = true
+		status.ExitCode = int(exitCode)
+		status.OOMKilled, _ = result["oom_killed"].(bool)
+		if exitedAt, ok := result["exited_at"].(string); ok {
+			status.ExitedAt, _ = time.Parse(time.RFC3339Nano, exitedAt)
+		}
+	}
+
+	return status, nil
 }
 
 // =============================================================================
@@ -279,11 +492,301 @@ type ResponseError struct {
 	Message string `json:"message"`
 }
 
+// SetTimezone sets the timezone of the guest, or of one container if
+// containerID is set. tzdata is the zoneinfo file for the named timezone.
+func (c *Client) SetTimezone(ctx context.Context, containerID, name string, tzdata []byte) error {
+	req := &Request{
+		Method: "set_timezone",
+		Params: map[string]interface{}{
+			"id":       containerID,
+			"timezone": name,
+			"tzdata":   tzdata,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("set_timezone failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// InstallCABundle replaces the CA certificate bundle of the guest, or of
+// one container if containerID is set.
+func (c *Client) InstallCABundle(ctx context.Context, containerID string, bundle []byte) error {
+	req := &Request{
+		Method: "install_ca_bundle",
+		Params: map[string]interface{}{
+			"id":     containerID,
+			"bundle": bundle,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("install_ca_bundle failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// SetOnlineCPUs keeps only the first count vCPUs of the guest online, for
+// VMs booted with more vCPUs than their workload asked for. It fails if
+// the guest kernel can't take CPUs offline.
+func (c *Client) SetOnlineCPUs(ctx context.Context, count int64) error {
+	req := &Request{
+		Method: "set_online_cpus",
+		Params: map[string]interface{}{
+			"count": count,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("set_online_cpus failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// ConfigureNetwork gives the guest's interface for the sandbox network,
+// which the agent finds by its MAC, static addresses, one per IP family on
+// dual-stack clusters, a default route, nameservers and DNS search domains.
+// A nil gateway leaves the default route alone, and no nameservers or
+// search domains leave resolv.conf alone. Agents without FeatureDNSSearch
+// ignore the search domains.
+func (c *Client) ConfigureNetwork(ctx context.Context, addresses []*net.IPNet, gateway net.IP, dns []net.IP, search []string) error {
+	cidrs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		cidrs = append(cidrs, address.String())
+	}
+	params := map[string]interface{}{
+		"addresses": cidrs,
+	}
+	if gateway != nil {
+		params["gateway"] = gateway.String()
+	}
+	servers := make([]string, 0, len(dns))
+	for _, server := range dns {
+		servers = append(servers, server.String())
+	}
+	params["dns"] = servers
+	if len(search) > 0 {
+		params["search"] = search
+	}
+	req := &Request{
+		Method: "configure_network",
+		Params: params,
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("configure_network failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// ConfigureInterface gives the guest interface with a MAC, one of a
+// sandbox's additional networks, static addresses and routes. Unlike
+// ConfigureNetwork, it leaves the default route and resolv.conf alone.
+// Only agents with FeatureInterfaces can find an interface by its MAC.
+func (c *Client) ConfigureInterface(ctx context.Context, mac string, addresses []*net.IPNet, routes []domain.Route) error {
+	cidrs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		cidrs = append(cidrs, address.String())
+	}
+	req := &Request{
+		Method: "configure_network",
+		Params: map[string]interface{}{
+			"mac":       mac,
+			"addresses": cidrs,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("configure_network failed: %s", resp.Error.Message)
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	params := make([]map[string]string, 0, len(routes))
+	for _, r := range routes {
+		route := map[string]string{"dst": r.Dst.String()}
+		if r.GW != nil {
+			route["gw"] = r.GW.String()
+		}
+		params = append(params, route)
+	}
+	req = &Request{
+		Method: "set_routes",
+		Params: map[string]interface{}{
+			"mac":    mac,
+			"routes": params,
+		},
+	}
+
+	resp, err = c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("set_routes failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// SetRoutes installs the sandbox's routes on the guest's interface for the
+// sandbox network, which the agent finds by its MAC, replacing any to the
+// same destinations.
+func (c *Client) SetRoutes(ctx context.Context, routes []domain.Route) error {
+	params := make([]map[string]string, 0, len(routes))
+	for _, r := range routes {
+		route := map[string]string{"dst": r.Dst.String()}
+		if r.GW != nil {
+			route["gw"] = r.GW.String()
+		}
+		params = append(params, route)
+	}
+	req := &Request{
+		Method: "set_routes",
+		Params: map[string]interface{}{
+			"routes": params,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("set_routes failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// MountVolume mounts the hot-attached drive whose filesystem carries label
+// at mountPoint in the guest, and returns the device it found. erofs drives
+// are always mounted read-only.
+func (c *Client) MountVolume(ctx context.Context, label, mountPoint, filesystem string, readOnly bool) (string, error) {
+	req := &Request{
+		Method: "mount_volume",
+		Params: map[string]interface{}{
+			"label":       label,
+			"mount_point": mountPoint,
+			"filesystem":  filesystem,
+			"read_only":   readOnly,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Error != nil {
+		return "", fmt.Errorf("mount_volume failed: %s", resp.Error.Message)
+	}
+
+	result, _ := resp.Result.(map[string]interface{})
+	device, _ := result["device"].(string)
+	return device, nil
+}
+
+// SyncTime sets the guest wall clock to now, for VMs resumed from a
+// snapshot with the clock they had when it was taken. It returns how far
+// the guest clock was off, positive when it was behind.
+func (c *Client) SyncTime(ctx context.Context, now time.Time) (time.Duration, error) {
+	req := &Request{
+		Method: "sync_time",
+		Params: map[string]interface{}{
+			"seconds": now.Unix(),
+			"nanos":   now.Nanosecond(),
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.Error != nil {
+		return 0, fmt.Errorf("sync_time failed: %s", resp.Error.Message)
+	}
+
+	result, _ := resp.Result.(map[string]interface{})
+	offset, _ := result["offset_ns"].(float64)
+	return time.Duration(offset), nil
+}
+
+// ShutdownResult is the agent's answer to Shutdown.
+type ShutdownResult struct {
+	Stopped int  // Containers that were still running
+	Synced  bool // Whether the guest's filesystems were synced
+}
+
+// Shutdown gets the guest ready for power-off: the agent stops its running
+// containers, each with its pod's grace period but no longer than timeout,
+// syncs the guest's filesystems and refuses new containers.
+func (c *Client) Shutdown(ctx context.Context, timeout time.Duration) (*ShutdownResult, error) {
+	req := &Request{
+		Method: "shutdown",
+		Params: map[string]interface{}{
+			"timeout": timeout.Seconds(),
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, fmt.Errorf("shutdown failed: %s", resp.Error.Message)
+	}
+
+	result, _ := resp.Result.(map[string]interface{})
+	stopped, _ := result["stopped"].(float64)
+	synced, _ := result["synced"].(bool)
+	return &ShutdownResult{Stopped: int(stopped), Synced: synced}, nil
+}
+
 // =============================================================================
 // Internal Methods
 // =============================================================================
 
 func (c *Client) call(ctx context.Context, req *Request) (*Response, error) {
+	// Count calls queued behind the connection lock too, so a slow guest
+	// shows up as RPCs piling up
+	defer metrics.Global().TrackInFlight(metrics.InFlightAgentRPC)()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -316,6 +819,10 @@ func (c *Client) call(ctx context.Context, req *Request) (*Response, error) {
 		return nil, fmt.Errorf("response ID mismatch: expected %d, got %d", req.ID, resp.ID)
 	}
 
+	if c.recorder != nil {
+		c.recorder.record(req, &resp)
+	}
+
 	return &resp, nil
 }
 
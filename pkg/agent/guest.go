@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ZoneinfoDir is the host directory timezone data is read from.
+const ZoneinfoDir = "/usr/share/zoneinfo"
+
+// LoadTimezone reads the tzdata of a named timezone (e.g. "Europe/Berlin")
+// from the host, so guests don't need their own zoneinfo.
+func LoadTimezone(name string) ([]byte, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid timezone %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(ZoneinfoDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", name, err)
+	}
+	if !bytes.HasPrefix(data, []byte("TZif")) {
+		return nil, fmt.Errorf("%q is not a timezone", name)
+	}
+	return data, nil
+}
+
+// LoadCABundle reads a PEM bundle of CA certificates.
+func LoadCABundle(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	if err := ValidateCABundle(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
+
+// ValidateCABundle checks that a PEM bundle holds at least one certificate
+// and nothing else, so a private key can't end up in a trust store.
+func ValidateCABundle(data []byte) error {
+	var certs int
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("CA bundle contains a %s block", block.Type)
+		}
+		certs++
+	}
+	if certs == 0 {
+		return fmt.Errorf("CA bundle contains no certificates")
+	}
+	return nil
+}
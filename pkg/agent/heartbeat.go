@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RecoveryPolicy controls what the host does when a guest stops sending
+// heartbeats.
+type RecoveryPolicy string
+
+const (
+	// PolicyAlert only logs and reports the silent sandbox.
+	PolicyAlert RecoveryPolicy = "alert"
+
+	// PolicyRestart attempts to restart the workload inside the VM.
+	PolicyRestart RecoveryPolicy = "restart"
+
+	// PolicyRecycle destroys the VM so it can be replaced.
+	PolicyRecycle RecoveryPolicy = "recycle"
+)
+
+// HeartbeatConfig configures guest heartbeat monitoring.
+type HeartbeatConfig struct {
+	// Port is the vsock port the guest agent sends heartbeats to.
+	Port uint32
+
+	// Interval is how often the guest is expected to send a heartbeat.
+	Interval time.Duration
+
+	// MissedBeats is how many consecutive intervals may pass without a
+	// heartbeat before the sandbox is marked unhealthy.
+	MissedBeats int
+
+	// Policy is the recovery action taken when the sandbox goes silent.
+	Policy RecoveryPolicy
+}
+
+// DefaultHeartbeatConfig returns sensible defaults.
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		Port:        1025,
+		Interval:    time.Second,
+		MissedBeats: 5,
+		Policy:      PolicyAlert,
+	}
+}
+
+// Heartbeat is the message the guest agent sends on the heartbeat port.
+type Heartbeat struct {
+	Seq        uint64    `json:"seq"`
+	Timestamp  time.Time `json:"timestamp"`
+	Containers int       `json:"containers"`
+}
+
+// HeartbeatMonitor receives heartbeats from a guest and reports when the
+// guest has gone silent.
+//
+// Firecracker forwards guest-initiated vsock connections on port P to the
+// Unix socket "<vsock_path>_P" on the host, so the monitor listens there.
+type HeartbeatMonitor struct {
+	mu sync.Mutex
+
+	config   HeartbeatConfig
+	log      *logrus.Entry
+	listener net.Listener
+
+	lastBeat  time.Time
+	lastSeq   uint64
+	unhealthy bool
+
+	// onUnhealthy is invoked once each time the guest transitions from
+	// healthy to silent.
+	onUnhealthy func(missed int)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewHeartbeatMonitor creates a heartbeat monitor. onUnhealthy is called
+// from a background goroutine when the guest misses too many heartbeats.
+func NewHeartbeatMonitor(config HeartbeatConfig, log *logrus.Entry, onUnhealthy func(missed int)) *HeartbeatMonitor {
+	return &HeartbeatMonitor{
+		config:      config,
+		log:         log.WithField("component", "heartbeat"),
+		onUnhealthy: onUnhealthy,
+	}
+}
+
+// HeartbeatSocketPath returns the host socket on which guest heartbeats
+// arrive for the given vsock path and port.
+func HeartbeatSocketPath(vsockPath string, port uint32) string {
+	return fmt.Sprintf("%s_%d", vsockPath, port)
+}
+
+// Start begins listening for heartbeats from the guest.
+func (h *HeartbeatMonitor) Start(ctx context.Context, vsockPath string) error {
+	socketPath := HeartbeatSocketPath(vsockPath, h.config.Port)
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen for heartbeats: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	h.mu.Lock()
+	h.listener = listener
+	h.cancel = cancel
+	// Give the guest a full grace window from the moment we start listening
+	h.lastBeat = time.Now()
+	h.mu.Unlock()
+
+	h.wg.Add(2)
+	go h.acceptLoop(ctx)
+	go h.checkLoop(ctx)
+
+	h.log.WithField("socket", socketPath).Debug("Heartbeat monitor started")
+	return nil
+}
+
+// Stop stops the monitor and releases its socket.
+func (h *HeartbeatMonitor) Stop() {
+	h.mu.Lock()
+	cancel := h.cancel
+	listener := h.listener
+	h.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if listener != nil {
+		_ = listener.Close()
+		_ = os.Remove(listener.Addr().String())
+	}
+	h.wg.Wait()
+}
+
+// LastBeat returns when the last heartbeat was received.
+func (h *HeartbeatMonitor) LastBeat() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastBeat
+}
+
+// Healthy reports whether the guest is currently sending heartbeats.
+func (h *HeartbeatMonitor) Healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.unhealthy
+}
+
+func (h *HeartbeatMonitor) acceptLoop(ctx context.Context) {
+	defer h.wg.Done()
+
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			h.log.WithError(err).Debug("Heartbeat accept failed")
+			continue
+		}
+
+		h.wg.Add(1)
+		go h.readBeats(ctx, conn)
+	}
+}
+
+func (h *HeartbeatMonitor) readBeats(ctx context.Context, conn net.Conn) {
+	defer h.wg.Done()
+	defer conn.Close()
+
+	// Unblock the decoder when the monitor is stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var beat Heartbeat
+		if err := decoder.Decode(&beat); err != nil {
+			return
+		}
+		h.recordBeat(beat)
+	}
+}
+
+func (h *HeartbeatMonitor) recordBeat(beat Heartbeat) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastBeat = time.Now()
+	h.lastSeq = beat.Seq
+
+	if h.unhealthy {
+		h.unhealthy = false
+		h.log.WithField("seq", beat.Seq).Info("Guest heartbeat resumed")
+	}
+}
+
+func (h *HeartbeatMonitor) checkLoop(ctx context.Context) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check()
+		}
+	}
+}
+
+func (h *HeartbeatMonitor) check() {
+	h.mu.Lock()
+	missed := int(time.Since(h.lastBeat) / h.config.Interval)
+	trigger := !h.unhealthy && missed >= h.config.MissedBeats
+	if trigger {
+		h.unhealthy = true
+	}
+	h.mu.Unlock()
+
+	if !trigger {
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"missed": missed,
+		"policy": h.config.Policy,
+	}).Warn("Guest stopped sending heartbeats")
+
+	if h.onUnhealthy != nil {
+		h.onUnhealthy(missed)
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHeartbeatSocketPath(t *testing.T) {
+	got := HeartbeatSocketPath("/run/fc-cri/fc-1/vsock.sock", 1025)
+	if got != "/run/fc-cri/fc-1/vsock.sock_1025" {
+		t.Errorf("HeartbeatSocketPath = %s, want /run/fc-cri/fc-1/vsock.sock_1025", got)
+	}
+}
+
+func TestHeartbeatMonitor(t *testing.T) {
+	vsockPath := filepath.Join(t.TempDir(), "vsock.sock")
+
+	config := DefaultHeartbeatConfig()
+	config.Interval = 20 * time.Millisecond
+	config.MissedBeats = 3
+
+	unhealthy := make(chan int, 1)
+	monitor := NewHeartbeatMonitor(config, logrus.NewEntry(logrus.New()), func(missed int) {
+		unhealthy <- missed
+	})
+	if err := monitor.Start(context.Background(), vsockPath); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer monitor.Stop()
+
+	conn, err := net.Dial("unix", HeartbeatSocketPath(vsockPath, config.Port))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Beat steadily for a while; the monitor must stay healthy
+	encoder := json.NewEncoder(conn)
+	for i := 1; i <= 10; i++ {
+		if err := encoder.Encode(&Heartbeat{Seq: uint64(i), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		time.Sleep(config.Interval / 2)
+	}
+	if !monitor.Healthy() {
+		t.Error("monitor unhealthy while guest is beating")
+	}
+
+	// Go silent; the monitor must report it
+	select {
+	case missed := <-unhealthy:
+		if missed < config.MissedBeats {
+			t.Errorf("unhealthy after %d missed beats, want >= %d", missed, config.MissedBeats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("monitor did not detect silent guest")
+	}
+	if monitor.Healthy() {
+		t.Error("monitor still healthy after guest went silent")
+	}
+
+	// Resuming beats restores health
+	if err := encoder.Encode(&Heartbeat{Seq: 11, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !monitor.Healthy() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !monitor.Healthy() {
+		t.Error("monitor did not recover after heartbeat resumed")
+	}
+}
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the version of the agent protocol this client speaks,
+// "major.minor". Agents of another major version are refused at Connect.
+// Minor versions only add methods, which agents announce as features, so
+// hosts and guests can be upgraded independently.
+const ProtocolVersion = "1.0"
+
+// Optional parts of the protocol an agent can announce.
+const (
+	FeatureAuth          = "auth"
+	FeatureHeartbeat     = "heartbeat"
+	FeatureNotifications = "notifications"
+	FeatureAgentLogs     = "agent_logs"
+	FeatureGuestSettings = "guest_settings"
+	FeatureOnlineCPUs    = "online_cpus"
+	FeatureRoutes        = "routes"
+	FeaturePodStats      = "pod_stats"
+	FeatureVolumes       = "volumes"
+	FeatureTimeSync      = "time_sync"
+	FeatureSecretEnv     = "secret_env"
+	FeatureShutdown      = "shutdown"
+	FeatureNetwork       = "configure_network"
+	FeatureDNSSearch     = "dns_search"
+	FeatureInterfaces    = "interfaces"
+	FeatureKernel        = "kernel_features"
+)
+
+// legacyFeatures are assumed for agents that predate get_info.
+var legacyFeatures = []string{
+	FeatureAuth,
+	FeatureHeartbeat,
+	FeatureNotifications,
+	FeatureAgentLogs,
+	FeatureGuestSettings,
+	FeatureOnlineCPUs,
+}
+
+// AgentInfo describes a guest agent.
+type AgentInfo struct {
+	Version         string    `json:"version"`
+	ProtocolVersion string    `json:"protocol_version"`
+	Features        []string  `json:"features"`
+	BootTime        time.Time `json:"boot_time"`
+	DevMode         bool      `json:"dev_mode"`
+
+	// The OCI runtime the agent runs containers with, e.g. "crun" and
+	// "1.14.4". Empty for agents that don't say.
+	Runtime        string `json:"runtime,omitempty"`
+	RuntimeVersion string `json:"runtime_version,omitempty"`
+}
+
+// KernelFeatures describes the guest kernel.
+type KernelFeatures struct {
+	Release  string   `json:"release"`  // e.g. "6.1.102"
+	Features []string `json:"features"` // e.g. "virtio_blk", "overlay"
+}
+
+// HasFeature reports whether the agent announced a feature.
+func (i *AgentInfo) HasFeature(feature string) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// GetInfo asks the agent for its version and features. Agents that predate
+// get_info are reported as protocol 1.0 with the legacy features.
+func (c *Client) GetInfo(ctx context.Context) (*AgentInfo, error) {
+	resp, err := c.call(ctx, &Request{Method: "get_info"})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		if resp.Error.Code == errCodeMethodNotFound {
+			return &AgentInfo{
+				Version:         "unknown",
+				ProtocolVersion: "1.0",
+				Features:        legacyFeatures,
+			}, nil
+		}
+		return nil, fmt.Errorf("get_info failed: %s", resp.Error.Message)
+	}
+
+	data, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, err
+	}
+	var info AgentInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid get_info response: %w", err)
+	}
+	return &info, nil
+}
+
+// GetKernelFeatures asks the agent which of the kernel features the
+// runtime may need the guest kernel has.
+func (c *Client) GetKernelFeatures(ctx context.Context) (*KernelFeatures, error) {
+	resp, err := c.call(ctx, &Request{Method: "get_kernel_features"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("get_kernel_features failed: %s", resp.Error.Message)
+	}
+
+	data, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, err
+	}
+	var features KernelFeatures
+	if err := json.Unmarshal(data, &features); err != nil {
+		return nil, fmt.Errorf("invalid get_kernel_features response: %w", err)
+	}
+	return &features, nil
+}
+
+// Info returns the agent info negotiated at Connect, or nil before.
+func (c *Client) Info() *AgentInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// Supports reports whether the connected agent announced a feature.
+func (c *Client) Supports(feature string) bool {
+	info := c.Info()
+	return info != nil && info.HasFeature(feature)
+}
+
+// negotiate checks that the agent speaks a compatible protocol and records
+// its info.
+func (c *Client) negotiate(ctx context.Context) error {
+	info, err := c.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkProtocolVersion(info.ProtocolVersion); err != nil {
+		return fmt.Errorf("agent %s: %w", info.Version, err)
+	}
+
+	c.mu.Lock()
+	c.info = info
+	c.mu.Unlock()
+	return nil
+}
+
+// checkProtocolVersion accepts agent protocol versions of the client's
+// major version.
+func checkProtocolVersion(version string) error {
+	agentMajor, err := protocolMajor(version)
+	if err != nil {
+		return err
+	}
+	clientMajor, _ := protocolMajor(ProtocolVersion)
+	if agentMajor != clientMajor {
+		return fmt.Errorf("incompatible agent protocol %s, host speaks %s", version, ProtocolVersion)
+	}
+	return nil
+}
+
+// protocolMajor returns the major version of a "major.minor" version.
+func protocolMajor(version string) (int, error) {
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("invalid agent protocol version %q", version)
+	}
+	return n, nil
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCheckProtocolVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"1.0", false},
+		{"1.7", false},
+		{"1", false},
+		{"2.0", true},
+		{"0.9", true},
+		{"", true},
+		{"v1.0", true},
+	}
+
+	for _, tt := range tests {
+		err := checkProtocolVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkProtocolVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+		}
+	}
+}
+
+// infoAgent answers get_info with result, or as an agent that predates
+// get_info if result is nil.
+func infoAgent(conn net.Conn, result map[string]interface{}) {
+	go func() {
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		encoder := json.NewEncoder(conn)
+		for {
+			var req Request
+			if err := decoder.Decode(&req); err != nil {
+				return
+			}
+			resp := Response{ID: req.ID}
+			if result == nil {
+				resp.Error = &ResponseError{Code: -32601, Message: "Method not found"}
+			} else {
+				resp.Result = result
+			}
+			if err := encoder.Encode(resp); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      map[string]interface{}
+		wantErr     bool
+		wantVersion string
+		wantRoutes  bool
+	}{
+		{
+			name: "current agent",
+			result: map[string]interface{}{
+				"version":          "v0.4.0",
+				"protocol_version": "1.1",
+				"features":         []string{FeatureAuth, FeatureRoutes},
+				"boot_time":        "2026-01-02T03:04:05Z",
+			},
+			wantVersion: "v0.4.0",
+			wantRoutes:  true,
+		},
+		{
+			name:        "agent without get_info",
+			result:      nil,
+			wantVersion: "unknown",
+		},
+		{
+			name: "incompatible agent",
+			result: map[string]interface{}{
+				"version":          "v2.0.0",
+				"protocol_version": "2.0",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, server := net.Pipe()
+			defer conn.Close()
+			infoAgent(server, tt.result)
+
+			c := NewClient(logrus.NewEntry(logrus.New()))
+			c.conn = conn
+			c.encoder = json.NewEncoder(conn)
+			c.decoder = json.NewDecoder(conn)
+
+			err := c.negotiate(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if c.Info() != nil {
+					t.Error("Info() set after failed negotiation")
+				}
+				return
+			}
+			if got := c.Info().Version; got != tt.wantVersion {
+				t.Errorf("Version = %s, want %s", got, tt.wantVersion)
+			}
+			if got := c.Supports(FeatureRoutes); got != tt.wantRoutes {
+				t.Errorf("Supports(routes) = %v, want %v", got, tt.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	conn, server := net.Pipe()
+	defer conn.Close()
+	infoAgent(server, map[string]interface{}{"stopped": 2, "synced": true})
+
+	c := NewClient(logrus.NewEntry(logrus.New()))
+	c.conn = conn
+	c.encoder = json.NewEncoder(conn)
+	c.decoder = json.NewDecoder(conn)
+
+	result, err := c.Shutdown(context.Background(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if result.Stopped != 2 || !result.Synced {
+		t.Errorf("Shutdown() = %+v, want 2 stopped and synced", result)
+	}
+}
+
+func TestGetKernelFeatures(t *testing.T) {
+	conn, server := net.Pipe()
+	defer conn.Close()
+	infoAgent(server, map[string]interface{}{"release": "6.1.102", "features": []string{"virtio_blk", "vsock"}})
+
+	c := NewClient(logrus.NewEntry(logrus.New()))
+	c.conn = conn
+	c.encoder = json.NewEncoder(conn)
+	c.decoder = json.NewDecoder(conn)
+
+	features, err := c.GetKernelFeatures(context.Background())
+	if err != nil {
+		t.Fatalf("GetKernelFeatures() error = %v", err)
+	}
+	if features.Release != "6.1.102" || len(features.Features) != 2 || features.Features[1] != "vsock" {
+		t.Errorf("GetKernelFeatures() = %+v", features)
+	}
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LivenessConfig configures host-initiated liveness checks of the guest
+// agent. Unlike heartbeats, which the guest sends on its own, these catch
+// an agent whose RPC connection broke or stopped answering while the guest
+// itself keeps running.
+type LivenessConfig struct {
+	// Interval is how often the agent is pinged. 0 disables the checks.
+	Interval time.Duration
+
+	// Window is how long the agent may go without answering before the
+	// sandbox is marked not ready.
+	Window time.Duration
+
+	// MaxBackoff caps the delay between reconnect attempts, which starts
+	// at Interval and doubles after each failure.
+	MaxBackoff time.Duration
+
+	// RestartVM replaces the VM of a sandbox whose agent stays silent for
+	// the window, keeping its containers' IDs.
+	RestartVM bool
+}
+
+// DefaultLivenessConfig returns sensible defaults.
+func DefaultLivenessConfig() LivenessConfig {
+	return LivenessConfig{
+		Interval:   5 * time.Second,
+		Window:     30 * time.Second,
+		MaxBackoff: 10 * time.Second,
+		RestartVM:  false,
+	}
+}
+
+// LivenessWatchdog pings the guest agent and reconnects to it with
+// exponential backoff when a ping fails. It reports when the agent has
+// been unreachable for the whole window and when it answers again.
+type LivenessWatchdog struct {
+	mu sync.Mutex
+
+	config    LivenessConfig
+	log       *logrus.Entry
+	ping      func(ctx context.Context) error
+	reconnect func(ctx context.Context) error
+
+	lastAnswer time.Time
+	down       bool
+
+	// onDown is invoked once each time the agent goes unreachable for
+	// the window, with how long it has been silent; onUp when it
+	// answers again after that.
+	onDown func(silent time.Duration)
+	onUp   func()
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewLivenessWatchdog creates a watchdog that checks the agent with ping and
+// restores its connection with reconnect. onDown and onUp are called from a
+// background goroutine.
+func NewLivenessWatchdog(config LivenessConfig, log *logrus.Entry, ping, reconnect func(ctx context.Context) error, onDown func(silent time.Duration), onUp func()) *LivenessWatchdog {
+	return &LivenessWatchdog{
+		config:    config,
+		log:       log.WithField("component", "liveness"),
+		ping:      ping,
+		reconnect: reconnect,
+		onDown:    onDown,
+		onUp:      onUp,
+	}
+}
+
+// Start begins checking the agent. It is a no-op if Interval is 0.
+func (w *LivenessWatchdog) Start(ctx context.Context) {
+	if w.config.Interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	w.mu.Lock()
+	w.cancel = cancel
+	w.lastAnswer = time.Now()
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go w.run(ctx)
+}
+
+// Stop stops checking the agent.
+func (w *LivenessWatchdog) Stop() {
+	w.mu.Lock()
+	cancel := w.cancel
+	w.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	w.wg.Wait()
+}
+
+// Down reports whether the agent has been unreachable for the window.
+func (w *LivenessWatchdog) Down() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.down
+}
+
+// LastAnswer returns when the agent last answered.
+func (w *LivenessWatchdog) LastAnswer() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastAnswer
+}
+
+func (w *LivenessWatchdog) run(ctx context.Context) {
+	defer w.wg.Done()
+
+	delay := w.config.Interval
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if w.check(ctx) {
+			delay = w.config.Interval
+		} else {
+			delay *= 2
+			if w.config.MaxBackoff > 0 && delay > w.config.MaxBackoff {
+				delay = w.config.MaxBackoff
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// check pings the agent, reconnecting if the ping fails, and reports
+// whether it answered.
+func (w *LivenessWatchdog) check(ctx context.Context) bool {
+	err := w.call(ctx, w.ping)
+	if err != nil && ctx.Err() == nil {
+		w.log.WithError(err).Debug("Agent did not answer ping, reconnecting")
+		err = w.call(ctx, w.reconnect)
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	w.mu.Lock()
+	if err == nil {
+		w.lastAnswer = time.Now()
+		recovered := w.down
+		w.down = false
+		w.mu.Unlock()
+
+		if recovered {
+			w.log.Info("Agent is answering again")
+			w.onUp()
+		}
+		return true
+	}
+
+	silent := time.Since(w.lastAnswer)
+	if w.down || silent < w.config.Window {
+		w.mu.Unlock()
+		w.log.WithError(err).WithField("silent", silent).Debug("Failed to reconnect to agent")
+		return false
+	}
+	w.down = true
+	w.mu.Unlock()
+
+	w.log.WithError(err).WithField("silent", silent).Warn("Agent is unreachable")
+	w.onDown(silent)
+	return false
+}
+
+// call runs fn with a deadline of one interval, so a hung agent can't
+// stall the watchdog.
+func (w *LivenessWatchdog) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, w.config.Interval)
+	defer cancel()
+	return fn(ctx)
+}
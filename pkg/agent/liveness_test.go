@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLivenessWatchdog(t *testing.T) {
+	config := LivenessConfig{
+		Interval:   10 * time.Millisecond,
+		Window:     50 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	}
+
+	var answering, reachable atomic.Bool
+	answering.Store(true)
+	var reconnectCalls atomic.Int32
+	respond := func(ctx context.Context) error {
+		if !answering.Load() {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	}
+	reconnect := func(ctx context.Context) error {
+		reconnectCalls.Add(1)
+		if !reachable.Load() {
+			return errors.New("connection refused")
+		}
+		answering.Store(true)
+		return nil
+	}
+
+	down := make(chan time.Duration, 1)
+	up := make(chan struct{}, 1)
+	watchdog := NewLivenessWatchdog(config, logrus.NewEntry(logrus.New()), respond, reconnect,
+		func(silent time.Duration) { down <- silent },
+		func() { up <- struct{}{} })
+	watchdog.Start(context.Background())
+	defer watchdog.Stop()
+
+	// An answering agent is never reported
+	time.Sleep(5 * config.Interval)
+	if watchdog.Down() || reconnectCalls.Load() != 0 {
+		t.Fatalf("watchdog down=%v after %d reconnects while the agent answers", watchdog.Down(), reconnectCalls.Load())
+	}
+
+	// The agent stops answering and can't be reconnected to
+	answering.Store(false)
+	select {
+	case silent := <-down:
+		if silent < config.Window {
+			t.Errorf("reported down after %v, want >= %v", silent, config.Window)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unreachable agent was never reported")
+	}
+	if !watchdog.Down() {
+		t.Error("Down() = false after reporting the agent down")
+	}
+	if n := reconnectCalls.Load(); n < 2 {
+		t.Errorf("made %d reconnect attempts, want several", n)
+	}
+
+	// Reconnecting brings it back
+	reachable.Store(true)
+	select {
+	case <-up:
+	case <-time.After(time.Second):
+		t.Fatal("reconnected agent was never reported")
+	}
+	if watchdog.Down() {
+		t.Error("Down() = true after the agent answered again")
+	}
+}
+
+func TestLivenessWatchdogDisabled(t *testing.T) {
+	called := false
+	watchdog := NewLivenessWatchdog(LivenessConfig{}, logrus.NewEntry(logrus.New()),
+		func(ctx context.Context) error { called = true; return nil },
+		func(ctx context.Context) error { return nil },
+		func(time.Duration) {}, func() {})
+	watchdog.Start(context.Background())
+	watchdog.Stop()
+	if called {
+		t.Error("disabled watchdog pinged the agent")
+	}
+}
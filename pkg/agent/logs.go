@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logRetryInterval is how long the log shipper waits before reconnecting
+// to an agent whose log stream broke.
+const logRetryInterval = 2 * time.Second
+
+// Agent log levels.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelError = "error"
+)
+
+// LogEntry is a guest agent log record. Seq numbers the agent's entries, so
+// a stream can resume after the last entry it saw.
+type LogEntry struct {
+	Seq    uint64                 `json:"seq"`
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// logBatch is a stream_agent_logs response.
+type logBatch struct {
+	Entries []LogEntry `json:"entries"`
+	Dropped uint64     `json:"dropped,omitempty"`
+}
+
+// SetLogLevel changes the guest agent's log level: "debug", "info" or
+// "error".
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	req := &Request{
+		Method: "set_log_level",
+		Params: map[string]interface{}{
+			"level": level,
+		},
+	}
+
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("set_log_level failed: %s", resp.Error.Message)
+	}
+
+	return nil
+}
+
+// StreamLogs reads the guest agent's log entries after since from conn and
+// calls fn with each one. Without follow it returns once the buffered
+// entries are read; with follow it keeps reading until ctx is done or the
+// connection fails. A following stream takes over the connection, so conn
+// must not be shared with a Client. dropped is called with the number of
+// entries the agent discarded before they could be read.
+func StreamLogs(ctx context.Context, conn net.Conn, since uint64, follow bool, fn func(LogEntry), dropped func(uint64)) error {
+	// Unblock the decoder when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := &Request{
+		ID:     1,
+		Method: "stream_agent_logs",
+		Params: map[string]interface{}{
+			"since":  since,
+			"follow": follow,
+		},
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var resp struct {
+			ID     uint64         `json:"id"`
+			Result logBatch       `json:"result"`
+			Error  *ResponseError `json:"error,omitempty"`
+		}
+		if err := decoder.Decode(&resp); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read logs: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("stream_agent_logs failed: %s", resp.Error.Message)
+		}
+
+		if resp.Result.Dropped > 0 && dropped != nil {
+			dropped(resp.Result.Dropped)
+		}
+		for _, entry := range resp.Result.Entries {
+			fn(entry)
+		}
+		if !follow {
+			return nil
+		}
+	}
+}
+
+// LogShipper copies a guest agent's logs into the host's log, so they go
+// through the same pipeline as the shim's own. It follows the agent's log
+// stream on a connection of its own, reconnecting if the stream breaks and
+// resuming after the last entry it shipped.
+type LogShipper struct {
+	log *logrus.Entry
+
+	// last is the sequence number of the last entry shipped. Only used by
+	// the shipping goroutine.
+	last uint64
+
+	// authKey authenticates the shipper's connections to the agent.
+	authKey []byte
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewLogShipper creates a shipper that writes agent logs to log.
+func NewLogShipper(log *logrus.Entry) *LogShipper {
+	return &LogShipper{
+		log: log.WithField("component", "fc-agent"),
+	}
+}
+
+// SetAuthKey sets the key the shipper authenticates to the agent with. It
+// must be called before Start.
+func (s *LogShipper) SetAuthKey(key []byte) {
+	s.authKey = key
+}
+
+// Start begins shipping the logs of the agent listening on port.
+func (s *LogShipper) Start(ctx context.Context, vsockPath string, cid uint32, port uint32) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	s.wg.Add(1)
+	go s.run(ctx, vsockPath, cid, port)
+}
+
+// Stop stops shipping logs.
+func (s *LogShipper) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *LogShipper) run(ctx context.Context, vsockPath string, cid uint32, port uint32) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := dialAuthenticated(vsockPath, cid, port, s.authKey)
+		if err == nil {
+			err = StreamLogs(ctx, conn, s.last, true, s.ship, func(n uint64) {
+				s.log.WithField("count", n).Warn("Guest agent logs were dropped before they could be shipped")
+			})
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.WithError(err).Debug("Agent log stream broke, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(logRetryInterval):
+		}
+	}
+}
+
+// ship writes one agent log entry to the host's log.
+func (s *LogShipper) ship(entry LogEntry) {
+	s.last = entry.Seq
+
+	log := s.log.WithFields(logrus.Fields(entry.Fields)).WithTime(entry.Time)
+	switch entry.Level {
+	case LogLevelDebug:
+		log.Debug(entry.Msg)
+	case LogLevelError:
+		log.Error(entry.Msg)
+	default:
+		log.Info(entry.Msg)
+	}
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeLogAgent answers one stream_agent_logs request per connection with
+// the given batches.
+func fakeLogAgent(t *testing.T, listener net.Listener, requests chan<- Request, batches ...logBatch) {
+	t.Helper()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var req Request
+				if err := json.NewDecoder(conn).Decode(&req); err != nil {
+					return
+				}
+				requests <- req
+				encoder := json.NewEncoder(conn)
+				for _, batch := range batches {
+					if err := encoder.Encode(map[string]interface{}{"id": req.ID, "result": batch}); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func TestStreamLogs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		var req Request
+		if err := json.NewDecoder(server).Decode(&req); err != nil {
+			return
+		}
+		_ = json.NewEncoder(server).Encode(map[string]interface{}{
+			"id": req.ID,
+			"result": logBatch{
+				Entries: []LogEntry{{Seq: 8, Level: LogLevelInfo, Msg: "Container started"}},
+				Dropped: 3,
+			},
+		})
+	}()
+
+	var got []LogEntry
+	var dropped uint64
+	err := StreamLogs(context.Background(), client, 4, false, func(e LogEntry) {
+		got = append(got, e)
+	}, func(n uint64) { dropped = n })
+	if err != nil {
+		t.Fatalf("StreamLogs() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Seq != 8 || got[0].Msg != "Container started" || dropped != 3 {
+		t.Errorf("StreamLogs() = %+v, dropped %d", got, dropped)
+	}
+}
+
+func TestLogShipper(t *testing.T) {
+	vsockPath := filepath.Join(t.TempDir(), "vsock.sock")
+	listener, err := net.Listen("unix", vsockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	requests := make(chan Request, 2)
+	fakeLogAgent(t, listener, requests, logBatch{Entries: []LogEntry{
+		{Seq: 1, Level: LogLevelInfo, Msg: "Listening on vsock", Fields: map[string]interface{}{"port": 1024}},
+		{Seq: 2, Level: LogLevelError, Msg: "Heartbeat failed"},
+	}})
+
+	logger, hook := test.NewNullLogger()
+	shipper := NewLogShipper(logrus.NewEntry(logger))
+	shipper.Start(context.Background(), vsockPath, 0, 1024)
+	defer shipper.Stop()
+
+	if req := <-requests; req.Method != "stream_agent_logs" || req.Params["follow"] != true {
+		t.Errorf("first request = %+v", req)
+	}
+
+	// The fake agent hangs up after one batch; the shipper resumes after
+	// the last entry it shipped
+	select {
+	case req := <-requests:
+		if req.Params["since"] != float64(2) {
+			t.Errorf("resumed since %v, want 2", req.Params["since"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shipper did not reconnect")
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) < 2 || entries[0].Message != "Listening on vsock" || entries[1].Level != logrus.ErrorLevel {
+		t.Fatalf("shipped %d entries", len(entries))
+	}
+	if entries[0].Data["component"] != "fc-agent" || entries[0].Data["port"] != float64(1024) {
+		t.Errorf("entry fields = %v", entries[0].Data)
+	}
+}
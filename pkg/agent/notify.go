@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NotifyPort is the host vsock port the guest agent sends container
+// notifications to.
+const NotifyPort = 1026
+
+// Notification types.
+const (
+	// NotifyExit reports that a container's init process exited.
+	NotifyExit = "exit"
+
+	// NotifyOOM reports that the OOM killer killed a process in a container.
+	// The container keeps running unless the victim was its init process.
+	NotifyOOM = "oom"
+)
+
+// Notification is a message the guest agent sends when something happens to
+// a container.
+type Notification struct {
+	Type        string    `json:"type"`
+	ContainerID string    `json:"container_id"`
+	PID         int       `json:"pid"`
+	ExitCode    int       `json:"exit_code,omitempty"`
+	OOMKilled   bool      `json:"oom_killed,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// NotificationListener receives container notifications from a guest.
+//
+// Like heartbeats, notifications arrive on the Unix socket Firecracker
+// forwards guest-initiated connections to. The guest keeps a notification
+// queued until it has been written, so events that happen while nobody is
+// listening are delivered once the listener starts.
+type NotificationListener struct {
+	mu sync.Mutex
+
+	log      *logrus.Entry
+	listener net.Listener
+
+	// handler is invoked from a background goroutine for each notification.
+	handler func(Notification)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNotificationListener creates a listener that calls handler for every
+// notification sent by the guest.
+func NewNotificationListener(log *logrus.Entry, handler func(Notification)) *NotificationListener {
+	return &NotificationListener{
+		log:     log.WithField("component", "notifications"),
+		handler: handler,
+	}
+}
+
+// NotificationSocketPath returns the host socket on which notifications
+// arrive for the given vsock path.
+func NotificationSocketPath(vsockPath string) string {
+	return fmt.Sprintf("%s_%d", vsockPath, NotifyPort)
+}
+
+// Start begins listening for notifications from the guest.
+func (e *NotificationListener) Start(ctx context.Context, vsockPath string) error {
+	socketPath := NotificationSocketPath(vsockPath)
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen for notifications: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	e.mu.Lock()
+	e.listener = listener
+	e.cancel = cancel
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go e.acceptLoop(ctx)
+
+	e.log.WithField("socket", socketPath).Debug("Notification listener started")
+	return nil
+}
+
+// Stop stops the listener and releases its socket.
+func (e *NotificationListener) Stop() {
+	e.mu.Lock()
+	cancel := e.cancel
+	listener := e.listener
+	e.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if listener != nil {
+		_ = listener.Close()
+		_ = os.Remove(listener.Addr().String())
+	}
+	e.wg.Wait()
+}
+
+func (e *NotificationListener) acceptLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			e.log.WithError(err).Debug("Notification accept failed")
+			continue
+		}
+
+		e.wg.Add(1)
+		go e.readNotifications(ctx, conn)
+	}
+}
+
+func (e *NotificationListener) readNotifications(ctx context.Context, conn net.Conn) {
+	defer e.wg.Done()
+	defer conn.Close()
+
+	// Unblock the decoder when the listener is stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var n Notification
+		if err := decoder.Decode(&n); err != nil {
+			return
+		}
+
+		e.log.WithFields(logrus.Fields{
+			"type":         n.Type,
+			"container_id": n.ContainerID,
+			"pid":          n.PID,
+		}).Debug("Container notification")
+
+		if e.handler != nil {
+			e.handler(n)
+		}
+	}
+}
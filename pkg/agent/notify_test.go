@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNotificationSocketPath(t *testing.T) {
+	got := NotificationSocketPath("/run/fc-cri/fc-1/vsock.sock")
+	if got != "/run/fc-cri/fc-1/vsock.sock_1026" {
+		t.Errorf("NotificationSocketPath = %s, want /run/fc-cri/fc-1/vsock.sock_1026", got)
+	}
+}
+
+func TestNotificationListener(t *testing.T) {
+	vsockPath := filepath.Join(t.TempDir(), "vsock.sock")
+
+	received := make(chan Notification, 2)
+	listener := NewNotificationListener(logrus.NewEntry(logrus.New()), func(n Notification) {
+		received <- n
+	})
+	if err := listener.Start(context.Background(), vsockPath); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer listener.Stop()
+
+	conn, err := net.Dial("unix", NotificationSocketPath(vsockPath))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	sent := []Notification{
+		{Type: NotifyOOM, ContainerID: "c2", PID: 11, Time: time.Now()},
+		{Type: NotifyExit, ContainerID: "c2", PID: 11, ExitCode: 137, OOMKilled: true, Time: time.Now()},
+	}
+	for i := range sent {
+		if err := encoder.Encode(&sent[i]); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+	}
+
+	for _, want := range sent {
+		select {
+		case got := <-received:
+			if got.Type != want.Type || got.ContainerID != want.ContainerID || got.PID != want.PID ||
+				got.ExitCode != want.ExitCode || got.OOMKilled != want.OOMKilled {
+				t.Errorf("notification = %+v, want %+v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s notification for %s not delivered", want.Type, want.ContainerID)
+		}
+	}
+}
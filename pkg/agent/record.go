@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// errCodeReplay answers requests a Replayer has no recording for.
+const errCodeReplay = -32000
+
+// redacted replaces the values of secret environment variables in
+// recordings.
+const redacted = "<redacted>"
+
+// Exchange is one recorded agent call: the request without its ID and the
+// agent's answer.
+type Exchange struct {
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Result interface{}            `json:"result,omitempty"`
+	Error  *ResponseError         `json:"error,omitempty"`
+}
+
+// recorder appends exchanges to a file, one JSON object per line.
+type recorder struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// RecordTo appends every call the client makes, and the agent's answers,
+// to path, for replaying with a Replayer. Recordings hold everything sent
+// to the guest, including container environments, so the file is only
+// readable by its owner. The values of secret environment variables are
+// redacted.
+func (c *Client) RecordTo(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open agent recording: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recorder != nil {
+		_ = c.recorder.file.Close()
+	}
+	c.recorder = &recorder{file: file, encoder: json.NewEncoder(file)}
+	return nil
+}
+
+// record appends an exchange. A failing recording never fails the call.
+func (r *recorder) record(req *Request, resp *Response) {
+	_ = r.encoder.Encode(Exchange{
+		Method: req.Method,
+		Params: redactParams(req.Params),
+		Result: resp.Result,
+		Error:  resp.Error,
+	})
+}
+
+// LoadRecording reads the exchanges recorded by RecordTo.
+func LoadRecording(path string) ([]Exchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var exchanges []Exchange
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var ex Exchange
+		if err := decoder.Decode(&ex); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", path, err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	return exchanges, nil
+}
+
+// Replayer plays the agent's side of a recording, so code driving a Client
+// can be tested without a VM. Requests must arrive in the recorded order
+// with the recorded parameters; others are answered with an error and
+// reported by Err.
+type Replayer struct {
+	// IgnoreParams matches requests on their method alone.
+	IgnoreParams bool
+
+	mu        sync.Mutex
+	exchanges []Exchange
+	next      int
+	err       error
+}
+
+// NewReplayer creates a replayer for a recording.
+func NewReplayer(exchanges []Exchange) *Replayer {
+	return &Replayer{exchanges: exchanges}
+}
+
+// Conn returns a connection to the replayed agent, for Client.ConnectConn.
+func (r *Replayer) Conn() net.Conn {
+	client, server := net.Pipe()
+	go r.serve(server)
+	return client
+}
+
+// Err returns the first request that didn't match the recording or, once
+// every request matched, the exchanges that were never requested.
+func (r *Replayer) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if left := len(r.exchanges) - r.next; left > 0 {
+		return fmt.Errorf("replay: %d recorded calls not made, next %s", left, r.exchanges[r.next].Method)
+	}
+	return nil
+}
+
+func (r *Replayer) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		var req Request
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		if err := encoder.Encode(r.answer(&req)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the recorded response to the next request.
+func (r *Replayer) answer(req *Request) *Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := &Response{ID: req.ID}
+	fail := func(err error) *Response {
+		if r.err == nil {
+			r.err = err
+		}
+		resp.Error = &ResponseError{Code: errCodeReplay, Message: err.Error()}
+		return resp
+	}
+
+	if r.next >= len(r.exchanges) {
+		return fail(fmt.Errorf("replay: unexpected %s after the recording ended", req.Method))
+	}
+	ex := r.exchanges[r.next]
+	if req.Method != ex.Method {
+		return fail(fmt.Errorf("replay: call %d is %s, recorded %s", r.next+1, req.Method, ex.Method))
+	}
+	params := redactParams(req.Params)
+	if !r.IgnoreParams && !sameParams(params, ex.Params) {
+		return fail(fmt.Errorf("replay: call %d (%s) has params %v, recorded %v", r.next+1, req.Method, params, ex.Params))
+	}
+
+	r.next++
+	resp.Result = ex.Result
+	resp.Error = ex.Error
+	return resp
+}
+
+// sameParams compares params decoded from JSON, treating nil and empty
+// alike.
+func sameParams(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// redactParams returns params with the values of secret environment
+// variables replaced, leaving params itself alone.
+func redactParams(params map[string]interface{}) map[string]interface{} {
+	var env []string
+	switch secret := params["secret_env"].(type) {
+	case []string:
+		env = secret
+	case []interface{}:
+		for _, item := range secret {
+			entry, _ := item.(string)
+			env = append(env, entry)
+		}
+	default:
+		return params
+	}
+
+	names := make([]interface{}, len(env))
+	for i, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		names[i] = name + "=" + redacted
+	}
+	copied := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		copied[key] = value
+	}
+	copied["secret_env"] = names
+	return copied
+}
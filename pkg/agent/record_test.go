@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sandbox.jsonl")
+	log := logrus.NewEntry(logrus.New())
+	ctx := context.Background()
+
+	// Record a session with a live agent
+	conn, server := net.Pipe()
+	infoAgent(server, map[string]interface{}{
+		"version":          "v0.4.0",
+		"protocol_version": "1.0",
+		"features":         []string{FeatureOnlineCPUs},
+	})
+	c := NewClient(log)
+	if err := c.RecordTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConnectConn(ctx, conn); err != nil {
+		t.Fatalf("ConnectConn() error = %v", err)
+	}
+	if err := c.SetOnlineCPUs(ctx, 2); err != nil {
+		t.Fatalf("SetOnlineCPUs() error = %v", err)
+	}
+	c.Close()
+
+	exchanges, err := LoadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, ex := range exchanges {
+		methods = append(methods, ex.Method)
+	}
+	if len(methods) != 3 || methods[0] != "ping" || methods[1] != "get_info" || methods[2] != "set_online_cpus" {
+		t.Fatalf("recorded %v, want ping, get_info, set_online_cpus", methods)
+	}
+
+	// The same calls replay without an agent
+	replayer := NewReplayer(exchanges)
+	c = NewClient(log)
+	if err := c.ConnectConn(ctx, replayer.Conn()); err != nil {
+		t.Fatalf("ConnectConn() on replay error = %v", err)
+	}
+	if got := c.Info().Version; got != "v0.4.0" {
+		t.Errorf("replayed Version = %s, want v0.4.0", got)
+	}
+	if err := c.SetOnlineCPUs(ctx, 2); err != nil {
+		t.Errorf("replayed SetOnlineCPUs() error = %v", err)
+	}
+	c.Close()
+	if err := replayer.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+
+	// Calls that stray from the recording fail and are reported
+	replayer = NewReplayer(exchanges)
+	c = NewClient(log)
+	if err := c.ConnectConn(ctx, replayer.Conn()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOnlineCPUs(ctx, 4); err == nil {
+		t.Error("SetOnlineCPUs(4) succeeded against a recording of 2")
+	}
+	c.Close()
+	if replayer.Err() == nil {
+		t.Error("Err() = nil after a mismatched call")
+	}
+
+	// Calls the recording doesn't reach are reported too
+	replayer = NewReplayer(exchanges)
+	c = NewClient(log)
+	if err := c.ConnectConn(ctx, replayer.Conn()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if replayer.Err() == nil {
+		t.Error("Err() = nil with set_online_cpus never called")
+	}
+}
+
+func TestRedactParams(t *testing.T) {
+	params := map[string]interface{}{
+		"id":         "c1",
+		"secret_env": []string{"DB_PASSWORD=hunter2", "TOKEN=a=b"},
+	}
+	got := redactParams(params)
+	want := []interface{}{"DB_PASSWORD=" + redacted, "TOKEN=" + redacted}
+	if !reflect.DeepEqual(got["secret_env"], want) || got["id"] != "c1" {
+		t.Errorf("redactParams() = %v, want secret_env %v", got, want)
+	}
+	if env := params["secret_env"].([]string); env[0] != "DB_PASSWORD=hunter2" {
+		t.Error("redactParams() changed its argument")
+	}
+
+	// Decoded requests replay against redacted recordings
+	decoded := map[string]interface{}{"secret_env": []interface{}{"DB_PASSWORD=hunter2"}}
+	if !sameParams(redactParams(decoded), map[string]interface{}{"secret_env": []interface{}{"DB_PASSWORD=" + redacted}}) {
+		t.Error("redacted request doesn't match its recording")
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeAgent answers one sync_time request with resp, passing the request's
+// params to got.
+func timeAgent(conn net.Conn, resp Response, got chan<- map[string]interface{}) {
+	go func() {
+		defer conn.Close()
+		var req Request
+		if err := json.NewDecoder(conn).Decode(&req); err != nil {
+			return
+		}
+		got <- req.Params
+		resp.ID = req.ID
+		_ = json.NewEncoder(conn).Encode(resp)
+	}()
+}
+
+func TestSyncTime(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       Response
+		wantOffset time.Duration
+		wantErr    string
+	}{
+		{
+			name:       "guest behind",
+			resp:       Response{Result: map[string]interface{}{"offset_ns": int64(72 * time.Hour)}},
+			wantOffset: 72 * time.Hour,
+		},
+		{
+			name:       "guest ahead",
+			resp:       Response{Result: map[string]interface{}{"offset_ns": int64(-1500 * time.Millisecond)}},
+			wantOffset: -1500 * time.Millisecond,
+		},
+		{
+			name:    "refused",
+			resp:    Response{Error: &ResponseError{Code: -32000, Message: "setting the clock is not supported in dev mode"}},
+			wantErr: "sync_time failed: setting the clock is not supported in dev mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, conn := net.Pipe()
+			defer conn.Close()
+			params := make(chan map[string]interface{}, 1)
+			timeAgent(server, tt.resp, params)
+
+			c := NewClient(logrus.NewEntry(logrus.New()))
+			c.conn = conn
+			c.encoder = json.NewEncoder(conn)
+			c.decoder = json.NewDecoder(conn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			now := time.Unix(1700000000, 123456789)
+			offset, err := c.SyncTime(ctx, now)
+
+			// The time goes as seconds and nanoseconds, which JSON numbers
+			// carry exactly
+			got := <-params
+			if got["seconds"] != float64(1700000000) || got["nanos"] != float64(123456789) {
+				t.Errorf("sent params %v, want seconds 1700000000 and nanos 123456789", got)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("SyncTime() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SyncTime() error = %v", err)
+			}
+			if offset != tt.wantOffset {
+				t.Errorf("SyncTime() = %v, want %v", offset, tt.wantOffset)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package annotation defines the annotations that configure sandboxes:
+// their keys, the values each takes, and the deprecated keys still
+// accepted for them. The shim checks every pod against the schema before
+// creating its VM; CRI integrations and fcctl can check or describe pods
+// with it before they reach a node.
+package annotation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+const (
+	// Prefix is the prefix of the runtime's annotations.
+	Prefix = "fc-cri.io/"
+
+	// DeprecatedPrefix is the runtime's former prefix. Every annotation is
+	// still accepted under it, as an alias of its key.
+	DeprecatedPrefix = "io.pipeops.firecracker/"
+)
+
+// Pod annotations.
+const (
+	// VM shape. A pod whose shape matches a pool bucket gets a pre-warmed VM
+	// from it; other shapes boot a fresh VM.
+	VCPUs    = Prefix + "vcpus"
+	MemoryMB = Prefix + "memory-mb"
+
+	// Kernel boots the pod's VM with a kernel from the kernel store (e.g.
+	// "6.1-minimal") instead of the default one.
+	Kernel = Prefix + "kernel"
+
+	// CPUTemplate picks the CPU template a pod's VM boots with: a
+	// Firecracker static template such as "T2S" or "C3", or the name of a
+	// custom template in the configured templates directory.
+	CPUTemplate = Prefix + "cpu-template"
+
+	// RuntimeDirClass picks the runtime directory class a pod's sandbox
+	// directory is created in, such as a fast local disk for
+	// latency-critical pods. The classes are configured with
+	// FC_CRI_RUNTIME_DIR_CLASSES.
+	RuntimeDirClass = Prefix + "runtime-dir-class"
+
+	// Timezone sets the guest's timezone (e.g. "Europe/Berlin") from the
+	// host's zoneinfo.
+	Timezone = Prefix + "timezone"
+
+	// CABundle installs a CA bundle, named by its file in the node's CA
+	// bundle directory without the .pem extension.
+	CABundle = Prefix + "ca-bundle"
+
+	// MMDS exposes the metadata service to the pod's guest: "true" or "v2"
+	// for MMDSv2 (session tokens), "v1" for MMDSv1.
+	MMDS = Prefix + "mmds"
+
+	// Network rate limits. Bandwidths are in bits per second with an
+	// optional k, M, G or T (or Ki, Mi, Gi, Ti) suffix, e.g. "100M"; packet
+	// rates are plain numbers.
+	NetRXBandwidth = Prefix + "net-rx-bandwidth"
+	NetTXBandwidth = Prefix + "net-tx-bandwidth"
+	NetRXPPS       = Prefix + "net-rx-pps"
+	NetTXPPS       = Prefix + "net-tx-pps"
+
+	// MTLSPorts has the shim terminate mesh mTLS on the host for the pod,
+	// so it needs no sidecar in its VM. It lists the ports to terminate as
+	// "listen:guest" pairs, e.g. "8443:8080,9443:9090"; a single port such
+	// as "8443" forwards to the same port in the guest.
+	MTLSPorts = Prefix + "mtls-ports"
+
+	// HostPorts carries a pod's CRI port mappings (its containers'
+	// hostPorts), which containerd doesn't hand to runtimes itself. It lists
+	// them as "[hostIP:]hostPort:containerPort[/protocol]", e.g.
+	// "8080:80,192.168.1.10:5353:53/udp", with IPv6 host IPs in brackets.
+	HostPorts = Prefix + "host-ports"
+
+	// Routes adds static routes to a pod's network, as "dst" or "dst via
+	// gw", e.g. "10.20.0.0/16 via 10.88.0.254,172.16.0.0/12". A route
+	// without a gateway goes through the default gateway of its IP family.
+	Routes = Prefix + "routes"
+
+	// DNSSearch adds DNS search domains to a pod's resolv.conf, after those
+	// of the network.
+	DNSSearch = Prefix + "dns-search"
+
+	// Networks attaches a pod to further CNI networks of the node's config
+	// directory, e.g. "storage,backup", which the guest sees as eth1, eth2
+	// and so on.
+	Networks = Prefix + "networks"
+
+	// AvoidNamespaces lists namespaces whose previous use of a pooled VM
+	// rules it out for the pod, or "*" for any other namespace.
+	AvoidNamespaces = Prefix + "avoid-namespaces"
+
+	// SecretEnv lists environment variables of the container that hold
+	// secrets, e.g. "DB_PASSWORD,API_TOKEN". They are taken out of the
+	// bundle before the guest sees it and handed to the agent over vsock.
+	SecretEnv = Prefix + "secret-env"
+
+	// DryRun makes Create run pre-flight checks and report timing estimates
+	// instead of booting a VM.
+	DryRun = Prefix + "dry-run"
+)
+
+// Node annotations, which fcctl pool annotate-node sets to the vCPUs and
+// memory the pool's idle VMs hold, as Kubernetes quantities.
+const (
+	PoolReservedCPU    = Prefix + "pool-reserved-cpu"
+	PoolReservedMemory = Prefix + "pool-reserved-memory"
+)
+
+// Type is the kind of value an annotation takes.
+type Type string
+
+const (
+	TypeBool      Type = "bool"
+	TypeInt       Type = "int"
+	TypeString    Type = "string"
+	TypeEnum      Type = "enum"
+	TypeBandwidth Type = "bandwidth"
+	TypeList      Type = "list"
+)
+
+// Spec describes a pod annotation.
+type Spec struct {
+	Key string
+
+	// Aliases are deprecated keys accepted for Key.
+	Aliases []string
+
+	Type Type
+
+	// Default describes what applies when the annotation is not set.
+	Default string
+
+	// Validate checks a value; nil accepts any value.
+	Validate func(value string) error
+}
+
+// spec describes the annotation name under Prefix, which is also accepted
+// under DeprecatedPrefix.
+func spec(name string, typ Type, def string, validate func(string) error) Spec {
+	return Spec{
+		Key:      Prefix + name,
+		Aliases:  []string{DeprecatedPrefix + name},
+		Type:     typ,
+		Default:  def,
+		Validate: validate,
+	}
+}
+
+// Schema lists every pod annotation the runtime understands.
+var Schema = []Spec{
+	spec("vcpus", TypeInt, "node default", positiveInt),
+	spec("memory-mb", TypeInt, "node default", positiveInt),
+	spec("kernel", TypeString, "kernel_path", kernel.ValidateName),
+	spec("cpu-template", TypeString, "cpu_template", vm.ValidateCPUTemplateName),
+	spec("runtime-dir-class", TypeString, "runtime_dir", vm.ValidateRuntimeDirClassName),
+	spec("timezone", TypeString, "guest default", validTimezone),
+	spec("ca-bundle", TypeString, "none", validCABundle),
+	spec("mmds", TypeEnum, "false", oneOf("true", "false", "v1", "v2")),
+	spec("net-rx-bandwidth", TypeBandwidth, "unlimited", validBandwidth),
+	spec("net-tx-bandwidth", TypeBandwidth, "unlimited", validBandwidth),
+	spec("net-rx-pps", TypeInt, "unlimited", positiveInt),
+	spec("net-tx-pps", TypeInt, "unlimited", positiveInt),
+	spec("mtls-ports", TypeList, "none", validPortMappings),
+	spec("host-ports", TypeList, "none", validHostPorts),
+	spec("routes", TypeList, "none", validRoutes),
+	spec("dns-search", TypeList, "none", validSearchDomains),
+	spec("networks", TypeList, "none", validNetworks),
+	spec("avoid-namespaces", TypeList, "none", nil),
+	spec("secret-env", TypeList, "none", validEnvNames),
+	spec("dry-run", TypeBool, "false", oneOf("true", "false")),
+}
+
+// Lookup returns the spec of an annotation key or alias.
+func Lookup(key string) (Spec, bool) {
+	for _, spec := range Schema {
+		if spec.Key == key {
+			return spec, true
+		}
+		for _, alias := range spec.Aliases {
+			if alias == key {
+				return spec, true
+			}
+		}
+	}
+	return Spec{}, false
+}
+
+// Validate checks a pod's annotations against the schema, reporting every
+// unknown or malformed one. Annotations outside the runtime's prefixes are
+// ignored.
+func Validate(annotations map[string]string) error {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		name, ok := trimPrefix(key)
+		if !ok {
+			continue
+		}
+
+		spec, known := Lookup(key)
+		if !known {
+			if suggestion := suggest(name); suggestion != "" {
+				errs = append(errs, fmt.Errorf("unknown annotation %s (did you mean %s?)", key, suggestion))
+			} else {
+				errs = append(errs, fmt.Errorf("unknown annotation %s", key))
+			}
+			continue
+		}
+
+		// An empty value is the same as not setting the annotation
+		if spec.Validate == nil || annotations[key] == "" {
+			continue
+		}
+		if err := spec.Validate(annotations[key]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s annotation: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Normalize returns a pod's annotations with deprecated keys replaced by
+// theirs. A key set under both keeps the value of the current one. Other
+// annotations are copied as they are.
+func Normalize(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	normalized := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if spec, ok := Lookup(key); ok && key != spec.Key {
+			if _, set := annotations[spec.Key]; set {
+				continue
+			}
+			key = spec.Key
+		}
+		normalized[key] = value
+	}
+	return normalized
+}
+
+// Deprecated returns the deprecated keys a pod's annotations use, sorted.
+func Deprecated(annotations map[string]string) []string {
+	var keys []string
+	for key := range annotations {
+		if spec, ok := Lookup(key); ok && key != spec.Key {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// trimPrefix returns an annotation's name without the runtime's prefix,
+// and whether it had one.
+func trimPrefix(key string) (string, bool) {
+	for _, prefix := range []string{Prefix, DeprecatedPrefix} {
+		if name, ok := strings.CutPrefix(key, prefix); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// suggest returns the known annotation a misspelled one probably meant,
+// or "".
+func suggest(name string) string {
+	if name == "" {
+		return ""
+	}
+	for _, spec := range Schema {
+		known, _ := trimPrefix(spec.Key)
+		if known == name || strings.HasPrefix(known, name) || strings.HasPrefix(name, known) {
+			return spec.Key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package annotation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{"none", nil, ""},
+		{"valid", map[string]string{
+			VCPUs:          "2",
+			MemoryMB:       "512",
+			Kernel:         "6.1-minimal",
+			MMDS:           "V2",
+			NetRXBandwidth: "100M",
+			MTLSPorts:      "8443:8080",
+			DryRun:         "false",
+		}, ""},
+		{"deprecated keys", map[string]string{
+			DeprecatedPrefix + "vcpus":  "2",
+			DeprecatedPrefix + "kernel": "6.1-minimal",
+		}, ""},
+		{"foreign annotations ignored", map[string]string{"io.kubernetes.cri.container-type": "sandbox"}, ""},
+		{"unknown", map[string]string{"fc-cri.io/gpu": "1"}, "unknown annotation fc-cri.io/gpu"},
+		{"unknown deprecated", map[string]string{"io.pipeops.firecracker/gpu": "1"}, "unknown annotation io.pipeops.firecracker/gpu"},
+		{"misspelled", map[string]string{"fc-cri.io/memory": "512"}, "did you mean " + MemoryMB},
+		{"misspelled deprecated", map[string]string{"io.pipeops.firecracker/memory": "512"}, "did you mean " + MemoryMB},
+		{"malformed int", map[string]string{VCPUs: "two"}, "invalid " + VCPUs},
+		{"malformed deprecated", map[string]string{DeprecatedPrefix + "vcpus": "two"}, "invalid " + DeprecatedPrefix + "vcpus"},
+		{"malformed enum", map[string]string{MMDS: "v3"}, "invalid " + MMDS},
+		{"malformed bool", map[string]string{DryRun: "yes"}, "invalid " + DryRun},
+		{"malformed ports", map[string]string{MTLSPorts: "8443:http"}, "invalid " + MTLSPorts},
+		{"malformed host ports", map[string]string{HostPorts: "8080"}, "invalid " + HostPorts},
+		{"repeated network", map[string]string{Networks: "storage,storage"}, "invalid " + Networks},
+		{"assignment as secret", map[string]string{SecretEnv: "TOKEN=x"}, "invalid " + SecretEnv},
+		{"path as CA bundle", map[string]string{CABundle: "../etc/shadow"}, "invalid " + CABundle},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.annotations)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAll(t *testing.T) {
+	err := Validate(map[string]string{
+		VCPUs:    "0",
+		MemoryMB: "lots",
+	})
+	if err == nil || strings.Count(err.Error(), "invalid") != 2 {
+		t.Errorf("Validate() error = %v, want both annotations reported", err)
+	}
+}
+
+func TestSchemaKeys(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, spec := range Schema {
+		keys := append([]string{spec.Key}, spec.Aliases...)
+		for _, key := range keys {
+			if seen[key] {
+				t.Errorf("%s is in the schema twice", key)
+			}
+			seen[key] = true
+		}
+		if !strings.HasPrefix(spec.Key, Prefix) {
+			t.Errorf("%s is not under %s", spec.Key, Prefix)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{"nil", nil, nil},
+		{"current keys", map[string]string{VCPUs: "2"}, map[string]string{VCPUs: "2"}},
+		{"deprecated key", map[string]string{DeprecatedPrefix + "vcpus": "2"}, map[string]string{VCPUs: "2"}},
+		{"both keys", map[string]string{
+			DeprecatedPrefix + "dry-run": "true",
+			DryRun:                       "false",
+		}, map[string]string{DryRun: "false"}},
+		{"others kept", map[string]string{
+			"io.kubernetes.cri.sandbox-name": "web",
+			DeprecatedPrefix + "gpu":         "1",
+		}, map[string]string{
+			"io.kubernetes.cri.sandbox-name": "web",
+			DeprecatedPrefix + "gpu":         "1",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.annotations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Normalize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCopies(t *testing.T) {
+	annotations := map[string]string{VCPUs: "2"}
+	Normalize(annotations)[VCPUs] = "4"
+	if annotations[VCPUs] != "2" {
+		t.Error("Normalize() modified its argument")
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	got := Deprecated(map[string]string{
+		DeprecatedPrefix + "vcpus":   "2",
+		DeprecatedPrefix + "dry-run": "true",
+		MemoryMB:                     "512",
+		DeprecatedPrefix + "gpu":     "1",
+	})
+	want := []string{DeprecatedPrefix + "dry-run", DeprecatedPrefix + "vcpus"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Deprecated() = %q, want %q", got, want)
+	}
+	if got := Deprecated(map[string]string{VCPUs: "2"}); got != nil {
+		t.Errorf("Deprecated() = %q, want nil", got)
+	}
+}
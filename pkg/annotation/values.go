@@ -0,0 +1,219 @@
+package annotation
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+// bandwidthSuffixes are the multipliers of bandwidth quantities.
+var bandwidthSuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// SplitList splits a comma-separated list, such as an annotation value,
+// dropping empty entries.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParsePort parses a TCP port number.
+func ParsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// ParseBandwidth parses a bandwidth in bits per second, such as "100M" or
+// "1.5Gi", into bytes per second.
+func ParseBandwidth(value string) (int64, error) {
+	number := strings.TrimSpace(value)
+	multiplier := 1.0
+	for _, s := range bandwidthSuffixes {
+		if strings.HasSuffix(number, s.suffix) {
+			number = strings.TrimSuffix(number, s.suffix)
+			multiplier = s.multiplier
+			break
+		}
+	}
+
+	bits, err := strconv.ParseFloat(number, 64)
+	if err != nil || bits <= 0 {
+		return 0, fmt.Errorf("%q is not a positive bandwidth", value)
+	}
+	bytesPerSec := int64(bits * multiplier / 8)
+	if bytesPerSec < 1 {
+		return 0, fmt.Errorf("%q is below 8 bits per second", value)
+	}
+	return bytesPerSec, nil
+}
+
+// ParseHostPort parses one "[hostIP:]hostPort:containerPort[/protocol]"
+// item of HostPorts.
+func ParseHostPort(item string) (domain.PortMapping, error) {
+	var pm domain.PortMapping
+	item, pm.Protocol, _ = strings.Cut(item, "/")
+	pm.Protocol = strings.ToLower(pm.Protocol)
+
+	i := strings.LastIndex(item, ":")
+	if i < 0 {
+		return pm, fmt.Errorf("%q is not hostPort:containerPort", item)
+	}
+	item, container := item[:i], item[i+1:]
+	if i = strings.LastIndex(item, ":"); i >= 0 && !strings.HasSuffix(item, "]") {
+		pm.HostIP = strings.Trim(item[:i], "[]")
+		item = item[i+1:]
+	}
+
+	var err error
+	if pm.HostPort, err = strconv.Atoi(item); err != nil {
+		return pm, fmt.Errorf("invalid host port %q", item)
+	}
+	if pm.ContainerPort, err = strconv.Atoi(container); err != nil {
+		return pm, fmt.Errorf("invalid container port %q", container)
+	}
+	return pm, network.ValidatePortMapping(pm)
+}
+
+// ParseNetworks returns the networks of a Networks value, refusing
+// repeated ones and more than a sandbox may add.
+func ParseNetworks(value string) ([]string, error) {
+	names := SplitList(value)
+	if len(names) > network.MaxAdditionalNetworks {
+		return nil, fmt.Errorf("%d networks, at most %d are supported", len(names), network.MaxAdditionalNetworks)
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if err := network.ValidateNetworkName(name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("network %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
+
+// positiveInt accepts positive integers.
+func positiveInt(value string) error {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%q is not a positive integer", value)
+	}
+	return nil
+}
+
+// oneOf accepts the given values, ignoring case.
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		v := strings.ToLower(strings.TrimSpace(value))
+		for _, allowed := range values {
+			if v == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(values, ", "))
+	}
+}
+
+// validBandwidth accepts bandwidths such as "100M".
+func validBandwidth(value string) error {
+	_, err := ParseBandwidth(value)
+	return err
+}
+
+// validPortMappings accepts "listen:guest" port pairs.
+func validPortMappings(value string) error {
+	for _, item := range SplitList(value) {
+		listen, guest, found := strings.Cut(item, ":")
+		if !found {
+			guest = listen
+		}
+		if _, err := ParsePort(listen); err != nil {
+			return err
+		}
+		if _, err := ParsePort(guest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validHostPorts accepts "[hostIP:]hostPort:containerPort[/protocol]" lists.
+func validHostPorts(value string) error {
+	for _, item := range SplitList(value) {
+		if _, err := ParseHostPort(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validRoutes accepts "dst[ via gw]" lists.
+func validRoutes(value string) error {
+	for _, item := range SplitList(value) {
+		if _, err := network.ParseRoute(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validSearchDomains accepts lists of domain names.
+func validSearchDomains(value string) error {
+	for _, item := range SplitList(value) {
+		if err := network.ValidateSearchDomain(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validNetworks accepts lists of network names.
+func validNetworks(value string) error {
+	_, err := ParseNetworks(value)
+	return err
+}
+
+// validEnvNames accepts a list of environment variable names.
+func validEnvNames(value string) error {
+	for _, name := range SplitList(value) {
+		if strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("%q is not an environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// validTimezone accepts zone names such as "Europe/Berlin".
+func validTimezone(value string) error {
+	if value == "" || !filepath.IsLocal(value) {
+		return fmt.Errorf("%q is not a timezone name", value)
+	}
+	return nil
+}
+
+// validCABundle accepts the name of a CA bundle.
+func validCABundle(value string) error {
+	if value == "" || !filepath.IsLocal(value) || filepath.Base(value) != value {
+		return fmt.Errorf("%q is not a CA bundle name", value)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package annotation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" tenant-a, ,tenant-b ")
+	if len(got) != 2 || got[0] != "tenant-a" || got[1] != "tenant-b" {
+		t.Errorf("SplitList = %q, want [tenant-a tenant-b]", got)
+	}
+	if got := SplitList(""); got != nil {
+		t.Errorf("SplitList(\"\") = %q, want nil", got)
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"8443", 8443, false},
+		{" 1 ", 1, false},
+		{"65535", 65535, false},
+		{"0", 0, true},
+		{"65536", 0, true},
+		{"http", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePort(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePort(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"100M", 12_500_000, false},
+		{"1G", 125_000_000, false},
+		{"1.5k", 187, false},
+		{"8Ki", 1024, false},
+		{"800", 100, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-10M", 0, true},
+		{"4", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBandwidth(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	got, err := ParseNetworks("storage, backup")
+	if err != nil || !reflect.DeepEqual(got, []string{"storage", "backup"}) {
+		t.Errorf("ParseNetworks() = %q, %v", got, err)
+	}
+	if _, err := ParseNetworks("storage,storage"); err == nil {
+		t.Error("ParseNetworks() accepted a repeated network")
+	}
+}
+
+func TestValidEnvNames(t *testing.T) {
+	if err := validEnvNames("DB_PASSWORD, TOKEN"); err != nil {
+		t.Errorf("validEnvNames() error = %v", err)
+	}
+	if err := validEnvNames("TOKEN=x"); err == nil {
+		t.Error("validEnvNames() accepted an assignment")
+	}
+}
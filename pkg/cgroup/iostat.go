@@ -0,0 +1,32 @@
+// Package cgroup reads cgroup v2 accounting files. It is shared by the shim
+// and the guest agent, so it only depends on the standard library.
+package cgroup
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadIOStat sums the bytes read and written across the devices in a
+// cgroup's io.stat. A missing or unreadable file counts as no I/O.
+func ReadIOStat(path string) (read, written uint64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+	for _, field := range strings.Fields(string(data)) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
+		case "rbytes":
+			read += n
+		case "wbytes":
+			written += n
+		}
+	}
+	return read, written
+}
@@ -0,0 +1,24 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadIOStat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "io.stat")
+	stat := "253:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n" +
+		"254:16 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=512 dios=1\n"
+	if err := os.WriteFile(path, []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, written := ReadIOStat(path)
+	if read != 5120 || written != 8192 {
+		t.Errorf("ReadIOStat() = %d, %d, want 5120, 8192", read, written)
+	}
+	if read, written := ReadIOStat(filepath.Join(t.TempDir(), "missing")); read != 0 || written != 0 {
+		t.Errorf("ReadIOStat() of a missing file = %d, %d, want 0, 0", read, written)
+	}
+}
@@ -0,0 +1,41 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSHA256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rootfs.img")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FileSHA256(path)
+	if err != nil {
+		t.Fatalf("FileSHA256() error = %v", err)
+	}
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+		t.Errorf("FileSHA256() = %s, want %s", got, want)
+	}
+	if _, err := FileSHA256(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("FileSHA256() of a missing file succeeded")
+	}
+}
+
+func TestValidSHA256(t *testing.T) {
+	tests := map[string]bool{
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad":        true,
+		"BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD":        true,
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015a":         false,
+		"sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad": false,
+		"zz7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad":        false,
+		"": false,
+	}
+	for sum, want := range tests {
+		if got := ValidSHA256(sum); got != want {
+			t.Errorf("ValidSHA256(%q) = %v, want %v", sum, got, want)
+		}
+	}
+}
@@ -16,15 +16,25 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/pipeops/firecracker-cri/pkg/image"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/sandboxlog"
 	"github.com/sirupsen/logrus"
 )
 
+// versionPattern matches a major.minor[.patch] version, e.g. "0.1.0".
+var versionPattern = regexp.MustCompile(`^v?\d+\.\d+(\.\d+)?$`)
+
 // Config holds all configuration for the Firecracker CRI runtime.
 type Config struct {
 	// Runtime configuration
@@ -50,6 +60,12 @@ type Config struct {
 
 	// Logging configuration
 	Log LogConfig `toml:"log"`
+
+	// Lifecycle hook configuration
+	Hooks HooksConfig `toml:"hooks"`
+
+	// Fault injection configuration (testing only)
+	Chaos ChaosConfig `toml:"chaos"`
 }
 
 // RuntimeConfig holds general runtime settings.
@@ -71,6 +87,44 @@ type RuntimeConfig struct {
 
 	// ContainerdSocket is the path to containerd's socket.
 	ContainerdSocket string `toml:"containerd_socket"`
+
+	// VMMMaxOpenFiles is the RLIMIT_NOFILE applied to each Firecracker
+	// process (0 keeps the inherited limit).
+	VMMMaxOpenFiles int64 `toml:"vmm_max_open_files"`
+
+	// FDAdmissionThreshold is the fraction (0.0-1.0) of the node or shim
+	// file descriptor limit above which new VMs are refused (0 disables).
+	FDAdmissionThreshold float64 `toml:"fd_admission_threshold"`
+
+	// SeccompFilter is a seccomp filter compiled with seccompiler-bin that
+	// Firecracker runs with. Empty uses Firecracker's built-in filters.
+	SeccompFilter string `toml:"seccomp_filter"`
+
+	// DisableSeccomp runs Firecracker without seccomp. Only for debugging.
+	DisableSeccomp bool `toml:"disable_seccomp"`
+
+	// CgroupAccounting places each VMM in a cgroup v2 of its own under
+	// CgroupParent, limited to the VM's resources plus overhead.
+	CgroupAccounting bool   `toml:"cgroup_accounting"`
+	CgroupParent     string `toml:"cgroup_parent"`
+
+	// VMMMemoryOverheadMB and VMMCPUOverheadMillicores are added to a VM's
+	// memory and vCPUs in its cgroup limits, for the VMM itself.
+	VMMMemoryOverheadMB      int64 `toml:"vmm_memory_overhead_mb"`
+	VMMCPUOverheadMillicores int64 `toml:"vmm_cpu_overhead_millicores"`
+
+	// DevMode runs each VM as a host process of DevAgentBinary instead of
+	// Firecracker, for development on machines without KVM. Nothing is
+	// isolated; never enable it in production.
+	DevMode        bool   `toml:"dev_mode"`
+	DevAgentBinary string `toml:"dev_agent_binary"`
+
+	// MaxConcurrentCreates, MaxConcurrentStarts and MaxConcurrentDeletes
+	// limit how many tasks are created, started or deleted at once across
+	// the node; the rest queue in arrival order (0 is unlimited).
+	MaxConcurrentCreates int `toml:"max_concurrent_creates"`
+	MaxConcurrentStarts  int `toml:"max_concurrent_starts"`
+	MaxConcurrentDeletes int `toml:"max_concurrent_deletes"`
 }
 
 // VMConfig holds default VM configuration.
@@ -99,11 +153,62 @@ type VMConfig struct {
 	// EnableSMT controls whether simultaneous multithreading is enabled.
 	EnableSMT bool `toml:"enable_smt"`
 
+	// CPUTemplate is the default CPU template: a Firecracker static
+	// template such as "T2S" or "C3", or the name of a custom CPUID/MSR
+	// template in CPUTemplatesDir. Empty passes the host CPU through.
+	CPUTemplate string `toml:"cpu_template"`
+
+	// CPUTemplatesDir holds custom CPU templates, one <name>.json file each.
+	CPUTemplatesDir string `toml:"cpu_templates_dir"`
+
+	// KernelsDir holds the kernels pods can select by annotation, one
+	// directory per kernel.
+	KernelsDir string `toml:"kernels_dir"`
+
+	// KernelDownload fetches missing kernels from the source in their
+	// manifest on first use.
+	KernelDownload bool `toml:"kernel_download"`
+
 	// BaseRootfsPath is the path to the base rootfs used for pooled VMs.
 	BaseRootfsPath string `toml:"base_rootfs_path"`
 
+	// BaseRootfsSHA256 is the expected SHA-256 of the base rootfs. Empty
+	// takes it from <base_rootfs_path>.sha256, if that exists. Pooled VMs
+	// are never booted from a base that doesn't match.
+	BaseRootfsSHA256 string `toml:"base_rootfs_sha256"`
+
+	// RootfsCoW is how each sandbox gets a private writable copy of its
+	// rootfs image: "auto", "reflink", "copy" or "none".
+	RootfsCoW string `toml:"rootfs_cow"`
+
+	// CoWDir holds the per-sandbox rootfs layers. Reflinks need it on the
+	// same filesystem as the converted images. It also holds the overlay
+	// drives of sandboxes booting read-only (erofs or squashfs) images.
+	CoWDir string `toml:"cow_dir"`
+
+	// OverlaySizeMB is the size of the sparse, writable overlay drive of
+	// sandboxes booting read-only images.
+	OverlaySizeMB int64 `toml:"overlay_size_mb"`
+
+	// DiskPrealloc is how the disk images the runtime creates are
+	// allocated: "sparse", "fallocate" or "full".
+	DiskPrealloc string `toml:"disk_prealloc"`
+
+	// DiskPreallocFilesystems overrides DiskPrealloc by the type of the
+	// filesystem holding the images, such as "xfs".
+	DiskPreallocFilesystems map[string]string `toml:"disk_prealloc_filesystems"`
+
+	// DiskPreallocVolumes overrides DiskPrealloc by volume type, "rootfs"
+	// or "emptydir", over DiskPreallocFilesystems.
+	DiskPreallocVolumes map[string]string `toml:"disk_prealloc_volumes"`
+
 	// VsockEnabled controls whether vsock is enabled for guest communication.
 	VsockEnabled bool `toml:"vsock_enabled"`
+
+	// RequiredKernelFeatures are the features the first VM of each kernel
+	// checks it has: virtio_blk, virtio_net, vsock and overlay. Kernels
+	// without them are refused. Empty disables the check.
+	RequiredKernelFeatures []string `toml:"required_kernel_features"`
 }
 
 // PoolConfig holds VM pool configuration.
@@ -128,6 +233,50 @@ type PoolConfig struct {
 
 	// PrewarmOnStart controls whether to pre-warm the pool on startup.
 	PrewarmOnStart bool `toml:"prewarm_on_start"`
+
+	// Generation is an epoch mixed into each VM's generation. Changing it
+	// retires every pooled VM.
+	Generation string `toml:"generation"`
+
+	// MaxReuse is how many times a VM may be returned to the pool for
+	// another workload (0 = unlimited).
+	MaxReuse int `toml:"max_reuse"`
+
+	// Buckets keep VMs of other shapes warm alongside the default VMs,
+	// keyed by bucket name.
+	Buckets map[string]PoolBucketConfig `toml:"buckets"`
+
+	// Resizable lets the default VMs serve smaller pods too, see
+	// PoolBucketConfig.Resizable.
+	Resizable bool `toml:"resizable"`
+
+	// IdleMemoryMB is the memory, in MiB, left to VMs while they wait in
+	// the pool; a balloon holds back the rest until they are acquired
+	// (0 = idle VMs keep all of their memory).
+	IdleMemoryMB int64 `toml:"idle_memory_mb"`
+}
+
+// PoolBucketConfig configures a pool bucket, which keeps VMs of one shape
+// warm. Zero shape fields take the VM defaults.
+type PoolBucketConfig struct {
+	// VcpuCount is the number of vCPUs of the bucket's VMs.
+	VcpuCount int64 `toml:"vcpu_count"`
+
+	// MemoryMB is the memory of the bucket's VMs in MiB.
+	MemoryMB int64 `toml:"memory_mb"`
+
+	// KernelPath is the kernel the bucket's VMs boot.
+	KernelPath string `toml:"kernel_path"`
+
+	// MinSize is the number of VMs to keep warm.
+	MinSize int `toml:"min_size"`
+
+	// MaxSize is the maximum number of VMs the bucket holds.
+	MaxSize int `toml:"max_size"`
+
+	// Resizable boots the bucket's VMs with a memory balloon and sizes
+	// them down on acquire, so they also serve smaller pods.
+	Resizable bool `toml:"resizable"`
 }
 
 // NetworkConfig holds CNI configuration.
@@ -144,11 +293,80 @@ type NetworkConfig struct {
 	// CNICacheDir is the directory for CNI state cache.
 	CNICacheDir string `toml:"cni_cache_dir"`
 
+	// CNIPluginTimeout bounds each CNI plugin invocation. A sandbox whose
+	// plugin times out fails to start with a retryable error, and its
+	// network setup is retried in the background. Zero lets plugins run
+	// unbounded.
+	CNIPluginTimeout time.Duration `toml:"cni_plugin_timeout"`
+
 	// DefaultNetworkName is the default CNI network to use.
 	DefaultNetworkName string `toml:"default_network_name"`
 
 	// DefaultSubnet is used if not specified in CNI config.
 	DefaultSubnet string `toml:"default_subnet"`
+
+	// DefaultSubnetV6 is the IPv6 subnet used if not specified in CNI
+	// config, on ipv6 and dual-stack clusters.
+	DefaultSubnetV6 string `toml:"default_subnet_v6"`
+
+	// IPFamily is the cluster's IP family: "ipv4", "ipv6" or "dual". A
+	// sandbox's primary address is IPv6 on ipv6 clusters, IPv4 otherwise.
+	IPFamily string `toml:"ip_family"`
+
+	// TAPMode is how a sandbox's tap is made: "plugin" by the
+	// tc-redirect-tap CNI plugin, or by the runtime and connected to the
+	// CNI interface with tc ("redirect") or to TAPBridge ("bridge").
+	// "plugin" falls back to "redirect" if the chain lacks the plugin or
+	// it isn't installed.
+	TAPMode string `toml:"tap_mode"`
+
+	// TAPBridge is the bridge in the sandbox's network namespace taps are
+	// attached to in "bridge" mode.
+	TAPBridge string `toml:"tap_bridge"`
+
+	// TAPQueues above 1 makes the runtime's taps multiqueue.
+	TAPQueues int `toml:"tap_queues"`
+
+	// IPReuseCooldown is how long a released IP is kept from being
+	// re-assigned to another sandbox. Zero disables the cooldown.
+	IPReuseCooldown time.Duration `toml:"ip_reuse_cooldown"`
+
+	// Default rate limits for VM network interfaces, in bytes and packets
+	// per second per direction (RX is traffic to the guest). Zero is
+	// unlimited; pods can set their own limits with annotations.
+	RXBytesPerSec   int64 `toml:"rx_bytes_per_sec"`
+	TXBytesPerSec   int64 `toml:"tx_bytes_per_sec"`
+	RXPacketsPerSec int64 `toml:"rx_packets_per_sec"`
+	TXPacketsPerSec int64 `toml:"tx_packets_per_sec"`
+
+	// Workload certificate files for host-terminated mTLS, which pods
+	// enable with the fc-cri.io/mtls-ports annotation. They
+	// are re-read when they change, so a SPIFFE agent can rotate them.
+	MTLSCertFile   string `toml:"mtls_cert_file"`
+	MTLSKeyFile    string `toml:"mtls_key_file"`
+	MTLSBundleFile string `toml:"mtls_bundle_file"`
+
+	// MTLSTrustDomain restricts mTLS peers to SPIFFE IDs of this trust
+	// domain. Empty accepts any peer the bundle verifies.
+	MTLSTrustDomain string `toml:"mtls_trust_domain"`
+
+	// ServiceRouting is "none" to leave ClusterIPs to kube-proxy, or
+	// "static" to DNAT each sandbox's service traffic on the host with
+	// nftables, following the services listed in ServicesFile.
+	ServiceRouting string `toml:"service_routing"`
+
+	// ServicesFile lists the services and endpoints to route, kept up to
+	// date by an EndpointSlice watcher on the node.
+	ServicesFile string `toml:"services_file"`
+
+	// AllowedPodRoutes are the networks (CIDRs) pods may route to with the
+	// fc-cri.io/routes annotation. Empty refuses pod routes.
+	AllowedPodRoutes []string `toml:"allowed_pod_routes"`
+
+	// AllowedDNSSearch are the domains pods may add, with their
+	// subdomains, as DNS search domains with the
+	// fc-cri.io/dns-search annotation. Empty refuses them.
+	AllowedDNSSearch []string `toml:"allowed_dns_search"`
 }
 
 // ImageConfig holds image service configuration.
@@ -156,6 +374,12 @@ type ImageConfig struct {
 	// RootDir is the directory for storing image data.
 	RootDir string `toml:"root_dir"`
 
+	// Filesystem is what images are converted to: "ext4", "xfs", "btrfs",
+	// or the read-only "erofs" or "squashfs". Read-only images are far
+	// smaller and faster to create; sandboxes write to a separate overlay
+	// drive.
+	Filesystem string `toml:"filesystem"`
+
 	// DefaultBlockSizeMB is the default size for block device images.
 	DefaultBlockSizeMB int64 `toml:"default_block_size_mb"`
 
@@ -167,6 +391,45 @@ type ImageConfig struct {
 
 	// CacheMaxSizeMB is the maximum cache size in MB.
 	CacheMaxSizeMB int64 `toml:"cache_max_size_mb"`
+
+	// FsifyMinVersion is the oldest fsify CLI conversions shell out to.
+	// An older fsify, or one lacking the flags a conversion needs, is
+	// skipped for the native implementation.
+	FsifyMinVersion string `toml:"fsify_min_version"`
+
+	// ConversionStageAttempts is how often a failing conversion stage
+	// (pull, unpack, mkfs and copy) is run before the conversion fails.
+	ConversionStageAttempts int `toml:"conversion_stage_attempts"`
+
+	// RemoteBuilderAddress is the gRPC address (host:port) of a builder
+	// that converts images when this node is short on resources. Empty
+	// converts everything locally.
+	RemoteBuilderAddress string `toml:"remote_builder_address"`
+
+	// RemoteBuilderCAFile verifies the builder's TLS certificate. Empty
+	// connects without TLS.
+	RemoteBuilderCAFile string `toml:"remote_builder_ca_file"`
+
+	// RemoteBuilderTimeout bounds a remote conversion, including the
+	// transfer of the result.
+	RemoteBuilderTimeout time.Duration `toml:"remote_builder_timeout"`
+
+	// RemoteBuilderMinFreeDiskMB delegates conversions when less than this
+	// is free for local conversion.
+	RemoteBuilderMinFreeDiskMB int64 `toml:"remote_builder_min_free_disk_mb"`
+
+	// RemoteBuilderMaxLocalConversions delegates conversions when this
+	// many are already running locally (0 = no limit).
+	RemoteBuilderMaxLocalConversions int `toml:"remote_builder_max_local_conversions"`
+
+	// BakeBootFiles copies fc-agent, an init and device nodes into
+	// converted images, so VMs boot them as their root without a base
+	// image.
+	BakeBootFiles bool `toml:"bake_boot_files"`
+
+	// BakeFiles are the files baked in, as "source:target[:mode]". Empty
+	// bakes /usr/local/bin/fc-agent as /sbin/fc-agent.
+	BakeFiles []string `toml:"bake_files"`
 }
 
 // AgentConfig holds guest agent configuration.
@@ -185,6 +448,48 @@ type AgentConfig struct {
 
 	// CommandTimeout is the default timeout for agent commands.
 	CommandTimeout time.Duration `toml:"command_timeout"`
+
+	// HeartbeatPort is the host vsock port the agent sends heartbeats to.
+	HeartbeatPort uint32 `toml:"heartbeat_port"`
+
+	// HeartbeatInterval is how often the agent is expected to send a heartbeat.
+	HeartbeatInterval time.Duration `toml:"heartbeat_interval"`
+
+	// HeartbeatMissedBeats is how many heartbeats may be missed before the
+	// sandbox is marked unhealthy.
+	HeartbeatMissedBeats int `toml:"heartbeat_missed_beats"`
+
+	// HeartbeatPolicy is the recovery action for a silent sandbox:
+	// "alert", "restart" or "recycle".
+	HeartbeatPolicy string `toml:"heartbeat_policy"`
+
+	// LivenessInterval is how often the shim pings the agent over its RPC
+	// connection. 0 disables the pings.
+	LivenessInterval time.Duration `toml:"liveness_interval"`
+
+	// LivenessWindow is how long the agent may go without answering
+	// before the sandbox is marked not ready.
+	LivenessWindow time.Duration `toml:"liveness_window"`
+
+	// LivenessRestartVM replaces the VM of a sandbox whose agent stays
+	// silent for the window, keeping its containers' IDs.
+	LivenessRestartVM bool `toml:"liveness_restart_vm"`
+
+	// LogLevel is the guest agent's log level: debug, info or error. Like
+	// the ports, it reaches the agent on the kernel command line.
+	LogLevel string `toml:"log_level"`
+
+	// Auth boots each VM with a key of its own that connections to its
+	// agent must authenticate with.
+	Auth bool `toml:"auth"`
+
+	// OCIRuntime is the OCI runtime the guest agent runs containers with,
+	// a path in the guest or a name such as "crun". Empty lets the agent
+	// pick runc, or crun if the guest has no runc.
+	OCIRuntime string `toml:"oci_runtime"`
+
+	// OCIRuntimeArgs are global options the agent passes the runtime.
+	OCIRuntimeArgs []string `toml:"oci_runtime_args"`
 }
 
 // MetricsConfig holds metrics configuration.
@@ -197,6 +502,26 @@ type MetricsConfig struct {
 
 	// Path is the HTTP path for metrics endpoint.
 	Path string `toml:"path"`
+
+	// Buckets overrides the latency histogram bucket upper bounds (in
+	// seconds) per operation, e.g. "create" or "pool_warm".
+	Buckets map[string][]float64 `toml:"buckets"`
+
+	// MaxSandboxSeries caps the number of per-sandbox labeled series.
+	MaxSandboxSeries int `toml:"max_sandbox_series"`
+
+	// MaxImageSeries caps the number of per-image labeled series.
+	MaxImageSeries int `toml:"max_image_series"`
+
+	// UsageSink is where a usage record is written for each destroyed VM,
+	// for chargeback: an absolute path (or file:// URL) of a JSON lines
+	// file, or an http(s) URL records are POSTed to. Empty disables it.
+	UsageSink string `toml:"usage_sink"`
+
+	// Rates also exports the 1m and 5m per-second rates of VM creations,
+	// errors, pool churn and container creations, computed in the
+	// collector, for infrequent scrapers and dashboards without PromQL.
+	Rates bool `toml:"rates"`
 }
 
 // LogConfig holds logging configuration.
@@ -209,6 +534,47 @@ type LogConfig struct {
 
 	// File is the optional log file path.
 	File string `toml:"file"`
+
+	// SandboxOutput routes each sandbox's shim and VMM logs: stderr,
+	// journald, file or both (journald and file).
+	SandboxOutput string `toml:"sandbox_output"`
+
+	// SandboxDir holds the per-sandbox log files.
+	SandboxDir string `toml:"sandbox_dir"`
+
+	// SandboxMaxSizeMB is the size at which a sandbox log file is rotated.
+	SandboxMaxSizeMB int `toml:"sandbox_max_size_mb"`
+
+	// SandboxMaxFiles is the number of rotated files kept per sandbox.
+	SandboxMaxFiles int `toml:"sandbox_max_files"`
+}
+
+// HooksConfig holds sandbox lifecycle hook settings.
+type HooksConfig struct {
+	// Dir holds one JSON hook definition per file.
+	Dir string `toml:"dir"`
+
+	// DefaultTimeout bounds hooks that don't set their own timeout.
+	DefaultTimeout time.Duration `toml:"default_timeout"`
+}
+
+// ChaosConfig holds fault injection settings for resilience testing.
+// Never enable this in production.
+type ChaosConfig struct {
+	// Enabled turns fault injection on.
+	Enabled bool `toml:"enabled"`
+
+	// CreateFailureRate is the fraction (0.0-1.0) of VM creations that fail.
+	CreateFailureRate float64 `toml:"create_failure_rate"`
+
+	// AcquireDelay is added to every pool acquisition.
+	AcquireDelay time.Duration `toml:"acquire_delay"`
+
+	// KillWarmInterval is how often a random pre-warmed VM is destroyed.
+	KillWarmInterval time.Duration `toml:"kill_warm_interval"`
+
+	// Seed seeds the random source for reproducible runs (0 = random).
+	Seed int64 `toml:"seed"`
 }
 
 // Default returns a Config with sensible defaults.
@@ -221,6 +587,17 @@ func Default() *Config {
 			EnableJailer:      false,
 			ShutdownTimeout:   30 * time.Second,
 			ContainerdSocket:  "/run/containerd/containerd.sock",
+
+			VMMMaxOpenFiles:      4096,
+			FDAdmissionThreshold: 0.9,
+
+			CgroupAccounting:         true,
+			CgroupParent:             "fc-cri.slice",
+			VMMMemoryOverheadMB:      64,
+			VMMCPUOverheadMillicores: 250,
+
+			DevMode:        false,
+			DevAgentBinary: "/usr/local/bin/fc-agent",
 		},
 		VM: VMConfig{
 			KernelPath:       "/var/lib/fc-cri/vmlinux",
@@ -230,8 +607,17 @@ func Default() *Config {
 			MinMemoryMB:      64,
 			MaxMemoryMB:      8192,
 			EnableSMT:        false,
+			CPUTemplatesDir:  "/etc/fc-cri/cpu-templates",
+			KernelsDir:       "/var/lib/fc-cri/kernels",
+			KernelDownload:   true,
 			BaseRootfsPath:   "/var/lib/fc-cri/rootfs/base.ext4",
+			RootfsCoW:        "auto",
+			DiskPrealloc:     "sparse",
+			CoWDir:           "/var/lib/fc-cri/cow",
+			OverlaySizeMB:    4096,
 			VsockEnabled:     true,
+
+			RequiredKernelFeatures: []string{"virtio_blk", "virtio_net", "vsock", "overlay"},
 		},
 		Pool: PoolConfig{
 			Enabled:           true,
@@ -247,15 +633,33 @@ func Default() *Config {
 			CNIPluginDir:       "/opt/cni/bin",
 			CNIConfDir:         "/etc/cni/net.d",
 			CNICacheDir:        "/var/lib/cni",
+			CNIPluginTimeout:   30 * time.Second,
 			DefaultNetworkName: "fc-net",
 			DefaultSubnet:      "10.88.0.0/16",
+			DefaultSubnetV6:    "fd00:fc::/64",
+			IPFamily:           "ipv4",
+			TAPMode:            "plugin",
+			IPReuseCooldown:    30 * time.Second,
+			MTLSCertFile:       "/run/spiffe/certs/svid.pem",
+			MTLSKeyFile:        "/run/spiffe/certs/svid_key.pem",
+			MTLSBundleFile:     "/run/spiffe/certs/svid_bundle.pem",
+			ServiceRouting:     "none",
+			ServicesFile:       "/etc/fc-cri/services.json",
 		},
 		Image: ImageConfig{
 			RootDir:            "/var/lib/fc-cri/images",
+			Filesystem:         "ext4",
 			DefaultBlockSizeMB: 1024,
 			UseSparseFiles:     true,
 			CacheEnabled:       true,
 			CacheMaxSizeMB:     10240,
+			FsifyMinVersion:    "0.1.0",
+
+			ConversionStageAttempts: 3,
+
+			RemoteBuilderTimeout:             10 * time.Minute,
+			RemoteBuilderMinFreeDiskMB:       2048,
+			RemoteBuilderMaxLocalConversions: 2,
 		},
 		Agent: AgentConfig{
 			VsockPort:         1024,
@@ -263,15 +667,37 @@ func Default() *Config {
 			DialRetries:       30,
 			DialRetryInterval: 100 * time.Millisecond,
 			CommandTimeout:    60 * time.Second,
+
+			HeartbeatPort:        1025,
+			HeartbeatInterval:    time.Second,
+			HeartbeatMissedBeats: 5,
+			HeartbeatPolicy:      "alert",
+			LivenessInterval:     5 * time.Second,
+			LivenessWindow:       30 * time.Second,
+			LivenessRestartVM:    false,
+			LogLevel:             "info",
+			Auth:                 true,
 		},
 		Metrics: MetricsConfig{
 			Enabled: true,
 			Address: ":9090",
 			Path:    "/metrics",
+
+			MaxSandboxSeries: 500,
+			MaxImageSeries:   100,
 		},
 		Log: LogConfig{
 			Level:  "info",
 			Format: "text",
+
+			SandboxOutput:    sandboxlog.OutputStderr,
+			SandboxDir:       "/var/log/fc-cri/sandboxes",
+			SandboxMaxSizeMB: 10,
+			SandboxMaxFiles:  5,
+		},
+		Hooks: HooksConfig{
+			Dir:            "/etc/fc-cri/hooks.d",
+			DefaultTimeout: 10 * time.Second,
 		},
 	}
 }
@@ -306,6 +732,19 @@ func LoadFromEnv(cfg *Config) {
 	loadEnvString(&cfg.Runtime.JailerBinary, "FC_CRI_JAILER_BINARY")
 	loadEnvBool(&cfg.Runtime.EnableJailer, "FC_CRI_ENABLE_JAILER")
 	loadEnvDuration(&cfg.Runtime.ShutdownTimeout, "FC_CRI_SHUTDOWN_TIMEOUT")
+	loadEnvInt64(&cfg.Runtime.VMMMaxOpenFiles, "FC_CRI_VMM_MAX_OPEN_FILES")
+	loadEnvString(&cfg.Runtime.SeccompFilter, "FC_CRI_SECCOMP_FILTER")
+	loadEnvBool(&cfg.Runtime.DisableSeccomp, "FC_CRI_DISABLE_SECCOMP")
+	loadEnvBool(&cfg.Runtime.CgroupAccounting, "FC_CRI_CGROUP_ACCOUNTING")
+	loadEnvString(&cfg.Runtime.CgroupParent, "FC_CRI_CGROUP_PARENT")
+	loadEnvInt64(&cfg.Runtime.VMMMemoryOverheadMB, "FC_CRI_VMM_MEMORY_OVERHEAD_MB")
+	loadEnvInt64(&cfg.Runtime.VMMCPUOverheadMillicores, "FC_CRI_VMM_CPU_OVERHEAD_MILLICORES")
+	loadEnvFloat64(&cfg.Runtime.FDAdmissionThreshold, "FC_CRI_FD_ADMISSION_THRESHOLD")
+	loadEnvBool(&cfg.Runtime.DevMode, "FC_CRI_DEV_MODE")
+	loadEnvString(&cfg.Runtime.DevAgentBinary, "FC_CRI_DEV_AGENT_BINARY")
+	loadEnvInt(&cfg.Runtime.MaxConcurrentCreates, "FC_CRI_MAX_CONCURRENT_CREATES")
+	loadEnvInt(&cfg.Runtime.MaxConcurrentStarts, "FC_CRI_MAX_CONCURRENT_STARTS")
+	loadEnvInt(&cfg.Runtime.MaxConcurrentDeletes, "FC_CRI_MAX_CONCURRENT_DELETES")
 
 	// VM
 	loadEnvString(&cfg.VM.KernelPath, "FC_CRI_VM_KERNEL_PATH")
@@ -315,6 +754,16 @@ func LoadFromEnv(cfg *Config) {
 	loadEnvInt64(&cfg.VM.MinMemoryMB, "FC_CRI_VM_MIN_MEMORY_MB")
 	loadEnvInt64(&cfg.VM.MaxMemoryMB, "FC_CRI_VM_MAX_MEMORY_MB")
 	loadEnvBool(&cfg.VM.EnableSMT, "FC_CRI_VM_ENABLE_SMT")
+	loadEnvString(&cfg.VM.CPUTemplate, "FC_CRI_VM_CPU_TEMPLATE")
+	loadEnvString(&cfg.VM.CPUTemplatesDir, "FC_CRI_VM_CPU_TEMPLATES_DIR")
+	loadEnvString(&cfg.VM.KernelsDir, "FC_CRI_VM_KERNELS_DIR")
+	loadEnvBool(&cfg.VM.KernelDownload, "FC_CRI_VM_KERNEL_DOWNLOAD")
+	loadEnvString(&cfg.VM.BaseRootfsSHA256, "FC_CRI_VM_BASE_ROOTFS_SHA256")
+	loadEnvString(&cfg.VM.RootfsCoW, "FC_CRI_VM_ROOTFS_COW")
+	loadEnvString(&cfg.VM.DiskPrealloc, "FC_CRI_VM_DISK_PREALLOC")
+	loadEnvString(&cfg.VM.CoWDir, "FC_CRI_VM_COW_DIR")
+	loadEnvInt64(&cfg.VM.OverlaySizeMB, "FC_CRI_VM_OVERLAY_SIZE_MB")
+	loadEnvList(&cfg.VM.RequiredKernelFeatures, "FC_CRI_VM_REQUIRED_KERNEL_FEATURES")
 
 	// Pool
 	loadEnvBool(&cfg.Pool.Enabled, "FC_CRI_POOL_ENABLED")
@@ -322,25 +771,90 @@ func LoadFromEnv(cfg *Config) {
 	loadEnvInt(&cfg.Pool.MinSize, "FC_CRI_POOL_MIN_SIZE")
 	loadEnvDuration(&cfg.Pool.MaxIdleTime, "FC_CRI_POOL_MAX_IDLE_TIME")
 	loadEnvInt(&cfg.Pool.WarmConcurrency, "FC_CRI_POOL_WARM_CONCURRENCY")
+	loadEnvString(&cfg.Pool.Generation, "FC_CRI_POOL_GENERATION")
+	loadEnvInt(&cfg.Pool.MaxReuse, "FC_CRI_POOL_MAX_REUSE")
+	loadEnvBool(&cfg.Pool.Resizable, "FC_CRI_POOL_RESIZABLE")
+	loadEnvInt64(&cfg.Pool.IdleMemoryMB, "FC_CRI_POOL_IDLE_MEMORY_MB")
 
 	// Network
 	loadEnvString(&cfg.Network.NetworkMode, "FC_CRI_NETWORK_MODE")
 	loadEnvString(&cfg.Network.CNIPluginDir, "FC_CRI_CNI_PLUGIN_DIR")
 	loadEnvString(&cfg.Network.CNIConfDir, "FC_CRI_CNI_CONF_DIR")
+	loadEnvDuration(&cfg.Network.CNIPluginTimeout, "FC_CRI_CNI_PLUGIN_TIMEOUT")
 	loadEnvString(&cfg.Network.DefaultSubnet, "FC_CRI_DEFAULT_SUBNET")
+	loadEnvString(&cfg.Network.DefaultSubnetV6, "FC_CRI_DEFAULT_SUBNET_V6")
+	loadEnvString(&cfg.Network.IPFamily, "FC_CRI_IP_FAMILY")
+	loadEnvString(&cfg.Network.TAPMode, "FC_CRI_TAP_MODE")
+	loadEnvString(&cfg.Network.TAPBridge, "FC_CRI_TAP_BRIDGE")
+	loadEnvInt(&cfg.Network.TAPQueues, "FC_CRI_TAP_QUEUES")
+	loadEnvDuration(&cfg.Network.IPReuseCooldown, "FC_CRI_IP_REUSE_COOLDOWN")
+	loadEnvInt64(&cfg.Network.RXBytesPerSec, "FC_CRI_NETWORK_RX_BYTES_PER_SEC")
+	loadEnvInt64(&cfg.Network.TXBytesPerSec, "FC_CRI_NETWORK_TX_BYTES_PER_SEC")
+	loadEnvInt64(&cfg.Network.RXPacketsPerSec, "FC_CRI_NETWORK_RX_PACKETS_PER_SEC")
+	loadEnvInt64(&cfg.Network.TXPacketsPerSec, "FC_CRI_NETWORK_TX_PACKETS_PER_SEC")
+	loadEnvString(&cfg.Network.MTLSCertFile, "FC_CRI_NETWORK_MTLS_CERT_FILE")
+	loadEnvString(&cfg.Network.MTLSKeyFile, "FC_CRI_NETWORK_MTLS_KEY_FILE")
+	loadEnvString(&cfg.Network.MTLSBundleFile, "FC_CRI_NETWORK_MTLS_BUNDLE_FILE")
+	loadEnvString(&cfg.Network.MTLSTrustDomain, "FC_CRI_NETWORK_MTLS_TRUST_DOMAIN")
+	loadEnvString(&cfg.Network.ServiceRouting, "FC_CRI_NETWORK_SERVICE_ROUTING")
+	loadEnvString(&cfg.Network.ServicesFile, "FC_CRI_NETWORK_SERVICES_FILE")
+	loadEnvList(&cfg.Network.AllowedPodRoutes, "FC_CRI_NETWORK_ALLOWED_POD_ROUTES")
+	loadEnvList(&cfg.Network.AllowedDNSSearch, "FC_CRI_NETWORK_ALLOWED_DNS_SEARCH")
 
 	// Image
 	loadEnvString(&cfg.Image.RootDir, "FC_CRI_IMAGE_ROOT_DIR")
+	loadEnvString(&cfg.Image.Filesystem, "FC_CRI_IMAGE_FILESYSTEM")
 	loadEnvInt64(&cfg.Image.DefaultBlockSizeMB, "FC_CRI_IMAGE_DEFAULT_BLOCK_SIZE_MB")
 	loadEnvBool(&cfg.Image.UseSparseFiles, "FC_CRI_IMAGE_USE_SPARSE_FILES")
+	loadEnvString(&cfg.Image.FsifyMinVersion, "FC_CRI_IMAGE_FSIFY_MIN_VERSION")
+	loadEnvInt(&cfg.Image.ConversionStageAttempts, "FC_CRI_IMAGE_CONVERSION_STAGE_ATTEMPTS")
+	loadEnvString(&cfg.Image.RemoteBuilderAddress, "FC_CRI_IMAGE_REMOTE_BUILDER_ADDRESS")
+	loadEnvString(&cfg.Image.RemoteBuilderCAFile, "FC_CRI_IMAGE_REMOTE_BUILDER_CA_FILE")
+	loadEnvDuration(&cfg.Image.RemoteBuilderTimeout, "FC_CRI_IMAGE_REMOTE_BUILDER_TIMEOUT")
+	loadEnvInt64(&cfg.Image.RemoteBuilderMinFreeDiskMB, "FC_CRI_IMAGE_REMOTE_BUILDER_MIN_FREE_DISK_MB")
+	loadEnvInt(&cfg.Image.RemoteBuilderMaxLocalConversions, "FC_CRI_IMAGE_REMOTE_BUILDER_MAX_LOCAL_CONVERSIONS")
+	loadEnvBool(&cfg.Image.BakeBootFiles, "FC_CRI_IMAGE_BAKE_BOOT_FILES")
+	loadEnvList(&cfg.Image.BakeFiles, "FC_CRI_IMAGE_BAKE_FILES")
+
+	// Agent
+	loadEnvUint32(&cfg.Agent.HeartbeatPort, "FC_CRI_AGENT_HEARTBEAT_PORT")
+	loadEnvDuration(&cfg.Agent.HeartbeatInterval, "FC_CRI_AGENT_HEARTBEAT_INTERVAL")
+	loadEnvInt(&cfg.Agent.HeartbeatMissedBeats, "FC_CRI_AGENT_HEARTBEAT_MISSED_BEATS")
+	loadEnvString(&cfg.Agent.HeartbeatPolicy, "FC_CRI_AGENT_HEARTBEAT_POLICY")
+	loadEnvDuration(&cfg.Agent.LivenessInterval, "FC_CRI_AGENT_LIVENESS_INTERVAL")
+	loadEnvDuration(&cfg.Agent.LivenessWindow, "FC_CRI_AGENT_LIVENESS_WINDOW")
+	loadEnvBool(&cfg.Agent.LivenessRestartVM, "FC_CRI_AGENT_LIVENESS_RESTART_VM")
+	loadEnvString(&cfg.Agent.LogLevel, "FC_CRI_AGENT_LOG_LEVEL")
+	loadEnvBool(&cfg.Agent.Auth, "FC_CRI_AGENT_AUTH")
+	loadEnvString(&cfg.Agent.OCIRuntime, "FC_CRI_AGENT_OCI_RUNTIME")
+	loadEnvList(&cfg.Agent.OCIRuntimeArgs, "FC_CRI_AGENT_OCI_RUNTIME_ARGS")
 
 	// Metrics
 	loadEnvBool(&cfg.Metrics.Enabled, "FC_CRI_METRICS_ENABLED")
 	loadEnvString(&cfg.Metrics.Address, "FC_CRI_METRICS_ADDRESS")
+	loadEnvInt(&cfg.Metrics.MaxSandboxSeries, "FC_CRI_METRICS_MAX_SANDBOX_SERIES")
+	loadEnvInt(&cfg.Metrics.MaxImageSeries, "FC_CRI_METRICS_MAX_IMAGE_SERIES")
+	loadEnvString(&cfg.Metrics.UsageSink, "FC_CRI_METRICS_USAGE_SINK")
+	loadEnvBool(&cfg.Metrics.Rates, "FC_CRI_METRICS_RATES")
 
 	// Logging
 	loadEnvString(&cfg.Log.Level, "FC_CRI_LOG_LEVEL")
 	loadEnvString(&cfg.Log.Format, "FC_CRI_LOG_FORMAT")
+	loadEnvString(&cfg.Log.SandboxOutput, "FC_CRI_LOG_SANDBOX_OUTPUT")
+	loadEnvString(&cfg.Log.SandboxDir, "FC_CRI_LOG_SANDBOX_DIR")
+	loadEnvInt(&cfg.Log.SandboxMaxSizeMB, "FC_CRI_LOG_SANDBOX_MAX_SIZE_MB")
+	loadEnvInt(&cfg.Log.SandboxMaxFiles, "FC_CRI_LOG_SANDBOX_MAX_FILES")
+
+	// Hooks
+	loadEnvString(&cfg.Hooks.Dir, "FC_CRI_HOOKS_DIR")
+	loadEnvDuration(&cfg.Hooks.DefaultTimeout, "FC_CRI_HOOKS_DEFAULT_TIMEOUT")
+
+	// Chaos
+	loadEnvBool(&cfg.Chaos.Enabled, "FC_CRI_CHAOS_ENABLED")
+	loadEnvFloat64(&cfg.Chaos.CreateFailureRate, "FC_CRI_CHAOS_CREATE_FAILURE_RATE")
+	loadEnvDuration(&cfg.Chaos.AcquireDelay, "FC_CRI_CHAOS_ACQUIRE_DELAY")
+	loadEnvDuration(&cfg.Chaos.KillWarmInterval, "FC_CRI_CHAOS_KILL_WARM_INTERVAL")
+	loadEnvInt64(&cfg.Chaos.Seed, "FC_CRI_CHAOS_SEED")
 }
 
 // Validate validates the configuration.
@@ -355,18 +869,25 @@ func (c *Config) Validate() error {
 		}
 	}
 
-	// Validate binaries exist
-	for _, bin := range []string{
-		c.Runtime.FirecrackerBinary,
-	} {
+	// Validate binaries exist; dev mode runs the agent without Firecracker
+	bins := []string{c.Runtime.FirecrackerBinary}
+	if c.Runtime.DevMode {
+		bins = []string{c.Runtime.DevAgentBinary}
+	}
+	for _, bin := range bins {
 		if _, err := os.Stat(bin); err != nil {
 			return fmt.Errorf("binary not found: %s", bin)
 		}
 	}
 
 	// Validate kernel exists
-	if _, err := os.Stat(c.VM.KernelPath); err != nil {
-		return fmt.Errorf("kernel not found: %s", c.VM.KernelPath)
+	if !c.Runtime.DevMode {
+		if _, err := os.Stat(c.VM.KernelPath); err != nil {
+			return fmt.Errorf("kernel not found: %s", c.VM.KernelPath)
+		}
+	}
+	if c.Runtime.DevMode && c.Runtime.EnableJailer {
+		return fmt.Errorf("enable_jailer can't be used with dev_mode")
 	}
 
 	// Validate memory limits
@@ -378,11 +899,134 @@ func (c *Config) Validate() error {
 			c.VM.DefaultMemoryMB, c.VM.MinMemoryMB, c.VM.MaxMemoryMB)
 	}
 
+	// Validate CPU template name; custom templates are files in a directory
+	if t := c.VM.CPUTemplate; t == "." || t == ".." || strings.ContainsAny(t, `/\`) {
+		return fmt.Errorf("invalid cpu_template: %q", t)
+	}
+
+	// Validate rootfs copy-on-write
+	switch c.VM.RootfsCoW {
+	case "auto", "reflink", "copy", "none":
+	default:
+		return fmt.Errorf("invalid rootfs_cow: %q (must be auto, reflink, copy or none)", c.VM.RootfsCoW)
+	}
+	if c.VM.RootfsCoW != "none" && c.VM.CoWDir == "" {
+		return fmt.Errorf("cow_dir is required unless rootfs_cow is none")
+	}
+	if sum := c.VM.BaseRootfsSHA256; sum != "" && !checksum.ValidSHA256(sum) {
+		return fmt.Errorf("invalid base_rootfs_sha256: %q (must be 64 hex digits)", sum)
+	}
+	for _, f := range c.VM.RequiredKernelFeatures {
+		switch f {
+		case "virtio_blk", "virtio_net", "vsock", "overlay":
+		default:
+			return fmt.Errorf("invalid required_kernel_features entry %q (must be virtio_blk, virtio_net, vsock or overlay)", f)
+		}
+	}
+
+	// Validate disk preallocation
+	validPrealloc := map[string]bool{"sparse": true, "fallocate": true, "full": true}
+	if !validPrealloc[c.VM.DiskPrealloc] {
+		return fmt.Errorf("invalid disk_prealloc: %q (must be sparse, fallocate or full)", c.VM.DiskPrealloc)
+	}
+	for fs, strategy := range c.VM.DiskPreallocFilesystems {
+		if !validPrealloc[strategy] {
+			return fmt.Errorf("invalid disk_prealloc_filesystems.%s: %q", fs, strategy)
+		}
+	}
+	for volume, strategy := range c.VM.DiskPreallocVolumes {
+		if volume != "rootfs" && volume != "emptydir" {
+			return fmt.Errorf("invalid disk_prealloc_volumes volume type: %q (must be rootfs or emptydir)", volume)
+		}
+		if !validPrealloc[strategy] {
+			return fmt.Errorf("invalid disk_prealloc_volumes.%s: %q", volume, strategy)
+		}
+	}
+
+	// Validate image filesystem; read-only images need overlay drives
+	switch c.Image.Filesystem {
+	case "ext4", "xfs", "btrfs":
+	case "erofs", "squashfs":
+		if c.VM.CoWDir == "" {
+			return fmt.Errorf("cow_dir is required for %s images", c.Image.Filesystem)
+		}
+		if c.VM.OverlaySizeMB <= 0 {
+			return fmt.Errorf("overlay_size_mb must be positive for %s images", c.Image.Filesystem)
+		}
+	default:
+		return fmt.Errorf("invalid image filesystem: %q (must be ext4, xfs, btrfs, erofs or squashfs)", c.Image.Filesystem)
+	}
+
+	if c.Image.FsifyMinVersion != "" && !versionPattern.MatchString(c.Image.FsifyMinVersion) {
+		return fmt.Errorf("invalid fsify_min_version %q (must be major.minor[.patch])", c.Image.FsifyMinVersion)
+	}
+	if c.Image.ConversionStageAttempts < 1 {
+		return fmt.Errorf("conversion_stage_attempts must be at least 1")
+	}
+
+	// Validate remote image conversion
+	if c.Image.RemoteBuilderMinFreeDiskMB < 0 || c.Image.RemoteBuilderMaxLocalConversions < 0 {
+		return fmt.Errorf("remote builder thresholds must not be negative")
+	}
+	for _, spec := range c.Image.BakeFiles {
+		if _, err := image.ParseBakeFile(spec); err != nil {
+			return err
+		}
+	}
+
 	// Validate pool settings
 	if c.Pool.Enabled {
 		if c.Pool.MinSize > c.Pool.MaxSize {
 			return fmt.Errorf("pool min_size (%d) > max_size (%d)", c.Pool.MinSize, c.Pool.MaxSize)
 		}
+		if c.Pool.MaxReuse < 0 {
+			return fmt.Errorf("pool max_reuse must not be negative")
+		}
+		if c.Pool.IdleMemoryMB < 0 {
+			return fmt.Errorf("pool idle_memory_mb must not be negative")
+		}
+		// Pooled VMs all boot from base_rootfs_path
+		if c.VM.RootfsCoW == "none" {
+			return fmt.Errorf("pool requires rootfs_cow, pooled VMs would share a writable base rootfs")
+		}
+		if err := c.validatePoolBuckets(); err != nil {
+			return err
+		}
+	}
+
+	// Validate file descriptor limits
+	if c.Runtime.VMMMaxOpenFiles < 0 {
+		return fmt.Errorf("vmm_max_open_files must not be negative")
+	}
+	if c.Runtime.FDAdmissionThreshold < 0 || c.Runtime.FDAdmissionThreshold > 1 {
+		return fmt.Errorf("fd_admission_threshold (%g) not in range [0, 1]", c.Runtime.FDAdmissionThreshold)
+	}
+
+	// Validate seccomp; Firecracker only reads the filter when a VM boots
+	if c.Runtime.SeccompFilter != "" {
+		if c.Runtime.DisableSeccomp {
+			return fmt.Errorf("seccomp_filter is set, but disable_seccomp is true")
+		}
+		info, err := os.Stat(c.Runtime.SeccompFilter)
+		if err != nil {
+			return fmt.Errorf("seccomp filter not found: %s", c.Runtime.SeccompFilter)
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return fmt.Errorf("seccomp filter %s is not a compiled filter", c.Runtime.SeccompFilter)
+		}
+	}
+
+	// Validate cgroup accounting
+	if c.Runtime.CgroupAccounting && !filepath.IsLocal(c.Runtime.CgroupParent) {
+		return fmt.Errorf("cgroup_parent must be a relative cgroup path, got %q", c.Runtime.CgroupParent)
+	}
+	if c.Runtime.VMMMemoryOverheadMB < 0 || c.Runtime.VMMCPUOverheadMillicores < 0 {
+		return fmt.Errorf("VMM overheads must not be negative")
+	}
+
+	// Validate task concurrency limits
+	if c.Runtime.MaxConcurrentCreates < 0 || c.Runtime.MaxConcurrentStarts < 0 || c.Runtime.MaxConcurrentDeletes < 0 {
+		return fmt.Errorf("max_concurrent_creates, max_concurrent_starts and max_concurrent_deletes must not be negative")
 	}
 
 	// Validate network mode
@@ -390,6 +1034,116 @@ func (c *Config) Validate() error {
 	if !validModes[c.Network.NetworkMode] {
 		return fmt.Errorf("invalid network_mode: %s (must be 'cni' or 'none')", c.Network.NetworkMode)
 	}
+	switch c.Network.IPFamily {
+	case "ipv4", "ipv6", "dual":
+	default:
+		return fmt.Errorf("invalid ip_family: %q (must be ipv4, ipv6 or dual)", c.Network.IPFamily)
+	}
+	if c.Network.IPFamily != "ipv4" {
+		if ip, _, err := net.ParseCIDR(c.Network.DefaultSubnetV6); err != nil || ip.To4() != nil {
+			return fmt.Errorf("invalid default_subnet_v6: %q (must be an IPv6 CIDR)", c.Network.DefaultSubnetV6)
+		}
+	}
+	switch c.Network.TAPMode {
+	case "plugin", "redirect":
+	case "bridge":
+		if c.Network.TAPBridge == "" {
+			return fmt.Errorf("tap_mode bridge requires tap_bridge")
+		}
+	default:
+		return fmt.Errorf("invalid tap_mode: %q (must be plugin, redirect or bridge)", c.Network.TAPMode)
+	}
+	if c.Network.TAPQueues < 0 {
+		return fmt.Errorf("tap_queues must not be negative")
+	}
+	if strings.ContainsAny(c.Network.MTLSTrustDomain, "/:") {
+		return fmt.Errorf("mtls_trust_domain must be a bare trust domain such as cluster.local, not %q", c.Network.MTLSTrustDomain)
+	}
+	if c.Network.ServiceRouting != "none" && c.Network.ServiceRouting != "static" {
+		return fmt.Errorf("invalid service_routing: %s (must be 'none' or 'static')", c.Network.ServiceRouting)
+	}
+	if c.Network.ServiceRouting == "static" && c.Network.ServicesFile == "" {
+		return fmt.Errorf("service_routing static requires services_file")
+	}
+	for _, cidr := range c.Network.AllowedPodRoutes {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid allowed_pod_routes entry %q: must be a CIDR", cidr)
+		}
+	}
+	for _, domain := range c.Network.AllowedDNSSearch {
+		if !validDomain(strings.ToLower(strings.TrimSuffix(domain, "."))) {
+			return fmt.Errorf("invalid allowed_dns_search entry %q: must be a domain name", domain)
+		}
+	}
+	if c.Network.CNIPluginTimeout < 0 {
+		return fmt.Errorf("cni_plugin_timeout must not be negative")
+	}
+	if c.Network.IPReuseCooldown < 0 {
+		return fmt.Errorf("ip_reuse_cooldown must not be negative")
+	}
+	if c.Network.RXBytesPerSec < 0 || c.Network.TXBytesPerSec < 0 ||
+		c.Network.RXPacketsPerSec < 0 || c.Network.TXPacketsPerSec < 0 {
+		return fmt.Errorf("network rate limits must not be negative")
+	}
+
+	// Validate heartbeat policy
+	validPolicies := map[string]bool{"alert": true, "restart": true, "recycle": true}
+	if !validPolicies[c.Agent.HeartbeatPolicy] {
+		return fmt.Errorf("invalid heartbeat_policy: %s (must be 'alert', 'restart' or 'recycle')", c.Agent.HeartbeatPolicy)
+	}
+	// The guest agent's minimum (vm.MinAgentHeartbeatInterval)
+	if c.Agent.HeartbeatInterval < 10*time.Millisecond {
+		return fmt.Errorf("heartbeat_interval must be at least 10ms")
+	}
+	if c.Agent.HeartbeatMissedBeats < 1 {
+		return fmt.Errorf("heartbeat_missed_beats must be at least 1")
+	}
+	if c.Agent.LivenessInterval < 0 {
+		return fmt.Errorf("liveness_interval must not be negative")
+	}
+	if c.Agent.LivenessInterval > 0 && c.Agent.LivenessWindow < c.Agent.LivenessInterval {
+		return fmt.Errorf("liveness_window (%s) must be at least liveness_interval (%s)", c.Agent.LivenessWindow, c.Agent.LivenessInterval)
+	}
+	switch c.Agent.LogLevel {
+	case "debug", "info", "error":
+	default:
+		return fmt.Errorf("invalid agent log_level: %s (must be 'debug', 'info' or 'error')", c.Agent.LogLevel)
+	}
+	// Both reach the agent as kernel parameters
+	if strings.ContainsAny(c.Agent.OCIRuntime, " \t,=") {
+		return fmt.Errorf("invalid agent oci_runtime: %q", c.Agent.OCIRuntime)
+	}
+	for _, arg := range c.Agent.OCIRuntimeArgs {
+		if !strings.HasPrefix(arg, "-") || strings.ContainsAny(arg, " \t,") {
+			return fmt.Errorf("invalid agent oci_runtime_args entry %q (must be a flag without spaces or commas)", arg)
+		}
+	}
+
+	// Validate hooks
+	if c.Hooks.DefaultTimeout <= 0 {
+		return fmt.Errorf("hooks default_timeout must be positive")
+	}
+
+	// Validate chaos settings
+	if c.Chaos.CreateFailureRate < 0 || c.Chaos.CreateFailureRate > 1 {
+		return fmt.Errorf("chaos create_failure_rate (%g) not in range [0, 1]", c.Chaos.CreateFailureRate)
+	}
+
+	// Validate metrics cardinality limits
+	if c.Metrics.MaxSandboxSeries < 0 || c.Metrics.MaxImageSeries < 0 {
+		return fmt.Errorf("metrics series limits must not be negative")
+	}
+	if sink := c.Metrics.UsageSink; sink != "" && !strings.HasPrefix(sink, "http://") && !strings.HasPrefix(sink, "https://") &&
+		!filepath.IsAbs(strings.TrimPrefix(sink, "file://")) {
+		return fmt.Errorf("invalid metrics usage_sink %q (must be an absolute path or an http(s) URL)", sink)
+	}
+
+	// Validate histogram buckets
+	for op, bounds := range c.Metrics.Buckets {
+		if err := metrics.ValidateBuckets(bounds); err != nil {
+			return fmt.Errorf("invalid metrics buckets for %s: %w", op, err)
+		}
+	}
 
 	// Validate log level
 	validLevels := map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
@@ -397,6 +1151,19 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid log level: %s", c.Log.Level)
 	}
 
+	// Validate per-sandbox log routing
+	if !sandboxlog.ValidOutput(c.Log.SandboxOutput) {
+		return fmt.Errorf("invalid sandbox log output: %s (must be stderr, journald, file or both)", c.Log.SandboxOutput)
+	}
+	if c.Log.SandboxOutput == sandboxlog.OutputFile || c.Log.SandboxOutput == sandboxlog.OutputBoth {
+		if c.Log.SandboxDir == "" {
+			return fmt.Errorf("sandbox_dir is required to log sandboxes to files")
+		}
+		if c.Log.SandboxMaxSizeMB <= 0 || c.Log.SandboxMaxFiles < 0 {
+			return fmt.Errorf("sandbox log rotation limits must be positive")
+		}
+	}
+
 	return nil
 }
 
@@ -473,6 +1240,29 @@ func loadEnvInt64(target *int64, key string) {
 	}
 }
 
+func loadEnvUint32(target *uint32, key string) {
+	if val := os.Getenv(key); val != "" {
+		if i, err := strconv.ParseUint(val, 10, 32); err == nil {
+			*target = uint32(i)
+		}
+	}
+}
+
+func loadEnvFloat64(target *float64, key string) {
+	if val := os.Getenv(key); val != "" {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			*target = f
+		}
+	}
+}
+
+// loadEnvList loads a comma-separated list.
+func loadEnvList(target *[]string, key string) {
+	if val := os.Getenv(key); val != "" {
+		*target = parseStringList(val)
+	}
+}
+
 func loadEnvDuration(target *time.Duration, key string) {
 	if val := os.Getenv(key); val != "" {
 		if d, err := time.ParseDuration(val); err == nil {
@@ -481,6 +1271,65 @@ func loadEnvDuration(target *time.Duration, key string) {
 	}
 }
 
+// domainLabel matches a label of a domain name.
+var domainLabel = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+// validDomain reports whether s is a domain name, in lowercase.
+func validDomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if !domainLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// validatePoolBuckets checks the pool buckets' sizes and that no two have
+// the same shape.
+func (c *Config) validatePoolBuckets() error {
+	names := make([]string, 0, len(c.Pool.Buckets))
+	for name := range c.Pool.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	shapes := map[string]string{
+		fmt.Sprintf("%d/%d/%s", c.VM.DefaultVcpuCount, c.VM.DefaultMemoryMB, c.VM.KernelPath): "default",
+	}
+	for _, name := range names {
+		b := c.Pool.Buckets[name]
+		if name == "default" {
+			return fmt.Errorf("pool bucket name %q is reserved", name)
+		}
+		if b.VcpuCount < 0 || b.MemoryMB < 0 {
+			return fmt.Errorf("pool bucket %s: vcpu_count and memory_mb must not be negative", name)
+		}
+		if b.MinSize < 0 || b.MinSize > b.MaxSize {
+			return fmt.Errorf("pool bucket %s: min_size (%d) must be between 0 and max_size (%d)", name, b.MinSize, b.MaxSize)
+		}
+
+		vcpus, memory, kernel := b.VcpuCount, b.MemoryMB, b.KernelPath
+		if vcpus == 0 {
+			vcpus = c.VM.DefaultVcpuCount
+		}
+		if memory == 0 {
+			memory = c.VM.DefaultMemoryMB
+		}
+		if kernel == "" {
+			kernel = c.VM.KernelPath
+		}
+		shape := fmt.Sprintf("%d/%d/%s", vcpus, memory, kernel)
+		if other, ok := shapes[shape]; ok {
+			return fmt.Errorf("pool buckets %s and %s have the same shape", other, name)
+		}
+		shapes[shape] = name
+	}
+	return nil
+}
+
 // parseTOML is a simple TOML parser for our specific config format.
 // For production, use a proper TOML library like github.com/BurntSushi/toml
 func parseTOML(data []byte, cfg *Config) error {
@@ -520,7 +1369,47 @@ func parseTOML(data []byte, cfg *Config) error {
 	return nil
 }
 
+// parseFloatList parses a TOML array of numbers such as "[0.1, 0.5, 1]".
+func parseFloatList(value string) ([]float64, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("not an array: %s", value)
+	}
+
+	var result []float64
+	for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// parseStringList parses a TOML array of strings such as
+// `["10.0.0.0/8", "192.168.0.0/16"]`, or a bare comma-separated list.
+func parseStringList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(strings.Trim(strings.TrimSpace(value), "[]"), ",") {
+		item = strings.Trim(strings.TrimSpace(item), `"'`)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 func applyConfigValue(cfg *Config, section, key, value string) {
+	if name, ok := strings.CutPrefix(section, "pool.buckets."); ok {
+		applyPoolBucketValue(cfg, name, key, value)
+		return
+	}
+
 	switch section {
 	case "runtime":
 		switch key {
@@ -536,6 +1425,46 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			if d, err := time.ParseDuration(value); err == nil {
 				cfg.Runtime.ShutdownTimeout = d
 			}
+		case "vmm_max_open_files":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Runtime.VMMMaxOpenFiles = i
+			}
+		case "fd_admission_threshold":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				cfg.Runtime.FDAdmissionThreshold = f
+			}
+		case "seccomp_filter":
+			cfg.Runtime.SeccompFilter = value
+		case "disable_seccomp":
+			cfg.Runtime.DisableSeccomp = value == "true"
+		case "cgroup_accounting":
+			cfg.Runtime.CgroupAccounting = value == "true"
+		case "cgroup_parent":
+			cfg.Runtime.CgroupParent = value
+		case "vmm_memory_overhead_mb":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Runtime.VMMMemoryOverheadMB = i
+			}
+		case "vmm_cpu_overhead_millicores":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Runtime.VMMCPUOverheadMillicores = i
+			}
+		case "dev_mode":
+			cfg.Runtime.DevMode = value == "true"
+		case "dev_agent_binary":
+			cfg.Runtime.DevAgentBinary = value
+		case "max_concurrent_creates":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Runtime.MaxConcurrentCreates = i
+			}
+		case "max_concurrent_starts":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Runtime.MaxConcurrentStarts = i
+			}
+		case "max_concurrent_deletes":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Runtime.MaxConcurrentDeletes = i
+			}
 		}
 
 	case "vm":
@@ -562,8 +1491,30 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			}
 		case "enable_smt":
 			cfg.VM.EnableSMT = value == "true"
+		case "cpu_template":
+			cfg.VM.CPUTemplate = value
+		case "cpu_templates_dir":
+			cfg.VM.CPUTemplatesDir = value
+		case "kernels_dir":
+			cfg.VM.KernelsDir = value
+		case "kernel_download":
+			cfg.VM.KernelDownload = value == "true"
 		case "base_rootfs_path":
 			cfg.VM.BaseRootfsPath = value
+		case "base_rootfs_sha256":
+			cfg.VM.BaseRootfsSHA256 = value
+		case "rootfs_cow":
+			cfg.VM.RootfsCoW = value
+		case "cow_dir":
+			cfg.VM.CoWDir = value
+		case "overlay_size_mb":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.VM.OverlaySizeMB = i
+			}
+		case "required_kernel_features":
+			cfg.VM.RequiredKernelFeatures = parseStringList(value)
+		case "disk_prealloc":
+			cfg.VM.DiskPrealloc = value
 		case "vsock_enabled":
 			cfg.VM.VsockEnabled = value == "true"
 		}
@@ -594,6 +1545,18 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			}
 		case "prewarm_on_start":
 			cfg.Pool.PrewarmOnStart = value == "true"
+		case "generation":
+			cfg.Pool.Generation = value
+		case "max_reuse":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Pool.MaxReuse = i
+			}
+		case "resizable":
+			cfg.Pool.Resizable = value == "true"
+		case "idle_memory_mb":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Pool.IdleMemoryMB = i
+			}
 		}
 
 	case "network":
@@ -606,16 +1569,70 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			cfg.Network.CNIConfDir = value
 		case "cni_cache_dir":
 			cfg.Network.CNICacheDir = value
+		case "cni_plugin_timeout":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Network.CNIPluginTimeout = d
+			}
 		case "default_network_name":
 			cfg.Network.DefaultNetworkName = value
 		case "default_subnet":
 			cfg.Network.DefaultSubnet = value
+		case "default_subnet_v6":
+			cfg.Network.DefaultSubnetV6 = value
+		case "ip_family":
+			cfg.Network.IPFamily = value
+		case "tap_mode":
+			cfg.Network.TAPMode = value
+		case "tap_bridge":
+			cfg.Network.TAPBridge = value
+		case "tap_queues":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Network.TAPQueues = i
+			}
+		case "ip_reuse_cooldown":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Network.IPReuseCooldown = d
+			}
+		case "rx_bytes_per_sec":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Network.RXBytesPerSec = i
+			}
+		case "tx_bytes_per_sec":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Network.TXBytesPerSec = i
+			}
+		case "rx_packets_per_sec":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Network.RXPacketsPerSec = i
+			}
+		case "tx_packets_per_sec":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Network.TXPacketsPerSec = i
+			}
+		case "mtls_cert_file":
+			cfg.Network.MTLSCertFile = value
+		case "mtls_key_file":
+			cfg.Network.MTLSKeyFile = value
+		case "mtls_bundle_file":
+			cfg.Network.MTLSBundleFile = value
+		case "mtls_trust_domain":
+			cfg.Network.MTLSTrustDomain = value
+		case "service_routing":
+			cfg.Network.ServiceRouting = value
+		case "services_file":
+			cfg.Network.ServicesFile = value
+		case "allowed_pod_routes":
+			cfg.Network.AllowedPodRoutes = parseStringList(value)
+		case "allowed_dns_search":
+			cfg.Network.AllowedDNSSearch = parseStringList(value)
 		}
 
 	case "image":
 		switch key {
 		case "root_dir":
 			cfg.Image.RootDir = value
+		case "filesystem":
+			cfg.Image.Filesystem = value
 		case "default_block_size_mb":
 			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
 				cfg.Image.DefaultBlockSizeMB = i
@@ -628,6 +1645,32 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
 				cfg.Image.CacheMaxSizeMB = i
 			}
+		case "fsify_min_version":
+			cfg.Image.FsifyMinVersion = value
+		case "conversion_stage_attempts":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Image.ConversionStageAttempts = i
+			}
+		case "remote_builder_address":
+			cfg.Image.RemoteBuilderAddress = value
+		case "remote_builder_ca_file":
+			cfg.Image.RemoteBuilderCAFile = value
+		case "remote_builder_timeout":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Image.RemoteBuilderTimeout = d
+			}
+		case "remote_builder_min_free_disk_mb":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Image.RemoteBuilderMinFreeDiskMB = i
+			}
+		case "remote_builder_max_local_conversions":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Image.RemoteBuilderMaxLocalConversions = i
+			}
+		case "bake_boot_files":
+			cfg.Image.BakeBootFiles = value == "true"
+		case "bake_files":
+			cfg.Image.BakeFiles = parseStringList(value)
 		}
 
 	case "agent":
@@ -652,6 +1695,38 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			if d, err := time.ParseDuration(value); err == nil {
 				cfg.Agent.CommandTimeout = d
 			}
+		case "heartbeat_port":
+			if i, err := strconv.ParseUint(value, 10, 32); err == nil {
+				cfg.Agent.HeartbeatPort = uint32(i)
+			}
+		case "heartbeat_interval":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Agent.HeartbeatInterval = d
+			}
+		case "heartbeat_missed_beats":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Agent.HeartbeatMissedBeats = i
+			}
+		case "heartbeat_policy":
+			cfg.Agent.HeartbeatPolicy = value
+		case "liveness_interval":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Agent.LivenessInterval = d
+			}
+		case "liveness_window":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Agent.LivenessWindow = d
+			}
+		case "liveness_restart_vm":
+			cfg.Agent.LivenessRestartVM = value == "true"
+		case "log_level":
+			cfg.Agent.LogLevel = value
+		case "auth":
+			cfg.Agent.Auth = value == "true"
+		case "oci_runtime":
+			cfg.Agent.OCIRuntime = value
+		case "oci_runtime_args":
+			cfg.Agent.OCIRuntimeArgs = parseStringList(value)
 		}
 
 	case "metrics":
@@ -662,6 +1737,60 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			cfg.Metrics.Address = value
 		case "path":
 			cfg.Metrics.Path = value
+		case "max_sandbox_series":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Metrics.MaxSandboxSeries = i
+			}
+		case "max_image_series":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Metrics.MaxImageSeries = i
+			}
+		case "usage_sink":
+			cfg.Metrics.UsageSink = value
+		case "rates":
+			cfg.Metrics.Rates = value == "true"
+		}
+
+	case "vm.disk_prealloc_filesystems":
+		if cfg.VM.DiskPreallocFilesystems == nil {
+			cfg.VM.DiskPreallocFilesystems = make(map[string]string)
+		}
+		cfg.VM.DiskPreallocFilesystems[key] = value
+
+	case "vm.disk_prealloc_volumes":
+		if cfg.VM.DiskPreallocVolumes == nil {
+			cfg.VM.DiskPreallocVolumes = make(map[string]string)
+		}
+		cfg.VM.DiskPreallocVolumes[key] = value
+
+	case "metrics.buckets":
+		if bounds, err := parseFloatList(value); err == nil {
+			if cfg.Metrics.Buckets == nil {
+				cfg.Metrics.Buckets = make(map[string][]float64)
+			}
+			cfg.Metrics.Buckets[key] = bounds
+		}
+
+	case "chaos":
+		switch key {
+		case "enabled":
+			cfg.Chaos.Enabled = value == "true"
+		case "create_failure_rate":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				cfg.Chaos.CreateFailureRate = f
+			}
+		case "acquire_delay":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Chaos.AcquireDelay = d
+			}
+		case "kill_warm_interval":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Chaos.KillWarmInterval = d
+			}
+		case "seed":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				cfg.Chaos.Seed = i
+			}
 		}
 
 	case "log":
@@ -672,6 +1801,61 @@ func applyConfigValue(cfg *Config, section, key, value string) {
 			cfg.Log.Format = value
 		case "file":
 			cfg.Log.File = value
+		case "sandbox_output":
+			cfg.Log.SandboxOutput = value
+		case "sandbox_dir":
+			cfg.Log.SandboxDir = value
+		case "sandbox_max_size_mb":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Log.SandboxMaxSizeMB = i
+			}
+		case "sandbox_max_files":
+			if i, err := strconv.Atoi(value); err == nil {
+				cfg.Log.SandboxMaxFiles = i
+			}
+		}
+
+	case "hooks":
+		switch key {
+		case "dir":
+			cfg.Hooks.Dir = value
+		case "default_timeout":
+			if d, err := time.ParseDuration(value); err == nil {
+				cfg.Hooks.DefaultTimeout = d
+			}
 		}
 	}
 }
+
+// applyPoolBucketValue applies a value from a [pool.buckets.<name>] section.
+func applyPoolBucketValue(cfg *Config, name, key, value string) {
+	if cfg.Pool.Buckets == nil {
+		cfg.Pool.Buckets = make(map[string]PoolBucketConfig)
+	}
+	b := cfg.Pool.Buckets[name]
+
+	switch key {
+	case "vcpu_count":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			b.VcpuCount = i
+		}
+	case "memory_mb":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			b.MemoryMB = i
+		}
+	case "kernel_path":
+		b.KernelPath = value
+	case "min_size":
+		if i, err := strconv.Atoi(value); err == nil {
+			b.MinSize = i
+		}
+	case "max_size":
+		if i, err := strconv.Atoi(value); err == nil {
+			b.MaxSize = i
+		}
+	case "resizable":
+		b.Resizable = value == "true"
+	}
+
+	cfg.Pool.Buckets[name] = b
+}
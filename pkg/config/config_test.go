@@ -38,21 +38,70 @@ func TestLoadFromFile(t *testing.T) {
 [runtime]
 runtime_dir = "/tmp/fc-cri"
 enable_jailer = true
+seccomp_filter = "/etc/fc-cri/seccomp/firecracker.bpf"
+cgroup_parent = "machine.slice/fc-cri"
+vmm_memory_overhead_mb = 96
+dev_agent_binary = "/opt/fc-cri/fc-agent"
+max_concurrent_creates = 4
 
 [vm]
 default_vcpu_count = 4
 default_memory_mb = 1024
 kernel_args = "console=ttyS0 reboot=k"
+cpu_template = "T2S"
+disk_prealloc = "fallocate"
+base_rootfs_sha256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+required_kernel_features = ["virtio_blk", "vsock"]
+
+[vm.disk_prealloc_volumes]
+emptydir = "full"
 
 [pool]
 enabled = false
 max_size = 20
+idle_memory_mb = 64
+
+[pool.buckets.large]
+vcpu_count = 2
+memory_mb = 1024
+min_size = 1
+max_size = 4
+resizable = true
+
+[image]
+filesystem = "erofs"
+remote_builder_address = "builder.fc-cri.svc:9000"
+remote_builder_timeout = "5m"
+remote_builder_max_local_conversions = 1
+bake_boot_files = true
+bake_files = ["/usr/local/bin/fc-agent:/sbin/fc-agent:755", "/usr/bin/runc:/usr/bin/runc"]
 
 [network]
 network_mode = "none"
+cni_plugin_timeout = "10s"
+rx_bytes_per_sec = 12500000
+mtls_trust_domain = "cluster.local"
+service_routing = "static"
+allowed_pod_routes = ["10.0.0.0/8", "fd00:c0::/32"]
+allowed_dns_search = ["corp.example.com"]
+
+[agent]
+auth = false
+oci_runtime = "crun"
+oci_runtime_args = ["--debug"]
+
+[metrics]
+rates = true
+
+[metrics.buckets]
+create = [0.1, 0.5, 1, 5]
 
 [log]
 level = "debug"
+
+[hooks]
+dir = "/etc/fc-cri/hooks"
+default_timeout = "3s"
 `
 	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
 		t.Fatalf("Failed to write config file: %v", err)
@@ -71,6 +120,21 @@ level = "debug"
 	if !cfg.Runtime.EnableJailer {
 		t.Errorf("EnableJailer = false, want true")
 	}
+	if cfg.Runtime.SeccompFilter != "/etc/fc-cri/seccomp/firecracker.bpf" {
+		t.Errorf("SeccompFilter = %s, want /etc/fc-cri/seccomp/firecracker.bpf", cfg.Runtime.SeccompFilter)
+	}
+	if cfg.Runtime.CgroupParent != "machine.slice/fc-cri" || cfg.Runtime.VMMMemoryOverheadMB != 96 {
+		t.Errorf("cgroup = %s, %d MB overhead, want machine.slice/fc-cri, 96 MB", cfg.Runtime.CgroupParent, cfg.Runtime.VMMMemoryOverheadMB)
+	}
+	if cfg.Runtime.DevMode || cfg.Runtime.DevAgentBinary != "/opt/fc-cri/fc-agent" {
+		t.Errorf("dev mode = %v, %s, want the default false, /opt/fc-cri/fc-agent", cfg.Runtime.DevMode, cfg.Runtime.DevAgentBinary)
+	}
+	if cfg.Runtime.MaxConcurrentCreates != 4 || cfg.Runtime.MaxConcurrentDeletes != 0 {
+		t.Errorf("task limits = %d creates, %d deletes, want 4 and unlimited", cfg.Runtime.MaxConcurrentCreates, cfg.Runtime.MaxConcurrentDeletes)
+	}
+	if !cfg.Runtime.CgroupAccounting {
+		t.Errorf("CgroupAccounting = false, want the default true")
+	}
 	if cfg.VM.DefaultVcpuCount != 4 {
 		t.Errorf("DefaultVcpuCount = %d, want 4", cfg.VM.DefaultVcpuCount)
 	}
@@ -80,18 +144,82 @@ level = "debug"
 	if cfg.VM.KernelArgs != "console=ttyS0 reboot=k" {
 		t.Errorf("KernelArgs = %s, want console=ttyS0 reboot=k", cfg.VM.KernelArgs)
 	}
+	if cfg.VM.CPUTemplate != "T2S" {
+		t.Errorf("CPUTemplate = %s, want T2S", cfg.VM.CPUTemplate)
+	}
+	if got := cfg.VM.RequiredKernelFeatures; len(got) != 2 || got[1] != "vsock" {
+		t.Errorf("RequiredKernelFeatures = %v, want [virtio_blk vsock]", got)
+	}
+	if cfg.VM.DiskPrealloc != "fallocate" || cfg.VM.DiskPreallocVolumes["emptydir"] != "full" {
+		t.Errorf("disk preallocation = %s, %v, want fallocate with full emptydir", cfg.VM.DiskPrealloc, cfg.VM.DiskPreallocVolumes)
+	}
+	if cfg.VM.BaseRootfsSHA256 != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("BaseRootfsSHA256 = %s, want 9f86d0...", cfg.VM.BaseRootfsSHA256)
+	}
+	if cfg.Image.Filesystem != "erofs" || cfg.VM.OverlaySizeMB != 4096 {
+		t.Errorf("image filesystem = %s, %d MB overlay, want erofs, the default 4096 MB", cfg.Image.Filesystem, cfg.VM.OverlaySizeMB)
+	}
 	if cfg.Pool.Enabled {
 		t.Errorf("Pool.Enabled = true, want false")
 	}
 	if cfg.Pool.MaxSize != 20 {
 		t.Errorf("Pool.MaxSize = %d, want 20", cfg.Pool.MaxSize)
 	}
+	if cfg.Image.RemoteBuilderAddress != "builder.fc-cri.svc:9000" {
+		t.Errorf("Image.RemoteBuilderAddress = %s, want builder.fc-cri.svc:9000", cfg.Image.RemoteBuilderAddress)
+	}
+	if cfg.Image.RemoteBuilderTimeout != 5*time.Minute || cfg.Image.RemoteBuilderMaxLocalConversions != 1 {
+		t.Errorf("Image remote builder timeout = %v, max local = %d, want 5m and 1",
+			cfg.Image.RemoteBuilderTimeout, cfg.Image.RemoteBuilderMaxLocalConversions)
+	}
+	if !cfg.Image.BakeBootFiles || len(cfg.Image.BakeFiles) != 2 || cfg.Image.BakeFiles[1] != "/usr/bin/runc:/usr/bin/runc" {
+		t.Errorf("Image bake = %v %v, want true and 2 files", cfg.Image.BakeBootFiles, cfg.Image.BakeFiles)
+	}
+	if cfg.Pool.IdleMemoryMB != 64 {
+		t.Errorf("Pool.IdleMemoryMB = %d, want 64", cfg.Pool.IdleMemoryMB)
+	}
+	if got := cfg.Pool.Buckets["large"]; got != (PoolBucketConfig{VcpuCount: 2, MemoryMB: 1024, MinSize: 1, MaxSize: 4, Resizable: true}) {
+		t.Errorf("Pool.Buckets[large] = %+v", got)
+	}
 	if cfg.Network.NetworkMode != "none" {
 		t.Errorf("NetworkMode = %s, want none", cfg.Network.NetworkMode)
 	}
+	if cfg.Network.MTLSTrustDomain != "cluster.local" {
+		t.Errorf("MTLSTrustDomain = %s, want cluster.local", cfg.Network.MTLSTrustDomain)
+	}
+	if cfg.Network.ServiceRouting != "static" || cfg.Network.ServicesFile != "/etc/fc-cri/services.json" {
+		t.Errorf("ServiceRouting = %s, ServicesFile = %s", cfg.Network.ServiceRouting, cfg.Network.ServicesFile)
+	}
+	if got := cfg.Network.AllowedPodRoutes; len(got) != 2 || got[0] != "10.0.0.0/8" || got[1] != "fd00:c0::/32" {
+		t.Errorf("AllowedPodRoutes = %q", got)
+	}
+	if got := cfg.Network.AllowedDNSSearch; len(got) != 1 || got[0] != "corp.example.com" {
+		t.Errorf("AllowedDNSSearch = %q", got)
+	}
+	if cfg.Network.RXBytesPerSec != 12500000 {
+		t.Errorf("RXBytesPerSec = %d, want 12500000", cfg.Network.RXBytesPerSec)
+	}
+	if cfg.Network.CNIPluginTimeout != 10*time.Second {
+		t.Errorf("CNIPluginTimeout = %s, want 10s", cfg.Network.CNIPluginTimeout)
+	}
+	if cfg.Agent.Auth {
+		t.Error("Agent.Auth = true, want false")
+	}
+	if cfg.Agent.OCIRuntime != "crun" || len(cfg.Agent.OCIRuntimeArgs) != 1 || cfg.Agent.OCIRuntimeArgs[0] != "--debug" {
+		t.Errorf("Agent OCI runtime = %q %v, want crun [--debug]", cfg.Agent.OCIRuntime, cfg.Agent.OCIRuntimeArgs)
+	}
 	if cfg.Log.Level != "debug" {
 		t.Errorf("Log.Level = %s, want debug", cfg.Log.Level)
 	}
+	if got := cfg.Metrics.Buckets["create"]; len(got) != 4 || got[3] != 5 {
+		t.Errorf("Metrics.Buckets[create] = %v, want [0.1 0.5 1 5]", got)
+	}
+	if !cfg.Metrics.Rates {
+		t.Error("Metrics.Rates = false, want true")
+	}
+	if cfg.Hooks.Dir != "/etc/fc-cri/hooks" || cfg.Hooks.DefaultTimeout != 3*time.Second {
+		t.Errorf("Hooks = %+v, want /etc/fc-cri/hooks with 3s timeout", cfg.Hooks)
+	}
 }
 
 func TestLoadFromEnv(t *testing.T) {
@@ -100,11 +228,13 @@ func TestLoadFromEnv(t *testing.T) {
 	os.Setenv("FC_CRI_VM_DEFAULT_VCPU_COUNT", "8")
 	os.Setenv("FC_CRI_POOL_ENABLED", "false")
 	os.Setenv("FC_CRI_SHUTDOWN_TIMEOUT", "1m")
+	os.Setenv("FC_CRI_AGENT_HEARTBEAT_PORT", "2025")
 	defer func() {
 		os.Unsetenv("FC_CRI_RUNTIME_DIR")
 		os.Unsetenv("FC_CRI_VM_DEFAULT_VCPU_COUNT")
 		os.Unsetenv("FC_CRI_POOL_ENABLED")
 		os.Unsetenv("FC_CRI_SHUTDOWN_TIMEOUT")
+		os.Unsetenv("FC_CRI_AGENT_HEARTBEAT_PORT")
 	}()
 
 	cfg := Default()
@@ -122,6 +252,9 @@ func TestLoadFromEnv(t *testing.T) {
 	if cfg.Runtime.ShutdownTimeout != 1*time.Minute {
 		t.Errorf("ShutdownTimeout = %s, want 1m", cfg.Runtime.ShutdownTimeout)
 	}
+	if cfg.Agent.HeartbeatPort != 2025 {
+		t.Errorf("HeartbeatPort = %d, want 2025", cfg.Agent.HeartbeatPort)
+	}
 }
 
 func TestValidate(t *testing.T) {
@@ -173,6 +306,64 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Invalid rootfs cow mode",
+			modify: func(c *Config) {
+				c.VM.RootfsCoW = "overlay"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown required kernel feature",
+			modify: func(c *Config) {
+				c.VM.RequiredKernelFeatures = []string{"virtio_blk", "btrfs"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid base rootfs checksum",
+			modify: func(c *Config) {
+				c.VM.BaseRootfsSHA256 = "sha256:9f86d081"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Pool sharing a writable base rootfs",
+			modify: func(c *Config) {
+				c.Pool.Enabled = true
+				c.VM.RootfsCoW = "none"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid disk preallocation",
+			modify: func(c *Config) {
+				c.VM.DiskPreallocFilesystems = map[string]string{"xfs": "eager"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid image filesystem",
+			modify: func(c *Config) {
+				c.Image.Filesystem = "zfs"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Read-only images without overlay drives",
+			modify: func(c *Config) {
+				c.Image.Filesystem = "squashfs"
+				c.VM.OverlaySizeMB = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid CPU template",
+			modify: func(c *Config) {
+				c.VM.CPUTemplate = "../templates/t2s"
+			},
+			wantErr: true,
+		},
 		{
 			name: "Invalid pool config",
 			modify: func(c *Config) {
@@ -181,6 +372,13 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Negative pool max reuse",
+			modify: func(c *Config) {
+				c.Pool.MaxReuse = -1
+			},
+			wantErr: true,
+		},
 		{
 			name: "Invalid network mode",
 			modify: func(c *Config) {
@@ -188,6 +386,319 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Negative CNI plugin timeout",
+			modify: func(c *Config) {
+				c.Network.CNIPluginTimeout = -time.Second
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative IP reuse cooldown",
+			modify: func(c *Config) {
+				c.Network.IPReuseCooldown = -time.Second
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative network rate limit",
+			modify: func(c *Config) {
+				c.Network.TXBytesPerSec = -1
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid FD admission threshold",
+			modify: func(c *Config) {
+				c.Runtime.FDAdmissionThreshold = 2
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid chaos failure rate",
+			modify: func(c *Config) {
+				c.Chaos.CreateFailureRate = 1.5
+			},
+			wantErr: true,
+		},
+		{
+			name: "Absolute cgroup parent",
+			modify: func(c *Config) {
+				c.Runtime.CgroupParent = "/sys/fs/cgroup/fc-cri.slice"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative VMM memory overhead",
+			modify: func(c *Config) {
+				c.Runtime.VMMMemoryOverheadMB = -1
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative create limit",
+			modify: func(c *Config) {
+				c.Runtime.MaxConcurrentCreates = -1
+			},
+			wantErr: true,
+		},
+		{
+			name: "Missing seccomp filter",
+			modify: func(c *Config) {
+				c.Runtime.SeccompFilter = filepath.Join(tmpDir, "missing.bpf")
+			},
+			wantErr: true,
+		},
+		{
+			name: "Seccomp filter with seccomp disabled",
+			modify: func(c *Config) {
+				c.Runtime.SeccompFilter = binFile
+				c.Runtime.DisableSeccomp = true
+			},
+			wantErr: true,
+		},
+		{
+			name: "Dev mode without Firecracker or a kernel",
+			modify: func(c *Config) {
+				c.Runtime.DevMode = true
+				c.Runtime.DevAgentBinary = binFile
+				c.Runtime.FirecrackerBinary = "/non/existent/binary"
+				c.VM.KernelPath = "/non/existent/kernel"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Dev mode without the agent",
+			modify: func(c *Config) {
+				c.Runtime.DevMode = true
+				c.Runtime.DevAgentBinary = "/non/existent/fc-agent"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Dev mode with the jailer",
+			modify: func(c *Config) {
+				c.Runtime.DevMode = true
+				c.Runtime.DevAgentBinary = binFile
+				c.Runtime.EnableJailer = true
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative remote builder threshold",
+			modify: func(c *Config) {
+				c.Image.RemoteBuilderMaxLocalConversions = -1
+			},
+			wantErr: true,
+		},
+		{
+			name: "Relative bake file target",
+			modify: func(c *Config) {
+				c.Image.BakeFiles = []string{"/usr/local/bin/fc-agent:sbin/fc-agent"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid fsify minimum version",
+			modify: func(c *Config) {
+				c.Image.FsifyMinVersion = "latest"
+			},
+			wantErr: true,
+		},
+		{
+			name: "No conversion stage attempts",
+			modify: func(c *Config) {
+				c.Image.ConversionStageAttempts = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative pool idle memory",
+			modify: func(c *Config) {
+				c.Pool.IdleMemoryMB = -1
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid pool bucket sizes",
+			modify: func(c *Config) {
+				c.Pool.Buckets = map[string]PoolBucketConfig{"large": {VcpuCount: 2, MinSize: 4, MaxSize: 2}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Pool bucket of the default shape",
+			modify: func(c *Config) {
+				c.Pool.Buckets = map[string]PoolBucketConfig{"small": {VcpuCount: c.VM.DefaultVcpuCount, MaxSize: 2}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid mTLS trust domain",
+			modify: func(c *Config) {
+				c.Network.MTLSTrustDomain = "spiffe://cluster.local"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid service routing",
+			modify: func(c *Config) {
+				c.Network.ServiceRouting = "kube-proxy"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Static service routing without file",
+			modify: func(c *Config) {
+				c.Network.ServiceRouting = "static"
+				c.Network.ServicesFile = ""
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid allowed pod route",
+			modify: func(c *Config) {
+				c.Network.AllowedPodRoutes = []string{"10.0.0.0"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid allowed DNS search domain",
+			modify: func(c *Config) {
+				c.Network.AllowedDNSSearch = []string{"corp example.com"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid IP family",
+			modify: func(c *Config) {
+				c.Network.IPFamily = "ipv5"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Dual-stack with an IPv4 v6 subnet",
+			modify: func(c *Config) {
+				c.Network.IPFamily = "dual"
+				c.Network.DefaultSubnetV6 = "10.89.0.0/16"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Valid IPv6-only",
+			modify: func(c *Config) {
+				c.Network.IPFamily = "ipv6"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Invalid tap mode",
+			modify: func(c *Config) {
+				c.Network.TAPMode = "macvtap"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Bridge tap mode without a bridge",
+			modify: func(c *Config) {
+				c.Network.TAPMode = "bridge"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid metrics buckets",
+			modify: func(c *Config) {
+				c.Metrics.Buckets = map[string][]float64{"create": {1, 0.5}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Relative usage sink",
+			modify: func(c *Config) {
+				c.Metrics.UsageSink = "usage.jsonl"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Usage sink URL",
+			modify: func(c *Config) {
+				c.Metrics.UsageSink = "https://billing.example.com/usage"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Agent runtime option not a flag",
+			modify: func(c *Config) {
+				c.Agent.OCIRuntimeArgs = []string{"debug"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid hooks timeout",
+			modify: func(c *Config) {
+				c.Hooks.DefaultTimeout = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid agent log level",
+			modify: func(c *Config) {
+				c.Agent.LogLevel = "trace"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid sandbox log output",
+			modify: func(c *Config) {
+				c.Log.SandboxOutput = "syslog"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sandbox log files without rotation",
+			modify: func(c *Config) {
+				c.Log.SandboxOutput = "file"
+				c.Log.SandboxMaxSizeMB = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sandbox logs to journald and files",
+			modify: func(c *Config) {
+				c.Log.SandboxOutput = "both"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Invalid heartbeat policy",
+			modify: func(c *Config) {
+				c.Agent.HeartbeatPolicy = "reboot"
+			},
+			wantErr: true,
+		},
+		{
+			name: "Heartbeat interval below the agent's minimum",
+			modify: func(c *Config) {
+				c.Agent.HeartbeatInterval = time.Millisecond
+			},
+			wantErr: true,
+		},
+		{
+			name: "Liveness window shorter than the interval",
+			modify: func(c *Config) {
+				c.Agent.LivenessInterval = 10 * time.Second
+				c.Agent.LivenessWindow = 5 * time.Second
+			},
+			wantErr: true,
+		},
+		{
+			name: "Liveness pings disabled",
+			modify: func(c *Config) {
+				c.Agent.LivenessInterval = 0
+				c.Agent.LivenessWindow = 0
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
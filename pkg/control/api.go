@@ -0,0 +1,270 @@
+// Package control defines the runtime's control API: a versioned gRPC
+// service on a Unix socket through which platform controllers and fcctl
+// manage a node (sandboxes, the VM pool, image conversion, snapshots and
+// metrics) instead of reading state files and scraping Prometheus text.
+//
+// Messages are JSON, like the guest agent protocol and the remote image
+// builder, so clients need no generated protobuf code: any gRPC client
+// that sends the "json" content subtype can call it.
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+)
+
+const (
+	// APIVersion is the version of the API this package serves. Methods
+	// are only added within a version; a breaking change gets a new
+	// service name.
+	APIVersion = "v1"
+
+	// ServiceName is the gRPC service the API is served as.
+	ServiceName = "fccri.runtime." + APIVersion + ".Runtime"
+
+	// DefaultSocket is where the runtime serves the API.
+	DefaultSocket = "/run/fc-cri/api.sock"
+)
+
+var (
+	// ErrNotFound is returned for a sandbox, image or snapshot that doesn't
+	// exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrUnavailable is returned by methods whose component the serving
+	// process doesn't run, e.g. pool methods in a process without a pool.
+	ErrUnavailable = errors.New("not available in this runtime")
+)
+
+// Runtime is what the API serves. A method may return ErrUnavailable if
+// the runtime doesn't have the component it needs.
+type Runtime interface {
+	ListSandboxes(ctx context.Context, req *ListSandboxesRequest) (*ListSandboxesResponse, error)
+	PoolStatus(ctx context.Context, req *PoolStatusRequest) (*PoolStatus, error)
+	WarmPool(ctx context.Context, req *WarmPoolRequest) (*WarmPoolResponse, error)
+	DrainPool(ctx context.Context, req *DrainPoolRequest) (*DrainPoolResponse, error)
+	InspectPool(ctx context.Context, req *InspectPoolRequest) (*InspectPoolResponse, error)
+	ListImages(ctx context.Context, req *ListImagesRequest) (*ListImagesResponse, error)
+	// ConvertImage converts an image, calling send with its progress and,
+	// last, the converted image.
+	ConvertImage(ctx context.Context, req *ConvertImageRequest, send func(*ConvertImageResponse) error) error
+	ListSnapshots(ctx context.Context, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error)
+	RebuildGoldenSnapshot(ctx context.Context, req *RebuildGoldenSnapshotRequest) (*Snapshot, error)
+	DeleteSnapshot(ctx context.Context, req *DeleteSnapshotRequest) (*DeleteSnapshotResponse, error)
+	Metrics(ctx context.Context, req *MetricsRequest) (*metrics.Snapshot, error)
+}
+
+// VersionRequest asks for the API version the server speaks.
+type VersionRequest struct{}
+
+// VersionResponse is the server's API version and the methods it serves,
+// so clients can check for a method before calling it.
+type VersionResponse struct {
+	APIVersion string   `json:"api_version"`
+	Methods    []string `json:"methods"`
+}
+
+// ListSandboxesRequest lists the sandboxes on the node.
+type ListSandboxesRequest struct{}
+
+// ListSandboxesResponse holds the node's sandboxes, newest first.
+type ListSandboxesResponse struct {
+	Sandboxes []Sandbox `json:"sandboxes"`
+}
+
+// Sandbox is a sandbox VM on the node.
+type Sandbox struct {
+	ID        string    `json:"id"`
+	ShimID    string    `json:"shim_id,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	PID       int       `json:"pid"`
+	Running   bool      `json:"running"`
+	VCPUs     int64     `json:"vcpus"`
+	MemoryMB  int64     `json:"memory_mb"`
+	FromPool  bool      `json:"from_pool"`
+	CreatedAt time.Time `json:"created_at"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+
+	// Network is nil for sandboxes without a network namespace.
+	Network *SandboxNetwork `json:"network,omitempty"`
+}
+
+// SandboxNetwork is how a sandbox is attached to the node's network, for
+// policy agents chained with its CNI network to correlate its tap and veth
+// with the pod.
+type SandboxNetwork struct {
+	NetNS    string   `json:"netns"`
+	IfName   string   `json:"ifname"`
+	IfMAC    string   `json:"if_mac,omitempty"`
+	Tap      string   `json:"tap"`
+	VethPeer string   `json:"veth_peer,omitempty"`
+	GuestMAC string   `json:"guest_mac,omitempty"`
+	IPs      []string `json:"ips,omitempty"`
+}
+
+// PoolStatusRequest asks for the VM pool's status.
+type PoolStatusRequest struct{}
+
+// PoolStatus is the VM pool's status.
+type PoolStatus struct {
+	Available        int          `json:"available"`
+	Warming          int          `json:"warming"`
+	Degraded         int          `json:"degraded"`
+	InUse            int          `json:"in_use"`
+	MaxSize          int          `json:"max_size"`
+	TotalServed      int64        `json:"total_served"`
+	PoolHits         int64        `json:"pool_hits"`
+	PoolMisses       int64        `json:"pool_misses"`
+	HitRate          float64      `json:"hit_rate"`
+	ReclaimedMB      int64        `json:"reclaimed_mb"`
+	ReservedVCPUs    int64        `json:"reserved_vcpus"`
+	ReservedMemoryMB int64        `json:"reserved_memory_mb"`
+	Draining         bool         `json:"draining"`
+	Buckets          []PoolBucket `json:"buckets,omitempty"`
+}
+
+// PoolBucket is the status of the pool's VMs of one shape.
+type PoolBucket struct {
+	Name      string `json:"name"`
+	VCPUs     int64  `json:"vcpus"`
+	MemoryMB  int64  `json:"memory_mb"`
+	Available int    `json:"available"`
+	Warming   int    `json:"warming"`
+	Degraded  int    `json:"degraded"`
+	InUse     int    `json:"in_use"`
+	MinSize   int    `json:"min_size"`
+	MaxSize   int    `json:"max_size"`
+}
+
+// WarmPoolRequest adds pre-warmed VMs of a shape to the pool. A zero shape
+// warms the pool's default VMs.
+type WarmPoolRequest struct {
+	Count    int   `json:"count"`
+	VCPUs    int64 `json:"vcpus,omitempty"`
+	MemoryMB int64 `json:"memory_mb,omitempty"`
+}
+
+// WarmPoolResponse is the pool's status after warming.
+type WarmPoolResponse struct {
+	Pool PoolStatus `json:"pool"`
+}
+
+// DrainPoolRequest drains the pool: it stops handing out VMs, destroys
+// the idle ones and waits for the ones in use.
+type DrainPoolRequest struct{}
+
+// DrainPoolResponse reports what draining the pool did.
+type DrainPoolResponse struct {
+	IdleDestroyed int      `json:"idle_destroyed"`
+	Released      int      `json:"released"`
+	ForceKilled   []string `json:"force_killed,omitempty"`
+	Errors        int      `json:"errors"`
+}
+
+// InspectPoolRequest asks for the state of every VM in the pool.
+type InspectPoolRequest struct{}
+
+// InspectPoolResponse holds the pool's VMs by bucket, followed by the VMs
+// it retired last.
+type InspectPoolResponse struct {
+	VMs []PoolVM `json:"vms"`
+}
+
+// PoolVM is a VM in the pool: warming, ready, degraded or retired. Only
+// ready VMs are handed out.
+type PoolVM struct {
+	ID          string             `json:"id"`
+	Bucket      string             `json:"bucket"`
+	State       string             `json:"state"`
+	Since       time.Time          `json:"since"`
+	Reason      string             `json:"reason,omitempty"`
+	Transitions []PoolVMTransition `json:"transitions,omitempty"`
+}
+
+// PoolVMTransition is a pooled VM's move from one state to another.
+type PoolVMTransition struct {
+	From   string    `json:"from,omitempty"`
+	To     string    `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ListImagesRequest lists the converted images.
+type ListImagesRequest struct{}
+
+// ListImagesResponse holds the converted images.
+type ListImagesResponse struct {
+	Images []Image `json:"images"`
+}
+
+// Image is a converted image.
+type Image struct {
+	Reference    string    `json:"reference"`
+	Digest       string    `json:"digest,omitempty"`
+	RootfsPath   string    `json:"rootfs_path"`
+	SquashfsPath string    `json:"squashfs_path,omitempty"`
+	SizeBytes    int64     `json:"size_bytes"`
+	Filesystem   string    `json:"filesystem"`
+	ConvertedAt  time.Time `json:"converted_at"`
+}
+
+// ConvertImageRequest converts an image. The conversion keeps running if
+// the client goes away.
+type ConvertImageRequest struct {
+	Image string `json:"image"`
+}
+
+// ConvertImageResponse is one message of a conversion's stream: its
+// progress, or the converted image as the last message.
+type ConvertImageResponse struct {
+	Progress *ImageProgress `json:"progress,omitempty"`
+	Image    *Image         `json:"image,omitempty"`
+}
+
+// ImageProgress is how far a conversion has got.
+type ImageProgress struct {
+	Phase          string    `json:"phase"`
+	BytesPulled    int64     `json:"bytes_pulled"`
+	LayersTotal    int       `json:"layers_total,omitempty"`
+	LayersUnpacked int       `json:"layers_unpacked"`
+	BytesCopied    int64     `json:"bytes_copied"`
+	BytesToCopy    int64     `json:"bytes_to_copy,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ListSnapshotsRequest lists the VM snapshots.
+type ListSnapshotsRequest struct{}
+
+// ListSnapshotsResponse holds the VM snapshots.
+type ListSnapshotsResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Snapshot is a VM snapshot.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type,omitempty"`
+	Parent    string    `json:"parent,omitempty"`
+	IsGolden  bool      `json:"is_golden"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RebuildGoldenSnapshotRequest takes the golden snapshot again, replacing
+// it and the snapshots layered on it.
+type RebuildGoldenSnapshotRequest struct{}
+
+// DeleteSnapshotRequest deletes a snapshot and the snapshots layered on it.
+type DeleteSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// DeleteSnapshotResponse acknowledges a deleted snapshot.
+type DeleteSnapshotResponse struct{}
+
+// MetricsRequest asks for a snapshot of the runtime's metrics.
+type MetricsRequest struct{}
@@ -0,0 +1,181 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Client calls the runtime API.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial returns a client of the API served on socketPath. It connects on
+// the first call.
+func Dial(ctx context.Context, socketPath string) (*Client, error) {
+	conn, err := grpc.DialContext(ctx, "unix://"+socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype("json")))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the client's connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(ctx context.Context, method string, req, resp interface{}) error {
+	return fromStatus(c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp))
+}
+
+// Version returns the API version the server speaks and its methods.
+func (c *Client) Version(ctx context.Context) (*VersionResponse, error) {
+	resp := &VersionResponse{}
+	return resp, c.call(ctx, "Version", &VersionRequest{}, resp)
+}
+
+// ListSandboxes lists the node's sandboxes, newest first.
+func (c *Client) ListSandboxes(ctx context.Context) ([]Sandbox, error) {
+	resp := &ListSandboxesResponse{}
+	if err := c.call(ctx, "ListSandboxes", &ListSandboxesRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Sandboxes, nil
+}
+
+// PoolStatus returns the VM pool's status.
+func (c *Client) PoolStatus(ctx context.Context) (*PoolStatus, error) {
+	resp := &PoolStatus{}
+	return resp, c.call(ctx, "PoolStatus", &PoolStatusRequest{}, resp)
+}
+
+// WarmPool adds pre-warmed VMs to the pool.
+func (c *Client) WarmPool(ctx context.Context, req *WarmPoolRequest) (*WarmPoolResponse, error) {
+	resp := &WarmPoolResponse{}
+	return resp, c.call(ctx, "WarmPool", req, resp)
+}
+
+// DrainPool drains the VM pool.
+func (c *Client) DrainPool(ctx context.Context) (*DrainPoolResponse, error) {
+	resp := &DrainPoolResponse{}
+	return resp, c.call(ctx, "DrainPool", &DrainPoolRequest{}, resp)
+}
+
+// InspectPool returns the state of every VM in the pool.
+func (c *Client) InspectPool(ctx context.Context) ([]PoolVM, error) {
+	resp := &InspectPoolResponse{}
+	if err := c.call(ctx, "InspectPool", &InspectPoolRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.VMs, nil
+}
+
+// ListImages lists the converted images.
+func (c *Client) ListImages(ctx context.Context) ([]Image, error) {
+	resp := &ListImagesResponse{}
+	if err := c.call(ctx, "ListImages", &ListImagesRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Images, nil
+}
+
+// ConvertImage converts an image, calling onProgress, if set, as it goes.
+func (c *Client) ConvertImage(ctx context.Context, imageRef string, onProgress func(ImageProgress)) (*Image, error) {
+	stream, err := c.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/"+ServiceName+"/ConvertImage")
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.SendMsg(&ConvertImageRequest{Image: imageRef}); err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, fromStatus(err)
+	}
+
+	var image *Image
+	for {
+		var resp ConvertImageResponse
+		err := stream.RecvMsg(&resp)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fromStatus(err)
+		}
+		if resp.Progress != nil && onProgress != nil {
+			onProgress(*resp.Progress)
+		}
+		if resp.Image != nil {
+			image = resp.Image
+		}
+	}
+	if image == nil {
+		return nil, errors.New("conversion ended without an image")
+	}
+	return image, nil
+}
+
+// ListSnapshots lists the VM snapshots.
+func (c *Client) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	resp := &ListSnapshotsResponse{}
+	if err := c.call(ctx, "ListSnapshots", &ListSnapshotsRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Snapshots, nil
+}
+
+// RebuildGoldenSnapshot takes the golden snapshot again.
+func (c *Client) RebuildGoldenSnapshot(ctx context.Context) (*Snapshot, error) {
+	resp := &Snapshot{}
+	return resp, c.call(ctx, "RebuildGoldenSnapshot", &RebuildGoldenSnapshotRequest{}, resp)
+}
+
+// DeleteSnapshot deletes a snapshot and the snapshots layered on it.
+func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
+	return c.call(ctx, "DeleteSnapshot", &DeleteSnapshotRequest{Name: name}, &DeleteSnapshotResponse{})
+}
+
+// Metrics returns a snapshot of the runtime's metrics.
+func (c *Client) Metrics(ctx context.Context) (*metrics.Snapshot, error) {
+	resp := &metrics.Snapshot{}
+	return resp, c.call(ctx, "Metrics", &MetricsRequest{}, resp)
+}
+
+// fromStatus turns the status of a failed call back into the package's
+// errors, so callers can check them with errors.Is.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return &apiError{message: s.Message(), kind: ErrNotFound}
+	case codes.Unimplemented:
+		// Also what an older server answers for a method it lacks
+		return &apiError{message: s.Message(), kind: ErrUnavailable}
+	}
+	return errors.New(s.Message())
+}
+
+// apiError is an error the server returned, carrying its message.
+type apiError struct {
+	message string
+	kind    error
+}
+
+func (e *apiError) Error() string { return e.message }
+func (e *apiError) Unwrap() error { return e.kind }
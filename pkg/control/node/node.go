@@ -0,0 +1,296 @@
+// Package node serves the runtime API (pkg/control) from the components a
+// node process runs: its VM pool, image converter and snapshot manager.
+// Components the process doesn't run answer control.ErrUnavailable.
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pipeops/firecracker-cri/pkg/control"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/image"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// Runtime implements control.Runtime. Nil components are unavailable.
+type Runtime struct {
+	// RunDir is where shims keep their sandboxes' state.
+	RunDir string
+
+	Pool      *vm.Pool
+	Converter *image.FsifyConverter
+	Snapshots *vm.SnapshotManager
+
+	// Collector defaults to the global metrics collector.
+	Collector *metrics.Collector
+}
+
+var _ control.Runtime = (*Runtime)(nil)
+
+// ListSandboxes lists the sandboxes the node's shims run.
+func (r *Runtime) ListSandboxes(ctx context.Context, req *control.ListSandboxesRequest) (*control.ListSandboxesResponse, error) {
+	if r.RunDir == "" {
+		return nil, fmt.Errorf("sandboxes: %w", control.ErrUnavailable)
+	}
+	sandboxes, err := listSandboxes(r.RunDir)
+	if err != nil {
+		return nil, err
+	}
+	return &control.ListSandboxesResponse{Sandboxes: sandboxes}, nil
+}
+
+// PoolStatus returns the VM pool's status.
+func (r *Runtime) PoolStatus(ctx context.Context, req *control.PoolStatusRequest) (*control.PoolStatus, error) {
+	if r.Pool == nil {
+		return nil, fmt.Errorf("pool: %w", control.ErrUnavailable)
+	}
+	status := r.poolStatus()
+	return &status, nil
+}
+
+func (r *Runtime) poolStatus() control.PoolStatus {
+	stats := r.Pool.Stats()
+	status := control.PoolStatus{
+		Available:        stats.Available,
+		Warming:          stats.Warming,
+		Degraded:         stats.Degraded,
+		InUse:            stats.InUse,
+		MaxSize:          stats.MaxSize,
+		TotalServed:      stats.TotalServed,
+		PoolHits:         stats.PoolHits,
+		PoolMisses:       stats.PoolMisses,
+		ReclaimedMB:      stats.ReclaimedMB,
+		ReservedVCPUs:    stats.ReservedVCPUs,
+		ReservedMemoryMB: stats.ReservedMemoryMB,
+		Draining:         r.Pool.Draining(),
+	}
+	if total := stats.PoolHits + stats.PoolMisses; total > 0 {
+		status.HitRate = float64(stats.PoolHits) / float64(total) * 100
+	}
+	for _, b := range stats.Buckets {
+		status.Buckets = append(status.Buckets, control.PoolBucket{
+			Name:      b.Name,
+			VCPUs:     b.VcpuCount,
+			MemoryMB:  b.MemoryMB,
+			Available: b.Available,
+			Warming:   b.Warming,
+			Degraded:  b.Degraded,
+			InUse:     b.InUse,
+			MinSize:   b.MinSize,
+			MaxSize:   b.MaxSize,
+		})
+	}
+	return status
+}
+
+// WarmPool adds pre-warmed VMs to the pool bucket of the requested shape,
+// or to the default bucket.
+func (r *Runtime) WarmPool(ctx context.Context, req *control.WarmPoolRequest) (*control.WarmPoolResponse, error) {
+	if r.Pool == nil {
+		return nil, fmt.Errorf("pool: %w", control.ErrUnavailable)
+	}
+	if req.Count <= 0 {
+		return nil, fmt.Errorf("count must be positive")
+	}
+
+	config := domain.VMConfig{VcpuCount: req.VCPUs, MemoryMB: req.MemoryMB}
+	if config.VcpuCount == 0 && config.MemoryMB == 0 {
+		for _, b := range r.Pool.Stats().Buckets {
+			if b.Name == vm.DefaultBucketName {
+				config.VcpuCount, config.MemoryMB = b.VcpuCount, b.MemoryMB
+			}
+		}
+	}
+	if err := r.Pool.Warm(ctx, req.Count, config); err != nil {
+		return nil, err
+	}
+	return &control.WarmPoolResponse{Pool: r.poolStatus()}, nil
+}
+
+// DrainPool drains the VM pool.
+func (r *Runtime) DrainPool(ctx context.Context, req *control.DrainPoolRequest) (*control.DrainPoolResponse, error) {
+	if r.Pool == nil {
+		return nil, fmt.Errorf("pool: %w", control.ErrUnavailable)
+	}
+	report, err := r.Pool.Drain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &control.DrainPoolResponse{
+		IdleDestroyed: report.IdleDestroyed,
+		Released:      report.Released,
+		ForceKilled:   report.ForceKilled,
+		Errors:        report.Errors,
+	}, nil
+}
+
+// InspectPool returns the state of every VM in the pool.
+func (r *Runtime) InspectPool(ctx context.Context, req *control.InspectPoolRequest) (*control.InspectPoolResponse, error) {
+	if r.Pool == nil {
+		return nil, fmt.Errorf("pool: %w", control.ErrUnavailable)
+	}
+	resp := &control.InspectPoolResponse{VMs: []control.PoolVM{}}
+	for _, v := range r.Pool.Inspect() {
+		vm := control.PoolVM{
+			ID:     v.ID,
+			Bucket: v.Bucket,
+			State:  string(v.State),
+			Since:  v.Since,
+			Reason: v.Reason,
+		}
+		for _, t := range v.Transitions {
+			vm.Transitions = append(vm.Transitions, control.PoolVMTransition{
+				From:   string(t.From),
+				To:     string(t.To),
+				At:     t.At,
+				Reason: t.Reason,
+			})
+		}
+		resp.VMs = append(resp.VMs, vm)
+	}
+	return resp, nil
+}
+
+// ListImages lists the converted images.
+func (r *Runtime) ListImages(ctx context.Context, req *control.ListImagesRequest) (*control.ListImagesResponse, error) {
+	if r.Converter == nil {
+		return nil, fmt.Errorf("images: %w", control.ErrUnavailable)
+	}
+	resp := &control.ListImagesResponse{Images: []control.Image{}}
+	for _, img := range r.Converter.List() {
+		resp.Images = append(resp.Images, convertedImage(img))
+	}
+	return resp, nil
+}
+
+// ConvertImage converts an image, streaming its progress. Like a
+// conversion started on the control socket, it keeps running if the
+// client goes away.
+func (r *Runtime) ConvertImage(ctx context.Context, req *control.ConvertImageRequest, send func(*control.ConvertImageResponse) error) error {
+	if r.Converter == nil {
+		return fmt.Errorf("images: %w", control.ErrUnavailable)
+	}
+
+	// Progress arrives from the converter's goroutine; the stream is only
+	// written from this one
+	updates := make(chan image.ConversionProgress, 16)
+	type result struct {
+		img *image.ConvertedImage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		img, err := r.Converter.ConvertWithProgress(context.Background(), req.Image, func(p image.ConversionProgress) {
+			select {
+			case updates <- p:
+			default:
+			}
+		})
+		done <- result{img, err}
+	}()
+
+	clientGone := false
+	for {
+		select {
+		case p := <-updates:
+			if !clientGone {
+				clientGone = send(&control.ConvertImageResponse{Progress: imageProgress(p)}) != nil
+			}
+		case res := <-done:
+			if res.err != nil {
+				return res.err
+			}
+			img := convertedImage(res.img)
+			return send(&control.ConvertImageResponse{Image: &img})
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func convertedImage(img *image.ConvertedImage) control.Image {
+	return control.Image{
+		Reference:    img.Reference,
+		Digest:       img.Digest,
+		RootfsPath:   img.RootfsPath,
+		SquashfsPath: img.SquashfsPath,
+		SizeBytes:    img.SizeBytes,
+		Filesystem:   img.Filesystem,
+		ConvertedAt:  img.ConvertedAt,
+	}
+}
+
+func imageProgress(p image.ConversionProgress) *control.ImageProgress {
+	return &control.ImageProgress{
+		Phase:          string(p.Phase),
+		BytesPulled:    p.BytesPulled,
+		LayersTotal:    p.LayersTotal,
+		LayersUnpacked: p.LayersUnpacked,
+		BytesCopied:    p.BytesCopied,
+		BytesToCopy:    p.BytesToCopy,
+		StartedAt:      p.StartedAt,
+		UpdatedAt:      p.UpdatedAt,
+	}
+}
+
+// ListSnapshots lists the VM snapshots.
+func (r *Runtime) ListSnapshots(ctx context.Context, req *control.ListSnapshotsRequest) (*control.ListSnapshotsResponse, error) {
+	if r.Snapshots == nil {
+		return nil, fmt.Errorf("snapshots: %w", control.ErrUnavailable)
+	}
+	resp := &control.ListSnapshotsResponse{Snapshots: []control.Snapshot{}}
+	for _, snap := range r.Snapshots.ListSnapshots() {
+		resp.Snapshots = append(resp.Snapshots, snapshot(snap))
+	}
+	return resp, nil
+}
+
+// RebuildGoldenSnapshot takes the golden snapshot again.
+func (r *Runtime) RebuildGoldenSnapshot(ctx context.Context, req *control.RebuildGoldenSnapshotRequest) (*control.Snapshot, error) {
+	if r.Snapshots == nil {
+		return nil, fmt.Errorf("snapshots: %w", control.ErrUnavailable)
+	}
+	snap, err := r.Snapshots.RebuildGoldenSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := snapshot(snap)
+	return &resp, nil
+}
+
+// DeleteSnapshot deletes a snapshot and the snapshots layered on it.
+func (r *Runtime) DeleteSnapshot(ctx context.Context, req *control.DeleteSnapshotRequest) (*control.DeleteSnapshotResponse, error) {
+	if r.Snapshots == nil {
+		return nil, fmt.Errorf("snapshots: %w", control.ErrUnavailable)
+	}
+	if _, ok := r.Snapshots.GetSnapshot(req.Name); !ok {
+		return nil, fmt.Errorf("snapshot %s: %w", req.Name, control.ErrNotFound)
+	}
+	if err := r.Snapshots.DeleteSnapshot(req.Name); err != nil {
+		return nil, err
+	}
+	return &control.DeleteSnapshotResponse{}, nil
+}
+
+func snapshot(snap *vm.Snapshot) control.Snapshot {
+	return control.Snapshot{
+		Name:      snap.Name,
+		Type:      snap.Type,
+		Parent:    snap.Parent,
+		IsGolden:  snap.IsGolden,
+		SizeBytes: snap.SizeBytes,
+		CreatedAt: snap.CreatedAt,
+	}
+}
+
+// Metrics returns a snapshot of the runtime's metrics.
+func (r *Runtime) Metrics(ctx context.Context, req *control.MetricsRequest) (*metrics.Snapshot, error) {
+	collector := r.Collector
+	if collector == nil {
+		collector = metrics.Global()
+	}
+	snap := collector.GetSnapshot()
+	return &snap, nil
+}
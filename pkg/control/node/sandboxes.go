@@ -0,0 +1,74 @@
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/control"
+)
+
+// sandboxState is the part of a shim's state file (pkg/shim/state.go)
+// that describes its sandbox.
+type sandboxState struct {
+	ShimID    string `json:"shim_id"`
+	Namespace string `json:"namespace"`
+	Sandbox   struct {
+		ID       string `json:"id"`
+		PID      int    `json:"pid"`
+		FromPool bool   `json:"from_pool"`
+		VMConfig struct {
+			VcpuCount int64 `json:"VcpuCount"`
+			MemoryMB  int64 `json:"MemoryMB"`
+		} `json:"vm_config"`
+		IPs       []string                `json:"ips"`
+		Network   *control.SandboxNetwork `json:"network"`
+		CreatedAt time.Time               `json:"created_at"`
+		StartedAt time.Time               `json:"started_at"`
+	} `json:"sandbox"`
+}
+
+// listSandboxes reads the sandboxes shims have recorded in runDir, newest
+// first.
+func listSandboxes(runDir string) ([]control.Sandbox, error) {
+	paths, err := filepath.Glob(filepath.Join(runDir, "*", "state.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxes := []control.Sandbox{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state sandboxState
+		if err := json.Unmarshal(data, &state); err != nil || state.Sandbox.ID == "" {
+			continue
+		}
+		sb := state.Sandbox
+		if sb.Network != nil {
+			sb.Network.IPs = sb.IPs
+		}
+		sandboxes = append(sandboxes, control.Sandbox{
+			ID:        sb.ID,
+			ShimID:    state.ShimID,
+			Namespace: state.Namespace,
+			PID:       sb.PID,
+			Running:   sb.PID > 0 && syscall.Kill(sb.PID, 0) == nil,
+			VCPUs:     sb.VMConfig.VcpuCount,
+			MemoryMB:  sb.VMConfig.MemoryMB,
+			FromPool:  sb.FromPool,
+			CreatedAt: sb.CreatedAt,
+			StartedAt: sb.StartedAt,
+			Network:   sb.Network,
+		})
+	}
+	sort.Slice(sandboxes, func(i, j int) bool {
+		return sandboxes[i].CreatedAt.After(sandboxes[j].CreatedAt)
+	})
+	return sandboxes, nil
+}
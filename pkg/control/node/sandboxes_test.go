@@ -0,0 +1,49 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListSandboxes(t *testing.T) {
+	runDir := t.TempDir()
+	write := func(dir, state string) {
+		if err := os.MkdirAll(filepath.Join(runDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(runDir, dir, "state.json"), []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old", `{"shim_id":"shim-1","namespace":"k8s.io","sandbox":{"id":"old","pid":`+strconv.Itoa(os.Getpid())+`,
+		"vm_config":{"VcpuCount":2,"MemoryMB":512},"from_pool":true,"created_at":"2026-01-01T00:00:00Z"}}`)
+	write("new", `{"sandbox":{"id":"new","pid":0,"created_at":"2026-02-01T00:00:00Z","ips":["10.88.0.5/16"],
+		"network":{"netns":"/run/netns/fc-new","ifname":"eth0","tap":"tap0","veth_peer":"veth1a2b3c4d","guest_mac":"02:fc:01:02:03:04"}}}`)
+	write("broken", `{`)
+	if err := os.MkdirAll(filepath.Join(runDir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sandboxes, err := listSandboxes(runDir)
+	if err != nil {
+		t.Fatalf("listSandboxes() error = %v", err)
+	}
+	if len(sandboxes) != 2 || sandboxes[0].ID != "new" || sandboxes[1].ID != "old" {
+		t.Fatalf("listSandboxes() = %+v, want new then old", sandboxes)
+	}
+	old := sandboxes[1]
+	if !old.Running || old.VCPUs != 2 || old.MemoryMB != 512 || !old.FromPool || old.ShimID != "shim-1" {
+		t.Errorf("old sandbox = %+v", old)
+	}
+	if sandboxes[0].Running {
+		t.Error("sandbox without a PID reported running")
+	}
+	if n := sandboxes[0].Network; n == nil || n.VethPeer != "veth1a2b3c4d" || n.Tap != "tap0" || len(n.IPs) != 1 || n.IPs[0] != "10.88.0.5/16" {
+		t.Errorf("new sandbox network = %+v", n)
+	}
+	if old.Network != nil {
+		t.Errorf("sandbox without a network namespace has network %+v", old.Network)
+	}
+}
@@ -0,0 +1,169 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+	apiVersion = version()
+}
+
+// jsonCodec encodes API messages as JSON. Clients select it with the
+// "json" content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+// unaryMethods are the API's request/response methods.
+var unaryMethods = []grpc.MethodDesc{
+	unary("Version", func(Runtime, context.Context, *VersionRequest) (*VersionResponse, error) {
+		return apiVersion, nil
+	}),
+	unary("ListSandboxes", Runtime.ListSandboxes),
+	unary("PoolStatus", Runtime.PoolStatus),
+	unary("WarmPool", Runtime.WarmPool),
+	unary("DrainPool", Runtime.DrainPool),
+	unary("InspectPool", Runtime.InspectPool),
+	unary("ListImages", Runtime.ListImages),
+	unary("ListSnapshots", Runtime.ListSnapshots),
+	unary("RebuildGoldenSnapshot", Runtime.RebuildGoldenSnapshot),
+	unary("DeleteSnapshot", Runtime.DeleteSnapshot),
+	unary("Metrics", Runtime.Metrics),
+}
+
+// streamMethods are the API's streaming methods.
+var streamMethods = []grpc.StreamDesc{
+	{StreamName: "ConvertImage", Handler: serveConvertImage, ServerStreams: true},
+}
+
+// apiVersion is the Version method's answer.
+var apiVersion *VersionResponse
+
+// version describes the API this package serves.
+func version() *VersionResponse {
+	resp := &VersionResponse{APIVersion: APIVersion}
+	for _, m := range unaryMethods {
+		resp.Methods = append(resp.Methods, m.MethodName)
+	}
+	for _, s := range streamMethods {
+		resp.Methods = append(resp.Methods, s.StreamName)
+	}
+	return resp
+}
+
+// Register serves runtime's API on server.
+func Register(server *grpc.Server, runtime Runtime) {
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*Runtime)(nil),
+		Methods:     unaryMethods,
+		Streams:     streamMethods,
+	}, runtime)
+}
+
+// Serve serves runtime's API on socketPath, accessible only to root, until
+// ctx is done.
+func Serve(ctx context.Context, socketPath string, runtime Runtime, log *logrus.Entry) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create socket dir: %w", err)
+	}
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict %s: %w", socketPath, err)
+	}
+
+	server := grpc.NewServer()
+	Register(server, runtime)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	log.WithFields(logrus.Fields{
+		"component":   "control",
+		"socket":      socketPath,
+		"api_version": APIVersion,
+	}).Info("Serving runtime API")
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
+
+// unary describes an API method served by a Runtime method.
+func unary[Req, Resp any](name string, call func(Runtime, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	fullMethod := "/" + ServiceName + "/" + name
+	handler := func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handle := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := call(srv.(Runtime), ctx, req.(*Req))
+			if err != nil {
+				return nil, toStatus(err)
+			}
+			return resp, nil
+		}
+		if interceptor == nil {
+			return handle(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handle)
+	}
+	return grpc.MethodDesc{MethodName: name, Handler: handler}
+}
+
+// serveConvertImage streams a conversion's progress and result.
+func serveConvertImage(srv interface{}, stream grpc.ServerStream) error {
+	var req ConvertImageRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	if req.Image == "" {
+		return status.Error(codes.InvalidArgument, "image is required")
+	}
+	err := srv.(Runtime).ConvertImage(stream.Context(), &req, func(resp *ConvertImageResponse) error {
+		return stream.SendMsg(resp)
+	})
+	return toStatus(err)
+}
+
+// toStatus gives an error returned by a Runtime its gRPC status code.
+func toStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrUnavailable):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
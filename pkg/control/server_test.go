@@ -0,0 +1,149 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeRuntime serves a pool and image conversions; it has no snapshots.
+type fakeRuntime struct {
+	warmed int
+}
+
+func (f *fakeRuntime) ListSandboxes(ctx context.Context, req *ListSandboxesRequest) (*ListSandboxesResponse, error) {
+	return &ListSandboxesResponse{Sandboxes: []Sandbox{{ID: "sb-1", Running: true, VCPUs: 2}}}, nil
+}
+
+func (f *fakeRuntime) PoolStatus(ctx context.Context, req *PoolStatusRequest) (*PoolStatus, error) {
+	return &PoolStatus{Available: f.warmed, MaxSize: 10}, nil
+}
+
+func (f *fakeRuntime) WarmPool(ctx context.Context, req *WarmPoolRequest) (*WarmPoolResponse, error) {
+	f.warmed += req.Count
+	return &WarmPoolResponse{Pool: PoolStatus{Available: f.warmed, MaxSize: 10}}, nil
+}
+
+func (f *fakeRuntime) DrainPool(ctx context.Context, req *DrainPoolRequest) (*DrainPoolResponse, error) {
+	drained := f.warmed
+	f.warmed = 0
+	return &DrainPoolResponse{IdleDestroyed: drained}, nil
+}
+
+func (f *fakeRuntime) InspectPool(ctx context.Context, req *InspectPoolRequest) (*InspectPoolResponse, error) {
+	resp := &InspectPoolResponse{VMs: []PoolVM{}}
+	for i := 0; i < f.warmed; i++ {
+		resp.VMs = append(resp.VMs, PoolVM{ID: fmt.Sprintf("warm-%d", i), Bucket: "default", State: "ready"})
+	}
+	return resp, nil
+}
+
+func (f *fakeRuntime) ListImages(ctx context.Context, req *ListImagesRequest) (*ListImagesResponse, error) {
+	return &ListImagesResponse{}, nil
+}
+
+func (f *fakeRuntime) ConvertImage(ctx context.Context, req *ConvertImageRequest, send func(*ConvertImageResponse) error) error {
+	if req.Image == "missing:latest" {
+		return ErrNotFound
+	}
+	for _, phase := range []string{"pull", "unpack"} {
+		if err := send(&ConvertImageResponse{Progress: &ImageProgress{Phase: phase}}); err != nil {
+			return err
+		}
+	}
+	return send(&ConvertImageResponse{Image: &Image{Reference: req.Image, Filesystem: "ext4"}})
+}
+
+func (f *fakeRuntime) ListSnapshots(ctx context.Context, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	return nil, ErrUnavailable
+}
+
+func (f *fakeRuntime) RebuildGoldenSnapshot(ctx context.Context, req *RebuildGoldenSnapshotRequest) (*Snapshot, error) {
+	return nil, ErrUnavailable
+}
+
+func (f *fakeRuntime) DeleteSnapshot(ctx context.Context, req *DeleteSnapshotRequest) (*DeleteSnapshotResponse, error) {
+	return nil, ErrUnavailable
+}
+
+func (f *fakeRuntime) Metrics(ctx context.Context, req *MetricsRequest) (*metrics.Snapshot, error) {
+	return &metrics.Snapshot{PoolAvailable: int64(f.warmed)}, nil
+}
+
+func TestServeAndClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, socket, &fakeRuntime{}, logrus.NewEntry(logrus.New()))
+	}()
+
+	callCtx, callCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer callCancel()
+	client, err := Dial(callCtx, socket)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	// The server may still be starting
+	var version *VersionResponse
+	for {
+		if version, err = client.Version(callCtx); err == nil || callCtx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || version.APIVersion != APIVersion || len(version.Methods) != len(unaryMethods)+len(streamMethods) {
+		t.Fatalf("Version() = %+v, %v", version, err)
+	}
+
+	if _, err := client.WarmPool(callCtx, &WarmPoolRequest{Count: 3}); err != nil {
+		t.Fatalf("WarmPool() error = %v", err)
+	}
+	status, err := client.PoolStatus(callCtx)
+	if err != nil || status.Available != 3 {
+		t.Errorf("PoolStatus() = %+v, %v, want 3 available", status, err)
+	}
+	vms, err := client.InspectPool(callCtx)
+	if err != nil || len(vms) != 3 || vms[0].State != "ready" {
+		t.Errorf("InspectPool() = %+v, %v, want 3 ready VMs", vms, err)
+	}
+	drained, err := client.DrainPool(callCtx)
+	if err != nil || drained.IdleDestroyed != 3 {
+		t.Errorf("DrainPool() = %+v, %v, want 3 destroyed", drained, err)
+	}
+
+	sandboxes, err := client.ListSandboxes(callCtx)
+	if err != nil || len(sandboxes) != 1 || sandboxes[0].ID != "sb-1" {
+		t.Errorf("ListSandboxes() = %+v, %v", sandboxes, err)
+	}
+
+	var phases []string
+	img, err := client.ConvertImage(callCtx, "nginx:latest", func(p ImageProgress) {
+		phases = append(phases, p.Phase)
+	})
+	if err != nil || img.Reference != "nginx:latest" || len(phases) != 2 {
+		t.Errorf("ConvertImage() = %+v, %v with progress %v", img, err, phases)
+	}
+	if _, err := client.ConvertImage(callCtx, "missing:latest", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ConvertImage() of a missing image error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := client.ListSnapshots(callCtx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("ListSnapshots() error = %v, want ErrUnavailable", err)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+}
@@ -84,14 +84,24 @@ type Sandbox struct {
 	VsockPath string   // Unix socket for vsock
 	VsockCID  uint32   // Guest context ID
 	AgentConn net.Conn // Connection to guest agent
+	AgentKey  []byte   // Key connections to the guest agent authenticate with; nil if none
 
 	// Networking
 	NetworkNamespace string
-	IP               net.IP
+	IP               net.IP // Primary address, in the cluster's IP family
+	Netmask          net.IPMask
+	IPs              []*net.IPNet // Every address of the CNI result, the primary first
 	Gateway          net.IP
+	Routes           []Route       // Every route of the CNI result, default route included
+	DNS              []net.IP      // Nameservers of the CNI result
+	DNSSearch        []string      // Search domains of the CNI result, then the pod's
+	PortMappings     []PortMapping // Host ports forwarded to the sandbox's addresses
+	Attachment       NetworkAttachment
+	Networks         []AdditionalNetwork // Networks besides the primary one, from the pod's annotations
 
 	// Storage
 	RootfsPath string // Path to rootfs block device
+	Dir        string // Sandbox directory, in the runtime dir class VMConfig names
 
 	// Containers within this sandbox
 	Containers map[string]*Container
@@ -102,8 +112,13 @@ type Sandbox struct {
 	FinishedAt time.Time
 
 	// Metadata for pool management
-	PooledAt time.Time // When this VM was added to pool (if pre-warmed)
-	FromPool bool      // Whether this sandbox came from the pool
+	PooledAt   time.Time // When this VM was added to pool (if pre-warmed)
+	FromPool   bool      // Whether this sandbox came from the pool
+	Recovered  bool      // Whether this sandbox was re-adopted after a shim restart
+	Generation string    // Kernel, rootfs and boot config version the VM booted with
+	ReuseCount int       // Times the VM was returned to the pool for another workload
+	UsedBy     []string  // Namespaces of the workloads that have run in this VM
+	Resized    bool      // Whether the VM was sized down from its boot shape for its workload
 }
 
 // NewSandbox creates a new sandbox with the given ID.
@@ -195,9 +210,10 @@ func NewContainer(id string) *Container {
 // This is a value object - immutable once created.
 type VMConfig struct {
 	// Compute
-	VcpuCount  int64
-	MemoryMB   int64
-	SMTEnabled bool
+	VcpuCount   int64
+	MemoryMB    int64
+	SMTEnabled  bool
+	CPUTemplate string // Static ("T2", "T2S", "C3", ...) or custom template name; empty for none
 
 	// Boot
 	KernelPath string
@@ -208,16 +224,33 @@ type VMConfig struct {
 	RootDrive DriveConfig
 
 	// Network
-	NetworkMode string // "cni" or "none"
-	CNIConfig   *CNIConfig
+	NetworkMode  string // "cni" or "none"
+	CNIConfig    *CNIConfig
+	NetRateLimit *NetRateLimit // nil leaves traffic unlimited
+	PortMappings []PortMapping // Host ports forwarded to the VM, as a pod's hostPorts
 
 	// Vsock
 	VsockEnabled bool
 	VsockCID     uint32
 
+	// Metadata service
+	MMDS *MMDSConfig // nil disables MMDS
+
+	// Balloon attaches a memory balloon, so the memory the guest may use
+	// can be lowered while it runs
+	Balloon bool
+
 	// Advanced
 	JailerEnabled bool
 	JailerConfig  *JailerConfig
+
+	// RuntimeDirClass names the runtime directory class the sandbox's
+	// directory is created in; empty for the runtime directory itself
+	RuntimeDirClass string
+
+	// Pool placement
+	Namespace       string   // Namespace of the workload, recorded on the VM
+	AvoidNamespaces []string // Never reuse a VM used by these namespaces; "*" for any other
 }
 
 // DefaultVMConfig returns a minimal VM configuration.
@@ -232,6 +265,81 @@ func DefaultVMConfig() VMConfig {
 	}
 }
 
+// NetRateLimit limits a VM's network traffic. It applies to each of the
+// VM's network interfaces.
+type NetRateLimit struct {
+	RX TrafficLimit // Traffic received by the guest
+	TX TrafficLimit // Traffic sent by the guest
+}
+
+// TrafficLimit limits one direction of traffic. Zero fields are unlimited.
+type TrafficLimit struct {
+	BytesPerSec   int64
+	PacketsPerSec int64
+}
+
+// IsZero reports whether the limit leaves traffic unlimited.
+func (l TrafficLimit) IsZero() bool {
+	return l.BytesPerSec <= 0 && l.PacketsPerSec <= 0
+}
+
+// NetworkAttachment is how a sandbox is attached to the node's network, for
+// policy agents chained with the runtime's CNI network to tell which pod a
+// tap or veth belongs to. Its NetNS is empty for sandboxes without one.
+type NetworkAttachment struct {
+	NetNS    string // Sandbox network namespace
+	IfName   string // Interface CNI configured in NetNS
+	IfMAC    string // MAC of IfName
+	TapName  string // Tap in NetNS the VM is attached to
+	VethPeer string // Host-side peer of IfName, if it is a veth
+	GuestMAC string // MAC of the guest's interface
+}
+
+// AdditionalNetwork is a network a sandbox is attached to besides its
+// primary one, through a tap of its own and a further interface in the
+// guest, eth1 for the first.
+type AdditionalNetwork struct {
+	Name     string       // CNI network
+	IfName   string       // Interface CNI configured in the sandbox's network namespace
+	TapName  string       // Tap in the namespace the VM is attached to
+	GuestMAC string       // MAC of the guest's interface
+	IPs      []*net.IPNet // Addresses of the CNI result
+	Routes   []Route      // Routes of the CNI result, without default routes
+}
+
+// PortMapping forwards a port of the node to a port of the sandbox, like
+// a CRI port mapping.
+type PortMapping struct {
+	Protocol      string // "tcp", "udp" or "sctp"; empty for tcp
+	HostPort      int
+	ContainerPort int
+	HostIP        string // Only forward connections to this node address; empty for any
+}
+
+// MMDSConfig exposes Firecracker's metadata service (MMDS) to the guest
+// through a network interface dedicated to it.
+type MMDSConfig struct {
+	Version   string // "V1" or "V2" (session tokens); defaults to V2
+	Address   string // IPv4 address the guest reaches MMDS at; defaults to 169.254.169.254
+	TapDevice string // Host tap device for the interface; one is created per VM if empty
+}
+
+// InstanceMetadata is the document a guest reads from MMDS.
+type InstanceMetadata struct {
+	SandboxID string            `json:"sandbox_id"`
+	Pod       PodMetadata       `json:"pod"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// PodMetadata identifies the pod a VM runs.
+type PodMetadata struct {
+	Name        string            `json:"name,omitempty"`
+	Namespace   string            `json:"namespace,omitempty"`
+	UID         string            `json:"uid,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
 // DriveConfig represents a block device configuration.
 type DriveConfig struct {
 	DriveID    string
@@ -248,6 +356,30 @@ type CNIConfig struct {
 	BinDir      string
 	ConfDir     string
 	CacheDir    string
+
+	// Routes and DNSSearch are added to what the network gives the sandbox,
+	// from the pod's annotations.
+	Routes    []Route
+	DNSSearch []string
+
+	// Networks are further CNI networks the sandbox is attached to, in the
+	// order of their guest interfaces.
+	Networks []string
+}
+
+// Route is a route from a CNI result. A nil GW reaches Dst directly on the
+// interface.
+type Route struct {
+	Dst *net.IPNet
+	GW  net.IP
+}
+
+// String formats the route like "10.96.0.0/12 via 10.88.0.1".
+func (r Route) String() string {
+	if r.GW == nil {
+		return r.Dst.String()
+	}
+	return r.Dst.String() + " via " + r.GW.String()
 }
 
 // JailerConfig holds jailer configuration for privilege isolation.
@@ -320,12 +452,45 @@ type VMPool interface {
 
 // PoolStats contains VM pool statistics.
 type PoolStats struct {
-	Available   int
+	Available   int // Ready VMs, the only ones handed out
+	Warming     int // VMs being readied for the pool
+	Degraded    int // VMs that failed a health check
 	InUse       int
 	MaxSize     int
 	TotalServed int64
 	PoolHits    int64
 	PoolMisses  int64
+	ReclaimedMB int64 // Memory ballooned out of idle VMs
+	Buckets     []PoolBucketStats
+
+	// Resources the idle VMs hold on the node without any pod accounting
+	// for them. Reserved memory leaves out what balloons reclaimed.
+	ReservedVCPUs    int64
+	ReservedMemoryMB int64
+
+	// ReplenishBacklog is how many VMs the buckets are short of their
+	// minimum sizes.
+	ReplenishBacklog int
+}
+
+// PoolBucketStats contains the statistics of a VM pool bucket, which keeps
+// VMs of one shape warm.
+type PoolBucketStats struct {
+	Name      string
+	VcpuCount int64
+	MemoryMB  int64
+	Available int
+	Warming   int
+	Degraded  int
+	InUse     int
+	MinSize   int
+	MaxSize   int
+	Hits      int64
+	Misses    int64
+
+	// ReclaimedMB is the memory the balloons of the bucket's idle VMs
+	// hold back from them.
+	ReclaimedMB int64
 }
 
 // AgentClient defines the interface for communicating with the guest agent.
@@ -353,6 +518,21 @@ type AgentClient interface {
 
 	// GetContainerStats retrieves container resource usage.
 	GetContainerStats(ctx context.Context, containerID string) (*ContainerStats, error)
+
+	// GetPodStats retrieves the resource usage of every running container
+	// and of the whole guest.
+	GetPodStats(ctx context.Context) (*PodStats, error)
+
+	// GetContainerStatus reports whether a container has exited and how.
+	GetContainerStatus(ctx context.Context, containerID string) (*ContainerStatus, error)
+
+	// SetTimezone sets the timezone of the guest, or of one container if
+	// containerID is set.
+	SetTimezone(ctx context.Context, containerID, name string, tzdata []byte) error
+
+	// InstallCABundle replaces the CA certificate bundle of the guest, or of
+	// one container if containerID is set.
+	InstallCABundle(ctx context.Context, containerID string, bundle []byte) error
 }
 
 // ContainerSpec is the specification for creating a container.
@@ -363,6 +543,10 @@ type ContainerSpec struct {
 	Stdout     bool
 	Stderr     bool
 	Terminal   bool
+
+	// SecretEnv are NAME=value environment variables the agent adds to
+	// the container's process without writing them to the guest.
+	SecretEnv []string
 }
 
 // ExecResult holds the result of a synchronous exec.
@@ -372,12 +556,72 @@ type ExecResult struct {
 	Stderr   []byte
 }
 
-// ContainerStats holds container resource usage statistics.
+// ContainerStatus is the run state of a container inside the VM.
+type ContainerStatus struct {
+	Status    string // created, running or stopped
+	PID       int
+	Exited    bool
+	ExitCode  int
+	OOMKilled bool
+	ExitedAt  time.Time
+}
+
+// ContainerStats holds container resource usage statistics, as accounted by
+// the container's cgroup in the guest. Limits are 0 when unlimited.
 type ContainerStats struct {
-	CPUUsage    uint64 // nanoseconds
-	MemoryUsage uint64 // bytes
-	ReadBytes   uint64
-	WriteBytes  uint64
+	CPUUsage            uint64 // nanoseconds
+	CPUUser             uint64 // nanoseconds
+	CPUSystem           uint64 // nanoseconds
+	CPUPeriods          uint64
+	CPUThrottledPeriods uint64
+	CPUThrottled        uint64 // nanoseconds
+
+	MemoryUsage        uint64 // bytes
+	MemoryLimit        uint64 // bytes
+	MemoryAnon         uint64 // bytes
+	MemoryFile         uint64 // bytes
+	MemoryInactiveFile uint64 // bytes
+	PageFaults         uint64
+	MajorPageFaults    uint64
+	OOMEvents          uint64
+	OOMKills           uint64
+
+	ReadBytes  uint64
+	WriteBytes uint64
+	Pids       uint64
+	PidsLimit  uint64
+}
+
+// Add adds the usage of another container. Limits are not added.
+func (s *ContainerStats) Add(other *ContainerStats) {
+	s.CPUUsage += other.CPUUsage
+	s.CPUUser += other.CPUUser
+	s.CPUSystem += other.CPUSystem
+	s.CPUPeriods += other.CPUPeriods
+	s.CPUThrottledPeriods += other.CPUThrottledPeriods
+	s.CPUThrottled += other.CPUThrottled
+	s.MemoryUsage += other.MemoryUsage
+	s.MemoryAnon += other.MemoryAnon
+	s.MemoryFile += other.MemoryFile
+	s.MemoryInactiveFile += other.MemoryInactiveFile
+	s.PageFaults += other.PageFaults
+	s.MajorPageFaults += other.MajorPageFaults
+	s.OOMEvents += other.OOMEvents
+	s.OOMKills += other.OOMKills
+	s.ReadBytes += other.ReadBytes
+	s.WriteBytes += other.WriteBytes
+	s.Pids += other.Pids
+}
+
+// PodStats holds the resource usage of the containers in a VM, as accounted
+// by their cgroups in the guest.
+type PodStats struct {
+	Containers map[string]*ContainerStats
+
+	// Memory used and available in the guest as a whole, including its
+	// kernel and the agent
+	GuestMemoryUsage uint64
+	GuestMemoryTotal uint64
 }
 
 // ImageService defines the interface for managing container images.
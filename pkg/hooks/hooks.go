@@ -0,0 +1,312 @@
+// Package hooks runs operator-defined hooks at sandbox lifecycle events.
+//
+// Hooks are defined one per file in a hooks directory:
+//
+//	/etc/fc-cri/hooks.d/
+//	  10-cmdb.json    {"events": ["create", "destroy"], "url": "https://cmdb.internal/sandboxes"}
+//	  20-ids.json     {"events": ["start"], "exec": "/usr/local/bin/notify-ids", "timeout": "2s"}
+//
+// A hook either executes a program, which gets the event payload as JSON on
+// stdin, or POSTs the payload to a webhook. Hooks for an event run one at a
+// time, in file name order.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Lifecycle events hooks can subscribe to.
+const (
+	EventCreate  = "create"
+	EventStart   = "start"
+	EventStop    = "stop"
+	EventDestroy = "destroy"
+)
+
+// maxOutput bounds the hook output kept for error messages.
+const maxOutput = 4096
+
+// Config configures the hook runner.
+type Config struct {
+	// Dir holds one JSON file per hook.
+	Dir string
+
+	// DefaultTimeout bounds hooks that don't set a timeout.
+	DefaultTimeout time.Duration
+}
+
+// DefaultConfig returns the default hook configuration.
+func DefaultConfig() Config {
+	return Config{
+		Dir:            "/etc/fc-cri/hooks.d",
+		DefaultTimeout: 10 * time.Second,
+	}
+}
+
+// Hook is a hook definition.
+type Hook struct {
+	// Name is the hook's file name without its extension.
+	Name string `json:"-"`
+
+	// Events the hook runs at.
+	Events []string `json:"events"`
+
+	// Exec is the absolute path of a program to run, with Args.
+	Exec string   `json:"exec,omitempty"`
+	Args []string `json:"args,omitempty"`
+
+	// URL is a webhook the payload is POSTed to, with extra Headers.
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Timeout bounds a single run, e.g. "5s".
+	Timeout string `json:"timeout,omitempty"`
+
+	// Required hooks abort sandbox creation and start when they fail.
+	// Failures of other hooks, and of any hook at stop or destroy, are only
+	// logged.
+	Required bool `json:"required,omitempty"`
+
+	timeout time.Duration
+}
+
+// Pod identifies the pod a sandbox belongs to.
+type Pod struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// Payload describes a lifecycle event.
+type Payload struct {
+	Event       string            `json:"event"`
+	Time        time.Time         `json:"time"`
+	SandboxID   string            `json:"sandbox_id"`
+	ContainerID string            `json:"container_id,omitempty"`
+	Pod         Pod               `json:"pod"`
+	PID         int               `json:"pid,omitempty"`
+	ExitStatus  *int              `json:"exit_status,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Runner runs the hooks subscribed to lifecycle events. A nil Runner runs
+// nothing.
+type Runner struct {
+	hooks  []*Hook
+	client *http.Client
+	log    *logrus.Entry
+}
+
+// Load reads the hook definitions from the configured directory. A missing
+// directory means no hooks.
+func Load(config Config, log *logrus.Entry) (*Runner, error) {
+	r := &Runner{
+		client: &http.Client{},
+		log:    log.WithField("component", "hooks"),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.Dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hooks: %w", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		hook, err := loadHook(path, config.DefaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+		r.hooks = append(r.hooks, hook)
+	}
+
+	if len(r.hooks) > 0 {
+		r.log.WithField("count", len(r.hooks)).Info("Loaded lifecycle hooks")
+	}
+	return r, nil
+}
+
+// loadHook reads and validates one hook definition.
+func loadHook(path string, defaultTimeout time.Duration) (*Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook: %w", err)
+	}
+
+	hook := &Hook{}
+	if err := json.Unmarshal(data, hook); err != nil {
+		return nil, fmt.Errorf("failed to parse hook %s: %w", path, err)
+	}
+	hook.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	hook.timeout = defaultTimeout
+	if hook.Timeout != "" {
+		if hook.timeout, err = time.ParseDuration(hook.Timeout); err != nil || hook.timeout <= 0 {
+			return nil, fmt.Errorf("hook %s: invalid timeout %q", hook.Name, hook.Timeout)
+		}
+	}
+	if err := hook.validate(); err != nil {
+		return nil, fmt.Errorf("hook %s: %w", hook.Name, err)
+	}
+	return hook, nil
+}
+
+// validate checks a hook definition.
+func (h *Hook) validate() error {
+	if (h.Exec == "") == (h.URL == "") {
+		return fmt.Errorf("exactly one of exec and url must be set")
+	}
+	if h.Exec != "" && !filepath.IsAbs(h.Exec) {
+		return fmt.Errorf("exec must be an absolute path: %s", h.Exec)
+	}
+	if h.URL != "" && !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+		return fmt.Errorf("url must be http or https: %s", h.URL)
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("no events")
+	}
+	for _, event := range h.Events {
+		switch event {
+		case EventCreate, EventStart, EventStop, EventDestroy:
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// subscribes reports whether the hook runs at an event.
+func (h *Hook) subscribes(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Hooks returns the loaded hook definitions.
+func (r *Runner) Hooks() []*Hook {
+	if r == nil {
+		return nil
+	}
+	return r.hooks
+}
+
+// Run runs every hook subscribed to the payload's event. It returns the
+// failures of required hooks at create and start; everything else is only
+// logged.
+func (r *Runner) Run(ctx context.Context, payload Payload) error {
+	if r == nil {
+		return nil
+	}
+	if payload.Time.IsZero() {
+		payload.Time = time.Now()
+	}
+
+	var errs []error
+	for _, hook := range r.hooks {
+		if !hook.subscribes(payload.Event) {
+			continue
+		}
+
+		log := r.log.WithFields(logrus.Fields{
+			"hook":       hook.Name,
+			"event":      payload.Event,
+			"sandbox_id": payload.SandboxID,
+		})
+		start := time.Now()
+		err := r.run(ctx, hook, payload)
+		if err == nil {
+			log.WithField("duration", time.Since(start)).Debug("Hook succeeded")
+			continue
+		}
+
+		blocking := hook.Required && (payload.Event == EventCreate || payload.Event == EventStart)
+		if blocking {
+			errs = append(errs, fmt.Errorf("hook %s: %w", hook.Name, err))
+		}
+		log.WithError(err).WithField("required", blocking).Warn("Hook failed")
+	}
+	return errors.Join(errs...)
+}
+
+// run runs a single hook.
+func (r *Runner) run(ctx context.Context, hook *Hook, payload Payload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+	defer cancel()
+
+	if hook.Exec != "" {
+		return runExec(ctx, hook, payload, data)
+	}
+	return r.post(ctx, hook, data)
+}
+
+// runExec runs an exec hook with the payload on stdin.
+func runExec(ctx context.Context, hook *Hook, payload Payload, data []byte) error {
+	cmd := exec.CommandContext(ctx, hook.Exec, hook.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"FC_CRI_HOOK_EVENT="+payload.Event,
+		"FC_CRI_SANDBOX_ID="+payload.SandboxID,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", hook.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, truncate(output))
+	}
+	return nil
+}
+
+// post sends the payload to a webhook. Any 2xx response is success.
+func (r *Runner) post(ctx context.Context, hook *Hook, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range hook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxOutput))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, truncate(body))
+	}
+	return nil
+}
+
+// truncate trims hook output for error messages.
+func truncate(output []byte) string {
+	if len(output) > maxOutput {
+		output = output[:maxOutput]
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,169 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeHook(t *testing.T, dir, name, definition string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(definition), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTestRunner(t *testing.T, dir string) *Runner {
+	t.Helper()
+	config := DefaultConfig()
+	config.Dir = dir
+	r, err := Load(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return r
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeHook(t, dir, "20-ids", `{"events": ["start"], "exec": "/bin/true", "timeout": "2s"}`)
+	writeHook(t, dir, "10-cmdb", `{"events": ["create", "destroy"], "url": "https://cmdb.example.com/sandboxes"}`)
+
+	r := loadTestRunner(t, dir)
+	hooks := r.Hooks()
+	if len(hooks) != 2 || hooks[0].Name != "10-cmdb" || hooks[1].Name != "20-ids" {
+		t.Fatalf("Hooks() = %+v", hooks)
+	}
+	if hooks[0].timeout != DefaultConfig().DefaultTimeout || hooks[1].timeout != 2*time.Second {
+		t.Errorf("timeouts = %s, %s", hooks[0].timeout, hooks[1].timeout)
+	}
+
+	// No directory, no hooks
+	if r := loadTestRunner(t, filepath.Join(dir, "missing")); len(r.Hooks()) != 0 {
+		t.Errorf("Hooks() = %+v, want none", r.Hooks())
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	invalid := map[string]string{
+		"both":        `{"events": ["start"], "exec": "/bin/true", "url": "https://example.com"}`,
+		"neither":     `{"events": ["start"]}`,
+		"relative":    `{"events": ["start"], "exec": "true"}`,
+		"scheme":      `{"events": ["start"], "url": "file:///etc/passwd"}`,
+		"no-events":   `{"exec": "/bin/true"}`,
+		"bad-event":   `{"events": ["reboot"], "exec": "/bin/true"}`,
+		"bad-timeout": `{"events": ["start"], "exec": "/bin/true", "timeout": "soon"}`,
+		"not-json":    `events: [start]`,
+	}
+
+	for name, definition := range invalid {
+		dir := t.TempDir()
+		writeHook(t, dir, name, definition)
+		config := DefaultConfig()
+		config.Dir = dir
+		if _, err := Load(config, logrus.NewEntry(logrus.New())); err == nil {
+			t.Errorf("Load() accepted %s", name)
+		}
+	}
+}
+
+func TestRun_Webhook(t *testing.T) {
+	var received []Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var p Payload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		received = append(received, p)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeHook(t, dir, "cmdb", `{"events": ["create"], "url": "`+server.URL+`", "headers": {"Authorization": "Bearer secret"}}`)
+	r := loadTestRunner(t, dir)
+
+	err := r.Run(context.Background(), Payload{Event: EventCreate, SandboxID: "fc-1", Pod: Pod{Name: "web-0", Namespace: "shop"}})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(received) != 1 || received[0].SandboxID != "fc-1" || received[0].Pod.Name != "web-0" || received[0].Time.IsZero() {
+		t.Errorf("received %+v", received)
+	}
+
+	// Hooks only run at the events they subscribe to
+	if err := r.Run(context.Background(), Payload{Event: EventStart, SandboxID: "fc-1"}); err != nil || len(received) != 1 {
+		t.Errorf("Run(start) = %v after %d deliveries", err, len(received))
+	}
+}
+
+func TestRun_Exec(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$FC_CRI_HOOK_EVENT\" > "+out+"\ncat >> "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeHook(t, dir, "exec", `{"events": ["stop"], "exec": "`+script+`"}`)
+	r := loadTestRunner(t, dir)
+
+	status := 137
+	if err := r.Run(context.Background(), Payload{Event: EventStop, SandboxID: "fc-1", ExitStatus: &status}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, payload, _ := strings.Cut(string(data), "\n")
+	if event != EventStop || !strings.Contains(payload, `"exit_status":137`) {
+		t.Errorf("hook saw %q", data)
+	}
+}
+
+func TestRun_Failures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, "no such tenant")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeHook(t, dir, "optional", `{"events": ["create", "destroy"], "exec": "/bin/false"}`)
+	writeHook(t, dir, "required", `{"events": ["create", "destroy"], "url": "`+server.URL+`", "required": true}`)
+	writeHook(t, dir, "slow", `{"events": ["start"], "exec": "/bin/sleep", "args": ["5"], "timeout": "50ms", "required": true}`)
+	r := loadTestRunner(t, dir)
+
+	err := r.Run(context.Background(), Payload{Event: EventCreate, SandboxID: "fc-1"})
+	if err == nil || !strings.Contains(err.Error(), "required") || strings.Contains(err.Error(), "optional") {
+		t.Errorf("Run(create) error = %v, want only the required hook", err)
+	}
+
+	// Teardown can't be aborted, so failures there are only logged
+	if err := r.Run(context.Background(), Payload{Event: EventDestroy, SandboxID: "fc-1"}); err != nil {
+		t.Errorf("Run(destroy) error = %v", err)
+	}
+
+	start := time.Now()
+	if err := r.Run(context.Background(), Payload{Event: EventStart, SandboxID: "fc-1"}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run(start) error = %v, want timeout", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("hook timeout was not enforced")
+	}
+
+	var nilRunner *Runner
+	if err := nilRunner.Run(context.Background(), Payload{Event: EventCreate}); err != nil {
+		t.Errorf("nil Runner error = %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package image
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+)
+
+// toolVersionTimeout bounds how long we wait for a tool to report its version.
+const toolVersionTimeout = 5 * time.Second
+
+// Provenance records where a converted image came from and what produced it,
+// so operators can audit exactly what runs on a node.
+type Provenance struct {
+	// TriggeredBy identifies who or what requested the conversion.
+	TriggeredBy string `json:"triggered_by"`
+
+	// Host is the node the conversion ran on.
+	Host string `json:"host,omitempty"`
+
+	// Builder is the address of the remote builder that ran the
+	// conversion, if it didn't run locally.
+	Builder string `json:"builder,omitempty"`
+
+	// SourceDigest is the manifest digest of the pulled image.
+	SourceDigest string `json:"source_digest,omitempty"`
+
+	// ToolVersions maps each tool used to the version it reported.
+	ToolVersions map[string]string `json:"tool_versions,omitempty"`
+
+	// StartedAt is when the conversion began.
+	StartedAt time.Time `json:"started_at"`
+
+	// Duration is how long the conversion took.
+	Duration time.Duration `json:"duration"`
+
+	// OutputSHA256 is the hash of the rootfs image.
+	OutputSHA256 string `json:"output_sha256,omitempty"`
+
+	// SquashfsSHA256 is the hash of the squashfs image (if DualOutput enabled).
+	SquashfsSHA256 string `json:"squashfs_sha256,omitempty"`
+}
+
+// AuditRecord is one line of the conversion audit log.
+type AuditRecord struct {
+	Time       time.Time   `json:"time"`
+	Reference  string      `json:"reference"`
+	Success    bool        `json:"success"`
+	Error      string      `json:"error,omitempty"`
+	Provenance *Provenance `json:"provenance"`
+}
+
+// triggerKey is the context key for the conversion trigger.
+type triggerKey struct{}
+
+// WithTrigger returns a context that attributes conversions to trigger
+// (e.g. "cri:PullImage pod=default/nginx").
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+// triggerFromContext returns the trigger set by WithTrigger, falling back to
+// the current process and user.
+func triggerFromContext(ctx context.Context) string {
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok && trigger != "" {
+		return trigger
+	}
+	return fmt.Sprintf("%s (pid %d, uid %d)", filepath.Base(os.Args[0]), os.Getpid(), os.Getuid())
+}
+
+// newProvenance starts a provenance record for a conversion.
+func (f *FsifyConverter) newProvenance(ctx context.Context, start time.Time) *Provenance {
+	host, _ := os.Hostname()
+	return &Provenance{
+		TriggeredBy:  triggerFromContext(ctx),
+		Host:         host,
+		ToolVersions: f.toolVersions(ctx),
+		StartedAt:    start,
+	}
+}
+
+// finishProvenance fills in the output side of a provenance record.
+func (f *FsifyConverter) finishProvenance(prov *Provenance, result *ConvertedImage) {
+	prov.Duration = time.Since(prov.StartedAt)
+	if result == nil {
+		return
+	}
+
+	prov.SourceDigest = result.Digest
+	if sum, err := checksum.FileSHA256(result.RootfsPath); err != nil {
+		f.log.WithError(err).Warn("Failed to hash rootfs image")
+	} else {
+		prov.OutputSHA256 = "sha256:" + sum
+	}
+	if result.SquashfsPath != "" {
+		if sum, err := checksum.FileSHA256(result.SquashfsPath); err != nil {
+			f.log.WithError(err).Warn("Failed to hash squashfs image")
+		} else {
+			prov.SquashfsSHA256 = "sha256:" + sum
+		}
+	}
+}
+
+// toolVersions collects the versions of the tools used for conversion.
+func (f *FsifyConverter) toolVersions(ctx context.Context) map[string]string {
+	versions := make(map[string]string)
+
+	if f.config.UseFsifyCLI {
+		versions["fsify"] = toolVersion(ctx, f.config.FsifyBinary, "--version")
+		return versions
+	}
+
+	versions["skopeo"] = toolVersion(ctx, f.config.SkopeoPath, "--version")
+	versions["umoci"] = toolVersion(ctx, f.config.UmociPath, "--version")
+	if f.config.Filesystem == "squashfs" || f.config.DualOutput {
+		versions["mksquashfs"] = toolVersion(ctx, "mksquashfs", "-version")
+	}
+	if f.config.Filesystem != "squashfs" {
+		mkfs := "mkfs." + f.config.Filesystem
+		versions[mkfs] = toolVersion(ctx, mkfs, "-V")
+	}
+
+	return versions
+}
+
+// toolVersion returns the first line a tool prints for its version flag, or
+// "unknown" if it can't be run.
+func toolVersion(ctx context.Context, binary string, args ...string) string {
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+
+	// Some tools (mke2fs) exit non-zero after printing their version
+	output, _ := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "unknown"
+}
+
+// auditLogPath returns the path to the conversion audit log.
+func (f *FsifyConverter) auditLogPath() string {
+	if f.config.AuditLogPath != "" {
+		return f.config.AuditLogPath
+	}
+	return filepath.Join(f.config.OutputDir, "audit.log")
+}
+
+// audit appends a record of a conversion attempt to the audit log.
+func (f *FsifyConverter) audit(imageRef string, prov *Provenance, convErr error) {
+	record := AuditRecord{
+		Time:       time.Now(),
+		Reference:  imageRef,
+		Success:    convErr == nil,
+		Provenance: prov,
+	}
+	if convErr != nil {
+		record.Error = convErr.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		f.log.WithError(err).Warn("Failed to marshal audit record")
+		return
+	}
+	data = append(data, '\n')
+
+	f.auditMu.Lock()
+	defer f.auditMu.Unlock()
+
+	file, err := os.OpenFile(f.auditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		f.log.WithError(err).Warn("Failed to open audit log")
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		f.log.WithError(err).Warn("Failed to write audit record")
+	}
+}
+
+// ReadAuditLog reads all records from a conversion audit log.
+func ReadAuditLog(path string) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse audit record: %w", err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return records, nil
+}
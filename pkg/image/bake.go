@@ -0,0 +1,250 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// An image normally holds only the container's files, and is attached to a
+// VM booting a base image with fc-agent in it. Images converted with boot
+// files baked in can instead be the VM's root drive themselves: the
+// converter copies fc-agent into the rootfs, links an init to it that the
+// VM boots with init=, and adds the device nodes the kernel opens before
+// devtmpfs is mounted. When fc-agent runs as PID 1 it mounts /proc, /sys,
+// /dev and /run itself before starting.
+
+const (
+	// BakedAgentPath is where fc-agent is baked into images by default.
+	BakedAgentPath = "/sbin/fc-agent"
+
+	// BakedInitPath is the init of images with boot files baked in, a
+	// symlink to BakedAgentPath. VMs booting them pass init=BakedInitPath.
+	BakedInitPath = "/sbin/fc-init"
+)
+
+// BakeConfig configures baking boot files into converted images.
+type BakeConfig struct {
+	// Enabled bakes boot files into every converted image.
+	Enabled bool
+
+	// Files are copied into the image. Defaults to DefaultBakeFiles.
+	Files []BakeFile
+}
+
+// BakeFile is a file copied from the host into converted images.
+type BakeFile struct {
+	// Source is the file on the host.
+	Source string
+
+	// Target is the absolute path in the image.
+	Target string
+
+	// Mode is the file's mode in the image; 0 keeps the source's.
+	Mode os.FileMode
+}
+
+// DefaultBakeFiles bakes the host's fc-agent into images.
+var DefaultBakeFiles = []BakeFile{
+	{Source: "/usr/local/bin/fc-agent", Target: BakedAgentPath, Mode: 0755},
+}
+
+// bakeDirs are the mount points fc-agent mounts on as init.
+var bakeDirs = []string{"/dev", "/proc", "/sys", "/run", "/tmp"}
+
+// bakeDevice is a character device node baked into images.
+type bakeDevice struct {
+	path         string
+	major, minor uint32
+	mode         uint32
+}
+
+// bakeDevices are opened before devtmpfs is mounted over /dev: the kernel
+// gives init /dev/console as its stdio, and early writes go to /dev/null.
+var bakeDevices = []bakeDevice{
+	{"/dev/console", 5, 1, 0600},
+	{"/dev/null", 1, 3, 0666},
+	{"/dev/zero", 1, 5, 0666},
+	{"/dev/tty", 5, 0, 0666},
+	{"/dev/random", 1, 8, 0666},
+	{"/dev/urandom", 1, 9, 0666},
+}
+
+// ParseBakeFile parses a file to bake from "source:target[:mode]", with
+// the mode in octal.
+func ParseBakeFile(spec string) (BakeFile, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return BakeFile{}, fmt.Errorf("invalid bake file %q (must be source:target[:mode])", spec)
+	}
+	file := BakeFile{Source: parts[0], Target: parts[1]}
+	if !filepath.IsAbs(file.Target) || filepath.Clean(file.Target) == "/" {
+		return BakeFile{}, fmt.Errorf("invalid bake file %q: target must be an absolute file path", spec)
+	}
+	if len(parts) == 3 {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || mode > 07777 {
+			return BakeFile{}, fmt.Errorf("invalid bake file %q: mode must be octal permissions", spec)
+		}
+		file.Mode = os.FileMode(mode)
+	}
+	return file, nil
+}
+
+// files returns the files to bake.
+func (b BakeConfig) files() []BakeFile {
+	if len(b.Files) == 0 {
+		return DefaultBakeFiles
+	}
+	return b.Files
+}
+
+// size returns how many bytes baking adds to an image, 0 if disabled.
+func (b BakeConfig) size() int64 {
+	if !b.Enabled {
+		return 0
+	}
+	var size int64
+	for _, file := range b.files() {
+		if info, err := os.Stat(file.Source); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// bakeRootfs bakes the boot files into the rootfs at root, returning the
+// path of its init.
+func bakeRootfs(root string, config BakeConfig) (string, error) {
+	for _, dir := range bakeDirs {
+		path, err := resolveInRoot(root, dir)
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	for _, file := range config.files() {
+		if err := bakeFile(root, file); err != nil {
+			return "", fmt.Errorf("failed to bake %s: %w", file.Target, err)
+		}
+	}
+
+	initPath, err := resolveInRoot(root, BakedInitPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(initPath), 0755); err != nil {
+		return "", err
+	}
+	_ = os.Remove(initPath)
+	if err := os.Symlink(BakedAgentPath, initPath); err != nil {
+		return "", fmt.Errorf("failed to link init: %w", err)
+	}
+
+	for _, dev := range bakeDevices {
+		path, err := resolveInRoot(root, dev.path)
+		if err != nil {
+			return "", err
+		}
+		_ = os.Remove(path)
+		if err := unix.Mknod(path, unix.S_IFCHR|dev.mode, int(unix.Mkdev(dev.major, dev.minor))); err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", dev.path, err)
+		}
+		// Mknod's mode is masked by the umask
+		if err := os.Chmod(path, os.FileMode(dev.mode)); err != nil {
+			return "", err
+		}
+	}
+	return BakedInitPath, nil
+}
+
+// bakeFile copies a file from the host into the rootfs at root, replacing
+// whatever the image has at its target.
+func bakeFile(root string, file BakeFile) error {
+	src, err := os.Open(file.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	mode := file.Mode
+	if mode == 0 {
+		info, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+
+	path, err := resolveInRoot(root, file.Target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_ = os.Remove(path)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// resolveInRoot returns where path in the rootfs at root is on the host,
+// following the image's symlinks in its directories as the guest would, so
+// an absolute link such as /sbin -> /usr/sbin stays inside root. The last
+// element is not followed.
+func resolveInRoot(root, path string) (string, error) {
+	dir, name := filepath.Split(filepath.Clean("/" + path))
+	resolved := "/"
+	parts := strings.Split(dir, "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			// Not a link, or not there yet
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("too many links resolving %s", path)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		parts = append(strings.Split(filepath.Clean(target), "/"), parts...)
+		resolved = "/"
+	}
+	return filepath.Join(root, resolved, name), nil
+}
+
+// baked reports whether img has boot files baked in if the converter bakes
+// them. Images converted before baking was enabled are converted again.
+func (f *FsifyConverter) baked(img *ConvertedImage) bool {
+	return !f.config.Bake.Enabled || img.BootInit != ""
+}
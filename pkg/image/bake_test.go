@@ -0,0 +1,135 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBakeFile(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    BakeFile
+		wantErr bool
+	}{
+		{spec: "/usr/local/bin/fc-agent:/sbin/fc-agent:755", want: BakeFile{"/usr/local/bin/fc-agent", "/sbin/fc-agent", 0755}},
+		{spec: "/usr/bin/runc:/usr/bin/runc", want: BakeFile{"/usr/bin/runc", "/usr/bin/runc", 0}},
+		{spec: "/usr/bin/runc", wantErr: true},
+		{spec: "/usr/bin/runc:usr/bin/runc", wantErr: true},
+		{spec: "/usr/bin/runc:/", wantErr: true},
+		{spec: "/usr/bin/runc:/usr/bin/runc:rwx", wantErr: true},
+		{spec: ":/usr/bin/runc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBakeFile(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBakeFile(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBakeFile(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr", "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Merged /usr layouts link /sbin absolutely, which must not leave root
+	if err := os.Symlink("/usr/sbin", filepath.Join(root, "sbin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../..", filepath.Join(root, "usr", "sbin", "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/sbin/fc-agent":           "usr/sbin/fc-agent",
+		"/sbin/up/etc/passwd":      "etc/passwd",
+		"/../../etc/passwd":        "etc/passwd",
+		"/opt/missing/bin/fc-init": "opt/missing/bin/fc-init",
+		"/sbin":                    "sbin",
+	}
+	for path, want := range tests {
+		got, err := resolveInRoot(root, path)
+		if err != nil {
+			t.Errorf("resolveInRoot(%q) error = %v", path, err)
+			continue
+		}
+		if got != filepath.Join(root, want) {
+			t.Errorf("resolveInRoot(%q) = %s, want %s", path, got, filepath.Join(root, want))
+		}
+	}
+}
+
+func TestBakeRootfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating device nodes needs root")
+	}
+	agent := filepath.Join(t.TempDir(), "fc-agent")
+	if err := os.WriteFile(agent, []byte("agent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr", "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/sbin", filepath.Join(root, "sbin")); err != nil {
+		t.Fatal(err)
+	}
+
+	init, err := bakeRootfs(root, BakeConfig{
+		Enabled: true,
+		Files:   []BakeFile{{Source: agent, Target: BakedAgentPath, Mode: 0755}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if init != BakedInitPath {
+		t.Errorf("bakeRootfs() init = %s, want %s", init, BakedInitPath)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "usr", "sbin", "fc-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("fc-agent mode = %v, want 0755", info.Mode().Perm())
+	}
+	if target, err := os.Readlink(filepath.Join(root, "usr", "sbin", "fc-init")); err != nil || target != BakedAgentPath {
+		t.Errorf("fc-init links to %q (%v), want %s", target, err, BakedAgentPath)
+	}
+	for _, dev := range bakeDevices {
+		info, err := os.Lstat(filepath.Join(root, dev.path))
+		if err != nil {
+			t.Errorf("%s: %v", dev.path, err)
+			continue
+		}
+		if info.Mode()&os.ModeCharDevice == 0 || uint32(info.Mode().Perm()) != dev.mode {
+			t.Errorf("%s mode = %v, want character device %o", dev.path, info.Mode(), dev.mode)
+		}
+	}
+	for _, dir := range bakeDirs {
+		if info, err := os.Stat(filepath.Join(root, dir)); err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", dir, err)
+		}
+	}
+}
+
+func TestBakedRequiresBootInit(t *testing.T) {
+	f := &FsifyConverter{}
+	img := &ConvertedImage{}
+	if !f.baked(img) {
+		t.Error("baked() = false with baking disabled")
+	}
+	f.config.Bake.Enabled = true
+	if f.baked(img) {
+		t.Error("baked() = true for an image without boot files")
+	}
+	img.BootInit = BakedInitPath
+	if !f.baked(img) {
+		t.Error("baked() = false for a baked image")
+	}
+}
@@ -0,0 +1,179 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultControlSocket is where the runtime serves its control API.
+const DefaultControlSocket = "/run/fc-cri/control.sock"
+
+// ControlServer serves image conversions and their progress on a Unix
+// socket, for fcctl:
+//
+//	GET  /v1/images/conversions              running conversions
+//	GET  /v1/images/conversions/watch?image= progress of one, as JSON lines
+//	POST /v1/images/convert                  {"image": ref, "watch": bool}
+//
+// A conversion started over the socket keeps running if the client goes
+// away; it ends with the server.
+type ControlServer struct {
+	converter *FsifyConverter
+	log       *logrus.Entry
+
+	// ctx bounds the conversions the server started
+	ctx context.Context
+}
+
+// NewControlServer creates a control server for a converter.
+func NewControlServer(converter *FsifyConverter, log *logrus.Entry) *ControlServer {
+	return &ControlServer{
+		converter: converter,
+		log:       log.WithField("component", "control"),
+		ctx:       context.Background(),
+	}
+}
+
+// Serve listens on socketPath, readable only by root, until ctx is done.
+func (s *ControlServer) Serve(ctx context.Context, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create socket dir: %w", err)
+	}
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict %s: %w", socketPath, err)
+	}
+
+	s.ctx = ctx
+	server := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	s.log.WithField("socket", socketPath).Info("Serving control API")
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the control API's HTTP handler.
+func (s *ControlServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/images/conversions", s.handleList)
+	mux.HandleFunc("GET /v1/images/conversions/watch", s.handleWatch)
+	mux.HandleFunc("POST /v1/images/convert", s.handleConvert)
+	return mux
+}
+
+func (s *ControlServer) handleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.converter.Progress())
+}
+
+func (s *ControlServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	imageRef := r.URL.Query().Get("image")
+	if imageRef == "" {
+		http.Error(w, "image is required", http.StatusBadRequest)
+		return
+	}
+
+	ch, stop, ok := s.converter.WatchProgress(imageRef)
+	if !ok {
+		http.Error(w, "no conversion of "+imageRef+" in progress", http.StatusNotFound)
+		return
+	}
+	defer stop()
+	streamProgress(w, r, ch)
+}
+
+func (s *ControlServer) handleConvert(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Image string `json:"image"`
+		Watch bool   `json:"watch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Image == "" {
+		http.Error(w, "expected {\"image\": ref}", http.StatusBadRequest)
+		return
+	}
+
+	// The update channel never blocks the conversion, so it finishes
+	// whether or not the client keeps reading
+	updates := make(chan ConversionProgress, 1)
+	go func() {
+		defer close(updates)
+		var last ConversionProgress
+		result, err := s.converter.ConvertWithProgress(s.ctx, req.Image, func(p ConversionProgress) {
+			last = p
+			if !p.Finished() {
+				sendLatest(updates, p)
+			}
+		})
+
+		// Cached images finish without reporting progress
+		last.Image = s.converter.normalizeRef(req.Image)
+		last.UpdatedAt = time.Now()
+		if err != nil {
+			s.log.WithError(err).WithField("image", req.Image).Warn("Conversion failed")
+			last.Phase = PhaseFailed
+			last.Error = err.Error()
+		} else {
+			last.Phase = PhaseDone
+			last.RootfsPath = result.RootfsPath
+		}
+		sendLatest(updates, last)
+	}()
+
+	if !req.Watch {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"image": req.Image})
+		return
+	}
+	streamProgress(w, r, updates)
+}
+
+// streamProgress writes progress updates as JSON lines until ch is closed
+// or the client goes away.
+func streamProgress(w http.ResponseWriter, r *http.Request, ch <-chan ConversionProgress) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(p); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
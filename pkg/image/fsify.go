@@ -11,21 +11,30 @@
 //  4. Create filesystem image (ext4, xfs, or btrfs)
 //  5. Mount and copy rootfs contents
 //  6. Optionally create squashfs for caching
+//
+// ext4 images are streamed instead (see stream.go): layers are applied to
+// the mounted image as skopeo downloads them, and the image is shrunk to
+// fit afterwards. Images the streaming path can't handle take the steps
+// above.
 package image
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,6 +50,15 @@ type FsifyConverter struct {
 
 	// In-progress conversions to prevent duplicate work
 	inProgress map[string]chan struct{}
+
+	// Progress of the in-progress conversions
+	progress map[string]*progressTracker
+
+	// auditMu serializes appends to the audit log
+	auditMu sync.Mutex
+
+	// localConversions counts conversions running in this process
+	localConversions atomic.Int32
 }
 
 // FsifyConfig configures the fsify converter.
@@ -51,7 +69,9 @@ type FsifyConfig struct {
 	// TempDir is used for intermediate files during conversion.
 	TempDir string
 
-	// Filesystem type: "ext4", "xfs", or "btrfs"
+	// Filesystem type: "ext4", "xfs", "btrfs", or the read-only "erofs"
+	// or "squashfs". Read-only images are far smaller and quicker to build;
+	// sandboxes booting one write to an overlay drive of their own.
 	Filesystem string
 
 	// SizeBufferMB is extra space (MB) added to images.
@@ -69,17 +89,43 @@ type FsifyConfig struct {
 	// FsifyBinary is the path to fsify binary.
 	FsifyBinary string
 
+	// MinFsifyVersion is the oldest fsify CLI to use. An older one, or one
+	// lacking the flags a conversion needs, is skipped for the native
+	// implementation. Defaults to DefaultMinFsifyVersion.
+	MinFsifyVersion string
+
 	// SkopeoPath is the path to skopeo binary.
 	SkopeoPath string
 
 	// UmociPath is the path to umoci binary.
 	UmociPath string
 
+	// StreamLayers applies layers to ext4 images while they download,
+	// instead of unpacking them all before creating the image.
+	StreamLayers bool
+
+	// StageAttempts is how often a failing stage of a conversion (the pull,
+	// the unpack, building the filesystem) is run before the conversion
+	// fails. Defaults to DefaultStageAttempts.
+	StageAttempts int
+
 	// DefaultRegistry is used when no registry is specified.
 	DefaultRegistry string
 
 	// InsecureRegistries allows HTTP for these registries.
 	InsecureRegistries []string
+
+	// AuditLogPath is the append-only conversion audit log.
+	// Defaults to audit.log in OutputDir.
+	AuditLogPath string
+
+	// RemoteBuilder delegates conversions to a builder service when local
+	// resources are constrained.
+	RemoteBuilder RemoteBuilderConfig
+
+	// Bake copies fc-agent, an init and device nodes into converted images
+	// so VMs boot them directly. The fsify CLI can't, so it is skipped.
+	Bake BakeConfig
 }
 
 // DefaultFsifyConfig returns sensible defaults.
@@ -93,9 +139,13 @@ func DefaultFsifyConfig() FsifyConfig {
 		DualOutput:      false,
 		UseFsifyCLI:     true,
 		FsifyBinary:     "/usr/local/bin/fsify",
+		MinFsifyVersion: DefaultMinFsifyVersion,
 		SkopeoPath:      "/usr/bin/skopeo",
 		UmociPath:       "/usr/bin/umoci",
+		StreamLayers:    true,
+		StageAttempts:   DefaultStageAttempts,
 		DefaultRegistry: "docker.io",
+		RemoteBuilder:   DefaultRemoteBuilderConfig(),
 	}
 }
 
@@ -124,6 +174,13 @@ type ConvertedImage struct {
 
 	// ConvertedAt is when the conversion completed.
 	ConvertedAt time.Time `json:"converted_at"`
+
+	// Provenance records who triggered the conversion and what produced it.
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// BootInit is the init VMs boot the image with, if boot files were
+	// baked into it.
+	BootInit string `json:"boot_init,omitempty"`
 }
 
 // OCIImageConfig holds relevant OCI image configuration.
@@ -146,6 +203,16 @@ func NewFsifyConverter(config FsifyConfig, log *logrus.Entry) (*FsifyConverter,
 		}
 	}
 
+	if config.StageAttempts <= 0 {
+		config.StageAttempts = DefaultStageAttempts
+	}
+
+	// The fsify CLI only builds writable filesystems
+	if config.UseFsifyCLI && ReadOnlyFilesystem(config.Filesystem) {
+		log.WithField("filesystem", config.Filesystem).Info("fsify CLI can't build read-only images, using native implementation")
+		config.UseFsifyCLI = false
+	}
+
 	// Check for required binaries
 	if config.UseFsifyCLI {
 		if _, err := os.Stat(config.FsifyBinary); os.IsNotExist(err) {
@@ -153,12 +220,25 @@ func NewFsifyConverter(config FsifyConfig, log *logrus.Entry) (*FsifyConverter,
 			config.UseFsifyCLI = false
 		}
 	}
+	if config.UseFsifyCLI {
+		cli, err := detectFsifyCLI(context.Background(), config.FsifyBinary)
+		if err == nil {
+			err = cli.check(config)
+		}
+		if err != nil {
+			log.WithError(err).WithField("binary", config.FsifyBinary).Warn("fsify CLI is incompatible, falling back to native implementation")
+			config.UseFsifyCLI = false
+		} else {
+			log.WithField("version", cli.version).Debug("Using fsify CLI")
+		}
+	}
 
 	converter := &FsifyConverter{
 		config:     config,
 		log:        log.WithField("component", "fsify-converter"),
 		cache:      make(map[string]*ConvertedImage),
 		inProgress: make(map[string]chan struct{}),
+		progress:   make(map[string]*progressTracker),
 	}
 
 	// Load existing cache from disk
@@ -170,6 +250,13 @@ func NewFsifyConverter(config FsifyConfig, log *logrus.Entry) (*FsifyConverter,
 // Convert converts an OCI image to a block device image.
 // Returns the path to the converted rootfs image.
 func (f *FsifyConverter) Convert(ctx context.Context, imageRef string) (*ConvertedImage, error) {
+	return f.ConvertWithProgress(ctx, imageRef, nil)
+}
+
+// ConvertWithProgress is Convert, calling onProgress as the conversion
+// moves through its phases. Callers joining a conversion already in
+// progress receive its progress too. A cached image reports nothing.
+func (f *FsifyConverter) ConvertWithProgress(ctx context.Context, imageRef string, onProgress ProgressFunc) (*ConvertedImage, error) {
 	// Normalize the image reference
 	normalizedRef := f.normalizeRef(imageRef)
 
@@ -178,8 +265,8 @@ func (f *FsifyConverter) Convert(ctx context.Context, imageRef string) (*Convert
 	// Check cache first
 	f.mu.RLock()
 	if cached, ok := f.cache[normalizedRef]; ok {
-		// Verify the file still exists
-		if _, err := os.Stat(cached.RootfsPath); err == nil {
+		// Verify the file still exists and was built as configured
+		if _, err := os.Stat(cached.RootfsPath); err == nil && f.baked(cached) {
 			f.mu.RUnlock()
 			f.log.WithField("image", normalizedRef).Debug("Using cached rootfs")
 			return cached, nil
@@ -190,7 +277,9 @@ func (f *FsifyConverter) Convert(ctx context.Context, imageRef string) (*Convert
 	// Check if conversion is already in progress
 	f.mu.Lock()
 	if progress, ok := f.inProgress[normalizedRef]; ok {
+		tracker := f.progress[normalizedRef]
 		f.mu.Unlock()
+		defer followProgress(tracker, onProgress)()
 		// Wait for existing conversion
 		select {
 		case <-progress:
@@ -210,46 +299,134 @@ func (f *FsifyConverter) Convert(ctx context.Context, imageRef string) (*Convert
 	// Mark conversion as in-progress
 	progress := make(chan struct{})
 	f.inProgress[normalizedRef] = progress
+	tracker := newProgressTracker(normalizedRef)
+	f.progress[normalizedRef] = tracker
 	f.mu.Unlock()
+	defer followProgress(tracker, onProgress)()
 
+	var result *ConvertedImage
+	var err error
 	defer func() {
+		tracker.finish(result, err)
 		f.mu.Lock()
 		delete(f.inProgress, normalizedRef)
+		delete(f.progress, normalizedRef)
 		close(progress)
 		f.mu.Unlock()
 	}()
 
+	// Shims on the same node don't share f.inProgress. Serialize on a lock
+	// file and pick up the result if another process converted the image
+	// while we waited.
+	digest := f.inspectDigest(ctx, normalizedRef)
+	lockPath := filepath.Join(f.lockDir(), f.conversionLockKey(normalizedRef, digest)+".lock")
+	unlock, lockErr := lockFile(ctx, lockPath, func() {
+		f.log.WithField("image", normalizedRef).Info("Waiting for conversion in another process")
+	})
+	if lockErr != nil {
+		err = fmt.Errorf("failed to lock conversion: %w", lockErr)
+		return nil, err
+	}
+	defer unlock()
+
+	if cached := f.convertedElsewhere(normalizedRef, digest); cached != nil {
+		f.log.WithField("image", normalizedRef).Info("Using rootfs converted by another process")
+		result = cached
+		return cached, nil
+	}
+
 	// Perform the conversion
-	var result *ConvertedImage
-	var err error
+	doneInFlight := metrics.Global().TrackInFlight(metrics.InFlightImageConversion)
 
-	if f.config.UseFsifyCLI {
-		result, err = f.convertWithCLI(ctx, normalizedRef)
-	} else {
-		result, err = f.convertNative(ctx, normalizedRef)
+	prov := f.newProvenance(ctx, time.Now())
+
+	result, err = f.convert(ctx, normalizedRef, digest, tracker)
+	doneInFlight()
+
+	// Record the attempt whether or not it succeeded
+	f.finishProvenance(prov, result)
+	if result != nil && result.Provenance != nil {
+		// Converted remotely: the builder's tools produced the image
+		prov.Builder = f.config.RemoteBuilder.Address
+		prov.Host = result.Provenance.Host
+		prov.ToolVersions = result.Provenance.ToolVersions
+	}
+	f.audit(normalizedRef, prov, err)
+
+	var sizeBytes int64
+	if result != nil {
+		sizeBytes = result.SizeBytes
 	}
+	metrics.Global().RecordImageConversion(normalizedRef, prov.Duration, sizeBytes, err)
 
 	if err != nil {
 		return nil, err
 	}
+	result.Provenance = prov
+	// Keyed by the lock's digest, the image is still found under other tags,
+	// while its provenance only records a digest that was pulled
+	if result.Digest == "" {
+		result.Digest = digest
+	}
 
-	// Cache the result
+	// Cache the result and persist it for other processes
 	f.mu.Lock()
 	f.cache[normalizedRef] = result
-	f.mu.Unlock()
-
-	// Persist cache to disk
 	f.saveCache()
+	f.mu.Unlock()
 
 	return result, nil
 }
 
+// convert runs a conversion on the remote builder when local resources are
+// constrained, and locally otherwise or if the builder fails.
+func (f *FsifyConverter) convert(ctx context.Context, imageRef, digest string, tracker *progressTracker) (*ConvertedImage, error) {
+	// Claim the partial name for Converting until a stage builds on it
+	partial := partialPath(f.getOutputPath(imageRef))
+	if err := os.WriteFile(partial, nil, 0644); err == nil {
+		defer os.Remove(partial)
+	}
+
+	if reason := f.delegateReason(); reason != "" {
+		log := f.log.WithFields(logrus.Fields{
+			"image":   imageRef,
+			"builder": f.config.RemoteBuilder.Address,
+			"reason":  reason,
+		})
+		log.Info("Delegating conversion to remote builder")
+
+		tracker.setPhase(PhaseRemote)
+		result, err := f.convertRemote(ctx, imageRef, digest)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.WithError(err).Warn("Remote conversion failed, converting locally")
+	}
+
+	f.localConversions.Add(1)
+	defer f.localConversions.Add(-1)
+
+	if f.config.UseFsifyCLI && !f.config.Bake.Enabled {
+		tracker.setPhase(PhaseFsify)
+		return f.convertWithCLI(ctx, imageRef)
+	}
+	return f.convertNative(ctx, imageRef, tracker)
+}
+
 // convertWithCLI uses the fsify CLI tool for conversion.
 func (f *FsifyConverter) convertWithCLI(ctx context.Context, imageRef string) (*ConvertedImage, error) {
 	outputPath := f.getOutputPath(imageRef)
+	squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
+	partial := partialPath(outputPath)
+	partialSquashfs := partialPath(squashfsPath)
+	defer os.Remove(partial)
+	defer os.Remove(partialSquashfs)
 
 	args := []string{
-		"-o", outputPath,
+		"-o", partial,
 		"-fs", f.config.Filesystem,
 		"-s", fmt.Sprintf("%d", f.config.SizeBufferMB),
 	}
@@ -269,22 +446,42 @@ func (f *FsifyConverter) convertWithCLI(ctx context.Context, imageRef string) (*
 		"args":   args,
 	}).Debug("Running fsify CLI")
 
-	cmd := exec.CommandContext(ctx, f.config.FsifyBinary, args...)
-	cmd.Env = os.Environ()
-
-	output, err := cmd.CombinedOutput()
+	// Truncate rather than remove the rootfs, keeping its name claimed
+	reset := func() {
+		os.Truncate(partial, 0)
+		os.Remove(partialSquashfs)
+	}
+	// The digest is the one of the run whose image is kept
+	var digest string
+	err := f.retryStage(ctx, "fsify", reset, func() error {
+		cmd := exec.CommandContext(ctx, f.config.FsifyBinary, args...)
+		cmd.Env = os.Environ()
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("fsify failed: %w: %s", err, output)
+		}
+		digest = pulledDigest(output)
+		// Verify the output exists
+		if info, err := os.Stat(partial); err != nil || info.Size() == 0 {
+			return fmt.Errorf("fsify completed but wrote no image")
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("fsify failed: %w: %s", err, output)
+		return nil, err
 	}
 
-	// Verify the output exists
+	if err := commitOutput(partial, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to commit image: %w", err)
+	}
 	info, err := os.Stat(outputPath)
 	if err != nil {
-		return nil, fmt.Errorf("fsify completed but output not found: %w", err)
+		return nil, fmt.Errorf("failed to stat output: %w", err)
 	}
 
 	result := &ConvertedImage{
 		Reference:   imageRef,
+		Digest:      digest,
 		RootfsPath:  outputPath,
 		SizeBytes:   info.Size(),
 		Filesystem:  f.config.Filesystem,
@@ -293,9 +490,12 @@ func (f *FsifyConverter) convertWithCLI(ctx context.Context, imageRef string) (*
 
 	// Check for squashfs output
 	if f.config.DualOutput {
-		squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
-		if _, err := os.Stat(squashfsPath); err == nil {
-			result.SquashfsPath = squashfsPath
+		if _, err := os.Stat(partialSquashfs); err == nil {
+			if err := commitOutput(partialSquashfs, squashfsPath); err != nil {
+				f.log.WithError(err).Warn("Failed to commit squashfs")
+			} else {
+				result.SquashfsPath = squashfsPath
+			}
 		}
 	}
 
@@ -306,14 +506,36 @@ func (f *FsifyConverter) convertWithCLI(ctx context.Context, imageRef string) (*
 }
 
 // convertNative implements the conversion logic natively in Go.
-func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string) (*ConvertedImage, error) {
+func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string, tracker *progressTracker) (*ConvertedImage, error) {
+	if f.config.StreamLayers {
+		result, err := f.convertStreaming(ctx, imageRef, tracker)
+		if err == nil || ctx.Err() != nil {
+			return result, err
+		}
+		log := f.log.WithError(err).WithField("image", imageRef)
+		if errors.Is(err, errStreamUnsupported) {
+			log.Debug("Image can't be streamed, converting serially")
+		} else {
+			log.Warn("Streaming conversion failed, converting serially")
+		}
+		tracker.update(func(p *ConversionProgress) {
+			p.BytesPulled = 0
+			p.LayersUnpacked = 0
+		})
+	}
+
 	f.log.WithField("image", imageRef).Info("Converting image (native)")
 
 	outputPath := f.getOutputPath(imageRef)
+	squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
+	partial := partialPath(outputPath)
+	partialSquashfs := partialPath(squashfsPath)
 	tempDir := filepath.Join(f.config.TempDir, f.sanitizeName(imageRef))
 
-	// Cleanup temp dir
+	// Cleanup temp dir and anything not committed
 	defer os.RemoveAll(tempDir)
+	defer os.Remove(partial)
+	defer os.Remove(partialSquashfs)
 
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
@@ -321,15 +543,32 @@ func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string) (*C
 
 	// Step 1: Pull image with skopeo
 	ociDir := filepath.Join(tempDir, "oci")
-	if err := f.pullImage(ctx, imageRef, ociDir); err != nil {
+	tracker.setPhase(PhasePull)
+	stopSampling := tracker.sample(func(p *ConversionProgress) {
+		p.BytesPulled = dirSize(ociDir)
+	})
+	err := f.retryStage(ctx, "pull", func() { os.RemoveAll(ociDir) }, func() error {
+		return f.pullImage(ctx, imageRef, ociDir)
+	})
+	stopSampling()
+	if err != nil {
 		return nil, fmt.Errorf("failed to pull image: %w", err)
 	}
 
 	// Step 2: Unpack with umoci
 	rootfsDir := filepath.Join(tempDir, "rootfs")
-	if err := f.unpackImage(ctx, ociDir, rootfsDir); err != nil {
+	layers := manifestLayers(ociDir)
+	tracker.update(func(p *ConversionProgress) {
+		p.Phase = PhaseUnpack
+		p.LayersTotal = layers
+	})
+	err = f.retryStage(ctx, "unpack", func() { os.RemoveAll(rootfsDir) }, func() error {
+		return f.unpackImage(ctx, ociDir, rootfsDir, tracker)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to unpack image: %w", err)
 	}
+	tracker.update(func(p *ConversionProgress) { p.LayersUnpacked = layers })
 
 	// Step 3: Extract OCI config
 	ociConfig := f.extractOCIConfigFromDir(ociDir)
@@ -339,16 +578,41 @@ func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string) (*C
 		_ = f.embedOCIConfig(rootfsDir, ociConfig)
 	}
 
-	// Step 4: Calculate required size
-	sizeMB, err := f.calculateSize(rootfsDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to calculate size: %w", err)
+	var bootInit string
+	if f.config.Bake.Enabled {
+		if bootInit, err = bakeRootfs(bundleRootfs(rootfsDir), f.config.Bake); err != nil {
+			return nil, fmt.Errorf("failed to bake boot files: %w", err)
+		}
+	}
+
+	if ReadOnlyFilesystem(f.config.Filesystem) {
+		// Step 4: Build the read-only image from the rootfs directly
+		tracker.setPhase(PhaseMkfs)
+		err := f.retryStage(ctx, "mkfs", nil, func() error {
+			return f.createReadOnlyImage(ctx, bundleRootfs(rootfsDir), partial)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem: %w", err)
+		}
+	} else {
+		// Step 4: Calculate required size
+		sizeMB, err := f.calculateSize(rootfsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate size: %w", err)
+		}
+		sizeMB += f.config.SizeBufferMB
+
+		// Step 5: Create filesystem image
+		err = f.retryStage(ctx, "mkfs", func() { os.Truncate(partial, 0) }, func() error {
+			return f.createFilesystemImage(ctx, partial, sizeMB, rootfsDir, tracker)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem: %w", err)
+		}
 	}
-	sizeMB += f.config.SizeBufferMB
 
-	// Step 5: Create filesystem image
-	if err := f.createFilesystemImage(ctx, outputPath, sizeMB, rootfsDir); err != nil {
-		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+	if err := commitOutput(partial, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to commit image: %w", err)
 	}
 
 	// Get final size
@@ -359,17 +623,23 @@ func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string) (*C
 
 	result := &ConvertedImage{
 		Reference:   imageRef,
+		Digest:      manifestDigest(ociDir),
 		RootfsPath:  outputPath,
 		SizeBytes:   info.Size(),
 		Filesystem:  f.config.Filesystem,
 		OCIConfig:   ociConfig,
 		ConvertedAt: time.Now(),
+		BootInit:    bootInit,
 	}
 
 	// Step 6: Create squashfs if dual output
-	if f.config.DualOutput {
-		squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
-		if err := f.createSquashfs(ctx, rootfsDir, squashfsPath); err != nil {
+	if f.config.DualOutput && !ReadOnlyFilesystem(f.config.Filesystem) {
+		tracker.setPhase(PhaseSquashfs)
+		err := f.createSquashfs(ctx, bundleRootfs(rootfsDir), partialSquashfs)
+		if err == nil {
+			err = commitOutput(partialSquashfs, squashfsPath)
+		}
+		if err != nil {
 			f.log.WithError(err).Warn("Failed to create squashfs")
 		} else {
 			result.SquashfsPath = squashfsPath
@@ -377,9 +647,10 @@ func (f *FsifyConverter) convertNative(ctx context.Context, imageRef string) (*C
 	}
 
 	f.log.WithFields(logrus.Fields{
-		"image":   imageRef,
-		"output":  outputPath,
-		"size_mb": sizeMB,
+		"image":      imageRef,
+		"output":     outputPath,
+		"filesystem": f.config.Filesystem,
+		"size_mb":    info.Size() >> 20,
 	}).Info("Image conversion complete")
 
 	return result, nil
@@ -419,8 +690,29 @@ func (f *FsifyConverter) pullImage(ctx context.Context, imageRef, destDir string
 	return nil
 }
 
-// unpackImage unpacks an OCI image using umoci.
-func (f *FsifyConverter) unpackImage(ctx context.Context, ociDir, destDir string) error {
+// inspectDigest asks skopeo for the manifest digest of a remote image,
+// which keys conversion locks. The tag can move before the image is pulled,
+// so results record the digest of the manifest pulled instead. Returns ""
+// if it can't be determined.
+func (f *FsifyConverter) inspectDigest(ctx context.Context, imageRef string) string {
+	srcRef := imageRef
+	if !strings.Contains(srcRef, "://") {
+		srcRef = "docker://" + srcRef
+	}
+
+	cmd := exec.CommandContext(ctx, f.config.SkopeoPath, "inspect", "--format", "{{.Digest}}", srcRef)
+	output, err := cmd.Output()
+	if err != nil {
+		f.log.WithError(err).WithField("image", imageRef).Debug("Failed to inspect image digest")
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// unpackImage unpacks an OCI image using umoci, counting the layers it
+// reports unpacking.
+func (f *FsifyConverter) unpackImage(ctx context.Context, ociDir, destDir string, tracker *progressTracker) error {
 	args := []string{
 		"unpack",
 		"--image", ociDir + ":latest",
@@ -429,10 +721,16 @@ func (f *FsifyConverter) unpackImage(ctx context.Context, ociDir, destDir string
 
 	f.log.WithField("dest", destDir).Debug("Unpacking image with umoci")
 
+	var output bytes.Buffer
+	layers := &lineWatcher{out: &output, match: "unpack layer", onMatch: func() {
+		tracker.update(func(p *ConversionProgress) { p.LayersUnpacked++ })
+	}}
+
 	cmd := exec.CommandContext(ctx, f.config.UmociPath, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("umoci unpack failed: %w: %s", err, output)
+	cmd.Stdout = layers
+	cmd.Stderr = layers
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("umoci unpack failed: %w: %s", err, output.Bytes())
 	}
 
 	return nil
@@ -461,11 +759,52 @@ func (f *FsifyConverter) calculateSize(dir string) (int64, error) {
 }
 
 // createFilesystemImage creates the filesystem image.
-func (f *FsifyConverter) createFilesystemImage(ctx context.Context, outputPath string, sizeMB int64, contentDir string) error {
+func (f *FsifyConverter) createFilesystemImage(ctx context.Context, outputPath string, sizeMB int64, contentDir string, tracker *progressTracker) error {
+	tracker.setPhase(PhaseMkfs)
+	if err := f.formatImage(ctx, outputPath, sizeMB, f.config.Preallocate); err != nil {
+		return err
+	}
+
+	// Mount and copy content
+	mountDir := outputPath + ".mount"
+	unmount, err := mountImage(ctx, outputPath, mountDir)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	sourceDir := bundleRootfs(contentDir)
+
+	// Copy content, measuring it by what the new filesystem uses beyond
+	// its own metadata
+	baseline := fsUsed(mountDir)
+	toCopy := dirSize(sourceDir)
+	tracker.update(func(p *ConversionProgress) {
+		p.Phase = PhaseCopy
+		p.BytesToCopy = toCopy
+	})
+	stopSampling := tracker.sample(func(p *ConversionProgress) {
+		p.BytesCopied = min(max(fsUsed(mountDir)-baseline, 0), toCopy)
+	})
+	cmd := exec.CommandContext(ctx, "cp", "-a", sourceDir+"/.", mountDir)
+	output, err := cmd.CombinedOutput()
+	stopSampling()
+	if err != nil {
+		return fmt.Errorf("cp failed: %w: %s", err, output)
+	}
+
+	// Sync before unmount
+	_ = exec.Command("sync").Run()
+
+	return nil
+}
+
+// formatImage creates an image file of sizeMB and a filesystem on it.
+func (f *FsifyConverter) formatImage(ctx context.Context, outputPath string, sizeMB int64, preallocate bool) error {
 	sizeBytes := sizeMB * 1024 * 1024
 
 	// Create the image file
-	if f.config.Preallocate {
+	if preallocate {
 		// Use fallocate for preallocation
 		cmd := exec.CommandContext(ctx, "fallocate", "-l", fmt.Sprintf("%d", sizeBytes), outputPath)
 		if err := cmd.Run(); err != nil {
@@ -511,50 +850,42 @@ func (f *FsifyConverter) createFilesystemImage(ctx context.Context, outputPath s
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("mkfs failed: %w: %s", err, output)
 	}
+	return nil
+}
 
-	// Mount and copy content
-	mountDir := outputPath + ".mount"
+// mountImage loop-mounts an image at mountDir, returning a function that
+// unmounts it and removes mountDir, once however often it's called.
+func mountImage(ctx context.Context, imagePath, mountDir string) (func(), error) {
 	if err := os.MkdirAll(mountDir, 0755); err != nil {
-		return err
+		return nil, err
 	}
-	defer os.RemoveAll(mountDir)
 
-	// Mount
-	cmd = exec.CommandContext(ctx, "mount", "-o", "loop", outputPath, mountDir)
+	cmd := exec.CommandContext(ctx, "mount", "-o", "loop", imagePath, mountDir)
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("mount failed: %w: %s", err, output)
+		os.Remove(mountDir)
+		return nil, fmt.Errorf("mount failed: %w: %s", err, output)
 	}
 
-	// Ensure unmount on exit
-	defer func() {
+	return sync.OnceFunc(func() {
+		// Remove rather than RemoveAll: a failed unmount leaves the
+		// image's contents there
 		_ = exec.Command("umount", mountDir).Run()
-	}()
-
-	// The umoci unpack creates a bundle structure, rootfs is inside
-	sourceDir := filepath.Join(contentDir, "rootfs")
-	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
-		sourceDir = contentDir // Fallback to direct content dir
-	}
-
-	// Copy content
-	cmd = exec.CommandContext(ctx, "cp", "-a", sourceDir+"/.", mountDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("cp failed: %w: %s", err, output)
-	}
-
-	// Sync before unmount
-	_ = exec.Command("sync").Run()
-
-	return nil
+		os.Remove(mountDir)
+	}), nil
 }
 
-// createSquashfs creates a squashfs image for caching.
-func (f *FsifyConverter) createSquashfs(ctx context.Context, contentDir, outputPath string) error {
+// bundleRootfs returns the rootfs of an unpacked image. umoci unpacks to a
+// bundle with the rootfs inside.
+func bundleRootfs(contentDir string) string {
 	sourceDir := filepath.Join(contentDir, "rootfs")
 	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
-		sourceDir = contentDir
+		return contentDir // Fallback to direct content dir
 	}
+	return sourceDir
+}
 
+// createSquashfs creates a squashfs image of sourceDir for caching.
+func (f *FsifyConverter) createSquashfs(ctx context.Context, sourceDir, outputPath string) error {
 	cmd := exec.CommandContext(ctx, "mksquashfs",
 		sourceDir, outputPath,
 		"-comp", "zstd",
@@ -569,6 +900,38 @@ func (f *FsifyConverter) createSquashfs(ctx context.Context, contentDir, outputP
 	return nil
 }
 
+// ReadOnlyFilesystem reports whether images of a filesystem type can only
+// be mounted read-only.
+func ReadOnlyFilesystem(fsType string) bool {
+	return fsType == "erofs" || fsType == "squashfs"
+}
+
+// createReadOnlyImage builds an erofs or squashfs image of sourceDir. Both
+// are compressed and sized to their contents, so unlike writable images
+// there is no size to work out and nothing to copy.
+func (f *FsifyConverter) createReadOnlyImage(ctx context.Context, sourceDir, outputPath string) error {
+	var cmd *exec.Cmd
+	switch f.config.Filesystem {
+	case "erofs":
+		cmd = exec.CommandContext(ctx, "mkfs.erofs", "-zlz4hc", outputPath, sourceDir)
+	case "squashfs":
+		// lz4 rather than the zstd of createSquashfs: this image is read
+		// on every boot, and decompressed in the guest
+		cmd = exec.CommandContext(ctx, "mksquashfs",
+			sourceDir, outputPath,
+			"-comp", "lz4", "-Xhc",
+			"-noappend")
+	default:
+		return fmt.Errorf("%s is not a read-only filesystem", f.config.Filesystem)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("%s failed: %w: %s", cmd.Args[0], err, output)
+	}
+	return nil
+}
+
 // extractOCIConfig reads OCI config from /etc/fsify-entrypoint in a mounted image.
 func (f *FsifyConverter) extractOCIConfig(imagePath string) *OCIImageConfig {
 	// Mount the image temporarily
@@ -598,13 +961,12 @@ func (f *FsifyConverter) extractOCIConfig(imagePath string) *OCIImageConfig {
 	return &config
 }
 
-// extractOCIConfigFromDir extracts OCI config from an OCI directory.
-func (f *FsifyConverter) extractOCIConfigFromDir(ociDir string) *OCIImageConfig {
-	// Read the index.json to find the manifest
-	indexPath := filepath.Join(ociDir, "index.json")
-	indexData, err := os.ReadFile(indexPath)
+// manifestDigest returns the digest of the first manifest in an OCI
+// directory's index.json, or "" if it can't be read.
+func manifestDigest(ociDir string) string {
+	indexData, err := os.ReadFile(filepath.Join(ociDir, "index.json"))
 	if err != nil {
-		return nil
+		return ""
 	}
 
 	var index struct {
@@ -613,12 +975,45 @@ func (f *FsifyConverter) extractOCIConfigFromDir(ociDir string) *OCIImageConfig
 		} `json:"manifests"`
 	}
 	if err := json.Unmarshal(indexData, &index); err != nil || len(index.Manifests) == 0 {
+		return ""
+	}
+
+	return index.Manifests[0].Digest
+}
+
+// manifestLayers returns the number of layers of the first manifest in an
+// OCI directory, or 0 if it can't be read.
+func manifestLayers(ociDir string) int {
+	algo, hash, ok := strings.Cut(manifestDigest(ociDir), ":")
+	if !ok {
+		return 0
+	}
+
+	manifestData, err := os.ReadFile(filepath.Join(ociDir, "blobs", algo, hash))
+	if err != nil {
+		return 0
+	}
+
+	var manifest struct {
+		Layers []json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return 0
+	}
+
+	return len(manifest.Layers)
+}
+
+// extractOCIConfigFromDir extracts OCI config from an OCI directory.
+func (f *FsifyConverter) extractOCIConfigFromDir(ociDir string) *OCIImageConfig {
+	// Read the index.json to find the manifest
+	digest := manifestDigest(ociDir)
+	if digest == "" {
 		return nil
 	}
 
 	// Parse digest to get blob path
-	manifestDigest := index.Manifests[0].Digest
-	parts := strings.SplitN(manifestDigest, ":", 2)
+	parts := strings.SplitN(digest, ":", 2)
 	if len(parts) != 2 {
 		return nil
 	}
@@ -683,11 +1078,16 @@ func (f *FsifyConverter) embedOCIConfig(rootfsDir string, config *OCIImageConfig
 		targetDir = filepath.Join(rootfsDir, "etc")
 	}
 
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
+	return writeOCIConfig(targetDir, config)
+}
+
+// writeOCIConfig writes OCI config to fsify-entrypoint in etcDir.
+func writeOCIConfig(etcDir string, config *OCIImageConfig) error {
+	if err := os.MkdirAll(etcDir, 0755); err != nil {
 		return err
 	}
 
-	configPath := filepath.Join(targetDir, "fsify-entrypoint")
+	configPath := filepath.Join(etcDir, "fsify-entrypoint")
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
@@ -746,14 +1146,26 @@ func (f *FsifyConverter) Delete(imageRef string) error {
 		return nil
 	}
 
-	// Remove files
-	os.Remove(cached.RootfsPath)
-	if cached.SquashfsPath != "" {
-		os.Remove(cached.SquashfsPath)
+	delete(f.cache, normalizedRef)
+
+	// Remove files, unless another reference to the same image, here or in
+	// another process, shares them
+	shared := false
+	for _, entries := range []map[string]*ConvertedImage{f.cache, f.readCacheFile()} {
+		for ref, img := range entries {
+			if ref != normalizedRef && img.RootfsPath == cached.RootfsPath {
+				shared = true
+			}
+		}
+	}
+	if !shared {
+		os.Remove(cached.RootfsPath)
+		if cached.SquashfsPath != "" {
+			os.Remove(cached.SquashfsPath)
+		}
 	}
 
-	delete(f.cache, normalizedRef)
-	f.saveCache()
+	f.saveCache(normalizedRef)
 
 	return nil
 }
@@ -777,33 +1189,103 @@ func (f *FsifyConverter) cacheFilePath() string {
 
 // loadCache loads the cache from disk.
 func (f *FsifyConverter) loadCache() {
+	for ref, img := range f.readCacheFile() {
+		f.cache[ref] = img
+	}
+}
+
+// readCacheFile returns the entries of the on-disk cache index whose rootfs
+// still exists.
+func (f *FsifyConverter) readCacheFile() map[string]*ConvertedImage {
 	data, err := os.ReadFile(f.cacheFilePath())
 	if err != nil {
-		return
+		return nil
 	}
 
 	var cache map[string]*ConvertedImage
 	if err := json.Unmarshal(data, &cache); err != nil {
-		return
+		return nil
 	}
 
 	// Validate each entry still exists
 	for ref, img := range cache {
-		if _, err := os.Stat(img.RootfsPath); err == nil {
-			f.cache[ref] = img
+		if img == nil {
+			delete(cache, ref)
+			continue
+		}
+		if _, err := os.Stat(img.RootfsPath); err != nil {
+			delete(cache, ref)
 		}
 	}
+	return cache
 }
 
-// saveCache persists the cache to disk.
-func (f *FsifyConverter) saveCache() {
-	data, err := json.MarshalIndent(f.cache, "", "  ")
+// convertedElsewhere returns an image another process has converted since
+// this converter last looked: the same reference, or another reference to
+// the same digest, whose output can be shared. Must be called with the
+// conversion lock held.
+func (f *FsifyConverter) convertedElsewhere(imageRef, digest string) *ConvertedImage {
+	onDisk := f.readCacheFile()
+
+	img := onDisk[imageRef]
+	if img == nil && digest != "" {
+		for _, other := range onDisk {
+			if other.Digest == digest {
+				alias := *other
+				alias.Reference = imageRef
+				img = &alias
+				break
+			}
+		}
+	}
+	if img == nil || !f.baked(img) {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache[imageRef] = img
+	if _, ok := onDisk[imageRef]; !ok {
+		f.saveCache()
+	}
+	return img
+}
+
+// saveCache persists the cache to disk. The index is shared by every
+// process on the node, so it is merged with the entries on disk under a
+// lock and replaced atomically. Removed references are dropped from it.
+// Must be called with f.mu held.
+func (f *FsifyConverter) saveCache(removed ...string) {
+	unlock, err := lockFile(context.Background(), filepath.Join(f.lockDir(), "cache.lock"), nil)
+	if err != nil {
+		f.log.WithError(err).Warn("Failed to lock cache")
+		return
+	}
+	defer unlock()
+
+	merged := f.readCacheFile()
+	if merged == nil {
+		merged = make(map[string]*ConvertedImage, len(f.cache))
+	}
+	for ref, img := range f.cache {
+		merged[ref] = img
+	}
+	for _, ref := range removed {
+		delete(merged, ref)
+	}
+
+	data, err := json.MarshalIndent(merged, "", "  ")
 	if err != nil {
 		f.log.WithError(err).Warn("Failed to marshal cache")
 		return
 	}
 
-	if err := os.WriteFile(f.cacheFilePath(), data, 0644); err != nil {
+	tmp := f.cacheFilePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		f.log.WithError(err).Warn("Failed to write cache")
+		return
+	}
+	if err := os.Rename(tmp, f.cacheFilePath()); err != nil {
 		f.log.WithError(err).Warn("Failed to write cache")
 	}
 }
@@ -1,6 +1,8 @@
 package image
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -34,6 +36,23 @@ func TestNewFsifyConverter(t *testing.T) {
 	}
 }
 
+func TestNewFsifyConverter_ReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := DefaultFsifyConfig()
+	config.OutputDir = filepath.Join(tmpDir, "output")
+	config.TempDir = filepath.Join(tmpDir, "temp")
+	config.Filesystem = "erofs"
+	config.FsifyBinary = os.Args[0]
+
+	f, err := NewFsifyConverter(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewFsifyConverter failed: %v", err)
+	}
+	if f.config.UseFsifyCLI {
+		t.Error("fsify CLI used for a read-only filesystem")
+	}
+}
+
 func TestNormalizeRef(t *testing.T) {
 	f := &FsifyConverter{}
 
@@ -168,3 +187,129 @@ func TestCalculateSize(t *testing.T) {
 		t.Errorf("Size too small: %d", size)
 	}
 }
+
+func TestAuditLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := DefaultFsifyConfig()
+	config.OutputDir = tmpDir
+	config.TempDir = filepath.Join(tmpDir, "temp")
+	config.UseFsifyCLI = false
+
+	log := logrus.NewEntry(logrus.New())
+	f, err := NewFsifyConverter(config, log)
+	if err != nil {
+		t.Fatalf("NewFsifyConverter failed: %v", err)
+	}
+
+	imgPath := filepath.Join(tmpDir, "nginx.img")
+	if err := os.WriteFile(imgPath, []byte("test data"), 0644); err != nil {
+		t.Fatalf("Failed to create dummy image: %v", err)
+	}
+
+	ctx := WithTrigger(context.Background(), "test")
+	prov := f.newProvenance(ctx, time.Now())
+	f.finishProvenance(prov, &ConvertedImage{
+		Digest:     "sha256:1234",
+		RootfsPath: imgPath,
+	})
+	f.audit("library/nginx:latest", prov, nil)
+	f.audit("library/broken:latest", f.newProvenance(ctx, time.Now()), errors.New("pull failed"))
+
+	records, err := ReadAuditLog(filepath.Join(tmpDir, "audit.log"))
+	if err != nil {
+		t.Fatalf("ReadAuditLog failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Got %d records, want 2", len(records))
+	}
+
+	ok := records[0]
+	if !ok.Success || ok.Provenance.TriggeredBy != "test" || ok.Provenance.SourceDigest != "sha256:1234" {
+		t.Errorf("Unexpected success record: %+v", ok.Provenance)
+	}
+	// sha256("test data")
+	want := "sha256:916f0027a575074ce72a331777c3478d6513f786a591bd892da1a577bf2335f9"
+	if ok.Provenance.OutputSHA256 != want {
+		t.Errorf("OutputSHA256 = %s, want %s", ok.Provenance.OutputSHA256, want)
+	}
+	if _, found := ok.Provenance.ToolVersions["skopeo"]; !found {
+		t.Errorf("Missing skopeo tool version")
+	}
+
+	failed := records[1]
+	if failed.Success || failed.Error != "pull failed" {
+		t.Errorf("Unexpected failure record: %+v", failed)
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if d := manifestDigest(tmpDir); d != "" {
+		t.Errorf("manifestDigest on empty dir = %q, want empty", d)
+	}
+
+	index := `{"manifests":[{"digest":"sha256:abcd"}]}`
+	if err := os.WriteFile(filepath.Join(tmpDir, "index.json"), []byte(index), 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+	if d := manifestDigest(tmpDir); d != "sha256:abcd" {
+		t.Errorf("manifestDigest = %q, want sha256:abcd", d)
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := DefaultFsifyConfig()
+	config.OutputDir = tmpDir
+	config.TempDir = filepath.Join(tmpDir, "temp")
+
+	log := logrus.NewEntry(logrus.New())
+	f1, _ := NewFsifyConverter(config, log)
+	f2, _ := NewFsifyConverter(config, log)
+
+	writeImage := func(name string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte("test data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Two processes saving different images both end up in the index
+	f1.mu.Lock()
+	f1.cache["library/nginx:1.25"] = &ConvertedImage{Reference: "library/nginx:1.25", Digest: "sha256:aaa", RootfsPath: writeImage("nginx.img")}
+	f1.saveCache()
+	f1.mu.Unlock()
+
+	f2.mu.Lock()
+	f2.cache["library/redis:7"] = &ConvertedImage{Reference: "library/redis:7", Digest: "sha256:bbb", RootfsPath: writeImage("redis.img")}
+	f2.saveCache()
+	f2.mu.Unlock()
+
+	onDisk := f1.readCacheFile()
+	if len(onDisk) != 2 {
+		t.Fatalf("index holds %d images, want 2", len(onDisk))
+	}
+
+	// Another reference to a digest converted elsewhere reuses its output
+	img := f2.convertedElsewhere("library/nginx@sha256:aaa", "sha256:aaa")
+	if img == nil || img.RootfsPath != filepath.Join(tmpDir, "nginx.img") || img.Reference != "library/nginx@sha256:aaa" {
+		t.Fatalf("convertedElsewhere() = %+v", img)
+	}
+	if f2.convertedElsewhere("library/alpine:3", "sha256:ccc") != nil {
+		t.Error("convertedElsewhere() found an image nobody converted")
+	}
+
+	// Deleting one reference keeps the output the other still uses
+	if err := f2.Delete("library/nginx@sha256:aaa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "nginx.img")); err != nil {
+		t.Errorf("shared rootfs removed: %v", err)
+	}
+	onDisk = f1.readCacheFile()
+	if _, ok := onDisk["library/nginx@sha256:aaa"]; ok || onDisk["library/nginx:1.25"] == nil {
+		t.Errorf("index after delete = %v", onDisk)
+	}
+}
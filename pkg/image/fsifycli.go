@@ -0,0 +1,133 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The fsify CLI is whatever binary is installed at FsifyBinary, so before
+// using it the converter checks that it is recent enough and accepts the
+// flags convertWithCLI passes. An fsify that doesn't is skipped in favour
+// of the native implementation rather than failing every conversion.
+
+// DefaultMinFsifyVersion is the oldest fsify CLI used by default.
+const DefaultMinFsifyVersion = "0.1.0"
+
+var semverPattern = regexp.MustCompile(`v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// pulledDigestPattern matches the manifest digest fsify reports pulling.
+var pulledDigestPattern = regexp.MustCompile(`(?i)digest\W+(sha256:[0-9a-f]{64})\b`)
+
+// fsifyCLI is what an installed fsify binary reports about itself.
+type fsifyCLI struct {
+	version string
+	help    string
+}
+
+// detectFsifyCLI asks the fsify binary for its version and usage.
+func detectFsifyCLI(ctx context.Context, binary string) (*fsifyCLI, error) {
+	version := toolVersion(ctx, binary, "--version")
+	if version == "unknown" || semverPattern.FindString(version) == "" {
+		return nil, fmt.Errorf("%s --version reported no version", binary)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+	// Go's flag package exits non-zero after printing usage
+	help, _ := exec.CommandContext(ctx, binary, "--help").CombinedOutput()
+	if len(help) == 0 {
+		return nil, fmt.Errorf("%s --help printed nothing", binary)
+	}
+
+	return &fsifyCLI{version: semverPattern.FindString(version), help: string(help)}, nil
+}
+
+// hasFlag reports whether the usage lists a flag, with one dash or two.
+func (c *fsifyCLI) hasFlag(flag string) bool {
+	name := regexp.QuoteMeta(strings.TrimLeft(flag, "-"))
+	return regexp.MustCompile(`(^|[\s,\[])--?` + name + `($|[\s,=\]])`).MatchString(c.help)
+}
+
+// check returns why the CLI can't be used for a conversion configured by
+// config, or nil if it can.
+func (c *fsifyCLI) check(config FsifyConfig) error {
+	minVersion := config.MinFsifyVersion
+	if minVersion == "" {
+		minVersion = DefaultMinFsifyVersion
+	}
+	older, err := versionLess(c.version, minVersion)
+	if err != nil {
+		return err
+	}
+	if older {
+		return fmt.Errorf("fsify %s is older than the minimum %s", c.version, minVersion)
+	}
+
+	var missing []string
+	for _, flag := range fsifyFlags(config) {
+		if !c.hasFlag(flag) {
+			missing = append(missing, flag)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("fsify %s does not support %s", c.version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// fsifyFlags returns the flags convertWithCLI passes for config.
+func fsifyFlags(config FsifyConfig) []string {
+	flags := []string{"-o", "-fs", "-s"}
+	if config.Preallocate {
+		flags = append(flags, "--preallocate")
+	}
+	if config.DualOutput {
+		flags = append(flags, "--dual-output")
+	}
+	return flags
+}
+
+// versionLess reports whether version a is older than b. Both are
+// major.minor[.patch], with an optional leading "v".
+func versionLess(a, b string) (bool, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			return va[i] < vb[i], nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(s string) ([3]int, error) {
+	var v [3]int
+	m := semverPattern.FindStringSubmatch(s)
+	if m == nil || m[0] != strings.TrimSpace(s) {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	for i := range v {
+		v[i], _ = strconv.Atoi(m[i+1])
+	}
+	return v, nil
+}
+
+// pulledDigest returns the manifest digest fsify's output reports pulling,
+// the last one if it reports several, or "" if it reports none.
+func pulledDigest(output []byte) string {
+	matches := pulledDigestPattern.FindAllSubmatch(output, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return string(matches[len(matches)-1][1])
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeFsify writes an fsify stand-in that reports version and lists flags
+// in its usage.
+func fakeFsify(t *testing.T, version string, flags ...string) string {
+	t.Helper()
+	script := "#!/bin/sh\nif [ \"$1\" = --version ]; then echo 'fsify version " + version + "'; exit 0; fi\necho 'Usage of fsify:'\n"
+	for _, flag := range flags {
+		script += "echo '  " + flag + " string'\n"
+	}
+	script += "exit 2\n"
+	path := filepath.Join(t.TempDir(), "fsify")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFsifyCLICheck(t *testing.T) {
+	all := []string{"-o", "-fs", "-s", "-preallocate", "-dual-output"}
+	tests := []struct {
+		name    string
+		version string
+		flags   []string
+		modify  func(*FsifyConfig)
+		wantErr bool
+	}{
+		{name: "compatible", version: "v0.3.1", flags: all},
+		{name: "older than minimum", version: "v0.2.9", flags: all,
+			modify: func(c *FsifyConfig) { c.MinFsifyVersion = "0.3.0" }, wantErr: true},
+		{name: "pinned minimum met", version: "1.0", flags: all,
+			modify: func(c *FsifyConfig) { c.MinFsifyVersion = "v0.9.2" }},
+		{name: "missing required flag", version: "v0.3.1", flags: []string{"-o", "-s"}, wantErr: true},
+		{name: "missing optional flag in use", version: "v0.3.1", flags: []string{"-o", "-fs", "-s"},
+			modify: func(c *FsifyConfig) { c.DualOutput = true }, wantErr: true},
+		{name: "optional flag unused", version: "v0.3.1", flags: []string{"-o", "-fs", "-s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultFsifyConfig()
+			if tt.modify != nil {
+				tt.modify(&config)
+			}
+			cli, err := detectFsifyCLI(context.Background(), fakeFsify(t, tt.version, tt.flags...))
+			if err != nil {
+				t.Fatalf("detectFsifyCLI() error = %v", err)
+			}
+			if err := cli.check(config); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDetectFsifyCLI_NoVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsify")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho nope\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := detectFsifyCLI(context.Background(), path); err == nil {
+		t.Error("detectFsifyCLI() accepted a binary without a version")
+	}
+}
+
+func TestNewFsifyConverter_IncompatibleCLI(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := DefaultFsifyConfig()
+	config.OutputDir = filepath.Join(tmpDir, "output")
+	config.TempDir = filepath.Join(tmpDir, "temp")
+	config.FsifyBinary = fakeFsify(t, "v0.0.1", "-o", "-fs", "-s")
+
+	f, err := NewFsifyConverter(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewFsifyConverter failed: %v", err)
+	}
+	if f.config.UseFsifyCLI {
+		t.Error("incompatible fsify CLI was used")
+	}
+}
+
+func TestPulledDigest(t *testing.T) {
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"Digest: " + a + "\n", a},
+		{"copying config\nmanifest digest=" + a + "\n", a},
+		{"index digest: " + a + "\nplatform digest: " + b + "\n", b},
+		{"layer " + a + " done\n", ""},
+		{"digest: sha256:1234\n", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := pulledDigest([]byte(tt.output)); got != tt.want {
+			t.Errorf("pulledDigest(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
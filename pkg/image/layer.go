@@ -0,0 +1,285 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted from lower layers.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower contents are hidden.
+	whiteoutOpaque = ".wh..wh..opq"
+
+	// maxSymlinkHops bounds symlink resolution, like the kernel's limit.
+	maxSymlinkHops = 40
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// layerApplier extracts layers into a filesystem tree, one after another.
+type layerApplier struct {
+	root string
+
+	// written holds the entries of the current layer, which an opaque
+	// whiteout in the same layer keeps
+	written map[string]bool
+}
+
+// applyLayer applies a layer tarball, gzipped or not, to the tree at root.
+// Entries keep their ownership, modes, times and extended attributes, and
+// whiteouts delete what lower layers created. Paths are resolved as if
+// root were /, so no entry lands outside it.
+func applyLayer(root string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	var tr *tar.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	case bytes.Equal(magic, zstdMagic):
+		return fmt.Errorf("%w: zstd layer", errStreamUnsupported)
+	default:
+		tr = tar.NewReader(br)
+	}
+
+	a := &layerApplier{root: root, written: make(map[string]bool)}
+
+	// Directory times are set last, as creating entries changes them
+	type dirTimes struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirTimes
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid layer: %w", err)
+		}
+
+		target, err := a.apply(hdr, tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if target != "" && hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{target, hdr})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply applies one entry, returning where it was created, or "" for
+// whiteouts and entries that create nothing.
+func (a *layerApplier) apply(hdr *tar.Header, r io.Reader) (string, error) {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return "", nil
+	}
+	dir, base := path.Split(name)
+
+	parent, err := a.resolveDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if base == whiteoutOpaque {
+		return "", a.clearDir(dir, parent)
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return "", os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+
+	target := filepath.Join(parent, base)
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return "", err
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return "", err
+		}
+	case tar.TypeLink:
+		linkDir, linkBase := path.Split(path.Clean("/" + hdr.Linkname))
+		source, err := a.resolveDir(linkDir)
+		if err != nil {
+			return "", err
+		}
+		// linkat doesn't follow a symlink source, so this stays in root
+		if err := os.Link(filepath.Join(source, linkBase), target); err != nil {
+			return "", err
+		}
+		a.written[name] = true
+		return target, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, kind|mode, int(dev)); err != nil {
+			return "", err
+		}
+	default:
+		// Global headers and the like carry no file
+		return "", nil
+	}
+	a.written[name] = true
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return "", err
+	}
+	for key, value := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(key, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return "", fmt.Errorf("failed to set %s: %w", attr, err)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return target, setTimes(target, hdr)
+	}
+
+	// After chown, which clears the setuid and setgid bits
+	if err := unix.Chmod(target, mode); err != nil {
+		return "", err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return target, nil
+	}
+	return target, setTimes(target, hdr)
+}
+
+// resolveDir returns the host path of a directory of the tree, creating it
+// if it's missing. Symlinks on the way are followed as if root were /.
+func (a *layerApplier) resolveDir(dir string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(dir, "/")
+	hops := 0
+
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		host := filepath.Join(a.root, next)
+		fi, err := os.Lstat(host)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(host, 0755); err != nil {
+				return "", err
+			}
+			resolved = next
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			if hops++; hops > maxSymlinkHops {
+				return "", fmt.Errorf("too many symlinks resolving %s", dir)
+			}
+			link, err := os.Readlink(host)
+			if err != nil {
+				return "", err
+			}
+			if path.IsAbs(link) {
+				resolved = "/"
+			}
+			pending = append(strings.Split(link, "/"), pending...)
+		case fi.IsDir():
+			resolved = next
+		default:
+			return "", fmt.Errorf("%s is not a directory", next)
+		}
+	}
+	return filepath.Join(a.root, resolved), nil
+}
+
+// clearDir empties a directory for an opaque whiteout, keeping what the
+// current layer put there. Directories the layer recreated lose their
+// lower contents too.
+func (a *layerApplier) clearDir(dir, host string) error {
+	entries, err := os.ReadDir(host)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if a.written[name] {
+			if entry.IsDir() {
+				if err := a.clearDir(name, filepath.Join(host, entry.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(host, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTimes sets the access and modification times of an entry, not
+// following symlinks.
+func setTimes(target string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,144 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// layerEntry is a tar entry of a test layer; content makes it a file.
+type layerEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     int64
+}
+
+func buildLayer(t *testing.T, compress bool, entries ...layerEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Size:     int64(len(e.content)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			ModTime:  time.Unix(1700000000, 0),
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestApplyLayer(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "rootfs")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	lower := buildLayer(t, true,
+		layerEntry{name: "etc/", typeflag: tar.TypeDir, mode: 0755},
+		layerEntry{name: "etc/passwd", typeflag: tar.TypeReg, content: "root:x:0:0", mode: 0640},
+		layerEntry{name: "etc/old", typeflag: tar.TypeReg, content: "old"},
+		layerEntry{name: "etc/passwd-", typeflag: tar.TypeLink, linkname: "etc/passwd"},
+		layerEntry{name: "var/cache/app/a", typeflag: tar.TypeReg, content: "a"},
+		layerEntry{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0755},
+		layerEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		layerEntry{name: "escape", typeflag: tar.TypeSymlink, linkname: "../../../outside"},
+	)
+	if err := applyLayer(root, lower); err != nil {
+		t.Fatalf("applyLayer(lower) error = %v", err)
+	}
+
+	upper := buildLayer(t, false,
+		layerEntry{name: "etc/.wh.old", typeflag: tar.TypeReg},
+		layerEntry{name: "var/cache/app/", typeflag: tar.TypeDir, mode: 0755},
+		layerEntry{name: "var/cache/app/b", typeflag: tar.TypeReg, content: "b"},
+		layerEntry{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		layerEntry{name: "lib/libc.so", typeflag: tar.TypeReg, content: "elf"},
+		layerEntry{name: "escape/evil", typeflag: tar.TypeReg, content: "evil"},
+		layerEntry{name: "/../../etc/shadow", typeflag: tar.TypeReg, content: "x"},
+	)
+	if err := applyLayer(root, upper); err != nil {
+		t.Fatalf("applyLayer(upper) error = %v", err)
+	}
+
+	files := map[string]string{
+		"etc/passwd":      "root:x:0:0",
+		"etc/passwd-":     "root:x:0:0",
+		"var/cache/app/b": "b",
+		"usr/lib/libc.so": "elf",
+		"outside/evil":    "evil",
+		"etc/shadow":      "x",
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"etc/old", "var/cache/app/a"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s survived its whiteout: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "outside")); !os.IsNotExist(err) {
+		t.Errorf("symlink led outside the root: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(root, "etc/passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("etc/passwd mode %v, mtime %v", fi.Mode(), fi.ModTime())
+	}
+}
+
+func TestWithDigest(t *testing.T) {
+	tests := map[string]string{
+		"library/nginx:latest":         "library/nginx@sha256:aa",
+		"my.reg:5000/repo/img:tag":     "my.reg:5000/repo/img@sha256:aa",
+		"my.reg:5000/repo/img":         "my.reg:5000/repo/img@sha256:aa",
+		"library/ubuntu@sha256:12345":  "library/ubuntu@sha256:aa",
+		"docker://quay.io/coreos/etcd": "docker://quay.io/coreos/etcd@sha256:aa",
+	}
+	for ref, want := range tests {
+		if got := withDigest(ref, "sha256:aa"); got != want {
+			t.Errorf("withDigest(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockRetryInterval is how often a blocked conversion retries its lock.
+const lockRetryInterval = 100 * time.Millisecond
+
+// lockDir returns the directory holding conversion lock files. They live
+// next to the output so every shim on the node sees the same locks.
+func (f *FsifyConverter) lockDir() string {
+	return filepath.Join(f.config.OutputDir, ".locks")
+}
+
+// conversionLockKey returns the lock that serializes converting an image:
+// its digest when known, so two references to the same image share one
+// conversion, otherwise its output file.
+func (f *FsifyConverter) conversionLockKey(imageRef, digest string) string {
+	if _, hash, ok := strings.Cut(digest, ":"); ok && hash != "" {
+		return "digest-" + filepath.Base(hash)
+	}
+	return "ref-" + f.sanitizeName(imageRef)
+}
+
+// lockFile takes an exclusive flock on path, waiting until it is free or
+// ctx is done. The lock is released when the returned function is called
+// or the process exits, so a crashed converter never leaves it held.
+func lockFile(ctx context.Context, path string, onWait func()) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+
+	waited := false
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if !waited && onWait != nil {
+			onWait()
+			waited = true
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
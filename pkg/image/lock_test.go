@@ -0,0 +1,67 @@
+package image
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks", "nginx.lock")
+
+	unlock, err := lockFile(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("lockFile() error = %v", err)
+	}
+
+	// flock locks belong to the open file, so a second open conflicts
+	// just as another process would
+	ctx, cancel := context.WithTimeout(context.Background(), 3*lockRetryInterval)
+	defer cancel()
+	waited := false
+	if _, err := lockFile(ctx, path, func() { waited = true }); err != context.DeadlineExceeded {
+		t.Fatalf("lockFile() on a held lock = %v, want DeadlineExceeded", err)
+	}
+	if !waited {
+		t.Error("onWait not called for a held lock")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		unlock2, err := lockFile(context.Background(), path, nil)
+		if err != nil {
+			t.Errorf("lockFile() error = %v", err)
+			close(acquired)
+			return
+		}
+		acquired <- unlock2
+	}()
+
+	time.Sleep(lockRetryInterval)
+	unlock()
+
+	select {
+	case unlock2 := <-acquired:
+		if unlock2 != nil {
+			unlock2()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+}
+
+func TestConversionLockKey(t *testing.T) {
+	f := &FsifyConverter{}
+
+	// References to the same digest share a lock
+	a := f.conversionLockKey("library/nginx:1.25", "sha256:abc123")
+	b := f.conversionLockKey("library/nginx@sha256:abc123", "sha256:abc123")
+	if a != b || a != "digest-abc123" {
+		t.Errorf("keys = %q, %q, want digest-abc123", a, b)
+	}
+
+	if got := f.conversionLockKey("library/nginx:latest", ""); got != "ref-nginx-latest" {
+		t.Errorf("key without digest = %q", got)
+	}
+}
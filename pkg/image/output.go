@@ -0,0 +1,113 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A conversion builds its images under hidden names in OutputDir and only
+// renames them into place once they are complete and on disk, so a failed
+// mkfs or cp, or a crash, never leaves a truncated image where the cache
+// would serve it. fcctl gc removes hidden files left by a crash. The
+// partial name is taken as soon as a conversion starts, so Converting sees
+// it through every stage.
+
+const (
+	// DefaultStageAttempts is how often a failing conversion stage is run
+	// before the conversion fails.
+	DefaultStageAttempts = 3
+)
+
+// stageRetryDelay is the wait before a failed stage's first retry; it
+// doubles with each further retry.
+var stageRetryDelay = 2 * time.Second
+
+// partialPath returns the hidden path an image destined for path is built
+// at. The extension is kept, so the squashfs the fsify CLI derives from a
+// partial rootfs's path is partial too.
+func partialPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(filepath.Base(path), ext)
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.partial-%d%s", base, os.Getpid(), ext))
+}
+
+// Converting reports whether an image destined for path is being built,
+// by this process or another, and isn't in place yet. Partial images left
+// by a converter that has exited don't count.
+func Converting(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return false
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(filepath.Base(path), ext)
+	prefix := filepath.Join(filepath.Dir(path), "."+base+".partial-")
+	partials, _ := filepath.Glob(prefix + "*" + ext)
+	for _, partial := range partials {
+		pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(partial, prefix), ext))
+		if err != nil {
+			continue
+		}
+		if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+			return true
+		}
+	}
+	return false
+}
+
+// commitOutput flushes the image at partial to disk and renames it to path.
+func commitOutput(partial, path string) error {
+	if err := syncPath(partial); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+	// Persist the rename too
+	return syncPath(filepath.Dir(path))
+}
+
+// syncPath fsyncs a file or directory.
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// retryStage runs a conversion stage until it succeeds, up to StageAttempts
+// times. reset, if set, clears what a failed attempt left behind before the
+// next one.
+func (f *FsifyConverter) retryStage(ctx context.Context, stage string, reset func(), run func() error) error {
+	attempts := max(f.config.StageAttempts, 1)
+	delay := stageRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		f.log.WithError(err).WithFields(logrus.Fields{
+			"stage":   stage,
+			"attempt": attempt,
+		}).Warn("Conversion stage failed, retrying")
+		if reset != nil {
+			reset()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,163 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failingFsify writes an fsify stand-in that writes a truncated image and
+// fails on its first failures runs, and writes a whole one after that. Each
+// run is counted in the returned file.
+func failingFsify(t *testing.T, failures int) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := "#!/bin/sh\necho run >> " + runs + "\n" +
+		"if [ $(wc -l < " + runs + ") -le " + strconv.Itoa(failures) + " ]; then printf trunc > \"$2\"; exit 1; fi\n" +
+		"printf complete > \"$2\"\n"
+	path := filepath.Join(dir, "fsify")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, runs
+}
+
+func newTestConverter(t *testing.T, binary string) *FsifyConverter {
+	t.Helper()
+	config := DefaultFsifyConfig()
+	config.OutputDir = t.TempDir()
+	config.TempDir = t.TempDir()
+	config.FsifyBinary = binary
+	config.SkopeoPath = filepath.Join(t.TempDir(), "skopeo")
+	return &FsifyConverter{config: config, log: logrus.NewEntry(logrus.New())}
+}
+
+func countRuns(t *testing.T, runs string) int {
+	t.Helper()
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestConvertWithCLI_RetriesFailedStage(t *testing.T) {
+	defer func(d time.Duration) { stageRetryDelay = d }(stageRetryDelay)
+	stageRetryDelay = time.Millisecond
+
+	binary, runs := failingFsify(t, 2)
+	f := newTestConverter(t, binary)
+
+	result, err := f.convertWithCLI(context.Background(), "alpine:3.19")
+	if err != nil {
+		t.Fatalf("convertWithCLI() failed: %v", err)
+	}
+	if n := countRuns(t, runs); n != 3 {
+		t.Errorf("fsify ran %d times, want 3", n)
+	}
+	data, err := os.ReadFile(result.RootfsPath)
+	if err != nil || string(data) != "complete" {
+		t.Errorf("rootfs = %q, %v; want the complete image", data, err)
+	}
+	entries, _ := os.ReadDir(f.config.OutputDir)
+	if len(entries) != 1 {
+		t.Errorf("OutputDir holds %d files, want only the image", len(entries))
+	}
+}
+
+func TestConvertWithCLI_PulledDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	path := filepath.Join(t.TempDir(), "fsify")
+	script := "#!/bin/sh\necho 'Pulled alpine:3.19, digest: " + digest + "'\nprintf complete > \"$2\"\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestConverter(t, path)
+
+	// The digest comes from the pull, not from asking skopeo again
+	result, err := f.convertWithCLI(context.Background(), "alpine:3.19")
+	if err != nil || result.Digest != digest {
+		t.Errorf("convertWithCLI() = %+v, %v, want digest %s", result, err, digest)
+	}
+
+	// An fsify that doesn't report one leaves the digest unknown
+	binary, _ := failingFsify(t, 0)
+	f = newTestConverter(t, binary)
+	if result, err := f.convertWithCLI(context.Background(), "alpine:3.19"); err != nil || result.Digest != "" {
+		t.Errorf("convertWithCLI() = %+v, %v, want no digest", result, err)
+	}
+}
+
+func TestConvertWithCLI_FailureLeavesNoImage(t *testing.T) {
+	defer func(d time.Duration) { stageRetryDelay = d }(stageRetryDelay)
+	stageRetryDelay = time.Millisecond
+
+	binary, runs := failingFsify(t, 9)
+	f := newTestConverter(t, binary)
+
+	if _, err := f.convertWithCLI(context.Background(), "alpine:3.19"); err == nil {
+		t.Fatal("convertWithCLI() succeeded with a failing fsify")
+	}
+	if n := countRuns(t, runs); n != DefaultStageAttempts {
+		t.Errorf("fsify ran %d times, want %d", n, DefaultStageAttempts)
+	}
+	// Neither the truncated image nor its partial may be left behind
+	entries, _ := os.ReadDir(f.config.OutputDir)
+	for _, entry := range entries {
+		t.Errorf("failed conversion left %s", entry.Name())
+	}
+}
+
+func TestRetryStage_StopsWhenCancelled(t *testing.T) {
+	f := newTestConverter(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	err := f.retryStage(ctx, "pull", nil, func() error {
+		runs++
+		cancel()
+		return context.Canceled
+	})
+	if err == nil || runs != 1 {
+		t.Errorf("retryStage() = %v after %d runs, want an error after 1", err, runs)
+	}
+}
+
+func TestPartialPath(t *testing.T) {
+	partial := partialPath("/var/lib/images/nginx-latest.img")
+	if filepath.Dir(partial) != "/var/lib/images" || !strings.HasPrefix(filepath.Base(partial), ".nginx-latest.") || filepath.Ext(partial) != ".img" {
+		t.Errorf("partialPath() = %q", partial)
+	}
+	// The fsify CLI derives the squashfs from the rootfs's path
+	squashfs := strings.TrimSuffix(partial, ".img") + ".squashfs"
+	if want := partialPath("/var/lib/images/nginx-latest.squashfs"); squashfs != want {
+		t.Errorf("derived squashfs = %q, want %q", squashfs, want)
+	}
+}
+
+func TestConverting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nginx-latest.img")
+	if Converting(path) {
+		t.Error("Converting() with nothing built")
+	}
+	partial := partialPath(path)
+	if err := os.WriteFile(partial, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !Converting(path) {
+		t.Error("Converting() = false with a partial image")
+	}
+	if err := os.Rename(partial, path); err != nil {
+		t.Fatal(err)
+	}
+	if Converting(path) {
+		t.Error("Converting() = true once the image is in place")
+	}
+}
@@ -0,0 +1,317 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConversionPhase is the step a conversion is in.
+type ConversionPhase string
+
+const (
+	// PhaseWaiting waits for another process converting the same image.
+	PhaseWaiting ConversionPhase = "waiting"
+	// PhasePull downloads the image's blobs with skopeo.
+	PhasePull ConversionPhase = "pull"
+	// PhaseUnpack unpacks the layers with umoci.
+	PhaseUnpack ConversionPhase = "unpack"
+	// PhaseStream pulls layers and applies them to the filesystem image
+	// at once.
+	PhaseStream ConversionPhase = "stream"
+	// PhaseMkfs creates the filesystem image.
+	PhaseMkfs ConversionPhase = "mkfs"
+	// PhaseCopy copies the rootfs into the filesystem image.
+	PhaseCopy ConversionPhase = "copy"
+	// PhaseSquashfs builds the squashfs cache image.
+	PhaseSquashfs ConversionPhase = "squashfs"
+	// PhaseRemote waits for the remote builder.
+	PhaseRemote ConversionPhase = "remote"
+	// PhaseFsify runs the fsify CLI, which reports no finer progress.
+	PhaseFsify ConversionPhase = "fsify"
+	// PhaseDone and PhaseFailed end a conversion.
+	PhaseDone   ConversionPhase = "done"
+	PhaseFailed ConversionPhase = "failed"
+)
+
+// ConversionProgress is a snapshot of a conversion.
+type ConversionProgress struct {
+	Image string          `json:"image"`
+	Phase ConversionPhase `json:"phase"`
+
+	// BytesPulled is the size of the blobs downloaded so far.
+	BytesPulled int64 `json:"bytes_pulled"`
+
+	// LayersUnpacked of LayersTotal, known once the pull finished.
+	LayersTotal    int `json:"layers_total,omitempty"`
+	LayersUnpacked int `json:"layers_unpacked"`
+
+	// BytesCopied of BytesToCopy into the filesystem image.
+	BytesCopied int64 `json:"bytes_copied"`
+	BytesToCopy int64 `json:"bytes_to_copy,omitempty"`
+
+	// RootfsPath is set when the conversion is done, Error when it failed.
+	RootfsPath string `json:"rootfs_path,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the conversion is done or failed.
+func (p ConversionProgress) Finished() bool {
+	return p.Phase == PhaseDone || p.Phase == PhaseFailed
+}
+
+// ProgressFunc receives the progress of a conversion, in order, from a
+// goroutine of its own. Updates arriving while it runs are coalesced.
+type ProgressFunc func(ConversionProgress)
+
+// progressInterval is how often byte counts are sampled while a step runs.
+const progressInterval = time.Second
+
+// progressTracker records the progress of one conversion and hands it to
+// watchers. Its methods are no-ops on a nil tracker.
+type progressTracker struct {
+	mu       sync.Mutex
+	state    ConversionProgress
+	watchers map[chan ConversionProgress]struct{}
+	done     bool
+}
+
+func newProgressTracker(imageRef string) *progressTracker {
+	now := time.Now()
+	return &progressTracker{
+		state: ConversionProgress{
+			Image:     imageRef,
+			Phase:     PhaseWaiting,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+		watchers: make(map[chan ConversionProgress]struct{}),
+	}
+}
+
+// update changes the progress and sends it to the watchers.
+func (p *progressTracker) update(fn func(*ConversionProgress)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	fn(&p.state)
+	p.state.UpdatedAt = time.Now()
+	for ch := range p.watchers {
+		sendLatest(ch, p.state)
+	}
+}
+
+// setPhase moves the conversion to a phase.
+func (p *progressTracker) setPhase(phase ConversionPhase) {
+	p.update(func(s *ConversionProgress) { s.Phase = phase })
+}
+
+// finish records the outcome and closes the watchers' channels.
+func (p *progressTracker) finish(result *ConvertedImage, err error) {
+	p.update(func(s *ConversionProgress) {
+		if err != nil {
+			s.Phase = PhaseFailed
+			s.Error = err.Error()
+			return
+		}
+		s.Phase = PhaseDone
+		s.RootfsPath = result.RootfsPath
+	})
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	for ch := range p.watchers {
+		close(ch)
+	}
+	p.watchers = nil
+}
+
+// snapshot returns the current progress.
+func (p *progressTracker) snapshot() ConversionProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// watch returns a channel that receives the current progress and every
+// update after it, and is closed when the conversion finishes. Slow readers
+// miss intermediate updates but always see the latest. Call the returned
+// function to stop watching early.
+func (p *progressTracker) watch() (<-chan ConversionProgress, func()) {
+	ch := make(chan ConversionProgress, 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch <- p.state
+	if p.done {
+		close(ch)
+		return ch, func() {}
+	}
+	p.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.watchers[ch]; ok {
+			delete(p.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// sample calls measure every progressInterval until the returned function
+// is called, for steps run by tools that report no progress themselves.
+func (p *progressTracker) sample(measure func(*ConversionProgress)) func() {
+	if p == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.update(measure)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		// One last sample so the step ends on its final count
+		p.update(measure)
+	}
+}
+
+// followProgress calls fn with the progress of a conversion until it
+// finishes or the returned function is called.
+func followProgress(p *progressTracker, fn ProgressFunc) func() {
+	if p == nil || fn == nil {
+		return func() {}
+	}
+	ch, stop := p.watch()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := range ch {
+			fn(v)
+		}
+	}()
+	return func() {
+		stop()
+		<-done
+	}
+}
+
+// lineWatcher collects a command's output and calls onMatch for every line
+// containing match.
+type lineWatcher struct {
+	out     io.Writer
+	match   string
+	onMatch func()
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *lineWatcher) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, data...)
+	for {
+		line, rest, ok := bytes.Cut(w.partial, []byte("\n"))
+		if !ok {
+			break
+		}
+		if bytes.Contains(line, []byte(w.match)) {
+			w.onMatch()
+		}
+		w.partial = rest
+	}
+	return w.out.Write(data)
+}
+
+// sendLatest sends a value on a channel of capacity one, replacing a value
+// the reader hasn't taken yet.
+func sendLatest(ch chan ConversionProgress, v ConversionProgress) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- v
+}
+
+// Progress returns the conversions running in this process, oldest first.
+func (f *FsifyConverter) Progress() []ConversionProgress {
+	f.mu.RLock()
+	trackers := make([]*progressTracker, 0, len(f.progress))
+	for _, p := range f.progress {
+		trackers = append(trackers, p)
+	}
+	f.mu.RUnlock()
+
+	result := make([]ConversionProgress, 0, len(trackers))
+	for _, p := range trackers {
+		result = append(result, p.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+// WatchProgress follows a conversion running in this process, as returned
+// by the tracker's watch. ok is false if the image isn't being converted.
+func (f *FsifyConverter) WatchProgress(imageRef string) (<-chan ConversionProgress, func(), bool) {
+	f.mu.RLock()
+	p, ok := f.progress[f.normalizeRef(imageRef)]
+	f.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	ch, stop := p.watch()
+	return ch, stop, true
+}
+
+// dirSize returns the apparent size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// fsUsed returns the bytes in use on the filesystem mounted at dir.
+func fsUsed(dir string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0
+	}
+	return int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+}
@@ -0,0 +1,148 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestProgressTracker(t *testing.T) {
+	p := newProgressTracker("docker.io/library/nginx:latest")
+
+	ch, stop := p.watch()
+	defer stop()
+
+	first := <-ch
+	if first.Phase != PhaseWaiting {
+		t.Errorf("first update phase = %s, want %s", first.Phase, PhaseWaiting)
+	}
+
+	p.setPhase(PhasePull)
+	p.update(func(s *ConversionProgress) { s.BytesPulled = 1024 })
+	p.finish(&ConvertedImage{RootfsPath: "/var/lib/fc-cri/rootfs/nginx.img"}, nil)
+
+	var last ConversionProgress
+	for update := range ch {
+		last = update
+	}
+	if last.Phase != PhaseDone || last.RootfsPath == "" {
+		t.Errorf("last update = %+v, want done with a rootfs path", last)
+	}
+	if last.BytesPulled != 1024 {
+		t.Errorf("BytesPulled = %d, want 1024", last.BytesPulled)
+	}
+
+	// Watching a finished conversion returns its outcome
+	ch, _ = p.watch()
+	if got := <-ch; got.Phase != PhaseDone {
+		t.Errorf("late watcher phase = %s, want %s", got.Phase, PhaseDone)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("late watcher channel not closed")
+	}
+}
+
+func TestLineWatcher(t *testing.T) {
+	var out bytes.Buffer
+	count := 0
+	w := &lineWatcher{out: &out, match: "unpack layer", onMatch: func() { count++ }}
+
+	chunks := []string{
+		"   • unpack layer: sha256:aaa\n   • unpack la",
+		"yer: sha256:bbb\n",
+		"   • unpacked image bundle\n",
+	}
+	for _, chunk := range chunks {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count != 2 {
+		t.Errorf("matched %d lines, want 2", count)
+	}
+	if out.Len() == 0 {
+		t.Error("output not collected")
+	}
+}
+
+var errFakeConversion = errors.New("skopeo copy failed")
+
+func TestControlServerWatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := DefaultFsifyConfig()
+	config.OutputDir = filepath.Join(tmpDir, "output")
+	config.TempDir = filepath.Join(tmpDir, "temp")
+
+	log := logrus.NewEntry(logrus.New())
+	f, err := NewFsifyConverter(config, log)
+	if err != nil {
+		t.Fatalf("NewFsifyConverter failed: %v", err)
+	}
+
+	imageRef := "library/nginx:latest"
+	tracker := newProgressTracker(imageRef)
+	tracker.setPhase(PhaseCopy)
+	f.progress[imageRef] = tracker
+
+	server := httptest.NewServer(NewControlServer(f, log).Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/images/conversions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conversions []ConversionProgress
+	err = json.NewDecoder(resp.Body).Decode(&conversions)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversions) != 1 || conversions[0].Phase != PhaseCopy {
+		t.Fatalf("conversions = %+v, want one copying", conversions)
+	}
+
+	resp, err = http.Get(server.URL + "/v1/images/conversions/watch?image=nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch status = %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatal("no progress from watch")
+	}
+	tracker.finish(nil, errFakeConversion)
+
+	var last ConversionProgress
+	for {
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			t.Fatal(err)
+		}
+		if !scanner.Scan() {
+			break
+		}
+	}
+	if last.Phase != PhaseFailed || last.Error != errFakeConversion.Error() {
+		t.Errorf("last update = %+v, want the failure", last)
+	}
+
+	resp, err = http.Get(server.URL + "/v1/images/conversions/watch?image=redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("watch of an idle image status = %d, want 404", resp.StatusCode)
+	}
+}
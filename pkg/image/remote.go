@@ -0,0 +1,405 @@
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// builderService is the gRPC service remote builders implement.
+	builderService = "fccri.builder.v1.Builder"
+
+	// builderConvertMethod converts an image and streams back the result.
+	builderConvertMethod = "/" + builderService + "/Convert"
+
+	// builderChunkSize is how much of an image each stream message carries.
+	builderChunkSize = 1 << 20
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes builder messages as JSON, like the guest agent
+// protocol, so builders don't need generated protobuf code. Clients select
+// it with the "json" content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+// RemoteBuilderConfig configures delegating conversions to a builder
+// service, so nodes short on disk or CPU don't convert images themselves.
+type RemoteBuilderConfig struct {
+	// Address is the builder's gRPC address (host:port). Empty converts
+	// everything locally.
+	Address string
+
+	// CAFile verifies the builder's TLS certificate. Empty connects
+	// without TLS.
+	CAFile string
+
+	// Timeout bounds a remote conversion, including the transfer.
+	Timeout time.Duration
+
+	// MinFreeDiskMB delegates conversions when less than this is free in
+	// TempDir.
+	MinFreeDiskMB int64
+
+	// MaxLocalConversions delegates conversions when this many are already
+	// running locally (0 = no limit).
+	MaxLocalConversions int
+}
+
+// DefaultRemoteBuilderConfig returns sensible defaults. Remote conversion
+// is disabled until an address is set.
+func DefaultRemoteBuilderConfig() RemoteBuilderConfig {
+	return RemoteBuilderConfig{
+		Timeout:             10 * time.Minute,
+		MinFreeDiskMB:       2048,
+		MaxLocalConversions: 2,
+	}
+}
+
+// Converter converts images. A builder serves conversions with one.
+type Converter interface {
+	Convert(ctx context.Context, imageRef string) (*ConvertedImage, error)
+}
+
+// ConvertRequest asks a builder to convert an image.
+type ConvertRequest struct {
+	ImageRef string `json:"image_ref"`
+	Digest   string `json:"digest,omitempty"`
+}
+
+// ConvertResponse is one message of a builder's reply. The first carries
+// the converted image's metadata and, if the builder uploaded the images to
+// an object store, their URLs. Otherwise the images' contents follow in
+// order, rootfs first.
+type ConvertResponse struct {
+	Image       *ConvertedImage `json:"image,omitempty"`
+	RootfsURL   string          `json:"rootfs_url,omitempty"`
+	SquashfsURL string          `json:"squashfs_url,omitempty"`
+
+	// Squashfs marks data belonging to the squashfs image.
+	Squashfs bool   `json:"squashfs,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// RegisterBuilder serves conversions by converter on server, making this
+// process a remote builder.
+func RegisterBuilder(server *grpc.Server, converter Converter) {
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: builderService,
+		HandlerType: (*Converter)(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    "Convert",
+				Handler:       serveConvert,
+				ServerStreams: true,
+			},
+		},
+	}, converter)
+}
+
+// serveConvert converts the requested image and streams it back.
+func serveConvert(srv interface{}, stream grpc.ServerStream) error {
+	var req ConvertRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	result, err := srv.(Converter).Convert(stream.Context(), req.ImageRef)
+	if err != nil {
+		return err
+	}
+	if req.Digest != "" && result.Digest != "" && req.Digest != result.Digest {
+		return fmt.Errorf("converted %s, but %s was requested", result.Digest, req.Digest)
+	}
+
+	if err := stream.SendMsg(&ConvertResponse{Image: result}); err != nil {
+		return err
+	}
+	if err := sendFile(stream, result.RootfsPath, false); err != nil {
+		return err
+	}
+	if result.SquashfsPath != "" {
+		return sendFile(stream, result.SquashfsPath, true)
+	}
+	return nil
+}
+
+// sendFile streams a file in chunks.
+func sendFile(stream grpc.ServerStream, path string, squashfs bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, builderChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&ConvertResponse{Squashfs: squashfs, Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// delegateReason returns why a conversion should run on the remote builder,
+// or "" to convert locally.
+func (f *FsifyConverter) delegateReason() string {
+	remote := f.config.RemoteBuilder
+	if remote.Address == "" {
+		return ""
+	}
+
+	if remote.MaxLocalConversions > 0 && int(f.localConversions.Load()) >= remote.MaxLocalConversions {
+		return "local conversion limit reached"
+	}
+
+	if remote.MinFreeDiskMB > 0 {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(f.config.TempDir, &stat); err == nil {
+			if freeMB := int64(stat.Bavail) * stat.Bsize / 1024 / 1024; freeMB < remote.MinFreeDiskMB {
+				return fmt.Sprintf("%d MB free in %s", freeMB, f.config.TempDir)
+			}
+		}
+	}
+
+	return ""
+}
+
+// convertRemote has the builder convert an image and stores the result
+// where a local conversion would have put it.
+func (f *FsifyConverter) convertRemote(ctx context.Context, imageRef, digest string) (*ConvertedImage, error) {
+	remote := f.config.RemoteBuilder
+	if remote.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, remote.Timeout)
+		defer cancel()
+	}
+
+	creds := insecure.NewCredentials()
+	if remote.CAFile != "" {
+		ca, err := os.ReadFile(remote.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read builder CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("builder CA %s holds no certificates", remote.CAFile)
+		}
+		creds = credentials.NewTLS(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	}
+
+	conn, err := grpc.DialContext(ctx, remote.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to builder: %w", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, builderConvertMethod, grpc.CallContentSubtype("json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start remote conversion: %w", err)
+	}
+	if err := stream.SendMsg(&ConvertRequest{ImageRef: imageRef, Digest: digest}); err != nil {
+		return nil, fmt.Errorf("failed to send conversion request: %w", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	var header ConvertResponse
+	if err := stream.RecvMsg(&header); err != nil {
+		return nil, fmt.Errorf("remote conversion failed: %w", err)
+	}
+	result := header.Image
+	if result == nil {
+		return nil, fmt.Errorf("builder sent no image metadata")
+	}
+	if result.Filesystem != f.config.Filesystem {
+		return nil, fmt.Errorf("builder produced %s, want %s", result.Filesystem, f.config.Filesystem)
+	}
+	if !f.baked(result) {
+		return nil, fmt.Errorf("builder produced an image without boot files")
+	}
+
+	outputPath := f.getOutputPath(imageRef)
+	squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
+	hasSquashfs := header.SquashfsURL != "" || (header.RootfsURL == "" && result.SquashfsPath != "")
+	if header.RootfsURL != "" {
+		err = downloadFile(ctx, header.RootfsURL, outputPath)
+		if err == nil && header.SquashfsURL != "" {
+			err = downloadFile(ctx, header.SquashfsURL, squashfsPath)
+		}
+	} else {
+		err = f.receiveImages(stream, outputPath, squashfsPath, hasSquashfs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive converted image: %w", err)
+	}
+
+	// The images are only trusted if they hash to what the builder recorded
+	if prov := result.Provenance; prov != nil && prov.OutputSHA256 != "" {
+		if sum, err := checksum.FileSHA256(outputPath); err != nil || "sha256:"+sum != prov.OutputSHA256 {
+			os.Remove(outputPath)
+			os.Remove(squashfsPath)
+			return nil, fmt.Errorf("received rootfs does not match the builder's hash")
+		}
+	}
+
+	result.Reference = imageRef
+	result.RootfsPath = outputPath
+	result.SquashfsPath = ""
+	if hasSquashfs {
+		result.SquashfsPath = squashfsPath
+	}
+	if info, err := os.Stat(outputPath); err == nil {
+		result.SizeBytes = info.Size()
+	}
+
+	f.log.WithFields(logrus.Fields{
+		"image":   imageRef,
+		"builder": remote.Address,
+		"output":  outputPath,
+	}).Info("Image converted remotely")
+
+	return result, nil
+}
+
+// receiveImages writes the streamed images to their paths.
+func (f *FsifyConverter) receiveImages(stream grpc.ClientStream, outputPath, squashfsPath string, squashfs bool) error {
+	rootfs, err := newPartialFile(outputPath)
+	if err != nil {
+		return err
+	}
+	defer rootfs.abort()
+
+	var squash *partialFile
+	if squashfs {
+		if squash, err = newPartialFile(squashfsPath); err != nil {
+			return err
+		}
+		defer squash.abort()
+	}
+
+	for {
+		var msg ConvertResponse
+		err := stream.RecvMsg(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		dst := rootfs
+		if msg.Squashfs {
+			if squash == nil {
+				return fmt.Errorf("builder sent an unannounced squashfs image")
+			}
+			dst = squash
+		}
+		if _, err := dst.Write(msg.Data); err != nil {
+			return err
+		}
+	}
+
+	if err := rootfs.commit(); err != nil {
+		return err
+	}
+	if squash != nil {
+		return squash.commit()
+	}
+	return nil
+}
+
+// downloadFile fetches an image from an object store URL.
+func downloadFile(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	file, err := newPartialFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return err
+	}
+	return file.commit()
+}
+
+// partialFile is written next to its path and only renamed into place once
+// complete, so an interrupted transfer never leaves a truncated image where
+// a VM could boot it.
+type partialFile struct {
+	*os.File
+	path string
+}
+
+func newPartialFile(path string) (*partialFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &partialFile{File: file, path: path}, nil
+}
+
+// commit flushes the file to disk and moves it into place.
+func (p *partialFile) commit() error {
+	if err := p.Sync(); err != nil {
+		p.Close()
+		return err
+	}
+	if err := p.Close(); err != nil {
+		return err
+	}
+	return os.Rename(p.Name(), p.path)
+}
+
+// abort removes the file unless it was committed.
+func (p *partialFile) abort() {
+	_ = p.Close()
+	_ = os.Remove(p.Name())
+}
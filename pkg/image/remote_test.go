@@ -0,0 +1,121 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// fakeConverter stands in for a builder's converter.
+type fakeConverter struct {
+	result *ConvertedImage
+	err    error
+}
+
+func (c *fakeConverter) Convert(ctx context.Context, imageRef string) (*ConvertedImage, error) {
+	return c.result, c.err
+}
+
+// startBuilder serves converter on a local port and returns its address.
+func startBuilder(t *testing.T, converter Converter) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	RegisterBuilder(server, converter)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestConvertRemote(t *testing.T) {
+	// The builder's image spans several stream messages
+	builderDir := t.TempDir()
+	rootfs := filepath.Join(builderDir, "nginx.img")
+	content := make([]byte, builderChunkSize*2+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := os.WriteFile(rootfs, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, _ := checksum.FileSHA256(rootfs)
+
+	addr := startBuilder(t, &fakeConverter{result: &ConvertedImage{
+		Reference:  "library/nginx:latest",
+		Digest:     "sha256:abc",
+		RootfsPath: rootfs,
+		Filesystem: "ext4",
+		Provenance: &Provenance{Host: "builder-1", OutputSHA256: "sha256:" + sum},
+	}})
+
+	config := DefaultFsifyConfig()
+	config.OutputDir = t.TempDir()
+	config.TempDir = t.TempDir()
+	config.RemoteBuilder.Address = addr
+	converter, err := NewFsifyConverter(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := converter.convertRemote(context.Background(), "library/nginx:latest", "sha256:abc")
+	if err != nil {
+		t.Fatalf("convertRemote() error = %v", err)
+	}
+	if result.RootfsPath != converter.getOutputPath("library/nginx:latest") || result.SizeBytes != int64(len(content)) {
+		t.Errorf("result = %+v", result)
+	}
+	if got, _ := checksum.FileSHA256(result.RootfsPath); got != sum {
+		t.Error("received rootfs differs from the builder's")
+	}
+
+	// A conversion the builder can't do fails, and leaves nothing behind
+	failing := startBuilder(t, &fakeConverter{err: errors.New("no space left")})
+	converter.config.RemoteBuilder.Address = failing
+	if _, err := converter.convertRemote(context.Background(), "library/redis:latest", ""); err == nil {
+		t.Error("convertRemote() succeeded with a failing builder")
+	}
+	if _, err := os.Stat(converter.getOutputPath("library/redis:latest")); !os.IsNotExist(err) {
+		t.Error("failed conversion left an image behind")
+	}
+}
+
+func TestDelegateReason(t *testing.T) {
+	config := DefaultFsifyConfig()
+	config.OutputDir = t.TempDir()
+	config.TempDir = t.TempDir()
+	config.RemoteBuilder.MinFreeDiskMB = 0
+	converter, err := NewFsifyConverter(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := converter.delegateReason(); reason != "" {
+		t.Errorf("delegated without a builder: %s", reason)
+	}
+
+	converter.config.RemoteBuilder.Address = "builder:9000"
+	if reason := converter.delegateReason(); reason != "" {
+		t.Errorf("delegated with resources to spare: %s", reason)
+	}
+
+	converter.localConversions.Store(int32(config.RemoteBuilder.MaxLocalConversions))
+	if reason := converter.delegateReason(); reason == "" {
+		t.Error("did not delegate at the local conversion limit")
+	}
+
+	converter.localConversions.Store(0)
+	converter.config.RemoteBuilder.MinFreeDiskMB = 1 << 40
+	if reason := converter.delegateReason(); reason == "" {
+		t.Error("did not delegate with the disk nearly full")
+	}
+}
@@ -0,0 +1,409 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errStreamUnsupported marks images the streaming path can't convert, which
+// are converted serially instead.
+var errStreamUnsupported = errors.New("not supported by streaming conversion")
+
+const (
+	// streamSizeFactor sizes the image before the layers are uncompressed:
+	// the compressed layers times this. The image is sparse, so unused
+	// space costs nothing, and it is shrunk once the layers are applied.
+	streamSizeFactor = 8
+
+	// streamMinSizeMB is the smallest image created for streaming.
+	streamMinSizeMB = 512
+
+	// blobPollInterval is how often the layout is checked for new blobs.
+	blobPollInterval = 100 * time.Millisecond
+)
+
+// streamableLayers are the layer media types the streaming path applies.
+// Others, such as zstd layers, are left to umoci.
+var streamableLayers = map[string]bool{
+	"application/vnd.oci.image.layer.v1.tar":            true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":       true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": true,
+	"application/vnd.docker.image.rootfs.diff.tar":      true,
+}
+
+// descriptor is an OCI content descriptor.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// manifest is an image manifest, or an index of them.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// convertStreaming converts an image to ext4 without unpacking it to disk
+// first. skopeo downloads the layers concurrently while they are applied,
+// in order, to the mounted image as each one lands. The image is created
+// larger than needed and shrunk to fit afterwards.
+func (f *FsifyConverter) convertStreaming(ctx context.Context, imageRef string, tracker *progressTracker) (*ConvertedImage, error) {
+	if f.config.Filesystem != "ext4" {
+		return nil, fmt.Errorf("%w: only ext4 can be shrunk", errStreamUnsupported)
+	}
+
+	layers, err := f.fetchLayers(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+	var compressed int64
+	for _, layer := range layers {
+		if !streamableLayers[layer.MediaType] {
+			return nil, fmt.Errorf("%w: layer type %s", errStreamUnsupported, layer.MediaType)
+		}
+		compressed += layer.Size
+	}
+
+	log := f.log.WithFields(logrus.Fields{"image": imageRef, "layers": len(layers)})
+	log.Info("Converting image (streaming)")
+
+	outputPath := f.getOutputPath(imageRef)
+	squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
+	partial := partialPath(outputPath)
+	tempDir := filepath.Join(f.config.TempDir, f.sanitizeName(imageRef))
+	defer os.RemoveAll(tempDir)
+	defer os.Remove(partial)
+	defer os.Remove(partialPath(squashfsPath))
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	// Pull in the background; blobs appear in the layout as they complete
+	ociDir := filepath.Join(tempDir, "oci")
+	pullCtx, cancelPull := context.WithCancel(ctx)
+	pullDone := make(chan struct{})
+	var pullErr error
+	go func() {
+		pullErr = f.pullImage(pullCtx, imageRef, ociDir)
+		close(pullDone)
+	}()
+	defer func() {
+		cancelPull()
+		<-pullDone
+	}()
+
+	tracker.update(func(p *ConversionProgress) {
+		p.Phase = PhaseStream
+		p.LayersTotal = len(layers)
+	})
+	stopSampling := tracker.sample(func(p *ConversionProgress) {
+		p.BytesPulled = dirSize(ociDir)
+	})
+	defer stopSampling()
+
+	sizeMB := max(compressed*streamSizeFactor>>20+f.config.SizeBufferMB+f.config.Bake.size()>>20, streamMinSizeMB)
+	if err := f.formatImage(ctx, partial, sizeMB, false); err != nil {
+		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+	}
+	result, err := f.streamLayers(ctx, imageRef, partial, ociDir, layers, pullDone, &pullErr, tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := commitOutput(partial, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to commit image: %w", err)
+	}
+	result.RootfsPath = outputPath
+	if result.SquashfsPath != "" {
+		if err := commitOutput(result.SquashfsPath, squashfsPath); err != nil {
+			f.log.WithError(err).Warn("Failed to commit squashfs")
+			result.SquashfsPath = ""
+		} else {
+			result.SquashfsPath = squashfsPath
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"output":  outputPath,
+		"size_mb": result.SizeBytes >> 20,
+	}).Info("Image conversion complete")
+
+	return result, nil
+}
+
+// streamLayers applies the layers to the image at outputPath as they are
+// pulled into ociDir, then shrinks it. The paths of the result are those
+// the images were built at.
+func (f *FsifyConverter) streamLayers(ctx context.Context, imageRef, outputPath, ociDir string, layers []descriptor,
+	pullDone <-chan struct{}, pullErr *error, tracker *progressTracker) (*ConvertedImage, error) {
+	mountDir := outputPath + ".mount"
+	unmount, err := mountImage(ctx, outputPath, mountDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+
+	for i, layer := range layers {
+		path, err := blobPath(ociDir, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := waitForBlob(ctx, path, pullDone, pullErr); err != nil {
+			return nil, err
+		}
+		if err := applyBlob(mountDir, path, layer.Digest); err != nil {
+			return nil, fmt.Errorf("failed to apply layer %d: %w", i+1, err)
+		}
+		tracker.update(func(p *ConversionProgress) { p.LayersUnpacked++ })
+	}
+
+	// The manifest and config are written once the pull completes
+	select {
+	case <-pullDone:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if *pullErr != nil {
+		return nil, fmt.Errorf("failed to pull image: %w", *pullErr)
+	}
+
+	ociConfig := f.extractOCIConfigFromDir(ociDir)
+	if ociConfig != nil {
+		_ = writeOCIConfig(filepath.Join(mountDir, "etc"), ociConfig)
+	}
+	var bootInit string
+	if f.config.Bake.Enabled {
+		if bootInit, err = bakeRootfs(mountDir, f.config.Bake); err != nil {
+			return nil, fmt.Errorf("failed to bake boot files: %w", err)
+		}
+	}
+
+	result := &ConvertedImage{
+		Reference:  imageRef,
+		Digest:     manifestDigest(ociDir),
+		RootfsPath: outputPath,
+		Filesystem: f.config.Filesystem,
+		OCIConfig:  ociConfig,
+		BootInit:   bootInit,
+	}
+
+	if f.config.DualOutput {
+		squashfsPath := strings.TrimSuffix(outputPath, ".img") + ".squashfs"
+		tracker.setPhase(PhaseSquashfs)
+		if err := f.createSquashfs(ctx, mountDir, squashfsPath); err != nil {
+			f.log.WithError(err).Warn("Failed to create squashfs")
+		} else {
+			result.SquashfsPath = squashfsPath
+		}
+	}
+
+	_ = exec.Command("sync").Run()
+	unmount()
+
+	size, err := f.shrinkImage(ctx, outputPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to shrink image: %w", err)
+	}
+	result.SizeBytes = size
+	result.ConvertedAt = time.Now()
+	return result, nil
+}
+
+// fetchLayers returns the layers of the image skopeo will pull: for a
+// multi-platform image, those of the manifest for this host.
+func (f *FsifyConverter) fetchLayers(ctx context.Context, imageRef string) ([]descriptor, error) {
+	m, err := f.inspectRaw(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Manifests) > 0 {
+		var digest string
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+				digest = d.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, fmt.Errorf("%w: no linux/%s manifest", errStreamUnsupported, runtime.GOARCH)
+		}
+		if m, err = f.inspectRaw(ctx, withDigest(imageRef, digest)); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.SchemaVersion != 2 || len(m.Layers) == 0 {
+		return nil, fmt.Errorf("%w: manifest schema %d", errStreamUnsupported, m.SchemaVersion)
+	}
+	return m.Layers, nil
+}
+
+// inspectRaw asks skopeo for the manifest of a remote image.
+func (f *FsifyConverter) inspectRaw(ctx context.Context, imageRef string) (*manifest, error) {
+	srcRef := imageRef
+	if !strings.Contains(srcRef, "://") {
+		srcRef = "docker://" + srcRef
+	}
+
+	args := []string{"inspect", "--raw", srcRef}
+	for _, insecure := range f.config.InsecureRegistries {
+		if strings.Contains(imageRef, insecure) {
+			args = append([]string{"inspect", "--tls-verify=false"}, args[1:]...)
+			break
+		}
+	}
+
+	output, err := exec.CommandContext(ctx, f.config.SkopeoPath, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("skopeo inspect failed: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(output, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// withDigest replaces the tag or digest of an image reference.
+func withDigest(imageRef, digest string) string {
+	repo, _, _ := strings.Cut(imageRef, "@")
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	return repo + "@" + digest
+}
+
+// blobPath returns where a blob is stored in an OCI layout.
+func blobPath(ociDir, digest string) (string, error) {
+	algo, hash, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" || strings.ContainsAny(hash, "/.") {
+		return "", fmt.Errorf("invalid layer digest %q", digest)
+	}
+	return filepath.Join(ociDir, "blobs", algo, hash), nil
+}
+
+// waitForBlob waits for skopeo to move a blob into the layout, which it
+// does once the blob is complete.
+func waitForBlob(ctx context.Context, path string, pullDone <-chan struct{}, pullErr *error) error {
+	ticker := time.NewTicker(blobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-pullDone:
+			if _, err := os.Stat(path); err == nil {
+				return nil
+			}
+			if *pullErr != nil {
+				return fmt.Errorf("failed to pull image: %w", *pullErr)
+			}
+			return fmt.Errorf("layer %s missing from the pulled image", filepath.Base(path))
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyBlob applies a layer blob to root, checking it against its digest.
+func applyBlob(root, path, digest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	r := io.TeeReader(file, hash)
+	if err := applyLayer(root, r); err != nil {
+		return err
+	}
+	// Hash what the tar reader left, such as padding
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("layer digest %s, want %s", got, digest)
+	}
+	return nil
+}
+
+// shrinkImage shrinks an unmounted ext4 image to its contents plus the
+// configured buffer, returning its new size.
+func (f *FsifyConverter) shrinkImage(ctx context.Context, imagePath string) (int64, error) {
+	// resize2fs refuses to shrink a filesystem that wasn't checked since
+	// it was mounted. e2fsck exits 1 when it corrected something.
+	cmd := exec.CommandContext(ctx, "e2fsck", "-f", "-y", imagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return 0, fmt.Errorf("e2fsck failed: %w: %s", err, output)
+		}
+	}
+
+	cmd = exec.CommandContext(ctx, "resize2fs", "-M", imagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("resize2fs failed: %w: %s", err, output)
+	}
+
+	output, err := exec.CommandContext(ctx, "dumpe2fs", "-h", imagePath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("dumpe2fs failed: %w", err)
+	}
+	blocks, blockSize := dumpe2fsField(output, "Block count"), dumpe2fsField(output, "Block size")
+	if blocks == 0 || blockSize == 0 {
+		return 0, fmt.Errorf("dumpe2fs reported no block count")
+	}
+
+	// Grow back by the buffer
+	size := blocks*blockSize + f.config.SizeBufferMB*1024*1024
+	if err := os.Truncate(imagePath, size); err != nil {
+		return 0, err
+	}
+	cmd = exec.CommandContext(ctx, "resize2fs", imagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("resize2fs failed: %w: %s", err, output)
+	}
+
+	if f.config.Preallocate {
+		_ = exec.CommandContext(ctx, "fallocate", "-l", strconv.FormatInt(size, 10), imagePath).Run()
+	}
+	return size, nil
+}
+
+// dumpe2fsField returns a numeric field of dumpe2fs -h output, or 0.
+func dumpe2fsField(output []byte, name string) int64 {
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && key == name {
+			n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
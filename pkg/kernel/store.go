@@ -0,0 +1,468 @@
+// Package kernel manages the guest kernels and initrds VMs boot with.
+//
+// Kernels live in a store directory, one subdirectory per kernel:
+//
+//	/var/lib/fc-cri/kernels/
+//	  6.1-minimal/
+//	    kernel.json   manifest: checksums, optional sources and boot args
+//	    vmlinux
+//	    initrd        optional
+//
+// Pods pick a kernel by name. Every file is checked against the checksum in
+// its manifest before a VM boots from it, and files that are missing can be
+// downloaded from an HTTP(S) URL or an OCI artifact on first use.
+package kernel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ManifestFile describes a kernel in its directory.
+	ManifestFile = "kernel.json"
+
+	// KernelFile and InitrdFile are the artifacts of a kernel.
+	KernelFile = "vmlinux"
+	InitrdFile = "initrd"
+
+	// ociTitleAnnotation names the file a layer of an OCI artifact holds.
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+var (
+	// ErrNotFound is returned for kernels that aren't in the store.
+	ErrNotFound = errors.New("kernel not found")
+
+	// ErrChecksum is returned when an artifact doesn't match its manifest.
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// Config configures the kernel store.
+type Config struct {
+	// Dir holds one directory per kernel.
+	Dir string
+
+	// AllowDownload fetches missing artifacts from their sources.
+	AllowDownload bool
+
+	// DownloadTimeout bounds fetching one artifact.
+	DownloadTimeout time.Duration
+
+	// SkopeoPath is used to pull artifacts from OCI registries.
+	SkopeoPath string
+}
+
+// DefaultConfig returns sensible defaults.
+func DefaultConfig() Config {
+	return Config{
+		Dir:             "/var/lib/fc-cri/kernels",
+		AllowDownload:   true,
+		DownloadTimeout: 5 * time.Minute,
+		SkopeoPath:      "/usr/bin/skopeo",
+	}
+}
+
+// Manifest describes a kernel.
+type Manifest struct {
+	// Kernel is the uncompressed kernel image.
+	Kernel Artifact `json:"kernel"`
+
+	// Initrd is an optional initial ramdisk.
+	Initrd *Artifact `json:"initrd,omitempty"`
+
+	// Args overrides the default kernel boot arguments.
+	Args string `json:"args,omitempty"`
+
+	// Description is shown when listing kernels.
+	Description string `json:"description,omitempty"`
+}
+
+// Artifact is one file of a kernel.
+type Artifact struct {
+	// SHA256 is the hex-encoded checksum of the file.
+	SHA256 string `json:"sha256"`
+
+	// Source is where to fetch the file if it's missing: an http(s) URL,
+	// or oci://registry/repo:tag for an artifact whose layer is titled
+	// with the file name.
+	Source string `json:"source,omitempty"`
+}
+
+// Kernel is a verified kernel ready to boot.
+type Kernel struct {
+	Name       string
+	KernelPath string
+	InitrdPath string
+	Args       string
+}
+
+// Info describes a kernel in the store.
+type Info struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	HasInitrd   bool   `json:"has_initrd"`
+	Present     bool   `json:"present"` // All artifacts are on disk
+}
+
+// Store resolves kernel names to verified artifacts.
+type Store struct {
+	config Config
+	log    *logrus.Entry
+
+	// fetchMu serializes downloads so concurrent pods don't fetch the
+	// same kernel twice
+	fetchMu sync.Mutex
+}
+
+// NewStore creates a kernel store.
+func NewStore(config Config, log *logrus.Entry) *Store {
+	return &Store{
+		config: config,
+		log:    log.WithField("component", "kernel-store"),
+	}
+}
+
+// ValidateName checks that a kernel name is a plain directory name.
+func ValidateName(name string) error {
+	if name == "" || name == "." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return fmt.Errorf("invalid kernel name %q", name)
+	}
+	return nil
+}
+
+// Resolve returns the verified artifacts of a kernel, fetching missing ones
+// from their sources if downloads are allowed.
+func (s *Store) Resolve(ctx context.Context, name string) (*Kernel, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	manifest, err := s.manifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(s.config.Dir, name)
+	kernel := &Kernel{
+		Name:       name,
+		KernelPath: filepath.Join(dir, KernelFile),
+		Args:       manifest.Args,
+	}
+	if err := s.ensure(ctx, kernel.KernelPath, manifest.Kernel); err != nil {
+		return nil, fmt.Errorf("kernel %s: %w", name, err)
+	}
+	if manifest.Initrd != nil {
+		kernel.InitrdPath = filepath.Join(dir, InitrdFile)
+		if err := s.ensure(ctx, kernel.InitrdPath, *manifest.Initrd); err != nil {
+			return nil, fmt.Errorf("kernel %s initrd: %w", name, err)
+		}
+	}
+
+	return kernel, nil
+}
+
+// List returns the kernels in the store, sorted by name.
+func (s *Store) List() ([]Info, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := s.manifest(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(s.config.Dir, entry.Name())
+		info := Info{
+			Name:        entry.Name(),
+			Description: manifest.Description,
+			HasInitrd:   manifest.Initrd != nil,
+			Present:     exists(filepath.Join(dir, KernelFile)),
+		}
+		if manifest.Initrd != nil && !exists(filepath.Join(dir, InitrdFile)) {
+			info.Present = false
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// manifest reads and checks a kernel's manifest.
+func (s *Store) manifest(name string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, name, ManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for kernel %s: %w", name, err)
+	}
+	if !checksum.ValidSHA256(manifest.Kernel.SHA256) {
+		return nil, fmt.Errorf("invalid manifest for kernel %s: kernel sha256 must be %d hex characters", name, sha256.Size*2)
+	}
+	if manifest.Initrd != nil && !checksum.ValidSHA256(manifest.Initrd.SHA256) {
+		return nil, fmt.Errorf("invalid manifest for kernel %s: initrd sha256 must be %d hex characters", name, sha256.Size*2)
+	}
+	return &manifest, nil
+}
+
+// =============================================================================
+// Verification
+// =============================================================================
+
+// stamp records a file's checksum along with its size and modification
+// time, so an unchanged file isn't hashed again on every VM boot.
+type stamp struct {
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// ensure makes sure an artifact is on disk and matches its checksum.
+func (s *Store) ensure(ctx context.Context, path string, artifact Artifact) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if artifact.Source == "" || !s.config.AllowDownload {
+			return fmt.Errorf("%s is missing", filepath.Base(path))
+		}
+		return s.fetch(ctx, path, artifact)
+	}
+	return verify(path, artifact.SHA256)
+}
+
+// verify checks a file against a checksum, trusting a stamp that matches
+// the file's current size and modification time.
+func verify(path, want string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	stampPath := stampPath(path)
+	if data, err := os.ReadFile(stampPath); err == nil {
+		var st stamp
+		if json.Unmarshal(data, &st) == nil && strings.EqualFold(st.SHA256, want) &&
+			st.Size == info.Size() && st.ModTime == info.ModTime().UnixNano() {
+			return nil
+		}
+	}
+
+	got, err := checksum.FileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", filepath.Base(path), err)
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("%w: %s is sha256:%s, want sha256:%s", ErrChecksum, filepath.Base(path), got, want)
+	}
+
+	// The stamp only saves work, so failing to write it is harmless
+	data, _ := json.Marshal(stamp{SHA256: got, Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	_ = os.WriteFile(stampPath, data, 0644)
+	return nil
+}
+
+// stampPath returns where the verification stamp of a file is kept.
+func stampPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".verified")
+}
+
+// =============================================================================
+// Downloads
+// =============================================================================
+
+// fetch downloads an artifact to path, checking its checksum before it is
+// moved into place so a bad download never becomes bootable.
+func (s *Store) fetch(ctx context.Context, path string, artifact Artifact) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	// Another pod may have fetched it while we waited
+	if exists(path) {
+		return verify(path, artifact.SHA256)
+	}
+
+	if s.config.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.DownloadTimeout)
+		defer cancel()
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"file":   path,
+		"source": artifact.Source,
+	}).Info("Fetching kernel artifact")
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	switch {
+	case strings.HasPrefix(artifact.Source, "http://"), strings.HasPrefix(artifact.Source, "https://"):
+		err = downloadHTTP(ctx, artifact.Source, w)
+	case strings.HasPrefix(artifact.Source, "oci://"):
+		err = s.downloadOCI(ctx, strings.TrimPrefix(artifact.Source, "oci://"), filepath.Base(path), w)
+	default:
+		err = fmt.Errorf("unsupported source %q", artifact.Source)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", filepath.Base(path), err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, artifact.SHA256) {
+		return fmt.Errorf("%w: %s from %s is sha256:%s, want sha256:%s",
+			ErrChecksum, filepath.Base(path), artifact.Source, got, artifact.SHA256)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// downloadHTTP writes the body of a URL to w.
+func downloadHTTP(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// downloadOCI pulls an OCI artifact with skopeo and writes the layer titled
+// with the given file name to w. An artifact with a single layer may leave
+// it untitled.
+func (s *Store) downloadOCI(ctx context.Context, ref, file string, w io.Writer) error {
+	dir, err := os.MkdirTemp(s.config.Dir, ".oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.CommandContext(ctx, s.config.SkopeoPath, "copy", "docker://"+ref, "oci:"+dir+":artifact")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("skopeo copy failed: %w: %s", err, output)
+	}
+
+	digest, err := ociLayer(dir, file)
+	if err != nil {
+		return err
+	}
+	blob, err := os.Open(blobPath(dir, digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	_, err = io.Copy(w, blob)
+	return err
+}
+
+// ociDescriptor is the subset of an OCI content descriptor we need.
+type ociDescriptor struct {
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociLayer returns the digest of the layer holding a file in an OCI
+// layout directory.
+func ociLayer(dir, file string) (string, error) {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := readJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return "", fmt.Errorf("invalid OCI layout: %w", err)
+	}
+	if len(index.Manifests) == 0 {
+		return "", fmt.Errorf("invalid OCI layout: no manifests")
+	}
+
+	var manifest struct {
+		Layers []ociDescriptor `json:"layers"`
+	}
+	if err := readJSON(blobPath(dir, index.Manifests[0].Digest), &manifest); err != nil {
+		return "", fmt.Errorf("invalid OCI manifest: %w", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[ociTitleAnnotation] == file {
+			return layer.Digest, nil
+		}
+	}
+	if len(manifest.Layers) == 1 && manifest.Layers[0].Annotations[ociTitleAnnotation] == "" {
+		return manifest.Layers[0].Digest, nil
+	}
+	return "", fmt.Errorf("artifact has no layer titled %q", file)
+}
+
+// blobPath returns the path of a blob in an OCI layout directory.
+func blobPath(dir, digest string) string {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(dir, "blobs", algorithm, filepath.Base(hash))
+}
+
+// =============================================================================
+// Helpers
+// =============================================================================
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,214 @@
+package kernel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func sum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	config := DefaultConfig()
+	config.Dir = t.TempDir()
+	return NewStore(config, logrus.NewEntry(logrus.New()))
+}
+
+func writeKernel(t *testing.T, s *Store, name string, manifest Manifest, files map[string][]byte) {
+	t.Helper()
+	dir := filepath.Join(s.config.Dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"6.1-minimal", "5.10", "lts_gpu"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("ValidateName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "../etc", `a\b`} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("ValidateName(%q) accepted", name)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	s := newTestStore(t)
+	vmlinux, initrd := []byte("kernel image"), []byte("ramdisk")
+	writeKernel(t, s, "6.1-minimal", Manifest{
+		Kernel: Artifact{SHA256: sum(vmlinux)},
+		Initrd: &Artifact{SHA256: sum(initrd)},
+		Args:   "console=ttyS0 quiet",
+	}, map[string][]byte{KernelFile: vmlinux, InitrdFile: initrd})
+
+	k, err := s.Resolve(context.Background(), "6.1-minimal")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	dir := filepath.Join(s.config.Dir, "6.1-minimal")
+	if k.KernelPath != filepath.Join(dir, KernelFile) || k.InitrdPath != filepath.Join(dir, InitrdFile) {
+		t.Errorf("paths = %s, %s", k.KernelPath, k.InitrdPath)
+	}
+	if k.Args != "console=ttyS0 quiet" {
+		t.Errorf("Args = %q", k.Args)
+	}
+
+	// A verified file is stamped
+	if _, err := os.Stat(stampPath(k.KernelPath)); err != nil {
+		t.Errorf("no verification stamp: %v", err)
+	}
+
+	if _, err := s.Resolve(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestResolve_ChecksumMismatch(t *testing.T) {
+	s := newTestStore(t)
+	vmlinux := []byte("kernel image")
+	writeKernel(t, s, "k", Manifest{Kernel: Artifact{SHA256: sum(vmlinux)}},
+		map[string][]byte{KernelFile: vmlinux})
+
+	if _, err := s.Resolve(context.Background(), "k"); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+
+	// Tampering changes size or mtime, which invalidates the stamp
+	path := filepath.Join(s.config.Dir, "k", KernelFile)
+	if err := os.WriteFile(path, []byte("tampered kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(context.Background(), "k"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Resolve() error = %v, want ErrChecksum", err)
+	}
+}
+
+func TestResolve_InvalidManifest(t *testing.T) {
+	s := newTestStore(t)
+	writeKernel(t, s, "k", Manifest{Kernel: Artifact{SHA256: "abc"}}, nil)
+
+	if _, err := s.Resolve(context.Background(), "k"); err == nil {
+		t.Error("Resolve() accepted a short checksum")
+	}
+}
+
+func TestResolve_Download(t *testing.T) {
+	vmlinux := []byte("downloaded kernel")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(vmlinux)
+	}))
+	defer server.Close()
+
+	s := newTestStore(t)
+	writeKernel(t, s, "remote", Manifest{Kernel: Artifact{SHA256: sum(vmlinux), Source: server.URL + "/vmlinux"}}, nil)
+	writeKernel(t, s, "bad", Manifest{Kernel: Artifact{SHA256: sum([]byte("other")), Source: server.URL + "/vmlinux"}}, nil)
+
+	k, err := s.Resolve(context.Background(), "remote")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if got, _ := os.ReadFile(k.KernelPath); string(got) != string(vmlinux) {
+		t.Errorf("downloaded %q", got)
+	}
+
+	// Present files aren't fetched again
+	if _, err := s.Resolve(context.Background(), "remote"); err != nil || requests != 1 {
+		t.Errorf("second Resolve() = %v after %d requests, want 1", err, requests)
+	}
+
+	// A download that doesn't match is never installed
+	if _, err := s.Resolve(context.Background(), "bad"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Resolve(bad) error = %v, want ErrChecksum", err)
+	}
+	if exists(filepath.Join(s.config.Dir, "bad", KernelFile)) {
+		t.Error("mismatched download was installed")
+	}
+
+	// Downloads can be turned off
+	s.config.AllowDownload = false
+	os.Remove(k.KernelPath)
+	if _, err := s.Resolve(context.Background(), "remote"); err == nil {
+		t.Error("Resolve() downloaded with downloads disabled")
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newTestStore(t)
+	vmlinux := []byte("kernel image")
+	writeKernel(t, s, "b", Manifest{Kernel: Artifact{SHA256: sum(vmlinux)}, Description: "present"},
+		map[string][]byte{KernelFile: vmlinux})
+	writeKernel(t, s, "a", Manifest{Kernel: Artifact{SHA256: sum(vmlinux), Source: "https://example.com/vmlinux"}}, nil)
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name != "a" || infos[1].Name != "b" {
+		t.Fatalf("List() = %+v", infos)
+	}
+	if infos[0].Present || !infos[1].Present || infos[1].Description != "present" {
+		t.Errorf("List() = %+v", infos)
+	}
+}
+
+func TestOCILayer(t *testing.T) {
+	dir := t.TempDir()
+	writeBlob := func(data []byte) string {
+		digest := "sha256:" + sum(data)
+		path := blobPath(dir, digest)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"layers": []ociDescriptor{
+			{Digest: "sha256:aaa", Annotations: map[string]string{ociTitleAnnotation: KernelFile}},
+			{Digest: "sha256:bbb", Annotations: map[string]string{ociTitleAnnotation: InitrdFile}},
+		},
+	})
+	index, _ := json.Marshal(map[string]interface{}{
+		"manifests": []ociDescriptor{{Digest: writeBlob(manifest)}},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if digest, err := ociLayer(dir, InitrdFile); err != nil || digest != "sha256:bbb" {
+		t.Errorf("ociLayer(initrd) = %s, %v", digest, err)
+	}
+	if _, err := ociLayer(dir, "bzImage"); err == nil {
+		t.Error("ociLayer found an untitled file")
+	}
+}
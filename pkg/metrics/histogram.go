@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DefaultLatencyBuckets are the default histogram bucket upper bounds in
+// seconds, matching the Prometheus client defaults.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into fixed buckets, the way a Prometheus
+// histogram does. It is not safe for concurrent use; the Collector guards it.
+type Histogram struct {
+	// bounds are the bucket upper bounds in ascending order. The +Inf
+	// bucket is implicit.
+	bounds []float64
+
+	// counts holds per-bucket (non-cumulative) counts, with the +Inf
+	// bucket last.
+	counts []uint64
+
+	sum   float64
+	count uint64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds.
+func NewHistogram(bounds []float64) (*Histogram, error) {
+	if err := ValidateBuckets(bounds); err != nil {
+		return nil, err
+	}
+
+	return &Histogram{
+		bounds: append([]float64(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	}, nil
+}
+
+// ValidateBuckets checks that bucket bounds are non-empty, positive and
+// strictly increasing.
+func ValidateBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no buckets")
+	}
+	for i, b := range bounds {
+		if b <= 0 || math.IsInf(b, 0) || math.IsNaN(b) {
+			return fmt.Errorf("invalid bucket bound %v", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("buckets must be strictly increasing: %v after %v", b, bounds[i-1])
+		}
+	}
+	return nil
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Snapshot returns a copy of the histogram with cumulative bucket counts.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	cumulative := make([]uint64, len(h.counts))
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		cumulative[i] = total
+	}
+
+	return HistogramSnapshot{
+		Bounds:     append([]float64(nil), h.bounds...),
+		Cumulative: cumulative,
+		Sum:        h.sum,
+		Count:      h.count,
+	}
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram.
+type HistogramSnapshot struct {
+	// Bounds are the bucket upper bounds, excluding +Inf.
+	Bounds []float64 `json:"bounds"`
+
+	// Cumulative holds cumulative counts per bucket, with +Inf last.
+	Cumulative []uint64 `json:"cumulative"`
+
+	Sum   float64 `json:"sum"`
+	Count uint64  `json:"count"`
+}
+
+// Quantile estimates the q-quantile (0-1) of the observations.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	return BucketQuantile(q, s.Bounds, s.Cumulative)
+}
+
+// BucketQuantile estimates the q-quantile from cumulative bucket counts by
+// linear interpolation within the bucket, as PromQL's histogram_quantile
+// does. cumulative has one more entry than bounds, for the +Inf bucket.
+// Observations in the +Inf bucket are reported as the highest finite bound.
+func BucketQuantile(q float64, bounds []float64, cumulative []uint64) float64 {
+	if len(cumulative) == 0 || len(cumulative) != len(bounds)+1 {
+		return 0
+	}
+	total := cumulative[len(cumulative)-1]
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	i := sort.Search(len(cumulative), func(i int) bool {
+		return float64(cumulative[i]) >= rank
+	})
+	if i >= len(bounds) {
+		return bounds[len(bounds)-1]
+	}
+
+	lower, prev := 0.0, uint64(0)
+	if i > 0 {
+		lower, prev = bounds[i-1], cumulative[i-1]
+	}
+	inBucket := cumulative[i] - prev
+	if inBucket == 0 {
+		return bounds[i]
+	}
+
+	return lower + (bounds[i]-lower)*(rank-float64(prev))/float64(inBucket)
+}
+
+// writeHistogram writes one labeled histogram series in Prometheus text
+// format. labels is either empty or of the form `key="value"`.
+func writeHistogram(w io.Writer, name, labels string, s HistogramSnapshot) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, bound := range s.Bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, s.Cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, s.Count)
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, suffix, strconv.FormatFloat(s.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, suffix, s.Count)
+}
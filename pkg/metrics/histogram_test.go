@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		bounds  []float64
+		wantErr bool
+	}{
+		{"Valid", []float64{0.1, 0.5, 1}, false},
+		{"Empty", nil, true},
+		{"Zero bound", []float64{0, 1}, true},
+		{"Not increasing", []float64{0.5, 0.5}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateBuckets(tt.bounds)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateBuckets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHistogram_Observe(t *testing.T) {
+	h, err := NewHistogram([]float64{1, 2, 4})
+	if err != nil {
+		t.Fatalf("NewHistogram failed: %v", err)
+	}
+
+	// Bounds are inclusive upper limits
+	for _, v := range []float64{0.5, 1, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+
+	snap := h.Snapshot()
+	want := []uint64{2, 3, 4, 5}
+	for i, n := range want {
+		if snap.Cumulative[i] != n {
+			t.Errorf("Cumulative[%d] = %d, want %d", i, snap.Cumulative[i], n)
+		}
+	}
+	if snap.Count != 5 {
+		t.Errorf("Count = %d, want 5", snap.Count)
+	}
+	if snap.Sum != 16 {
+		t.Errorf("Sum = %v, want 16", snap.Sum)
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+	bounds := []float64{1, 2, 4}
+
+	tests := []struct {
+		name       string
+		cumulative []uint64
+		q          float64
+		want       float64
+	}{
+		{"Empty", []uint64{0, 0, 0, 0}, 0.5, 0},
+		{"First bucket", []uint64{10, 10, 10, 10}, 0.5, 0.5},
+		{"Interpolated", []uint64{0, 10, 10, 10}, 0.5, 1.5},
+		{"Inf bucket", []uint64{0, 0, 0, 10}, 0.99, 4},
+		{"Mismatched", []uint64{1}, 0.5, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BucketQuantile(tt.q, bounds, tt.cumulative); got != tt.want {
+				t.Errorf("BucketQuantile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	h, _ := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	writeHistogram(&buf, "test_seconds", `op="a"`, h.Snapshot())
+	out := buf.String()
+
+	expected := []string{
+		`test_seconds_bucket{op="a",le="0.1"} 1`,
+		`test_seconds_bucket{op="a",le="1"} 1`,
+		`test_seconds_bucket{op="a",le="+Inf"} 2`,
+		`test_seconds_sum{op="a"} 2.05`,
+		`test_seconds_count{op="a"} 2`,
+	}
+	for _, exp := range expected {
+		if !strings.Contains(out, exp) {
+			t.Errorf("Output missing %q:\n%s", exp, out)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default label cardinality limits. Series beyond the limit are folded into
+// a single series labeled OverflowLabel so a busy node can't blow up
+// Prometheus.
+const (
+	DefaultMaxSandboxSeries = 500
+	DefaultMaxImageSeries   = 100
+
+	// OverflowLabel replaces label values once a series limit is reached.
+	OverflowLabel = "other"
+)
+
+// SandboxLabels identifies the pod a sandbox belongs to.
+type SandboxLabels struct {
+	SandboxID string
+	Namespace string
+	Pod       string
+}
+
+// sandboxSeries holds the labeled per-sandbox gauges.
+type sandboxSeries struct {
+	labels   SandboxLabels
+	memoryMB int64
+	vcpus    int64
+	host     HostUsage
+	pod      PodUsage
+}
+
+// HostUsage is the host resource usage of a sandbox's VMM, as accounted by
+// its cgroup.
+type HostUsage struct {
+	CPUSeconds          float64
+	CPUThrottledSeconds float64
+	MemoryBytes         int64
+	OOMKills            int64
+}
+
+// PodUsage splits the usage of a sandbox into its containers, as accounted
+// by their cgroups in the guest, and the overhead of the VM around them:
+// what its VMM uses on the host beyond the containers.
+type PodUsage struct {
+	ContainerCPUSeconds  float64
+	ContainerMemoryBytes int64
+	OverheadCPUSeconds   float64
+	OverheadMemoryBytes  int64
+}
+
+// poolBucketSeries holds the labeled metrics of a VM pool bucket.
+type poolBucketSeries struct {
+	available int64
+	inUse     int64
+	minSize   int64
+	maxSize   int64
+	hits      int64
+	misses    int64
+	reclaimed int64
+}
+
+// imageSeries holds the labeled per-image conversion metrics.
+type imageSeries struct {
+	successes int64
+	failures  int64
+	sizeBytes int64
+	duration  *Histogram
+}
+
+// SetSeriesLimits sets the maximum number of distinct sandbox and image
+// series. Existing series are kept; only new ones are affected.
+func (c *Collector) SetSeriesLimits(maxSandboxes, maxImages int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSandboxSeries = maxSandboxes
+	c.maxImageSeries = maxImages
+}
+
+// =============================================================================
+// Per-Sandbox Metrics
+// =============================================================================
+
+// SetSandboxResources records the resources allocated to a sandbox.
+func (c *Collector) SetSandboxResources(labels SandboxLabels, memoryMB, vcpus int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, ok := c.sandboxSeries[labels.SandboxID]
+	if !ok {
+		series, ok = c.sandboxOverflow[labels.SandboxID]
+	}
+	if !ok {
+		series = &sandboxSeries{}
+		if len(c.sandboxSeries) < c.maxSandboxSeries {
+			c.sandboxSeries[labels.SandboxID] = series
+		} else {
+			c.sandboxOverflow[labels.SandboxID] = series
+			c.seriesOverflows["sandbox"]++
+		}
+	}
+
+	series.labels = labels
+	series.memoryMB = memoryMB
+	series.vcpus = vcpus
+}
+
+// SetSandboxHostUsage records the host resource usage of a sandbox. It is
+// ignored for sandboxes without resources recorded.
+func (c *Collector) SetSandboxHostUsage(sandboxID string, usage HostUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, ok := c.sandboxSeries[sandboxID]
+	if !ok {
+		series, ok = c.sandboxOverflow[sandboxID]
+	}
+	if ok {
+		series.host = usage
+	}
+}
+
+// SetSandboxPodUsage records how the usage of a sandbox splits into its
+// containers and VM overhead. It is ignored for sandboxes without resources
+// recorded.
+func (c *Collector) SetSandboxPodUsage(sandboxID string, usage PodUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, ok := c.sandboxSeries[sandboxID]
+	if !ok {
+		series, ok = c.sandboxOverflow[sandboxID]
+	}
+	if ok {
+		series.pod = usage
+	}
+}
+
+// RemoveSandbox drops the series of a sandbox that no longer exists.
+func (c *Collector) RemoveSandbox(sandboxID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sandboxSeries, sandboxID)
+	delete(c.sandboxOverflow, sandboxID)
+}
+
+// =============================================================================
+// Per-Bucket Pool Metrics
+// =============================================================================
+
+// poolBucket returns the series of a pool bucket. Must be called with c.mu
+// held. Buckets are configured by the operator, so their number is bounded
+// without a series limit.
+func (c *Collector) poolBucket(bucket string) *poolBucketSeries {
+	series, ok := c.poolBuckets[bucket]
+	if !ok {
+		series = &poolBucketSeries{}
+		c.poolBuckets[bucket] = series
+	}
+	return series
+}
+
+// SetPoolBucketStats updates the statistics of a VM pool bucket.
+func (c *Collector) SetPoolBucketStats(bucket string, available, inUse, minSize, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	series := c.poolBucket(bucket)
+	series.available = available
+	series.inUse = inUse
+	series.minSize = minSize
+	series.maxSize = maxSize
+}
+
+// SetPoolBucketReclaimedMemory sets how much memory, in MiB, is ballooned
+// out of the idle VMs of a pool bucket.
+func (c *Collector) SetPoolBucketReclaimedMemory(bucket string, mb int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolBucket(bucket).reclaimed = mb
+}
+
+// RecordPoolBucketHit records an acquisition served by a pool bucket.
+func (c *Collector) RecordPoolBucketHit(bucket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolBucket(bucket).hits++
+}
+
+// RecordPoolBucketMiss records an acquisition a pool bucket fit but had no
+// VM for.
+func (c *Collector) RecordPoolBucketMiss(bucket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolBucket(bucket).misses++
+}
+
+// =============================================================================
+// Per-Image Metrics
+// =============================================================================
+
+// RecordImageConversion records the outcome of converting an image.
+func (c *Collector) RecordImageConversion(image string, duration time.Duration, sizeBytes int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, ok := c.imageSeries[image]
+	if !ok {
+		if len(c.imageSeries) >= c.maxImageSeries {
+			c.seriesOverflows["image"]++
+			image = OverflowLabel
+			series, ok = c.imageSeries[image]
+		}
+		if !ok {
+			series = &imageSeries{duration: c.newHistogram("image_conversion")}
+			c.imageSeries[image] = series
+		}
+	}
+
+	series.duration.Observe(duration.Seconds())
+	if err != nil {
+		series.failures++
+		return
+	}
+	series.successes++
+	series.sizeBytes = sizeBytes
+}
+
+// =============================================================================
+// Export
+// =============================================================================
+
+// writeLabeledMetrics writes the per-sandbox and per-image series.
+func (c *Collector) writeLabeledMetrics(w http.ResponseWriter) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// Per-sandbox gauges, with overflowed sandboxes summed into one series
+	sandboxes := make([]*sandboxSeries, 0, len(c.sandboxSeries)+1)
+	for _, series := range c.sandboxSeries {
+		sandboxes = append(sandboxes, series)
+	}
+	sort.Slice(sandboxes, func(i, j int) bool {
+		return sandboxes[i].labels.SandboxID < sandboxes[j].labels.SandboxID
+	})
+	if len(c.sandboxOverflow) > 0 {
+		other := &sandboxSeries{labels: SandboxLabels{
+			SandboxID: OverflowLabel,
+			Namespace: OverflowLabel,
+			Pod:       OverflowLabel,
+		}}
+		for _, series := range c.sandboxOverflow {
+			other.memoryMB += series.memoryMB
+			other.vcpus += series.vcpus
+			other.host.CPUSeconds += series.host.CPUSeconds
+			other.host.CPUThrottledSeconds += series.host.CPUThrottledSeconds
+			other.host.MemoryBytes += series.host.MemoryBytes
+			other.host.OOMKills += series.host.OOMKills
+			other.pod.ContainerCPUSeconds += series.pod.ContainerCPUSeconds
+			other.pod.ContainerMemoryBytes += series.pod.ContainerMemoryBytes
+			other.pod.OverheadCPUSeconds += series.pod.OverheadCPUSeconds
+			other.pod.OverheadMemoryBytes += series.pod.OverheadMemoryBytes
+		}
+		sandboxes = append(sandboxes, other)
+	}
+
+	writeHeader(w, "fc_cri_vm_memory_mb", "gauge", "Memory allocated to a sandbox VM (MB)")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_memory_mb", s.labels.String(), itoa(s.memoryMB))
+	}
+	writeHeader(w, "fc_cri_vm_vcpus", "gauge", "vCPUs allocated to a sandbox VM")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_vcpus", s.labels.String(), itoa(s.vcpus))
+	}
+	writeHeader(w, "fc_cri_vm_host_cpu_seconds_total", "counter", "Host CPU time used by a sandbox's VMM")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_host_cpu_seconds_total", s.labels.String(), ftoa(s.host.CPUSeconds))
+	}
+	writeHeader(w, "fc_cri_vm_host_cpu_throttled_seconds_total", "counter", "Time a sandbox's VMM was throttled by its CPU limit")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_host_cpu_throttled_seconds_total", s.labels.String(), ftoa(s.host.CPUThrottledSeconds))
+	}
+	writeHeader(w, "fc_cri_vm_host_memory_bytes", "gauge", "Host memory charged to a sandbox's VMM")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_host_memory_bytes", s.labels.String(), itoa(s.host.MemoryBytes))
+	}
+	writeHeader(w, "fc_cri_vm_host_oom_kills_total", "counter", "OOM kills in a sandbox's VMM cgroup")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_vm_host_oom_kills_total", s.labels.String(), itoa(s.host.OOMKills))
+	}
+	writeHeader(w, "fc_cri_pod_container_cpu_seconds_total", "counter", "CPU time used by a sandbox's containers, in the guest")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_pod_container_cpu_seconds_total", s.labels.String(), ftoa(s.pod.ContainerCPUSeconds))
+	}
+	writeHeader(w, "fc_cri_pod_container_memory_bytes", "gauge", "Memory used by a sandbox's containers, in the guest")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_pod_container_memory_bytes", s.labels.String(), itoa(s.pod.ContainerMemoryBytes))
+	}
+	writeHeader(w, "fc_cri_pod_overhead_cpu_seconds_total", "counter", "Host CPU time used by a sandbox's VM beyond its containers")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_pod_overhead_cpu_seconds_total", s.labels.String(), ftoa(s.pod.OverheadCPUSeconds))
+	}
+	writeHeader(w, "fc_cri_pod_overhead_memory_bytes", "gauge", "Host memory used by a sandbox's VM beyond its containers")
+	for _, s := range sandboxes {
+		writeLabeled(w, "fc_cri_pod_overhead_memory_bytes", s.labels.String(), itoa(s.pod.OverheadMemoryBytes))
+	}
+
+	// Per-bucket pool metrics
+	buckets := make([]string, 0, len(c.poolBuckets))
+	for bucket := range c.poolBuckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	for _, m := range []struct {
+		name, metricType, help string
+		value                  func(*poolBucketSeries) int64
+	}{
+		{"fc_cri_pool_bucket_available", "gauge", "VMs available in a pool bucket", func(s *poolBucketSeries) int64 { return s.available }},
+		{"fc_cri_pool_bucket_in_use", "gauge", "VMs from a pool bucket currently in use", func(s *poolBucketSeries) int64 { return s.inUse }},
+		{"fc_cri_pool_bucket_min_size", "gauge", "VMs a pool bucket keeps warm", func(s *poolBucketSeries) int64 { return s.minSize }},
+		{"fc_cri_pool_bucket_max_size", "gauge", "Maximum VMs a pool bucket holds", func(s *poolBucketSeries) int64 { return s.maxSize }},
+		{"fc_cri_pool_bucket_reclaimed_memory_mb", "gauge", "Memory ballooned out of the idle VMs of a pool bucket, in MiB", func(s *poolBucketSeries) int64 { return s.reclaimed }},
+		{"fc_cri_pool_bucket_hits_total", "counter", "Acquisitions served by a pool bucket", func(s *poolBucketSeries) int64 { return s.hits }},
+		{"fc_cri_pool_bucket_misses_total", "counter", "Acquisitions a pool bucket fit but had no VM for", func(s *poolBucketSeries) int64 { return s.misses }},
+	} {
+		writeHeader(w, m.name, m.metricType, m.help)
+		for _, bucket := range buckets {
+			writeLabeled(w, m.name, label("bucket", bucket), itoa(m.value(c.poolBuckets[bucket])))
+		}
+	}
+
+	// Per-image conversion metrics
+	images := make([]string, 0, len(c.imageSeries))
+	for image := range c.imageSeries {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	writeHeader(w, "fc_cri_image_conversions_total", "counter", "Image conversions by result")
+	for _, image := range images {
+		series := c.imageSeries[image]
+		writeLabeled(w, "fc_cri_image_conversions_total", label("image", image)+`,result="success"`, itoa(series.successes))
+		writeLabeled(w, "fc_cri_image_conversions_total", label("image", image)+`,result="failure"`, itoa(series.failures))
+	}
+	writeHeader(w, "fc_cri_image_size_bytes", "gauge", "Size of the last converted rootfs image")
+	for _, image := range images {
+		writeLabeled(w, "fc_cri_image_size_bytes", label("image", image), itoa(c.imageSeries[image].sizeBytes))
+	}
+	writeHistogramHeader(w, "fc_cri_image_conversion_duration_seconds", "Image conversion latency")
+	for _, image := range images {
+		writeHistogram(w, "fc_cri_image_conversion_duration_seconds", label("image", image), c.imageSeries[image].duration.Snapshot())
+	}
+
+	// Cardinality protection
+	writeHeader(w, "fc_cri_metric_series_overflow_total", "counter", "Series folded into the overflow label after hitting the series limit")
+	for _, kind := range []string{"image", "sandbox"} {
+		writeLabeled(w, "fc_cri_metric_series_overflow_total", label("kind", kind), itoa(c.seriesOverflows[kind]))
+	}
+}
+
+// String formats the labels for the Prometheus text format.
+func (l SandboxLabels) String() string {
+	return label("sandbox_id", l.SandboxID) + "," + label("namespace", l.Namespace) + "," + label("pod", l.Pod)
+}
+
+func writeHeader(w http.ResponseWriter, name, metricType, help string) {
+	_, _ = w.Write([]byte("# HELP " + name + " " + help + "\n"))
+	_, _ = w.Write([]byte("# TYPE " + name + " " + metricType + "\n"))
+}
+
+func writeLabeled(w http.ResponseWriter, name, labels, value string) {
+	_, _ = w.Write([]byte(name + "{" + labels + "} " + value + "\n"))
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func scrape(t *testing.T, c *Collector) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	return string(body)
+}
+
+func TestCollector_SandboxSeries(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+
+	c.SetSandboxResources(SandboxLabels{SandboxID: "fc-1", Namespace: "default", Pod: "nginx"}, 256, 2)
+	c.SetSandboxHostUsage("fc-1", HostUsage{CPUSeconds: 1.5, MemoryBytes: 300 << 20, OOMKills: 1})
+	c.SetSandboxHostUsage("fc-unknown", HostUsage{CPUSeconds: 3})
+	c.SetSandboxPodUsage("fc-1", PodUsage{ContainerCPUSeconds: 1, ContainerMemoryBytes: 200 << 20, OverheadCPUSeconds: 0.5, OverheadMemoryBytes: 100 << 20})
+	out := scrape(t, c)
+
+	expected := []string{
+		`fc_cri_vm_memory_mb{sandbox_id="fc-1",namespace="default",pod="nginx"} 256`,
+		`fc_cri_vm_vcpus{sandbox_id="fc-1",namespace="default",pod="nginx"} 2`,
+		`fc_cri_vm_host_cpu_seconds_total{sandbox_id="fc-1",namespace="default",pod="nginx"} 1.5`,
+		`fc_cri_vm_host_memory_bytes{sandbox_id="fc-1",namespace="default",pod="nginx"} 314572800`,
+		`fc_cri_vm_host_oom_kills_total{sandbox_id="fc-1",namespace="default",pod="nginx"} 1`,
+		`fc_cri_pod_container_memory_bytes{sandbox_id="fc-1",namespace="default",pod="nginx"} 209715200`,
+		`fc_cri_pod_overhead_cpu_seconds_total{sandbox_id="fc-1",namespace="default",pod="nginx"} 0.5`,
+	}
+	for _, exp := range expected {
+		if !strings.Contains(out, exp) {
+			t.Errorf("Response missing expected string: %s", exp)
+		}
+	}
+
+	c.RemoveSandbox("fc-1")
+	if strings.Contains(out, "fc-unknown") {
+		t.Error("Host usage of an unknown sandbox was exported")
+	}
+	if strings.Contains(scrape(t, c), `sandbox_id="fc-1"`) {
+		t.Error("Removed sandbox still exported")
+	}
+}
+
+func TestCollector_SeriesLimits(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+	c.SetSeriesLimits(1, 1)
+
+	c.SetSandboxResources(SandboxLabels{SandboxID: "fc-1"}, 128, 1)
+	c.SetSandboxResources(SandboxLabels{SandboxID: "fc-2"}, 128, 1)
+	c.SetSandboxResources(SandboxLabels{SandboxID: "fc-3"}, 256, 1)
+
+	c.RecordImageConversion("nginx:latest", time.Second, 1024, nil)
+	c.RecordImageConversion("redis:latest", time.Second, 2048, nil)
+	c.RecordImageConversion("alpine:latest", time.Second, 0, errors.New("pull failed"))
+
+	out := scrape(t, c)
+	expected := []string{
+		`fc_cri_vm_memory_mb{sandbox_id="fc-1",namespace="",pod=""} 128`,
+		`fc_cri_vm_memory_mb{sandbox_id="other",namespace="other",pod="other"} 384`,
+		`fc_cri_image_conversions_total{image="nginx:latest",result="success"} 1`,
+		`fc_cri_image_conversions_total{image="other",result="success"} 1`,
+		`fc_cri_image_conversions_total{image="other",result="failure"} 1`,
+		`fc_cri_image_conversion_duration_seconds_count{image="other"} 2`,
+		`fc_cri_metric_series_overflow_total{kind="sandbox"} 2`,
+		`fc_cri_metric_series_overflow_total{kind="image"} 2`,
+	}
+	for _, exp := range expected {
+		if !strings.Contains(out, exp) {
+			t.Errorf("Response missing expected string: %s", exp)
+		}
+	}
+	if strings.Contains(out, "redis") {
+		t.Error("Image over the series limit was exported with its own label")
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	got := label("pod", "a\"b\\c\nd")
+	want := `pod="a\"b\\c\nd"`
+	if got != want {
+		t.Errorf("label() = %s, want %s", got, want)
+	}
+}
+
+func TestCollector_PoolBucketSeries(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+
+	c.SetPoolBucketStats("large", 2, 1, 2, 4)
+	c.RecordPoolBucketHit("large")
+	c.SetPoolBucketReclaimedMemory("large", 1920)
+	c.RecordPoolBucketMiss("large")
+	c.RecordPoolBucketMiss("large")
+	out := scrape(t, c)
+
+	expected := []string{
+		`fc_cri_pool_bucket_available{bucket="large"} 2`,
+		`fc_cri_pool_bucket_in_use{bucket="large"} 1`,
+		`fc_cri_pool_bucket_min_size{bucket="large"} 2`,
+		`fc_cri_pool_bucket_max_size{bucket="large"} 4`,
+		`fc_cri_pool_bucket_reclaimed_memory_mb{bucket="large"} 1920`,
+		`fc_cri_pool_bucket_hits_total{bucket="large"} 1`,
+		`fc_cri_pool_bucket_misses_total{bucket="large"} 2`,
+	}
+	for _, exp := range expected {
+		if !strings.Contains(out, exp) {
+			t.Errorf("Response missing expected string: %s", exp)
+		}
+	}
+}
@@ -10,6 +10,7 @@ package metrics
 
 import (
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -26,19 +27,41 @@ type Collector struct {
 	poolHits        int64
 	poolMisses      int64
 	poolMaxSize     int64
-	poolWarmingTime []float64 // Recent warming times in ms
+	poolWarmingTime *Histogram
 
-	// Operation latencies (in milliseconds)
-	createLatencies []float64
-	startLatencies  []float64
-	stopLatencies   []float64
-	deleteLatencies []float64
+	// Resources the pool's idle VMs hold
+	poolReservedVCPUs    int64
+	poolReservedMemoryMB int64
+	poolBuckets          map[string]*poolBucketSeries // see labeled.go
+
+	// Whether the pool keeps up with churn
+	poolReplenishBacklog int64
+	poolBelowMinSince    time.Time
+
+	// Operation latency histograms (in seconds), keyed by operation
+	latencies map[string]*Histogram
+
+	// Bucket bounds overriding DefaultLatencyBuckets, keyed by operation
+	buckets map[string][]float64
+
+	// Operations currently running, keyed by operation
+	inFlight map[string]int64
+
+	// Labeled per-sandbox and per-image series (see labeled.go)
+	sandboxSeries    map[string]*sandboxSeries
+	sandboxOverflow  map[string]*sandboxSeries
+	imageSeries      map[string]*imageSeries
+	seriesOverflows  map[string]int64
+	maxSandboxSeries int
+	maxImageSeries   int
 
 	// Counters
 	totalVMsCreated   int64
 	totalVMsDestroyed int64
 	totalContainers   int64
 	activeContainers  int64
+	oomKills          int64
+	snapshotRebuilds  int64
 
 	// Error counters
 	vmCreateErrors     int64
@@ -46,23 +69,169 @@ type Collector struct {
 	containerErrors    int64
 	agentConnectErrors int64
 
+	// VM creation retries after transient failures
+	vmCreateRetries          int64
+	vmCreateRetriesRecovered int64
+	vmCreateRetriesExhausted int64
+
+	// Restarts and failures, keyed by component and event
+	componentEvents map[ComponentEvent]int64
+
 	// Resource metrics
 	totalMemoryMB int64
 	totalVCPUs    int64
 
+	// File descriptor metrics
+	nodeFDsUsed        int64
+	nodeFDsMax         int64
+	shimFDsUsed        int64
+	shimFDsMax         int64
+	vmmFDsUsed         int64
+	fdAdmissionRejects int64
+
+	// Waits for node-wide task operation slots, keyed by operation (see
+	// throttle.go)
+	taskThrottles map[string]*TaskThrottle
+
+	// Counter samples for precomputed rates, nil unless started (see
+	// rates.go)
+	rates *rateTracker
+
 	log *logrus.Entry
 }
 
+// Bucket keys for histograms that aren't container operations.
+const (
+	PoolWarmBuckets        = "pool_warm"
+	ImageConversionBuckets = "image_conversion"
+)
+
+// defaultImageConversionBuckets cover conversions from sub-second to minutes.
+var defaultImageConversionBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Operations tracked by in-flight gauges.
+const (
+	InFlightCreate          = "create"
+	InFlightStart           = "start"
+	InFlightImageConversion = "image_conversion"
+	InFlightSnapshotRestore = "snapshot_restore"
+	InFlightAgentRPC        = "agent_rpc"
+)
+
+// defaultInFlight always have an in-flight gauge, even before the first
+// operation, so alerts on them don't see missing series.
+var defaultInFlight = []string{
+	InFlightCreate, InFlightStart, InFlightImageConversion, InFlightSnapshotRestore, InFlightAgentRPC,
+}
+
+// Components and their events counted by fc_cri_component_events_total.
+const (
+	ComponentShim  = "shim"
+	ComponentAgent = "agent"
+	ComponentVMM   = "vmm"
+	ComponentCNI   = "cni"
+
+	EventRestart        = "restart"
+	EventReconnect      = "reconnect"
+	EventUnexpectedExit = "unexpected_exit"
+	EventFailure        = "failure"
+	EventUnresponsive   = "unresponsive"
+)
+
+// ComponentEvent is a restart or failure of a runtime component.
+type ComponentEvent struct {
+	Component string `json:"component"`
+	Event     string `json:"event"`
+}
+
+// defaultComponentEvents are exported from startup, so rate() sees the
+// first occurrence.
+var defaultComponentEvents = []ComponentEvent{
+	{ComponentShim, EventRestart},
+	{ComponentAgent, EventReconnect},
+	{ComponentAgent, EventUnresponsive},
+	{ComponentVMM, EventUnexpectedExit},
+	{ComponentCNI, EventFailure},
+}
+
+// defaultOperations always have a latency histogram, even before the first
+// observation, so dashboards see the series from startup.
+var defaultOperations = []string{"create", "start", "stop", "delete"}
+
 // NewCollector creates a new metrics collector.
 func NewCollector(log *logrus.Entry) *Collector {
-	return &Collector{
-		log:             log.WithField("component", "metrics"),
-		createLatencies: make([]float64, 0, 100),
-		startLatencies:  make([]float64, 0, 100),
-		stopLatencies:   make([]float64, 0, 100),
-		deleteLatencies: make([]float64, 0, 100),
-		poolWarmingTime: make([]float64, 0, 100),
+	c := &Collector{
+		log:       log.WithField("component", "metrics"),
+		latencies: make(map[string]*Histogram),
+		inFlight:  make(map[string]int64),
+
+		componentEvents: make(map[ComponentEvent]int64),
+		taskThrottles:   make(map[string]*TaskThrottle),
+		buckets: map[string][]float64{
+			ImageConversionBuckets: defaultImageConversionBuckets,
+		},
+
+		sandboxSeries:    make(map[string]*sandboxSeries),
+		sandboxOverflow:  make(map[string]*sandboxSeries),
+		imageSeries:      make(map[string]*imageSeries),
+		poolBuckets:      make(map[string]*poolBucketSeries),
+		seriesOverflows:  make(map[string]int64),
+		maxSandboxSeries: DefaultMaxSandboxSeries,
+		maxImageSeries:   DefaultMaxImageSeries,
+	}
+
+	for _, op := range defaultOperations {
+		c.latencies[op] = c.newHistogram(op)
+	}
+	c.poolWarmingTime = c.newHistogram(PoolWarmBuckets)
+	for _, op := range defaultInFlight {
+		c.inFlight[op] = 0
 	}
+	for _, ev := range defaultComponentEvents {
+		c.componentEvents[ev] = 0
+	}
+	for _, op := range defaultTaskOps {
+		c.taskThrottles[op] = &TaskThrottle{}
+	}
+
+	return c
+}
+
+// SetBuckets sets the histogram bucket upper bounds (in seconds) for an
+// operation, or for the pool warm time and image conversions with
+// PoolWarmBuckets and ImageConversionBuckets. Observations already recorded
+// for that operation are discarded; image series created before the call
+// keep their buckets.
+func (c *Collector) SetBuckets(operation string, bounds []float64) error {
+	if err := ValidateBuckets(bounds); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buckets[operation] = append([]float64(nil), bounds...)
+	switch operation {
+	case PoolWarmBuckets:
+		c.poolWarmingTime = c.newHistogram(operation)
+	case ImageConversionBuckets:
+		// Applies to image series created from now on
+	default:
+		c.latencies[operation] = c.newHistogram(operation)
+	}
+	return nil
+}
+
+// newHistogram creates a histogram with the configured buckets for an
+// operation. Callers must hold c.mu or own c exclusively.
+func (c *Collector) newHistogram(operation string) *Histogram {
+	bounds, ok := c.buckets[operation]
+	if !ok {
+		bounds = DefaultLatencyBuckets
+	}
+	// Bounds are validated by SetBuckets
+	h, _ := NewHistogram(bounds)
+	return h
 }
 
 // =============================================================================
@@ -78,6 +247,24 @@ func (c *Collector) SetPoolStats(available, inUse, maxSize int64) {
 	c.poolMaxSize = maxSize
 }
 
+// SetPoolReservation updates the vCPUs and memory held by the pool's idle
+// VMs, which no pod accounts for.
+func (c *Collector) SetPoolReservation(vcpus, memoryMB int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolReservedVCPUs = vcpus
+	c.poolReservedMemoryMB = memoryMB
+}
+
+// SetPoolReplenishState updates how many VMs the pool is short of its
+// minimum size, and since when it has been short of it (zero if it isn't).
+func (c *Collector) SetPoolReplenishState(backlog int64, belowMinSince time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.poolReplenishBacklog = backlog
+	c.poolBelowMinSince = belowMinSince
+}
+
 // RecordPoolHit records a successful pool acquisition.
 func (c *Collector) RecordPoolHit() {
 	c.mu.Lock()
@@ -96,7 +283,7 @@ func (c *Collector) RecordPoolMiss() {
 func (c *Collector) RecordPoolWarmTime(duration time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.poolWarmingTime = appendWithLimit(c.poolWarmingTime, float64(duration.Milliseconds()), 100)
+	c.poolWarmingTime.Observe(duration.Seconds())
 }
 
 // =============================================================================
@@ -126,21 +313,40 @@ func (t *Timer) Stop() time.Duration {
 	return duration
 }
 
+// ObserveLatency records the latency of an operation timed by the caller.
+func (c *Collector) ObserveLatency(operation string, duration time.Duration) {
+	c.recordLatency(operation, duration)
+}
+
 func (c *Collector) recordLatency(operation string, duration time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	ms := float64(duration.Milliseconds())
+	h, ok := c.latencies[operation]
+	if !ok {
+		h = c.newHistogram(operation)
+		c.latencies[operation] = h
+	}
+	h.Observe(duration.Seconds())
+}
 
-	switch operation {
-	case "create":
-		c.createLatencies = appendWithLimit(c.createLatencies, ms, 100)
-	case "start":
-		c.startLatencies = appendWithLimit(c.startLatencies, ms, 100)
-	case "stop":
-		c.stopLatencies = appendWithLimit(c.stopLatencies, ms, 100)
-	case "delete":
-		c.deleteLatencies = appendWithLimit(c.deleteLatencies, ms, 100)
+// TrackInFlight counts an operation as in flight until the returned function
+// is called. Latency percentiles only show slow operations once they finish;
+// the in-flight gauges show them piling up while they run.
+//
+//	defer metrics.Global().TrackInFlight(metrics.InFlightCreate)()
+func (c *Collector) TrackInFlight(operation string) func() {
+	c.mu.Lock()
+	c.inFlight[operation]++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.inFlight[operation]--
+		})
 	}
 }
 
@@ -190,6 +396,40 @@ func (c *Collector) RecordContainerDestroyed() {
 	}
 }
 
+// RecordOOMKill records a process in a container killed by the guest OOM
+// killer.
+func (c *Collector) RecordOOMKill() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.oomKills++
+}
+
+// RecordSnapshotRebuild records a golden snapshot rebuilt because the
+// kernel, rootfs or agent it was taken with changed.
+func (c *Collector) RecordSnapshotRebuild() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshotRebuilds++
+}
+
+// SetFDUsage updates file descriptor usage.
+func (c *Collector) SetFDUsage(nodeUsed, nodeMax, shimUsed, shimMax, vmmUsed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeFDsUsed = nodeUsed
+	c.nodeFDsMax = nodeMax
+	c.shimFDsUsed = shimUsed
+	c.shimFDsMax = shimMax
+	c.vmmFDsUsed = vmmUsed
+}
+
+// RecordFDAdmissionReject records a VM refused because FDs were nearly exhausted.
+func (c *Collector) RecordFDAdmissionReject() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fdAdmissionRejects++
+}
+
 // =============================================================================
 // Error Metrics
 // =============================================================================
@@ -222,6 +462,35 @@ func (c *Collector) RecordAgentConnectError() {
 	c.agentConnectErrors++
 }
 
+// RecordVMCreateRetry records a VM creation tried again after a transient
+// failure.
+func (c *Collector) RecordVMCreateRetry() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vmCreateRetries++
+}
+
+// RecordVMCreateRetryOutcome records how a VM creation that was retried
+// ended: recovered, or failed once out of attempts.
+func (c *Collector) RecordVMCreateRetryOutcome(recovered bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if recovered {
+		c.vmCreateRetriesRecovered++
+	} else {
+		c.vmCreateRetriesExhausted++
+	}
+}
+
+// RecordComponentEvent counts a restart or failure of a component, such as
+// a shim restarting or a VMM exiting on its own. The counters only grow, so
+// a component that keeps failing shows up even when each failure is brief.
+func (c *Collector) RecordComponentEvent(component, event string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.componentEvents[ComponentEvent{component, event}]++
+}
+
 // =============================================================================
 // Metrics Export
 // =============================================================================
@@ -236,7 +505,14 @@ type Snapshot struct {
 	PoolMisses    int64   `json:"pool_misses"`
 	PoolHitRate   float64 `json:"pool_hit_rate"`
 
-	// Latencies (p50, p95, p99 in ms)
+	PoolReservedVCPUs    int64 `json:"pool_reserved_vcpus"`
+	PoolReservedMemoryMB int64 `json:"pool_reserved_memory_mb"`
+
+	// VMs the pool is short of its minimum size, and for how long
+	PoolReplenishBacklog    int64   `json:"pool_replenish_backlog"`
+	PoolBelowMinSizeSeconds float64 `json:"pool_below_min_size_seconds"`
+
+	// Latencies (p50, p95, p99 in ms), estimated from the histograms
 	CreateLatencyP50 float64 `json:"create_latency_p50_ms"`
 	CreateLatencyP95 float64 `json:"create_latency_p95_ms"`
 	CreateLatencyP99 float64 `json:"create_latency_p99_ms"`
@@ -244,21 +520,52 @@ type Snapshot struct {
 	StartLatencyP95  float64 `json:"start_latency_p95_ms"`
 	StartLatencyP99  float64 `json:"start_latency_p99_ms"`
 
+	// Latency histograms (seconds), keyed by operation
+	Latencies    map[string]HistogramSnapshot `json:"latencies"`
+	PoolWarmTime HistogramSnapshot            `json:"pool_warm_time"`
+
+	// Operations currently running, keyed by operation
+	InFlight map[string]int64 `json:"in_flight"`
+
 	// Counters
 	TotalVMsCreated   int64 `json:"total_vms_created"`
 	TotalVMsDestroyed int64 `json:"total_vms_destroyed"`
 	TotalContainers   int64 `json:"total_containers"`
 	ActiveContainers  int64 `json:"active_containers"`
+	OOMKills          int64 `json:"oom_kills"`
+	SnapshotRebuilds  int64 `json:"snapshot_rebuilds"`
 
 	// Resources
 	TotalMemoryMB int64 `json:"total_memory_mb"`
 	TotalVCPUs    int64 `json:"total_vcpus"`
 
+	// File descriptors
+	NodeFDsUsed        int64 `json:"node_fds_used"`
+	NodeFDsMax         int64 `json:"node_fds_max"`
+	ShimFDsUsed        int64 `json:"shim_fds_used"`
+	ShimFDsMax         int64 `json:"shim_fds_max"`
+	VMMFDsUsed         int64 `json:"vmm_fds_used"`
+	FDAdmissionRejects int64 `json:"fd_admission_rejects"`
+
 	// Errors
 	VMCreateErrors     int64 `json:"vm_create_errors"`
 	VMDestroyErrors    int64 `json:"vm_destroy_errors"`
 	ContainerErrors    int64 `json:"container_errors"`
 	AgentConnectErrors int64 `json:"agent_connect_errors"`
+
+	// VM creation retries
+	VMCreateRetries          int64 `json:"vm_create_retries"`
+	VMCreateRetriesRecovered int64 `json:"vm_create_retries_recovered"`
+	VMCreateRetriesExhausted int64 `json:"vm_create_retries_exhausted"`
+
+	// Restarts and failures, by component then event
+	ComponentEvents map[string]map[string]int64 `json:"component_events"`
+
+	// Waits for node-wide task operation slots, by operation
+	TaskThrottles map[string]TaskThrottle `json:"task_throttles"`
+
+	// Per-second rates by counter then window, e.g. "1m", if started
+	Rates map[string]map[string]float64 `json:"rates,omitempty"`
 }
 
 // GetSnapshot returns a snapshot of current metrics.
@@ -272,6 +579,36 @@ func (c *Collector) GetSnapshot() Snapshot {
 		hitRate = float64(c.poolHits) / float64(total) * 100
 	}
 
+	// Measured at scrape time, so the gauge keeps growing between updates
+	belowMin := float64(0)
+	if !c.poolBelowMinSince.IsZero() {
+		belowMin = time.Since(c.poolBelowMinSince).Seconds()
+	}
+
+	latencies := make(map[string]HistogramSnapshot, len(c.latencies))
+	for op, h := range c.latencies {
+		latencies[op] = h.Snapshot()
+	}
+	create, start := latencies["create"], latencies["start"]
+
+	inFlight := make(map[string]int64, len(c.inFlight))
+	for op, n := range c.inFlight {
+		inFlight[op] = n
+	}
+
+	componentEvents := make(map[string]map[string]int64)
+	for ev, n := range c.componentEvents {
+		if componentEvents[ev.Component] == nil {
+			componentEvents[ev.Component] = make(map[string]int64)
+		}
+		componentEvents[ev.Component][ev.Event] = n
+	}
+
+	taskThrottles := make(map[string]TaskThrottle, len(c.taskThrottles))
+	for op, t := range c.taskThrottles {
+		taskThrottles[op] = *t
+	}
+
 	return Snapshot{
 		PoolAvailable: c.poolAvailable,
 		PoolInUse:     c.poolInUse,
@@ -280,25 +617,53 @@ func (c *Collector) GetSnapshot() Snapshot {
 		PoolMisses:    c.poolMisses,
 		PoolHitRate:   hitRate,
 
-		CreateLatencyP50: percentile(c.createLatencies, 0.50),
-		CreateLatencyP95: percentile(c.createLatencies, 0.95),
-		CreateLatencyP99: percentile(c.createLatencies, 0.99),
-		StartLatencyP50:  percentile(c.startLatencies, 0.50),
-		StartLatencyP95:  percentile(c.startLatencies, 0.95),
-		StartLatencyP99:  percentile(c.startLatencies, 0.99),
+		PoolReservedVCPUs:    c.poolReservedVCPUs,
+		PoolReservedMemoryMB: c.poolReservedMemoryMB,
+
+		PoolReplenishBacklog:    c.poolReplenishBacklog,
+		PoolBelowMinSizeSeconds: belowMin,
+
+		CreateLatencyP50: create.Quantile(0.50) * 1000,
+		CreateLatencyP95: create.Quantile(0.95) * 1000,
+		CreateLatencyP99: create.Quantile(0.99) * 1000,
+		StartLatencyP50:  start.Quantile(0.50) * 1000,
+		StartLatencyP95:  start.Quantile(0.95) * 1000,
+		StartLatencyP99:  start.Quantile(0.99) * 1000,
+
+		Latencies:    latencies,
+		PoolWarmTime: c.poolWarmingTime.Snapshot(),
+		InFlight:     inFlight,
 
 		TotalVMsCreated:   c.totalVMsCreated,
 		TotalVMsDestroyed: c.totalVMsDestroyed,
 		TotalContainers:   c.totalContainers,
 		ActiveContainers:  c.activeContainers,
+		OOMKills:          c.oomKills,
+		SnapshotRebuilds:  c.snapshotRebuilds,
 
 		TotalMemoryMB: c.totalMemoryMB,
 		TotalVCPUs:    c.totalVCPUs,
 
+		NodeFDsUsed:        c.nodeFDsUsed,
+		NodeFDsMax:         c.nodeFDsMax,
+		ShimFDsUsed:        c.shimFDsUsed,
+		ShimFDsMax:         c.shimFDsMax,
+		VMMFDsUsed:         c.vmmFDsUsed,
+		FDAdmissionRejects: c.fdAdmissionRejects,
+
 		VMCreateErrors:     c.vmCreateErrors,
 		VMDestroyErrors:    c.vmDestroyErrors,
 		ContainerErrors:    c.containerErrors,
 		AgentConnectErrors: c.agentConnectErrors,
+
+		VMCreateRetries:          c.vmCreateRetries,
+		VMCreateRetriesRecovered: c.vmCreateRetriesRecovered,
+		VMCreateRetriesExhausted: c.vmCreateRetriesExhausted,
+
+		ComponentEvents: componentEvents,
+		TaskThrottles:   taskThrottles,
+
+		Rates: c.ratesAt(time.Now()),
 	}
 }
 
@@ -316,30 +681,102 @@ func (c *Collector) PrometheusHandler() http.Handler {
 		writeMetric(w, "fc_cri_pool_hits_total", "counter", "Total pool hits", snap.PoolHits)
 		writeMetric(w, "fc_cri_pool_misses_total", "counter", "Total pool misses", snap.PoolMisses)
 		writeMetricFloat(w, "fc_cri_pool_hit_rate", "gauge", "Pool hit rate percentage", snap.PoolHitRate)
+		writeMetric(w, "fc_cri_pool_reserved_vcpus", "gauge", "vCPUs held by idle pooled VMs", snap.PoolReservedVCPUs)
+		writeMetric(w, "fc_cri_pool_reserved_memory_mb", "gauge", "Memory in MiB held by idle pooled VMs", snap.PoolReservedMemoryMB)
+		writeMetric(w, "fc_cri_pool_replenish_backlog", "gauge", "VMs the pool is short of its minimum size", snap.PoolReplenishBacklog)
+		writeMetricFloat(w, "fc_cri_pool_below_min_size_seconds", "gauge", "Seconds since the pool last held its minimum size, 0 while it does", snap.PoolBelowMinSizeSeconds)
+		writeHistogramHeader(w, "fc_cri_pool_warm_duration_seconds", "Time to warm a VM in the pool")
+		writeHistogram(w, "fc_cri_pool_warm_duration_seconds", "", snap.PoolWarmTime)
 
 		// Latency metrics
-		writeMetricFloat(w, "fc_cri_create_latency_p50_ms", "gauge", "Container create latency p50", snap.CreateLatencyP50)
-		writeMetricFloat(w, "fc_cri_create_latency_p95_ms", "gauge", "Container create latency p95", snap.CreateLatencyP95)
-		writeMetricFloat(w, "fc_cri_create_latency_p99_ms", "gauge", "Container create latency p99", snap.CreateLatencyP99)
-		writeMetricFloat(w, "fc_cri_start_latency_p50_ms", "gauge", "Container start latency p50", snap.StartLatencyP50)
-		writeMetricFloat(w, "fc_cri_start_latency_p95_ms", "gauge", "Container start latency p95", snap.StartLatencyP95)
-		writeMetricFloat(w, "fc_cri_start_latency_p99_ms", "gauge", "Container start latency p99", snap.StartLatencyP99)
+		ops := make([]string, 0, len(snap.Latencies))
+		for op := range snap.Latencies {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		writeHistogramHeader(w, "fc_cri_operation_duration_seconds", "Container operation latency")
+		for _, op := range ops {
+			writeHistogram(w, "fc_cri_operation_duration_seconds", `operation="`+op+`"`, snap.Latencies[op])
+		}
+
+		// Deprecated: estimated from the histograms, and kept for dashboards
+		// built on them until the release after next
+		writeMetricFloat(w, "fc_cri_create_latency_p50_ms", "gauge", "Container create latency p50 (deprecated, use fc_cri_operation_duration_seconds)", snap.CreateLatencyP50)
+		writeMetricFloat(w, "fc_cri_create_latency_p95_ms", "gauge", "Container create latency p95 (deprecated, use fc_cri_operation_duration_seconds)", snap.CreateLatencyP95)
+		writeMetricFloat(w, "fc_cri_create_latency_p99_ms", "gauge", "Container create latency p99 (deprecated, use fc_cri_operation_duration_seconds)", snap.CreateLatencyP99)
+		writeMetricFloat(w, "fc_cri_start_latency_p50_ms", "gauge", "Container start latency p50 (deprecated, use fc_cri_operation_duration_seconds)", snap.StartLatencyP50)
+		writeMetricFloat(w, "fc_cri_start_latency_p95_ms", "gauge", "Container start latency p95 (deprecated, use fc_cri_operation_duration_seconds)", snap.StartLatencyP95)
+		writeMetricFloat(w, "fc_cri_start_latency_p99_ms", "gauge", "Container start latency p99 (deprecated, use fc_cri_operation_duration_seconds)", snap.StartLatencyP99)
+
+		// In-flight metrics
+		ops = ops[:0]
+		for op := range snap.InFlight {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		_, _ = w.Write([]byte("# HELP fc_cri_operations_in_flight Operations currently running\n"))
+		_, _ = w.Write([]byte("# TYPE fc_cri_operations_in_flight gauge\n"))
+		for _, op := range ops {
+			_, _ = w.Write([]byte(`fc_cri_operations_in_flight{operation="` + op + `"} ` + itoa(snap.InFlight[op]) + "\n"))
+		}
 
 		// Counter metrics
 		writeMetric(w, "fc_cri_vms_created_total", "counter", "Total VMs created", snap.TotalVMsCreated)
 		writeMetric(w, "fc_cri_vms_destroyed_total", "counter", "Total VMs destroyed", snap.TotalVMsDestroyed)
 		writeMetric(w, "fc_cri_containers_total", "counter", "Total containers created", snap.TotalContainers)
 		writeMetric(w, "fc_cri_containers_active", "gauge", "Active containers", snap.ActiveContainers)
+		writeMetric(w, "fc_cri_oom_kills_total", "counter", "Total container processes killed by the guest OOM killer", snap.OOMKills)
+		writeMetric(w, "fc_cri_snapshot_rebuilds_total", "counter", "Golden snapshots rebuilt because their kernel, rootfs or agent changed", snap.SnapshotRebuilds)
 
 		// Resource metrics
 		writeMetric(w, "fc_cri_total_memory_mb", "gauge", "Total memory allocated to VMs (MB)", snap.TotalMemoryMB)
 		writeMetric(w, "fc_cri_total_vcpus", "gauge", "Total vCPUs allocated to VMs", snap.TotalVCPUs)
 
+		// File descriptor metrics
+		writeMetric(w, "fc_cri_node_fds_used", "gauge", "Node-wide allocated file handles", snap.NodeFDsUsed)
+		writeMetric(w, "fc_cri_node_fds_max", "gauge", "Node-wide file handle limit", snap.NodeFDsMax)
+		writeMetric(w, "fc_cri_shim_fds_used", "gauge", "File descriptors open in the shim", snap.ShimFDsUsed)
+		writeMetric(w, "fc_cri_shim_fds_max", "gauge", "Shim RLIMIT_NOFILE soft limit", snap.ShimFDsMax)
+		writeMetric(w, "fc_cri_vmm_fds_used", "gauge", "File descriptors open across all VMMs", snap.VMMFDsUsed)
+		writeMetric(w, "fc_cri_fd_admission_rejects_total", "counter", "VMs refused because file descriptors were nearly exhausted", snap.FDAdmissionRejects)
+
 		// Error metrics
 		writeMetric(w, "fc_cri_vm_create_errors_total", "counter", "Total VM creation errors", snap.VMCreateErrors)
 		writeMetric(w, "fc_cri_vm_destroy_errors_total", "counter", "Total VM destruction errors", snap.VMDestroyErrors)
 		writeMetric(w, "fc_cri_container_errors_total", "counter", "Total container errors", snap.ContainerErrors)
 		writeMetric(w, "fc_cri_agent_connect_errors_total", "counter", "Total agent connection errors", snap.AgentConnectErrors)
+		writeMetric(w, "fc_cri_vm_create_retries_total", "counter", "VM creations tried again after a transient failure", snap.VMCreateRetries)
+		writeMetric(w, "fc_cri_vm_create_retries_recovered_total", "counter", "Retried VM creations that succeeded", snap.VMCreateRetriesRecovered)
+		writeMetric(w, "fc_cri_vm_create_retries_exhausted_total", "counter", "Retried VM creations that ran out of attempts", snap.VMCreateRetriesExhausted)
+
+		// Component restart and failure metrics
+		components := make([]string, 0, len(snap.ComponentEvents))
+		for component := range snap.ComponentEvents {
+			components = append(components, component)
+		}
+		sort.Strings(components)
+		_, _ = w.Write([]byte("# HELP fc_cri_component_events_total Restarts and failures of runtime components\n"))
+		_, _ = w.Write([]byte("# TYPE fc_cri_component_events_total counter\n"))
+		for _, component := range components {
+			events := make([]string, 0, len(snap.ComponentEvents[component]))
+			for event := range snap.ComponentEvents[component] {
+				events = append(events, event)
+			}
+			sort.Strings(events)
+			for _, event := range events {
+				_, _ = w.Write([]byte(`fc_cri_component_events_total{component="` + component + `",event="` + event + `"} ` +
+					itoa(snap.ComponentEvents[component][event]) + "\n"))
+			}
+		}
+
+		// Task operation throttling
+		writeTaskThrottles(w, snap.TaskThrottles)
+
+		// Precomputed rates
+		writeRates(w, snap.Rates)
+
+		// Per-sandbox and per-image metrics
+		c.writeLabeledMetrics(w)
 	})
 }
 
@@ -359,6 +796,11 @@ func writeMetricFloat(w http.ResponseWriter, name, metricType, help string, valu
 	_, _ = w.Write([]byte(name + " " + ftoa(value) + "\n"))
 }
 
+func writeHistogramHeader(w http.ResponseWriter, name, help string) {
+	_, _ = w.Write([]byte("# HELP " + name + " " + help + "\n"))
+	_, _ = w.Write([]byte("# TYPE " + name + " histogram\n"))
+}
+
 func itoa(i int64) string {
 	return string(appendInt(nil, i))
 }
@@ -402,37 +844,6 @@ func appendFloat(b []byte, f float64) []byte {
 	return b
 }
 
-func appendWithLimit(slice []float64, value float64, limit int) []float64 {
-	if len(slice) >= limit {
-		// Remove oldest (first) element
-		slice = slice[1:]
-	}
-	return append(slice, value)
-}
-
-func percentile(data []float64, p float64) float64 {
-	if len(data) == 0 {
-		return 0
-	}
-
-	// Make a copy and sort
-	sorted := make([]float64, len(data))
-	copy(sorted, data)
-
-	// Simple insertion sort (good enough for small arrays)
-	for i := 1; i < len(sorted); i++ {
-		j := i
-		for j > 0 && sorted[j-1] > sorted[j] {
-			sorted[j-1], sorted[j] = sorted[j], sorted[j-1]
-			j--
-		}
-	}
-
-	// Calculate percentile index
-	index := int(float64(len(sorted)-1) * p)
-	return sorted[index]
-}
-
 // =============================================================================
 // Global Collector (convenience)
 // =============================================================================
@@ -43,6 +43,24 @@ func TestCollector_PoolStats(t *testing.T) {
 	}
 }
 
+func TestCollector_PoolReplenishState(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+
+	c.SetPoolReplenishState(3, time.Now().Add(-time.Minute))
+	snap := c.GetSnapshot()
+	if snap.PoolReplenishBacklog != 3 {
+		t.Errorf("PoolReplenishBacklog = %d, want 3", snap.PoolReplenishBacklog)
+	}
+	if snap.PoolBelowMinSizeSeconds < 60 {
+		t.Errorf("PoolBelowMinSizeSeconds = %f, want at least 60", snap.PoolBelowMinSizeSeconds)
+	}
+
+	c.SetPoolReplenishState(0, time.Time{})
+	if snap := c.GetSnapshot(); snap.PoolBelowMinSizeSeconds != 0 {
+		t.Errorf("PoolBelowMinSizeSeconds = %f at minimum size, want 0", snap.PoolBelowMinSizeSeconds)
+	}
+}
+
 func TestCollector_Counters(t *testing.T) {
 	log := logrus.NewEntry(logrus.New())
 	c := NewCollector(log)
@@ -54,12 +72,17 @@ func TestCollector_Counters(t *testing.T) {
 	c.RecordContainerCreated()
 	c.RecordContainerCreated()
 	c.RecordContainerDestroyed()
+	c.RecordOOMKill()
 
 	c.RecordVMCreateError()
 	c.RecordVMDestroyError()
 	c.RecordContainerError()
 	c.RecordAgentConnectError()
 
+	c.RecordVMCreateRetry()
+	c.RecordVMCreateRetry()
+	c.RecordVMCreateRetryOutcome(true)
+
 	snap := c.GetSnapshot()
 
 	if snap.TotalVMsCreated != 2 {
@@ -80,6 +103,9 @@ func TestCollector_Counters(t *testing.T) {
 	if snap.ActiveContainers != 1 {
 		t.Errorf("ActiveContainers = %d, want 1", snap.ActiveContainers)
 	}
+	if snap.OOMKills != 1 {
+		t.Errorf("OOMKills = %d, want 1", snap.OOMKills)
+	}
 	if snap.VMCreateErrors != 1 {
 		t.Errorf("VMCreateErrors = %d, want 1", snap.VMCreateErrors)
 	}
@@ -92,6 +118,10 @@ func TestCollector_Counters(t *testing.T) {
 	if snap.AgentConnectErrors != 1 {
 		t.Errorf("AgentConnectErrors = %d, want 1", snap.AgentConnectErrors)
 	}
+	if snap.VMCreateRetries != 2 || snap.VMCreateRetriesRecovered != 1 || snap.VMCreateRetriesExhausted != 0 {
+		t.Errorf("VM create retries = %d, recovered %d, exhausted %d, want 2, 1, 0",
+			snap.VMCreateRetries, snap.VMCreateRetriesRecovered, snap.VMCreateRetriesExhausted)
+	}
 }
 
 func TestCollector_Latencies(t *testing.T) {
@@ -108,6 +138,63 @@ func TestCollector_Latencies(t *testing.T) {
 	if snap.CreateLatencyP50 < 0 {
 		t.Errorf("CreateLatencyP50 = %f, want >= 0", snap.CreateLatencyP50)
 	}
+	if snap.Latencies["create"].Count != 1 {
+		t.Errorf("create count = %d, want 1", snap.Latencies["create"].Count)
+	}
+
+	// Operations outside the defaults get their own histogram
+	c.StartTimer("exec").Stop()
+	if c.GetSnapshot().Latencies["exec"].Count != 1 {
+		t.Errorf("exec histogram not recorded")
+	}
+}
+
+func TestCollector_SetBuckets(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	c := NewCollector(log)
+
+	if err := c.SetBuckets("create", []float64{1, 0.5}); err == nil {
+		t.Error("SetBuckets accepted decreasing bounds")
+	}
+	if err := c.SetBuckets("create", []float64{0.1, 1}); err != nil {
+		t.Fatalf("SetBuckets failed: %v", err)
+	}
+	if err := c.SetBuckets(PoolWarmBuckets, []float64{1, 5, 30}); err != nil {
+		t.Fatalf("SetBuckets failed: %v", err)
+	}
+
+	snap := c.GetSnapshot()
+	if len(snap.Latencies["create"].Bounds) != 2 {
+		t.Errorf("create bounds = %v, want [0.1 1]", snap.Latencies["create"].Bounds)
+	}
+	if len(snap.PoolWarmTime.Bounds) != 3 {
+		t.Errorf("pool warm bounds = %v, want [1 5 30]", snap.PoolWarmTime.Bounds)
+	}
+}
+
+func TestCollector_InFlight(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	c := NewCollector(log)
+
+	if n, ok := c.GetSnapshot().InFlight[InFlightAgentRPC]; !ok || n != 0 {
+		t.Errorf("agent_rpc in flight = %d (present %v), want 0", n, ok)
+	}
+
+	done1 := c.TrackInFlight(InFlightCreate)
+	done2 := c.TrackInFlight(InFlightCreate)
+	if n := c.GetSnapshot().InFlight[InFlightCreate]; n != 2 {
+		t.Errorf("create in flight = %d, want 2", n)
+	}
+
+	done1()
+	done1() // Calling twice is harmless
+	if n := c.GetSnapshot().InFlight[InFlightCreate]; n != 1 {
+		t.Errorf("create in flight = %d, want 1", n)
+	}
+	done2()
+	if n := c.GetSnapshot().InFlight[InFlightCreate]; n != 0 {
+		t.Errorf("create in flight = %d, want 0", n)
+	}
 }
 
 func TestPrometheusHandler(t *testing.T) {
@@ -116,7 +203,14 @@ func TestPrometheusHandler(t *testing.T) {
 
 	// Populate some data
 	c.SetPoolStats(10, 5, 20)
+	c.SetPoolReservation(10, 1024)
+	c.SetPoolReplenishState(2, time.Time{})
 	c.RecordPoolHit()
+	c.RecordOOMKill()
+	c.RecordSnapshotRebuild()
+	c.RecordComponentEvent(ComponentVMM, EventUnexpectedExit)
+	c.RecordComponentEvent(ComponentVMM, EventUnexpectedExit)
+	defer c.TrackInFlight(InFlightImageConversion)()
 
 	req := httptest.NewRequest("GET", "/metrics", nil)
 	w := httptest.NewRecorder()
@@ -136,7 +230,26 @@ func TestPrometheusHandler(t *testing.T) {
 		"fc_cri_pool_in_use 5",
 		"fc_cri_pool_max_size 20",
 		"fc_cri_pool_hits_total 1",
+		"fc_cri_pool_reserved_vcpus 10",
+		"fc_cri_pool_reserved_memory_mb 1024",
+		"fc_cri_pool_replenish_backlog 2",
+		"fc_cri_pool_below_min_size_seconds 0",
+		"fc_cri_oom_kills_total 1",
+		"fc_cri_snapshot_rebuilds_total 1",
 		"TYPE fc_cri_pool_available gauge",
+		"TYPE fc_cri_operation_duration_seconds histogram",
+		`fc_cri_operation_duration_seconds_bucket{operation="create",le="0.005"} 0`,
+		`fc_cri_operation_duration_seconds_bucket{operation="create",le="+Inf"} 0`,
+		`fc_cri_operation_duration_seconds_count{operation="create"} 0`,
+		"fc_cri_pool_warm_duration_seconds_sum 0",
+		"TYPE fc_cri_create_latency_p50_ms gauge",
+		"fc_cri_start_latency_p99_ms 0",
+		"TYPE fc_cri_operations_in_flight gauge",
+		`fc_cri_operations_in_flight{operation="image_conversion"} 1`,
+		`fc_cri_operations_in_flight{operation="snapshot_restore"} 0`,
+		"TYPE fc_cri_component_events_total counter",
+		`fc_cri_component_events_total{component="vmm",event="unexpected_exit"} 2`,
+		`fc_cri_component_events_total{component="shim",event="restart"} 0`,
 	}
 
 	for _, exp := range expected {
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Prometheus computes rates from counters at query time, but needs samples
+// a few per window apart to do so. For scrapers that come by less often,
+// and for dashboards without PromQL, the collector can also export rates it
+// computes itself: it samples the counters every rateSampleInterval and
+// exports their per-second increase over each of RateWindows.
+
+// Counters exported as rates.
+const (
+	RateVMCreates  = "vm_creates" // VMs created
+	RateErrors     = "errors"     // VM, container and agent errors
+	RatePoolChurn  = "pool_churn" // VMs handed out by the pool or warmed into it
+	RateContainers = "containers" // Containers created
+)
+
+// RateWindows are the windows rates are computed over.
+var RateWindows = []time.Duration{time.Minute, 5 * time.Minute}
+
+// rateSampleInterval is how often the counters are sampled for rates.
+const rateSampleInterval = 10 * time.Second
+
+// rateSample holds the counters exported as rates at one time.
+type rateSample struct {
+	at       time.Time
+	counters map[string]int64
+}
+
+// rateTracker keeps the samples of the longest window.
+type rateTracker struct {
+	samples []rateSample // Oldest first
+}
+
+// StartRates starts sampling the counters for their rates, until ctx is
+// done. The rates are exported from then on.
+func (c *Collector) StartRates(ctx context.Context) {
+	c.mu.Lock()
+	if c.rates != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.rates = &rateTracker{}
+	c.mu.Unlock()
+
+	c.sampleRates(time.Now())
+	go func() {
+		ticker := time.NewTicker(rateSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.sampleRates(now)
+			}
+		}
+	}()
+}
+
+// sampleRates records the counters exported as rates, dropping the samples
+// no window needs anymore.
+func (c *Collector) sampleRates(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rates == nil {
+		return
+	}
+	c.rates.samples = append(c.rates.samples, rateSample{at: now, counters: c.rateCounters()})
+
+	// Keep the newest sample at least the longest window old, which that
+	// window's rate is computed from
+	oldest := now.Add(-maxRateWindow())
+	drop := 0
+	for drop+1 < len(c.rates.samples) && !c.rates.samples[drop+1].at.After(oldest) {
+		drop++
+	}
+	c.rates.samples = append(c.rates.samples[:0], c.rates.samples[drop:]...)
+}
+
+// rateCounters returns the counters exported as rates. Callers must hold
+// c.mu.
+func (c *Collector) rateCounters() map[string]int64 {
+	return map[string]int64{
+		RateVMCreates:  c.totalVMsCreated,
+		RateErrors:     c.vmCreateErrors + c.vmDestroyErrors + c.containerErrors + c.agentConnectErrors,
+		RatePoolChurn:  c.poolHits + int64(c.poolWarmingTime.Snapshot().Count),
+		RateContainers: c.totalContainers,
+	}
+}
+
+// ratesAt returns the per-second rates of the counters over each window,
+// keyed by counter then window, e.g. "1m". A window only partly sampled yet
+// is computed over the samples there are. Callers must hold c.mu.
+func (c *Collector) ratesAt(now time.Time) map[string]map[string]float64 {
+	if c.rates == nil {
+		return nil
+	}
+	latest := rateSample{at: now, counters: c.rateCounters()}
+	rates := make(map[string]map[string]float64)
+	for _, window := range RateWindows {
+		// The newest sample at least the window old, or else the oldest
+		var from *rateSample
+		for i := range c.rates.samples {
+			if i == 0 || !c.rates.samples[i].at.After(now.Add(-window)) {
+				from = &c.rates.samples[i]
+			}
+		}
+		elapsed := 0.0
+		if from != nil {
+			elapsed = latest.at.Sub(from.at).Seconds()
+		}
+		for name, value := range latest.counters {
+			if rates[name] == nil {
+				rates[name] = make(map[string]float64)
+			}
+			rate := 0.0
+			if elapsed > 0 && value > from.counters[name] {
+				rate = float64(value-from.counters[name]) / elapsed
+			}
+			rates[name][windowLabel(window)] = rate
+		}
+	}
+	return rates
+}
+
+// maxRateWindow returns the longest of RateWindows.
+func maxRateWindow() time.Duration {
+	var max time.Duration
+	for _, window := range RateWindows {
+		if window > max {
+			max = window
+		}
+	}
+	return max
+}
+
+// windowLabel formats a window as Prometheus durations are, e.g. "5m".
+func windowLabel(window time.Duration) string {
+	if window%time.Minute == 0 {
+		return strconv.FormatInt(int64(window/time.Minute), 10) + "m"
+	}
+	return strconv.FormatInt(int64(window/time.Second), 10) + "s"
+}
+
+// writeRates writes the rates as fc_cri_rate_per_second, labeled with the
+// counter and window.
+func writeRates(w http.ResponseWriter, rates map[string]map[string]float64) {
+	if len(rates) == 0 {
+		return
+	}
+	names := make([]string, 0, len(rates))
+	for name := range rates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_, _ = w.Write([]byte("# HELP fc_cri_rate_per_second Per-second increase of runtime counters over a window, computed by the runtime\n"))
+	_, _ = w.Write([]byte("# TYPE fc_cri_rate_per_second gauge\n"))
+	for _, name := range names {
+		for _, window := range RateWindows {
+			label := windowLabel(window)
+			_, _ = w.Write([]byte(`fc_cri_rate_per_second{counter="` + name + `",window="` + label + `"} ` +
+				strconv.FormatFloat(rates[name][label], 'g', 6, 64) + "\n"))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRates(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+	if rates := c.GetSnapshot().Rates; rates != nil {
+		t.Fatalf("Rates = %v before StartRates, want none", rates)
+	}
+	c.rates = &rateTracker{}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.sampleRates(start)
+	// 8 VMs a minute for 4 minutes, then 6 in the last one
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 8; j++ {
+			c.RecordVMCreated(128, 1)
+		}
+		c.sampleRates(start.Add(time.Duration(i+1) * time.Minute))
+	}
+	c.RecordVMCreateError()
+	c.RecordPoolHit()
+	for j := 0; j < 6; j++ {
+		c.RecordVMCreated(128, 1)
+	}
+	c.sampleRates(start.Add(5 * time.Minute))
+
+	c.mu.RLock()
+	rates := c.ratesAt(start.Add(5 * time.Minute))
+	c.mu.RUnlock()
+	if got := rates[RateVMCreates]["1m"]; got != 0.1 {
+		t.Errorf("vm_creates 1m = %v, want 0.1", got)
+	}
+	if got := rates[RateVMCreates]["5m"]; got != 38.0/300 {
+		t.Errorf("vm_creates 5m = %v, want %v", got, 38.0/300)
+	}
+	if got := rates[RateErrors]["1m"]; got != 1.0/60 {
+		t.Errorf("errors 1m = %v, want %v", got, 1.0/60)
+	}
+	if got := rates[RatePoolChurn]["5m"]; got != 1.0/300 {
+		t.Errorf("pool_churn 5m = %v, want %v", got, 1.0/300)
+	}
+
+	// Samples older than the longest window are dropped
+	c.sampleRates(start.Add(11 * time.Minute))
+	if n := len(c.rates.samples); n != 2 {
+		t.Errorf("%d samples kept, want 2", n)
+	}
+}
+
+func TestRatesPartialWindow(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+	c.rates = &rateTracker{}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.sampleRates(start)
+	c.RecordContainerCreated()
+	c.RecordContainerCreated()
+
+	// Before the window has passed, the rate is over the time sampled
+	c.mu.RLock()
+	rates := c.ratesAt(start.Add(20 * time.Second))
+	c.mu.RUnlock()
+	if got := rates[RateContainers]["5m"]; got != 0.1 {
+		t.Errorf("containers 5m = %v, want 0.1", got)
+	}
+}
+
+func TestRatesPrometheus(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+	rec := httptest.NewRecorder()
+	c.PrometheusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "fc_cri_rate_per_second") {
+		t.Error("rates exported before StartRates")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartRates(ctx)
+	rec = httptest.NewRecorder()
+	c.PrometheusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"# TYPE fc_cri_rate_per_second gauge",
+		`fc_cri_rate_per_second{counter="vm_creates",window="1m"} `,
+		`fc_cri_rate_per_second{counter="pool_churn",window="5m"} `,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
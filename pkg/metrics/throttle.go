@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Task operations limited node-wide wait for a slot when too many run at
+// once. These metrics show how often that happens and for how long, so a
+// limit set too low shows up as queued operations rather than slow pods.
+
+// Task operations that can be throttled.
+const (
+	TaskOpCreate = "create"
+	TaskOpStart  = "start"
+	TaskOpDelete = "delete"
+)
+
+// defaultTaskOps always have throttle series, even before the first wait.
+var defaultTaskOps = []string{TaskOpCreate, TaskOpStart, TaskOpDelete}
+
+// TaskThrottle is how a task operation has been throttled.
+type TaskThrottle struct {
+	Queued      int64   `json:"queued"`       // Waiting for a slot now
+	Throttled   int64   `json:"throttled"`    // Had to wait for a slot
+	WaitSeconds float64 `json:"wait_seconds"` // Total time spent waiting
+}
+
+// TrackTaskQueued counts an operation as waiting for a slot until the
+// returned function is called.
+func (c *Collector) TrackTaskQueued(op string) func() {
+	c.mu.Lock()
+	c.taskThrottle(op).Queued++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.taskThrottle(op).Queued--
+		})
+	}
+}
+
+// RecordTaskThrottled records an operation that waited for a slot.
+func (c *Collector) RecordTaskThrottled(op string, wait time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.taskThrottle(op)
+	t.Throttled++
+	t.WaitSeconds += wait.Seconds()
+}
+
+// taskThrottle returns an operation's throttle counters. Callers must hold
+// c.mu.
+func (c *Collector) taskThrottle(op string) *TaskThrottle {
+	t, ok := c.taskThrottles[op]
+	if !ok {
+		t = &TaskThrottle{}
+		c.taskThrottles[op] = t
+	}
+	return t
+}
+
+// writeTaskThrottles writes the throttle metrics, labeled with the
+// operation.
+func writeTaskThrottles(w http.ResponseWriter, throttles map[string]TaskThrottle) {
+	ops := make([]string, 0, len(throttles))
+	for op := range throttles {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	series := []struct {
+		name, kind, help string
+		value            func(TaskThrottle) string
+	}{
+		{"fc_cri_task_queued", "gauge", "Task operations waiting for a node-wide slot",
+			func(t TaskThrottle) string { return itoa(t.Queued) }},
+		{"fc_cri_task_throttled_total", "counter", "Task operations that waited for a node-wide slot",
+			func(t TaskThrottle) string { return itoa(t.Throttled) }},
+		{"fc_cri_task_throttle_wait_seconds_total", "counter", "Time task operations spent waiting for a node-wide slot",
+			func(t TaskThrottle) string { return strconv.FormatFloat(t.WaitSeconds, 'g', -1, 64) }},
+	}
+	for _, s := range series {
+		_, _ = w.Write([]byte("# HELP " + s.name + " " + s.help + "\n"))
+		_, _ = w.Write([]byte("# TYPE " + s.name + " " + s.kind + "\n"))
+		for _, op := range ops {
+			_, _ = w.Write([]byte(s.name + `{operation="` + op + `"} ` + s.value(throttles[op]) + "\n"))
+		}
+	}
+}
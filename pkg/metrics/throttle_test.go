@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestTaskThrottles(t *testing.T) {
+	c := NewCollector(logrus.NewEntry(logrus.New()))
+	dequeue := c.TrackTaskQueued(TaskOpCreate)
+	if got := c.GetSnapshot().TaskThrottles[TaskOpCreate].Queued; got != 1 {
+		t.Errorf("queued creates = %d, want 1", got)
+	}
+	dequeue()
+	dequeue()
+	c.RecordTaskThrottled(TaskOpCreate, 1500*time.Millisecond)
+
+	create := c.GetSnapshot().TaskThrottles[TaskOpCreate]
+	if create != (TaskThrottle{Queued: 0, Throttled: 1, WaitSeconds: 1.5}) {
+		t.Errorf("create throttle = %+v", create)
+	}
+
+	rec := httptest.NewRecorder()
+	c.PrometheusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`fc_cri_task_queued{operation="delete"} 0`,
+		`fc_cri_task_throttled_total{operation="create"} 1`,
+		`fc_cri_task_throttle_wait_seconds_total{operation="create"} 1.5`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
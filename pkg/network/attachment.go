@@ -0,0 +1,38 @@
+package network
+
+import (
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/vishvananda/netlink"
+)
+
+// attachment describes how a sandbox set up in netnsPath is attached to the
+// node's network. The interface's MAC and veth peer are looked up in the
+// kernel, as CNI results don't say which host interface is the peer; they
+// are left empty if the lookup fails.
+func attachment(netnsPath, ifName string) domain.NetworkAttachment {
+	a := domain.NetworkAttachment{
+		NetNS:   netnsPath,
+		IfName:  ifName,
+		TapName: TapName,
+	}
+	var peerIndex int
+	_ = inNetNS(netnsPath, func() error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		a.IfMAC = link.Attrs().HardwareAddr.String()
+		if _, ok := link.(*netlink.Veth); ok {
+			peerIndex = link.Attrs().ParentIndex
+		}
+		return nil
+	})
+	// The peer's index is in the namespace the veth was created from, the
+	// node's for every CNI plugin that makes veths
+	if peerIndex > 0 {
+		if peer, err := netlink.LinkByIndex(peerIndex); err == nil {
+			a.VethPeer = peer.Attrs().Name
+		}
+	}
+	return a
+}
@@ -15,22 +15,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
-	"os"
 	"path/filepath"
-	"runtime"
+	"time"
 
 	"github.com/containernetworking/cni/libcni"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
+// TapName is the tap device in each sandbox's network namespace, created by
+// the tc-redirect-tap plugin or the service depending on the TAP mode, for
+// Firecracker to attach as the guest's eth0.
+const TapName = "tap0"
+
 // CNIService implements domain.NetworkService using CNI plugins.
 type CNIService struct {
 	config    CNIServiceConfig
 	cniConfig *libcni.CNIConfig
 	netConfig *libcni.NetworkConfigList
+	cooldown  *ipCooldown // nil if disabled
 	log       *logrus.Entry
+
+	// tapMode is the TAP mode in effect: TAPModePlugin falls back to
+	// TAPModeRedirect without the tc-redirect-tap plugin.
+	tapMode string
+
+	// portMapPlugin is set if the network forwards host ports itself;
+	// otherwise the service does, loading rulesets with nft.
+	portMapPlugin bool
+	nft           func(ruleset string) error
+
+	// generateMAC makes the guest MACs; GenerateMAC if nil.
+	generateMAC func(prefix string) (string, error)
 }
 
 // CNIServiceConfig holds CNI configuration.
@@ -50,22 +68,112 @@ type CNIServiceConfig struct {
 
 	// DefaultSubnet is used if not specified in CNI config.
 	DefaultSubnet string
+
+	// DefaultSubnetV6 is the IPv6 subnet of the default config, used when
+	// IPFamily is IPFamilyIPv6 or IPFamilyDual.
+	DefaultSubnetV6 string
+
+	// IPFamily is the cluster's IP family. It picks the subnets of the
+	// default config, and which of a dual-stack result's addresses is a
+	// sandbox's primary one: IPv6 for IPFamilyIPv6, IPv4 otherwise.
+	IPFamily string
+
+	// IPReuseCooldown is how long a released IP is kept from being
+	// re-assigned. Zero disables the cooldown. Only supported with the
+	// host-local IPAM plugin.
+	IPReuseCooldown time.Duration
+
+	// IPAMDataDir is host-local's data directory, used when the network
+	// config doesn't set ipam.dataDir.
+	IPAMDataDir string
+
+	// NetNSDir is where sandbox network namespaces are mounted, and
+	// NetNSStateDir where who they belong to is recorded.
+	NetNSDir      string
+	NetNSStateDir string
+
+	// MACStateDir is where the guest MACs handed out on the node are
+	// claimed.
+	MACStateDir string
+
+	// TAPMode is how the tap is made: by the tc-redirect-tap plugin
+	// (TAPModePlugin), or by the service and redirected to the CNI
+	// interface (TAPModeRedirect) or attached to TAPBridge (TAPModeBridge).
+	// TAPModePlugin falls back to TAPModeRedirect if the network's chain
+	// doesn't end in tc-redirect-tap or the plugin isn't in PluginDir.
+	TAPMode string
+
+	// TAPBridge is the bridge in the sandbox's network namespace the tap is
+	// attached to in TAPModeBridge.
+	TAPBridge string
+
+	// TAPQueues above 1 makes the service's taps multiqueue.
+	TAPQueues int
+
+	// TAPOwnerUID and TAPOwnerGID own the service's taps, so a jailed
+	// Firecracker can open them. Set them to the jailer's UID and GID.
+	TAPOwnerUID int
+	TAPOwnerGID int
+
+	// NftPath is the nft binary host ports are forwarded with, for
+	// networks without the portmap plugin.
+	NftPath string
+
+	// PluginTimeout bounds each CNI plugin invocation; a plugin that runs
+	// longer is killed and fails with a *PluginTimeoutError. Zero lets
+	// plugins run for as long as the caller's context allows.
+	PluginTimeout time.Duration
 }
 
 // DefaultCNIServiceConfig returns sensible defaults.
 func DefaultCNIServiceConfig() CNIServiceConfig {
 	return CNIServiceConfig{
-		PluginDir:     "/opt/cni/bin",
-		ConfDir:       "/etc/cni/net.d",
-		CacheDir:      "/var/lib/cni",
-		DefaultSubnet: "10.88.0.0/16",
+		PluginDir:       "/opt/cni/bin",
+		ConfDir:         "/etc/cni/net.d",
+		CacheDir:        "/var/lib/cni",
+		DefaultSubnet:   "10.88.0.0/16",
+		DefaultSubnetV6: "fd00:fc::/64",
+		IPFamily:        IPFamilyIPv4,
+		IPReuseCooldown: 30 * time.Second,
+		IPAMDataDir:     "/var/lib/cni/networks",
+		NetNSDir:        DefaultNetNSDir,
+		NetNSStateDir:   DefaultNetNSStateDir,
+		MACStateDir:     DefaultMACStateDir,
+		TAPMode:         TAPModePlugin,
+		NftPath:         "nft",
+		PluginTimeout:   DefaultPluginTimeout,
 	}
 }
 
 // NewCNIService creates a new CNI-based network service.
 func NewCNIService(config CNIServiceConfig, log *logrus.Entry) (*CNIService, error) {
-	// Create CNI config executor
-	cniConfig := libcni.NewCNIConfig([]string{config.PluginDir}, nil)
+	if err := ValidateIPFamily(config.IPFamily); err != nil {
+		return nil, err
+	}
+	if config.TAPMode == "" {
+		config.TAPMode = TAPModePlugin
+	}
+	if config.NetNSDir == "" {
+		config.NetNSDir = DefaultNetNSDir
+	}
+	if config.NetNSStateDir == "" {
+		config.NetNSStateDir = DefaultNetNSStateDir
+	}
+	if config.MACStateDir == "" {
+		config.MACStateDir = DefaultMACStateDir
+	}
+	if config.NftPath == "" {
+		config.NftPath = "nft"
+	}
+	if err := ValidateTAPMode(config.TAPMode); err != nil {
+		return nil, err
+	}
+	if config.TAPMode == TAPModeBridge && config.TAPBridge == "" {
+		return nil, fmt.Errorf("tap mode %s needs a bridge", TAPModeBridge)
+	}
+
+	// Create CNI config executor, whose plugins can't hang setups
+	cniConfig := libcni.NewCNIConfig([]string{config.PluginDir}, newTimeoutExec(config.PluginTimeout))
 
 	// Load network configuration
 	netConfig, err := loadNetworkConfig(config)
@@ -73,12 +181,50 @@ func NewCNIService(config CNIServiceConfig, log *logrus.Entry) (*CNIService, err
 		return nil, fmt.Errorf("failed to load CNI config: %w", err)
 	}
 
-	return &CNIService{
+	s := &CNIService{
 		config:    config,
 		cniConfig: cniConfig,
 		netConfig: netConfig,
 		log:       log.WithField("component", "cni"),
-	}, nil
+		tapMode:   config.TAPMode,
+	}
+	s.nft = func(ruleset string) error { return runNft(config.NftPath, ruleset) }
+	s.portMapPlugin = hasPortMappingsCapability(netConfig)
+	if config.TAPMode == TAPModePlugin {
+		if err := s.resolvePluginMode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.IPReuseCooldown > 0 {
+		if dataDir, ok := hostLocalDataDir(netConfig); ok {
+			if dataDir == "" {
+				dataDir = config.IPAMDataDir
+			}
+			s.cooldown = newIPCooldown(dataDir, netConfig.Name, config.IPReuseCooldown)
+		} else {
+			s.log.Warn("IP reuse cooldown requires host-local IPAM, disabling it")
+		}
+	}
+
+	// Namespaces a crash left behind would otherwise never be removed; one
+	// that can't be removed now is retried on the next start
+	leaked, err := s.ReconcileNetNS()
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to remove leaked network namespaces")
+	}
+	if len(leaked) > 0 {
+		s.log.WithField("count", len(leaked)).Info("Removed leaked network namespaces")
+	}
+	released, err := s.ReconcileMACs()
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to release leaked MACs")
+	}
+	if len(released) > 0 {
+		s.log.WithField("count", len(released)).Info("Released MACs of removed sandboxes")
+	}
+
+	return s, nil
 }
 
 // Setup configures networking for a sandbox.
@@ -93,6 +239,11 @@ func (s *CNIService) Setup(ctx context.Context, sandbox *domain.Sandbox, config
 	}
 	sandbox.NetworkNamespace = netnsPath
 
+	// Free IPs whose cooldown has passed before allocating
+	if _, err := s.ReconcileIPs(); err != nil {
+		s.log.WithError(err).Warn("Failed to reconcile IP cooldowns")
+	}
+
 	// Prepare CNI runtime config
 	rt := &libcni.RuntimeConf{
 		ContainerID: sandbox.ID,
@@ -102,12 +253,15 @@ func (s *CNIService) Setup(ctx context.Context, sandbox *domain.Sandbox, config
 			{"IgnoreUnknown", "1"},
 			{"K8S_POD_NAMESPACE", sandbox.Namespace},
 			{"K8S_POD_NAME", sandbox.Name},
+			{"TC_REDIRECT_TAP_NAME", TapName},
 		},
+		CapabilityArgs: s.portMappingsArgs(sandbox),
 	}
 
 	// Add the network
 	result, err := s.cniConfig.AddNetworkList(ctx, s.netConfig, rt)
 	if err != nil {
+		metrics.Global().RecordComponentEvent(metrics.ComponentCNI, metrics.EventFailure)
 		return fmt.Errorf("CNI AddNetworkList failed: %w", err)
 	}
 
@@ -117,28 +271,60 @@ func (s *CNIService) Setup(ctx context.Context, sandbox *domain.Sandbox, config
 		return fmt.Errorf("failed to parse CNI result: %w", err)
 	}
 
-	// Extract IP address
-	if len(result100.IPs) > 0 {
-		sandbox.IP = result100.IPs[0].Address.IP
-		s.log.WithField("ip", sandbox.IP).Debug("Assigned IP address")
+	// Extract the addresses, both families' on dual-stack clusters
+	sandbox.IPs = addressesFromResult(result100, s.config.IPFamily)
+	if len(sandbox.IPs) > 0 {
+		sandbox.IP = sandbox.IPs[0].IP
+		sandbox.Netmask = sandbox.IPs[0].Mask
+		s.log.WithField("ips", sandbox.IPs).Debug("Assigned IP addresses")
+	}
+
+	// Extract the routes, service and node-local CIDRs included
+	sandbox.Routes, sandbox.Gateway = routesFromResult(result100)
+	if gw := familyGateway(sandbox.Routes, sandbox.IP); gw != nil {
+		sandbox.Gateway = gw
+	}
+	sandbox.Routes = append(sandbox.Routes, podRoutes(config, sandbox.Routes)...)
+	sandbox.DNS = nameserversFromResult(result100)
+	sandbox.DNSSearch = searchDomains(result100.DNS.Search, config)
+	if err := applyRoutes(netnsPath, rt.IfName, sandbox.Routes); err != nil {
+		s.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to apply routes in network namespace")
+	}
+	if err := s.forwardHostPorts(sandbox); err != nil {
+		return err
 	}
 
-	// Extract gateway
-	for _, route := range result100.Routes {
-		if route.GW != nil {
-			sandbox.Gateway = route.GW
-			break
+	// Firecracker attaches to the tap in the namespace through the
+	// VMConfig.NetworkInterfaces
+	if s.tapMode != TAPModePlugin {
+		bridge := ""
+		if s.tapMode == TAPModeBridge {
+			bridge = s.config.TAPBridge
+		}
+		if err := s.setupTAP(netnsPath, TapName, rt.IfName, bridge); err != nil {
+			return err
 		}
 	}
+	sandbox.Attachment = attachment(netnsPath, rt.IfName)
+	if sandbox.Attachment.GuestMAC, err = s.allocateMAC(sandbox.ID, "eth0", GuestMACPrefix); err != nil {
+		return err
+	}
 
-	// The tap device is now ready in the namespace
-	// Firecracker will attach to it via the VMConfig.NetworkInterfaces
+	if config != nil {
+		if err := s.setupAdditionalNetworks(ctx, sandbox, config.Networks); err != nil {
+			return err
+		}
+	}
 
 	s.log.WithFields(logrus.Fields{
 		"sandbox_id": sandbox.ID,
 		"ip":         sandbox.IP,
+		"ips":        len(sandbox.IPs),
 		"gateway":    sandbox.Gateway,
+		"routes":     len(sandbox.Routes),
 		"netns":      netnsPath,
+		"veth_peer":  sandbox.Attachment.VethPeer,
+		"networks":   len(sandbox.Networks),
 	}).Info("Network setup complete")
 
 	return nil
@@ -153,25 +339,81 @@ func (s *CNIService) Teardown(ctx context.Context, sandbox *domain.Sandbox) erro
 	}
 
 	rt := &libcni.RuntimeConf{
-		ContainerID: sandbox.ID,
-		NetNS:       sandbox.NetworkNamespace,
-		IfName:      "eth0",
+		ContainerID:    sandbox.ID,
+		NetNS:          sandbox.NetworkNamespace,
+		IfName:         "eth0",
+		CapabilityArgs: s.portMappingsArgs(sandbox),
+	}
+
+	s.teardownAdditionalNetworks(ctx, sandbox)
+
+	// Remove the tap, and with it its tc filters
+	if s.tapMode != TAPModePlugin {
+		if err := DeleteTAP(sandbox.NetworkNamespace, TapName); err != nil {
+			s.log.WithError(err).Warn("Failed to delete tap")
+		}
+	}
+
+	if err := s.unforwardHostPorts(sandbox); err != nil {
+		s.log.WithError(err).Warn("Failed to remove host port forwarding")
 	}
 
 	// Remove the network
 	if err := s.cniConfig.DelNetworkList(ctx, s.netConfig, rt); err != nil {
+		metrics.Global().RecordComponentEvent(metrics.ComponentCNI, metrics.EventFailure)
 		s.log.WithError(err).Warn("CNI DelNetworkList failed")
 		// Continue with cleanup
+	} else if s.cooldown != nil {
+		// Keep the IPs from being handed to another pod straight away
+		for _, address := range sandbox.IPs {
+			if err := s.cooldown.Hold(address.IP); err != nil {
+				s.log.WithError(err).Warn("Failed to hold IP for cooldown")
+			}
+		}
 	}
 
 	// Remove the network namespace
 	if err := s.deleteNetNS(sandbox.ID); err != nil {
 		s.log.WithError(err).Warn("Failed to delete network namespace")
 	}
+	if err := s.releaseMACs(sandbox.ID); err != nil {
+		s.log.WithError(err).Warn("Failed to release MACs")
+	}
 
 	return nil
 }
 
+// setupTAP creates a tap of the sandbox, with the MTU CNI gave ifName, and
+// connects it to bridge or, without one, to ifName.
+func (s *CNIService) setupTAP(netnsPath, tapName, ifName, bridge string) error {
+	mtu, err := linkMTU(netnsPath, ifName)
+	if err != nil {
+		return fmt.Errorf("failed to read MTU of %s: %w", ifName, err)
+	}
+	err = CreateTAP(TAPConfig{
+		Name:    tapName,
+		NetNS:   netnsPath,
+		MTU:     mtu,
+		Queues:  s.config.TAPQueues,
+		OwnerID: s.config.TAPOwnerUID,
+		GroupID: s.config.TAPOwnerGID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if bridge != "" {
+		err = AttachTAPToBridge(netnsPath, tapName, bridge)
+	} else {
+		err = RedirectTAP(netnsPath, tapName, ifName)
+	}
+	if err != nil {
+		_ = DeleteTAP(netnsPath, tapName)
+		return err
+	}
+	return nil
+}
+
 // GetIP returns the IP address assigned to a sandbox.
 func (s *CNIService) GetIP(ctx context.Context, sandboxID string) (net.IP, error) {
 	// This would typically look up the sandbox state
@@ -179,42 +421,37 @@ func (s *CNIService) GetIP(ctx context.Context, sandboxID string) (net.IP, error
 	return nil, fmt.Errorf("use sandbox.IP directly")
 }
 
-// createNetNS creates a new network namespace for the sandbox.
-func (s *CNIService) createNetNS(sandboxID string) (string, error) {
-	// Network namespace path
-	nsPath := filepath.Join("/var/run/netns", fmt.Sprintf("fc-%s", sandboxID))
-
-	// Ensure the netns directory exists
-	if err := os.MkdirAll("/var/run/netns", 0755); err != nil {
-		return "", fmt.Errorf("failed to create netns dir: %w", err)
+// ReconcileIPs releases IPs whose reuse cooldown has expired, returning the
+// IPs that became available again.
+func (s *CNIService) ReconcileIPs() ([]net.IP, error) {
+	if s.cooldown == nil {
+		return nil, nil
 	}
 
-	// Create the namespace file
-	f, err := os.Create(nsPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create netns file: %w", err)
+	released, err := s.cooldown.Reconcile(time.Now())
+	if len(released) > 0 {
+		s.log.WithField("ips", released).Debug("Released IPs after cooldown")
 	}
-	f.Close()
-
-	// Create a new network namespace via unshare
-	// This is a simplified version - in production, use the netns package
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	// In a real implementation, you'd call:
-	// syscall.Unshare(syscall.CLONE_NEWNET)
-	// syscall.Mount("/proc/self/ns/net", nsPath, "", syscall.MS_BIND, "")
-
-	return nsPath, nil
+	return released, err
 }
 
-// deleteNetNS removes a network namespace.
-func (s *CNIService) deleteNetNS(sandboxID string) error {
-	nsPath := filepath.Join("/var/run/netns", fmt.Sprintf("fc-%s", sandboxID))
+// hostLocalDataDir reports whether a network uses host-local IPAM and, if
+// so, the data directory it configures (empty for the plugin default).
+func hostLocalDataDir(list *libcni.NetworkConfigList) (string, bool) {
+	for _, plugin := range list.Plugins {
+		if plugin.Network == nil || plugin.Network.IPAM.Type != "host-local" {
+			continue
+		}
 
-	// Unmount and remove
-	// syscall.Unmount(nsPath, 0)
-	return os.Remove(nsPath)
+		var conf struct {
+			IPAM struct {
+				DataDir string `json:"dataDir"`
+			} `json:"ipam"`
+		}
+		_ = json.Unmarshal(plugin.Bytes, &conf)
+		return conf.IPAM.DataDir, true
+	}
+	return "", false
 }
 
 // loadNetworkConfig loads CNI network configuration from the config directory.
@@ -259,13 +496,7 @@ func createDefaultConfig(config CNIServiceConfig) (*libcni.NetworkConfigList, er
 				"bridge":    "fc-br0",
 				"isGateway": true,
 				"ipMasq":    true,
-				"ipam": map[string]interface{}{
-					"type":   "host-local",
-					"subnet": config.DefaultSubnet,
-					"routes": []map[string]string{
-						{"dst": "0.0.0.0/0"},
-					},
-				},
+				"ipam":      defaultIPAM(config),
 			},
 			{
 				"type": "portmap",
@@ -273,11 +504,14 @@ func createDefaultConfig(config CNIServiceConfig) (*libcni.NetworkConfigList, er
 					"portMappings": true,
 				},
 			},
-			{
-				"type": "tc-redirect-tap",
-			},
 		},
 	}
+	// The service makes the tap itself in the other modes, or without
+	// the plugin
+	if (config.TAPMode == TAPModePlugin || config.TAPMode == "") && tapPluginInstalled(config.PluginDir) {
+		defaultConf["plugins"] = append(defaultConf["plugins"].([]map[string]interface{}),
+			map[string]interface{}{"type": "tc-redirect-tap"})
+	}
 
 	confBytes, err := json.Marshal(defaultConf)
 	if err != nil {
@@ -287,47 +521,24 @@ func createDefaultConfig(config CNIServiceConfig) (*libcni.NetworkConfigList, er
 	return libcni.ConfListFromBytes(confBytes)
 }
 
-// =============================================================================
-// TAP Device Management
-// =============================================================================
-
-// TAPConfig holds configuration for creating a TAP device.
-type TAPConfig struct {
-	Name    string
-	MTU     int
-	OwnerID int
-	GroupID int
-}
-
-// CreateTAP creates a TAP device for Firecracker to use.
-// The TAP device bridges the VM's virtio-net to the host network.
-func CreateTAP(config TAPConfig) error {
-	// This would typically use netlink to create the tap device
-	// For example:
-	//
-	// link := &netlink.Tuntap{
-	//     LinkAttrs: netlink.LinkAttrs{Name: config.Name, MTU: config.MTU},
-	//     Mode:      netlink.TUNTAP_MODE_TAP,
-	//     Flags:     netlink.TUNTAP_VNET_HDR,
-	// }
-	// if err := netlink.LinkAdd(link); err != nil {
-	//     return err
-	// }
-	// if err := netlink.LinkSetUp(link); err != nil {
-	//     return err
-	// }
-
-	// For simplicity, use ip command
-	// In production, use netlink directly
-	return nil
-}
-
-// AttachTAPToBridge attaches a TAP device to a bridge.
-func AttachTAPToBridge(tapName, bridgeName string) error {
-	// link, _ := netlink.LinkByName(tapName)
-	// bridge, _ := netlink.LinkByName(bridgeName)
-	// return netlink.LinkSetMaster(link, bridge)
-	return nil
+// defaultIPAM returns the host-local IPAM config of the default network, with
+// a range and default route for each of the cluster's IP families.
+func defaultIPAM(config CNIServiceConfig) map[string]interface{} {
+	var ranges [][]map[string]string
+	var routes []map[string]string
+	if config.IPFamily != IPFamilyIPv6 {
+		ranges = append(ranges, []map[string]string{{"subnet": config.DefaultSubnet}})
+		routes = append(routes, map[string]string{"dst": "0.0.0.0/0"})
+	}
+	if config.IPFamily == IPFamilyIPv6 || config.IPFamily == IPFamilyDual {
+		ranges = append(ranges, []map[string]string{{"subnet": config.DefaultSubnetV6}})
+		routes = append(routes, map[string]string{"dst": "::/0"})
+	}
+	return map[string]interface{}{
+		"type":   "host-local",
+		"ranges": ranges,
+		"routes": routes,
+	}
 }
 
 // =============================================================================
@@ -343,16 +554,3 @@ func FirecrackerNetConfig(tapName string, macAddress string) map[string]interfac
 		"guest_mac":     macAddress,
 	}
 }
-
-// GenerateMAC generates a random MAC address.
-func GenerateMAC() string {
-	// Use a locally administered MAC address
-	// Format: x2:xx:xx:xx:xx:xx (where x2 ensures locally administered bit)
-	return fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x",
-		randByte(), randByte(), randByte(), randByte(), randByte())
-}
-
-func randByte() byte {
-	// In production, use crypto/rand
-	return byte(os.Getpid() & 0xFF)
-}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cooldownOwner is the container ID recorded in IP reservations held for
+// cooldown. It can never collide with a sandbox ID.
+const cooldownOwner = "fc-cri-cooldown"
+
+// ipCooldown keeps released IPs from being re-assigned for a while, so a new
+// pod doesn't inherit stale conntrack or ARP entries of the previous one.
+//
+// It works with the host-local IPAM plugin by writing reservation files in
+// its data directory (<data_dir>/<network>/<ip>), which host-local treats as
+// allocated. The file's mtime records when the IP was released. Reservation
+// changes take host-local's own lock so they can't race an allocation.
+type ipCooldown struct {
+	dir    string // host-local data directory for the network
+	window time.Duration
+}
+
+// newIPCooldown returns a cooldown for the given network, or nil if the
+// cooldown is disabled.
+func newIPCooldown(dataDir, network string, window time.Duration) *ipCooldown {
+	if window <= 0 || network == "" {
+		return nil
+	}
+	return &ipCooldown{
+		dir:    filepath.Join(dataDir, network),
+		window: window,
+	}
+}
+
+// Hold reserves a released IP until the cooldown expires. An IP that was
+// already re-assigned is left alone.
+func (c *ipCooldown) Hold(ip net.IP) error {
+	if ip == nil {
+		return nil
+	}
+
+	return c.withLock(func() error {
+		path := filepath.Join(c.dir, ip.String())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reserve %s: %w", ip, err)
+		}
+		defer f.Close()
+
+		if _, err := f.WriteString(cooldownOwner + "\neth0"); err != nil {
+			return fmt.Errorf("failed to reserve %s: %w", ip, err)
+		}
+		return nil
+	})
+}
+
+// Reconcile releases holds whose cooldown has expired and returns the IPs it
+// released.
+func (c *ipCooldown) Reconcile(now time.Time) ([]net.IP, error) {
+	var released []net.IP
+
+	err := c.withLock(func() error {
+		entries, err := os.ReadDir(c.dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			ip := net.ParseIP(entry.Name())
+			if ip == nil || entry.IsDir() {
+				continue // lock, last_reserved_ip.N, ...
+			}
+
+			path := filepath.Join(c.dir, entry.Name())
+			if !isCooldownHold(path) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || now.Sub(info.ModTime()) < c.window {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to release %s: %w", ip, err)
+			}
+			released = append(released, ip)
+		}
+		return nil
+	})
+
+	return released, err
+}
+
+// Held reports whether an IP is currently held for cooldown.
+func (c *ipCooldown) Held(ip net.IP) bool {
+	return isCooldownHold(filepath.Join(c.dir, ip.String()))
+}
+
+// withLock runs fn while holding host-local's lock on the network.
+func (c *ipCooldown) withLock(fn func() error) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(c.dir, "lock"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open IPAM lock: %w", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock IPAM store: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// isCooldownHold reports whether a reservation file is a cooldown hold
+// rather than a real allocation.
+func isCooldownHold(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	return scanner.Scan() && strings.TrimSpace(scanner.Text()) == cooldownOwner
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPCooldown(t *testing.T) {
+	dataDir := t.TempDir()
+	cooldown := newIPCooldown(dataDir, "fc-net", time.Minute)
+
+	ip := net.ParseIP("10.88.0.5")
+	if err := cooldown.Hold(ip); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	if !cooldown.Held(ip) {
+		t.Fatal("IP not held after Hold")
+	}
+
+	// A real allocation of another IP must never be released
+	allocated := filepath.Join(dataDir, "fc-net", "10.88.0.6")
+	if err := os.WriteFile(allocated, []byte("fc-123\neth0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is released before the window passes
+	released, err := cooldown.Reconcile(time.Now())
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(released) != 0 {
+		t.Errorf("released %v before cooldown expired", released)
+	}
+
+	released, err = cooldown.Reconcile(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(released) != 1 || !released[0].Equal(ip) {
+		t.Errorf("released %v, want [%s]", released, ip)
+	}
+	if cooldown.Held(ip) {
+		t.Error("IP still held after cooldown")
+	}
+	if _, err := os.Stat(allocated); err != nil {
+		t.Errorf("real allocation was removed: %v", err)
+	}
+}
+
+func TestIPCooldownKeepsReassignedIP(t *testing.T) {
+	dataDir := t.TempDir()
+	cooldown := newIPCooldown(dataDir, "fc-net", time.Minute)
+
+	// The IP was already handed to another sandbox
+	path := filepath.Join(dataDir, "fc-net", "10.88.0.7")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("fc-456\neth0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cooldown.Hold(net.ParseIP("10.88.0.7")); err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	if cooldown.Held(net.ParseIP("10.88.0.7")) {
+		t.Error("Hold took over an allocated IP")
+	}
+}
+
+func TestNewIPCooldownDisabled(t *testing.T) {
+	if newIPCooldown(t.TempDir(), "fc-net", 0) != nil {
+		t.Error("cooldown enabled with a zero window")
+	}
+}
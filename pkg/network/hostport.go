@@ -0,0 +1,172 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// Host ports forward ports of the node to a sandbox, as a pod's hostPorts.
+// A network whose chain takes the portMappings capability, as the portmap
+// plugin does, is handed the mappings through CNI. For other networks the
+// service forwards them itself, with an nftables table per sandbox that is
+// removed on teardown.
+
+// portMappingsCapability is the CNI capability host ports are passed as.
+const portMappingsCapability = "portMappings"
+
+// hasPortMappingsCapability reports whether a plugin of the network takes
+// host ports.
+func hasPortMappingsCapability(list *libcni.NetworkConfigList) bool {
+	for _, plugin := range list.Plugins {
+		if plugin.Network != nil && plugin.Network.Capabilities[portMappingsCapability] {
+			return true
+		}
+	}
+	return false
+}
+
+// portMappingsArgs returns the capability args passing a sandbox's host
+// ports to CNI, or nil if it has none or the service forwards them itself.
+func (s *CNIService) portMappingsArgs(sandbox *domain.Sandbox) map[string]interface{} {
+	if len(sandbox.PortMappings) == 0 || !s.portMapPlugin {
+		return nil
+	}
+	var mappings []map[string]interface{}
+	for _, pm := range sandbox.PortMappings {
+		protocol, _ := serviceProtocol(pm.Protocol)
+		mapping := map[string]interface{}{
+			"hostPort":      pm.HostPort,
+			"containerPort": pm.ContainerPort,
+			"protocol":      protocol,
+		}
+		if pm.HostIP != "" {
+			mapping["hostIP"] = pm.HostIP
+		}
+		mappings = append(mappings, mapping)
+	}
+	return map[string]interface{}{portMappingsCapability: mappings}
+}
+
+// forwardHostPorts forwards a sandbox's host ports to its addresses, for
+// networks that don't.
+func (s *CNIService) forwardHostPorts(sandbox *domain.Sandbox) error {
+	if len(sandbox.PortMappings) == 0 || s.portMapPlugin {
+		return nil
+	}
+	ruleset, err := hostPortRuleset(hostPortTableName(sandbox.ID), sandbox.IPs, sandbox.PortMappings)
+	if err != nil {
+		return err
+	}
+	if err := s.nft(ruleset); err != nil {
+		return fmt.Errorf("failed to forward host ports: %w", err)
+	}
+	s.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"ports":      len(sandbox.PortMappings),
+	}).Debug("Forwarding host ports")
+	return nil
+}
+
+// unforwardHostPorts removes the forwarding of a sandbox's host ports.
+func (s *CNIService) unforwardHostPorts(sandbox *domain.Sandbox) error {
+	if len(sandbox.PortMappings) == 0 || s.portMapPlugin {
+		return nil
+	}
+	table := hostPortTableName(sandbox.ID)
+	return s.nft(fmt.Sprintf("table ip %s\ndelete table ip %s\ntable ip6 %s\ndelete table ip6 %s\n", table, table, table, table))
+}
+
+// ValidatePortMapping checks a host port mapping.
+func ValidatePortMapping(pm domain.PortMapping) error {
+	if pm.HostPort < 1 || pm.HostPort > 65535 {
+		return fmt.Errorf("invalid host port %d", pm.HostPort)
+	}
+	if pm.ContainerPort < 1 || pm.ContainerPort > 65535 {
+		return fmt.Errorf("invalid container port %d", pm.ContainerPort)
+	}
+	if _, err := serviceProtocol(pm.Protocol); err != nil {
+		return err
+	}
+	if pm.HostIP != "" && net.ParseIP(pm.HostIP) == nil {
+		return fmt.Errorf("invalid host IP %q", pm.HostIP)
+	}
+	return nil
+}
+
+// hostPortTableName returns the nftables table of a sandbox's host ports.
+func hostPortTableName(sandboxID string) string {
+	sum := sha256.Sum256([]byte(sandboxID))
+	return "fc_hp_" + hex.EncodeToString(sum[:])[:12]
+}
+
+// hostPortRuleset renders the nftables tables forwarding host ports to a
+// sandbox, one for each of its address families, replacing any previous
+// version atomically. Connections to a local address, from outside or from
+// the node itself, are DNATed to the sandbox; loopback addresses are left
+// alone, as the kernel won't route them out. A mapping with a host IP only
+// applies to that address's family. Connections a sandbox makes to its own
+// host port are masqueraded, so the reply comes back through the host.
+func hostPortRuleset(table string, addresses []*net.IPNet, mappings []domain.PortMapping) (string, error) {
+	for _, pm := range mappings {
+		if err := ValidatePortMapping(pm); err != nil {
+			return "", err
+		}
+	}
+
+	var b strings.Builder
+	for _, family := range []string{"ip", "ip6"} {
+		// Declaring the table first lets the delete succeed when it
+		// doesn't exist yet
+		fmt.Fprintf(&b, "table %s %s\ndelete table %s %s\n", family, table, family, table)
+
+		var addr net.IP
+		for _, address := range addresses {
+			if (address.IP.To4() != nil) == (family == "ip") {
+				addr = address.IP
+				break
+			}
+		}
+		if addr == nil {
+			continue
+		}
+		loopback, target := "127.0.0.0/8", addr.String()
+		if family == "ip6" {
+			loopback, target = "::1", "["+addr.String()+"]"
+		}
+
+		var rules []string
+		for _, pm := range mappings {
+			match := ""
+			if pm.HostIP != "" {
+				hostIP := net.ParseIP(pm.HostIP)
+				if (hostIP.To4() != nil) != (family == "ip") {
+					continue
+				}
+				match = fmt.Sprintf("%s daddr %s ", family, hostIP)
+			}
+			protocol, _ := serviceProtocol(pm.Protocol)
+			rules = append(rules, fmt.Sprintf("%s%s dport %d dnat to %s:%d", match, protocol, pm.HostPort, target, pm.ContainerPort))
+		}
+		if len(rules) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "table %s %s {\n", family, table)
+		fmt.Fprintf(&b, "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n\t\tfib daddr type local jump hostports\n\t}\n")
+		fmt.Fprintf(&b, "\tchain output {\n\t\ttype nat hook output priority dstnat; policy accept;\n\t\t%s daddr != %s fib daddr type local jump hostports\n\t}\n", family, loopback)
+		fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n\t\t%s saddr %s %s daddr %s ct status dnat masquerade\n\t}\n", family, addr, family, addr)
+		b.WriteString("\tchain hostports {\n")
+		for _, rule := range rules {
+			fmt.Fprintf(&b, "\t\t%s\n", rule)
+		}
+		b.WriteString("\t}\n}\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHostPortRuleset(t *testing.T) {
+	addresses := []*net.IPNet{
+		{IP: net.ParseIP("10.88.0.5"), Mask: net.CIDRMask(16, 32)},
+		{IP: net.ParseIP("fd00:fc::5"), Mask: net.CIDRMask(64, 128)},
+	}
+	mappings := []domain.PortMapping{
+		{HostPort: 8080, ContainerPort: 80},
+		{Protocol: "UDP", HostPort: 5353, ContainerPort: 53, HostIP: "192.168.1.10"},
+	}
+
+	ruleset, err := hostPortRuleset("fc_hp_test", addresses, mappings)
+	if err != nil {
+		t.Fatalf("hostPortRuleset() error = %v", err)
+	}
+	for _, want := range []string{
+		"table ip fc_hp_test\ndelete table ip fc_hp_test\n",
+		"table ip6 fc_hp_test\ndelete table ip6 fc_hp_test\n",
+		"fib daddr type local jump hostports",
+		"ip daddr != 127.0.0.0/8 fib daddr type local jump hostports",
+		"ip saddr 10.88.0.5 ip daddr 10.88.0.5 ct status dnat masquerade",
+		"tcp dport 8080 dnat to 10.88.0.5:80",
+		"ip daddr 192.168.1.10 udp dport 5353 dnat to 10.88.0.5:53",
+		"tcp dport 8080 dnat to [fd00:fc::5]:80",
+		"ip6 daddr != ::1 fib daddr type local jump hostports",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("ruleset is missing %q:\n%s", want, ruleset)
+		}
+	}
+	// The IPv4 host IP doesn't apply to the IPv6 address
+	if strings.Contains(ruleset, "dnat to [fd00:fc::5]:53") {
+		t.Errorf("IPv4 host IP mapped in the ip6 table:\n%s", ruleset)
+	}
+
+	// Without an IPv6 address there is no ip6 table, only its removal
+	ruleset, _ = hostPortRuleset("fc_hp_test", addresses[:1], mappings)
+	if strings.Contains(ruleset, "table ip6 fc_hp_test {") {
+		t.Errorf("ip6 table for a sandbox without IPv6:\n%s", ruleset)
+	}
+
+	for _, pm := range []domain.PortMapping{
+		{HostPort: 0, ContainerPort: 80},
+		{HostPort: 8080, ContainerPort: 70000},
+		{Protocol: "icmp", HostPort: 8080, ContainerPort: 80},
+		{HostPort: 8080, ContainerPort: 80, HostIP: "node1"},
+	} {
+		if _, err := hostPortRuleset("fc_hp_test", addresses, []domain.PortMapping{pm}); err == nil {
+			t.Errorf("hostPortRuleset(%+v) succeeded", pm)
+		}
+	}
+}
+
+func TestHostPorts_PortMapPlugin(t *testing.T) {
+	withPortMap, err := libcni.ConfListFromBytes([]byte(`{"cniVersion": "1.0.0", "name": "test-net", "plugins": [
+		{"type": "bridge"}, {"type": "portmap", "capabilities": {"portMappings": true}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPortMappingsCapability(withPortMap) {
+		t.Error("hasPortMappingsCapability() = false for a chain with portmap")
+	}
+	stock, _ := libcni.ConfListFromBytes([]byte(`{"cniVersion": "1.0.0", "name": "test-net", "plugins": [{"type": "bridge"}]}`))
+	if hasPortMappingsCapability(stock) {
+		t.Error("hasPortMappingsCapability() = true for a chain without portmap")
+	}
+
+	var rulesets []string
+	s := &CNIService{
+		portMapPlugin: true,
+		nft:           func(ruleset string) error { rulesets = append(rulesets, ruleset); return nil },
+		log:           logrus.NewEntry(logrus.New()),
+	}
+	sandbox := domain.NewSandbox("sb-1")
+	sandbox.IPs = []*net.IPNet{{IP: net.ParseIP("10.88.0.5"), Mask: net.CIDRMask(16, 32)}}
+	if args := s.portMappingsArgs(sandbox); args != nil {
+		t.Errorf("capability args without host ports = %v", args)
+	}
+
+	// The plugin gets the mappings; the service leaves them alone
+	sandbox.PortMappings = []domain.PortMapping{{Protocol: "UDP", HostPort: 5353, ContainerPort: 53, HostIP: "192.168.1.10"}}
+	args := s.portMappingsArgs(sandbox)
+	mappings, _ := args[portMappingsCapability].([]map[string]interface{})
+	if len(mappings) != 1 || mappings[0]["hostPort"] != 5353 || mappings[0]["containerPort"] != 53 ||
+		mappings[0]["protocol"] != "udp" || mappings[0]["hostIP"] != "192.168.1.10" {
+		t.Errorf("capability args = %v", args)
+	}
+	if err := s.forwardHostPorts(sandbox); err != nil || len(rulesets) != 0 {
+		t.Errorf("forwardHostPorts() with portmap = %v, loaded %d rulesets", err, len(rulesets))
+	}
+
+	// Without the plugin the service forwards them, and removes them again
+	s.portMapPlugin = false
+	if args := s.portMappingsArgs(sandbox); args != nil {
+		t.Errorf("capability args without portmap = %v", args)
+	}
+	if err := s.forwardHostPorts(sandbox); err != nil {
+		t.Fatalf("forwardHostPorts() error = %v", err)
+	}
+	if err := s.unforwardHostPorts(sandbox); err != nil {
+		t.Fatalf("unforwardHostPorts() error = %v", err)
+	}
+	table := hostPortTableName(sandbox.ID)
+	if len(rulesets) != 2 || !strings.Contains(rulesets[0], "table ip "+table+" {") ||
+		strings.Contains(rulesets[1], "{") || !strings.Contains(rulesets[1], "delete table ip6 "+table) {
+		t.Errorf("rulesets = %q", rulesets)
+	}
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Guest MACs are random, so they don't repeat across a node's sandboxes or
+// its restarts. Each is claimed on the node by a record in MACStateDir named
+// after it and created exclusively, so the shims of a node never hand out
+// the same one: a MAC already claimed is a collision, retried with another.
+// The record names the sandbox and guest interface, so a sandbox whose
+// network is set up again keeps its MACs. Teardown releases a sandbox's
+// MACs; those of sandboxes whose namespace is gone are released when the
+// service starts.
+
+const (
+	// DefaultMACStateDir holds the claims of the node's guest MACs.
+	DefaultMACStateDir = "/run/fc-cri/macs"
+
+	// GuestMACPrefix starts the MAC of a sandbox's eth0, which the udev
+	// rule of images built by scripts/create-rootfs.sh names eth0, and
+	// AdditionalMACPrefix those of its additional networks' interfaces.
+	GuestMACPrefix      = "02:fc"
+	AdditionalMACPrefix = "02:fd"
+
+	// macAttempts bounds the MACs tried when allocating one collides.
+	macAttempts = 8
+)
+
+// macClaim records who a guest MAC belongs to.
+type macClaim struct {
+	SandboxID string    `json:"sandbox_id"`
+	Interface string    `json:"interface"` // Guest interface, e.g. "eth0"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GenerateMAC returns a random MAC starting with prefix, its first two
+// bytes, e.g. GuestMACPrefix. The prefix should be a locally administered
+// unicast one.
+func GenerateMAC(prefix string) (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate MAC: %w", err)
+	}
+	return fmt.Sprintf("%s:%02x:%02x:%02x:%02x", prefix, b[0], b[1], b[2], b[3]), nil
+}
+
+// macClaimPath returns the path of a MAC's claim.
+func (s *CNIService) macClaimPath(mac string) string {
+	return filepath.Join(s.config.MACStateDir, strings.ReplaceAll(mac, ":", "-")+".json")
+}
+
+// allocateMAC returns a MAC for a sandbox's guest interface that no other
+// interface on the node has. An interface that has one keeps it.
+func (s *CNIService) allocateMAC(sandboxID, guestIf, prefix string) (string, error) {
+	claims, err := s.readMACClaims()
+	if err != nil {
+		return "", err
+	}
+	for mac, claim := range claims {
+		if claim.SandboxID == sandboxID && claim.Interface == guestIf {
+			return mac, nil
+		}
+	}
+
+	if err := os.MkdirAll(s.config.MACStateDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create MAC state dir: %w", err)
+	}
+	data, err := json.Marshal(macClaim{SandboxID: sandboxID, Interface: guestIf, CreatedAt: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	generate := s.generateMAC
+	if generate == nil {
+		generate = GenerateMAC
+	}
+	for attempt := 1; attempt <= macAttempts; attempt++ {
+		mac, err := generate(prefix)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(s.macClaimPath(mac), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			s.log.WithFields(logrus.Fields{"sandbox_id": sandboxID, "mac": mac}).Debug("MAC already claimed, retrying")
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to claim MAC: %w", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", fmt.Errorf("failed to claim MAC: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("failed to claim MAC: %w", err)
+		}
+		return mac, nil
+	}
+	return "", fmt.Errorf("no free MAC for %s after %d attempts", guestIf, macAttempts)
+}
+
+// releaseMACs releases the MACs a sandbox's interfaces claimed.
+func (s *CNIService) releaseMACs(sandboxID string) error {
+	claims, err := s.readMACClaims()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for mac, claim := range claims {
+		if claim.SandboxID != sandboxID {
+			continue
+		}
+		if err := os.Remove(s.macClaimPath(mac)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readMACClaims returns the node's claimed MACs. A claim that can't be read
+// is skipped: its MAC stays taken.
+func (s *CNIService) readMACClaims() (map[string]macClaim, error) {
+	entries, err := os.ReadDir(s.config.MACStateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	claims := make(map[string]macClaim, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		var claim macClaim
+		data, err := os.ReadFile(filepath.Join(s.config.MACStateDir, entry.Name()))
+		if err != nil || json.Unmarshal(data, &claim) != nil {
+			continue
+		}
+		claims[strings.ReplaceAll(name, "-", ":")] = claim
+	}
+	return claims, nil
+}
+
+// ReconcileMACs releases the MACs of sandboxes whose network namespace is
+// gone, which a crash left claimed. Run it after ReconcileNetNS. It returns
+// the released MACs.
+func (s *CNIService) ReconcileMACs() ([]string, error) {
+	claims, err := s.readMACClaims()
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	var errs []error
+	for mac, claim := range claims {
+		if _, err := os.Lstat(s.netnsPath(claim.SandboxID)); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Remove(s.macClaimPath(mac)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		released = append(released, mac)
+	}
+	return released, errors.Join(errs...)
+}
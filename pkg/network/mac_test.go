@@ -0,0 +1,109 @@
+package network
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testMACService(t *testing.T) *CNIService {
+	t.Helper()
+	config := CNIServiceConfig{NetNSDir: t.TempDir(), MACStateDir: t.TempDir()}
+	return &CNIService{config: config, log: logrus.NewEntry(logrus.New())}
+}
+
+func TestGenerateMAC(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		mac, err := GenerateMAC(GuestMACPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatalf("GenerateMAC() = %q: %v", mac, err)
+		}
+		if !strings.HasPrefix(mac, GuestMACPrefix+":") || hw[0]&0x01 != 0 || hw[0]&0x02 == 0 {
+			t.Fatalf("GenerateMAC() = %s, want a locally administered unicast address with prefix %s", mac, GuestMACPrefix)
+		}
+		seen[mac] = true
+	}
+	if len(seen) < 99 {
+		t.Errorf("GenerateMAC() returned %d distinct MACs out of 100", len(seen))
+	}
+}
+
+func TestAllocateMAC(t *testing.T) {
+	s := testMACService(t)
+	eth0, err := s.allocateMAC("sb-1", "eth0", GuestMACPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth1, err := s.allocateMAC("sb-1", "eth1", AdditionalMACPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(eth1, AdditionalMACPrefix+":") || eth0 == eth1 {
+		t.Errorf("allocateMAC() = %s, %s; want distinct MACs with their interfaces' prefixes", eth0, eth1)
+	}
+	// An interface keeps its MAC
+	if again, err := s.allocateMAC("sb-1", "eth0", GuestMACPrefix); err != nil || again != eth0 {
+		t.Errorf("allocateMAC() again = %s, %v; want %s", again, err, eth0)
+	}
+
+	// A claimed MAC is never handed out again
+	macs := []string{eth0, eth0, "02:fc:00:00:00:01"}
+	s.generateMAC = func(string) (string, error) {
+		mac := macs[0]
+		macs = macs[1:]
+		return mac, nil
+	}
+	mac, err := s.allocateMAC("sb-2", "eth0", GuestMACPrefix)
+	if err != nil || mac != "02:fc:00:00:00:01" {
+		t.Errorf("allocateMAC() on collision = %s, %v; want 02:fc:00:00:00:01", mac, err)
+	}
+	s.generateMAC = func(string) (string, error) { return eth0, nil }
+	if _, err := s.allocateMAC("sb-3", "eth0", GuestMACPrefix); err == nil {
+		t.Error("allocateMAC() succeeded with every MAC taken")
+	}
+
+	if err := s.releaseMACs("sb-1"); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.readMACClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims) != 1 || claims["02:fc:00:00:00:01"].SandboxID != "sb-2" {
+		t.Errorf("claims after release = %v, want sb-2's only", claims)
+	}
+}
+
+func TestReconcileMACs(t *testing.T) {
+	s := testMACService(t)
+	for _, id := range []string{"live", "gone"} {
+		if _, err := s.allocateMAC(id, "eth0", GuestMACPrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(s.netnsPath("live"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := s.ReconcileMACs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := s.readMACClaims()
+	if len(released) != 1 || len(claims) != 1 {
+		t.Fatalf("ReconcileMACs() released %v, left %v", released, claims)
+	}
+	for _, claim := range claims {
+		if claim.SandboxID != "live" {
+			t.Errorf("claim of %s kept, want live's", claim.SandboxID)
+		}
+	}
+}
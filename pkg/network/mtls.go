@@ -0,0 +1,287 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mtlsHandshakeTimeout bounds how long a peer may take to complete the TLS
+// handshake.
+const mtlsHandshakeTimeout = 10 * time.Second
+
+// MTLSConfig configures host-terminated mTLS, which lets pods take part in
+// a service mesh without running a sidecar inside their VM. The workload
+// certificate files are typically kept up to date by a SPIFFE agent such as
+// spire-agent; they are re-read whenever they change.
+type MTLSConfig struct {
+	// CertFile is the workload certificate (X.509 SVID) presented to peers,
+	// followed by its intermediates.
+	CertFile string
+
+	// KeyFile is the certificate's private key.
+	KeyFile string
+
+	// BundleFile holds the CA certificates peer certificates must chain to.
+	BundleFile string
+
+	// TrustDomain restricts peers to SPIFFE IDs of this trust domain, e.g.
+	// "cluster.local". Empty accepts any peer the bundle verifies.
+	TrustDomain string
+}
+
+// DefaultMTLSConfig returns the default mTLS configuration, using the file
+// names spiffe-helper writes.
+func DefaultMTLSConfig() MTLSConfig {
+	return MTLSConfig{
+		CertFile:   "/run/spiffe/certs/svid.pem",
+		KeyFile:    "/run/spiffe/certs/svid_key.pem",
+		BundleFile: "/run/spiffe/certs/svid_bundle.pem",
+	}
+}
+
+// PortMapping forwards a port the proxy listens on to a port in the guest.
+type PortMapping struct {
+	ListenPort int
+	GuestPort  int
+}
+
+// MTLSProxy terminates mTLS on the host for one sandbox. It listens on the
+// host side of the sandbox's tap, accepts connections from peers presenting
+// a certificate from the trust bundle, and forwards the decrypted stream to
+// the guest, which only ever sees plain TCP.
+type MTLSProxy struct {
+	certs     *certSource
+	listeners []net.Listener
+	log       *logrus.Entry
+
+	wg sync.WaitGroup
+}
+
+// StartMTLSProxy starts a proxy listening on listenIP for each mapping and
+// forwarding to guestIP. The certificates are loaded before anything
+// listens, so a misconfigured node fails the sandbox up front.
+func StartMTLSProxy(config MTLSConfig, listenIP, guestIP net.IP, ports []PortMapping, log *logrus.Entry) (*MTLSProxy, error) {
+	if listenIP == nil || guestIP == nil {
+		return nil, fmt.Errorf("mTLS proxy needs the sandbox's host and guest addresses")
+	}
+
+	certs := &certSource{config: config}
+	if _, err := certs.tlsConfig(); err != nil {
+		return nil, err
+	}
+
+	p := &MTLSProxy{
+		certs: certs,
+		log:   log.WithField("component", "mtls-proxy"),
+	}
+
+	serverConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return certs.tlsConfig()
+		},
+	}
+
+	for _, port := range ports {
+		addr := net.JoinHostPort(listenIP.String(), strconv.Itoa(port.ListenPort))
+		listener, err := tls.Listen("tcp", addr, serverConfig)
+		if err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		p.listeners = append(p.listeners, listener)
+
+		target := net.JoinHostPort(guestIP.String(), strconv.Itoa(port.GuestPort))
+		p.log.WithFields(logrus.Fields{
+			"listen": addr,
+			"target": target,
+		}).Info("Terminating mTLS for sandbox port")
+
+		p.wg.Add(1)
+		go p.serve(listener, target)
+	}
+
+	return p, nil
+}
+
+// Addrs returns the addresses the proxy listens on.
+func (p *MTLSProxy) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.listeners))
+	for _, listener := range p.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// Stop closes the proxy's listeners and waits for them to stop accepting.
+// Connections already forwarded run until either side closes them.
+func (p *MTLSProxy) Stop() {
+	for _, listener := range p.listeners {
+		_ = listener.Close()
+	}
+	p.wg.Wait()
+}
+
+func (p *MTLSProxy) serve(listener net.Listener, target string) {
+	defer p.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.log.WithError(err).Warn("Failed to accept connection")
+			continue
+		}
+		go p.forward(conn.(*tls.Conn), target)
+	}
+}
+
+// forward completes the handshake with a peer and copies the stream to and
+// from the guest.
+func (p *MTLSProxy) forward(conn *tls.Conn, target string) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mtlsHandshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		p.log.WithError(err).WithField("peer", conn.RemoteAddr()).Debug("mTLS handshake failed")
+		return
+	}
+
+	log := p.log.WithFields(logrus.Fields{
+		"peer":     conn.RemoteAddr(),
+		"identity": peerIdentity(conn.ConnectionState()),
+		"target":   target,
+	})
+
+	upstream, err := net.DialTimeout("tcp", target, mtlsHandshakeTimeout)
+	if err != nil {
+		log.WithError(err).Warn("Failed to connect to guest")
+		return
+	}
+	defer upstream.Close()
+
+	log.Debug("Forwarding mTLS connection")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// peerIdentity returns the SPIFFE ID of a verified peer, or empty if its
+// certificate has none.
+func peerIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	for _, uri := range state.PeerCertificates[0].URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// certSource serves the workload certificate and trust bundle, reloading
+// them when the files change so rotated certificates are picked up.
+type certSource struct {
+	config MTLSConfig
+
+	mu      sync.Mutex
+	current *tls.Config
+	version string // modification times of the files current was loaded from
+}
+
+// tlsConfig returns the TLS configuration for the current files.
+func (s *certSource) tlsConfig() (*tls.Config, error) {
+	version, err := s.fileVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && version == s.version {
+		return s.current, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load workload certificate: %w", err)
+	}
+	bundle, err := os.ReadFile(s.config.BundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("trust bundle %s holds no certificates", s.config.BundleFile)
+	}
+
+	s.current = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyTrustDomain(state, s.config.TrustDomain)
+		},
+	}
+	s.version = version
+	return s.current, nil
+}
+
+// fileVersion identifies the current contents of the certificate files.
+func (s *certSource) fileVersion() (string, error) {
+	var version string
+	for _, path := range []string{s.config.CertFile, s.config.KeyFile, s.config.BundleFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read mTLS certificates: %w", err)
+		}
+		version += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
+
+// verifyTrustDomain checks that a peer's SPIFFE ID is in the trust domain.
+func verifyTrustDomain(state tls.ConnectionState, trustDomain string) error {
+	if trustDomain == "" {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	for _, uri := range state.PeerCertificates[0].URIs {
+		if uri.Scheme == "spiffe" && uri.Host == trustDomain {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer is not in trust domain %s", trustDomain)
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testCA issues certificates for SPIFFE IDs.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key, in PEM, for a SPIFFE ID.
+func (ca *testCA) issue(t *testing.T, spiffeID string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := url.Parse(spiffeID)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{id},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// echoServer stands in for the guest.
+func echoServer(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestMTLSProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "spiffe://cluster.local/ns/default/sa/web")
+	config := MTLSConfig{
+		CertFile:    filepath.Join(dir, "svid.pem"),
+		KeyFile:     filepath.Join(dir, "svid_key.pem"),
+		BundleFile:  filepath.Join(dir, "bundle.pem"),
+		TrustDomain: "cluster.local",
+	}
+	for path, data := range map[string][]byte{config.CertFile: cert, config.KeyFile: key, config.BundleFile: ca.pem} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loopback := net.IPv4(127, 0, 0, 1)
+	proxy, err := StartMTLSProxy(config, loopback, loopback, []PortMapping{{GuestPort: echoServer(t)}}, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("StartMTLSProxy() error = %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.Addrs()[0].String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(spiffeID string) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if spiffeID != "" {
+			certPEM, keyPEM := ca.issue(t, spiffeID)
+			clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{clientCert}
+		}
+
+		conn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != "ping" {
+			t.Errorf("echoed %q, want ping", buf)
+		}
+		return nil
+	}
+
+	if err := dial("spiffe://cluster.local/ns/default/sa/client"); err != nil {
+		t.Errorf("peer in trust domain: %v", err)
+	}
+	if err := dial("spiffe://other.example/ns/default/sa/client"); err == nil {
+		t.Error("peer from another trust domain was accepted")
+	}
+	if err := dial(""); err == nil {
+		t.Error("peer without a certificate was accepted")
+	}
+}
+
+func TestStartMTLSProxyMissingCertificates(t *testing.T) {
+	config := MTLSConfig{
+		CertFile:   filepath.Join(t.TempDir(), "svid.pem"),
+		KeyFile:    filepath.Join(t.TempDir(), "svid_key.pem"),
+		BundleFile: filepath.Join(t.TempDir(), "bundle.pem"),
+	}
+	loopback := net.IPv4(127, 0, 0, 1)
+	if _, err := StartMTLSProxy(config, loopback, loopback, []PortMapping{{GuestPort: 80}}, logrus.NewEntry(logrus.New())); err == nil {
+		t.Error("StartMTLSProxy() succeeded without certificates")
+	}
+}
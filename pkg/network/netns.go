@@ -0,0 +1,288 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Sandbox network namespaces are bind mounts of a namespace onto a file in
+// NetNSDir, named fc-<sandbox-id>, as `ip netns add` makes them, so the
+// namespace outlives the thread that created it and ip, CNI plugins and the
+// jailer can open it by path. A record in NetNSStateDir names the sandbox
+// and the process that created each one; a namespace whose creator has
+// exited and that no process runs in has leaked, and is removed when the
+// service starts.
+
+const (
+	// DefaultNetNSDir is where network namespaces are mounted.
+	DefaultNetNSDir = "/var/run/netns"
+
+	// DefaultNetNSStateDir holds the ownership records of the namespaces.
+	DefaultNetNSStateDir = "/run/fc-cri/netns"
+
+	// netnsPrefix marks the namespaces of sandboxes.
+	netnsPrefix = "fc-"
+)
+
+// netnsOwner records who a sandbox network namespace belongs to.
+type netnsOwner struct {
+	SandboxID string    `json:"sandbox_id"`
+	PID       int       `json:"pid"` // Process that created the namespace
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// netnsPath returns the path of a sandbox's network namespace.
+func (s *CNIService) netnsPath(sandboxID string) string {
+	return filepath.Join(s.config.NetNSDir, netnsPrefix+sandboxID)
+}
+
+// ownerPath returns the path of a namespace's ownership record.
+func (s *CNIService) ownerPath(name string) string {
+	return filepath.Join(s.config.NetNSStateDir, name+".json")
+}
+
+// createNetNS creates a new network namespace for the sandbox. One left by
+// a crashed earlier attempt is removed first.
+func (s *CNIService) createNetNS(sandboxID string) (string, error) {
+	path := s.netnsPath(sandboxID)
+	if _, err := os.Lstat(path); err == nil {
+		s.log.WithField("netns", path).Warn("Removing stale network namespace")
+		if err := s.deleteNetNS(sandboxID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := prepareNetNSDir(s.config.NetNSDir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.config.NetNSStateDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create netns state dir: %w", err)
+	}
+	// Record the owner first, so a crash halfway leaves a namespace the
+	// next start knows to be ours
+	owner, err := json.Marshal(netnsOwner{SandboxID: sandboxID, PID: os.Getpid(), CreatedAt: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(s.ownerPath(filepath.Base(path)), owner, 0600); err != nil {
+		return "", fmt.Errorf("failed to record netns owner: %w", err)
+	}
+
+	if err := mountNetNS(path); err != nil {
+		_ = os.Remove(s.ownerPath(filepath.Base(path)))
+		return "", err
+	}
+	return path, nil
+}
+
+// deleteNetNS unmounts and removes a sandbox's network namespace and its
+// ownership record. Parts already gone, after a crash, are not an error.
+func (s *CNIService) deleteNetNS(sandboxID string) error {
+	return removeNetNS(s.netnsPath(sandboxID), s.ownerPath(netnsPrefix+sandboxID))
+}
+
+func removeNetNS(path, ownerPath string) error {
+	// Detaching succeeds even while a process still holds the namespace;
+	// it lives on until the last one exits
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount netns %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove netns %s: %w", path, err)
+	}
+	if err := os.Remove(ownerPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove netns owner record: %w", err)
+	}
+	return nil
+}
+
+// ReconcileNetNS removes the sandbox network namespaces that leaked: their
+// creator has exited and no process runs in them. Namespaces of VMs a
+// restarted shim adopted still have the VMM in them and are kept. It
+// returns the paths of the removed namespaces.
+func (s *CNIService) ReconcileNetNS() ([]string, error) {
+	entries, err := os.ReadDir(s.config.NetNSDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var leaked []string
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, netnsPrefix) {
+			continue
+		}
+		path := filepath.Join(s.config.NetNSDir, name)
+		log := s.log.WithField("netns", path)
+
+		if owner, err := readNetNSOwner(s.ownerPath(name)); err == nil && processRunning(owner.PID) {
+			continue
+		}
+		inUse, err := netnsInUse(path)
+		if err != nil {
+			log.WithError(err).Warn("Failed to check network namespace for processes")
+			continue
+		}
+		if inUse {
+			continue
+		}
+
+		log.Info("Removing leaked network namespace")
+		if err := removeNetNS(path, s.ownerPath(name)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		leaked = append(leaked, path)
+	}
+	return leaked, errors.Join(errs...)
+}
+
+func readNetNSOwner(path string) (netnsOwner, error) {
+	var owner netnsOwner
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return owner, err
+	}
+	return owner, json.Unmarshal(data, &owner)
+}
+
+// processRunning reports whether a process with the given PID exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// netnsInUse reports whether any process runs in the network namespace
+// mounted at path. An unmounted file holds no namespace and isn't in use.
+func netnsInUse(path string) (bool, error) {
+	var ns unix.Stat_t
+	if err := unix.Stat(path, &ns); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return false, err
+	}
+	if fs.Type != unix.NSFS_MAGIC {
+		return false, nil
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, err
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		var st unix.Stat_t
+		if unix.Stat(filepath.Join("/proc", proc.Name(), "ns", "net"), &st) != nil {
+			continue // Exited, or not ours to look at
+		}
+		if st.Ino == ns.Ino && st.Dev == ns.Dev {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mountNetNS creates a network namespace and bind mounts it at path.
+func mountNetNS(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to create netns file: %w", err)
+	}
+	f.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	// Unshare on a thread of its own, so no other goroutine ever runs in
+	// the new namespace
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		defer origin.Close()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("failed to create network namespace: %w", err)
+			return
+		}
+		source := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		err = unix.Mount(source, path, "none", unix.MS_BIND, "")
+		if err != nil {
+			err = fmt.Errorf("failed to mount network namespace at %s: %w", path, err)
+		}
+		// A thread stuck in the new namespace is left locked, so it exits
+		// with the goroutine rather than running anything else
+		if netns.Set(origin) == nil {
+			runtime.UnlockOSThread()
+		}
+		result <- err
+	}()
+	return <-result
+}
+
+var (
+	netnsDirMu       sync.Mutex
+	netnsDirPrepared = map[string]bool{}
+)
+
+// prepareNetNSDir creates the namespace directory and makes it a shared
+// mount, as `ip netns add` does, so namespaces mounted in it show up in
+// every mount namespace, the jailer's included.
+func prepareNetNSDir(dir string) error {
+	netnsDirMu.Lock()
+	defer netnsDirMu.Unlock()
+	if netnsDirPrepared[dir] {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create netns dir: %w", err)
+	}
+	err := unix.Mount("", dir, "none", unix.MS_SHARED|unix.MS_REC, "")
+	if err == unix.EINVAL {
+		// Not a mount point yet
+		if err := unix.Mount(dir, dir, "none", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount netns dir: %w", err)
+		}
+		err = unix.Mount("", dir, "none", unix.MS_SHARED|unix.MS_REC, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to make netns dir shared: %w", err)
+	}
+	netnsDirPrepared[dir] = true
+	return nil
+}
@@ -0,0 +1,150 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// testNetNSService returns a service keeping its namespaces in temporary
+// directories, skipping the test if namespaces can't be mounted there.
+func testNetNSService(t *testing.T) *CNIService {
+	t.Helper()
+	config := DefaultCNIServiceConfig()
+	config.NetNSDir = t.TempDir()
+	config.NetNSStateDir = t.TempDir()
+	if err := prepareNetNSDir(config.NetNSDir); err != nil {
+		t.Skipf("can't mount network namespaces: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Unmount(config.NetNSDir, unix.MNT_DETACH) })
+	return &CNIService{config: config, log: logrus.NewEntry(logrus.New())}
+}
+
+// deadPID returns the PID of a process that has exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// orphan rewrites a namespace's ownership record as if its creator had
+// exited.
+func orphan(t *testing.T, s *CNIService, sandboxID string) {
+	t.Helper()
+	data, _ := json.Marshal(netnsOwner{SandboxID: sandboxID, PID: deadPID(t), CreatedAt: time.Now()})
+	if err := os.WriteFile(s.ownerPath(netnsPrefix+sandboxID), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetNSLifecycle(t *testing.T) {
+	s := testNetNSService(t)
+
+	path, err := s.createNetNS("sb-1")
+	if err != nil {
+		t.Fatalf("createNetNS() failed: %v", err)
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil || fs.Type != unix.NSFS_MAGIC {
+		t.Fatalf("%s is not a mounted namespace (%v)", path, err)
+	}
+	owner, err := readNetNSOwner(s.ownerPath(netnsPrefix + "sb-1"))
+	if err != nil || owner.SandboxID != "sb-1" || owner.PID != os.Getpid() {
+		t.Errorf("owner record = %+v, %v", owner, err)
+	}
+	if _, err := linkMTU(path, "lo"); err != nil {
+		t.Errorf("can't enter the namespace: %v", err)
+	}
+
+	if err := s.deleteNetNS("sb-1"); err != nil {
+		t.Fatalf("deleteNetNS() failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("namespace still at %s", path)
+	}
+	// Deleting it again, as a retried teardown does, is fine
+	if err := s.deleteNetNS("sb-1"); err != nil {
+		t.Errorf("deleteNetNS() of a removed namespace = %v", err)
+	}
+}
+
+func TestCreateNetNS_ReplacesStale(t *testing.T) {
+	s := testNetNSService(t)
+
+	// A crash between creating the file and mounting the namespace
+	if err := os.WriteFile(s.netnsPath("sb-1"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	path, err := s.createNetNS("sb-1")
+	if err != nil {
+		t.Fatalf("createNetNS() over a stale file failed: %v", err)
+	}
+	defer s.deleteNetNS("sb-1")
+	if _, err := linkMTU(path, "lo"); err != nil {
+		t.Errorf("can't enter the namespace: %v", err)
+	}
+}
+
+func TestReconcileNetNS(t *testing.T) {
+	s := testNetNSService(t)
+
+	for _, id := range []string{"live", "leaked", "busy"} {
+		if _, err := s.createNetNS(id); err != nil {
+			t.Fatalf("createNetNS(%s) failed: %v", id, err)
+		}
+		defer s.deleteNetNS(id)
+	}
+	// An unmounted file left by a crash, without an owner record
+	if err := os.WriteFile(s.netnsPath("crashed"), nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	orphan(t, s, "leaked")
+	orphan(t, s, "busy")
+
+	// A VMM still running in the namespace keeps it
+	vmm := exec.Command("nsenter", "--net="+s.netnsPath("busy"), "sleep", "30")
+	if err := vmm.Start(); err != nil {
+		t.Skipf("can't run a process in the namespace: %v", err)
+	}
+	defer func() {
+		_ = vmm.Process.Kill()
+		_ = vmm.Wait()
+	}()
+	// Wait for nsenter to have entered the namespace
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if inUse, _ := netnsInUse(s.netnsPath("busy")); inUse || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leaked, err := s.ReconcileNetNS()
+	if err != nil {
+		t.Fatalf("ReconcileNetNS() failed: %v", err)
+	}
+	want := map[string]bool{s.netnsPath("leaked"): true, s.netnsPath("crashed"): true}
+	if len(leaked) != len(want) {
+		t.Errorf("ReconcileNetNS() removed %v, want the leaked and crashed namespaces", leaked)
+	}
+	for _, path := range leaked {
+		if !want[path] {
+			t.Errorf("ReconcileNetNS() removed %s", path)
+		}
+	}
+	for _, id := range []string{"live", "busy"} {
+		if _, err := os.Stat(s.netnsPath(id)); err != nil {
+			t.Errorf("namespace %s was removed: %v", id, err)
+		}
+	}
+	if _, err := os.Stat(s.ownerPath(netnsPrefix + "leaked")); !os.IsNotExist(err) {
+		t.Error("owner record of the leaked namespace left behind")
+	}
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/containernetworking/cni/libcni"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Pods may ask for networks besides the primary one, as with Multus. Each
+// is a CNI network in the config directory, added to the sandbox's network
+// namespace as net1, net2... with a tap of its own, tap1, tap2..., which the
+// guest sees as eth1, eth2... The primary network keeps the default route
+// and nameservers; an additional network only brings its addresses and
+// its other routes.
+
+// MaxAdditionalNetworks is how many networks a sandbox may add.
+const MaxAdditionalNetworks = 4
+
+// networkName is what CNI accepts as a network name.
+var networkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+// ValidateNetworkName checks the name of an additional network.
+func ValidateNetworkName(name string) error {
+	if !networkName.MatchString(name) {
+		return fmt.Errorf("invalid network name %q", name)
+	}
+	return nil
+}
+
+// additionalIfName and additionalTapName name the interface and tap of a
+// sandbox's i-th additional network, counting from 0.
+func additionalIfName(i int) string  { return fmt.Sprintf("net%d", i+1) }
+func additionalTapName(i int) string { return fmt.Sprintf("tap%d", i+1) }
+
+// additionalNetwork loads an additional network from the config directory.
+// pluginTap reports whether its chain makes the tap with tc-redirect-tap;
+// otherwise the service redirects one to the network's interface, as
+// bridging it to the primary network's bridge would be wrong.
+func (s *CNIService) additionalNetwork(name string) (list *libcni.NetworkConfigList, pluginTap bool, err error) {
+	if err := ValidateNetworkName(name); err != nil {
+		return nil, false, err
+	}
+	if name == s.netConfig.Name {
+		return nil, false, fmt.Errorf("network %s is the primary network", name)
+	}
+	list, err = libcni.LoadConfList(s.config.ConfDir, name)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load network %s: %w", name, err)
+	}
+	last := len(list.Plugins) - 1
+	if last < 0 || list.Plugins[last].Network.Type != tapPlugin {
+		return list, false, nil
+	}
+	if s.tapMode == TAPModePlugin {
+		return list, true, nil
+	}
+	if list, err = withoutLastPlugin(list); err != nil {
+		return nil, false, fmt.Errorf("failed to remove %s from network %s: %w", tapPlugin, name, err)
+	}
+	return list, false, nil
+}
+
+// additionalRuntimeConf returns the CNI runtime config of one of a
+// sandbox's additional networks.
+func additionalRuntimeConf(sandbox *domain.Sandbox, n domain.AdditionalNetwork) *libcni.RuntimeConf {
+	return &libcni.RuntimeConf{
+		ContainerID: sandbox.ID,
+		NetNS:       sandbox.NetworkNamespace,
+		IfName:      n.IfName,
+		Args: [][2]string{
+			{"IgnoreUnknown", "1"},
+			{"K8S_POD_NAMESPACE", sandbox.Namespace},
+			{"K8S_POD_NAME", sandbox.Name},
+			{"TC_REDIRECT_TAP_NAME", n.TapName},
+		},
+	}
+}
+
+// setupAdditionalNetworks adds a sandbox's additional networks, after its
+// primary one. Each is recorded in sandbox.Networks before it is added, so
+// Teardown also deletes one whose add failed part way.
+func (s *CNIService) setupAdditionalNetworks(ctx context.Context, sandbox *domain.Sandbox, names []string) error {
+	if len(names) > MaxAdditionalNetworks {
+		return fmt.Errorf("%d additional networks requested, at most %d are supported", len(names), MaxAdditionalNetworks)
+	}
+	for i, name := range names {
+		list, pluginTap, err := s.additionalNetwork(name)
+		if err != nil {
+			return err
+		}
+		mac, err := s.allocateMAC(sandbox.ID, fmt.Sprintf("eth%d", i+1), AdditionalMACPrefix)
+		if err != nil {
+			return err
+		}
+		sandbox.Networks = append(sandbox.Networks, domain.AdditionalNetwork{
+			Name:     name,
+			IfName:   additionalIfName(i),
+			TapName:  additionalTapName(i),
+			GuestMAC: mac,
+		})
+		n := &sandbox.Networks[len(sandbox.Networks)-1]
+
+		result, err := s.cniConfig.AddNetworkList(ctx, list, additionalRuntimeConf(sandbox, *n))
+		if err != nil {
+			metrics.Global().RecordComponentEvent(metrics.ComponentCNI, metrics.EventFailure)
+			return fmt.Errorf("CNI AddNetworkList failed for network %s: %w", name, err)
+		}
+		result100, err := types100.NewResultFromResult(result)
+		if err != nil {
+			return fmt.Errorf("failed to parse CNI result of network %s: %w", name, err)
+		}
+		n.IPs = addressesFromResult(result100, s.config.IPFamily)
+		routes, _ := routesFromResult(result100)
+		n.Routes = withoutDefaultRoutes(routes)
+		if err := applyRoutes(sandbox.NetworkNamespace, n.IfName, n.Routes); err != nil {
+			s.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to apply routes in network namespace")
+		}
+
+		if !pluginTap {
+			if err := s.setupTAP(sandbox.NetworkNamespace, n.TapName, n.IfName, ""); err != nil {
+				return fmt.Errorf("network %s: %w", name, err)
+			}
+		}
+		s.log.WithFields(logrus.Fields{
+			"sandbox_id": sandbox.ID,
+			"network":    name,
+			"interface":  n.IfName,
+			"ips":        n.IPs,
+		}).Debug("Additional network set up")
+	}
+	return nil
+}
+
+// teardownAdditionalNetworks deletes a sandbox's additional networks, the
+// last added first. Failures are logged: the namespace is deleted anyway.
+func (s *CNIService) teardownAdditionalNetworks(ctx context.Context, sandbox *domain.Sandbox) {
+	for i := len(sandbox.Networks) - 1; i >= 0; i-- {
+		n := sandbox.Networks[i]
+		log := s.log.WithFields(logrus.Fields{"sandbox_id": sandbox.ID, "network": n.Name})
+		list, pluginTap, err := s.additionalNetwork(n.Name)
+		if err != nil {
+			log.WithError(err).Warn("Failed to load additional network for teardown")
+			continue
+		}
+		if !pluginTap {
+			if err := DeleteTAP(sandbox.NetworkNamespace, n.TapName); err != nil {
+				log.WithError(err).Warn("Failed to delete tap")
+			}
+		}
+		if err := s.cniConfig.DelNetworkList(ctx, list, additionalRuntimeConf(sandbox, n)); err != nil {
+			metrics.Global().RecordComponentEvent(metrics.ComponentCNI, metrics.EventFailure)
+			log.WithError(err).Warn("CNI DelNetworkList failed")
+		}
+	}
+}
+
+// withoutDefaultRoutes drops the default routes of an additional network,
+// which would compete with the primary network's.
+func withoutDefaultRoutes(routes []domain.Route) []domain.Route {
+	var kept []domain.Route
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
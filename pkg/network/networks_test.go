@@ -0,0 +1,92 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateNetworkName(t *testing.T) {
+	for _, name := range []string{"storage", "sriov-net.1", "Net_2"} {
+		if err := ValidateNetworkName(name); err != nil {
+			t.Errorf("ValidateNetworkName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "-net", "../net", "a b"} {
+		if err := ValidateNetworkName(name); err == nil {
+			t.Errorf("ValidateNetworkName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestAdditionalNetwork(t *testing.T) {
+	bridge := `{"type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.22.0.0/16"}}`
+	config := DefaultCNIServiceConfig()
+	config.ConfDir = t.TempDir()
+	config.PluginDir = t.TempDir()
+	config.NetworkName = "primary"
+	config.IPReuseCooldown = 0
+	files := map[string]string{
+		"10-primary.conflist": `{"cniVersion": "1.0.0", "name": "primary", "plugins": [` + bridge + `, {"type": "tc-redirect-tap"}]}`,
+		"20-storage.conflist": `{"cniVersion": "1.0.0", "name": "storage", "plugins": [` + bridge + `, {"type": "tc-redirect-tap"}]}`,
+		"30-stock.conflist":   `{"cniVersion": "1.0.0", "name": "stock", "plugins": [` + bridge + `]}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(config.ConfDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without the plugin installed, the service makes every tap
+	s, err := NewCNIService(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, pluginTap, err := s.additionalNetwork("storage")
+	if err != nil {
+		t.Fatalf("additionalNetwork(storage) error = %v", err)
+	}
+	if pluginTap || len(list.Plugins) != 1 {
+		t.Errorf("additionalNetwork(storage) = %d plugins, pluginTap %v; want the chain without %s", len(list.Plugins), pluginTap, tapPlugin)
+	}
+
+	// With it, it makes taps for chains that end in it
+	if err := os.WriteFile(filepath.Join(config.PluginDir, tapPlugin), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewCNIService(config, logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatal(err)
+	}
+	if list, pluginTap, err = s.additionalNetwork("storage"); err != nil || !pluginTap || len(list.Plugins) != 2 {
+		t.Errorf("additionalNetwork(storage) = %v, %v; want the plugin to make the tap", pluginTap, err)
+	}
+	if _, pluginTap, err = s.additionalNetwork("stock"); err != nil || pluginTap {
+		t.Errorf("additionalNetwork(stock) = %v, %v; want the service to make the tap", pluginTap, err)
+	}
+
+	for _, name := range []string{"primary", "missing", "../storage"} {
+		if _, _, err := s.additionalNetwork(name); err == nil {
+			t.Errorf("additionalNetwork(%q) succeeded", name)
+		}
+	}
+}
+
+func TestWithoutDefaultRoutes(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+	routes := []domain.Route{
+		{Dst: cidr("0.0.0.0/0"), GW: net.ParseIP("10.1.0.1")},
+		{Dst: cidr("10.2.0.0/16"), GW: net.ParseIP("10.1.0.1")},
+		{Dst: cidr("::/0"), GW: net.ParseIP("fd00::1")},
+	}
+	kept := withoutDefaultRoutes(routes)
+	if len(kept) != 1 || kept[0].Dst.String() != "10.2.0.0/16" {
+		t.Errorf("withoutDefaultRoutes() = %v, want [10.2.0.0/16 via 10.1.0.1]", kept)
+	}
+}
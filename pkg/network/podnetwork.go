@@ -0,0 +1,154 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// Pods may add static routes and DNS search domains to what CNI gives them,
+// within what the node's allow-list permits. The routes are installed in
+// the sandbox's network namespace and in the guest; the search domains are
+// only the guest's.
+
+// PodNetworkAllowList limits the routes and search domains pods may add.
+// The zero value allows none.
+type PodNetworkAllowList struct {
+	// Routes are the networks pod routes may lead into.
+	Routes []*net.IPNet
+
+	// DNSSearch are the domains pods may search, with their subdomains.
+	DNSSearch []string
+}
+
+// ParsePodNetworkAllowList parses allowed route destinations (CIDRs) and
+// search domains.
+func ParsePodNetworkAllowList(routes, search []string) (PodNetworkAllowList, error) {
+	var list PodNetworkAllowList
+	for _, cidr := range routes {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return list, fmt.Errorf("invalid allowed route %q", cidr)
+		}
+		list.Routes = append(list.Routes, network)
+	}
+	for _, name := range search {
+		name = normalizeDomain(name)
+		if err := ValidateSearchDomain(name); err != nil {
+			return list, err
+		}
+		list.DNSSearch = append(list.DNSSearch, name)
+	}
+	return list, nil
+}
+
+// CheckRoute fails unless the route's destination lies within an allowed
+// network.
+func (l PodNetworkAllowList) CheckRoute(route domain.Route) error {
+	ones, bits := route.Dst.Mask.Size()
+	for _, allowed := range l.Routes {
+		allowedOnes, allowedBits := allowed.Mask.Size()
+		if bits == allowedBits && ones >= allowedOnes && allowed.Contains(route.Dst.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("route to %s is not allowed on this node", route.Dst)
+}
+
+// CheckSearch fails unless the search domain is an allowed domain or one
+// of its subdomains.
+func (l PodNetworkAllowList) CheckSearch(name string) error {
+	name = normalizeDomain(name)
+	for _, allowed := range l.DNSSearch {
+		if name == allowed || strings.HasSuffix(name, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("search domain %s is not allowed on this node", name)
+}
+
+// ParseRoute parses a route written as "dst" or "dst via gw", the form
+// domain.Route formats itself in. A route without a gateway goes through
+// the sandbox's gateway of its family.
+func ParseRoute(s string) (domain.Route, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+		return domain.Route{}, fmt.Errorf("invalid route %q (want \"dst\" or \"dst via gw\")", s)
+	}
+	_, dst, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return domain.Route{}, fmt.Errorf("invalid route destination %q", fields[0])
+	}
+	route := domain.Route{Dst: dst}
+	if len(fields) == 3 {
+		if route.GW = net.ParseIP(fields[2]); route.GW == nil {
+			return domain.Route{}, fmt.Errorf("invalid route gateway %q", fields[2])
+		}
+		if (route.GW.To4() != nil) != (dst.IP.To4() != nil) {
+			return domain.Route{}, fmt.Errorf("route %s has a gateway of another IP family", s)
+		}
+	}
+	return route, nil
+}
+
+// ValidateSearchDomain checks a DNS search domain.
+func ValidateSearchDomain(name string) error {
+	name = normalizeDomain(name)
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid search domain %q", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid search domain %q", name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid search domain %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeDomain lowercases a domain name and drops its trailing dot.
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// podRoutes returns the routes a pod added, those without a gateway given
+// the default gateway of their family.
+func podRoutes(config *domain.CNIConfig, routes []domain.Route) []domain.Route {
+	if config == nil {
+		return nil
+	}
+	var added []domain.Route
+	for _, route := range config.Routes {
+		if route.GW == nil {
+			route.GW = familyGateway(routes, route.Dst.IP)
+		}
+		added = append(added, route)
+	}
+	return added
+}
+
+// searchDomains returns the search domains of a CNI result followed by
+// those a pod added, without duplicates.
+func searchDomains(result []string, config *domain.CNIConfig) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	all := result
+	if config != nil {
+		all = append(append([]string(nil), result...), config.DNSSearch...)
+	}
+	for _, name := range all {
+		name = normalizeDomain(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		domains = append(domains, name)
+	}
+	return domains
+}
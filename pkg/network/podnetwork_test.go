@@ -0,0 +1,108 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestPodNetworkAllowList(t *testing.T) {
+	allow, err := ParsePodNetworkAllowList([]string{"10.20.0.0/16", "fd00:c0::/32"}, []string{"Corp.Example.com."})
+	if err != nil {
+		t.Fatalf("ParsePodNetworkAllowList() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		route   string
+		allowed bool
+	}{
+		{"10.20.0.0/16", true},
+		{"10.20.5.0/24 via 10.88.0.254", true},
+		{"fd00:c0:1::/48", true},
+		{"10.0.0.0/8", false}, // Wider than allowed
+		{"10.21.0.0/24", false},
+		{"0.0.0.0/0 via 10.88.0.254", false},
+	} {
+		route, err := ParseRoute(tt.route)
+		if err != nil {
+			t.Fatalf("ParseRoute(%q) error = %v", tt.route, err)
+		}
+		if err := allow.CheckRoute(route); (err == nil) != tt.allowed {
+			t.Errorf("CheckRoute(%s) = %v, want allowed %v", tt.route, err, tt.allowed)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		allowed bool
+	}{
+		{"corp.example.com", true},
+		{"eu.corp.example.com.", true},
+		{"EU.Corp.Example.com", true},
+		{"evilcorp.example.com", false},
+		{"example.com", false},
+	} {
+		if err := allow.CheckSearch(tt.name); (err == nil) != tt.allowed {
+			t.Errorf("CheckSearch(%s) = %v, want allowed %v", tt.name, err, tt.allowed)
+		}
+	}
+
+	// The zero value allows nothing
+	route, _ := ParseRoute("10.20.0.0/16")
+	if (PodNetworkAllowList{}).CheckRoute(route) == nil || (PodNetworkAllowList{}).CheckSearch("corp.example.com") == nil {
+		t.Error("empty allow-list allowed a route or search domain")
+	}
+
+	if _, err := ParsePodNetworkAllowList([]string{"10.20.0.0"}, nil); err == nil {
+		t.Error("ParsePodNetworkAllowList() accepted an address without a prefix")
+	}
+	if _, err := ParsePodNetworkAllowList(nil, []string{"corp example.com"}); err == nil {
+		t.Error("ParsePodNetworkAllowList() accepted an invalid domain")
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, bad := range []string{"", "10.20.0.0", "10.20.0.0/16 10.88.0.1", "10.20.0.0/16 via", "10.20.0.0/16 via fd00::1", "10.20.0.0/16 via gw"} {
+		if _, err := ParseRoute(bad); err == nil {
+			t.Errorf("ParseRoute(%q) succeeded", bad)
+		}
+	}
+	route, err := ParseRoute("10.20.0.0/16 via 10.88.0.254")
+	if err != nil || route.String() != "10.20.0.0/16 via 10.88.0.254" {
+		t.Errorf("ParseRoute() = %v, %v", route, err)
+	}
+}
+
+func TestPodRoutesAndSearch(t *testing.T) {
+	_, defaultV4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultV6, _ := net.ParseCIDR("::/0")
+	routes := []domain.Route{
+		{Dst: defaultV4, GW: net.ParseIP("10.88.0.1")},
+		{Dst: defaultV6, GW: net.ParseIP("fd00:fc::1")},
+	}
+	viaGW, _ := ParseRoute("10.20.0.0/16 via 10.88.0.254")
+	v4, _ := ParseRoute("172.16.0.0/12")
+	v6, _ := ParseRoute("fd00:c0::/32")
+	config := &domain.CNIConfig{
+		Routes:    []domain.Route{viaGW, v4, v6},
+		DNSSearch: []string{"corp.example.com", "svc.cluster.local"},
+	}
+
+	added := podRoutes(config, routes)
+	if len(added) != 3 || !added[0].GW.Equal(net.ParseIP("10.88.0.254")) ||
+		!added[1].GW.Equal(net.ParseIP("10.88.0.1")) || !added[2].GW.Equal(net.ParseIP("fd00:fc::1")) {
+		t.Errorf("podRoutes() = %v", added)
+	}
+	if podRoutes(nil, routes) != nil {
+		t.Error("podRoutes() without a config returned routes")
+	}
+
+	// The network's search domains come first, without repeats
+	got := searchDomains([]string{"default.svc.cluster.local", "svc.cluster.local"}, config)
+	want := []string{"default.svc.cluster.local", "svc.cluster.local", "corp.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("searchDomains() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// routesFromResult returns every route of a CNI result and the gateway of
+// its default route. Routes without a gateway use the gateway of the
+// result's IP of the same family, as the CNI spec leaves them to the
+// plugin's default gateway.
+func routesFromResult(result *types100.Result) ([]domain.Route, net.IP) {
+	var routes []domain.Route
+	for _, r := range result.Routes {
+		dst := r.Dst
+		route := domain.Route{Dst: &dst, GW: r.GW}
+		if route.GW == nil {
+			route.GW = ipGateway(result.IPs, dst.IP)
+		}
+		routes = append(routes, route)
+	}
+	return routes, defaultGateway(routes)
+}
+
+// nameserversFromResult returns the nameservers of a CNI result, skipping
+// any that aren't IP addresses.
+func nameserversFromResult(result *types100.Result) []net.IP {
+	var servers []net.IP
+	for _, server := range result.DNS.Nameservers {
+		if ip := net.ParseIP(server); ip != nil {
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+// The IP families a cluster's pods may have addresses in.
+const (
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+	IPFamilyDual = "dual"
+)
+
+// ValidateIPFamily checks a cluster IP family. Empty is IPv4.
+func ValidateIPFamily(family string) error {
+	switch family {
+	case "", IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual:
+		return nil
+	}
+	return fmt.Errorf("invalid IP family %q (must be ipv4, ipv6 or dual)", family)
+}
+
+// addressesFromResult returns every address of a CNI result, the primary
+// one first: the first IPv6 address if family is IPFamilyIPv6, the first
+// IPv4 address otherwise. Addresses of one family keep their order.
+func addressesFromResult(result *types100.Result, family string) []*net.IPNet {
+	preferV6 := family == IPFamilyIPv6
+	var preferred, others []*net.IPNet
+	for _, config := range result.IPs {
+		address := config.Address
+		if (address.IP.To4() == nil) == preferV6 {
+			preferred = append(preferred, &address)
+		} else {
+			others = append(others, &address)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// familyGateway returns the gateway of the default route in the family of
+// ip, or nil if there is none.
+func familyGateway(routes []domain.Route, ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	v4 := ip.To4() != nil
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 && r.GW != nil && (r.Dst.IP.To4() != nil) == v4 {
+			return r.GW
+		}
+	}
+	return nil
+}
+
+// defaultGateway returns the gateway of the default route, or else the
+// first gateway of any route.
+func defaultGateway(routes []domain.Route) net.IP {
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 && r.GW != nil {
+			return r.GW
+		}
+	}
+	for _, r := range routes {
+		if r.GW != nil {
+			return r.GW
+		}
+	}
+	return nil
+}
+
+// ipGateway returns the gateway of the first IP in the same family as ip.
+func ipGateway(ips []*types100.IPConfig, ip net.IP) net.IP {
+	v4 := ip.To4() != nil
+	for _, config := range ips {
+		if config.Gateway != nil && (config.Address.IP.To4() != nil) == v4 {
+			return config.Gateway
+		}
+	}
+	return nil
+}
+
+// routeArgs returns the "ip route replace" arguments installing a route on
+// dev.
+func routeArgs(route domain.Route, dev string) []string {
+	args := []string{"route", "replace", route.Dst.String()}
+	if route.GW != nil {
+		args = append(args, "via", route.GW.String())
+	}
+	return append(args, "dev", dev)
+}
+
+// applyRoutes installs routes on an interface of a network namespace. CNI
+// plugins usually install the routes of their IPAM result themselves, but
+// not all do; replacing them is harmless either way.
+func applyRoutes(netnsPath, ifName string, routes []domain.Route) error {
+	var failed []string
+	for _, route := range routes {
+		args := append([]string{"--net=" + netnsPath, "ip"}, routeArgs(route, ifName)...)
+		if output, err := exec.Command("nsenter", args...).CombinedOutput(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", route, strings.TrimSpace(string(output))))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to add routes: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestRoutesFromResult(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+
+	result := &types100.Result{
+		IPs: []*types100.IPConfig{
+			{Address: cidr("10.88.0.5/16"), Gateway: net.ParseIP("10.88.0.1")},
+		},
+		Routes: []*types.Route{
+			{Dst: cidr("10.96.0.0/12"), GW: net.ParseIP("10.88.0.254")},
+			{Dst: cidr("169.254.20.10/32")},
+			{Dst: cidr("0.0.0.0/0")},
+		},
+	}
+
+	routes, gateway := routesFromResult(result)
+
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"10.96.0.0/12 via 10.88.0.254",
+		"169.254.20.10/32 via 10.88.0.1",
+		"0.0.0.0/0 via 10.88.0.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %v, want %v", got, want)
+	}
+	if !gateway.Equal(net.ParseIP("10.88.0.1")) {
+		t.Errorf("gateway = %s, want the default route's 10.88.0.1", gateway)
+	}
+
+	args := routeArgs(routes[0], "eth0")
+	wantArgs := []string{"route", "replace", "10.96.0.0/12", "via", "10.88.0.254", "dev", "eth0"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("routeArgs = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestNameserversFromResult(t *testing.T) {
+	result := &types100.Result{
+		DNS: types.DNS{Nameservers: []string{"10.96.0.10", "not-an-ip", "fd00::a"}},
+	}
+	got := nameserversFromResult(result)
+	if len(got) != 2 || got[0].String() != "10.96.0.10" || got[1].String() != "fd00::a" {
+		t.Errorf("nameserversFromResult() = %v, want the two IP addresses", got)
+	}
+}
+
+func TestAddressesFromResult(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return *n
+	}
+	result := &types100.Result{
+		IPs: []*types100.IPConfig{
+			{Address: cidr("fd00:fc::5/64")},
+			{Address: cidr("10.88.0.5/16")},
+		},
+	}
+
+	for _, tt := range []struct {
+		family string
+		want   []string
+	}{
+		{IPFamilyIPv4, []string{"10.88.0.5/16", "fd00:fc::5/64"}},
+		{IPFamilyDual, []string{"10.88.0.5/16", "fd00:fc::5/64"}},
+		{IPFamilyIPv6, []string{"fd00:fc::5/64", "10.88.0.5/16"}},
+	} {
+		var got []string
+		for _, address := range addressesFromResult(result, tt.family) {
+			got = append(got, address.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("addressesFromResult(%s) = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestFamilyGateway(t *testing.T) {
+	_, v4Default, _ := net.ParseCIDR("0.0.0.0/0")
+	_, v6Default, _ := net.ParseCIDR("::/0")
+	routes := []domain.Route{
+		{Dst: v4Default, GW: net.ParseIP("10.88.0.1")},
+		{Dst: v6Default, GW: net.ParseIP("fd00:fc::1")},
+	}
+	if got := familyGateway(routes, net.ParseIP("fd00:fc::5")); !got.Equal(net.ParseIP("fd00:fc::1")) {
+		t.Errorf("familyGateway(IPv6) = %v, want fd00:fc::1", got)
+	}
+	if got := familyGateway(routes, net.ParseIP("10.88.0.5")); !got.Equal(net.ParseIP("10.88.0.1")) {
+		t.Errorf("familyGateway(IPv4) = %v, want 10.88.0.1", got)
+	}
+	if got := familyGateway(routes[:1], net.ParseIP("fd00:fc::5")); got != nil {
+		t.Errorf("familyGateway() without an IPv6 default route = %v, want nil", got)
+	}
+}
@@ -0,0 +1,317 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Service routing modes.
+const (
+	// ServiceRoutingNone leaves ClusterIPs to kube-proxy.
+	ServiceRoutingNone = "none"
+
+	// ServiceRoutingStatic programs the services listed in a file.
+	ServiceRoutingStatic = "static"
+)
+
+// ServiceRoutingConfig configures host-side service routing, for nodes
+// without kube-proxy. Each sandbox gets its own nftables table that DNATs
+// its traffic to ClusterIPs to the services' endpoints.
+type ServiceRoutingConfig struct {
+	// Mode is ServiceRoutingNone or ServiceRoutingStatic.
+	Mode string
+
+	// ServicesFile lists the services and their endpoints as JSON (see
+	// ServiceList). It is re-read when it changes, so an EndpointSlice
+	// watcher on the node can keep it current.
+	ServicesFile string
+
+	// ResyncInterval is how often the file is checked for changes.
+	ResyncInterval time.Duration
+
+	// NftPath is the nft binary rules are applied with.
+	NftPath string
+}
+
+// DefaultServiceRoutingConfig returns the default service routing
+// configuration, which leaves services to kube-proxy.
+func DefaultServiceRoutingConfig() ServiceRoutingConfig {
+	return ServiceRoutingConfig{
+		Mode:           ServiceRoutingNone,
+		ServicesFile:   "/etc/fc-cri/services.json",
+		ResyncInterval: 5 * time.Second,
+		NftPath:        "nft",
+	}
+}
+
+// ServiceList is the format of the services file.
+type ServiceList struct {
+	Services []Service `json:"services"`
+}
+
+// Service is a ClusterIP service and the endpoints it balances over.
+type Service struct {
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	ClusterIP net.IP        `json:"cluster_ip"`
+	Ports     []ServicePort `json:"ports"`
+
+	// Endpoints are the addresses of the service's ready endpoints.
+	Endpoints []net.IP `json:"endpoints"`
+}
+
+// ServicePort maps a port of a service's ClusterIP to its endpoints.
+type ServicePort struct {
+	Name string `json:"name,omitempty"`
+
+	// Protocol is TCP, UDP or SCTP; empty means TCP.
+	Protocol string `json:"protocol,omitempty"`
+
+	Port int `json:"port"`
+
+	// TargetPort is the endpoints' port; zero means Port.
+	TargetPort int `json:"target_port,omitempty"`
+}
+
+// ServiceRouter keeps one sandbox's service DNAT rules in sync with the
+// services file until stopped.
+type ServiceRouter struct {
+	config    ServiceRoutingConfig
+	table     string
+	sandboxIP net.IP
+	log       *logrus.Entry
+
+	// apply loads an nft ruleset; replaced in tests.
+	apply func(ruleset string) error
+
+	version string // modification time and size of the file last applied
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartServiceRouter programs the service rules for the sandbox with the
+// given IP and keeps them current. The services are loaded before it
+// returns, so a broken file fails the sandbox up front.
+func StartServiceRouter(config ServiceRoutingConfig, sandboxID string, sandboxIP net.IP, log *logrus.Entry) (*ServiceRouter, error) {
+	if config.Mode != ServiceRoutingStatic {
+		return nil, fmt.Errorf("unsupported service routing mode %q", config.Mode)
+	}
+	if sandboxIP.To4() == nil {
+		return nil, fmt.Errorf("service routing needs the sandbox's IPv4 address")
+	}
+
+	r := &ServiceRouter{
+		config:    config,
+		table:     serviceTableName(sandboxID),
+		sandboxIP: sandboxIP,
+		log:       log.WithField("component", "service-router"),
+		stop:      make(chan struct{}),
+	}
+	r.apply = r.nft
+	if err := r.sync(); err != nil {
+		return nil, err
+	}
+
+	if config.ResyncInterval > 0 {
+		r.wg.Add(1)
+		go r.run()
+	}
+	return r, nil
+}
+
+// Stop stops following the services file and removes the sandbox's rules.
+func (r *ServiceRouter) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+
+	if err := r.apply(fmt.Sprintf("table ip %s\ndelete table ip %s\n", r.table, r.table)); err != nil {
+		r.log.WithError(err).Warn("Failed to remove service rules")
+	}
+}
+
+func (r *ServiceRouter) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.ResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.sync(); err != nil {
+				r.log.WithError(err).Warn("Failed to sync service rules")
+			}
+		}
+	}
+}
+
+// sync reprograms the rules if the services file changed since they were
+// last applied.
+func (r *ServiceRouter) sync() error {
+	info, err := os.Stat(r.config.ServicesFile)
+	if err != nil {
+		return fmt.Errorf("failed to read services: %w", err)
+	}
+	version := fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	if version == r.version {
+		return nil
+	}
+
+	services, err := loadServices(r.config.ServicesFile)
+	if err != nil {
+		return err
+	}
+	if err := r.apply(serviceRuleset(r.table, r.sandboxIP, services)); err != nil {
+		return fmt.Errorf("failed to apply service rules: %w", err)
+	}
+	r.version = version
+
+	r.log.WithFields(logrus.Fields{
+		"table":    r.table,
+		"services": len(services),
+	}).Debug("Service rules applied")
+	return nil
+}
+
+// nft loads a ruleset with nft, as one transaction.
+func (r *ServiceRouter) nft(ruleset string) error {
+	return runNft(r.config.NftPath, ruleset)
+}
+
+// runNft loads a ruleset with the nft binary at path, as one transaction.
+func runNft(path, ruleset string) error {
+	cmd := exec.Command(path, "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// loadServices reads and checks a services file.
+func loadServices(path string) ([]Service, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read services: %w", err)
+	}
+	var list ServiceList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid services file %s: %w", path, err)
+	}
+
+	for _, svc := range list.Services {
+		name := svc.Namespace + "/" + svc.Name
+		if svc.ClusterIP == nil {
+			return nil, fmt.Errorf("service %s has no cluster_ip", name)
+		}
+		for _, port := range svc.Ports {
+			if port.Port < 1 || port.Port > 65535 || port.TargetPort < 0 || port.TargetPort > 65535 {
+				return nil, fmt.Errorf("service %s has an invalid port %d:%d", name, port.Port, port.TargetPort)
+			}
+			if _, err := serviceProtocol(port.Protocol); err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+		}
+	}
+	return list.Services, nil
+}
+
+// serviceProtocol returns the nft name of a service port's protocol.
+func serviceProtocol(protocol string) (string, error) {
+	switch strings.ToLower(protocol) {
+	case "", "tcp":
+		return "tcp", nil
+	case "udp":
+		return "udp", nil
+	case "sctp":
+		return "sctp", nil
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", protocol)
+	}
+}
+
+// serviceTableName returns the nftables table of a sandbox. Sandbox IDs
+// can be long, so the name is derived from a hash of it.
+func serviceTableName(sandboxID string) string {
+	sum := sha256.Sum256([]byte(sandboxID))
+	return "fc_svc_" + hex.EncodeToString(sum[:])[:12]
+}
+
+// serviceRuleset renders the nftables table routing a sandbox's traffic to
+// the services. It replaces any previous version of the table atomically.
+// Connections to a ClusterIP port are DNATed to one of the service's
+// endpoints at random; ports of services without IPv4 endpoints are left
+// alone. Connections a sandbox makes to itself through a service are
+// masqueraded, so the replies come back through the host.
+func serviceRuleset(table string, sandboxIP net.IP, services []Service) string {
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed when it doesn't
+	// exist yet
+	fmt.Fprintf(&b, "table ip %s\ndelete table ip %s\n", table, table)
+	fmt.Fprintf(&b, "table ip %s {\n", table)
+
+	var rules []string
+	var chains strings.Builder
+	for i, svc := range services {
+		clusterIP := svc.ClusterIP.To4()
+		var endpoints []net.IP
+		for _, ep := range svc.Endpoints {
+			if ep.To4() != nil {
+				endpoints = append(endpoints, ep.To4())
+			}
+		}
+		if clusterIP == nil || len(endpoints) == 0 {
+			continue
+		}
+
+		for j, port := range svc.Ports {
+			proto, err := serviceProtocol(port.Protocol)
+			if err != nil {
+				continue
+			}
+			target := port.TargetPort
+			if target == 0 {
+				target = port.Port
+			}
+
+			chain := fmt.Sprintf("svc_%d_%d", i, j)
+			rules = append(rules, fmt.Sprintf("ip daddr %s %s dport %d jump %s", clusterIP, proto, port.Port, chain))
+
+			if len(endpoints) == 1 {
+				fmt.Fprintf(&chains, "\tchain %s {\n\t\tdnat to %s:%d\n\t}\n", chain, endpoints[0], target)
+				continue
+			}
+			verdicts := make([]string, len(endpoints))
+			for k, ep := range endpoints {
+				verdicts[k] = fmt.Sprintf("%d : goto %s_%d", k, chain, k)
+				fmt.Fprintf(&chains, "\tchain %s_%d {\n\t\tdnat to %s:%d\n\t}\n", chain, k, ep, target)
+			}
+			fmt.Fprintf(&chains, "\tchain %s {\n\t\tnumgen random mod %d vmap { %s }\n\t}\n", chain, len(endpoints), strings.Join(verdicts, ", "))
+		}
+	}
+
+	ip := sandboxIP.To4()
+	fmt.Fprintf(&b, "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n\t\tip saddr %s jump services\n\t}\n", ip)
+	fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n\t\tip saddr %s ip daddr %s ct status dnat masquerade\n\t}\n", ip, ip)
+	b.WriteString("\tchain services {\n")
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "\t\t%s\n", rule)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString(chains.String())
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testServices = `{
+  "services": [
+    {
+      "namespace": "kube-system",
+      "name": "kube-dns",
+      "cluster_ip": "10.96.0.10",
+      "ports": [
+        {"name": "dns", "protocol": "UDP", "port": 53},
+        {"name": "metrics", "protocol": "TCP", "port": 9153}
+      ],
+      "endpoints": ["10.88.0.7", "10.88.0.8"]
+    },
+    {
+      "namespace": "default",
+      "name": "kubernetes",
+      "cluster_ip": "10.96.0.1",
+      "ports": [{"name": "https", "port": 443, "target_port": 6443}],
+      "endpoints": ["192.168.1.10"]
+    },
+    {
+      "namespace": "default",
+      "name": "idle",
+      "cluster_ip": "10.96.0.99",
+      "ports": [{"port": 80}],
+      "endpoints": []
+    }
+  ]
+}`
+
+func TestServiceRuleset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	if err := os.WriteFile(path, []byte(testServices), 0644); err != nil {
+		t.Fatal(err)
+	}
+	services, err := loadServices(path)
+	if err != nil {
+		t.Fatalf("loadServices() error = %v", err)
+	}
+
+	ruleset := serviceRuleset("fc_svc_test", net.ParseIP("10.88.0.5"), services)
+	for _, want := range []string{
+		"table ip fc_svc_test\ndelete table ip fc_svc_test\n",
+		"ip saddr 10.88.0.5 jump services",
+		"ip saddr 10.88.0.5 ip daddr 10.88.0.5 ct status dnat masquerade",
+		"ip daddr 10.96.0.10 udp dport 53 jump svc_0_0",
+		"ip daddr 10.96.0.10 tcp dport 9153 jump svc_0_1",
+		"numgen random mod 2 vmap { 0 : goto svc_0_0_0, 1 : goto svc_0_0_1 }",
+		"chain svc_0_0_1 {\n\t\tdnat to 10.88.0.8:53\n",
+		"ip daddr 10.96.0.1 tcp dport 443 jump svc_1_0",
+		"chain svc_1_0 {\n\t\tdnat to 192.168.1.10:6443\n",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+	if strings.Contains(ruleset, "10.96.0.99") {
+		t.Errorf("ruleset routes a service without endpoints:\n%s", ruleset)
+	}
+}
+
+func TestLoadServicesInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"no cluster IP": `{"services": [{"name": "a", "ports": [{"port": 80}]}]}`,
+		"bad port":      `{"services": [{"name": "a", "cluster_ip": "10.96.0.2", "ports": [{"port": 0}]}]}`,
+		"bad protocol":  `{"services": [{"name": "a", "cluster_ip": "10.96.0.2", "ports": [{"port": 80, "protocol": "ICMP"}]}]}`,
+		"not JSON":      `services: []`,
+	} {
+		path := filepath.Join(t.TempDir(), "services.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadServices(path); err == nil {
+			t.Errorf("%s: loadServices() succeeded, want error", name)
+		}
+	}
+}
+
+func TestServiceRouterSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	if err := os.WriteFile(path, []byte(testServices), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied []string
+	r := &ServiceRouter{
+		config:    ServiceRoutingConfig{Mode: ServiceRoutingStatic, ServicesFile: path},
+		table:     serviceTableName("sandbox-1"),
+		sandboxIP: net.ParseIP("10.88.0.5"),
+		log:       logrus.NewEntry(logrus.New()),
+		stop:      make(chan struct{}),
+		apply: func(ruleset string) error {
+			applied = append(applied, ruleset)
+			return nil
+		},
+	}
+
+	if err := r.sync(); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if err := r.sync(); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if len(applied) != 1 {
+		t.Fatalf("applied %d rulesets for an unchanged file, want 1", len(applied))
+	}
+
+	// A changed file is applied again
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte(`{"services": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.sync(); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if len(applied) != 2 || strings.Contains(applied[1], "10.96.0.10") {
+		t.Errorf("changed services were not applied: %v", applied)
+	}
+
+	r.Stop()
+	if last := applied[len(applied)-1]; !strings.HasSuffix(last, "delete table ip "+r.table+"\n") {
+		t.Errorf("Stop() applied %q, want the table deleted", last)
+	}
+}
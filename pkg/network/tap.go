@@ -0,0 +1,307 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// How a sandbox's tap reaches the interface CNI configured in its network
+// namespace.
+const (
+	// TAPModePlugin leaves the tap to the tc-redirect-tap CNI plugin,
+	// which must be the last plugin of the network's chain.
+	TAPModePlugin = "plugin"
+
+	// TAPModeRedirect creates the tap and redirects traffic between it and
+	// the CNI interface with tc, as tc-redirect-tap does.
+	TAPModeRedirect = "redirect"
+
+	// TAPModeBridge creates the tap and attaches it to a bridge in the
+	// sandbox's network namespace, which the CNI chain must create.
+	TAPModeBridge = "bridge"
+)
+
+// ValidateTAPMode checks a TAP mode.
+func ValidateTAPMode(mode string) error {
+	switch mode {
+	case TAPModePlugin, TAPModeRedirect, TAPModeBridge:
+		return nil
+	}
+	return fmt.Errorf("invalid tap mode %q (must be %s, %s or %s)", mode, TAPModePlugin, TAPModeRedirect, TAPModeBridge)
+}
+
+// TAPConfig holds configuration for creating a TAP device.
+type TAPConfig struct {
+	Name string
+
+	// NetNS is the path of the network namespace to create the tap in.
+	// Empty creates it in the current one.
+	NetNS string
+
+	// MTU of the tap; 0 keeps the kernel's default.
+	MTU int
+
+	// Queues above 1 create a multiqueue tap, which the VMM must open with
+	// IFF_MULTI_QUEUE.
+	Queues int
+
+	// OwnerID and GroupID may open the tap without CAP_NET_ADMIN. Jailed
+	// VMs need them set to the jailer's UID and GID.
+	OwnerID int
+	GroupID int
+}
+
+// CreateTAP creates a TAP device for Firecracker to use.
+// The TAP device bridges the VM's virtio-net to the host network.
+func CreateTAP(config TAPConfig) error {
+	flags := netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR
+	if config.Queues > 1 {
+		flags |= netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+	}
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: config.Name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     flags,
+		Queues:    max(config.Queues, 1),
+		Owner:     uint32(config.OwnerID),
+		Group:     uint32(config.GroupID),
+	}
+
+	// The tap is created through /dev/net/tun, which creates it in the
+	// namespace of the calling thread
+	return inNetNS(config.NetNS, func() error {
+		if err := netlink.LinkAdd(tap); err != nil {
+			return fmt.Errorf("failed to create tap %s: %w", config.Name, err)
+		}
+		// The link is persistent; the queues were only needed to set it up
+		for _, fd := range tap.Fds {
+			fd.Close()
+		}
+		if config.MTU > 0 {
+			if err := netlink.LinkSetMTU(tap, config.MTU); err != nil {
+				_ = netlink.LinkDel(tap)
+				return fmt.Errorf("failed to set MTU of tap %s: %w", config.Name, err)
+			}
+		}
+		if err := netlink.LinkSetUp(tap); err != nil {
+			_ = netlink.LinkDel(tap)
+			return fmt.Errorf("failed to bring up tap %s: %w", config.Name, err)
+		}
+		return nil
+	})
+}
+
+// DeleteTAP removes a TAP device. A missing one is not an error.
+func DeleteTAP(netnsPath, name string) error {
+	return inNetNS(netnsPath, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		return netlink.LinkDel(link)
+	})
+}
+
+// TAPTraffic returns the bytes the guest behind a tap received and sent.
+// The tap counts the other way round: what it transmits, the guest
+// receives.
+func TAPTraffic(netnsPath, name string) (received, sent uint64, err error) {
+	err = inNetNS(netnsPath, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		if stats := link.Attrs().Statistics; stats != nil {
+			received, sent = stats.TxBytes, stats.RxBytes
+		}
+		return nil
+	})
+	return received, sent, err
+}
+
+// AttachTAPToBridge attaches a TAP device to a bridge in the same network
+// namespace.
+func AttachTAPToBridge(netnsPath, tapName, bridgeName string) error {
+	return inNetNS(netnsPath, func() error {
+		tap, err := netlink.LinkByName(tapName)
+		if err != nil {
+			return fmt.Errorf("failed to find tap %s: %w", tapName, err)
+		}
+		bridge, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			return fmt.Errorf("failed to find bridge %s: %w", bridgeName, err)
+		}
+		if _, ok := bridge.(*netlink.Bridge); !ok {
+			return fmt.Errorf("%s is a %s, not a bridge", bridgeName, bridge.Type())
+		}
+		return netlink.LinkSetMaster(tap, bridge)
+	})
+}
+
+// RedirectTAP sends every frame arriving on the tap out of ifName, and
+// every frame arriving on ifName out of the tap, with tc ingress filters.
+func RedirectTAP(netnsPath, tapName, ifName string) error {
+	return inNetNS(netnsPath, func() error {
+		tap, err := netlink.LinkByName(tapName)
+		if err != nil {
+			return fmt.Errorf("failed to find tap %s: %w", tapName, err)
+		}
+		iface, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %w", ifName, err)
+		}
+		if err := redirect(tap, iface); err != nil {
+			return err
+		}
+		return redirect(iface, tap)
+	})
+}
+
+// redirect adds an ingress filter to src redirecting everything to dst.
+func redirect(src, dst netlink.Link) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: src.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscReplace(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc to %s: %w", src.Attrs().Name, err)
+	}
+
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: src.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				ActionAttrs:  netlink.ActionAttrs{Action: netlink.TC_ACT_STOLEN},
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      dst.Attrs().Index,
+			},
+		},
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("failed to redirect %s to %s: %w", src.Attrs().Name, dst.Attrs().Name, err)
+	}
+	return nil
+}
+
+// linkMTU returns the MTU of an interface.
+func linkMTU(netnsPath, name string) (int, error) {
+	var mtu int
+	err := inNetNS(netnsPath, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		mtu = link.Attrs().MTU
+		return nil
+	})
+	return mtu, err
+}
+
+// inNetNS runs fn on a thread in the network namespace at path, or in the
+// current one if path is empty.
+func inNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %w", path, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %w", path, err)
+	}
+	defer func() {
+		// A thread stuck in the wrong namespace is left locked, so it
+		// exits with the goroutine rather than running anything else
+		if netns.Set(origin) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
+
+// tapPlugin is the CNI plugin that makes taps in TAPModePlugin.
+const tapPlugin = "tc-redirect-tap"
+
+// tapPluginInstalled reports whether the tc-redirect-tap plugin is in
+// pluginDir.
+func tapPluginInstalled(pluginDir string) bool {
+	_, err := invoke.FindInPath(tapPlugin, []string{pluginDir})
+	return err == nil
+}
+
+// resolvePluginMode falls back to redirecting the tap in-process when the
+// network can't rely on tc-redirect-tap: stock bridge or ptp chains don't
+// include it, and a chain that does fails on a node without the binary,
+// so it is dropped from the chain.
+func (s *CNIService) resolvePluginMode() error {
+	last := len(s.netConfig.Plugins) - 1
+	hasPlugin := last >= 0 && s.netConfig.Plugins[last].Network.Type == tapPlugin
+	log := s.log.WithFields(logrus.Fields{
+		"network":  s.netConfig.Name,
+		"tap_mode": TAPModeRedirect,
+	})
+
+	switch {
+	case hasPlugin && tapPluginInstalled(s.config.PluginDir):
+		return nil
+	case hasPlugin:
+		list, err := withoutLastPlugin(s.netConfig)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s from network %s: %w", tapPlugin, s.netConfig.Name, err)
+		}
+		s.netConfig = list
+		log.WithField("plugin_dir", s.config.PluginDir).Warn("tc-redirect-tap plugin not installed, redirecting taps in-process")
+	default:
+		log.Info("Network chain has no tc-redirect-tap plugin, redirecting taps in-process")
+	}
+	s.tapMode = TAPModeRedirect
+	return nil
+}
+
+// withoutLastPlugin returns a network config list without its last plugin.
+func withoutLastPlugin(list *libcni.NetworkConfigList) (*libcni.NetworkConfigList, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(list.Bytes, &raw); err != nil {
+		return nil, err
+	}
+	plugins, ok := raw["plugins"].([]interface{})
+	if !ok || len(plugins) == 0 {
+		return nil, fmt.Errorf("network has no plugins")
+	}
+	raw["plugins"] = plugins[:len(plugins)-1]
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	return libcni.ConfListFromBytes(data)
+}
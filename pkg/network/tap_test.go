@@ -0,0 +1,170 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// testNetNS creates a network namespace for a test, skipping the test if
+// it can't.
+func testNetNS(t *testing.T) string {
+	t.Helper()
+	name := fmt.Sprintf("fc-cri-test-%d", os.Getpid())
+	if output, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("can't create a network namespace: %v: %s", err, output)
+	}
+	t.Cleanup(func() { _ = exec.Command("ip", "netns", "delete", name).Run() })
+	return filepath.Join("/var/run/netns", name)
+}
+
+func TestValidateTAPMode(t *testing.T) {
+	for _, mode := range []string{TAPModePlugin, TAPModeRedirect, TAPModeBridge} {
+		if err := ValidateTAPMode(mode); err != nil {
+			t.Errorf("ValidateTAPMode(%q) = %v", mode, err)
+		}
+	}
+	if err := ValidateTAPMode("macvtap"); err == nil {
+		t.Error("ValidateTAPMode accepted an unknown mode")
+	}
+}
+
+func TestCreateTAP(t *testing.T) {
+	ns := testNetNS(t)
+
+	// Stand-ins for the interface and bridge a CNI chain would create
+	err := inNetNS(ns, func() error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 1450}, PeerName: "peer0"}); err != nil {
+			return err
+		}
+		return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtu, err := linkMTU(ns, "eth0")
+	if err != nil || mtu != 1450 {
+		t.Fatalf("linkMTU() = %d, %v", mtu, err)
+	}
+	if err := CreateTAP(TAPConfig{Name: TapName, NetNS: ns, MTU: mtu, OwnerID: 1000, GroupID: 1001}); err != nil {
+		t.Fatalf("CreateTAP() failed: %v", err)
+	}
+	if err := RedirectTAP(ns, TapName, "eth0"); err != nil {
+		t.Fatalf("RedirectTAP() failed: %v", err)
+	}
+	if err := AttachTAPToBridge(ns, TapName, "eth0"); err == nil {
+		t.Error("AttachTAPToBridge() attached to an interface that isn't a bridge")
+	}
+	if err := AttachTAPToBridge(ns, TapName, "br0"); err != nil {
+		t.Fatalf("AttachTAPToBridge() failed: %v", err)
+	}
+
+	err = inNetNS(ns, func() error {
+		link, err := netlink.LinkByName(TapName)
+		if err != nil {
+			return err
+		}
+		tap, ok := link.(*netlink.Tuntap)
+		if !ok || tap.Mode != netlink.TUNTAP_MODE_TAP {
+			t.Errorf("%s is a %s, not a tap", TapName, link.Type())
+		} else if tap.Owner != 1000 || tap.Group != 1001 {
+			t.Errorf("tap owned by %d:%d, want 1000:1001", tap.Owner, tap.Group)
+		}
+		if link.Attrs().MTU != 1450 {
+			t.Errorf("tap MTU = %d, want 1450", link.Attrs().MTU)
+		}
+		if link.Attrs().MasterIndex == 0 {
+			t.Error("tap not attached to the bridge")
+		}
+		for _, name := range []string{TapName, "eth0"} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+			if err != nil {
+				return err
+			}
+			if len(filters) == 0 {
+				t.Errorf("no redirect filter on %s", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteTAP(ns, TapName); err != nil {
+		t.Fatalf("DeleteTAP() failed: %v", err)
+	}
+	if _, err := linkMTU(ns, TapName); err == nil {
+		t.Error("tap still exists after DeleteTAP()")
+	}
+	// Deleting it again is fine
+	if err := DeleteTAP(ns, TapName); err != nil {
+		t.Errorf("DeleteTAP() of a missing tap = %v", err)
+	}
+}
+
+func TestNewCNIService_TAPPluginFallback(t *testing.T) {
+	bridge := `{"type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.22.0.0/16"}}`
+	tests := []struct {
+		name      string
+		conflist  string // Empty uses the default network
+		installed bool
+		wantMode  string
+		wantTypes []string
+	}{
+		{"plugin installed", `[` + bridge + `, {"type": "tc-redirect-tap"}]`, true, TAPModePlugin, []string{"bridge", "tc-redirect-tap"}},
+		{"plugin missing", `[` + bridge + `, {"type": "tc-redirect-tap"}]`, false, TAPModeRedirect, []string{"bridge"}},
+		{"stock chain", `[` + bridge + `]`, true, TAPModeRedirect, []string{"bridge"}},
+		{"default network without plugin", "", false, TAPModeRedirect, []string{"bridge", "portmap"}},
+		{"default network with plugin", "", true, TAPModePlugin, []string{"bridge", "portmap", "tc-redirect-tap"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultCNIServiceConfig()
+			config.ConfDir = t.TempDir()
+			config.PluginDir = t.TempDir()
+			config.IPReuseCooldown = 0
+			if tt.conflist != "" {
+				data := `{"cniVersion": "1.0.0", "name": "test-net", "plugins": ` + tt.conflist + `}`
+				if err := os.WriteFile(filepath.Join(config.ConfDir, "10-test.conflist"), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.installed {
+				if err := os.WriteFile(filepath.Join(config.PluginDir, tapPlugin), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := NewCNIService(config, logrus.NewEntry(logrus.New()))
+			if err != nil {
+				t.Fatalf("NewCNIService() failed: %v", err)
+			}
+			if s.tapMode != tt.wantMode {
+				t.Errorf("tap mode = %s, want %s", s.tapMode, tt.wantMode)
+			}
+			var types []string
+			for _, plugin := range s.netConfig.Plugins {
+				types = append(types, plugin.Network.Type)
+			}
+			if strings.Join(types, ",") != strings.Join(tt.wantTypes, ",") {
+				t.Errorf("chain = %v, want %v", types, tt.wantTypes)
+			}
+			// libcni caches the bytes, not the parsed chain
+			if tt.wantMode == TAPModeRedirect && strings.Contains(string(s.netConfig.Bytes), tapPlugin) {
+				t.Errorf("config bytes still name %s: %s", tapPlugin, s.netConfig.Bytes)
+			}
+		})
+	}
+}
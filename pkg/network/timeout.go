@@ -0,0 +1,108 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// DefaultPluginTimeout bounds each CNI plugin invocation. Plugins normally
+// finish in well under a second; one that takes this long is hung, on an
+// unresponsive IPAM daemon or a stuck netlink call.
+const DefaultPluginTimeout = 30 * time.Second
+
+// PluginTimeoutError is a CNI plugin that didn't finish within the plugin
+// timeout. It was killed, and whatever it had set up is left to a DEL. The
+// failure is retryable: the same setup may succeed once the plugin, or
+// whatever it waits on, recovers.
+type PluginTimeoutError struct {
+	Plugin  string // Plugin binary, e.g. "bridge"
+	Command string // CNI command, e.g. "ADD"
+	Timeout time.Duration
+}
+
+func (e *PluginTimeoutError) Error() string {
+	return fmt.Sprintf("CNI plugin %s timed out after %s on %s", e.Plugin, e.Timeout, e.Command)
+}
+
+// Temporary reports that the failure may not happen again.
+func (e *PluginTimeoutError) Temporary() bool {
+	return true
+}
+
+// IsPluginTimeout reports whether err is, or wraps, a CNI plugin timeout.
+func IsPluginTimeout(err error) bool {
+	var timeout *PluginTimeoutError
+	return errors.As(err, &timeout)
+}
+
+// timeoutExec runs CNI plugins, each with a deadline of its own, so one
+// hung plugin can't block a sandbox's network setup indefinitely.
+type timeoutExec struct {
+	invoke.Exec
+	timeout time.Duration
+}
+
+// newTimeoutExec returns the executor of CNI plugins that kills those that
+// run for longer than timeout. A timeout of zero or less lets them run as
+// long as the caller's context allows.
+func newTimeoutExec(timeout time.Duration) invoke.Exec {
+	exec := &invoke.DefaultExec{
+		RawExec:       &invoke.RawExec{Stderr: os.Stderr},
+		PluginDecoder: version.PluginDecoder{},
+	}
+	if timeout <= 0 {
+		return exec
+	}
+	return &timeoutExec{Exec: exec, timeout: timeout}
+}
+
+// ExecPlugin runs a plugin, killing it at its deadline. The plugin's exit
+// isn't waited for past the deadline: one whose children hold its output
+// open would otherwise keep the caller waiting anyway.
+func (e *timeoutExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	pluginCtx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := e.Exec.ExecPlugin(pluginCtx, pluginPath, stdinData, environ)
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && pluginCtx.Err() != nil && ctx.Err() == nil {
+			return nil, e.timeoutError(pluginPath, environ)
+		}
+		return r.output, r.err
+	case <-pluginCtx.Done():
+		// The caller giving up isn't the plugin's fault
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, e.timeoutError(pluginPath, environ)
+	}
+}
+
+// timeoutError describes a plugin run with environ that timed out.
+func (e *timeoutExec) timeoutError(pluginPath string, environ []string) error {
+	command := ""
+	for _, v := range environ {
+		if value, ok := strings.CutPrefix(v, "CNI_COMMAND="); ok {
+			command = value
+		}
+	}
+	return &PluginTimeoutError{Plugin: filepath.Base(pluginPath), Command: command, Timeout: e.timeout}
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+// fakeExec runs plugins by calling run.
+type fakeExec struct {
+	invoke.Exec
+	run func(ctx context.Context) ([]byte, error)
+}
+
+func (e *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	return e.run(ctx)
+}
+
+func TestTimeoutExec(t *testing.T) {
+	environ := []string{"CNI_COMMAND=DEL", "CNI_CONTAINERID=fc-1"}
+
+	// Plugins within the timeout are left alone, failures included
+	exec := &timeoutExec{timeout: time.Second, Exec: &fakeExec{run: func(ctx context.Context) ([]byte, error) {
+		return []byte("{}"), nil
+	}}}
+	if out, err := exec.ExecPlugin(context.Background(), "/opt/cni/bin/bridge", nil, environ); err != nil || string(out) != "{}" {
+		t.Errorf("ExecPlugin() = %q, %v, want {}", out, err)
+	}
+	failed := errors.New("no IP addresses available")
+	exec.Exec = &fakeExec{run: func(ctx context.Context) ([]byte, error) { return nil, failed }}
+	if _, err := exec.ExecPlugin(context.Background(), "/opt/cni/bin/bridge", nil, environ); !errors.Is(err, failed) {
+		t.Errorf("ExecPlugin() error = %v, want %v", err, failed)
+	}
+
+	// A hung plugin times out, even one that doesn't exit when killed
+	exec = &timeoutExec{timeout: 20 * time.Millisecond, Exec: &fakeExec{run: func(ctx context.Context) ([]byte, error) {
+		time.Sleep(time.Second)
+		return nil, ctx.Err()
+	}}}
+	start := time.Now()
+	_, err := exec.ExecPlugin(context.Background(), "/opt/cni/bin/host-local", nil, environ)
+	var timeout *PluginTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("ExecPlugin() error = %v, want a PluginTimeoutError", err)
+	}
+	if timeout.Plugin != "host-local" || timeout.Command != "DEL" || timeout.Timeout != 20*time.Millisecond {
+		t.Errorf("PluginTimeoutError = %+v", timeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ExecPlugin() returned after %s, want the timeout", elapsed)
+	}
+
+	// The caller giving up isn't a plugin timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := exec.ExecPlugin(ctx, "/opt/cni/bin/host-local", nil, environ); IsPluginTimeout(err) || !errors.Is(err, context.Canceled) {
+		t.Errorf("ExecPlugin() with a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestPluginTimeout_AddNetworkList(t *testing.T) {
+	pluginDir := t.TempDir()
+	// The sleep outlives the killed shell and holds its output open
+	if err := os.WriteFile(filepath.Join(pluginDir, "hang"), []byte("#!/bin/sh\nsleep 5\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	list, err := libcni.ConfListFromBytes([]byte(`{"cniVersion": "1.0.0", "name": "hung", "plugins": [{"type": "hang"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cni := libcni.NewCNIConfig([]string{pluginDir}, newTimeoutExec(100*time.Millisecond))
+
+	start := time.Now()
+	_, err = cni.AddNetworkList(context.Background(), list, &libcni.RuntimeConf{
+		ContainerID: "fc-1",
+		NetNS:       "/var/run/netns/fc-1",
+		IfName:      "eth0",
+	})
+	if !IsPluginTimeout(err) {
+		t.Fatalf("AddNetworkList() error = %v, want a plugin timeout", err)
+	}
+	if want := "CNI plugin hang timed out after 100ms on ADD"; !strings.Contains(err.Error(), want) {
+		t.Errorf("AddNetworkList() error = %q, want it to contain %q", err, want)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("AddNetworkList() returned after %s, want the timeout", elapsed)
+	}
+}
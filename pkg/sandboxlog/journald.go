@@ -0,0 +1,155 @@
+package sandboxlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSocket is where journald receives entries in its native protocol.
+var journalSocket = "/run/systemd/journal/socket"
+
+// syslogIdentifier tags every entry, so `journalctl -t fc-cri-shim` shows
+// them all.
+const syslogIdentifier = "fc-cri-shim"
+
+// journaldHook sends entries to journald, each logrus field as a field of
+// its own: component=vmm becomes COMPONENT=vmm.
+type journaldHook struct {
+	conn *net.UnixConn
+
+	// fields identify the sandbox on every entry
+	fields map[string]string
+}
+
+func newJournaldHook(socket string, sandbox Sandbox) (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+	return &journaldHook{
+		conn: conn,
+		fields: map[string]string{
+			"SYSLOG_IDENTIFIER": syslogIdentifier,
+			"FC_SANDBOX_ID":     sandbox.ID,
+			"FC_NAMESPACE":      sandbox.Namespace,
+		},
+	}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var msg bytes.Buffer
+	writeField(&msg, "MESSAGE", entry.Message)
+	writeField(&msg, "PRIORITY", fmt.Sprint(priority(entry.Level)))
+	for name, value := range h.fields {
+		writeField(&msg, name, value)
+	}
+	for key, value := range entry.Data {
+		name := fieldName(key)
+		if name == "" || h.fields[name] != "" {
+			continue
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeField(&msg, name, fmt.Sprint(value))
+	}
+
+	_, err := h.conn.Write(msg.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return h.sendLarge(msg.Bytes())
+	}
+	return err
+}
+
+// sendLarge sends an entry too large for a datagram the way journald
+// expects: in an unlinked file whose descriptor is passed instead.
+func (h *journaldHook) sendLarge(msg []byte) error {
+	file, err := os.CreateTemp("/dev/shm", "fc-cri-journal-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(msg); err != nil {
+		return err
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// Close disconnects from journald.
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// writeField appends a field in journald's native format. Values spanning
+// lines are written with their length instead.
+func writeField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName turns a logrus key into a journald field name: upper case
+// letters, digits and underscores, not starting with an underscore, which
+// marks fields only journald itself may set.
+func fieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" {
+		return ""
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// priority maps a logrus level to a syslog priority.
+func priority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	}
+	return 7 // debug
+}
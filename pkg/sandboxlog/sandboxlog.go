@@ -0,0 +1,128 @@
+// Package sandboxlog routes a sandbox's logs away from the shim's stderr,
+// where they interleave with every other shim and VMM on the node.
+//
+// A sandbox's logs can go to journald, with the sandbox's identity as
+// structured fields, to a file of its own, rotated by size, or to both:
+//
+//	/var/log/fc-cri/sandboxes/
+//	  k8s.io/
+//	    4f1c9e....log      current file
+//	    4f1c9e....log.1    previous file
+package sandboxlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Where sandbox logs go.
+const (
+	OutputStderr   = "stderr"
+	OutputJournald = "journald"
+	OutputFile     = "file"
+	OutputBoth     = "both"
+)
+
+// Config configures where sandbox logs go.
+type Config struct {
+	// Output is stderr, journald, file or both (journald and file).
+	Output string
+
+	// Dir holds the per-sandbox log files, one directory per namespace.
+	Dir string
+
+	// MaxSizeMB is the size at which a log file is rotated.
+	MaxSizeMB int
+
+	// MaxFiles is the number of rotated files kept besides the current one.
+	MaxFiles int
+}
+
+// DefaultConfig returns the default configuration: logs stay on stderr.
+func DefaultConfig() Config {
+	return Config{
+		Output:    OutputStderr,
+		Dir:       "/var/log/fc-cri/sandboxes",
+		MaxSizeMB: 10,
+		MaxFiles:  5,
+	}
+}
+
+// ValidOutput reports whether output is a known log destination.
+func ValidOutput(output string) bool {
+	switch output {
+	case OutputStderr, OutputJournald, OutputFile, OutputBoth:
+		return true
+	}
+	return false
+}
+
+// Sandbox identifies the sandbox logs belong to.
+type Sandbox struct {
+	ID        string
+	Namespace string
+}
+
+// New returns a logger for the sandbox's logs with base's level and
+// formatter, and a function that closes its destinations. With the stderr
+// output it returns base itself.
+func New(base *logrus.Logger, config Config, sandbox Sandbox) (*logrus.Logger, func() error, error) {
+	if config.Output == "" || config.Output == OutputStderr {
+		return base, func() error { return nil }, nil
+	}
+	if !ValidOutput(config.Output) {
+		return nil, nil, fmt.Errorf("unknown sandbox log output %q", config.Output)
+	}
+
+	log := logrus.New()
+	log.SetLevel(base.GetLevel())
+	log.SetFormatter(base.Formatter)
+	log.SetOutput(io.Discard)
+	closeLog := func() error { return nil }
+
+	if config.Output == OutputFile || config.Output == OutputBoth {
+		file, err := openRotating(config, sandbox)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.SetOutput(file)
+		closeLog = file.Close
+	}
+
+	if config.Output == OutputJournald || config.Output == OutputBoth {
+		hook, err := newJournaldHook(journalSocket, sandbox)
+		if err != nil {
+			closeLog()
+			return nil, nil, err
+		}
+		log.AddHook(hook)
+		file := closeLog
+		closeLog = func() error {
+			hook.Close()
+			return file()
+		}
+	}
+
+	return log, closeLog, nil
+}
+
+// Path returns the path of the sandbox's current log file.
+func Path(config Config, sandbox Sandbox) string {
+	namespace := sandbox.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	return filepath.Join(config.Dir, namespace, sandbox.ID+".log")
+}
+
+func openRotating(config Config, sandbox Sandbox) (*rotatingFile, error) {
+	path := Path(config, sandbox)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sandbox log dir: %w", err)
+	}
+	return newRotatingFile(path, int64(config.MaxSizeMB)*1024*1024, config.MaxFiles)
+}
@@ -0,0 +1,158 @@
+package sandboxlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNew_Stderr(t *testing.T) {
+	base := logrus.New()
+	log, closeLog, err := New(base, DefaultConfig(), Sandbox{ID: "sb1", Namespace: "k8s.io"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer closeLog()
+	if log != base {
+		t.Error("stderr output should log through the base logger")
+	}
+
+	if _, _, err := New(base, Config{Output: "syslog"}, Sandbox{ID: "sb1"}); err == nil {
+		t.Error("New() with an unknown output should fail")
+	}
+}
+
+func TestNew_File(t *testing.T) {
+	config := DefaultConfig()
+	config.Output = OutputFile
+	config.Dir = t.TempDir()
+	sandbox := Sandbox{ID: "sb1", Namespace: "k8s.io"}
+
+	base := logrus.New()
+	base.SetLevel(logrus.DebugLevel)
+	log, closeLog, err := New(base, config, sandbox)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	log.WithField("component", "vmm").Debug("VM booted")
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := Path(config, sandbox)
+	if path != filepath.Join(config.Dir, "k8s.io", "sb1.log") {
+		t.Errorf("Path() = %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "VM booted") || !strings.Contains(string(data), "component=vmm") {
+		t.Errorf("log file = %q", data)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sb1.log")
+	r, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range want {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), data, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 rotated files should be kept")
+	}
+}
+
+func TestJournald(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	hook, err := newJournaldHook(socket, Sandbox{ID: "sb1", Namespace: "k8s.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	log := logrus.New()
+	log.SetOutput(bytes.NewBuffer(nil))
+	log.AddHook(hook)
+	log.WithFields(logrus.Fields{"component": "fc-agent", "sandbox-id": "fc-1", "_PID": 1}).Warn("line one\nline two")
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+
+	for _, field := range []string{
+		"PRIORITY=4\n",
+		"SYSLOG_IDENTIFIER=fc-cri-shim\n",
+		"FC_SANDBOX_ID=sb1\n",
+		"FC_NAMESPACE=k8s.io\n",
+		"COMPONENT=fc-agent\n",
+		"SANDBOX_ID=fc-1\n",
+		"PID=1\n",
+	} {
+		if !bytes.Contains(msg, []byte(field)) {
+			t.Errorf("entry lacks %q: %q", field, msg)
+		}
+	}
+
+	// Multi-line values carry their length
+	var multiline bytes.Buffer
+	multiline.WriteString("MESSAGE\n")
+	_ = binary.Write(&multiline, binary.LittleEndian, uint64(len("line one\nline two")))
+	multiline.WriteString("line one\nline two\n")
+	if !bytes.Contains(msg, multiline.Bytes()) {
+		t.Errorf("entry lacks a length-prefixed MESSAGE: %q", msg)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := map[string]string{
+		"component":  "COMPONENT",
+		"sandbox_id": "SANDBOX_ID",
+		"error.kind": "ERROR_KIND",
+		"__hidden":   "HIDDEN",
+		"9lives":     "F_9LIVES",
+		"___":        "",
+	}
+	for key, want := range tests {
+		if got := fieldName(key); got != want {
+			t.Errorf("fieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
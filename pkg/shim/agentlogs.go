@@ -0,0 +1,28 @@
+package shim
+
+import (
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// startAgentLogs begins shipping the guest agent's logs of the current
+// sandbox into the shim's log. Must be called with s.mu held.
+func (s *Service) startAgentLogs() {
+	if s.sandbox == nil {
+		return
+	}
+
+	shipper := agent.NewLogShipper(s.log.WithField("sandbox_id", s.sandbox.ID))
+	shipper.SetAuthKey(s.sandbox.AgentKey)
+	shipper.Start(s.ctx, s.sandbox.VsockPath, s.sandbox.VsockCID, vm.AgentPort(s.sandbox.VMConfig))
+	s.agentLogs = shipper
+}
+
+// stopAgentLogs stops shipping guest agent logs. Must be called with s.mu
+// held.
+func (s *Service) stopAgentLogs() {
+	if s.agentLogs != nil {
+		s.agentLogs.Stop()
+		s.agentLogs = nil
+	}
+}
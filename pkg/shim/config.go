@@ -0,0 +1,215 @@
+package shim
+
+import (
+	"sort"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+	"github.com/sirupsen/logrus"
+)
+
+// runtimeConfigPath is the node's runtime config, which every shim reads.
+const runtimeConfigPath = "/etc/fc-cri/config.toml"
+
+// loadConfig reads the node's runtime config at path, with the FC_CRI_*
+// variables applied over it. A missing file leaves the defaults; one that
+// can't be read or parsed is logged, and the defaults are used too.
+func loadConfig(path string, log *logrus.Entry) *config.Config {
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Warn("Failed to load runtime config, using the defaults")
+		cfg = config.Default()
+	}
+	config.LoadFromEnv(cfg)
+	return cfg
+}
+
+// configureMetrics applies the [metrics] section to collector. Invalid
+// buckets are logged, and the operation keeps its defaults; series limits
+// that aren't positive keep theirs.
+func configureMetrics(collector *metrics.Collector, c config.MetricsConfig, log *logrus.Entry) {
+	maxSandboxes, maxImages := metrics.DefaultMaxSandboxSeries, metrics.DefaultMaxImageSeries
+	if c.MaxSandboxSeries > 0 {
+		maxSandboxes = c.MaxSandboxSeries
+	}
+	if c.MaxImageSeries > 0 {
+		maxImages = c.MaxImageSeries
+	}
+	collector.SetSeriesLimits(maxSandboxes, maxImages)
+
+	ops := make([]string, 0, len(c.Buckets))
+	for op := range c.Buckets {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		if err := collector.SetBuckets(op, c.Buckets[op]); err != nil {
+			log.WithError(err).WithField("operation", op).Warn("Invalid metrics buckets, using the defaults")
+		}
+	}
+}
+
+// kernelStoreConfig returns where the kernels pods select are kept, for
+// the [vm] section.
+func kernelStoreConfig(c config.VMConfig) kernel.Config {
+	kernels := kernel.DefaultConfig()
+	if c.KernelsDir != "" {
+		kernels.Dir = c.KernelsDir
+	}
+	kernels.AllowDownload = c.KernelDownload
+	return kernels
+}
+
+// cniServiceConfig returns the CNI settings VMs are networked with, for the
+// [network] section. Empty and negative values keep the defaults.
+func cniServiceConfig(c config.NetworkConfig) network.CNIServiceConfig {
+	cni := network.DefaultCNIServiceConfig()
+	for _, s := range []struct {
+		value string
+		field *string
+	}{
+		{c.CNIPluginDir, &cni.PluginDir},
+		{c.CNIConfDir, &cni.ConfDir},
+		{c.CNICacheDir, &cni.CacheDir},
+		{c.DefaultNetworkName, &cni.NetworkName},
+		{c.DefaultSubnet, &cni.DefaultSubnet},
+		{c.DefaultSubnetV6, &cni.DefaultSubnetV6},
+		{c.IPFamily, &cni.IPFamily},
+		{c.TAPMode, &cni.TAPMode},
+		{c.TAPBridge, &cni.TAPBridge},
+	} {
+		if s.value != "" {
+			*s.field = s.value
+		}
+	}
+	if c.TAPQueues > 0 {
+		cni.TAPQueues = c.TAPQueues
+	}
+	if c.IPReuseCooldown >= 0 {
+		cni.IPReuseCooldown = c.IPReuseCooldown
+	}
+	// A hung plugin fails the sandbox with a retryable error rather than
+	// holding Create until containerd gives up
+	if c.CNIPluginTimeout >= 0 {
+		cni.PluginTimeout = c.CNIPluginTimeout
+	}
+	return cni
+}
+
+// defaultNetRateLimit returns the network rate limit of VMs whose pods don't
+// set one, for the [network] section, or nil to leave them unlimited.
+// Negative rates are unlimited, like zero ones.
+func defaultNetRateLimit(c config.NetworkConfig) *domain.NetRateLimit {
+	limit := domain.NetRateLimit{
+		RX: domain.TrafficLimit{BytesPerSec: max(c.RXBytesPerSec, 0), PacketsPerSec: max(c.RXPacketsPerSec, 0)},
+		TX: domain.TrafficLimit{BytesPerSec: max(c.TXBytesPerSec, 0), PacketsPerSec: max(c.TXPacketsPerSec, 0)},
+	}
+	if limit.RX.IsZero() && limit.TX.IsZero() {
+		return nil
+	}
+	return &limit
+}
+
+// mtlsConfig returns the certificates host-terminated mTLS uses, for the
+// [network] section. Empty files keep the defaults.
+func mtlsConfig(c config.NetworkConfig) network.MTLSConfig {
+	mtls := network.DefaultMTLSConfig()
+	if c.MTLSCertFile != "" {
+		mtls.CertFile = c.MTLSCertFile
+	}
+	if c.MTLSKeyFile != "" {
+		mtls.KeyFile = c.MTLSKeyFile
+	}
+	if c.MTLSBundleFile != "" {
+		mtls.BundleFile = c.MTLSBundleFile
+	}
+	mtls.TrustDomain = c.MTLSTrustDomain
+	return mtls
+}
+
+// cpuTemplateConfig returns the CPU templates VMs boot with, for the [vm]
+// section. A default that can't name a template is dropped, and an empty
+// directory keeps the default.
+func cpuTemplateConfig(c config.VMConfig) vm.CPUTemplateConfig {
+	templates := vm.DefaultCPUTemplateConfig()
+	if vm.ValidateCPUTemplateName(c.CPUTemplate) == nil {
+		templates.Default = c.CPUTemplate
+	}
+	if c.CPUTemplatesDir != "" {
+		templates.Dir = c.CPUTemplatesDir
+	}
+	return templates
+}
+
+// preallocConfig returns how the disk images of VMs are allocated, for the
+// [vm] section.
+func preallocConfig(c config.VMConfig) vm.PreallocConfig {
+	prealloc := vm.DefaultPreallocConfig()
+	if c.DiskPrealloc != "" {
+		prealloc.Default = c.DiskPrealloc
+	}
+	prealloc.Filesystems = c.DiskPreallocFilesystems
+	prealloc.Volumes = c.DiskPreallocVolumes
+	return prealloc
+}
+
+// fdLimitConfig returns the VMMs' file descriptor limits for the [runtime]
+// section. Values out of range keep the defaults.
+func fdLimitConfig(c config.RuntimeConfig) vm.FDLimitConfig {
+	limits := vm.DefaultFDLimitConfig()
+	if c.VMMMaxOpenFiles >= 0 {
+		limits.VMMMaxOpenFiles = uint64(c.VMMMaxOpenFiles)
+	}
+	if c.FDAdmissionThreshold >= 0 && c.FDAdmissionThreshold <= 1 {
+		limits.AdmissionThreshold = c.FDAdmissionThreshold
+	}
+	return limits
+}
+
+// cgroupConfig returns the VMMs' cgroup settings for the [runtime] section.
+// An empty parent and negative overheads keep the defaults.
+func cgroupConfig(c config.RuntimeConfig) vm.CgroupConfig {
+	cgroup := vm.DefaultCgroupConfig()
+	cgroup.Enabled = c.CgroupAccounting
+	if c.CgroupParent != "" {
+		cgroup.Parent = c.CgroupParent
+	}
+	if c.VMMMemoryOverheadMB >= 0 {
+		cgroup.MemoryOverheadMB = c.VMMMemoryOverheadMB
+	}
+	if c.VMMCPUOverheadMillicores >= 0 {
+		cgroup.CPUOverheadMillicores = c.VMMCPUOverheadMillicores
+	}
+	return cgroup
+}
+
+// hooksConfig returns where lifecycle hooks are defined, for the [hooks]
+// section. An empty directory and a timeout that isn't positive keep the
+// defaults.
+func hooksConfig(c config.HooksConfig) hooks.Config {
+	hookConfig := hooks.DefaultConfig()
+	if c.Dir != "" {
+		hookConfig.Dir = c.Dir
+	}
+	if c.DefaultTimeout > 0 {
+		hookConfig.DefaultTimeout = c.DefaultTimeout
+	}
+	return hookConfig
+}
+
+// chaosConfig returns the VM manager's fault injection settings for the
+// [chaos] section.
+func chaosConfig(c config.ChaosConfig) vm.ChaosConfig {
+	return vm.ChaosConfig{
+		Enabled:           c.Enabled,
+		CreateFailureRate: c.CreateFailureRate,
+		AcquireDelay:      c.AcquireDelay,
+		KillWarmInterval:  c.KillWarmInterval,
+		Seed:              c.Seed,
+	}
+}
@@ -0,0 +1,359 @@
+package shim
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLoadConfig_Chaos(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	dir := t.TempDir()
+
+	// Without a config, fault injection stays off
+	if c := chaosConfig(loadConfig(filepath.Join(dir, "missing.toml"), log).Chaos); c != (vm.ChaosConfig{}) {
+		t.Errorf("chaosConfig() without a config = %+v, want it disabled", c)
+	}
+
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte(`
+[chaos]
+enabled = true
+create_failure_rate = 0.2
+acquire_delay = "200ms"
+kill_warm_interval = "30s"
+seed = 42
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := vm.ChaosConfig{
+		Enabled:           true,
+		CreateFailureRate: 0.2,
+		AcquireDelay:      200 * time.Millisecond,
+		KillWarmInterval:  30 * time.Second,
+		Seed:              42,
+	}
+	if c := chaosConfig(loadConfig(path, log).Chaos); c != want {
+		t.Errorf("chaosConfig() = %+v, want %+v", c, want)
+	}
+
+	// The environment overrides the file
+	t.Setenv("FC_CRI_CHAOS_CREATE_FAILURE_RATE", "0.5")
+	t.Setenv("FC_CRI_CHAOS_SEED", "7")
+	want.CreateFailureRate = 0.5
+	want.Seed = 7
+	if c := chaosConfig(loadConfig(path, log).Chaos); c != want {
+		t.Errorf("chaosConfig() with FC_CRI_CHAOS_* = %+v, want %+v", c, want)
+	}
+
+	// A config that can't be read leaves the environment's settings
+	t.Setenv("FC_CRI_CHAOS_ENABLED", "true")
+	want = vm.ChaosConfig{Enabled: true, CreateFailureRate: 0.5, Seed: 7}
+	if c := chaosConfig(loadConfig(dir, log).Chaos); c != want {
+		t.Errorf("chaosConfig() with an unreadable config = %+v, want %+v", c, want)
+	}
+}
+
+func TestConfigureMetrics(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(`
+[metrics.buckets]
+create = [0.1, 1, 10]
+pool_warm = [1, 5]
+start = [2, 1]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := metrics.NewCollector(log)
+	defaults := collector.GetSnapshot().Latencies["start"].Bounds
+	configureMetrics(collector, loadConfig(path, log).Metrics, log)
+
+	snap := collector.GetSnapshot()
+	if got := snap.Latencies["create"].Bounds; !reflect.DeepEqual(got, []float64{0.1, 1, 10}) {
+		t.Errorf("create bounds = %v, want [0.1 1 10]", got)
+	}
+	if got := snap.PoolWarmTime.Bounds; !reflect.DeepEqual(got, []float64{1, 5}) {
+		t.Errorf("pool warm bounds = %v, want [1 5]", got)
+	}
+	// Invalid buckets keep the defaults
+	if got := snap.Latencies["start"].Bounds; !reflect.DeepEqual(got, defaults) {
+		t.Errorf("start bounds = %v, want the defaults %v", got, defaults)
+	}
+}
+
+func TestConfigureMetrics_SeriesLimits(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	collector := metrics.NewCollector(log)
+	configureMetrics(collector, config.MetricsConfig{MaxSandboxSeries: 1, MaxImageSeries: 1}, log)
+
+	collector.SetSandboxResources(metrics.SandboxLabels{SandboxID: "fc-1"}, 128, 1)
+	collector.SetSandboxResources(metrics.SandboxLabels{SandboxID: "fc-2"}, 128, 1)
+	collector.RecordImageConversion("nginx:latest", time.Second, 1024, nil)
+	collector.RecordImageConversion("redis:latest", time.Second, 1024, nil)
+
+	w := httptest.NewRecorder()
+	collector.PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`fc_cri_metric_series_overflow_total{kind="sandbox"} 1`,
+		`fc_cri_metric_series_overflow_total{kind="image"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestCgroupConfig(t *testing.T) {
+	if c := cgroupConfig(config.Default().Runtime); c != vm.DefaultCgroupConfig() {
+		t.Errorf("cgroupConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[runtime]\ncgroup_parent = \"pods.slice\"\nvmm_memory_overhead_mb = 32\nvmm_cpu_overhead_millicores = 0\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_CGROUP_ACCOUNTING", "false")
+
+	want := vm.DefaultCgroupConfig()
+	want.Enabled = false
+	want.Parent = "pods.slice"
+	want.MemoryOverheadMB = 32
+	want.CPUOverheadMillicores = 0
+	if c := cgroupConfig(loadConfig(path, logrus.NewEntry(logrus.New())).Runtime); c != want {
+		t.Errorf("cgroupConfig() = %+v, want %+v", c, want)
+	}
+}
+
+func TestFDLimitConfig(t *testing.T) {
+	if c := fdLimitConfig(config.Default().Runtime); c != vm.DefaultFDLimitConfig() {
+		t.Errorf("fdLimitConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[runtime]\nvmm_max_open_files = 1024\nfd_admission_threshold = 0.5\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.NewEntry(logrus.New())
+	want := vm.FDLimitConfig{VMMMaxOpenFiles: 1024, AdmissionThreshold: 0.5}
+	if c := fdLimitConfig(loadConfig(path, log).Runtime); c != want {
+		t.Errorf("fdLimitConfig() = %+v, want %+v", c, want)
+	}
+
+	// 0 disables admission checks; the environment overrides the file
+	t.Setenv("FC_CRI_FD_ADMISSION_THRESHOLD", "0")
+	want.AdmissionThreshold = 0
+	if c := fdLimitConfig(loadConfig(path, log).Runtime); c != want {
+		t.Errorf("fdLimitConfig() with FC_CRI_FD_ADMISSION_THRESHOLD=0 = %+v, want %+v", c, want)
+	}
+
+	// Out of range keeps the defaults
+	if c := fdLimitConfig(config.RuntimeConfig{VMMMaxOpenFiles: -1, FDAdmissionThreshold: 1.5}); c != vm.DefaultFDLimitConfig() {
+		t.Errorf("fdLimitConfig() out of range = %+v, want the defaults", c)
+	}
+}
+
+func TestPreallocConfig(t *testing.T) {
+	if c := preallocConfig(config.Default().VM); !reflect.DeepEqual(c, vm.DefaultPreallocConfig()) {
+		t.Errorf("preallocConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(`
+[vm]
+disk_prealloc = "fallocate"
+
+[vm.disk_prealloc_filesystems]
+xfs = "full"
+
+[vm.disk_prealloc_volumes]
+emptydir = "sparse"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := vm.PreallocConfig{
+		Default:     vm.PreallocFallocate,
+		Filesystems: map[string]string{"xfs": vm.PreallocFull},
+		Volumes:     map[string]string{"emptydir": vm.PreallocSparse},
+	}
+	c := preallocConfig(loadConfig(path, logrus.NewEntry(logrus.New())).VM)
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("preallocConfig() = %+v, want %+v", c, want)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestCPUTemplateConfig(t *testing.T) {
+	if c := cpuTemplateConfig(config.Default().VM); c != vm.DefaultCPUTemplateConfig() {
+		t.Errorf("cpuTemplateConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[vm]\ncpu_template = \"T2S\"\ncpu_templates_dir = \"/srv/cpu-templates\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.NewEntry(logrus.New())
+	want := vm.CPUTemplateConfig{Default: "T2S", Dir: "/srv/cpu-templates"}
+	if c := cpuTemplateConfig(loadConfig(path, log).VM); c != want {
+		t.Errorf("cpuTemplateConfig() = %+v, want %+v", c, want)
+	}
+
+	// The environment overrides the file
+	t.Setenv("FC_CRI_VM_CPU_TEMPLATE", "fleet-v2")
+	want.Default = "fleet-v2"
+	if c := cpuTemplateConfig(loadConfig(path, log).VM); c != want {
+		t.Errorf("cpuTemplateConfig() = %+v, want %+v", c, want)
+	}
+
+	// A name that can't be a template file keeps the default
+	if c := cpuTemplateConfig(config.VMConfig{CPUTemplate: "../t2s"}); c != vm.DefaultCPUTemplateConfig() {
+		t.Errorf("cpuTemplateConfig() with an invalid name = %+v, want the defaults", c)
+	}
+}
+
+func TestCNIServiceConfig(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	c := cniServiceConfig(loadConfig(filepath.Join(t.TempDir(), "missing.toml"), log).Network)
+	if c.PluginTimeout != network.DefaultPluginTimeout || c.NetworkName != "fc-net" || c.TAPMode != network.TAPModePlugin {
+		t.Errorf("cniServiceConfig() without a config = %+v", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(`
+[network]
+cni_plugin_dir = "/usr/libexec/cni"
+cni_plugin_timeout = "5s"
+tap_mode = "bridge"
+tap_bridge = "br0"
+ip_reuse_cooldown = "0s"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = cniServiceConfig(loadConfig(path, log).Network)
+	if c.PluginDir != "/usr/libexec/cni" || c.PluginTimeout != 5*time.Second || c.TAPMode != network.TAPModeBridge || c.TAPBridge != "br0" || c.IPReuseCooldown != 0 {
+		t.Errorf("cniServiceConfig() = %+v", c)
+	}
+
+	// The environment overrides the file; 0 lets plugins run unbounded
+	t.Setenv("FC_CRI_CNI_PLUGIN_TIMEOUT", "0s")
+	if c := cniServiceConfig(loadConfig(path, log).Network); c.PluginTimeout != 0 {
+		t.Errorf("cniServiceConfig() with FC_CRI_CNI_PLUGIN_TIMEOUT=0s timeout = %s, want 0", c.PluginTimeout)
+	}
+}
+
+func TestDefaultNetRateLimit(t *testing.T) {
+	if limit := defaultNetRateLimit(config.Default().Network); limit != nil {
+		t.Errorf("defaultNetRateLimit() = %+v, want unlimited", limit)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[network]\nrx_bytes_per_sec = 12500000\ntx_bytes_per_sec = 12500000\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_NETWORK_TX_PACKETS_PER_SEC", "20000")
+
+	want := domain.NetRateLimit{
+		RX: domain.TrafficLimit{BytesPerSec: 12500000},
+		TX: domain.TrafficLimit{BytesPerSec: 12500000, PacketsPerSec: 20000},
+	}
+	limit := defaultNetRateLimit(loadConfig(path, logrus.NewEntry(logrus.New())).Network)
+	if limit == nil || *limit != want {
+		t.Errorf("defaultNetRateLimit() = %+v, want %+v", limit, want)
+	}
+
+	// Negative rates are unlimited
+	if limit := defaultNetRateLimit(config.NetworkConfig{RXBytesPerSec: -1}); limit != nil {
+		t.Errorf("defaultNetRateLimit() with a negative rate = %+v, want unlimited", limit)
+	}
+}
+
+func TestMTLSConfig(t *testing.T) {
+	if c := mtlsConfig(config.Default().Network); c != network.DefaultMTLSConfig() {
+		t.Errorf("mtlsConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[network]\nmtls_cert_file = \"/etc/certs/tls.crt\"\nmtls_key_file = \"/etc/certs/tls.key\"\nmtls_trust_domain = \"cluster.local\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_NETWORK_MTLS_BUNDLE_FILE", "/etc/certs/ca.crt")
+
+	want := network.MTLSConfig{
+		CertFile:    "/etc/certs/tls.crt",
+		KeyFile:     "/etc/certs/tls.key",
+		BundleFile:  "/etc/certs/ca.crt",
+		TrustDomain: "cluster.local",
+	}
+	if c := mtlsConfig(loadConfig(path, logrus.NewEntry(logrus.New())).Network); c != want {
+		t.Errorf("mtlsConfig() = %+v, want %+v", c, want)
+	}
+}
+
+func TestKernelStoreConfig(t *testing.T) {
+	if c := kernelStoreConfig(config.Default().VM); c != kernel.DefaultConfig() {
+		t.Errorf("kernelStoreConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[vm]\nkernels_dir = \"/srv/kernels\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_VM_KERNEL_DOWNLOAD", "false")
+
+	want := kernel.DefaultConfig()
+	want.Dir = "/srv/kernels"
+	want.AllowDownload = false
+	if c := kernelStoreConfig(loadConfig(path, logrus.NewEntry(logrus.New())).VM); c != want {
+		t.Errorf("kernelStoreConfig() = %+v, want %+v", c, want)
+	}
+}
+
+func TestHooksConfig(t *testing.T) {
+	if c := hooksConfig(config.Default().Hooks); c != hooks.DefaultConfig() {
+		t.Errorf("hooksConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[hooks]\ndir = \"/srv/hooks.d\"\ndefault_timeout = \"3s\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_HOOKS_DEFAULT_TIMEOUT", "30s")
+
+	want := hooks.Config{Dir: "/srv/hooks.d", DefaultTimeout: 30 * time.Second}
+	if c := hooksConfig(loadConfig(path, logrus.NewEntry(logrus.New())).Hooks); c != want {
+		t.Errorf("hooksConfig() = %+v, want %+v", c, want)
+	}
+
+	// A timeout that isn't positive keeps the default
+	if c := hooksConfig(config.HooksConfig{DefaultTimeout: -time.Second}); c != hooks.DefaultConfig() {
+		t.Errorf("hooksConfig() with a negative timeout = %+v, want the defaults", c)
+	}
+}
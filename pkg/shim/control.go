@@ -0,0 +1,159 @@
+package shim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// controlSocketName is the socket in a sandbox's runtime directory on
+	// which its shim takes requests from fcctl.
+	controlSocketName = "shim.sock"
+
+	// controlReadTimeout bounds reading a request from a control connection.
+	controlReadTimeout = 5 * time.Second
+)
+
+// Methods of the control socket.
+const (
+	// controlRestart reboots the sandbox's VM in place and restarts its
+	// container, keeping its addresses, MAC and rootfs.
+	controlRestart = "restart"
+)
+
+// controlRequest is a request on the control socket. Each connection
+// carries one request and its response, both JSON.
+type controlRequest struct {
+	Method string `json:"method"`
+}
+
+// controlResponse answers a control request.
+type controlResponse struct {
+	Error     string   `json:"error,omitempty"`
+	SandboxID string   `json:"sandbox_id,omitempty"`
+	PID       int      `json:"pid,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	GuestMAC  string   `json:"guest_mac,omitempty"`
+	Elapsed   string   `json:"elapsed,omitempty"`
+}
+
+// startControl begins taking control requests for the current sandbox.
+// The socket is only reachable by root. Must be called with s.mu held.
+func (s *Service) startControl() {
+	if s.sandbox == nil {
+		return
+	}
+
+	path := filepath.Join(s.runtimeDir, s.sandbox.ID, controlSocketName)
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to listen for control requests")
+		return
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		s.log.WithError(err).Warn("Failed to restrict control socket")
+		return
+	}
+	s.control = listener
+	go s.serveControl(listener)
+}
+
+// stopControl stops taking control requests; requests being handled run
+// to completion. Must be called with s.mu held.
+func (s *Service) stopControl() {
+	if s.control != nil {
+		s.control.Close()
+		s.control = nil
+	}
+}
+
+// serveControl handles the connections to listener until it is closed.
+func (s *Service) serveControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleControl(conn)
+	}
+}
+
+// handleControl answers the request on a control connection.
+func (s *Service) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	var req controlRequest
+	_ = conn.SetReadDeadline(time.Now().Add(controlReadTimeout))
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		_ = json.NewEncoder(conn).Encode(&controlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	var resp controlResponse
+	switch req.Method {
+	case controlRestart:
+		resp = s.handleRestartRequest()
+	default:
+		resp = controlResponse{Error: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		s.log.WithError(err).WithField("method", req.Method).Warn("Failed to answer control request")
+	}
+}
+
+// handleRestartRequest reboots the VM of the current sandbox in place and
+// restarts its container. A sandbox that can't be restarted is left alone;
+// one whose restart fails part way is recycled, as its VM is gone.
+func (s *Service) handleRestartRequest() controlResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sandbox == nil {
+		return controlResponse{Error: "shim has no sandbox"}
+	}
+	plan, err := s.planRestart()
+	if err == nil {
+		err = s.vmManager.CheckReboot(s.sandbox)
+	}
+	if err != nil {
+		return controlResponse{Error: fmt.Sprintf("cannot restart sandbox: %v", err)}
+	}
+
+	sandboxID := s.sandbox.ID
+	log := s.log.WithField("sandbox_id", sandboxID)
+	start := time.Now()
+	agentDown := s.agentDown
+	if err := s.rebootSandbox(plan); err != nil {
+		log.WithError(err).Warn("Failed to restart sandbox, recycling it")
+		s.recycleSandbox("restart failed")
+		return controlResponse{Error: fmt.Sprintf("restart failed, sandbox recycled: %v", err)}
+	}
+	elapsed := time.Since(start)
+	log.WithFields(logrus.Fields{
+		"pid":     s.sandbox.PID,
+		"elapsed": elapsed,
+	}).Info("Restarted sandbox")
+	if agentDown {
+		s.emit(&AgentRecovered{
+			ContainerID: s.id,
+			SandboxID:   sandboxID,
+			RestartedVM: true,
+		})
+	}
+
+	return controlResponse{
+		SandboxID: sandboxID,
+		PID:       s.sandbox.PID,
+		IPs:       addressStrings(s.sandbox.IPs),
+		GuestMAC:  s.sandbox.Attachment.GuestMAC,
+		Elapsed:   elapsed.Round(time.Millisecond).String(),
+	}
+}
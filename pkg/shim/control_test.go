@@ -0,0 +1,74 @@
+package shim
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// controlCall sends a request to the control socket at path.
+func controlCall(t *testing.T, path string, req controlRequest) controlResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	return resp
+}
+
+func TestControl(t *testing.T) {
+	runtimeDir := t.TempDir()
+	s := &Service{
+		runtimeDir: runtimeDir,
+		processes:  make(map[string]*processState),
+		log:        logrus.NewEntry(logrus.New()),
+	}
+	s.sandbox = domain.NewSandbox("fc-1")
+	if err := os.MkdirAll(filepath.Join(runtimeDir, "fc-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.startControl()
+	s.mu.Unlock()
+	path := filepath.Join(runtimeDir, "fc-1", controlSocketName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("control socket not created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("control socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	if resp := controlCall(t, path, controlRequest{Method: "reboot-host"}); !strings.Contains(resp.Error, "unknown method") {
+		t.Errorf("unknown method error = %q", resp.Error)
+	}
+	// Restarts are refused before anything is torn down
+	if resp := controlCall(t, path, controlRequest{Method: controlRestart}); !strings.Contains(resp.Error, "has no container") {
+		t.Errorf("restart without a container error = %q", resp.Error)
+	}
+	if s.sandbox == nil {
+		t.Fatal("refused restart released the sandbox")
+	}
+
+	s.mu.Lock()
+	s.stopControl()
+	s.mu.Unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("control socket left behind: %v", err)
+	}
+}
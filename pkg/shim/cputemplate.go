@@ -0,0 +1,19 @@
+package shim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// cpuTemplate returns the CPU template a pod asked for, or empty to use the
+// default.
+func cpuTemplate(annotations map[string]string) (string, error) {
+	name := strings.TrimSpace(annotations[annotation.CPUTemplate])
+	if err := vm.ValidateCPUTemplateName(name); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %w", annotation.CPUTemplate, err)
+	}
+	return name, nil
+}
@@ -0,0 +1,27 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+func TestCPUTemplate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"T2S", "T2S", false},
+		{" fleet-2024 ", "fleet-2024", false},
+		{"../../etc/shadow", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := cpuTemplate(map[string]string{annotation.CPUTemplate: tt.value})
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("cpuTemplate(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
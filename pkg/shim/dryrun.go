@@ -0,0 +1,210 @@
+package shim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dryRunReportFile is written to the bundle with the dry-run result.
+	dryRunReportFile = "dry-run.json"
+
+	// Latency histograms for VM acquisition, split by pool hit or miss.
+	latencyAcquireWarm = "acquire_warm"
+	latencyAcquireCold = "acquire_cold"
+)
+
+// Start time estimates used until the shim has observed real acquisitions.
+const (
+	defaultWarmEstimate = 50 * time.Millisecond
+	defaultColdEstimate = 150 * time.Millisecond
+)
+
+// kvmDevice must be accessible to boot VMs.
+var kvmDevice = "/dev/kvm"
+
+// DryRunCheck is the outcome of one pre-flight check.
+type DryRunCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DryRunReport is the result of a dry-run Create.
+type DryRunReport struct {
+	ID     string        `json:"id"`
+	OK     bool          `json:"ok"`
+	Checks []DryRunCheck `json:"checks"`
+
+	// PoolAvailable is the number of warm VMs; a non-zero value means the
+	// real Create would be served from the pool.
+	PoolAvailable int  `json:"pool_available"`
+	FromPool      bool `json:"from_pool"`
+
+	// EstimatedStart is the expected time to acquire a VM.
+	EstimatedStart time.Duration `json:"estimated_start"`
+}
+
+// isDryRun reports whether the bundle requests a dry-run Create.
+func isDryRun(annotations map[string]string) bool {
+	return annotations[annotation.DryRun] == "true"
+}
+
+// createDryRun validates that the task could be created and records a
+// report in the bundle, without acquiring a VM. The task is tracked so
+// Start, Wait and Delete behave; it exits immediately with status 0.
+// Must be called with s.mu held.
+func (s *Service) createDryRun(r *taskAPI.CreateTaskRequest) (*taskAPI.CreateTaskResponse, error) {
+	report := s.dryRun(r)
+
+	log := s.log.WithFields(logrus.Fields{
+		"id":              r.ID,
+		"ok":              report.OK,
+		"from_pool":       report.FromPool,
+		"estimated_start": report.EstimatedStart,
+	})
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(r.Bundle, dryRunReportFile), data, 0644)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to write dry-run report")
+	}
+
+	if !report.OK {
+		var failed []string
+		for _, check := range report.Checks {
+			if !check.OK {
+				failed = append(failed, check.Name+": "+check.Detail)
+			}
+		}
+		log.Warn("Dry-run create failed")
+		return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "dry run: %s", strings.Join(failed, "; "))
+	}
+	log.Info("Dry-run create succeeded")
+
+	s.bundle = r.Bundle
+	s.processes[r.ID] = &processState{
+		id:          r.ID,
+		containerID: r.ID,
+		stdin:       r.Stdin,
+		stdout:      r.Stdout,
+		stderr:      r.Stderr,
+		terminal:    r.Terminal,
+		dryRun:      true,
+		done:        make(chan struct{}),
+	}
+	s.emitCreate(r, 0)
+
+	return &taskAPI.CreateTaskResponse{}, nil
+}
+
+// dryRun runs the pre-flight checks for a Create.
+func (s *Service) dryRun(r *taskAPI.CreateTaskRequest) *DryRunReport {
+	report := &DryRunReport{ID: r.ID, OK: true}
+	add := func(name string, err error) {
+		check := DryRunCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Detail = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	add("image", checkRootfs(r))
+	add("kvm", checkKVM())
+	add("admission", s.checkAdmission())
+	add("network", checkNetNS(r.Bundle))
+
+	stats := s.vmPool.Stats()
+	report.PoolAvailable = stats.Available
+	report.FromPool = stats.Available > 0
+	report.EstimatedStart = estimateStart(report.FromPool)
+
+	return report
+}
+
+// checkRootfs verifies the task's rootfs is present on the host.
+func checkRootfs(r *taskAPI.CreateTaskRequest) error {
+	if len(r.Rootfs) == 0 {
+		return fmt.Errorf("no rootfs mount")
+	}
+	if _, err := os.Stat(r.Rootfs[0].Source); err != nil {
+		return fmt.Errorf("rootfs %s: %w", r.Rootfs[0].Source, err)
+	}
+	return nil
+}
+
+// checkKVM verifies the shim can open the KVM device.
+func checkKVM() error {
+	f, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkAdmission verifies the pool is accepting work and the node has
+// headroom for another VM.
+func (s *Service) checkAdmission() error {
+	if s.vmPool.Draining() {
+		return fmt.Errorf("vm pool is draining")
+	}
+	return s.vmManager.CheckAdmission()
+}
+
+// checkNetNS verifies the network namespace set up for the pod exists.
+// Bundles without one (host networking) pass.
+func checkNetNS(bundle string) error {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	var spec struct {
+		Linux struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("failed to parse spec: %w", err)
+	}
+
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			if _, err := os.Stat(ns.Path); err != nil {
+				return fmt.Errorf("network namespace %s: %w", ns.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// estimateStart returns the median observed acquisition time for a pool hit
+// or miss, falling back to published figures before any are observed.
+func estimateStart(fromPool bool) time.Duration {
+	op, fallback := latencyAcquireCold, defaultColdEstimate
+	if fromPool {
+		op, fallback = latencyAcquireWarm, defaultWarmEstimate
+	}
+
+	hist, ok := metrics.Global().GetSnapshot().Latencies[op]
+	if !ok || hist.Count == 0 {
+		return fallback
+	}
+	return time.Duration(hist.Quantile(0.5) * float64(time.Second))
+}
@@ -0,0 +1,81 @@
+package shim
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/api/types"
+)
+
+func writeSpec(t *testing.T, spec string) string {
+	t.Helper()
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(spec), 0644); err != nil {
+		t.Fatalf("Failed to write spec: %v", err)
+	}
+	return bundle
+}
+
+func TestIsDryRun(t *testing.T) {
+	bundle := writeSpec(t, `{"annotations": {"fc-cri.io/dry-run": "true"}}`)
+	if !isDryRun(podAnnotations(bundle)) {
+		t.Error("isDryRun = false for annotated bundle")
+	}
+
+	// The deprecated key still works, unless the new one says otherwise
+	bundle = writeSpec(t, `{"annotations": {"io.pipeops.firecracker/dry-run": "true"}}`)
+	if !isDryRun(podAnnotations(bundle)) {
+		t.Error("isDryRun = false for bundle annotated with the deprecated key")
+	}
+	bundle = writeSpec(t, `{"annotations": {"fc-cri.io/dry-run": "false", "io.pipeops.firecracker/dry-run": "true"}}`)
+	if isDryRun(podAnnotations(bundle)) {
+		t.Error("isDryRun = true for bundle whose new key is false")
+	}
+
+	bundle = writeSpec(t, `{"annotations": {}}`)
+	if isDryRun(podAnnotations(bundle)) {
+		t.Error("isDryRun = true for plain bundle")
+	}
+}
+
+func TestCheckRootfs(t *testing.T) {
+	if err := checkRootfs(&taskAPI.CreateTaskRequest{}); err == nil {
+		t.Error("checkRootfs accepted a request without rootfs")
+	}
+
+	r := &taskAPI.CreateTaskRequest{
+		Rootfs: []*types.Mount{{Source: filepath.Join(t.TempDir(), "missing.img")}},
+	}
+	if err := checkRootfs(r); err == nil {
+		t.Error("checkRootfs accepted a missing image")
+	}
+
+	r.Rootfs[0].Source = t.TempDir()
+	if err := checkRootfs(r); err != nil {
+		t.Errorf("checkRootfs() = %v, want nil", err)
+	}
+}
+
+func TestCheckNetNS(t *testing.T) {
+	// Host networking: no network namespace path
+	bundle := writeSpec(t, `{"linux": {"namespaces": [{"type": "pid"}]}}`)
+	if err := checkNetNS(bundle); err != nil {
+		t.Errorf("checkNetNS() = %v, want nil", err)
+	}
+
+	bundle = writeSpec(t, `{"linux": {"namespaces": [{"type": "network", "path": "/var/run/netns/missing"}]}}`)
+	if err := checkNetNS(bundle); err == nil {
+		t.Error("checkNetNS accepted a missing namespace")
+	}
+}
+
+func TestEstimateStart(t *testing.T) {
+	if got := estimateStart(true); got != defaultWarmEstimate {
+		t.Errorf("estimateStart(warm) = %s, want %s", got, defaultWarmEstimate)
+	}
+	if got := estimateStart(false); got != defaultColdEstimate {
+		t.Errorf("estimateStart(cold) = %s, want %s", got, defaultColdEstimate)
+	}
+}
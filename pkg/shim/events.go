@@ -0,0 +1,288 @@
+package shim
+
+import (
+	"context"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl/v2"
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// flushTimeout bounds publishing of events still queued at shutdown.
+const flushTimeout = 5 * time.Second
+
+// Topics of the sandbox health events, which containerd has no types for.
+const (
+	AgentUnresponsiveEventTopic = "/tasks/agent-unresponsive"
+	AgentRecoveredEventTopic    = "/tasks/agent-recovered"
+	CreateProgressEventTopic    = "/tasks/create-progress"
+)
+
+// AgentUnresponsive is published when a sandbox's guest agent has not
+// answered for the liveness window and the sandbox is marked not ready.
+type AgentUnresponsive struct {
+	ContainerID string `json:"container_id"`
+	SandboxID   string `json:"sandbox_id"`
+	Silent      string `json:"silent"`
+	RestartVM   bool   `json:"restart_vm"`
+}
+
+// AgentRecovered is published when the agent of a sandbox marked not ready
+// answers again, or its VM was replaced with one whose agent does.
+type AgentRecovered struct {
+	ContainerID string `json:"container_id"`
+	SandboxID   string `json:"sandbox_id"`
+	RestartedVM bool   `json:"restarted_vm"`
+}
+
+// CreateProgress is published as a Create moves through its phases, and
+// periodically while it waits for its rootfs image, so a slow Create shows
+// what it is doing before containerd's timeout.
+type CreateProgress struct {
+	ContainerID string `json:"container_id"`
+	Phase       string `json:"phase"`
+	Elapsed     string `json:"elapsed"`
+}
+
+func init() {
+	// Registered types without protobuf definitions are sent as JSON
+	typeurl.Register(&AgentUnresponsive{}, "io.pipeops.firecracker", "events", "AgentUnresponsive")
+	typeurl.Register(&AgentRecovered{}, "io.pipeops.firecracker", "events", "AgentRecovered")
+	typeurl.Register(&CreateProgress{}, "io.pipeops.firecracker", "events", "CreateProgress")
+}
+
+// emit queues an event for publishing to containerd. It never blocks, since
+// callers hold s.mu; if the queue is full the event is dropped.
+func (s *Service) emit(event interface{}) {
+	select {
+	case s.events <- event:
+	default:
+		s.log.WithField("topic", getTopic(event)).Warn("Event queue full, dropping event")
+	}
+}
+
+// emitCreate publishes TaskCreate for a newly created task.
+func (s *Service) emitCreate(r *taskAPI.CreateTaskRequest, pid int) {
+	s.emit(&eventstypes.TaskCreate{
+		ContainerID: r.ID,
+		Bundle:      r.Bundle,
+		Rootfs:      r.Rootfs,
+		IO: &eventstypes.TaskIO{
+			Stdin:    r.Stdin,
+			Stdout:   r.Stdout,
+			Stderr:   r.Stderr,
+			Terminal: r.Terminal,
+		},
+		Checkpoint: r.Checkpoint,
+		Pid:        uint32(pid),
+	})
+}
+
+// emitCreateProgress publishes CreateProgress for a Create that started
+// at start.
+func (s *Service) emitCreateProgress(id, phase string, start time.Time) {
+	s.emit(&CreateProgress{
+		ContainerID: id,
+		Phase:       phase,
+		Elapsed:     time.Since(start).Round(time.Millisecond).String(),
+	})
+}
+
+// setExited records that a process exited and publishes TaskExit. It is a
+// no-op for processes already marked exited. Must be called with s.mu held.
+func (s *Service) setExited(proc *processState, status int, exitedAt time.Time) {
+	if !proc.exitedAt.IsZero() {
+		return
+	}
+	proc.exitStatus = status
+	proc.exitedAt = exitedAt
+	if proc.done != nil {
+		close(proc.done)
+	}
+
+	s.emit(&eventstypes.TaskExit{
+		ContainerID: proc.containerID,
+		ID:          proc.id,
+		Pid:         uint32(proc.pid),
+		ExitStatus:  uint32(status),
+		ExitedAt:    timestamppb.New(exitedAt),
+	})
+}
+
+// startNotificationListener begins receiving container notifications from
+// the guest of the current sandbox. Must be called with s.mu held.
+func (s *Service) startNotificationListener() {
+	if s.sandbox == nil {
+		return
+	}
+
+	sandboxID := s.sandbox.ID
+	listener := agent.NewNotificationListener(s.log.WithField("sandbox_id", sandboxID), func(n agent.Notification) {
+		// Handle off the listener's goroutine so stopping the listener
+		// with s.mu held cannot deadlock.
+		go s.handleNotification(sandboxID, n)
+	})
+	if err := listener.Start(s.ctx, s.sandbox.VsockPath); err != nil {
+		s.log.WithError(err).Warn("Failed to start notification listener")
+		return
+	}
+	s.notifications = listener
+}
+
+// stopNotificationListener stops receiving container notifications. Must be
+// called with s.mu held.
+func (s *Service) stopNotificationListener() {
+	if s.notifications != nil {
+		s.notifications.Stop()
+		s.notifications = nil
+	}
+}
+
+// handleNotification records a container event reported by the guest.
+func (s *Service) handleNotification(sandboxID string, n agent.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sandbox == nil || s.sandbox.ID != sandboxID {
+		return
+	}
+
+	switch n.Type {
+	case agent.NotifyExit:
+		s.handleExit(n)
+	case agent.NotifyOOM:
+		s.handleOOM(n)
+	default:
+		s.log.WithField("type", n.Type).Debug("Ignoring unknown notification")
+	}
+}
+
+// handleExit records a container exit. Must be called with s.mu held.
+func (s *Service) handleExit(n agent.Notification) {
+	for _, proc := range s.processes {
+		// A restart may have replaced the process that exited
+		if proc.containerID != n.ContainerID || proc.pid != n.PID {
+			continue
+		}
+		exitedAt := n.Time
+		if exitedAt.IsZero() {
+			exitedAt = time.Now()
+		}
+		s.setExited(proc, n.ExitCode, exitedAt)
+		s.saveState()
+		return
+	}
+}
+
+// handleOOM publishes TaskOOM for a process the guest OOM killer killed.
+// The guest reports the kill ahead of any exit it caused, so TaskOOM
+// precedes TaskExit. Must be called with s.mu held.
+func (s *Service) handleOOM(n agent.Notification) {
+	if _, ok := s.processes[n.ContainerID]; !ok {
+		return
+	}
+
+	s.log.WithField("id", n.ContainerID).Warn("Container process killed by OOM killer")
+	metrics.Global().RecordOOMKill()
+	s.emit(&eventstypes.TaskOOM{ContainerID: n.ContainerID})
+}
+
+// reconcileExits asks the agent about processes that were running when the
+// shim last saved state, in case they exited while it was down. Must be
+// called with s.mu held.
+func (s *Service) reconcileExits() {
+	if s.agentClient == nil {
+		return
+	}
+
+	for _, proc := range s.processes {
+		if proc.pid == 0 || !proc.exitedAt.IsZero() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, recoveryTimeout)
+		status, err := s.agentClient.GetContainerStatus(ctx, proc.containerID)
+		cancel()
+		if err != nil {
+			s.log.WithError(err).WithField("id", proc.id).Warn("Failed to reconcile process state")
+			continue
+		}
+		if !status.Exited || status.PID != proc.pid {
+			continue
+		}
+		exitedAt := status.ExitedAt
+		if exitedAt.IsZero() {
+			exitedAt = time.Now()
+		}
+		s.setExited(proc, status.ExitCode, exitedAt)
+	}
+}
+
+// forwardEvents publishes queued events to containerd until the shim shuts
+// down, then flushes whatever is left so the final TaskDelete isn't lost.
+func (s *Service) forwardEvents() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.flushEvents()
+			return
+		case e := <-s.events:
+			s.publish(s.ctx, e)
+		}
+	}
+}
+
+// flushEvents publishes events still queued after the shim context ended.
+func (s *Service) flushEvents() {
+	ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), s.namespace), flushTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case e := <-s.events:
+			s.publish(ctx, e)
+		default:
+			return
+		}
+	}
+}
+
+func (s *Service) publish(ctx context.Context, e interface{}) {
+	if err := s.publisher.Publish(ctx, getTopic(e), e); err != nil {
+		s.log.WithError(err).WithField("topic", getTopic(e)).Warn("Failed to publish event")
+	}
+}
+
+// getTopic returns the containerd event topic for an event.
+func getTopic(e interface{}) string {
+	switch e.(type) {
+	case *eventstypes.TaskCreate:
+		return runtime.TaskCreateEventTopic
+	case *eventstypes.TaskStart:
+		return runtime.TaskStartEventTopic
+	case *eventstypes.TaskOOM:
+		return runtime.TaskOOMEventTopic
+	case *eventstypes.TaskExit:
+		return runtime.TaskExitEventTopic
+	case *eventstypes.TaskDelete:
+		return runtime.TaskDeleteEventTopic
+	case *eventstypes.TaskPaused:
+		return runtime.TaskPausedEventTopic
+	case *eventstypes.TaskResumed:
+		return runtime.TaskResumedEventTopic
+	case *AgentUnresponsive:
+		return AgentUnresponsiveEventTopic
+	case *AgentRecovered:
+		return AgentRecoveredEventTopic
+	case *CreateProgress:
+		return CreateProgressEventTopic
+	default:
+		return runtime.TaskUnknownTopic
+	}
+}
@@ -0,0 +1,147 @@
+package shim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+func newEventTestService(queue int) *Service {
+	return &Service{
+		events: make(chan interface{}, queue),
+		log:    logrus.NewEntry(logrus.New()),
+	}
+}
+
+func TestGetTopic(t *testing.T) {
+	tests := []struct {
+		event interface{}
+		want  string
+	}{
+		{&eventstypes.TaskCreate{}, "/tasks/create"},
+		{&eventstypes.TaskStart{}, "/tasks/start"},
+		{&eventstypes.TaskOOM{}, "/tasks/oom"},
+		{&eventstypes.TaskExit{}, "/tasks/exit"},
+		{&eventstypes.TaskDelete{}, "/tasks/delete"},
+		{&eventstypes.TaskPaused{}, "/tasks/paused"},
+		{&eventstypes.TaskResumed{}, "/tasks/resumed"},
+		{&AgentUnresponsive{}, "/tasks/agent-unresponsive"},
+		{&AgentRecovered{}, "/tasks/agent-recovered"},
+		{&CreateProgress{}, "/tasks/create-progress"},
+		{nil, "/tasks/?"},
+	}
+
+	for _, tt := range tests {
+		if got := getTopic(tt.event); got != tt.want {
+			t.Errorf("getTopic(%T) = %s, want %s", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestSetExited(t *testing.T) {
+	s := newEventTestService(8)
+	proc := &processState{id: "c1", containerID: "c1", pid: 42, done: make(chan struct{})}
+
+	exitedAt := time.Now()
+	s.setExited(proc, 137, exitedAt)
+
+	select {
+	case <-proc.done:
+	default:
+		t.Fatal("done not closed on exit")
+	}
+	if proc.exitStatus != 137 || !proc.exitedAt.Equal(exitedAt) {
+		t.Errorf("exit = %d at %v, want 137 at %v", proc.exitStatus, proc.exitedAt, exitedAt)
+	}
+
+	exit, ok := (<-s.events).(*eventstypes.TaskExit)
+	if !ok {
+		t.Fatal("event is not TaskExit")
+	}
+	if exit.ContainerID != "c1" || exit.ID != "c1" || exit.Pid != 42 || exit.ExitStatus != 137 {
+		t.Errorf("TaskExit = %+v", exit)
+	}
+
+	// A second exit is ignored
+	s.setExited(proc, 0, time.Now())
+	if len(s.events) != 0 || proc.exitStatus != 137 {
+		t.Error("setExited re-recorded an exited process")
+	}
+}
+
+func TestHandleNotification(t *testing.T) {
+	s := newEventTestService(8)
+	s.runtimeDir = t.TempDir()
+	s.sandbox = domain.NewSandbox("sb-1")
+	proc := &processState{id: "c1", containerID: "c1", pid: 42, done: make(chan struct{})}
+	s.processes = map[string]*processState{"c1": proc}
+
+	// An exit of a process that has since been restarted is ignored
+	s.handleNotification("sb-1", agent.Notification{Type: agent.NotifyExit, ContainerID: "c1", PID: 7, ExitCode: 1})
+	if !proc.exitedAt.IsZero() {
+		t.Fatal("exit of a replaced process was recorded")
+	}
+
+	// As is an exit for another sandbox
+	s.handleNotification("sb-2", agent.Notification{Type: agent.NotifyExit, ContainerID: "c1", PID: 42, ExitCode: 1})
+	if !proc.exitedAt.IsZero() {
+		t.Fatal("exit for another sandbox was recorded")
+	}
+
+	// An OOM kill is published and counted without ending the task
+	ooms := metrics.Global().GetSnapshot().OOMKills
+	s.handleNotification("sb-1", agent.Notification{Type: agent.NotifyOOM, ContainerID: "c1", PID: 50})
+	if oom, ok := (<-s.events).(*eventstypes.TaskOOM); !ok || oom.ContainerID != "c1" {
+		t.Fatalf("event = %v, want TaskOOM for c1", oom)
+	}
+	if got := metrics.Global().GetSnapshot().OOMKills; got != ooms+1 {
+		t.Errorf("OOMKills = %d, want %d", got, ooms+1)
+	}
+	if !proc.exitedAt.IsZero() {
+		t.Fatal("OOM kill was recorded as an exit")
+	}
+
+	s.handleNotification("sb-1", agent.Notification{Type: agent.NotifyExit, ContainerID: "c1", PID: 42, ExitCode: 3, Time: time.Now()})
+	select {
+	case <-proc.done:
+	default:
+		t.Fatal("Wait would not unblock after exit")
+	}
+	if proc.exitStatus != 3 {
+		t.Errorf("exit status = %d, want 3", proc.exitStatus)
+	}
+}
+
+func TestEmitDropsWhenFull(t *testing.T) {
+	s := newEventTestService(1)
+	s.emit(&eventstypes.TaskStart{ContainerID: "a"})
+	s.emit(&eventstypes.TaskStart{ContainerID: "b"})
+
+	if len(s.events) != 1 {
+		t.Fatalf("queued %d events, want 1", len(s.events))
+	}
+	if start := (<-s.events).(*eventstypes.TaskStart); start.ContainerID != "a" {
+		t.Errorf("queued event for %s, want a", start.ContainerID)
+	}
+}
+
+func TestForwardEventsFlushesOnShutdown(t *testing.T) {
+	s := newEventTestService(8)
+	publisher := &MockPublisher{}
+	s.publisher = publisher
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.emit(&eventstypes.TaskDelete{ContainerID: "c1"})
+	s.cancel()
+	s.forwardEvents()
+
+	if len(publisher.events) != 1 {
+		t.Fatalf("published %d events, want 1", len(publisher.events))
+	}
+}
@@ -0,0 +1,78 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+const (
+	// annotationContainerType is set by the CRI plugin; the sandbox
+	// container's settings apply to the whole guest.
+	annotationContainerType = "io.kubernetes.cri.container-type"
+	containerTypeSandbox    = "sandbox"
+)
+
+// caBundleDir holds the CA bundles pods may ask for. Pods can only pick a
+// bundle by name, never read arbitrary host files.
+var caBundleDir = "/etc/fc-cri/ca-bundles"
+
+// guestSettings are the guest settings requested by a task's annotations.
+type guestSettings struct {
+	target   string // Container ID, or empty for the whole guest
+	timezone string
+	caBundle string // Host path of the CA bundle
+}
+
+// parseGuestSettings reads the guest settings requested for a task. The
+// pod sandbox's settings apply to the guest, other containers' to just
+// that container.
+func parseGuestSettings(id string, annotations map[string]string) (guestSettings, error) {
+	settings := guestSettings{
+		timezone: annotations[annotation.Timezone],
+	}
+	if annotations[annotationContainerType] != containerTypeSandbox {
+		settings.target = id
+	}
+
+	if name := annotations[annotation.CABundle]; name != "" {
+		if !filepath.IsLocal(name) || filepath.Base(name) != name {
+			return settings, fmt.Errorf("invalid %s %q", annotation.CABundle, name)
+		}
+		settings.caBundle = filepath.Join(caBundleDir, name+".pem")
+	}
+	return settings, nil
+}
+
+// empty reports whether no settings were requested.
+func (g guestSettings) empty() bool {
+	return g.timezone == "" && g.caBundle == ""
+}
+
+// applyGuestSettings pushes the requested settings to the guest agent. Must
+// be called with s.mu held.
+func (s *Service) applyGuestSettings(ctx context.Context, settings guestSettings) error {
+	if settings.timezone != "" {
+		tzdata, err := agent.LoadTimezone(settings.timezone)
+		if err != nil {
+			return err
+		}
+		if err := s.agentClient.SetTimezone(ctx, settings.target, settings.timezone, tzdata); err != nil {
+			return err
+		}
+	}
+
+	if settings.caBundle != "" {
+		bundle, err := agent.LoadCABundle(settings.caBundle)
+		if err != nil {
+			return err
+		}
+		if err := s.agentClient.InstallCABundle(ctx, settings.target, bundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
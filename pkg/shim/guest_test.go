@@ -0,0 +1,60 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+func TestParseGuestSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        guestSettings
+		wantErr     bool
+	}{
+		{
+			name:        "none",
+			annotations: nil,
+			want:        guestSettings{target: "c1"},
+		},
+		{
+			name: "container",
+			annotations: map[string]string{
+				annotation.Timezone: "Europe/Berlin",
+				annotation.CABundle: "corp",
+			},
+			want: guestSettings{target: "c1", timezone: "Europe/Berlin", caBundle: "/etc/fc-cri/ca-bundles/corp.pem"},
+		},
+		{
+			name: "sandbox applies to the guest",
+			annotations: map[string]string{
+				annotationContainerType: containerTypeSandbox,
+				annotation.Timezone:     "UTC",
+			},
+			want: guestSettings{timezone: "UTC"},
+		},
+		{
+			name:        "bundle outside the bundle directory",
+			annotations: map[string]string{annotation.CABundle: "../../etc/shadow"},
+			wantErr:     true,
+		},
+		{
+			name:        "bundle in a subdirectory",
+			annotations: map[string]string{annotation.CABundle: "team/corp"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGuestSettings("c1", tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGuestSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseGuestSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// recoveryTimeout bounds each agent call made while recovering a
+	// silent sandbox; a hung guest must not wedge the shim.
+	recoveryTimeout = 10 * time.Second
+
+	// restartTimeout bounds replacing the VM of a sandbox whose agent
+	// stopped answering, from booting it to restarting its container.
+	restartTimeout = 2 * time.Minute
+
+	// recycledExitStatus is reported for processes killed by a VM recycle
+	// or a VMM crash, matching a SIGKILL'd process.
+	recycledExitStatus = 137
+)
+
+// startHeartbeat begins monitoring guest heartbeats for the current
+// sandbox for the lifetime of the shim. Must be called with s.mu held.
+func (s *Service) startHeartbeat() {
+	if s.sandbox == nil {
+		return
+	}
+
+	sandboxID := s.sandbox.ID
+	monitor := agent.NewHeartbeatMonitor(s.heartbeatConfig, s.log.WithField("sandbox_id", sandboxID), func(missed int) {
+		// Recover off the monitor's goroutine so stopping the monitor
+		// from within recovery cannot deadlock.
+		go s.handleUnhealthy(sandboxID, missed)
+	})
+	if err := monitor.Start(s.ctx, s.sandbox.VsockPath); err != nil {
+		s.log.WithError(err).Warn("Failed to start heartbeat monitor")
+		return
+	}
+	s.heartbeat = monitor
+}
+
+// stopHeartbeat stops heartbeat monitoring. Must be called with s.mu held.
+func (s *Service) stopHeartbeat() {
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+		s.heartbeat = nil
+	}
+}
+
+// handleUnhealthy applies the configured recovery policy to a sandbox whose
+// guest stopped sending heartbeats.
+func (s *Service) handleUnhealthy(sandboxID string, missed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The sandbox may have been released while we were waiting for the lock
+	if s.sandbox == nil || s.sandbox.ID != sandboxID {
+		return
+	}
+
+	log := s.log.WithFields(logrus.Fields{
+		"sandbox_id": sandboxID,
+		"missed":     missed,
+		"policy":     s.heartbeatConfig.Policy,
+	})
+
+	switch s.heartbeatConfig.Policy {
+	case agent.PolicyRestart:
+		err := s.restartWorkload()
+		if err == nil {
+			log.Info("Restarted workload of unresponsive sandbox")
+			return
+		}
+		log.WithError(err).Warn("Failed to restart workload, recycling VM")
+		s.recycleSandbox("unresponsive")
+
+	case agent.PolicyRecycle:
+		s.recycleSandbox("unresponsive")
+
+	default:
+		log.Warn("Sandbox is unhealthy")
+	}
+}
+
+// restartWorkload stops and restarts every running container in the
+// sandbox. Must be called with s.mu held.
+func (s *Service) restartWorkload() error {
+	if s.agentClient == nil {
+		return fmt.Errorf("no agent connection")
+	}
+
+	for _, proc := range s.processes {
+		if proc.id != proc.containerID || proc.pid == 0 || !proc.exitedAt.IsZero() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, recoveryTimeout)
+		err := s.agentClient.StopContainer(ctx, proc.containerID, recoveryTimeout/2)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to stop container %s: %w", proc.containerID, err)
+		}
+
+		ctx, cancel = context.WithTimeout(s.ctx, recoveryTimeout)
+		pid, err := s.agentClient.StartContainer(ctx, proc.containerID)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to start container %s: %w", proc.containerID, err)
+		}
+		proc.pid = pid
+	}
+
+	s.saveState()
+	return nil
+}
+
+// heartbeatConfig returns the guest heartbeats' settings for the [agent]
+// section. Invalid values keep the defaults.
+func heartbeatConfig(c config.AgentConfig) agent.HeartbeatConfig {
+	heartbeat := agent.DefaultHeartbeatConfig()
+	if c.HeartbeatPort > 0 {
+		heartbeat.Port = c.HeartbeatPort
+	}
+	// The guest agent ignores shorter intervals, and would beat less often
+	// than expected
+	if c.HeartbeatInterval >= vm.MinAgentHeartbeatInterval {
+		heartbeat.Interval = c.HeartbeatInterval
+	}
+	if c.HeartbeatMissedBeats >= 1 {
+		heartbeat.MissedBeats = c.HeartbeatMissedBeats
+	}
+	switch policy := agent.RecoveryPolicy(c.HeartbeatPolicy); policy {
+	case agent.PolicyAlert, agent.PolicyRestart, agent.PolicyRecycle:
+		heartbeat.Policy = policy
+	}
+	return heartbeat
+}
+
+// livenessConfig returns the agent liveness checks' settings for the
+// [agent] section. Invalid values keep the defaults.
+func livenessConfig(c config.AgentConfig) agent.LivenessConfig {
+	liveness := agent.DefaultLivenessConfig()
+	if c.LivenessInterval >= 0 {
+		liveness.Interval = c.LivenessInterval
+	}
+	if c.LivenessWindow > 0 {
+		liveness.Window = c.LivenessWindow
+	}
+	liveness.RestartVM = c.LivenessRestartVM
+	return liveness
+}
+
+// startLiveness begins pinging the agent of the current sandbox. Must be
+// called with s.mu held.
+func (s *Service) startLiveness() {
+	if s.sandbox == nil || s.agentClient == nil {
+		return
+	}
+
+	sandboxID := s.sandbox.ID
+	client := s.agentClient
+	// Handle off the watchdog's goroutine so stopping the watchdog from
+	// within the handlers cannot deadlock.
+	watchdog := agent.NewLivenessWatchdog(s.livenessConfig, s.log.WithField("sandbox_id", sandboxID), client.Ping, client.Reconnect,
+		func(silent time.Duration) { go s.handleAgentDown(sandboxID, silent) },
+		func() { go s.handleAgentUp(sandboxID) })
+	watchdog.Start(s.ctx)
+	s.liveness = watchdog
+}
+
+// stopLiveness stops pinging the agent. Must be called with s.mu held.
+func (s *Service) stopLiveness() {
+	if s.liveness != nil {
+		s.liveness.Stop()
+		s.liveness = nil
+	}
+	s.agentDown = false
+}
+
+// handleAgentDown marks a sandbox whose agent stopped answering as not
+// ready and, if configured, replaces its VM.
+func (s *Service) handleAgentDown(sandboxID string, silent time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The sandbox may have been released, or the agent come back, while
+	// we were waiting for the lock
+	if s.sandbox == nil || s.sandbox.ID != sandboxID || s.liveness == nil || !s.liveness.Down() {
+		return
+	}
+
+	log := s.log.WithFields(logrus.Fields{
+		"sandbox_id": sandboxID,
+		"silent":     silent,
+	})
+	log.Warn("Guest agent is unresponsive, marking sandbox not ready")
+	s.agentDown = true
+	metrics.Global().RecordComponentEvent(metrics.ComponentAgent, metrics.EventUnresponsive)
+	s.emit(&AgentUnresponsive{
+		ContainerID: s.id,
+		SandboxID:   sandboxID,
+		Silent:      silent.String(),
+		RestartVM:   s.livenessConfig.RestartVM,
+	})
+
+	if !s.livenessConfig.RestartVM {
+		return
+	}
+	if err := s.restartSandbox(); err != nil {
+		log.WithError(err).Warn("Failed to restart VM, recycling it")
+		s.recycleSandbox("restart failed")
+		return
+	}
+	log.WithField("new_sandbox_id", s.sandbox.ID).Info("Restarted VM of unresponsive sandbox")
+	s.emit(&AgentRecovered{
+		ContainerID: s.id,
+		SandboxID:   s.sandbox.ID,
+		RestartedVM: true,
+	})
+}
+
+// handleAgentUp marks a sandbox whose agent answers again as ready.
+func (s *Service) handleAgentUp(sandboxID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sandbox == nil || s.sandbox.ID != sandboxID || !s.agentDown || s.liveness == nil || s.liveness.Down() {
+		return
+	}
+
+	s.log.WithField("sandbox_id", sandboxID).Info("Guest agent is answering again, marking sandbox ready")
+	s.agentDown = false
+	s.emit(&AgentRecovered{
+		ContainerID: s.id,
+		SandboxID:   sandboxID,
+	})
+}
+
+// restartPlan is what restarting a sandbox's container needs, gathered
+// before anything is torn down.
+type restartPlan struct {
+	initProc    *processState
+	annotations map[string]string
+	settings    guestSettings
+	mtls        []network.PortMapping
+}
+
+// planRestart checks the container of the current sandbox can be created
+// again and gathers what that takes. Must be called with s.mu held.
+func (s *Service) planRestart() (*restartPlan, error) {
+	plan := &restartPlan{}
+	for _, proc := range s.processes {
+		if proc.id == proc.containerID {
+			plan.initProc = proc
+		}
+	}
+	if plan.initProc == nil {
+		return nil, fmt.Errorf("sandbox has no container")
+	}
+
+	plan.annotations = podAnnotations(s.bundle)
+	// Create took the secrets out of the bundle, so they can't be injected again
+	if len(annotation.SplitList(plan.annotations[annotation.SecretEnv])) > 0 {
+		return nil, fmt.Errorf("container %s has secret environment variables", plan.initProc.containerID)
+	}
+	var err error
+	if plan.settings, err = parseGuestSettings(plan.initProc.containerID, plan.annotations); err != nil {
+		return nil, err
+	}
+	if plan.mtls, err = mtlsPorts(plan.annotations); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// restartSandbox replaces the VM of a sandbox whose agent stopped answering
+// with a new one of the same configuration, and recreates its container
+// there under the same ID. Processes exec'd into the old VM are reported
+// as exited. Must be called with s.mu held.
+func (s *Service) restartSandbox() error {
+	plan, err := s.planRestart()
+	if err != nil {
+		return err
+	}
+
+	old := s.sandbox
+	s.log.WithField("sandbox_id", old.ID).Warn("Restarting VM of unresponsive sandbox")
+	s.discardVM()
+	_ = s.runHooks(s.ctx, hooks.EventStop, plan.initProc)
+	_ = s.runHooks(s.ctx, hooks.EventDestroy, plan.initProc)
+	s.removeState(old.ID)
+	metrics.Global().RemoveSandbox(old.ID)
+	metrics.Global().RecordComponentEvent(metrics.ComponentVMM, metrics.EventRestart)
+	s.sandbox = nil
+	s.exitExecs(plan.initProc)
+
+	ctx, cancel := context.WithTimeout(s.ctx, restartTimeout)
+	defer cancel()
+	sandbox, err := s.vmPool.Acquire(ctx, old.VMConfig)
+	if err != nil {
+		return fmt.Errorf("failed to acquire VM: %w", err)
+	}
+	s.sandbox = sandbox
+	if err := s.setupSandbox(ctx, plan.annotations, plan.mtls); err != nil {
+		return err
+	}
+
+	if err := s.recreateContainer(ctx, plan); err != nil {
+		return err
+	}
+	if err := s.runHooks(ctx, hooks.EventCreate, plan.initProc); err != nil {
+		return fmt.Errorf("create hook failed: %w", err)
+	}
+	if err := s.restartContainer(ctx, plan.initProc); err != nil {
+		return err
+	}
+
+	s.saveState()
+	return nil
+}
+
+// rebootSandbox reboots the VM of the current sandbox in place and
+// recreates its container there under the same ID. Unlike restartSandbox,
+// the sandbox keeps its ID, addresses, MAC and rootfs. Processes exec'd
+// into the VM are reported as exited. Must be called with s.mu held.
+func (s *Service) rebootSandbox(plan *restartPlan) error {
+	sandbox := s.sandbox
+	s.log.WithField("sandbox_id", sandbox.ID).Warn("Rebooting VM of sandbox")
+	s.detachVM()
+	_ = s.runHooks(s.ctx, hooks.EventStop, plan.initProc)
+	s.exitExecs(plan.initProc)
+
+	ctx, cancel := context.WithTimeout(s.ctx, restartTimeout)
+	defer cancel()
+	if err := s.vmManager.RebootVM(ctx, sandbox); err != nil {
+		return fmt.Errorf("failed to reboot VM: %w", err)
+	}
+	metrics.Global().RecordComponentEvent(metrics.ComponentVMM, metrics.EventRestart)
+	s.saveState()
+	if err := s.setupSandbox(ctx, plan.annotations, plan.mtls); err != nil {
+		return err
+	}
+
+	if err := s.recreateContainer(ctx, plan); err != nil {
+		return err
+	}
+	if err := s.restartContainer(ctx, plan.initProc); err != nil {
+		return err
+	}
+
+	s.saveState()
+	return nil
+}
+
+// exitExecs reports every process of the sandbox but its container as
+// exited. Must be called with s.mu held.
+func (s *Service) exitExecs(initProc *processState) {
+	now := time.Now()
+	for _, proc := range s.processes {
+		if proc != initProc {
+			s.setExited(proc, recycledExitStatus, now)
+		}
+	}
+}
+
+// recreateContainer creates the container of a restart plan in the guest
+// of the current sandbox. Must be called with s.mu held.
+func (s *Service) recreateContainer(ctx context.Context, plan *restartPlan) error {
+	initProc := plan.initProc
+	containerSpec := &domain.ContainerSpec{
+		ID:         initProc.containerID,
+		BundlePath: s.bundle,
+		Stdin:      initProc.stdin != "",
+		Stdout:     initProc.stdout != "",
+		Stderr:     initProc.stderr != "",
+		Terminal:   initProc.terminal,
+	}
+	if err := s.agentClient.CreateContainer(ctx, containerSpec); err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	if !plan.settings.empty() {
+		if err := s.applyGuestSettings(ctx, plan.settings); err != nil {
+			return fmt.Errorf("failed to apply guest settings: %w", err)
+		}
+	}
+	return nil
+}
+
+// restartContainer starts a recreated container again if it was running.
+// Must be called with s.mu held.
+func (s *Service) restartContainer(ctx context.Context, initProc *processState) error {
+	if initProc.pid <= 0 || !initProc.exitedAt.IsZero() {
+		return nil
+	}
+	pid, err := s.agentClient.StartContainer(ctx, initProc.containerID)
+	if err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	initProc.pid = pid
+	if err := s.runHooks(ctx, hooks.EventStart, initProc); err != nil {
+		return fmt.Errorf("start hook failed: %w", err)
+	}
+	return nil
+}
+
+// discardVM stops everything around the VM of the current sandbox and
+// destroys it. Must be called with s.mu held.
+func (s *Service) discardVM() {
+	sandbox := s.sandbox
+	s.detachVM()
+
+	ctx, cancel := context.WithTimeout(s.ctx, recoveryTimeout)
+	defer cancel()
+	if err := s.vmPool.Discard(ctx, sandbox); err != nil {
+		s.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Error destroying VM")
+	}
+}
+
+// detachVM stops everything around the VM of the current sandbox and
+// closes the agent connection. Must be called with s.mu held.
+func (s *Service) detachVM() {
+	s.stopHeartbeat()
+	s.stopLiveness()
+	s.stopNotificationListener()
+	s.stopAgentLogs()
+	s.stopMTLSProxy()
+	s.stopServiceRouter()
+	s.stopControl()
+
+	if s.agentClient != nil {
+		_ = s.agentClient.Close()
+		s.agentClient = nil
+	}
+}
+
+// handleVMMExit cleans up after the VMM of the current sandbox exited
+// unexpectedly: its processes are reported as exited, and its network,
+// volumes and runtime directory are released.
+func (s *Service) handleVMMExit(sandboxID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The sandbox may have been released while we were waiting for the lock
+	if s.sandbox == nil || s.sandbox.ID != sandboxID {
+		return
+	}
+	s.recycleSandbox("vmm exited")
+}
+
+// recycleSandbox destroys the VM of a broken sandbox, if it still has one,
+// and marks all of its processes as exited so containerd can replace the
+// task. Must be called with s.mu held.
+func (s *Service) recycleSandbox(reason string) {
+	sandbox := s.sandbox
+	if sandbox != nil {
+		s.log.WithFields(logrus.Fields{
+			"sandbox_id": sandbox.ID,
+			"reason":     reason,
+		}).Warn("Recycling VM")
+		s.discardVM()
+	}
+
+	now := time.Now()
+	for _, proc := range s.processes {
+		s.setExited(proc, recycledExitStatus, now)
+	}
+	if sandbox == nil {
+		return
+	}
+	_ = s.runHooks(s.ctx, hooks.EventStop, nil)
+	_ = s.runHooks(s.ctx, hooks.EventDestroy, nil)
+
+	s.removeState(sandbox.ID)
+	metrics.Global().RemoveSandbox(sandbox.ID)
+	s.sandbox = nil
+}
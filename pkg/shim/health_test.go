@@ -0,0 +1,59 @@
+package shim
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHeartbeatConfig(t *testing.T) {
+	if c := heartbeatConfig(config.Default().Agent); c != agent.DefaultHeartbeatConfig() {
+		t.Errorf("heartbeatConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[agent]\nheartbeat_port = 2025\nheartbeat_interval = \"2s\"\nheartbeat_missed_beats = 3\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_AGENT_HEARTBEAT_POLICY", "recycle")
+
+	log := logrus.NewEntry(logrus.New())
+	want := agent.HeartbeatConfig{Port: 2025, Interval: 2 * time.Second, MissedBeats: 3, Policy: agent.PolicyRecycle}
+	if c := heartbeatConfig(loadConfig(path, log).Agent); c != want {
+		t.Errorf("heartbeatConfig() = %+v, want %+v", c, want)
+	}
+
+	// Invalid values keep the defaults
+	invalid := config.AgentConfig{HeartbeatMissedBeats: 0, HeartbeatInterval: time.Millisecond, HeartbeatPolicy: "reboot"}
+	if c := heartbeatConfig(invalid); c != agent.DefaultHeartbeatConfig() {
+		t.Errorf("heartbeatConfig() with invalid values = %+v, want the defaults", c)
+	}
+}
+
+func TestLivenessConfig(t *testing.T) {
+	if c := livenessConfig(config.Default().Agent); c != agent.DefaultLivenessConfig() {
+		t.Errorf("livenessConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[agent]\nliveness_interval = \"0s\"\nliveness_window = \"1m\"\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FC_CRI_AGENT_LIVENESS_RESTART_VM", "true")
+
+	want := agent.DefaultLivenessConfig()
+	want.Interval = 0
+	want.Window = time.Minute
+	want.RestartVM = true
+	if c := livenessConfig(loadConfig(path, logrus.NewEntry(logrus.New())).Agent); c != want {
+		t.Errorf("livenessConfig() = %+v, want %+v", c, want)
+	}
+}
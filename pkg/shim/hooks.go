@@ -0,0 +1,37 @@
+package shim
+
+import (
+	"context"
+
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+)
+
+// runHooks runs the lifecycle hooks subscribed to an event of the current
+// sandbox. proc is the sandbox's init process, if it has one yet. Must be
+// called with s.mu held.
+func (s *Service) runHooks(ctx context.Context, event string, proc *processState) error {
+	if s.sandbox == nil {
+		return nil
+	}
+
+	annotations := bundleAnnotations(s.bundle)
+	payload := hooks.Payload{
+		Event:     event,
+		SandboxID: s.sandbox.ID,
+		Pod: hooks.Pod{
+			Name:      annotations[annotationSandboxName],
+			Namespace: annotations[annotationSandboxNamespace],
+			UID:       annotations[annotationSandboxUID],
+		},
+		Annotations: annotations,
+	}
+	if proc != nil {
+		payload.ContainerID = proc.containerID
+		payload.PID = proc.pid
+		if !proc.exitedAt.IsZero() {
+			status := proc.exitStatus
+			payload.ExitStatus = &status
+		}
+	}
+	return s.hooks.Run(ctx, payload)
+}
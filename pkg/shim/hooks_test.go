@@ -0,0 +1,71 @@
+package shim
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRunHooks(t *testing.T) {
+	var received []hooks.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p hooks.Payload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		received = append(received, p)
+	}))
+	defer server.Close()
+
+	hooksDir := t.TempDir()
+	hook := `{"events": ["create", "stop"], "url": "` + server.URL + `"}`
+	if err := os.WriteFile(filepath.Join(hooksDir, "cmdb.json"), []byte(hook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := hooks.DefaultConfig()
+	config.Dir = hooksDir
+	runner, err := hooks.Load(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := t.TempDir()
+	spec := `{"annotations": {"` + annotationSandboxName + `": "web-0", "` + annotationSandboxNamespace + `": "shop", "` + annotationSandboxUID + `": "uid-1"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{hooks: runner, bundle: bundle, log: logrus.NewEntry(logrus.New())}
+
+	// Without a sandbox there is nothing to report
+	if err := s.runHooks(context.Background(), hooks.EventCreate, nil); err != nil || len(received) != 0 {
+		t.Fatalf("runHooks() = %v, delivered %d", err, len(received))
+	}
+
+	s.sandbox = domain.NewSandbox("fc-1")
+	if err := s.runHooks(context.Background(), hooks.EventCreate, nil); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+	proc := &processState{id: "c1", containerID: "c1", pid: 42, exitStatus: 3, exitedAt: time.Now()}
+	if err := s.runHooks(context.Background(), hooks.EventStop, proc); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("delivered %d payloads, want 2", len(received))
+	}
+	create, stop := received[0], received[1]
+	if create.SandboxID != "fc-1" || create.Pod != (hooks.Pod{Name: "web-0", Namespace: "shop", UID: "uid-1"}) {
+		t.Errorf("create payload = %+v", create)
+	}
+	if stop.ContainerID != "c1" || stop.PID != 42 || stop.ExitStatus == nil || *stop.ExitStatus != 3 {
+		t.Errorf("stop payload = %+v", stop)
+	}
+}
@@ -0,0 +1,21 @@
+package shim
+
+import (
+	"fmt"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// hostPorts returns the host ports a pod asked to have forwarded.
+func hostPorts(annotations map[string]string) ([]domain.PortMapping, error) {
+	var mappings []domain.PortMapping
+	for _, item := range annotation.SplitList(annotations[annotation.HostPorts]) {
+		pm, err := annotation.ParseHostPort(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %w", annotation.HostPorts, item, err)
+		}
+		mappings = append(mappings, pm)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,37 @@
+package shim
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestHostPorts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []domain.PortMapping
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"8080:80", []domain.PortMapping{{HostPort: 8080, ContainerPort: 80}}, false},
+		{"8080:80/TCP, 192.168.1.10:5353:53/udp", []domain.PortMapping{
+			{Protocol: "tcp", HostPort: 8080, ContainerPort: 80},
+			{Protocol: "udp", HostPort: 5353, ContainerPort: 53, HostIP: "192.168.1.10"},
+		}, false},
+		{"[fd00::1]:8080:80", []domain.PortMapping{{HostPort: 8080, ContainerPort: 80, HostIP: "fd00::1"}}, false},
+		{"8080", nil, true},
+		{"8080:http", nil, true},
+		{"70000:80", nil, true},
+		{"8080:80/icmp", nil, true},
+		{"node1:8080:80", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := hostPorts(map[string]string{annotation.HostPorts: tt.value})
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hostPorts(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package shim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+)
+
+// kernelName returns the kernel a pod asked for, or "" for the default.
+func kernelName(annotations map[string]string) (string, error) {
+	name := annotations[annotation.Kernel]
+	if name == "" {
+		return "", nil
+	}
+	if err := kernel.ValidateName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// selectKernel points a VM config at the kernel requested by the
+// annotations, verifying (and if needed fetching) it first.
+func (s *Service) selectKernel(ctx context.Context, vmConfig *domain.VMConfig, annotations map[string]string) error {
+	name, err := kernelName(annotations)
+	if err != nil {
+		return errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if name == "" {
+		return nil
+	}
+
+	k, err := s.kernels.Resolve(ctx, name)
+	if errors.Is(err, kernel.ErrNotFound) {
+		return errdefs.ToGRPCf(errdefs.ErrNotFound, "%v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve kernel: %w", err)
+	}
+
+	s.log.WithField("kernel", name).Info("Using kernel from kernel store")
+	vmConfig.KernelPath = k.KernelPath
+	vmConfig.InitrdPath = k.InitrdPath
+	if k.Args != "" {
+		vmConfig.KernelArgs = k.Args
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package shim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/sirupsen/logrus"
+)
+
+func TestKernelName(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{nil, "", false},
+		{map[string]string{annotation.Kernel: "6.1-minimal"}, "6.1-minimal", false},
+		{map[string]string{annotation.DeprecatedPrefix + "kernel": "5.10"}, "5.10", false},
+		{map[string]string{annotation.Kernel: "6.1", annotation.DeprecatedPrefix + "kernel": "5.10"}, "6.1", false},
+		{map[string]string{annotation.Kernel: "../../etc"}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := kernelName(annotation.Normalize(tt.annotations))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("kernelName(%v) = %q, %v, want %q", tt.annotations, got, err, tt.want)
+		}
+	}
+}
+
+func TestSelectKernel(t *testing.T) {
+	dir := t.TempDir()
+	vmlinux := []byte("kernel image")
+	sum := sha256.Sum256(vmlinux)
+	manifest, _ := json.Marshal(kernel.Manifest{
+		Kernel: kernel.Artifact{SHA256: hex.EncodeToString(sum[:])},
+		Args:   "console=ttyS0 quiet",
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "6.1-minimal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "6.1-minimal", kernel.ManifestFile), manifest, 0644)
+	os.WriteFile(filepath.Join(dir, "6.1-minimal", kernel.KernelFile), vmlinux, 0644)
+
+	log := logrus.NewEntry(logrus.New())
+	config := kernel.DefaultConfig()
+	config.Dir = dir
+	s := &Service{kernels: kernel.NewStore(config, log), log: log}
+
+	vmConfig := domain.DefaultVMConfig()
+	if err := s.selectKernel(context.Background(), &vmConfig, nil); err != nil || vmConfig.KernelPath != "" {
+		t.Fatalf("selectKernel() without annotation = %v, kernel %q", err, vmConfig.KernelPath)
+	}
+
+	annotations := map[string]string{annotation.Kernel: "6.1-minimal"}
+	if err := s.selectKernel(context.Background(), &vmConfig, annotations); err != nil {
+		t.Fatalf("selectKernel() error = %v", err)
+	}
+	if vmConfig.KernelPath != filepath.Join(dir, "6.1-minimal", kernel.KernelFile) || vmConfig.KernelArgs != "console=ttyS0 quiet" {
+		t.Errorf("vmConfig = %q %q", vmConfig.KernelPath, vmConfig.KernelArgs)
+	}
+
+	annotations[annotation.Kernel] = "missing"
+	if err := s.selectKernel(context.Background(), &vmConfig, annotations); err == nil {
+		t.Error("selectKernel() accepted a missing kernel")
+	}
+}
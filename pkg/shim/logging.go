@@ -0,0 +1,27 @@
+package shim
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pipeops/firecracker-cri/pkg/sandboxlog"
+)
+
+// sandboxLogConfig reads where the sandbox's logs go from the [log]
+// settings, which reach the shim through the environment.
+func sandboxLogConfig() sandboxlog.Config {
+	config := sandboxlog.DefaultConfig()
+	if output := os.Getenv("FC_CRI_LOG_SANDBOX_OUTPUT"); output != "" {
+		config.Output = output
+	}
+	if dir := os.Getenv("FC_CRI_LOG_SANDBOX_DIR"); dir != "" {
+		config.Dir = dir
+	}
+	if n, err := strconv.Atoi(os.Getenv("FC_CRI_LOG_SANDBOX_MAX_SIZE_MB")); err == nil && n > 0 {
+		config.MaxSizeMB = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("FC_CRI_LOG_SANDBOX_MAX_FILES")); err == nil && n >= 0 {
+		config.MaxFiles = n
+	}
+	return config
+}
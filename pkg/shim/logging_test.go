@@ -0,0 +1,23 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/sandboxlog"
+)
+
+func TestSandboxLogConfig(t *testing.T) {
+	if config := sandboxLogConfig(); config != sandboxlog.DefaultConfig() {
+		t.Errorf("sandboxLogConfig() = %+v, want the defaults", config)
+	}
+
+	t.Setenv("FC_CRI_LOG_SANDBOX_OUTPUT", "both")
+	t.Setenv("FC_CRI_LOG_SANDBOX_DIR", "/var/log/pods-fc")
+	t.Setenv("FC_CRI_LOG_SANDBOX_MAX_SIZE_MB", "50")
+	t.Setenv("FC_CRI_LOG_SANDBOX_MAX_FILES", "0")
+
+	want := sandboxlog.Config{Output: "both", Dir: "/var/log/pods-fc", MaxSizeMB: 50, MaxFiles: 0}
+	if config := sandboxLogConfig(); config != want {
+		t.Errorf("sandboxLogConfig() = %+v, want %+v", config, want)
+	}
+}
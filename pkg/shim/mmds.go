@@ -0,0 +1,67 @@
+package shim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// annotationSandboxUID is the pod UID set by the CRI plugin.
+const annotationSandboxUID = "io.kubernetes.cri.sandbox-uid"
+
+// mmdsConfig returns the MMDS configuration a pod asked for, or nil.
+func mmdsConfig(annotations map[string]string) (*domain.MMDSConfig, error) {
+	switch value := strings.ToLower(strings.TrimSpace(annotations[annotation.MMDS])); value {
+	case "", "false":
+		return nil, nil
+	case "true", "v2":
+		return &domain.MMDSConfig{Version: vm.MMDSVersionV2}, nil
+	case "v1":
+		return &domain.MMDSConfig{Version: vm.MMDSVersionV1}, nil
+	default:
+		return nil, fmt.Errorf("invalid %s annotation %q", annotation.MMDS, value)
+	}
+}
+
+// populateMetadata publishes the pod's identity and environment to the
+// sandbox's MMDS. Must be called with s.mu held, after recordSandboxMetrics
+// has set the pod identity on the sandbox.
+func (s *Service) populateMetadata(ctx context.Context, annotations map[string]string) error {
+	if s.sandbox.VMConfig.MMDS == nil {
+		return nil
+	}
+	metadata := vm.SandboxMetadata(s.sandbox, annotations[annotationSandboxUID], bundleEnv(s.bundle))
+	return s.vmManager.SetMetadata(ctx, s.sandbox, metadata)
+}
+
+// bundleEnv reads the process environment from a bundle's OCI spec.
+func bundleEnv(bundle string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil
+	}
+
+	var spec struct {
+		Process struct {
+			Env []string `json:"env"`
+		} `json:"process"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil
+	}
+
+	env := make(map[string]string, len(spec.Process.Env))
+	for _, kv := range spec.Process.Env {
+		if key, value, ok := strings.Cut(kv, "="); ok && key != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
@@ -0,0 +1,56 @@
+package shim
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+func TestMMDSConfig(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"false", "", false},
+		{"true", vm.MMDSVersionV2, false},
+		{"V2", vm.MMDSVersionV2, false},
+		{"v1", vm.MMDSVersionV1, false},
+		{"yes please", "", true},
+	}
+
+	for _, tt := range tests {
+		config, err := mmdsConfig(map[string]string{annotation.MMDS: tt.value})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mmdsConfig(%q) error = %v", tt.value, err)
+			continue
+		}
+		got := ""
+		if config != nil {
+			got = config.Version
+		}
+		if got != tt.want {
+			t.Errorf("mmdsConfig(%q) version = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBundleEnv(t *testing.T) {
+	bundle := t.TempDir()
+	spec := `{"process": {"env": ["PATH=/usr/bin", "DSN=a=b", "EMPTY=", "=bad", "NOVALUE"]}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := bundleEnv(bundle)
+	if len(env) != 3 || env["PATH"] != "/usr/bin" || env["DSN"] != "a=b" || env["EMPTY"] != "" {
+		t.Errorf("bundleEnv() = %v", env)
+	}
+	if bundleEnv(t.TempDir()) != nil {
+		t.Error("bundleEnv() of a bundle without a spec is not nil")
+	}
+}
@@ -0,0 +1,54 @@
+package shim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+// mtlsPorts returns the ports a pod asked the shim to terminate mTLS for.
+func mtlsPorts(annotations map[string]string) ([]network.PortMapping, error) {
+	var ports []network.PortMapping
+	for _, item := range annotation.SplitList(annotations[annotation.MTLSPorts]) {
+		listen, guest, found := strings.Cut(item, ":")
+		if !found {
+			guest = listen
+		}
+		listenPort, err := annotation.ParsePort(listen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %w", annotation.MTLSPorts, item, err)
+		}
+		guestPort, err := annotation.ParsePort(guest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %w", annotation.MTLSPorts, item, err)
+		}
+		ports = append(ports, network.PortMapping{ListenPort: listenPort, GuestPort: guestPort})
+	}
+	return ports, nil
+}
+
+// startMTLSProxy starts terminating mTLS for the current sandbox on the
+// given ports. Must be called with s.mu held.
+func (s *Service) startMTLSProxy(ports []network.PortMapping) error {
+	if s.sandbox == nil || len(ports) == 0 {
+		return nil
+	}
+
+	proxy, err := network.StartMTLSProxy(s.mtlsConfig, s.sandbox.Gateway, s.sandbox.IP, ports, s.log.WithField("sandbox_id", s.sandbox.ID))
+	if err != nil {
+		return err
+	}
+	s.mtlsProxy = proxy
+	return nil
+}
+
+// stopMTLSProxy stops terminating mTLS for the sandbox. Must be called with
+// s.mu held.
+func (s *Service) stopMTLSProxy() {
+	if s.mtlsProxy != nil {
+		s.mtlsProxy.Stop()
+		s.mtlsProxy = nil
+	}
+}
@@ -0,0 +1,30 @@
+package shim
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+func TestMTLSPorts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []network.PortMapping
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"8443", []network.PortMapping{{ListenPort: 8443, GuestPort: 8443}}, false},
+		{"8443:8080, 9443:9090", []network.PortMapping{{ListenPort: 8443, GuestPort: 8080}, {ListenPort: 9443, GuestPort: 9090}}, false},
+		{"8443:http", nil, true},
+		{"70000:80", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := mtlsPorts(map[string]string{annotation.MTLSPorts: tt.value})
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mtlsPorts(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package shim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+const (
+	// The Kubernetes bandwidth annotations are honored as well, with the
+	// same meaning as for the CNI bandwidth plugin.
+	annotationIngressBandwidth = "kubernetes.io/ingress-bandwidth"
+	annotationEgressBandwidth  = "kubernetes.io/egress-bandwidth"
+)
+
+// netRateLimit returns the network rate limit a pod asked for, or nil to
+// use the default.
+func netRateLimit(annotations map[string]string) (*domain.NetRateLimit, error) {
+	var limit domain.NetRateLimit
+	var err error
+
+	if limit.RX.BytesPerSec, err = bandwidthAnnotation(annotations, annotation.NetRXBandwidth, annotationIngressBandwidth); err != nil {
+		return nil, err
+	}
+	if limit.TX.BytesPerSec, err = bandwidthAnnotation(annotations, annotation.NetTXBandwidth, annotationEgressBandwidth); err != nil {
+		return nil, err
+	}
+	if limit.RX.PacketsPerSec, err = ppsAnnotation(annotations, annotation.NetRXPPS); err != nil {
+		return nil, err
+	}
+	if limit.TX.PacketsPerSec, err = ppsAnnotation(annotations, annotation.NetTXPPS); err != nil {
+		return nil, err
+	}
+
+	if limit.RX.IsZero() && limit.TX.IsZero() {
+		return nil, nil
+	}
+	return &limit, nil
+}
+
+// bandwidthAnnotation returns the bandwidth in bytes per second set by the
+// first of the annotations present, or 0.
+func bandwidthAnnotation(annotations map[string]string, keys ...string) (int64, error) {
+	for _, key := range keys {
+		if value, ok := annotations[key]; ok {
+			bytesPerSec, err := annotation.ParseBandwidth(value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s annotation: %w", key, err)
+			}
+			return bytesPerSec, nil
+		}
+	}
+	return 0, nil
+}
+
+// ppsAnnotation returns the packet rate set by an annotation, or 0.
+func ppsAnnotation(annotations map[string]string, key string) (int64, error) {
+	value, ok := annotations[key]
+	if !ok {
+		return 0, nil
+	}
+	pps, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || pps <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a positive integer", key, value)
+	}
+	return pps, nil
+}
@@ -0,0 +1,36 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestNetRateLimit(t *testing.T) {
+	limit, err := netRateLimit(nil)
+	if err != nil || limit != nil {
+		t.Fatalf("netRateLimit(nil) = %+v, %v, want nil", limit, err)
+	}
+
+	limit, err = netRateLimit(map[string]string{
+		annotationIngressBandwidth: "10M",
+		annotation.NetTXBandwidth:  "80M",
+		annotationEgressBandwidth:  "1M",
+		annotation.NetRXPPS:        "5000",
+	})
+	if err != nil {
+		t.Fatalf("netRateLimit() error = %v", err)
+	}
+	want := domain.NetRateLimit{
+		RX: domain.TrafficLimit{BytesPerSec: 1_250_000, PacketsPerSec: 5000},
+		TX: domain.TrafficLimit{BytesPerSec: 10_000_000},
+	}
+	if *limit != want {
+		t.Errorf("netRateLimit() = %+v, want %+v", *limit, want)
+	}
+
+	if _, err := netRateLimit(map[string]string{annotation.NetTXPPS: "lots"}); err == nil {
+		t.Error("netRateLimit() accepted an invalid packet rate")
+	}
+}
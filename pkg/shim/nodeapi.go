@@ -0,0 +1,179 @@
+package shim
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/control"
+	"github.com/pipeops/firecracker-cri/pkg/control/node"
+	"github.com/pipeops/firecracker-cri/pkg/image"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+	"github.com/sirupsen/logrus"
+)
+
+// The node has no daemon of its own, only a shim per pod, so the node's
+// runtime API (pkg/control) and image control socket (image.ControlServer)
+// are served by one of them: the shim holding api.lock in the runtime
+// directory flocked. The others poll for the lock; the kernel drops it when
+// its holder exits, and the next to poll takes over the sockets.
+
+const (
+	nodeAPILockName   = "api.lock"
+	nodeAPISocketName = "api.sock"
+
+	imageControlSocketName = "control.sock"
+)
+
+// nodeAPIPollInterval is how often a shim not serving the node's API checks
+// whether the one that was has gone.
+var nodeAPIPollInterval = 5 * time.Second
+
+// nodeAPI is what a shim serves the node's API from.
+type nodeAPI struct {
+	runDir string
+	pool   *vm.Pool
+	images image.FsifyConfig
+	log    *logrus.Entry
+}
+
+// run serves the node's API whenever this shim holds its lock, until ctx is
+// done.
+func (a *nodeAPI) run(ctx context.Context) {
+	release := lockNodeAPI(ctx, filepath.Join(a.runDir, nodeAPILockName))
+	if release == nil {
+		return
+	}
+	defer release()
+	a.serve(ctx)
+}
+
+// serve serves the node's API until ctx is done. Image conversion is left
+// unavailable, and the image control socket unserved, if the converter
+// can't be set up.
+func (a *nodeAPI) serve(ctx context.Context) {
+	log := a.log.WithField("component", "node-api")
+	runtime := &node.Runtime{RunDir: a.runDir, Pool: a.pool}
+	converter, err := image.NewFsifyConverter(a.images, log)
+	if err != nil {
+		log.WithError(err).Warn("Failed to set up image conversion, serving the runtime API without it")
+	} else {
+		runtime.Converter = converter
+	}
+
+	var wg sync.WaitGroup
+	if converter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := image.NewControlServer(converter, log).Serve(ctx, filepath.Join(a.runDir, imageControlSocketName)); err != nil {
+				log.WithError(err).Error("Failed to serve the image control socket")
+			}
+		}()
+	}
+	if err := control.Serve(ctx, filepath.Join(a.runDir, nodeAPISocketName), runtime, log); err != nil {
+		log.WithError(err).Error("Failed to serve the runtime API")
+	}
+	wg.Wait()
+}
+
+// lockNodeAPI waits for the node API's lock at path, returning the function
+// releasing it, or nil once ctx is done.
+func lockNodeAPI(ctx context.Context, path string) func() {
+	ticker := time.NewTicker(nodeAPIPollInterval)
+	defer ticker.Stop()
+	for {
+		if release := tryLockNodeAPI(path); release != nil {
+			return release
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryLockNodeAPI takes the node API's lock at path if no other shim holds
+// it, returning the function releasing it.
+func tryLockNodeAPI(path string) func() {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+// fsifyConfig returns the image converter's settings for the [image]
+// section.
+func fsifyConfig(c config.ImageConfig, log *logrus.Entry) image.FsifyConfig {
+	images := image.DefaultFsifyConfig()
+	if c.RootDir != "" {
+		images.OutputDir = filepath.Join(c.RootDir, "rootfs")
+		images.TempDir = filepath.Join(c.RootDir, "tmp")
+	}
+	if c.Filesystem != "" {
+		images.Filesystem = c.Filesystem
+	}
+	if c.FsifyMinVersion != "" {
+		images.MinFsifyVersion = c.FsifyMinVersion
+	}
+	if c.ConversionStageAttempts > 0 {
+		images.StageAttempts = c.ConversionStageAttempts
+	}
+	images.RemoteBuilder = remoteBuilderConfig(c)
+	images.Bake = bakeConfig(c, log)
+	return images
+}
+
+// bakeConfig returns the boot files baked into converted images, for the
+// [image] section. A file that can't be parsed is logged, and nothing is
+// baked rather than images missing a file VMs boot with.
+func bakeConfig(c config.ImageConfig, log *logrus.Entry) image.BakeConfig {
+	if !c.BakeBootFiles {
+		return image.BakeConfig{}
+	}
+	bake := image.BakeConfig{Enabled: true}
+	for _, spec := range c.BakeFiles {
+		file, err := image.ParseBakeFile(spec)
+		if err != nil {
+			log.WithError(err).Warn("Invalid bake file, not baking boot files into images")
+			return image.BakeConfig{}
+		}
+		bake.Files = append(bake.Files, file)
+	}
+	return bake
+}
+
+// remoteBuilderConfig returns the builder conversions are delegated to, for
+// the [image] section. A timeout that isn't positive and negative
+// thresholds keep the defaults.
+func remoteBuilderConfig(c config.ImageConfig) image.RemoteBuilderConfig {
+	builder := image.DefaultRemoteBuilderConfig()
+	builder.Address = c.RemoteBuilderAddress
+	builder.CAFile = c.RemoteBuilderCAFile
+	if c.RemoteBuilderTimeout > 0 {
+		builder.Timeout = c.RemoteBuilderTimeout
+	}
+	if c.RemoteBuilderMinFreeDiskMB >= 0 {
+		builder.MinFreeDiskMB = c.RemoteBuilderMinFreeDiskMB
+	}
+	if c.RemoteBuilderMaxLocalConversions >= 0 {
+		builder.MaxLocalConversions = c.RemoteBuilderMaxLocalConversions
+	}
+	return builder
+}
@@ -0,0 +1,264 @@
+package shim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/control"
+	"github.com/pipeops/firecracker-cri/pkg/image"
+	"github.com/sirupsen/logrus"
+)
+
+// startNodeAPI runs a shim's node API in runDir until the returned function
+// is called, which waits for it to stop.
+func startNodeAPI(t *testing.T, runDir string) func() {
+	t.Helper()
+	log := logrus.NewEntry(logrus.New())
+	images := fsifyConfig(config.ImageConfig{RootDir: filepath.Join(runDir, "images")}, log)
+	images.UseFsifyCLI = false
+	api := &nodeAPI{runDir: runDir, images: images, log: log}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		api.run(ctx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// dialNodeAPI waits for the node API in runDir to answer.
+func dialNodeAPI(t *testing.T, runDir string) *control.Client {
+	t.Helper()
+	client, err := control.Dial(context.Background(), filepath.Join(runDir, nodeAPISocketName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := client.Version(ctx)
+		cancel()
+		if err == nil {
+			return client
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Version() error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeAPI(t *testing.T) {
+	defer func(interval time.Duration) { nodeAPIPollInterval = interval }(nodeAPIPollInterval)
+	nodeAPIPollInterval = 10 * time.Millisecond
+	runDir := t.TempDir()
+	ctx := context.Background()
+
+	stopFirst := startNodeAPI(t, runDir)
+	client := dialNodeAPI(t, runDir)
+	if images, err := client.ListImages(ctx); err != nil || len(images) != 0 {
+		t.Errorf("ListImages() = %v, %v, want none", images, err)
+	}
+	if sandboxes, err := client.ListSandboxes(ctx); err != nil || len(sandboxes) != 0 {
+		t.Errorf("ListSandboxes() = %v, %v, want none", sandboxes, err)
+	}
+	// Shims don't run snapshots
+	if _, err := client.ListSnapshots(ctx); !errors.Is(err, control.ErrUnavailable) {
+		t.Errorf("ListSnapshots() error = %v, want %v", err, control.ErrUnavailable)
+	}
+
+	// A second shim waits for the first to go, then takes over
+	startNodeAPI(t, runDir)
+	stopFirst()
+	dialNodeAPI(t, runDir)
+}
+
+func TestNodeAPI_ImageControl(t *testing.T) {
+	runDir := t.TempDir()
+	startNodeAPI(t, runDir)
+	dialNodeAPI(t, runDir)
+
+	// fcctl images convert --watch follows conversions on control.sock
+	socket := filepath.Join(runDir, imageControlSocketName)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		if resp, err = client.Get("http://control/v1/images/conversions"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /v1/images/conversions error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer resp.Body.Close()
+	var conversions []image.ConversionProgress
+	if err := json.NewDecoder(resp.Body).Decode(&conversions); err != nil || resp.StatusCode != http.StatusOK || len(conversions) != 0 {
+		t.Errorf("GET /v1/images/conversions = %s, %v, %v, want none", resp.Status, conversions, err)
+	}
+}
+
+func TestTryLockNodeAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", nodeAPILockName)
+	release := tryLockNodeAPI(path)
+	if release == nil {
+		t.Fatal("tryLockNodeAPI() of a free lock failed")
+	}
+	if again := tryLockNodeAPI(path); again != nil {
+		again()
+		t.Fatal("tryLockNodeAPI() took a held lock")
+	}
+	release()
+	if again := tryLockNodeAPI(path); again == nil {
+		t.Error("tryLockNodeAPI() of a released lock failed")
+	} else {
+		again()
+	}
+}
+
+func TestFsifyConfig(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	if got, want := fsifyConfig(config.ImageConfig{}, log), image.DefaultFsifyConfig(); got.OutputDir != want.OutputDir || got.Filesystem != want.Filesystem {
+		t.Errorf("fsifyConfig() without settings = %+v, want the defaults", got)
+	}
+	got := fsifyConfig(config.ImageConfig{RootDir: "/data/images", Filesystem: "erofs"}, log)
+	if got.OutputDir != "/data/images/rootfs" || got.TempDir != "/data/images/tmp" || got.Filesystem != "erofs" {
+		t.Errorf("fsifyConfig() = %+v", got)
+	}
+}
+
+func TestFsifyConfig_MinVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[image]\nfsify_min_version = \"0.2.0\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.NewEntry(logrus.New())
+	if got := fsifyConfig(loadConfig(path, log).Image, log); got.MinFsifyVersion != "0.2.0" {
+		t.Errorf("fsifyConfig() MinFsifyVersion = %q, want 0.2.0", got.MinFsifyVersion)
+	}
+
+	// The environment overrides the file
+	t.Setenv("FC_CRI_IMAGE_FSIFY_MIN_VERSION", "0.3")
+	if got := fsifyConfig(loadConfig(path, log).Image, log); got.MinFsifyVersion != "0.3" {
+		t.Errorf("fsifyConfig() MinFsifyVersion = %q, want 0.3", got.MinFsifyVersion)
+	}
+}
+
+func TestFsifyConfig_StageAttempts(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	if got := fsifyConfig(config.Default().Image, log); got.StageAttempts != image.DefaultStageAttempts {
+		t.Errorf("fsifyConfig() StageAttempts = %d, want %d", got.StageAttempts, image.DefaultStageAttempts)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[image]\nconversion_stage_attempts = 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := fsifyConfig(loadConfig(path, log).Image, log); got.StageAttempts != 5 {
+		t.Errorf("fsifyConfig() StageAttempts = %d, want 5", got.StageAttempts)
+	}
+
+	// The environment overrides the file, and fewer than one attempt keeps
+	// the default
+	t.Setenv("FC_CRI_IMAGE_CONVERSION_STAGE_ATTEMPTS", "0")
+	if got := fsifyConfig(loadConfig(path, log).Image, log); got.StageAttempts != image.DefaultStageAttempts {
+		t.Errorf("fsifyConfig() StageAttempts = %d, want %d", got.StageAttempts, image.DefaultStageAttempts)
+	}
+}
+
+func TestRemoteBuilderConfig(t *testing.T) {
+	if c := remoteBuilderConfig(config.Default().Image); c != image.DefaultRemoteBuilderConfig() {
+		t.Errorf("remoteBuilderConfig() = %+v, want the defaults", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `[image]
+remote_builder_address = "fc-builder:9000"
+remote_builder_ca_file = "/etc/fc-cri/builder-ca.pem"
+remote_builder_timeout = "5m"
+remote_builder_min_free_disk_mb = 4096
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_IMAGE_REMOTE_BUILDER_MAX_LOCAL_CONVERSIONS", "0")
+
+	want := image.RemoteBuilderConfig{
+		Address:       "fc-builder:9000",
+		CAFile:        "/etc/fc-cri/builder-ca.pem",
+		Timeout:       5 * time.Minute,
+		MinFreeDiskMB: 4096,
+	}
+	log := logrus.NewEntry(logrus.New())
+	images := fsifyConfig(loadConfig(path, log).Image, log)
+	if images.RemoteBuilder != want {
+		t.Errorf("fsifyConfig() remote builder = %+v, want %+v", images.RemoteBuilder, want)
+	}
+
+	// Negative thresholds keep the defaults
+	invalid := config.ImageConfig{RemoteBuilderMinFreeDiskMB: -1, RemoteBuilderMaxLocalConversions: -1}
+	if c := remoteBuilderConfig(invalid); c != image.DefaultRemoteBuilderConfig() {
+		t.Errorf("remoteBuilderConfig() with negative thresholds = %+v, want the defaults", c)
+	}
+}
+
+func TestBakeConfig(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	if c := bakeConfig(config.Default().Image, log); c.Enabled || len(c.Files) != 0 {
+		t.Errorf("bakeConfig() = %+v, want nothing baked", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `[image]
+bake_files = ["/usr/local/bin/fc-agent:/sbin/fc-agent:755", "/usr/local/sbin/runc:/usr/local/sbin/runc"]
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_IMAGE_BAKE_BOOT_FILES", "true")
+
+	want := image.BakeConfig{Enabled: true, Files: []image.BakeFile{
+		{Source: "/usr/local/bin/fc-agent", Target: "/sbin/fc-agent", Mode: 0755},
+		{Source: "/usr/local/sbin/runc", Target: "/usr/local/sbin/runc"},
+	}}
+	images := fsifyConfig(loadConfig(path, log).Image, log)
+	if !reflect.DeepEqual(images.Bake, want) {
+		t.Errorf("fsifyConfig() bake = %+v, want %+v", images.Bake, want)
+	}
+
+	// Without files, the defaults are baked
+	if c := bakeConfig(config.ImageConfig{BakeBootFiles: true}, log); !c.Enabled || len(c.Files) != 0 {
+		t.Errorf("bakeConfig() without files = %+v, want the default files", c)
+	}
+	// An invalid file bakes nothing
+	invalid := config.ImageConfig{BakeBootFiles: true, BakeFiles: []string{"/usr/local/bin/fc-agent:sbin/fc-agent"}}
+	if c := bakeConfig(invalid, log); c.Enabled {
+		t.Errorf("bakeConfig() with an invalid file = %+v, want nothing baked", c)
+	}
+}
@@ -0,0 +1,53 @@
+package shim
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+// podNetworkAllowList returns what pods may add to their network, from
+// FC_CRI_NETWORK_ALLOWED_POD_ROUTES and FC_CRI_NETWORK_ALLOWED_DNS_SEARCH.
+func podNetworkAllowList() (network.PodNetworkAllowList, error) {
+	return network.ParsePodNetworkAllowList(
+		annotation.SplitList(os.Getenv("FC_CRI_NETWORK_ALLOWED_POD_ROUTES")),
+		annotation.SplitList(os.Getenv("FC_CRI_NETWORK_ALLOWED_DNS_SEARCH")))
+}
+
+// podNetwork returns the routes, search domains and additional networks a
+// pod adds to its network, nil if none, refusing routes and search domains
+// the node doesn't allow.
+func podNetwork(annotations map[string]string, allow network.PodNetworkAllowList) (*domain.CNIConfig, error) {
+	var config domain.CNIConfig
+	var err error
+	for _, item := range annotation.SplitList(annotations[annotation.Routes]) {
+		route, err := network.ParseRoute(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", annotation.Routes, err)
+		}
+		if err := allow.CheckRoute(route); err != nil {
+			return nil, err
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	for _, name := range annotation.SplitList(annotations[annotation.DNSSearch]) {
+		if err := network.ValidateSearchDomain(name); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", annotation.DNSSearch, err)
+		}
+		if err := allow.CheckSearch(name); err != nil {
+			return nil, err
+		}
+		config.DNSSearch = append(config.DNSSearch, strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	if config.Networks, err = annotation.ParseNetworks(annotations[annotation.Networks]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", annotation.Networks, err)
+	}
+	if len(config.Routes) == 0 && len(config.DNSSearch) == 0 && len(config.Networks) == 0 {
+		return nil, nil
+	}
+	return &config, nil
+}
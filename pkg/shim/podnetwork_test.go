@@ -0,0 +1,59 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+func TestPodNetwork(t *testing.T) {
+	allow, err := network.ParsePodNetworkAllowList([]string{"10.20.0.0/16"}, []string{"corp.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := podNetwork(map[string]string{}, allow)
+	if config != nil || err != nil {
+		t.Errorf("podNetwork() without annotations = %v, %v", config, err)
+	}
+
+	config, err = podNetwork(map[string]string{
+		annotation.Routes:    "10.20.1.0/24 via 10.88.0.254, 10.20.2.0/24",
+		annotation.DNSSearch: "EU.corp.example.com.",
+	}, allow)
+	if err != nil {
+		t.Fatalf("podNetwork() error = %v", err)
+	}
+	if len(config.Routes) != 2 || config.Routes[0].String() != "10.20.1.0/24 via 10.88.0.254" || config.Routes[1].GW != nil {
+		t.Errorf("routes = %v", config.Routes)
+	}
+	if len(config.DNSSearch) != 1 || config.DNSSearch[0] != "eu.corp.example.com" {
+		t.Errorf("search domains = %v", config.DNSSearch)
+	}
+
+	for _, annotations := range []map[string]string{
+		{annotation.Routes: "192.168.0.0/24"},
+		{annotation.Routes: "10.20.0.0"},
+		{annotation.DNSSearch: "example.org"},
+		{annotation.DNSSearch: "corp..example.com"},
+	} {
+		if _, err := podNetwork(annotations, allow); err == nil {
+			t.Errorf("podNetwork(%v) succeeded", annotations)
+		}
+	}
+	config, err = podNetwork(map[string]string{annotation.Networks: "storage, backup"}, allow)
+	if err != nil || config == nil || len(config.Networks) != 2 || config.Networks[1] != "backup" {
+		t.Errorf("podNetwork() with networks = %v, %v", config, err)
+	}
+	for _, networks := range []string{"storage,storage", "../storage", "a,b,c,d,e"} {
+		if _, err := podNetwork(map[string]string{annotation.Networks: networks}, allow); err == nil {
+			t.Errorf("podNetwork() with networks %q succeeded", networks)
+		}
+	}
+
+	// Nothing is allowed without an allow-list
+	if _, err := podNetwork(map[string]string{annotation.Routes: "10.20.1.0/24"}, network.PodNetworkAllowList{}); err == nil {
+		t.Error("podNetwork() allowed a route without an allow-list")
+	}
+}
@@ -0,0 +1,90 @@
+package shim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pipeops/firecracker-cri/pkg/image"
+)
+
+const (
+	// defaultCreateReserve is how much of Create's deadline is kept for
+	// booting the VM and creating the container once the rootfs is ready.
+	defaultCreateReserve = 15 * time.Second
+
+	// How often a Create waiting for its rootfs checks on it, and reports
+	// its progress to containerd.
+	rootfsPollInterval     = 500 * time.Millisecond
+	createProgressInterval = 5 * time.Second
+)
+
+// Phases reported in CreateProgress events.
+const (
+	CreatePhaseImage     = "image"     // Waiting for the rootfs image to be converted
+	CreatePhaseVM        = "vm"        // Acquiring a VM from the pool or booting one
+	CreatePhaseSandbox   = "sandbox"   // Setting up metadata, proxies and watchers
+	CreatePhaseContainer = "container" // Creating the container in the guest
+)
+
+// ErrImageNotReady fails a Create whose rootfs image is still being
+// converted and won't be ready within the request's deadline. It is
+// returned as Unavailable, which kubelet retries with backoff, and by then
+// the conversion has had time to finish.
+var ErrImageNotReady = errors.New("image not ready, retry")
+
+// waitForRootfs waits for a rootfs image that is still being converted,
+// reporting progress to containerd, for as long as ctx's deadline leaves
+// time for the rest of Create. Rootfs images not being converted are left
+// to fail or boot as they are.
+func (s *Service) waitForRootfs(ctx context.Context, id, path string) error {
+	if path == "" || !image.Converting(path) {
+		return nil
+	}
+	start := time.Now()
+	log := s.log.WithField("rootfs", path)
+
+	wait := time.Duration(-1) // Until ctx is done, without a deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		if wait = time.Until(deadline) - s.createReserve; wait <= 0 {
+			log.Info("Rootfs is still being converted, failing Create for a retry")
+			return notReady(path)
+		}
+	}
+	log.WithField("wait", wait).Info("Waiting for rootfs conversion")
+	s.emitCreateProgress(id, CreatePhaseImage, start)
+
+	poll := time.NewTicker(rootfsPollInterval)
+	defer poll.Stop()
+	progress := time.NewTicker(createProgressInterval)
+	defer progress.Stop()
+	var expired <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-poll.C:
+			if !image.Converting(path) {
+				log.WithField("waited", time.Since(start).Round(time.Millisecond)).Info("Rootfs conversion finished")
+				return nil
+			}
+		case <-progress.C:
+			s.emitCreateProgress(id, CreatePhaseImage, start)
+		case <-expired:
+			log.Info("Rootfs conversion outlasted the Create deadline, failing Create for a retry")
+			return notReady(path)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notReady returns ErrImageNotReady for a rootfs as a gRPC error.
+func notReady(path string) error {
+	return errdefs.ToGRPC(fmt.Errorf("%w: rootfs %s is still being converted: %w", ErrImageNotReady, path, errdefs.ErrUnavailable))
+}
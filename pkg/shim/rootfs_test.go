@@ -0,0 +1,82 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// convertingRootfs returns the path of a rootfs image this process is
+// still converting, and a function that puts the image in place.
+func convertingRootfs(t *testing.T) (string, func()) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nginx-latest.img")
+	partial := filepath.Join(dir, fmt.Sprintf(".nginx-latest.partial-%d.img", os.Getpid()))
+	if err := os.WriteFile(partial, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() {
+		if err := os.Rename(partial, path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWaitForRootfs_Ready(t *testing.T) {
+	s := newEventTestService(4)
+	path := filepath.Join(t.TempDir(), "nginx-latest.img")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.waitForRootfs(context.Background(), "ctr", path); err != nil {
+		t.Errorf("waitForRootfs() = %v", err)
+	}
+	if len(s.events) != 0 {
+		t.Errorf("%d events published for a ready rootfs", len(s.events))
+	}
+}
+
+func TestWaitForRootfs_NotReadyInTime(t *testing.T) {
+	s := newEventTestService(4)
+	s.createReserve = time.Minute
+	path, _ := convertingRootfs(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := s.waitForRootfs(ctx, "ctr", path)
+	if !errdefs.IsUnavailable(errdefs.FromGRPC(err)) || !strings.Contains(err.Error(), ErrImageNotReady.Error()) {
+		t.Errorf("waitForRootfs() = %v, want unavailable image not ready", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("waitForRootfs() waited without time to spare")
+	}
+}
+
+func TestWaitForRootfs_WaitsForConversion(t *testing.T) {
+	s := newEventTestService(4)
+	s.createReserve = time.Second
+	path, finish := convertingRootfs(t)
+	time.AfterFunc(200*time.Millisecond, finish)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.waitForRootfs(ctx, "ctr", path); err != nil {
+		t.Fatalf("waitForRootfs() = %v", err)
+	}
+	select {
+	case event := <-s.events:
+		if progress, ok := event.(*CreateProgress); !ok || progress.Phase != CreatePhaseImage || progress.ContainerID != "ctr" {
+			t.Errorf("published %#v, want image progress", event)
+		}
+	default:
+		t.Error("no progress published while waiting")
+	}
+}
@@ -0,0 +1,21 @@
+package shim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+// runtimeDirClass returns the runtime directory class a pod asked for, or
+// empty for the runtime directory itself.
+func runtimeDirClass(annotations map[string]string, classes map[string]string) (string, error) {
+	name := strings.TrimSpace(annotations[annotation.RuntimeDirClass])
+	if name == "" {
+		return "", nil
+	}
+	if _, ok := classes[name]; !ok {
+		return "", fmt.Errorf("invalid %s annotation: unknown class %q", annotation.RuntimeDirClass, name)
+	}
+	return name, nil
+}
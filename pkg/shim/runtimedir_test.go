@@ -0,0 +1,28 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+)
+
+func TestRuntimeDirClass(t *testing.T) {
+	classes := map[string]string{"nvme": "/mnt/nvme/fc-cri"}
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"nvme", "nvme", false},
+		{" nvme ", "nvme", false},
+		{"ssd", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := runtimeDirClass(map[string]string{annotation.RuntimeDirClass: tt.value}, classes)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("runtimeDirClass(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
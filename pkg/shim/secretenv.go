@@ -0,0 +1,81 @@
+package shim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stripSecretEnv removes the named environment variables from the process
+// in a bundle's OCI spec and returns them as NAME=value entries. Names the
+// spec doesn't set are skipped.
+func stripSecretEnv(bundle string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	path := filepath.Join(bundle, "config.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything but the environment is written back untouched
+	var spec map[string]json.RawMessage
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	var process map[string]json.RawMessage
+	if err := json.Unmarshal(spec["process"], &process); err != nil || process == nil {
+		return nil, fmt.Errorf("%s has no process", path)
+	}
+	var env []string
+	if raw, ok := process["env"]; ok {
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return nil, fmt.Errorf("failed to parse environment in %s: %w", path, err)
+		}
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var kept, secret []string
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if wanted[name] {
+			secret = append(secret, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	if process["env"], err = json.Marshal(kept); err != nil {
+		return nil, err
+	}
+	if spec["process"], err = json.Marshal(process); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(spec); err != nil {
+		return nil, err
+	}
+
+	// Replace the spec whole, so the guest never reads half of it
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return secret, nil
+}
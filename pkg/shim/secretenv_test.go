@@ -0,0 +1,58 @@
+package shim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStripSecretEnv(t *testing.T) {
+	bundle := t.TempDir()
+	path := filepath.Join(bundle, "config.json")
+	spec := `{"ociVersion":"1.0.2","process":{"args":["app"],"env":["PATH=/bin","DB_PASSWORD=hunter2","TOKEN=a=b"]},"root":{"path":"rootfs"}}`
+	if err := os.WriteFile(path, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := stripSecretEnv(bundle, []string{"DB_PASSWORD", "TOKEN", "UNSET"})
+	if err != nil {
+		t.Fatalf("stripSecretEnv() error = %v", err)
+	}
+	if want := []string{"DB_PASSWORD=hunter2", "TOKEN=a=b"}; !reflect.DeepEqual(secret, want) {
+		t.Errorf("stripSecretEnv() = %v, want %v", secret, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		OCIVersion string `json:"ociVersion"`
+		Process    struct {
+			Args []string `json:"args"`
+			Env  []string `json:"env"`
+		} `json:"process"`
+		Root struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Process.Env, []string{"PATH=/bin"}) {
+		t.Errorf("bundle env = %v, want only PATH", got.Process.Env)
+	}
+	if got.OCIVersion != "1.0.2" || got.Root.Path != "rootfs" || len(got.Process.Args) != 1 {
+		t.Errorf("bundle spec lost fields: %s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("bundle spec mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// Nothing left to take leaves the spec alone
+	if secret, err := stripSecretEnv(bundle, []string{"DB_PASSWORD"}); err != nil || secret != nil {
+		t.Errorf("stripSecretEnv() again = %v, %v", secret, err)
+	}
+}
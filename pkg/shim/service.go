@@ -11,19 +11,32 @@ package shim
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	cgroupstats "github.com/containerd/cgroups/v3/cgroup2/stats"
+	eventstypes "github.com/containerd/containerd/api/events"
 	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
 	"github.com/containerd/containerd/api/types/task"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/protobuf"
 	"github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/containerd/typeurl/v2"
 	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/hooks"
+	"github.com/pipeops/firecracker-cri/pkg/kernel"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/pipeops/firecracker-cri/pkg/sandboxlog"
+	"github.com/pipeops/firecracker-cri/pkg/trace"
 	"github.com/pipeops/firecracker-cri/pkg/vm"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -34,8 +47,9 @@ const (
 	// shimID is used by containerd to identify this runtime.
 	// shimID = "io.containerd.firecracker.v2"
 
-	// vsockAgentPort is the port the guest agent listens on.
-	vsockAgentPort = 1024
+	// Pod identity annotations set by the CRI plugin on the OCI spec.
+	annotationSandboxNamespace = "io.kubernetes.cri.sandbox-namespace"
+	annotationSandboxName      = "io.kubernetes.cri.sandbox-name"
 )
 
 // Service implements the containerd task service for Firecracker.
@@ -43,15 +57,59 @@ type Service struct {
 	mu sync.Mutex
 
 	// Shim identity
-	id        string
-	namespace string
-	bundle    string
+	id         string
+	namespace  string
+	bundle     string
+	runtimeDir string
+
+	// Other bases for sandbox directories, by class name
+	runtimeDirClasses map[string]string
+
+	// Time Create keeps from its deadline after waiting for a rootfs
+	createReserve time.Duration
+
+	// Node-wide limits on simultaneous task operations, nil if none
+	taskLimits *taskLimiter
 
 	// Core components
 	vmManager   *vm.Manager
 	vmPool      *vm.Pool
+	kernels     *kernel.Store
 	agentClient *agent.Client
 
+	// Operator-defined lifecycle hooks
+	hooks *hooks.Runner
+
+	// Guest liveness monitoring
+	heartbeat       *agent.HeartbeatMonitor
+	heartbeatConfig agent.HeartbeatConfig
+
+	// Agent liveness checks. agentDown is set while the agent has been
+	// unreachable for the liveness window.
+	liveness       *agent.LivenessWatchdog
+	livenessConfig agent.LivenessConfig
+	agentDown      bool
+
+	// Container exit and OOM notifications from the guest
+	notifications *agent.NotificationListener
+
+	// Guest agent logs shipped into the shim's log
+	agentLogs *agent.LogShipper
+
+	// Host-terminated mesh mTLS for the sandbox
+	mtlsConfig network.MTLSConfig
+	mtlsProxy  *network.MTLSProxy
+
+	// Host-side ClusterIP routing for nodes without kube-proxy
+	serviceRouting network.ServiceRoutingConfig
+	serviceRouter  *network.ServiceRouter
+
+	// Routes and search domains pods may add to their network
+	podNetworkAllow network.PodNetworkAllowList
+
+	// Requests from fcctl, such as restarts
+	control net.Listener
+
 	// Current sandbox (one sandbox per shim instance)
 	sandbox *domain.Sandbox
 
@@ -68,6 +126,9 @@ type Service struct {
 	shutdown func()
 
 	log *logrus.Entry
+
+	// closeLog closes the sandbox's log destinations
+	closeLog func() error
 }
 
 // processState tracks the state of a process (init or exec).
@@ -81,6 +142,10 @@ type processState struct {
 	stdout      string
 	stderr      string
 	terminal    bool
+	dryRun      bool // Created by a dry-run; there is no container behind it
+
+	// done is closed when the process exits
+	done chan struct{}
 }
 
 // New creates a new Firecracker shim service.
@@ -88,7 +153,15 @@ type processState struct {
 func New(ctx context.Context, id string, publisher shim.Publisher, shutdown func()) (shim.Shim, error) {
 	ns, _ := namespaces.Namespace(ctx)
 
-	log := logrus.NewEntry(logrus.StandardLogger()).WithFields(logrus.Fields{
+	// The sandbox's logs, and its VMM's, may go where the node keeps
+	// per-pod diagnostics rather than the stderr every shim shares
+	logger, closeLog, err := sandboxlog.New(logrus.StandardLogger(), sandboxLogConfig(), sandboxlog.Sandbox{ID: id, Namespace: ns})
+	if err != nil {
+		logrus.WithError(err).WithField("id", id).Warn("Failed to route sandbox logs, logging to stderr")
+		logger, closeLog = logrus.StandardLogger(), func() error { return nil }
+	}
+
+	log := logrus.NewEntry(logger).WithFields(logrus.Fields{
 		"namespace": ns,
 		"id":        id,
 	})
@@ -96,39 +169,160 @@ func New(ctx context.Context, id string, publisher shim.Publisher, shutdown func
 
 	ctx, cancel := context.WithCancel(ctx)
 
+	cfg := loadConfig(runtimeConfigPath, log)
+
 	// Initialize VM manager
 	vmConfig := vm.DefaultManagerConfig()
+	vmConfig.Chaos = chaosConfig(cfg.Chaos)
+	// A filter that can't be passed to Firecracker fails the manager here
+	// rather than every VM
+	vmConfig.Seccomp = vm.SeccompConfig{
+		FilterPath: cfg.Runtime.SeccompFilter,
+		Disabled:   cfg.Runtime.DisableSeccomp,
+	}
+	vmConfig.Cgroup = cgroupConfig(cfg.Runtime)
+	vmConfig.FDLimits = fdLimitConfig(cfg.Runtime)
+	vmConfig.Prealloc = preallocConfig(cfg.VM)
+	vmConfig.CPUTemplates = cpuTemplateConfig(cfg.VM)
+	// Pods' rate limit annotations replace the default, see netRateLimit
+	vmConfig.DefaultNetRateLimit = defaultNetRateLimit(cfg.Network)
+	// Developers without KVM run VMs as agent processes
+	if os.Getenv("FC_CRI_DEV_MODE") == "true" {
+		vmConfig.DevMode.Enabled = true
+		if bin := os.Getenv("FC_CRI_DEV_AGENT_BINARY"); bin != "" {
+			vmConfig.DevMode.AgentBinary = bin
+		}
+	}
+	vmConfig.CaptureVMMLogs = logger != logrus.StandardLogger()
+	// May use per-VM variables like ${guest_ip}, see vm.ValidateKernelArgs
+	if args := os.Getenv("FC_CRI_VM_KERNEL_ARGS"); args != "" {
+		vmConfig.DefaultKernelArgs = args
+	}
+	// e.g. "nvme=/mnt/nvme/fc-cri", for pods to select by annotation
+	if classes := os.Getenv("FC_CRI_RUNTIME_DIR_CLASSES"); classes != "" {
+		if vmConfig.RuntimeDirClasses, err = vm.ParseRuntimeDirClasses(classes); err != nil {
+			cancel()
+			closeLog()
+			return nil, fmt.Errorf("invalid FC_CRI_RUNTIME_DIR_CLASSES: %w", err)
+		}
+	}
+	allow, err := podNetworkAllowList()
+	if err != nil {
+		cancel()
+		closeLog()
+		return nil, fmt.Errorf("invalid pod network allow-list: %w", err)
+	}
+	// How much of Create's deadline is kept for booting once a rootfs
+	// still being converted is ready
+	createReserve := defaultCreateReserve
+	if reserve, err := time.ParseDuration(os.Getenv("FC_CRI_CREATE_RESERVE")); err == nil {
+		createReserve = reserve
+	}
+	// How long containers get to stop before their VM is powered off
+	if timeout, err := time.ParseDuration(os.Getenv("FC_CRI_GUEST_SHUTDOWN_TIMEOUT")); err == nil {
+		vmConfig.GuestShutdownTimeout = timeout
+	}
+	// Where usage records of destroyed VMs go
+	vmConfig.UsageSink = os.Getenv("FC_CRI_METRICS_USAGE_SINK")
+	configureMetrics(metrics.Global(), cfg.Metrics, log)
+	// Rates computed in the collector, for infrequent scrapers
+	if os.Getenv("FC_CRI_METRICS_RATES") == "true" {
+		metrics.Global().StartRates(ctx)
+	}
+	// Kernel features the first VM of each kernel must find
+	if features, ok := os.LookupEnv("FC_CRI_VM_REQUIRED_KERNEL_FEATURES"); ok {
+		vmConfig.KernelCheck.Required = annotation.SplitList(features)
+	}
+	// The OCI runtime the guest agent runs containers with
+	vmConfig.Agent.Runtime = os.Getenv("FC_CRI_AGENT_OCI_RUNTIME")
+	vmConfig.Agent.RuntimeArgs = annotation.SplitList(os.Getenv("FC_CRI_AGENT_OCI_RUNTIME_ARGS"))
+	// The guest sends its heartbeats to the port the shim listens on, as
+	// often as the shim expects them
+	heartbeat := heartbeatConfig(cfg.Agent)
+	vmConfig.Agent.HeartbeatPort = heartbeat.Port
+	vmConfig.Agent.HeartbeatInterval = heartbeat.Interval
 	vmManager, err := vm.NewManager(vmConfig, log)
 	if err != nil {
 		cancel()
+		closeLog()
 		return nil, fmt.Errorf("failed to create VM manager: %w", err)
 	}
+	// Without a usable CNI setup, VMs boot without a network
+	if cfg.Network.NetworkMode != "none" {
+		cni, err := network.NewCNIService(cniServiceConfig(cfg.Network), log)
+		if err != nil {
+			log.WithError(err).Warn("Failed to set up CNI, VMs boot without a network")
+		} else {
+			vmManager.SetNetworkService(cni)
+		}
+	}
 
 	// Initialize VM pool
 	poolConfig := vm.DefaultPoolConfig()
+	poolConfig.DefaultVMConfig.KernelArgs = "" // The manager's default
+	// How long Shutdown waits for in-use VMs to be released
+	if cfg.Runtime.ShutdownTimeout > 0 {
+		poolConfig.ShutdownTimeout = cfg.Runtime.ShutdownTimeout
+	}
 	vmPool, err := vm.NewPool(vmManager, poolConfig, log)
 	if err != nil {
+		vmManager.Close()
 		cancel()
+		closeLog()
 		return nil, fmt.Errorf("failed to create VM pool: %w", err)
 	}
 
+	// Load lifecycle hooks. A broken definition disables hooks rather than
+	// every sandbox on the node.
+	hookRunner, err := hooks.Load(hooksConfig(cfg.Hooks), log)
+	if err != nil {
+		log.WithError(err).Error("Failed to load lifecycle hooks")
+	}
+
 	s := &Service{
-		id:        id,
-		namespace: ns,
-		vmManager: vmManager,
-		vmPool:    vmPool,
-		processes: make(map[string]*processState),
-		events:    make(chan interface{}, 128),
-		publisher: publisher,
-		ctx:       ctx,
-		cancel:    cancel,
-		shutdown:  shutdown,
-		log:       log,
+		id:                id,
+		namespace:         ns,
+		runtimeDir:        vmConfig.RuntimeDir,
+		runtimeDirClasses: vmConfig.RuntimeDirClasses,
+		createReserve:     createReserve,
+		taskLimits:        taskLimits(cfg.Runtime, log),
+		vmManager:         vmManager,
+		vmPool:            vmPool,
+		kernels:           kernel.NewStore(kernelStoreConfig(cfg.VM), log),
+		hooks:             hookRunner,
+		heartbeatConfig:   heartbeat,
+		livenessConfig:    livenessConfig(cfg.Agent),
+		mtlsConfig:        mtlsConfig(cfg.Network),
+		serviceRouting:    serviceRoutingConfig(),
+		podNetworkAllow:   allow,
+		processes:         make(map[string]*processState),
+		events:            make(chan interface{}, 128),
+		publisher:         publisher,
+		ctx:               ctx,
+		cancel:            cancel,
+		shutdown:          shutdown,
+		log:               log,
+		closeLog:          closeLog,
+	}
+
+	// Clean up after VMMs that crash or are killed. Handle off the
+	// manager's goroutine, which must not wait for s.mu.
+	vmManager.OnVMMExit(func(sandbox *domain.Sandbox) {
+		go s.handleVMMExit(sandbox.ID)
+	})
+
+	// Re-adopt a VM left running by a previous instance of this shim
+	if err := s.recover(ctx); err != nil {
+		log.WithError(err).Warn("Failed to recover sandbox state")
 	}
 
 	// Start event forwarding
 	go s.forwardEvents()
 
+	// One shim on the node serves its runtime API
+	api := &nodeAPI{runDir: s.runtimeDir, pool: vmPool, images: fsifyConfig(cfg.Image, log), log: log}
+	go api.run(ctx)
+
 	return s, nil
 }
 
@@ -161,6 +355,7 @@ func (s *Service) Cleanup(ctx context.Context) (*taskAPI.DeleteResponse, error)
 		if err := s.vmManager.DestroyVM(ctx, s.sandbox); err != nil {
 			s.log.WithError(err).Warn("Error destroying sandbox during cleanup")
 		}
+		_ = s.runHooks(ctx, hooks.EventDestroy, nil)
 	}
 
 	return &taskAPI.DeleteResponse{
@@ -208,12 +403,74 @@ func (s *Service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (*ta
 		"id":     r.ID,
 		"bundle": r.Bundle,
 	}).Info("Creating task")
+	defer metrics.Global().TrackInFlight(metrics.InFlightCreate)()
+	start := time.Now()
+
+	// Wait for a rootfs still being converted, or fail fast for a retry,
+	// without holding up the shim's other requests
+	if len(r.Rootfs) > 0 {
+		if err := s.waitForRootfs(ctx, r.ID, r.Rootfs[0].Source); err != nil {
+			return nil, err
+		}
+	}
+	release, err := s.taskLimits.acquire(ctx, metrics.TaskOpCreate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	raw := bundleAnnotations(r.Bundle)
+	if err := annotation.Validate(raw); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if deprecated := annotation.Deprecated(raw); len(deprecated) > 0 {
+		s.log.WithField("annotations", deprecated).Warnf("Deprecated annotations, use the %s prefix", annotation.Prefix)
+	}
+	annotations := annotation.Normalize(raw)
+	if isDryRun(annotations) {
+		return s.createDryRun(r)
+	}
+	settings, err := parseGuestSettings(r.ID, annotations)
+	if err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+
 	// Create or acquire a VM for this task
 	vmConfig := domain.DefaultVMConfig()
+	vmConfig.KernelArgs = "" // The manager's default, unless the kernel has its own
+	vmConfig.Namespace = annotations[annotationSandboxNamespace]
+	vmConfig.AvoidNamespaces = annotation.SplitList(annotations[annotation.AvoidNamespaces])
+	if err := applyShape(&vmConfig, annotations); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if err := s.selectKernel(ctx, &vmConfig, annotations); err != nil {
+		return nil, err
+	}
+	if vmConfig.MMDS, err = mmdsConfig(annotations); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if vmConfig.NetRateLimit, err = netRateLimit(annotations); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if vmConfig.PortMappings, err = hostPorts(annotations); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if vmConfig.CNIConfig, err = podNetwork(annotations, s.podNetworkAllow); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if vmConfig.CPUTemplate, err = cpuTemplate(annotations); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	if vmConfig.RuntimeDirClass, err = runtimeDirClass(annotations, s.runtimeDirClasses); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
+	mtls, err := mtlsPorts(annotations)
+	if err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "%v", err)
+	}
 
 	// The rootfs comes from the bundle
 	if len(r.Rootfs) > 0 {
@@ -226,17 +483,22 @@ func (s *Service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (*ta
 	}
 
 	// Acquire VM from pool (fast path) or create new
+	s.emitCreateProgress(r.ID, CreatePhaseVM, start)
+	acquireStart := time.Now()
 	sandbox, err := s.vmPool.Acquire(ctx, vmConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire VM: %w", err)
 	}
+	if sandbox.FromPool {
+		metrics.Global().ObserveLatency(latencyAcquireWarm, time.Since(acquireStart))
+	} else {
+		metrics.Global().ObserveLatency(latencyAcquireCold, time.Since(acquireStart))
+	}
 	s.sandbox = sandbox
 	s.bundle = r.Bundle
-
-	// Connect to the guest agent
-	s.agentClient = agent.NewClient(s.log)
-	if err := s.agentClient.Connect(ctx, sandbox.VsockPath, sandbox.VsockCID, vsockAgentPort); err != nil {
-		return nil, fmt.Errorf("failed to connect to agent: %w", err)
+	s.emitCreateProgress(r.ID, CreatePhaseSandbox, start)
+	if err := s.setupSandbox(ctx, annotations, mtls); err != nil {
+		return nil, err
 	}
 
 	// Create the container inside the VM
@@ -248,9 +510,31 @@ func (s *Service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (*ta
 		Stderr:     r.Stderr != "",
 		Terminal:   r.Terminal,
 	}
-	if err := s.agentClient.CreateContainer(ctx, containerSpec); err != nil {
+	// Secrets go to the agent directly instead of through the bundle
+	if names := annotation.SplitList(annotations[annotation.SecretEnv]); len(names) > 0 {
+		if !s.agentClient.Supports(agent.FeatureSecretEnv) {
+			return nil, fmt.Errorf("guest agent can't inject secret environment variables")
+		}
+		if containerSpec.SecretEnv, err = stripSecretEnv(r.Bundle, names); err != nil {
+			return nil, fmt.Errorf("failed to take secret environment variables out of the bundle: %w", err)
+		}
+	}
+	s.emitCreateProgress(r.ID, CreatePhaseContainer, start)
+	createStart := time.Now()
+	err = s.agentClient.CreateContainer(ctx, containerSpec)
+	trace.Record(filepath.Join(s.runtimeDir, s.sandbox.ID), trace.PhaseContainerCreate, createStart, err)
+	if err != nil {
 		return nil, fmt.Errorf("failed to create container: %w", err)
 	}
+	if !settings.empty() {
+		if err := s.applyGuestSettings(ctx, settings); err != nil {
+			return nil, fmt.Errorf("failed to apply guest settings: %w", err)
+		}
+	}
+
+	if err := s.runHooks(ctx, hooks.EventCreate, nil); err != nil {
+		return nil, fmt.Errorf("create hook failed: %w", err)
+	}
 
 	// Track the init process
 	proc := &processState{
@@ -260,20 +544,80 @@ func (s *Service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (*ta
 		stdout:      r.Stdout,
 		stderr:      r.Stderr,
 		terminal:    r.Terminal,
+		done:        make(chan struct{}),
 	}
 	s.processes[r.ID] = proc
+	s.saveState()
+	s.emitCreate(r, sandbox.PID)
 
 	return &taskAPI.CreateTaskResponse{
 		Pid: uint32(sandbox.PID),
 	}, nil
 }
 
+// setupSandbox sets up everything around the VM of the current sandbox:
+// its metadata, the mTLS proxy, service routing, the agent connection and
+// the guest watchers. Must be called with s.mu held.
+func (s *Service) setupSandbox(ctx context.Context, annotations map[string]string, mtls []network.PortMapping) error {
+	sandbox := s.sandbox
+	s.recordSandboxMetrics()
+	if err := s.populateMetadata(ctx, annotations); err != nil {
+		return fmt.Errorf("failed to populate metadata: %w", err)
+	}
+	if err := s.startMTLSProxy(mtls); err != nil {
+		return fmt.Errorf("failed to start mTLS proxy: %w", err)
+	}
+	if err := s.startServiceRouter(); err != nil {
+		return fmt.Errorf("failed to route services: %w", err)
+	}
+
+	// Connect to the guest agent
+	s.agentClient = agent.NewClient(s.log)
+	s.agentClient.SetAuthKey(sandbox.AgentKey)
+	s.recordAgentCalls(s.agentClient, sandbox.ID)
+	connectStart := time.Now()
+	err := s.agentClient.Connect(ctx, sandbox.VsockPath, sandbox.VsockCID, vm.AgentPort(sandbox.VMConfig))
+	trace.Record(filepath.Join(s.runtimeDir, s.sandbox.ID), trace.PhaseAgentReady, connectStart, err)
+	if err != nil {
+		return fmt.Errorf("failed to connect to agent: %w", err)
+	}
+	if sandbox.Resized && sandbox.VMConfig.VcpuCount > 0 {
+		// Firecracker can't unplug vCPUs, so the guest takes the surplus offline
+		if err := s.agentClient.SetOnlineCPUs(ctx, sandbox.VMConfig.VcpuCount); err != nil {
+			s.log.WithError(err).Warn("Failed to take surplus vCPUs offline")
+		}
+	}
+	// CNI routes beyond the default one, e.g. service and node-local CIDRs
+	if len(sandbox.Routes) > 0 {
+		if !s.agentClient.Supports(agent.FeatureRoutes) {
+			s.log.Warn("Guest agent can't set routes, only the default route applies")
+		} else if err := s.agentClient.SetRoutes(ctx, sandbox.Routes); err != nil {
+			return fmt.Errorf("failed to set guest routes: %w", err)
+		}
+	}
+	s.startHeartbeat()
+	s.startNotificationListener()
+	s.startAgentLogs()
+	s.startLiveness()
+	s.startControl()
+	return nil
+}
+
 // Start starts a created task.
 func (s *Service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
 	s.log.WithFields(logrus.Fields{
 		"id":      r.ID,
 		"exec_id": r.ExecID,
 	}).Info("Starting task")
+	defer metrics.Global().TrackInFlight(metrics.InFlightStart)()
+	// Only tasks are limited; execs don't touch the VM
+	if r.ExecID == "" {
+		release, err := s.taskLimits.acquire(ctx, metrics.TaskOpStart)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -288,12 +632,31 @@ func (s *Service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.
 		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "process %s not found", procID)
 	}
 
+	// Dry-run tasks exit as soon as they start
+	if proc.dryRun {
+		s.emit(&eventstypes.TaskStart{ContainerID: proc.containerID})
+		s.setExited(proc, 0, time.Now())
+		return &taskAPI.StartResponse{}, nil
+	}
+
 	// Start the container via the agent
+	startStart := time.Now()
 	pid, err := s.agentClient.StartContainer(ctx, proc.containerID)
+	if r.ExecID == "" {
+		trace.Record(filepath.Join(s.runtimeDir, s.sandbox.ID), trace.PhaseContainerStart, startStart, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to start container: %w", err)
 	}
 	proc.pid = pid
+	s.saveState()
+	s.emit(&eventstypes.TaskStart{ContainerID: proc.containerID, Pid: uint32(pid)})
+
+	if r.ExecID == "" {
+		if err := s.runHooks(ctx, hooks.EventStart, proc); err != nil {
+			return nil, fmt.Errorf("start hook failed: %w", err)
+		}
+	}
 
 	return &taskAPI.StartResponse{
 		Pid: uint32(pid),
@@ -306,6 +669,13 @@ func (s *Service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 		"id":      r.ID,
 		"exec_id": r.ExecID,
 	}).Info("Deleting task")
+	if r.ExecID == "" {
+		release, err := s.taskLimits.acquire(ctx, metrics.TaskOpDelete)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -321,7 +691,7 @@ func (s *Service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 	}
 
 	// Remove the container via the agent
-	if s.agentClient != nil {
+	if s.agentClient != nil && !proc.dryRun {
 		if err := s.agentClient.RemoveContainer(ctx, proc.containerID); err != nil {
 			s.log.WithError(err).Warn("Error removing container")
 		}
@@ -332,10 +702,23 @@ func (s *Service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 
 	// If this is the init process, release the VM
 	if r.ExecID == "" && s.sandbox != nil {
+		_ = s.runHooks(ctx, hooks.EventStop, proc)
+		s.stopHeartbeat()
+		s.stopLiveness()
+		s.stopNotificationListener()
+		s.stopAgentLogs()
+		s.stopMTLSProxy()
+		s.stopServiceRouter()
+		s.stopControl()
+		s.removeState(s.sandbox.ID)
+		metrics.Global().RemoveSandbox(s.sandbox.ID)
 		if err := s.vmPool.Release(ctx, s.sandbox); err != nil {
 			s.log.WithError(err).Warn("Error releasing VM to pool")
 		}
+		_ = s.runHooks(ctx, hooks.EventDestroy, proc)
 		s.sandbox = nil
+	} else {
+		s.saveState()
 	}
 
 	var exitedAt *timestamppb.Timestamp
@@ -343,6 +726,14 @@ func (s *Service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 		exitedAt = timestamppb.New(proc.exitedAt)
 	}
 
+	s.emit(&eventstypes.TaskDelete{
+		ContainerID: proc.containerID,
+		ID:          proc.id,
+		Pid:         uint32(proc.pid),
+		ExitStatus:  uint32(proc.exitStatus),
+		ExitedAt:    exitedAt,
+	})
+
 	return &taskAPI.DeleteResponse{
 		Pid:        uint32(proc.pid),
 		ExitStatus: uint32(proc.exitStatus),
@@ -370,6 +761,11 @@ func (s *Service) Kill(ctx context.Context, r *taskAPI.KillRequest) (*emptypb.Em
 		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "process %s not found", procID)
 	}
 
+	if proc.dryRun {
+		s.setExited(proc, 0, time.Now())
+		return &emptypb.Empty{}, nil
+	}
+
 	// Send signal via the agent
 	timeout := 30 * time.Second
 	if err := s.agentClient.StopContainer(ctx, proc.containerID, timeout); err != nil {
@@ -416,6 +812,7 @@ func (s *Service) Pause(ctx context.Context, r *taskAPI.PauseRequest) (*emptypb.
 	if err := s.vmManager.PauseVM(ctx, s.sandbox); err != nil {
 		return nil, fmt.Errorf("failed to pause VM: %w", err)
 	}
+	s.emit(&eventstypes.TaskPaused{ContainerID: r.ID})
 
 	return &emptypb.Empty{}, nil
 }
@@ -429,6 +826,7 @@ func (s *Service) Resume(ctx context.Context, r *taskAPI.ResumeRequest) (*emptyp
 	if err := s.vmManager.ResumeVM(ctx, s.sandbox); err != nil {
 		return nil, fmt.Errorf("failed to resume VM: %w", err)
 	}
+	s.emit(&eventstypes.TaskResumed{ContainerID: r.ID})
 
 	return &emptypb.Empty{}, nil
 }
@@ -459,39 +857,87 @@ func (s *Service) Wait(ctx context.Context, r *taskAPI.WaitRequest) (*taskAPI.Wa
 		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "process %s not found", procID)
 	}
 
-	// In a real implementation, you'd wait on a channel here
-	// For now, just return current state if exited
-	if !proc.exitedAt.IsZero() {
-		return &taskAPI.WaitResponse{
-			ExitStatus: uint32(proc.exitStatus),
-			ExitedAt:   timestamppb.New(proc.exitedAt),
-		}, nil
+	// Block until the process exits or the context is cancelled
+	select {
+	case <-proc.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
-	// Block until context cancelled or process exits
-	<-ctx.Done()
-	return nil, ctx.Err()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &taskAPI.WaitResponse{
+		ExitStatus: uint32(proc.exitStatus),
+		ExitedAt:   timestamppb.New(proc.exitedAt),
+	}, nil
 }
 
-// Stats returns resource usage statistics.
+// Stats returns resource usage statistics. A container of the pod reports
+// its own usage in the guest. The sandbox reports the pod as a whole: its
+// containers plus the overhead of the VM, from the host usage of the VMM,
+// so the tasks of a pod add up to what the VM really uses.
 func (s *Service) Stats(ctx context.Context, r *taskAPI.StatsRequest) (*taskAPI.StatsResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.agentClient == nil {
-		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "no agent connection")
+	if s.sandbox == nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "no sandbox")
+	}
+
+	var m *cgroupstats.Metrics
+	if proc, ok := s.processes[r.ID]; ok && r.ID != s.id && !proc.dryRun && s.agentClient != nil {
+		stats, err := s.agentClient.GetContainerStats(ctx, r.ID)
+		if err != nil {
+			return nil, errdefs.ToGRPCf(errdefs.ErrUnavailable, "failed to get container stats: %v", err)
+		}
+		m = containerMetrics(stats)
+	} else {
+		host, err := s.vmManager.CgroupStats(s.sandbox)
+		if err != nil {
+			return nil, errdefs.ToGRPCf(errdefs.ErrUnavailable, "failed to get stats: %v", err)
+		}
+		metrics.Global().SetSandboxHostUsage(s.sandbox.ID, hostUsage(host))
+
+		// Without the guest's view, the VM as a whole is the best there is
+		m = cgroupMetrics(host)
+		if pod, err := s.podStats(ctx); err != nil {
+			s.log.WithError(err).Debug("Failed to get container stats, reporting VM usage")
+		} else {
+			usage := newPodUsage(pod, host)
+			metrics.Global().SetSandboxPodUsage(s.sandbox.ID, usage.metrics())
+			m = podMetrics(usage, host)
+		}
 	}
 
-	stats, err := s.agentClient.GetContainerStats(ctx, r.ID)
+	data, err := typeurl.MarshalAny(m)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get stats: %w", err)
+		return nil, fmt.Errorf("failed to marshal stats: %w", err)
 	}
+	return &taskAPI.StatsResponse{Stats: protobuf.FromAny(data)}, nil
+}
 
-	// Convert to containerd stats format
-	// This is simplified - real implementation would use cgroups metrics
-	_ = stats // TODO: Convert stats
+// podStats gets the usage of the pod's containers from the agent. Agents
+// that can't report them at once are asked for one container at a time.
+func (s *Service) podStats(ctx context.Context) (*domain.PodStats, error) {
+	if s.agentClient == nil {
+		return nil, fmt.Errorf("not connected to agent")
+	}
+	if s.agentClient.Supports(agent.FeaturePodStats) {
+		return s.agentClient.GetPodStats(ctx)
+	}
 
-	return &taskAPI.StatsResponse{}, nil
+	pod := &domain.PodStats{Containers: make(map[string]*domain.ContainerStats)}
+	for id, proc := range s.processes {
+		if id != proc.containerID || proc.dryRun || !proc.exitedAt.IsZero() {
+			continue
+		}
+		stats, err := s.agentClient.GetContainerStats(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		pod.Containers[id] = stats
+	}
+	return pod, nil
 }
 
 // Connect returns shim information.
@@ -514,8 +960,31 @@ func (s *Service) Shutdown(ctx context.Context, r *taskAPI.ShutdownRequest) (*em
 
 	s.cancel()
 
+	s.mu.Lock()
+	s.stopHeartbeat()
+	s.stopLiveness()
+	s.stopNotificationListener()
+	s.stopAgentLogs()
+	s.stopMTLSProxy()
+	s.stopServiceRouter()
+	s.stopControl()
+	s.mu.Unlock()
+
+	// Give in-flight sandboxes a chance to be released before tearing down
 	if s.vmPool != nil {
-		s.vmPool.Close(ctx)
+		if _, err := s.vmPool.Drain(ctx); err != nil {
+			s.log.WithError(err).Warn("Error draining VM pool")
+		}
+	}
+	// Stops retrying networks left pending by CNI plugin timeouts
+	if s.vmManager != nil {
+		s.vmManager.Close()
+	}
+
+	if s.closeLog != nil {
+		if err := s.closeLog(); err != nil {
+			logrus.WithError(err).WithField("id", s.id).Warn("Failed to close sandbox log")
+		}
 	}
 
 	if s.shutdown != nil {
@@ -546,27 +1015,64 @@ func (s *Service) processStatus(proc *processState) task.Status {
 		return task.Status_STOPPED
 	}
 	if proc.pid > 0 {
+		// Nothing is known about processes in a guest that stopped answering
+		if s.agentDown {
+			return task.Status_UNKNOWN
+		}
 		return task.Status_RUNNING
 	}
 	return task.Status_CREATED
 }
 
-func (s *Service) forwardEvents() {
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		case e := <-s.events:
-			if err := s.publisher.Publish(s.ctx, getTopic(e), e); err != nil {
-				s.log.WithError(err).Warn("Failed to publish event")
-			}
-		}
+// recordSandboxMetrics exports the resources of the current sandbox, labeled
+// with the pod it belongs to.
+func (s *Service) recordSandboxMetrics() {
+	sandbox := s.sandbox
+	annotations := bundleAnnotations(s.bundle)
+	sandbox.Namespace = annotations[annotationSandboxNamespace]
+	sandbox.Name = annotations[annotationSandboxName]
+
+	metrics.Global().SetSandboxResources(metrics.SandboxLabels{
+		SandboxID: sandbox.ID,
+		Namespace: sandbox.Namespace,
+		Pod:       sandbox.Name,
+	}, sandbox.VMConfig.MemoryMB, sandbox.VMConfig.VcpuCount)
+}
+
+// bundleAnnotations reads the annotations from a bundle's OCI spec.
+func bundleAnnotations(bundle string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil
+	}
+
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil
 	}
+	return spec.Annotations
 }
 
-func getTopic(e interface{}) string {
-	switch e.(type) {
-	default:
-		return "/tasks/unknown"
+// podAnnotations reads a bundle's annotations with deprecated keys
+// replaced by their current ones.
+func podAnnotations(bundle string) map[string]string {
+	return annotation.Normalize(bundleAnnotations(bundle))
+}
+
+// recordAgentCalls records a client's calls to the sandbox's agent when
+// FC_CRI_AGENT_RECORD_DIR is set, for replay in tests (see agent.Replayer).
+func (s *Service) recordAgentCalls(client *agent.Client, sandboxID string) {
+	dir := os.Getenv("FC_CRI_AGENT_RECORD_DIR")
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.log.WithError(err).Warn("Failed to create agent recording dir")
+		return
+	}
+	if err := client.RecordTo(filepath.Join(dir, sandboxID+".jsonl")); err != nil {
+		s.log.WithError(err).Warn("Failed to record agent calls")
 	}
 }
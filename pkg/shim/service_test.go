@@ -4,6 +4,8 @@ import (
 	"context"
 	"testing"
 	"time"
+
+	"github.com/containerd/containerd/events"
 )
 
 // MockPublisher implements shim.Publisher
@@ -11,11 +13,15 @@ type MockPublisher struct {
 	events []interface{}
 }
 
-func (p *MockPublisher) Publish(ctx context.Context, topic string, event interface{}) error {
+func (p *MockPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
 	p.events = append(p.events, event)
 	return nil
 }
 
+func (p *MockPublisher) Close() error {
+	return nil
+}
+
 func TestNewService(t *testing.T) {
 	// This test sets up the service but we can't fully initialize it
 	// because it tries to create VM manager which needs directories.
@@ -56,6 +62,13 @@ func TestService_ProcessStatus(t *testing.T) {
 		t.Logf("Status for running process: %v", status)
 	}
 
+	// Test Unknown while the agent is unreachable
+	s.agentDown = true
+	if status = s.processStatus(proc); status != 0 { // task.Status_UNKNOWN
+		t.Errorf("Status with the agent down = %v, want UNKNOWN", status)
+	}
+	s.agentDown = false
+
 	// Test Stopped
 	proc.exitedAt = time.Now()
 	status = s.processStatus(proc)
@@ -64,16 +77,6 @@ func TestService_ProcessStatus(t *testing.T) {
 	}
 }
 
-func TestGetTopic(t *testing.T) {
-	// Test topic mapping
-	// Since we can't easily import events package here without adding deps,
-	// we'll skip exact type matching and just ensure it returns "unknown" for nil.
-	topic := getTopic(nil)
-	if topic != "/tasks/unknown" {
-		t.Errorf("getTopic(nil) = %s, want /tasks/unknown", topic)
-	}
-}
-
 // NOTE: Most Shim methods (Create, Start, Delete) depend heavily on
 // vm.Pool and agent.Client. Without dependency injection (interfaces),
 // these are very hard to unit test in isolation.
@@ -0,0 +1,49 @@
+package shim
+
+import (
+	"os"
+
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+// serviceRoutingConfig returns the service routing configuration, from the
+// environment containerd starts the shim with.
+func serviceRoutingConfig() network.ServiceRoutingConfig {
+	config := network.DefaultServiceRoutingConfig()
+	if mode := os.Getenv("FC_CRI_NETWORK_SERVICE_ROUTING"); mode != "" {
+		config.Mode = mode
+	}
+	if path := os.Getenv("FC_CRI_NETWORK_SERVICES_FILE"); path != "" {
+		config.ServicesFile = path
+	}
+	return config
+}
+
+// startServiceRouter starts routing the current sandbox's traffic to
+// ClusterIPs, if the node routes services itself. Must be called with s.mu
+// held.
+func (s *Service) startServiceRouter() error {
+	if s.sandbox == nil || s.serviceRouting.Mode == network.ServiceRoutingNone {
+		return nil
+	}
+	if s.sandbox.IP == nil {
+		s.log.WithField("sandbox_id", s.sandbox.ID).Warn("Sandbox has no IP, not routing services")
+		return nil
+	}
+
+	router, err := network.StartServiceRouter(s.serviceRouting, s.sandbox.ID, s.sandbox.IP, s.log.WithField("sandbox_id", s.sandbox.ID))
+	if err != nil {
+		return err
+	}
+	s.serviceRouter = router
+	return nil
+}
+
+// stopServiceRouter removes the sandbox's service rules. Must be called
+// with s.mu held.
+func (s *Service) stopServiceRouter() {
+	if s.serviceRouter != nil {
+		s.serviceRouter.Stop()
+		s.serviceRouter = nil
+	}
+}
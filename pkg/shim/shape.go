@@ -0,0 +1,37 @@
+package shim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// applyShape sets the vCPUs and memory a pod asked for, leaving the
+// defaults for the ones it didn't.
+func applyShape(vmConfig *domain.VMConfig, annotations map[string]string) error {
+	var err error
+	if vmConfig.VcpuCount, err = shapeAnnotation(annotations, annotation.VCPUs, vmConfig.VcpuCount); err != nil {
+		return err
+	}
+	if vmConfig.MemoryMB, err = shapeAnnotation(annotations, annotation.MemoryMB, vmConfig.MemoryMB); err != nil {
+		return err
+	}
+	return nil
+}
+
+// shapeAnnotation returns the positive number set by an annotation, or def
+// if it is not set.
+func shapeAnnotation(annotations map[string]string, key string, def int64) (int64, error) {
+	value := strings.TrimSpace(annotations[key])
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a positive number", key, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,35 @@
+package shim
+
+import (
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/annotation"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestApplyShape(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		vcpus       int64
+		memoryMB    int64
+		wantErr     bool
+	}{
+		{nil, 1, 128, false},
+		{map[string]string{annotation.VCPUs: "2", annotation.MemoryMB: "1024"}, 2, 1024, false},
+		{map[string]string{annotation.MemoryMB: " 512 "}, 1, 512, false},
+		{map[string]string{annotation.VCPUs: "0"}, 0, 0, true},
+		{map[string]string{annotation.MemoryMB: "1Gi"}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		vmConfig := domain.DefaultVMConfig()
+		err := applyShape(&vmConfig, tt.annotations)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("applyShape(%v) error = %v, wantErr %v", tt.annotations, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (vmConfig.VcpuCount != tt.vcpus || vmConfig.MemoryMB != tt.memoryMB) {
+			t.Errorf("applyShape(%v) = %d vCPU, %d MiB, want %d, %d", tt.annotations, vmConfig.VcpuCount, vmConfig.MemoryMB, tt.vcpus, tt.memoryMB)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package shim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// stateFileName is the name of the persisted state file inside a sandbox's
+// runtime directory (<runtime_dir>/<sandbox-id>/state.json).
+const stateFileName = "state.json"
+
+// persistedState is the on-disk representation of a shim's state.
+// It is rewritten after every mutation so that a restarted shim can
+// re-adopt the VM instead of leaving it orphaned.
+type persistedState struct {
+	ShimID    string          `json:"shim_id"`
+	Namespace string          `json:"namespace"`
+	Bundle    string          `json:"bundle"`
+	Sandbox   sandboxRecord   `json:"sandbox"`
+	Processes []processRecord `json:"processes"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// sandboxRecord holds the sandbox fields needed to reconnect to a VM.
+type sandboxRecord struct {
+	ID        string          `json:"id"`
+	PID       int             `json:"pid"`
+	VsockPath string          `json:"vsock_path"`
+	VsockCID  uint32          `json:"vsock_cid"`
+	VMConfig  domain.VMConfig `json:"vm_config"`
+	AgentKey  []byte          `json:"agent_key,omitempty"`
+	Rootfs    string          `json:"rootfs,omitempty"`
+	Dir       string          `json:"dir,omitempty"`
+	IPs       []string        `json:"ips,omitempty"` // CIDRs, the primary first
+	Gateway   string          `json:"gateway,omitempty"`
+	Network   *networkRecord  `json:"network,omitempty"`
+	Networks  []extraNetwork  `json:"networks,omitempty"`
+	FromPool  bool            `json:"from_pool"`
+	CreatedAt time.Time       `json:"created_at"`
+	StartedAt time.Time       `json:"started_at"`
+}
+
+// networkRecord is how the sandbox is attached to the node's network, read
+// by the control API and fcctl for policy agents.
+type networkRecord struct {
+	NetNS    string `json:"netns"`
+	IfName   string `json:"ifname"`
+	IfMAC    string `json:"if_mac,omitempty"`
+	Tap      string `json:"tap"`
+	VethPeer string `json:"veth_peer,omitempty"`
+	GuestMAC string `json:"guest_mac,omitempty"`
+}
+
+// extraNetwork is one of the sandbox's additional networks, kept so they
+// are deleted from CNI when a recovered sandbox is torn down.
+type extraNetwork struct {
+	Name     string   `json:"name"`
+	IfName   string   `json:"ifname"`
+	Tap      string   `json:"tap"`
+	GuestMAC string   `json:"guest_mac,omitempty"`
+	IPs      []string `json:"ips,omitempty"`
+}
+
+// processRecord is the serializable form of processState.
+type processRecord struct {
+	ID          string    `json:"id"`
+	ContainerID string    `json:"container_id"`
+	PID         int       `json:"pid"`
+	ExitStatus  int       `json:"exit_status"`
+	ExitedAt    time.Time `json:"exited_at,omitempty"`
+	Stdin       string    `json:"stdin,omitempty"`
+	Stdout      string    `json:"stdout,omitempty"`
+	Stderr      string    `json:"stderr,omitempty"`
+	Terminal    bool      `json:"terminal"`
+}
+
+// saveState persists the current shim state. Must be called with s.mu held.
+func (s *Service) saveState() {
+	if s.sandbox == nil {
+		return
+	}
+
+	state := persistedState{
+		ShimID:    s.id,
+		Namespace: s.namespace,
+		Bundle:    s.bundle,
+		Sandbox: sandboxRecord{
+			ID:        s.sandbox.ID,
+			PID:       s.sandbox.PID,
+			VsockPath: s.sandbox.VsockPath,
+			VsockCID:  s.sandbox.VsockCID,
+			VMConfig:  s.sandbox.VMConfig,
+			AgentKey:  s.sandbox.AgentKey,
+			Rootfs:    s.sandbox.RootfsPath,
+			Dir:       s.sandbox.Dir,
+			IPs:       addressStrings(s.sandbox.IPs),
+			Network:   attachmentRecord(s.sandbox.Attachment),
+			Networks:  extraNetworkRecords(s.sandbox.Networks),
+			FromPool:  s.sandbox.FromPool,
+			CreatedAt: s.sandbox.CreatedAt,
+			StartedAt: s.sandbox.StartedAt,
+		},
+		UpdatedAt: time.Now(),
+	}
+	if s.sandbox.Gateway != nil {
+		state.Sandbox.Gateway = s.sandbox.Gateway.String()
+	}
+	for _, proc := range s.processes {
+		state.Processes = append(state.Processes, processRecord{
+			ID:          proc.id,
+			ContainerID: proc.containerID,
+			PID:         proc.pid,
+			ExitStatus:  proc.exitStatus,
+			ExitedAt:    proc.exitedAt,
+			Stdin:       proc.stdin,
+			Stdout:      proc.stdout,
+			Stderr:      proc.stderr,
+			Terminal:    proc.terminal,
+		})
+	}
+
+	path := filepath.Join(s.runtimeDir, s.sandbox.ID, stateFileName)
+	if err := writeStateFile(path, &state); err != nil {
+		s.log.WithError(err).Warn("Failed to persist shim state")
+	}
+}
+
+// removeState deletes the persisted state for a sandbox.
+func (s *Service) removeState(sandboxID string) {
+	path := filepath.Join(s.runtimeDir, sandboxID, stateFileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		s.log.WithError(err).Warn("Failed to remove shim state")
+	}
+}
+
+// recover looks for state left behind by a previous instance of this shim
+// and re-adopts its VM. It is a no-op if no matching state exists.
+func (s *Service) recover(ctx context.Context) error {
+	state, err := findState(s.runtimeDir, s.id, s.namespace)
+	if err != nil || state == nil {
+		return err
+	}
+
+	log := s.log.WithField("sandbox_id", state.Sandbox.ID)
+	log.Info("Recovering sandbox from persisted state")
+	// Only a shim that died leaves state behind
+	metrics.Global().RecordComponentEvent(metrics.ComponentShim, metrics.EventRestart)
+
+	sandbox := domain.NewSandbox(state.Sandbox.ID)
+	sandbox.PID = state.Sandbox.PID
+	sandbox.VsockPath = state.Sandbox.VsockPath
+	sandbox.VsockCID = state.Sandbox.VsockCID
+	sandbox.VMConfig = state.Sandbox.VMConfig
+	sandbox.AgentKey = state.Sandbox.AgentKey
+	sandbox.RootfsPath = state.Sandbox.Rootfs
+	sandbox.Dir = state.Sandbox.Dir
+	restoreAddresses(sandbox, state.Sandbox.IPs, state.Sandbox.Gateway)
+	sandbox.Attachment = restoreAttachment(state.Sandbox.Network)
+	sandbox.Networks = restoreExtraNetworks(state.Sandbox.Networks)
+	sandbox.FromPool = state.Sandbox.FromPool
+	sandbox.CreatedAt = state.Sandbox.CreatedAt
+	sandbox.StartedAt = state.Sandbox.StartedAt
+
+	if err := s.vmManager.AdoptVM(ctx, sandbox); err != nil {
+		// The VM is gone; the state is stale and only confuses later runs.
+		s.removeState(state.Sandbox.ID)
+		return fmt.Errorf("failed to adopt VM: %w", err)
+	}
+	s.vmPool.Adopt(sandbox)
+
+	client := agent.NewClient(s.log)
+	client.SetAuthKey(sandbox.AgentKey)
+	s.recordAgentCalls(client, sandbox.ID)
+	if err := client.Connect(ctx, sandbox.VsockPath, sandbox.VsockCID, vm.AgentPort(sandbox.VMConfig)); err != nil {
+		log.WithError(err).Warn("Failed to reconnect to agent of recovered sandbox")
+		metrics.Global().RecordAgentConnectError()
+	} else {
+		s.agentClient = client
+		metrics.Global().RecordComponentEvent(metrics.ComponentAgent, metrics.EventReconnect)
+	}
+
+	s.sandbox = sandbox
+	s.bundle = state.Bundle
+	s.recordSandboxMetrics()
+	s.startHeartbeat()
+	s.startLiveness()
+	for _, rec := range state.Processes {
+		proc := &processState{
+			id:          rec.ID,
+			containerID: rec.ContainerID,
+			pid:         rec.PID,
+			exitStatus:  rec.ExitStatus,
+			exitedAt:    rec.ExitedAt,
+			stdin:       rec.Stdin,
+			stdout:      rec.Stdout,
+			stderr:      rec.Stderr,
+			terminal:    rec.Terminal,
+			done:        make(chan struct{}),
+		}
+		s.processes[rec.ID] = proc
+
+		if !proc.exitedAt.IsZero() {
+			close(proc.done)
+		}
+	}
+	s.startNotificationListener()
+	if s.agentClient != nil {
+		s.startAgentLogs()
+	}
+	if ports, err := mtlsPorts(podAnnotations(s.bundle)); err == nil {
+		if err := s.startMTLSProxy(ports); err != nil {
+			log.WithError(err).Warn("Failed to restart mTLS proxy of recovered sandbox")
+		}
+	}
+	if err := s.startServiceRouter(); err != nil {
+		log.WithError(err).Warn("Failed to restart service routing of recovered sandbox")
+	}
+	s.startControl()
+	s.reconcileExits()
+
+	log.WithField("processes", len(state.Processes)).Info("Sandbox recovered")
+	return nil
+}
+
+// addressStrings formats a sandbox's addresses for its persisted state.
+func addressStrings(addresses []*net.IPNet) []string {
+	var cidrs []string
+	for _, address := range addresses {
+		cidrs = append(cidrs, address.String())
+	}
+	return cidrs
+}
+
+// restoreAddresses sets a recovered sandbox's addresses and gateway from
+// its persisted state, skipping any that don't parse.
+func restoreAddresses(sandbox *domain.Sandbox, cidrs []string, gateway string) {
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		sandbox.IPs = append(sandbox.IPs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	if len(sandbox.IPs) > 0 {
+		sandbox.IP = sandbox.IPs[0].IP
+		sandbox.Netmask = sandbox.IPs[0].Mask
+	}
+	sandbox.Gateway = net.ParseIP(gateway)
+}
+
+// attachmentRecord returns a sandbox's network attachment for its persisted
+// state, nil if it has no network namespace.
+func attachmentRecord(a domain.NetworkAttachment) *networkRecord {
+	if a.NetNS == "" {
+		return nil
+	}
+	return &networkRecord{
+		NetNS:    a.NetNS,
+		IfName:   a.IfName,
+		IfMAC:    a.IfMAC,
+		Tap:      a.TapName,
+		VethPeer: a.VethPeer,
+		GuestMAC: a.GuestMAC,
+	}
+}
+
+// restoreAttachment returns a recovered sandbox's network attachment.
+func restoreAttachment(n *networkRecord) domain.NetworkAttachment {
+	if n == nil {
+		return domain.NetworkAttachment{}
+	}
+	return domain.NetworkAttachment{
+		NetNS:    n.NetNS,
+		IfName:   n.IfName,
+		IfMAC:    n.IfMAC,
+		TapName:  n.Tap,
+		VethPeer: n.VethPeer,
+		GuestMAC: n.GuestMAC,
+	}
+}
+
+// extraNetworkRecords returns a sandbox's additional networks for its
+// persisted state.
+func extraNetworkRecords(networks []domain.AdditionalNetwork) []extraNetwork {
+	var records []extraNetwork
+	for _, n := range networks {
+		records = append(records, extraNetwork{
+			Name:     n.Name,
+			IfName:   n.IfName,
+			Tap:      n.TapName,
+			GuestMAC: n.GuestMAC,
+			IPs:      addressStrings(n.IPs),
+		})
+	}
+	return records
+}
+
+// restoreExtraNetworks returns a recovered sandbox's additional networks.
+// Their routes are only needed at boot and aren't kept.
+func restoreExtraNetworks(records []extraNetwork) []domain.AdditionalNetwork {
+	var networks []domain.AdditionalNetwork
+	for _, r := range records {
+		n := domain.AdditionalNetwork{Name: r.Name, IfName: r.IfName, TapName: r.Tap, GuestMAC: r.GuestMAC}
+		for _, cidr := range r.IPs {
+			if ip, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				n.IPs = append(n.IPs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+			}
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// findState scans the runtime directory for state persisted by the shim
+// with the given ID and namespace.
+func findState(runtimeDir, shimID, namespace string) (*persistedState, error) {
+	entries, err := os.ReadDir(runtimeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// Sandboxes in a runtime dir class are links to their directory
+		if !entry.IsDir() && entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		state, err := readStateFile(filepath.Join(runtimeDir, entry.Name(), stateFileName))
+		if err != nil {
+			continue
+		}
+		if state.ShimID == shimID && state.Namespace == namespace {
+			return state, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// writeStateFile atomically writes state to path.
+func writeStateFile(path string, state *persistedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readStateFile reads persisted state from path.
+func readStateFile(path string) (*persistedState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -0,0 +1,138 @@
+package shim
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestService_SaveState(t *testing.T) {
+	runtimeDir := t.TempDir()
+
+	sb := domain.NewSandbox("fc-123")
+	sb.PID = 4242
+	sb.VsockCID = 7
+	sb.VsockPath = "/run/fc-cri/fc-123/vsock.sock"
+	restoreAddresses(sb, []string{"10.88.0.5/16", "fd00:fc::5/64"}, "10.88.0.1")
+	sb.Attachment = domain.NetworkAttachment{
+		NetNS:    "/run/netns/fc-fc-123",
+		IfName:   "eth0",
+		TapName:  "tap0",
+		VethPeer: "veth1a2b3c4d",
+		GuestMAC: "02:fc:01:02:03:04",
+	}
+	sb.Networks = []domain.AdditionalNetwork{{
+		Name:     "storage",
+		IfName:   "net1",
+		TapName:  "tap1",
+		GuestMAC: "02:fc:05:06:07:08",
+		IPs:      []*net.IPNet{{IP: net.ParseIP("10.30.0.5"), Mask: net.CIDRMask(24, 32)}},
+	}}
+	if err := os.MkdirAll(filepath.Join(runtimeDir, sb.ID), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{
+		id:         "shim-a",
+		namespace:  "k8s.io",
+		bundle:     "/run/containerd/bundle",
+		runtimeDir: runtimeDir,
+		sandbox:    sb,
+		processes: map[string]*processState{
+			"ctr1": {id: "ctr1", containerID: "ctr1", pid: 12, exitedAt: time.Now()},
+		},
+		log: logrus.NewEntry(logrus.New()),
+	}
+
+	s.saveState()
+
+	state, err := findState(runtimeDir, "shim-a", "k8s.io")
+	if err != nil {
+		t.Fatalf("findState failed: %v", err)
+	}
+	if state == nil {
+		t.Fatal("persisted state not found")
+	}
+	if state.Sandbox.ID != "fc-123" || state.Sandbox.PID != 4242 || state.Sandbox.VsockCID != 7 {
+		t.Errorf("unexpected sandbox record: %+v", state.Sandbox)
+	}
+	recovered := domain.NewSandbox(state.Sandbox.ID)
+	restoreAddresses(recovered, state.Sandbox.IPs, state.Sandbox.Gateway)
+	if len(recovered.IPs) != 2 || recovered.IP.String() != "10.88.0.5" || recovered.IPs[1].String() != "fd00:fc::5/64" || recovered.Gateway.String() != "10.88.0.1" {
+		t.Errorf("recovered addresses = %v (primary %s, gateway %s)", recovered.IPs, recovered.IP, recovered.Gateway)
+	}
+	if got := restoreAttachment(state.Sandbox.Network); got != sb.Attachment {
+		t.Errorf("recovered attachment = %+v, want %+v", got, sb.Attachment)
+	}
+	if networks := restoreExtraNetworks(state.Sandbox.Networks); len(networks) != 1 || networks[0].TapName != "tap1" ||
+		len(networks[0].IPs) != 1 || networks[0].IPs[0].String() != "10.30.0.5/24" {
+		t.Errorf("recovered networks = %+v", networks)
+	}
+	if len(state.Processes) != 1 || state.Processes[0].PID != 12 {
+		t.Errorf("unexpected processes: %+v", state.Processes)
+	}
+
+	// A different shim must not pick up this state
+	other, err := findState(runtimeDir, "shim-b", "k8s.io")
+	if err != nil {
+		t.Fatalf("findState failed: %v", err)
+	}
+	if other != nil {
+		t.Error("findState returned state belonging to another shim")
+	}
+
+	s.removeState(sb.ID)
+	if _, err := os.Stat(filepath.Join(runtimeDir, sb.ID, stateFileName)); !os.IsNotExist(err) {
+		t.Error("state file was not removed")
+	}
+}
+
+func TestFindState_MissingDir(t *testing.T) {
+	state, err := findState(filepath.Join(t.TempDir(), "missing"), "shim", "ns")
+	if err != nil {
+		t.Errorf("findState on missing dir returned error: %v", err)
+	}
+	if state != nil {
+		t.Error("findState on missing dir returned state")
+	}
+}
+
+func TestFindState_RuntimeDirClass(t *testing.T) {
+	runtimeDir := t.TempDir()
+	classDir := filepath.Join(t.TempDir(), "fc-123")
+	if err := os.MkdirAll(classDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(classDir, filepath.Join(runtimeDir, "fc-123")); err != nil {
+		t.Fatal(err)
+	}
+
+	sb := domain.NewSandbox("fc-123")
+	sb.Dir = classDir
+	s := &Service{
+		id:         "shim-a",
+		namespace:  "k8s.io",
+		runtimeDir: runtimeDir,
+		sandbox:    sb,
+		processes:  map[string]*processState{},
+		log:        logrus.NewEntry(logrus.New()),
+	}
+	s.saveState()
+
+	// The state lands in the class's directory and is found through the link
+	if _, err := os.Stat(filepath.Join(classDir, stateFileName)); err != nil {
+		t.Fatalf("state not written to the class directory: %v", err)
+	}
+	state, err := findState(runtimeDir, "shim-a", "k8s.io")
+	if err != nil || state == nil {
+		t.Fatalf("findState() = %v, %v", state, err)
+	}
+	if state.Sandbox.Dir != classDir {
+		t.Errorf("Sandbox.Dir = %q, want %q", state.Sandbox.Dir, classDir)
+	}
+}
@@ -0,0 +1,157 @@
+package shim
+
+import (
+	"math"
+
+	cgroupstats "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+// cgroupMetrics converts the host usage of a VMM to the cgroup v2 metrics
+// containerd expects from a task's Stats.
+func cgroupMetrics(stats *vm.CgroupStats) *cgroupstats.Metrics {
+	return &cgroupstats.Metrics{
+		Pids: &cgroupstats.PidsStat{
+			Current: stats.PidsCurrent,
+			Limit:   stats.PidsLimit,
+		},
+		CPU: &cgroupstats.CPUStat{
+			UsageUsec:     stats.CPUUsageUsec,
+			UserUsec:      stats.CPUUserUsec,
+			SystemUsec:    stats.CPUSystemUsec,
+			NrPeriods:     stats.CPUPeriods,
+			NrThrottled:   stats.CPUThrottled,
+			ThrottledUsec: stats.CPUThrottledUsec,
+		},
+		Memory: &cgroupstats.MemoryStat{
+			Usage:      stats.MemoryUsageBytes,
+			UsageLimit: memoryLimit(stats.MemoryLimitBytes),
+		},
+		MemoryEvents: &cgroupstats.MemoryEvents{
+			Oom:     stats.OOMEvents,
+			OomKill: stats.OOMKills,
+		},
+		Io: &cgroupstats.IOStat{
+			Usage: []*cgroupstats.IOEntry{{
+				Rbytes: stats.IOReadBytes,
+				Wbytes: stats.IOWriteBytes,
+			}},
+		},
+	}
+}
+
+// hostUsage converts the host usage of a VMM to its metrics.
+func hostUsage(stats *vm.CgroupStats) metrics.HostUsage {
+	return metrics.HostUsage{
+		CPUSeconds:          float64(stats.CPUUsageUsec) / 1e6,
+		CPUThrottledSeconds: float64(stats.CPUThrottledUsec) / 1e6,
+		MemoryBytes:         int64(stats.MemoryUsageBytes),
+		OOMKills:            int64(stats.OOMKills),
+	}
+}
+
+// podUsage is the usage of a pod: its containers, summed from their cgroups
+// in the guest, and the overhead of the VM around them. The overhead is
+// what the VMM's host cgroup uses beyond the containers: the guest kernel,
+// the agent, page cache and the VMM itself.
+type podUsage struct {
+	containers      domain.ContainerStats
+	overheadCPUUsec uint64
+	overheadMemory  uint64
+}
+
+// newPodUsage totals the containers of a pod against the host usage of its
+// VMM. Usage the guest accounts but the host hasn't caught up with yet
+// leaves no overhead rather than a negative one.
+func newPodUsage(pod *domain.PodStats, host *vm.CgroupStats) podUsage {
+	var usage podUsage
+	for _, stats := range pod.Containers {
+		usage.containers.Add(stats)
+	}
+	if cpu := usage.containers.CPUUsage / 1000; host.CPUUsageUsec > cpu {
+		usage.overheadCPUUsec = host.CPUUsageUsec - cpu
+	}
+	if host.MemoryUsageBytes > usage.containers.MemoryUsage {
+		usage.overheadMemory = host.MemoryUsageBytes - usage.containers.MemoryUsage
+	}
+	return usage
+}
+
+// metrics converts the usage of a pod to its metrics.
+func (u podUsage) metrics() metrics.PodUsage {
+	return metrics.PodUsage{
+		ContainerCPUSeconds:  float64(u.containers.CPUUsage) / 1e9,
+		ContainerMemoryBytes: int64(u.containers.MemoryUsage),
+		OverheadCPUSeconds:   float64(u.overheadCPUUsec) / 1e6,
+		OverheadMemoryBytes:  int64(u.overheadMemory),
+	}
+}
+
+// podMetrics reports a pod as a whole, as the cgroup of a pod would: its
+// containers plus the VM overhead. Limits, throttling, OOM kills and disk
+// I/O are the VMM's; processes and the breakdown of memory are the
+// containers', so the overhead counts toward the pod's working set.
+func podMetrics(usage podUsage, host *vm.CgroupStats) *cgroupstats.Metrics {
+	m := cgroupMetrics(host)
+	m.CPU.UsageUsec = usage.containers.CPUUsage/1000 + usage.overheadCPUUsec
+	m.Memory.Usage = usage.containers.MemoryUsage + usage.overheadMemory
+	m.Memory.Anon = usage.containers.MemoryAnon
+	m.Memory.File = usage.containers.MemoryFile
+	m.Memory.InactiveFile = usage.containers.MemoryInactiveFile
+	m.Memory.Pgfault = usage.containers.PageFaults
+	m.Memory.Pgmajfault = usage.containers.MajorPageFaults
+	m.Pids.Current = usage.containers.Pids
+	return m
+}
+
+// containerMetrics converts the usage of one container in the guest to the
+// cgroup v2 metrics containerd expects from a task's Stats. From these the
+// CRI plugin derives what kubelet reports in /stats/summary: the working
+// set is usage less inactive file pages, RSS is anonymous memory.
+func containerMetrics(stats *domain.ContainerStats) *cgroupstats.Metrics {
+	return &cgroupstats.Metrics{
+		Pids: &cgroupstats.PidsStat{
+			Current: stats.Pids,
+			Limit:   stats.PidsLimit,
+		},
+		CPU: &cgroupstats.CPUStat{
+			UsageUsec:     stats.CPUUsage / 1000,
+			UserUsec:      stats.CPUUser / 1000,
+			SystemUsec:    stats.CPUSystem / 1000,
+			NrPeriods:     stats.CPUPeriods,
+			NrThrottled:   stats.CPUThrottledPeriods,
+			ThrottledUsec: stats.CPUThrottled / 1000,
+		},
+		Memory: &cgroupstats.MemoryStat{
+			Usage:        stats.MemoryUsage,
+			UsageLimit:   memoryLimit(stats.MemoryLimit),
+			Anon:         stats.MemoryAnon,
+			File:         stats.MemoryFile,
+			InactiveFile: stats.MemoryInactiveFile,
+			Pgfault:      stats.PageFaults,
+			Pgmajfault:   stats.MajorPageFaults,
+		},
+		MemoryEvents: &cgroupstats.MemoryEvents{
+			Oom:     stats.OOMEvents,
+			OomKill: stats.OOMKills,
+		},
+		Io: &cgroupstats.IOStat{
+			Usage: []*cgroupstats.IOEntry{{
+				Rbytes: stats.ReadBytes,
+				Wbytes: stats.WriteBytes,
+			}},
+		},
+	}
+}
+
+// memoryLimit reports an unlimited cgroup the way the kernel does, as the
+// largest value: the CRI plugin takes anything smaller for a limit and
+// would compute the available memory from 0.
+func memoryLimit(limit uint64) uint64 {
+	if limit == 0 {
+		return math.MaxUint64
+	}
+	return limit
+}
@@ -0,0 +1,120 @@
+package shim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/vm"
+)
+
+func TestCgroupMetrics(t *testing.T) {
+	stats := &vm.CgroupStats{
+		CPUUsageUsec:     2500000,
+		CPUThrottledUsec: 500000,
+		MemoryUsageBytes: 192 << 20,
+		MemoryLimitBytes: 256 << 20,
+		OOMKills:         1,
+		IOReadBytes:      4096,
+	}
+
+	m := cgroupMetrics(stats)
+	if m.CPU.UsageUsec != 2500000 || m.Memory.Usage != 192<<20 || m.Memory.UsageLimit != 256<<20 {
+		t.Errorf("cgroupMetrics() = %+v", m)
+	}
+	if m.MemoryEvents.OomKill != 1 || m.Io.Usage[0].Rbytes != 4096 {
+		t.Errorf("cgroupMetrics() events = %+v, io = %+v", m.MemoryEvents, m.Io.Usage)
+	}
+
+	usage := hostUsage(stats)
+	if usage.CPUSeconds != 2.5 || usage.CPUThrottledSeconds != 0.5 || usage.MemoryBytes != 192<<20 {
+		t.Errorf("hostUsage() = %+v", usage)
+	}
+}
+
+func TestPodUsage(t *testing.T) {
+	pod := &domain.PodStats{Containers: map[string]*domain.ContainerStats{
+		"app":     {CPUUsage: 1500000000, MemoryUsage: 100 << 20, MemoryInactiveFile: 10 << 20, Pids: 4},
+		"sidecar": {CPUUsage: 500000000, MemoryUsage: 20 << 20, MemoryInactiveFile: 2 << 20, Pids: 1},
+	}}
+	host := &vm.CgroupStats{
+		CPUUsageUsec:     2500000,
+		MemoryUsageBytes: 200 << 20,
+		MemoryLimitBytes: 512 << 20,
+		PidsCurrent:      9,
+	}
+
+	usage := newPodUsage(pod, host)
+	got := usage.metrics()
+	if got.ContainerCPUSeconds != 2 || got.ContainerMemoryBytes != 120<<20 {
+		t.Errorf("containers = %+v", got)
+	}
+	if got.OverheadCPUSeconds != 0.5 || got.OverheadMemoryBytes != 80<<20 {
+		t.Errorf("overhead = %+v", got)
+	}
+
+	m := podMetrics(usage, host)
+	if m.CPU.UsageUsec != 2500000 || m.Memory.Usage != 200<<20 || m.Memory.UsageLimit != 512<<20 || m.Pids.Current != 5 {
+		t.Errorf("podMetrics() = %+v", m)
+	}
+	if m.Memory.InactiveFile != 12<<20 {
+		t.Errorf("podMetrics() inactive file = %d, want the containers'", m.Memory.InactiveFile)
+	}
+
+	// The guest can account memory before the host does
+	host.MemoryUsageBytes = 100 << 20
+	usage = newPodUsage(pod, host)
+	if usage.overheadMemory != 0 || podMetrics(usage, host).Memory.Usage != 120<<20 {
+		t.Errorf("overhead with host behind the guest = %d", usage.overheadMemory)
+	}
+
+	c := containerMetrics(pod.Containers["app"])
+	if c.CPU.UsageUsec != 1500000 || c.Memory.Usage != 100<<20 || c.Pids.Current != 4 {
+		t.Errorf("containerMetrics() = %+v", c)
+	}
+}
+
+func TestContainerMetrics(t *testing.T) {
+	stats := &domain.ContainerStats{
+		CPUUsage:            3000000000,
+		CPUUser:             2000000000,
+		CPUSystem:           1000000000,
+		CPUPeriods:          100,
+		CPUThrottledPeriods: 10,
+		CPUThrottled:        250000000,
+		MemoryUsage:         96 << 20,
+		MemoryLimit:         128 << 20,
+		MemoryAnon:          64 << 20,
+		MemoryFile:          32 << 20,
+		MemoryInactiveFile:  16 << 20,
+		PageFaults:          1000,
+		MajorPageFaults:     5,
+		OOMKills:            1,
+		Pids:                3,
+		PidsLimit:           100,
+	}
+
+	m := containerMetrics(stats)
+	if m.CPU.UsageUsec != 3000000 || m.CPU.UserUsec != 2000000 || m.CPU.SystemUsec != 1000000 {
+		t.Errorf("CPU = %+v", m.CPU)
+	}
+	if m.CPU.NrPeriods != 100 || m.CPU.NrThrottled != 10 || m.CPU.ThrottledUsec != 250000 {
+		t.Errorf("CPU throttling = %+v", m.CPU)
+	}
+	// What the CRI plugin takes the working set and RSS from
+	if m.Memory.Usage != 96<<20 || m.Memory.InactiveFile != 16<<20 || m.Memory.Anon != 64<<20 || m.Memory.UsageLimit != 128<<20 {
+		t.Errorf("Memory = %+v", m.Memory)
+	}
+	if m.Memory.Pgfault != 1000 || m.Memory.Pgmajfault != 5 || m.MemoryEvents.OomKill != 1 || m.Pids.Limit != 100 {
+		t.Errorf("faults = %+v, events = %+v, pids = %+v", m.Memory, m.MemoryEvents, m.Pids)
+	}
+
+	// Unlimited memory is reported the way the kernel reports it
+	stats.MemoryLimit = 0
+	if limit := containerMetrics(stats).Memory.UsageLimit; limit != math.MaxUint64 {
+		t.Errorf("unlimited UsageLimit = %d", limit)
+	}
+	if limit := cgroupMetrics(&vm.CgroupStats{}).Memory.UsageLimit; limit != math.MaxUint64 {
+		t.Errorf("unlimited VMM UsageLimit = %d", limit)
+	}
+}
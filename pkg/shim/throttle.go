@@ -0,0 +1,194 @@
+package shim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Under mass scheduling a node is sent dozens of Creates at once, each to a
+// shim of its own, and they all copy rootfs layers and boot VMs at the same
+// time. Creates, Starts and Deletes of tasks can each be limited node-wide.
+// A running operation holds one of a fixed number of slot files flocked;
+// operations waiting for one queue behind ticket files, named for when they
+// arrived, so they get slots in that order. The kernel drops the locks of a
+// shim that exits, so a crashed shim never keeps a slot or the queue's head.
+
+// defaultTaskLimitsDir holds the slots and queues of limited operations.
+const defaultTaskLimitsDir = "/run/fc-cri/task-limits"
+
+// taskQueuePollInterval is how often a queued operation checks whether it
+// is next and a slot is free.
+const taskQueuePollInterval = 20 * time.Millisecond
+
+// taskTickets numbers the tickets of a shim, for two taken in the same
+// nanosecond.
+var taskTickets atomic.Uint64
+
+// taskLimiter limits how many of each task operation run on the node.
+type taskLimiter struct {
+	dir string
+	max map[string]int // By operation; unlimited if not positive
+	log *logrus.Entry
+}
+
+// taskLimits returns the shim's limiter, from the runtime config's
+// max_concurrent_creates, _starts and _deletes, which
+// FC_CRI_MAX_CONCURRENT_CREATES, _STARTS and _DELETES override. It is nil
+// if nothing is limited.
+func taskLimits(cfg config.RuntimeConfig, log *logrus.Entry) *taskLimiter {
+	l := &taskLimiter{dir: defaultTaskLimitsDir, max: make(map[string]int), log: log}
+	for op, n := range map[string]int{
+		metrics.TaskOpCreate: cfg.MaxConcurrentCreates,
+		metrics.TaskOpStart:  cfg.MaxConcurrentStarts,
+		metrics.TaskOpDelete: cfg.MaxConcurrentDeletes,
+	} {
+		if n > 0 {
+			l.max[op] = n
+		}
+	}
+	if len(l.max) == 0 {
+		return nil
+	}
+	return l
+}
+
+// acquire waits for a slot for op, in the order operations arrived, until
+// ctx is done. The slot is held until the returned function is called.
+func (l *taskLimiter) acquire(ctx context.Context, op string) (func(), error) {
+	if l == nil || l.max[op] <= 0 {
+		return func() {}, nil
+	}
+	dir := filepath.Join(l.dir, op)
+	ticket, leave, err := enqueueTask(dir)
+	if err != nil {
+		// Unlimited rather than failing every task
+		l.log.WithError(err).WithField("operation", op).Warn("Failed to queue for a task slot, not limiting")
+		return func() {}, nil
+	}
+	defer leave()
+
+	ticker := time.NewTicker(taskQueuePollInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var dequeue func()
+	for {
+		if nextInTaskQueue(dir, ticket) {
+			if release := takeTaskSlot(dir, l.max[op]); release != nil {
+				if dequeue != nil {
+					dequeue()
+					wait := time.Since(start)
+					metrics.Global().RecordTaskThrottled(op, wait)
+					l.log.WithFields(logrus.Fields{"operation": op, "waited": wait}).Info("Got a task slot")
+				}
+				return release, nil
+			}
+		}
+		if dequeue == nil {
+			dequeue = metrics.Global().TrackTaskQueued(op)
+			l.log.WithFields(logrus.Fields{"operation": op, "limit": l.max[op]}).Info("Waiting for a task slot")
+		}
+
+		select {
+		case <-ctx.Done():
+			dequeue()
+			return nil, fmt.Errorf("waiting for a %s slot: %w", op, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueTask takes a ticket in the queue for the slots in dir, returning
+// its name and the function leaving the queue. The ticket is flocked before
+// it is moved into the queue, so other shims never take it for one left
+// behind.
+func enqueueTask(dir string) (string, func(), error) {
+	queue := filepath.Join(dir, "queue")
+	if err := os.MkdirAll(queue, 0755); err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("%019d-%d-%d", time.Now().UnixNano(), os.Getpid(), taskTickets.Add(1))
+	tmp := filepath.Join(dir, name+".tmp")
+	file, err := os.OpenFile(tmp, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err == nil {
+		err = os.Rename(tmp, filepath.Join(queue, name))
+	}
+	if err != nil {
+		file.Close()
+		_ = os.Remove(tmp)
+		return "", nil, err
+	}
+	return name, func() {
+		_ = os.Remove(filepath.Join(queue, name))
+		file.Close()
+	}, nil
+}
+
+// nextInTaskQueue reports whether ticket is the oldest in the queue for the
+// slots in dir, removing the tickets of shims that are gone.
+func nextInTaskQueue(dir, ticket string) bool {
+	queue := filepath.Join(dir, "queue")
+	entries, err := os.ReadDir(queue)
+	if err != nil {
+		return true
+	}
+	for _, entry := range entries { // Sorted by name, oldest first
+		if entry.Name() >= ticket {
+			return true
+		}
+		path := filepath.Join(queue, entry.Name())
+		if flocked(path) {
+			return false
+		}
+		_ = os.Remove(path)
+	}
+	return true
+}
+
+// takeTaskSlot takes one of the first max slots in dir, returning the
+// function releasing it, or nil if they are all taken.
+func takeTaskSlot(dir string, max int) func() {
+	for i := 0; i < max; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, "slot-"+strconv.Itoa(i)), os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			continue
+		}
+		return func() {
+			_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// flocked reports whether a file is flocked by another open file, so its
+// owner is still running. A file that is gone is not.
+func flocked(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return false
+}
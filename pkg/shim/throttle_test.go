@@ -0,0 +1,146 @@
+package shim
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/config"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+func TestTaskLimits(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	if l := taskLimits(config.RuntimeConfig{}, log); l != nil {
+		t.Errorf("taskLimits() = %+v without limits, want nil", l)
+	}
+
+	l := taskLimits(config.RuntimeConfig{MaxConcurrentCreates: 4, MaxConcurrentDeletes: -1}, log)
+	if l == nil || l.max[metrics.TaskOpCreate] != 4 || l.max[metrics.TaskOpDelete] != 0 {
+		t.Fatalf("taskLimits() = %+v, want 4 creates", l)
+	}
+
+	// Unlimited operations never wait, and neither does a nil limiter
+	release, err := l.acquire(context.Background(), metrics.TaskOpStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	var none *taskLimiter
+	if _, err := none.acquire(context.Background(), metrics.TaskOpCreate); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskLimits_Config(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "[runtime]\nmax_concurrent_creates = 2\nmax_concurrent_starts = 3\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("FC_CRI_MAX_CONCURRENT_CREATES", "6")
+	t.Setenv("FC_CRI_MAX_CONCURRENT_DELETES", "1")
+
+	log := logrus.NewEntry(logrus.New())
+	l := taskLimits(loadConfig(path, log).Runtime, log)
+	want := map[string]int{metrics.TaskOpCreate: 6, metrics.TaskOpStart: 3, metrics.TaskOpDelete: 1}
+	if l == nil || !reflect.DeepEqual(l.max, want) {
+		t.Errorf("taskLimits() = %+v, want %v", l, want)
+	}
+}
+
+func TestTaskLimiterAcquire(t *testing.T) {
+	l := &taskLimiter{
+		dir: t.TempDir(),
+		max: map[string]int{metrics.TaskOpCreate: 1},
+		log: logrus.NewEntry(logrus.New()),
+	}
+
+	first, err := l.acquire(context.Background(), metrics.TaskOpCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiters get the slot in the order they came
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			release, err := l.acquire(context.Background(), metrics.TaskOpCreate)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			time.Sleep(50 * time.Millisecond)
+			release()
+		}(i)
+		time.Sleep(50 * time.Millisecond) // Queued one after the other
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, metrics.TaskOpCreate); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() with every slot taken = %v, want DeadlineExceeded", err)
+	}
+
+	first()
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Errorf("waiter %d got the slot, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiters never got the slot")
+		}
+	}
+
+	// Nothing is left queued
+	entries, err := os.ReadDir(filepath.Join(l.dir, metrics.TaskOpCreate, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d tickets left in the queue", len(entries))
+	}
+}
+
+func TestNextInTaskQueueSkipsAbandonedTickets(t *testing.T) {
+	dir := t.TempDir()
+	queue := filepath.Join(dir, "queue")
+	if err := os.MkdirAll(queue, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Left by a shim that crashed, so nobody holds its lock
+	abandoned := filepath.Join(queue, "0000000000000000001-1-1")
+	if err := os.WriteFile(abandoned, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ticket, leave, err := enqueueTask(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leave()
+	if !nextInTaskQueue(dir, ticket) {
+		t.Error("nextInTaskQueue() = false behind an abandoned ticket")
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Errorf("abandoned ticket not removed: %v", err)
+	}
+
+	later, leaveLater, err := enqueueTask(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaveLater()
+	if nextInTaskQueue(dir, later) {
+		t.Error("nextInTaskQueue() = true behind a waiting ticket")
+	}
+}
@@ -0,0 +1,100 @@
+// Package trace records when each phase of a sandbox's lifecycle started
+// and how long it took, so slow pod starts can be broken down after the
+// fact with fcctl trace.
+//
+// Phases are appended to a file in the sandbox dir, one JSON object per
+// line, by whichever process ran them: the VM manager for creating and
+// booting the VM, the shim for the agent and containers. The file goes
+// away with the sandbox dir.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileName is the trace's file in a sandbox dir.
+const FileName = "trace.jsonl"
+
+// Lifecycle phases.
+const (
+	PhaseVMCreate        = "vm-create"        // Creating a VM, from request to guest network
+	PhaseNetwork         = "network"          // CNI and the tap
+	PhaseRootfsAttach    = "rootfs-attach"    // Preparing the rootfs drive
+	PhaseBoot            = "boot"             // Starting Firecracker until the VM runs
+	PhaseGuestNetwork    = "guest-network"    // Pushing routes to the booted guest
+	PhasePoolAcquire     = "pool-acquire"     // Taking a warm VM and preparing it
+	PhaseSnapshotRestore = "snapshot-restore" // Restoring a VM from a snapshot
+	PhaseAgentReady      = "agent-ready"      // Connecting to the guest agent
+	PhaseContainerCreate = "container-create" // Creating the container in the guest
+	PhaseContainerStart  = "container-start"  // Starting the container
+)
+
+// Span is a phase of a sandbox's lifecycle.
+type Span struct {
+	Phase    string        `json:"phase"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// End returns when the phase ended.
+func (s Span) End() time.Time {
+	return s.Start.Add(s.Duration)
+}
+
+// Record appends a phase that started at start and ended now to the trace
+// in sandboxDir. err is the phase's failure, if any. Tracing is best
+// effort: a trace that can't be written never fails the phase.
+func Record(sandboxDir, phase string, start time.Time, err error) {
+	span := Span{Phase: phase, Start: start, Duration: time.Since(start)}
+	if err != nil {
+		span.Error = err.Error()
+	}
+	line, merr := json.Marshal(span)
+	if merr != nil {
+		return
+	}
+	file, ferr := os.OpenFile(filepath.Join(sandboxDir, FileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if ferr != nil {
+		return
+	}
+	defer file.Close()
+	// A single write, so phases recorded concurrently don't interleave
+	_, _ = file.Write(append(line, '\n'))
+}
+
+// Load reads the trace in sandboxDir, ordered by start time.
+func Load(sandboxDir string) ([]Span, error) {
+	path := filepath.Join(sandboxDir, FileName)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var spans []Span
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var span Span
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			return nil, fmt.Errorf("invalid trace %s: %w", path, err)
+		}
+		spans = append(spans, span)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start.Before(spans[j].Start)
+	})
+	return spans, nil
+}
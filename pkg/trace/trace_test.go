@@ -0,0 +1,67 @@
+package trace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// Recorded out of order, as the shim and VM manager may
+	Record(dir, PhaseBoot, now.Add(-time.Second), nil)
+	Record(dir, PhaseVMCreate, now.Add(-2*time.Second), nil)
+	Record(dir, PhaseAgentReady, now.Add(-10*time.Millisecond), errors.New("connection refused"))
+
+	spans, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Load() = %d spans, want 3", len(spans))
+	}
+	want := []string{PhaseVMCreate, PhaseBoot, PhaseAgentReady}
+	for i, span := range spans {
+		if span.Phase != want[i] {
+			t.Errorf("span %d = %s, want %s", i, span.Phase, want[i])
+		}
+	}
+	if spans[0].Duration < 2*time.Second {
+		t.Errorf("vm-create duration = %v, want at least 2s", spans[0].Duration)
+	}
+	if spans[2].Error != "connection refused" {
+		t.Errorf("agent-ready error = %q", spans[2].Error)
+	}
+	if spans[1].Error != "" {
+		t.Errorf("boot error = %q, want none", spans[1].Error)
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	if _, err := Load(t.TempDir()); !os.IsNotExist(err) {
+		t.Errorf("Load() of a sandbox without a trace error = %v, want not exist", err)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("{not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Error("Load() of an invalid trace should fail")
+	}
+}
+
+func TestRecord_MissingDir(t *testing.T) {
+	// Must not panic or create the dir
+	dir := filepath.Join(t.TempDir(), "gone")
+	Record(dir, PhaseBoot, time.Now(), nil)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Record() created %s", dir)
+	}
+}
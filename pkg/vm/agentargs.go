@@ -0,0 +1,182 @@
+package vm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// Guest agent defaults. The agent uses these unless the kernel command line
+// says otherwise.
+const (
+	DefaultAgentPort          = 1024
+	DefaultAgentHeartbeatPort = 1025
+	DefaultAgentNotifyPort    = 1026
+	DefaultAgentLogLevel      = "info"
+
+	// DefaultAgentHeartbeatInterval is how often the agent sends a
+	// heartbeat, and MinAgentHeartbeatInterval the shortest interval it
+	// accepts.
+	DefaultAgentHeartbeatInterval = time.Second
+	MinAgentHeartbeatInterval     = 10 * time.Millisecond
+
+	// agentArgPrefix prefixes the kernel parameters the agent reads.
+	agentArgPrefix = "fcagent."
+
+	// agentKeySize is the size of the key each VM's agent authenticates
+	// connections with.
+	agentKeySize = 32
+
+	// agentKeyFile holds a sandbox's agent key in its runtime directory,
+	// for fcctl. Kept in sync with agent.AuthKeyFile.
+	agentKeyFile = "agent.key"
+)
+
+// AgentBootConfig configures the guest agent through the kernel command
+// line, so changing it doesn't need a new rootfs build.
+type AgentBootConfig struct {
+	// Port is the vsock port the agent listens on.
+	Port uint32
+
+	// HeartbeatPort and NotifyPort are the host vsock ports the agent
+	// sends heartbeats and container notifications to.
+	HeartbeatPort uint32
+	NotifyPort    uint32
+
+	// HeartbeatInterval is how often the agent sends a heartbeat. It must
+	// match the interval the host expects them at, or a host expecting them
+	// more often takes a healthy guest for a hung one.
+	HeartbeatInterval time.Duration
+
+	// LogLevel is "debug", "info" or "error".
+	LogLevel string
+
+	// Auth boots each VM with a key of its own, which connections to its
+	// agent must authenticate with. Without it, any process that can reach
+	// a VM's vsock socket can drive its agent.
+	Auth bool
+
+	// Runtime is the OCI runtime the agent runs containers with, a path in
+	// the guest or a name such as "crun". Empty leaves the choice to the
+	// agent, which prefers runc.
+	Runtime string
+
+	// RuntimeArgs are global options the agent passes the runtime, e.g.
+	// "--debug".
+	RuntimeArgs []string
+}
+
+// Validate checks the runtime settings, which must fit in kernel
+// parameters.
+func (c AgentBootConfig) Validate() error {
+	if strings.ContainsAny(c.Runtime, " \t,=") {
+		return fmt.Errorf("invalid agent runtime %q", c.Runtime)
+	}
+	for _, arg := range c.RuntimeArgs {
+		if !strings.HasPrefix(arg, "-") || strings.ContainsAny(arg, " \t,") {
+			return fmt.Errorf("invalid agent runtime option %q (must be a flag without spaces or commas)", arg)
+		}
+	}
+	return nil
+}
+
+// DefaultAgentBootConfig returns the agent's own defaults.
+func DefaultAgentBootConfig() AgentBootConfig {
+	return AgentBootConfig{
+		Port:          DefaultAgentPort,
+		HeartbeatPort: DefaultAgentHeartbeatPort,
+		NotifyPort:    DefaultAgentNotifyPort,
+		LogLevel:      DefaultAgentLogLevel,
+		Auth:          true,
+
+		HeartbeatInterval: DefaultAgentHeartbeatInterval,
+	}
+}
+
+// kernelArgs returns the kernel parameters for settings that differ from
+// the agent's defaults. Default settings add nothing, so kernel arguments
+// (and with them VM generations) only change when the settings do.
+func (c AgentBootConfig) kernelArgs() []string {
+	var args []string
+	if c.Port != 0 && c.Port != DefaultAgentPort {
+		args = append(args, fmt.Sprintf("%sport=%d", agentArgPrefix, c.Port))
+	}
+	if c.HeartbeatPort != 0 && c.HeartbeatPort != DefaultAgentHeartbeatPort {
+		args = append(args, fmt.Sprintf("%sheartbeat_port=%d", agentArgPrefix, c.HeartbeatPort))
+	}
+	if c.NotifyPort != 0 && c.NotifyPort != DefaultAgentNotifyPort {
+		args = append(args, fmt.Sprintf("%snotify_port=%d", agentArgPrefix, c.NotifyPort))
+	}
+	if c.HeartbeatInterval > 0 && c.HeartbeatInterval != DefaultAgentHeartbeatInterval {
+		args = append(args, agentArgPrefix+"heartbeat_interval="+c.HeartbeatInterval.String())
+	}
+	if c.LogLevel != "" && c.LogLevel != DefaultAgentLogLevel {
+		args = append(args, agentArgPrefix+"loglevel="+c.LogLevel)
+	}
+	if c.Runtime != "" {
+		args = append(args, agentArgPrefix+"runtime="+c.Runtime)
+	}
+	if len(c.RuntimeArgs) > 0 {
+		args = append(args, agentArgPrefix+"runtime_args="+strings.Join(c.RuntimeArgs, ","))
+	}
+	return args
+}
+
+// withAgentArgs replaces the agent parameters in a kernel command line with
+// those for the given configuration.
+func withAgentArgs(cmdline string, config AgentBootConfig) string {
+	var fields []string
+	for _, field := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(field, agentArgPrefix) {
+			fields = append(fields, field)
+		}
+	}
+	return strings.Join(append(fields, config.kernelArgs()...), " ")
+}
+
+// AgentPort returns the vsock port the agent of a VM listens on, as set on
+// its kernel command line.
+func AgentPort(config domain.VMConfig) uint32 {
+	for _, field := range strings.Fields(config.KernelArgs) {
+		if value, ok := strings.CutPrefix(field, agentArgPrefix+"port="); ok {
+			if port, err := strconv.ParseUint(value, 10, 32); err == nil && port != 0 {
+				return uint32(port)
+			}
+		}
+	}
+	return DefaultAgentPort
+}
+
+// issueAgentKey creates the agent key of a new VM and stores it in the
+// sandbox's runtime directory. The key is not part of the VM config, so it
+// doesn't change the VM's generation.
+func issueAgentKey(sandboxDir string) ([]byte, error) {
+	key := make([]byte, agentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate agent key: %w", err)
+	}
+	if err := writeAgentKey(sandboxDir, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeAgentKey stores an agent key in a sandbox's runtime directory.
+func writeAgentKey(sandboxDir string, key []byte) error {
+	if err := os.WriteFile(filepath.Join(sandboxDir, agentKeyFile), []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return fmt.Errorf("failed to write agent key: %w", err)
+	}
+	return nil
+}
+
+// agentKeyArg returns the kernel parameter passing a key to the agent.
+func agentKeyArg(key []byte) string {
+	return agentArgPrefix + "auth_key=" + hex.EncodeToString(key)
+}
@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestWithAgentArgs(t *testing.T) {
+	base := "console=ttyS0 reboot=k panic=1"
+
+	// Defaults leave the command line alone
+	if got := withAgentArgs(base, DefaultAgentBootConfig()); got != base {
+		t.Errorf("withAgentArgs(defaults) = %q, want %q", got, base)
+	}
+
+	config := DefaultAgentBootConfig()
+	config.Port = 2048
+	config.LogLevel = "debug"
+	config.HeartbeatInterval = 500 * time.Millisecond
+	want := base + " fcagent.port=2048 fcagent.heartbeat_interval=500ms fcagent.loglevel=debug"
+	if got := withAgentArgs(base, config); got != want {
+		t.Errorf("withAgentArgs() = %q, want %q", got, want)
+	}
+
+	// Existing agent parameters are replaced, not repeated
+	if got := withAgentArgs(want, config); got != want {
+		t.Errorf("withAgentArgs() twice = %q, want %q", got, want)
+	}
+	if got := withAgentArgs(want, DefaultAgentBootConfig()); got != base {
+		t.Errorf("withAgentArgs(defaults) = %q, want %q", got, base)
+	}
+}
+
+func TestAgentRuntimeArgs(t *testing.T) {
+	config := DefaultAgentBootConfig()
+	config.Runtime = "crun"
+	config.RuntimeArgs = []string{"--debug", "--log-level=debug"}
+	want := "console=ttyS0 fcagent.runtime=crun fcagent.runtime_args=--debug,--log-level=debug"
+	if got := withAgentArgs("console=ttyS0", config); got != want {
+		t.Errorf("withAgentArgs() = %q, want %q", got, want)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	for _, invalid := range []AgentBootConfig{
+		{Runtime: "/usr/bin/crun --debug"},
+		{RuntimeArgs: []string{"debug"}},
+		{RuntimeArgs: []string{"--root=/a,b"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", invalid)
+		}
+	}
+}
+
+func TestAgentPort(t *testing.T) {
+	tests := []struct {
+		args string
+		want uint32
+	}{
+		{"console=ttyS0", DefaultAgentPort},
+		{"console=ttyS0 fcagent.port=2048", 2048},
+		{"fcagent.port=bad", DefaultAgentPort},
+		{"fcagent.heartbeat_port=3000", DefaultAgentPort},
+	}
+
+	for _, tt := range tests {
+		if got := AgentPort(domain.VMConfig{KernelArgs: tt.args}); got != tt.want {
+			t.Errorf("AgentPort(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/sirupsen/logrus"
+)
+
+// checksumSuffix names the file next to a base rootfs holding its expected
+// SHA-256, in sha256sum format, for when the pool isn't configured with one.
+const checksumSuffix = ".sha256"
+
+// baseVerifier checks the base rootfs images pooled VMs boot from against
+// their expected SHA-256. An image is hashed again whenever it or its
+// checksum file changes, so a replaced artifact is verified before any VM
+// boots from it.
+type baseVerifier struct {
+	// expected is the configured SHA-256, which takes precedence over
+	// checksum files.
+	expected string
+	log      *logrus.Entry
+
+	mu       sync.Mutex
+	verified map[string]string // path -> version last verified
+	warned   map[string]bool   // paths without a checksum, warned about
+}
+
+func newBaseVerifier(expected string, log *logrus.Entry) *baseVerifier {
+	return &baseVerifier{
+		expected: strings.ToLower(expected),
+		log:      log,
+		verified: make(map[string]string),
+		warned:   make(map[string]bool),
+	}
+}
+
+// verify checks a base rootfs against its expected SHA-256. An image with
+// no known checksum passes, with a warning the first time.
+func (v *baseVerifier) verify(path string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	version, err := checksumVersion(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat base rootfs: %w", err)
+	}
+	if v.verified[path] == version {
+		return nil
+	}
+
+	expected, source := v.expected, "configuration"
+	if expected == "" {
+		expected, err = readChecksumFile(path + checksumSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read base rootfs checksum: %w", err)
+		}
+		source = path + checksumSuffix
+	}
+	if expected == "" {
+		if !v.warned[path] {
+			v.log.WithField("path", path).Warn("Base rootfs has no checksum, pooled VMs boot from it unverified")
+			v.warned[path] = true
+		}
+		return nil
+	}
+
+	sum, err := checksum.FileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash base rootfs: %w", err)
+	}
+	if sum != expected {
+		return fmt.Errorf("base rootfs %s has SHA-256 %s, want %s (from %s)", path, sum, expected, source)
+	}
+	// An image replaced while it was hashed is verified again next time
+	if after, err := checksumVersion(path); err != nil || after != version {
+		return fmt.Errorf("base rootfs %s changed while it was verified", path)
+	}
+
+	v.verified[path] = version
+	v.log.WithFields(logrus.Fields{
+		"path":   path,
+		"sha256": sum,
+	}).Info("Verified base rootfs")
+	return nil
+}
+
+// checksumVersion identifies the contents of an image and its checksum
+// file by their sizes and modification times.
+func checksumVersion(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	version := fmt.Sprintf("size=%d mtime=%d", info.Size(), info.ModTime().UnixNano())
+	if sum, err := os.Stat(path + checksumSuffix); err == nil {
+		version += fmt.Sprintf(" checksum=%d", sum.ModTime().UnixNano())
+	}
+	return version, nil
+}
+
+// readChecksumFile returns the SHA-256 in a sha256sum-style file: the
+// first field of its first line.
+func readChecksumFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !checksum.ValidSHA256(fields[0]) {
+		return "", fmt.Errorf("%s holds no SHA-256", path)
+	}
+	return strings.ToLower(fields[0]), nil
+}
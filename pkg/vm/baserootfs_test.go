@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestBaseVerifier(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	path := filepath.Join(t.TempDir(), "base.ext4")
+	if err := os.WriteFile(path, []byte("base image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("base image"))
+	want := hex.EncodeToString(sum[:])
+
+	// Without a checksum the image passes unverified
+	v := newBaseVerifier("", log)
+	if err := v.verify(path); err != nil {
+		t.Fatalf("verify() without checksum error = %v", err)
+	}
+
+	if err := os.WriteFile(path+checksumSuffix, []byte(strings.ToUpper(want)+"  base.ext4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(path); err != nil {
+		t.Fatalf("verify() with checksum file error = %v", err)
+	}
+
+	// A replaced image is hashed again
+	if err := os.WriteFile(path, []byte("tampered!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(path); err == nil {
+		t.Error("verify() of a replaced image succeeded, want error")
+	}
+
+	// The configured checksum takes precedence over the file
+	if err := newBaseVerifier(want, log).verify(path); err == nil {
+		t.Error("verify() against configured checksum succeeded, want error")
+	}
+	if err := os.WriteFile(path, []byte("base image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBaseVerifier(want, log).verify(path); err != nil {
+		t.Errorf("verify() against configured checksum error = %v", err)
+	}
+
+	if err := os.WriteFile(path+checksumSuffix, []byte("not a checksum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBaseVerifier("", log).verify(path); err == nil {
+		t.Error("verify() with a malformed checksum file succeeded, want error")
+	}
+}
@@ -0,0 +1,266 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/cgroup"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+const (
+	// cgroupControllers are enabled for the VM cgroups under the parent.
+	cgroupControllers = "+cpu +memory +io +pids"
+
+	// enterCgroupHandlerName names the init handler that moves a VMM into
+	// its cgroup.
+	enterCgroupHandlerName = "fc-cri.EnterCgroup"
+)
+
+// CgroupConfig configures the cgroup v2 each VMM runs in. Each VM gets a
+// cgroup of its own under Parent, limited to the VM's vCPUs and memory plus
+// the VMM's overhead, so one VM can't starve the node and its host usage
+// can be accounted for.
+type CgroupConfig struct {
+	// Enabled places each VMM into a per-sandbox cgroup.
+	Enabled bool
+
+	// Parent is the cgroup, relative to the cgroup root, the VM cgroups
+	// are created under. With the jailer, its CgroupParent is used.
+	Parent string
+
+	// MemoryOverheadMB is added to a VM's memory for the VMM itself.
+	MemoryOverheadMB int64
+
+	// CPUOverheadMillicores is added to a VM's vCPUs for the VMM's API
+	// and I/O threads.
+	CPUOverheadMillicores int64
+
+	// CPUPeriod is the CFS period of the CPU limit.
+	CPUPeriod time.Duration
+}
+
+// DefaultCgroupConfig returns sensible defaults.
+func DefaultCgroupConfig() CgroupConfig {
+	return CgroupConfig{
+		Enabled:               true,
+		Parent:                "fc-cri.slice",
+		MemoryOverheadMB:      64,
+		CPUOverheadMillicores: 250,
+		CPUPeriod:             100 * time.Millisecond,
+	}
+}
+
+// CgroupStats is the host resource usage of a VMM, read from its cgroup.
+type CgroupStats struct {
+	CPUUsageUsec     uint64
+	CPUUserUsec      uint64
+	CPUSystemUsec    uint64
+	CPUPeriods       uint64
+	CPUThrottled     uint64
+	CPUThrottledUsec uint64
+
+	MemoryUsageBytes uint64
+	MemoryPeakBytes  uint64 // 0 on kernels without memory.peak
+	MemoryLimitBytes uint64 // 0 if unlimited
+	OOMEvents        uint64
+	OOMKills         uint64
+
+	PidsCurrent uint64
+	PidsLimit   uint64 // 0 if unlimited
+
+	IOReadBytes  uint64
+	IOWriteBytes uint64
+}
+
+// cgroupLimits returns the cpu.max and memory.max of a VM.
+func (c CgroupConfig) cgroupLimits(config domain.VMConfig) (cpuMax, memoryMax string) {
+	period := c.CPUPeriod.Microseconds()
+	if period <= 0 {
+		period = 100000
+	}
+	quota := (config.VcpuCount*1000 + c.CPUOverheadMillicores) * period / 1000
+	cpuMax = fmt.Sprintf("%d %d", quota, period)
+	memoryMax = strconv.FormatInt((config.MemoryMB+c.MemoryOverheadMB)<<20, 10)
+	return cpuMax, memoryMax
+}
+
+// initCgroups creates the parent cgroup and enables the controllers the
+// VM cgroups need. It fails if the host has no cgroup v2 hierarchy.
+func (c CgroupConfig) initCgroups() error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 not mounted at %s", cgroupRoot)
+	}
+	parent := filepath.Join(cgroupRoot, c.Parent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(cgroupControllers), 0644); err != nil {
+		return fmt.Errorf("failed to enable cgroup controllers in %s: %w", parent, err)
+	}
+	return nil
+}
+
+// cgroupPath returns the cgroup of a sandbox's VMM, or "" if VMs don't get
+// cgroups.
+func (m *Manager) cgroupPath(sandboxID string, config domain.VMConfig) string {
+	if config.JailerEnabled && m.jailer != nil {
+		return m.jailer.cgroupPath(sandboxID)
+	}
+	if !m.config.Cgroup.Enabled {
+		return ""
+	}
+	return filepath.Join(cgroupRoot, m.config.Cgroup.Parent, sandboxID)
+}
+
+// createCgroup creates the cgroup of a VM and applies its limits. The
+// jailer creates the cgroup of jailed VMs; their limits are still set here.
+func (m *Manager) createCgroup(sandboxID string, config domain.VMConfig) error {
+	path := m.cgroupPath(sandboxID, config)
+	if path == "" || !m.config.Cgroup.Enabled {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	cpuMax, memoryMax := m.config.Cgroup.cgroupLimits(config)
+	if err := os.WriteFile(filepath.Join(path, "cpu.max"), []byte(cpuMax), 0644); err != nil {
+		return fmt.Errorf("failed to set cgroup CPU limit: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "memory.max"), []byte(memoryMax), 0644); err != nil {
+		return fmt.Errorf("failed to set cgroup memory limit: %w", err)
+	}
+	return nil
+}
+
+// cgroupOpts moves an unjailed VMM into its cgroup as soon as it starts,
+// before the guest touches its memory, so all of it is charged to the VM.
+func (m *Manager) cgroupOpts(sandboxID string, config domain.VMConfig) []firecracker.Opt {
+	path := m.cgroupPath(sandboxID, config)
+	if path == "" || config.JailerEnabled {
+		return nil
+	}
+
+	handler := firecracker.Handler{
+		Name: enterCgroupHandlerName,
+		Fn: func(_ context.Context, machine *firecracker.Machine) error {
+			pid, err := machine.PID()
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+		},
+	}
+	return []firecracker.Opt{func(machine *firecracker.Machine) {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(firecracker.StartVMMHandlerName, handler)
+	}}
+}
+
+// removeCgroup removes the cgroup of an unjailed VM once its VMM has
+// exited. The jailer removes the cgroups of jailed VMs.
+func (m *Manager) removeCgroup(sandboxID string, config domain.VMConfig) {
+	path := m.cgroupPath(sandboxID, config)
+	if path == "" || config.JailerEnabled {
+		return
+	}
+
+	// The cgroup stays busy until the exited VMM has been reaped
+	for i := 0; i < 10; i++ {
+		err := os.Remove(path)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			m.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to remove VM cgroup")
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	m.log.WithField("sandbox_id", sandboxID).Warn("VM cgroup still busy, leaving it behind")
+}
+
+// CgroupStats reads the host resource usage of a sandbox's VMM.
+func (m *Manager) CgroupStats(sandbox *domain.Sandbox) (*CgroupStats, error) {
+	path := m.cgroupPath(sandbox.ID, sandbox.VMConfig)
+	if path == "" {
+		return nil, fmt.Errorf("sandbox %s has no cgroup", sandbox.ID)
+	}
+	return ReadCgroupStats(path)
+}
+
+// ReadCgroupStats reads the resource usage of a cgroup v2.
+func ReadCgroupStats(path string) (*CgroupStats, error) {
+	cpu, err := readKeyedFile(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup stats: %w", err)
+	}
+	stats := &CgroupStats{
+		CPUUsageUsec:     cpu["usage_usec"],
+		CPUUserUsec:      cpu["user_usec"],
+		CPUSystemUsec:    cpu["system_usec"],
+		CPUPeriods:       cpu["nr_periods"],
+		CPUThrottled:     cpu["nr_throttled"],
+		CPUThrottledUsec: cpu["throttled_usec"],
+	}
+
+	stats.MemoryUsageBytes, _ = readCgroupUint(filepath.Join(path, "memory.current"))
+	stats.MemoryPeakBytes, _ = readCgroupUint(filepath.Join(path, "memory.peak"))
+	stats.MemoryLimitBytes, _ = readCgroupUint(filepath.Join(path, "memory.max"))
+	if events, err := readKeyedFile(filepath.Join(path, "memory.events")); err == nil {
+		stats.OOMEvents = events["oom"]
+		stats.OOMKills = events["oom_kill"]
+	}
+	stats.PidsCurrent, _ = readCgroupUint(filepath.Join(path, "pids.current"))
+	stats.PidsLimit, _ = readCgroupUint(filepath.Join(path, "pids.max"))
+	stats.IOReadBytes, stats.IOWriteBytes = cgroup.ReadIOStat(filepath.Join(path, "io.stat"))
+
+	return stats, nil
+}
+
+// readKeyedFile parses a cgroup file of "key value" lines.
+func readKeyedFile(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readCgroupUint reads a single-value cgroup file. "max" reads as 0.
+func readCgroupUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	config := DefaultCgroupConfig()
+	cpuMax, memoryMax := config.cgroupLimits(domain.VMConfig{VcpuCount: 2, MemoryMB: 512})
+	if cpuMax != "225000 100000" {
+		t.Errorf("cpu.max = %q, want 225000 100000", cpuMax)
+	}
+	if memoryMax != "603979776" {
+		t.Errorf("memory.max = %q, want 603979776 (576 MiB)", memoryMax)
+	}
+}
+
+func TestReadCgroupStats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cpu.stat":       "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 40000\n",
+		"memory.current": "201326592\n",
+		"memory.peak":    "268435456\n",
+		"memory.max":     "max\n",
+		"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"pids.current":   "5\n",
+		"io.stat":        "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2\n8:16 rbytes=1024 wbytes=0 rios=1 wios=0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := ReadCgroupStats(dir)
+	if err != nil {
+		t.Fatalf("ReadCgroupStats() error = %v", err)
+	}
+	want := CgroupStats{
+		CPUUsageUsec:     2500000,
+		CPUUserUsec:      2000000,
+		CPUSystemUsec:    500000,
+		CPUPeriods:       10,
+		CPUThrottled:     2,
+		CPUThrottledUsec: 40000,
+		MemoryUsageBytes: 201326592,
+		MemoryPeakBytes:  268435456,
+		OOMEvents:        1,
+		OOMKills:         1,
+		PidsCurrent:      5,
+		IOReadBytes:      5120,
+		IOWriteBytes:     8192,
+	}
+	if *stats != want {
+		t.Errorf("ReadCgroupStats() = %+v, want %+v", *stats, want)
+	}
+
+	if _, err := ReadCgroupStats(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ReadCgroupStats() of a missing cgroup succeeded")
+	}
+}
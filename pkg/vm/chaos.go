@@ -0,0 +1,191 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrChaosInjected is returned by operations failed on purpose by the
+// fault injector.
+var ErrChaosInjected = errors.New("chaos: injected failure")
+
+// ChaosConfig configures fault injection for the VM manager and pool.
+// It exists to exercise the replenish and fallback paths in CI and staging
+// and must never be enabled in production.
+type ChaosConfig struct {
+	// Enabled turns fault injection on. All other fields are ignored
+	// when false.
+	Enabled bool
+
+	// CreateFailureRate is the fraction (0.0-1.0) of VM creation attempts
+	// that fail with ErrChaosInjected. The failures are transient, so they
+	// exercise CreateVM's retries too.
+	CreateFailureRate float64
+
+	// AcquireDelay is added to every Pool.Acquire.
+	AcquireDelay time.Duration
+
+	// KillWarmInterval is how often a random pre-warmed VM is destroyed.
+	// Zero disables killing.
+	KillWarmInterval time.Duration
+
+	// Seed seeds the random source so runs can be reproduced. Zero uses
+	// the current time.
+	Seed int64
+}
+
+// chaos injects faults according to a ChaosConfig. A nil *chaos injects
+// nothing, so callers don't need to check whether it is enabled.
+type chaos struct {
+	mu     sync.Mutex
+	config ChaosConfig
+	rand   *rand.Rand
+	log    *logrus.Entry
+}
+
+// newChaos returns a fault injector, or nil if chaos is disabled.
+func newChaos(config ChaosConfig, log *logrus.Entry) *chaos {
+	if !config.Enabled {
+		return nil
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	c := &chaos{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+		log:    log.WithField("component", "chaos"),
+	}
+	c.log.WithFields(logrus.Fields{
+		"create_failure_rate": config.CreateFailureRate,
+		"acquire_delay":       config.AcquireDelay,
+		"kill_warm_interval":  config.KillWarmInterval,
+		"seed":                seed,
+	}).Warn("Fault injection enabled")
+
+	return c
+}
+
+// createFault returns ErrChaosInjected for the configured fraction of calls.
+func (c *chaos) createFault() error {
+	if c == nil || c.config.CreateFailureRate <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	fail := c.rand.Float64() < c.config.CreateFailureRate
+	c.mu.Unlock()
+
+	if fail {
+		c.log.Debug("Injecting VM create failure")
+		return ErrChaosInjected
+	}
+	return nil
+}
+
+// acquireDelay sleeps for the configured acquire delay.
+func (c *chaos) acquireDelay(ctx context.Context) error {
+	if c == nil || c.config.AcquireDelay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.config.AcquireDelay):
+		return nil
+	}
+}
+
+// pick returns a random index in [0, n).
+func (c *chaos) pick(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Intn(n)
+}
+
+// chaosLoop periodically destroys a random pre-warmed VM.
+func (p *Pool) chaosLoop(c *chaos) {
+	ticker := time.NewTicker(c.config.KillWarmInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.killRandomWarm(c)
+		}
+	}
+}
+
+// killRandomWarm destroys one randomly chosen VM from the pool, as if it had
+// died underneath us.
+func (p *Pool) killRandomWarm(c *chaos) {
+	n := 0
+	for _, b := range p.buckets {
+		n += len(b.available)
+	}
+	if n == 0 {
+		return
+	}
+
+	// Find the bucket holding the victim
+	victimIdx := c.pick(n)
+	var b *bucket
+	for _, b = range p.buckets {
+		if victimIdx < len(b.available) {
+			break
+		}
+		victimIdx -= len(b.available)
+	}
+
+	// Take VMs off the bucket up to the victim, then put the survivors back
+	var taken []*domain.Sandbox
+	for i := 0; i <= victimIdx; i++ {
+		select {
+		case sandbox := <-b.available:
+			taken = append(taken, sandbox)
+		default:
+			// Drained concurrently by Acquire
+		}
+	}
+	if len(taken) == 0 {
+		return
+	}
+	victim := taken[len(taken)-1]
+
+	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
+	defer cancel()
+
+	c.log.WithField("sandbox_id", victim.ID).Info("Killing warm VM")
+	p.mu.Lock()
+	p.transition(victim.ID, PoolVMRetired, "killed by chaos testing")
+	p.mu.Unlock()
+	_ = p.manager.DestroyVM(ctx, victim)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, sandbox := range taken[:len(taken)-1] {
+		if p.draining || p.closed {
+			p.transition(sandbox.ID, PoolVMRetired, "pool draining")
+			_ = p.manager.DestroyVM(ctx, sandbox)
+			continue
+		}
+		select {
+		case b.available <- sandbox:
+		default:
+			p.transition(sandbox.ID, PoolVMRetired, "bucket full")
+			_ = p.manager.DestroyVM(ctx, sandbox)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestChaos_Disabled(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	c := newChaos(ChaosConfig{CreateFailureRate: 1}, log)
+	if c != nil {
+		t.Fatal("newChaos returned injector while disabled")
+	}
+
+	// A nil injector must be safe to use
+	if err := c.createFault(); err != nil {
+		t.Errorf("nil createFault() = %v, want nil", err)
+	}
+	if err := c.acquireDelay(context.Background()); err != nil {
+		t.Errorf("nil acquireDelay() = %v, want nil", err)
+	}
+}
+
+func TestChaos_CreateFailureRate(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	always := newChaos(ChaosConfig{Enabled: true, CreateFailureRate: 1, Seed: 1}, log)
+	never := newChaos(ChaosConfig{Enabled: true, CreateFailureRate: 0, Seed: 1}, log)
+
+	for i := 0; i < 100; i++ {
+		if err := always.createFault(); err != ErrChaosInjected {
+			t.Fatalf("createFault() with rate 1 = %v, want ErrChaosInjected", err)
+		}
+		if err := never.createFault(); err != nil {
+			t.Fatalf("createFault() with rate 0 = %v, want nil", err)
+		}
+	}
+}
+
+func TestChaos_AcquireDelay(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	c := newChaos(ChaosConfig{Enabled: true, AcquireDelay: time.Hour}, log)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := c.acquireDelay(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquireDelay() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestPool_KillRandomWarm(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, DefaultPoolConfig(), log)
+	defer pool.Close(context.Background())
+
+	for _, id := range []string{"sb-1", "sb-2", "sb-3"} {
+		addWarm(pool, pool.buckets[0], domain.NewSandbox(id))
+	}
+
+	c := newChaos(ChaosConfig{Enabled: true, Seed: 42}, log)
+	pool.killRandomWarm(c)
+
+	if got := pool.Stats().Available; got != 2 {
+		t.Errorf("Available after kill = %d, want 2", got)
+	}
+}
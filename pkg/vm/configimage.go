@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Secret and configmap volumes are small trees of files, shipped to the
+// guest as a read-only filesystem image of their own. The files are copied
+// with the volume's ownership and mode into a staging directory first, so
+// the image carries them and the agent only has to mount it.
+const (
+	// configImageMinSize is the smallest ext4 config image; mkfs needs room
+	// for its metadata even when there are few files.
+	configImageMinSize = 2 << 20
+
+	// configLabelPrefix starts the filesystem labels of config images. The
+	// agent finds a hot-attached drive by its label, as the device name
+	// depends on the order drives are attached in.
+	configLabelPrefix = "fc"
+)
+
+// configImageLabel returns the filesystem label of a config image. Labels
+// are at most 16 bytes in ext4 and erofs, so the drive ID is hashed.
+func configImageLabel(driveID string) string {
+	sum := sha256.Sum256([]byte(driveID))
+	return configLabelPrefix + hex.EncodeToString(sum[:])[:14]
+}
+
+// createConfigImage builds a read-only ext4 or erofs image of a secret or
+// configmap volume's files and returns its path and filesystem label.
+func (h *HotplugManager) createConfigImage(sandboxID, driveID string, vol VolumeSpec) (string, string, error) {
+	fsType := vol.Filesystem
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if fsType != "ext4" && fsType != "erofs" {
+		return "", "", fmt.Errorf("unsupported config image filesystem %q (must be ext4 or erofs)", fsType)
+	}
+	if vol.Source == "" {
+		return "", "", fmt.Errorf("%s volume has no source", vol.Type)
+	}
+
+	dir := filepath.Join(volumesDir, sandboxID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	staging, err := os.MkdirTemp(dir, "."+vol.Name+"-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(staging)
+
+	size, files, err := stageConfigFiles(vol.Source, staging, vol)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to stage %s: %w", vol.Source, err)
+	}
+
+	path := filepath.Join(dir, vol.Name+"."+fsType)
+	label := configImageLabel(driveID)
+	os.Remove(path)
+	if fsType == "erofs" {
+		err = buildErofsConfigImage(path, label, staging)
+	} else {
+		err = buildExt4ConfigImage(path, label, staging, size, files)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+	if err := os.Chmod(path, 0444); err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"sandbox_id": sandboxID,
+		"volume":     vol.Name,
+		"filesystem": fsType,
+		"files":      files,
+		"bytes":      size,
+	}).Debug("Created config image")
+	return path, label, nil
+}
+
+// stageConfigFiles copies the tree at src to dst, owned by the volume's UID
+// and GID, with files of the volume's mode if it has one. Symlinks, such as
+// the ..data links kubelet writes, are copied as links. It returns the
+// bytes and entries copied.
+func stageConfigFiles(src, dst string, vol VolumeSpec) (int64, int, error) {
+	var size int64
+	var files int
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if rel != "." {
+				if err := os.Mkdir(target, 0755); err != nil {
+					return err
+				}
+			}
+			if err := os.Chmod(target, 0755); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			mode := info.Mode().Perm()
+			if vol.FileMode != 0 {
+				mode = vol.FileMode.Perm()
+			}
+			if err := copyConfigFile(path, target, mode); err != nil {
+				return err
+			}
+			size += info.Size()
+		default:
+			// Devices, sockets and pipes have no place in a config volume
+			return nil
+		}
+
+		files++
+		return os.Lchown(target, vol.UID, vol.GID)
+	})
+	return size, files, err
+}
+
+// copyConfigFile copies a regular file, giving the copy mode.
+func copyConfigFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The umask applied at creation may have cleared bits
+	return os.Chmod(dst, mode)
+}
+
+// buildExt4ConfigImage creates an ext4 image populated from dir, sized for
+// its contents. Nothing writes to it, so it has no journal.
+func buildExt4ConfigImage(path, label, dir string, size int64, files int) error {
+	imageSize := max(2*size+int64(files)*4096, configImageMinSize)
+	imageSize = (imageSize + 1<<20 - 1) &^ (1<<20 - 1)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(imageSize)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("mkfs.ext4", "-F", "-q", "-L", label, "-O", "^has_journal",
+		"-N", fmt.Sprint(files+16), "-d", dir, path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: %w: %s", err, output)
+	}
+	return nil
+}
+
+// buildErofsConfigImage creates an erofs image of dir.
+func buildErofsConfigImage(path, label, dir string) error {
+	cmd := exec.Command("mkfs.erofs", "-L", label, path, dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.erofs failed: %w: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigSource lays out a volume the way kubelet does: the keys are
+// links into a timestamped directory, reached through ..data.
+func writeConfigSource(t *testing.T) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "config")
+	data := filepath.Join(src, "..2026_10_16_12_00_00.000000001")
+	if err := os.MkdirAll(data, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "app.conf"), []byte("level=debug\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Base(data), filepath.Join(src, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..data/app.conf", filepath.Join(src, "app.conf")); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestStageConfigFiles(t *testing.T) {
+	src := writeConfigSource(t)
+	dst := t.TempDir()
+	vol := VolumeSpec{Name: "config", UID: os.Getuid(), GID: os.Getgid(), FileMode: 0440}
+
+	size, files, err := stageConfigFiles(src, dst, vol)
+	if err != nil {
+		t.Fatalf("stageConfigFiles() error = %v", err)
+	}
+	if size != int64(len("level=debug\n")) || files != 5 {
+		t.Errorf("staged %d bytes, %d entries, want %d bytes, 5 entries", size, files, len("level=debug\n"))
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "app.conf"))
+	if err != nil || string(got) != "level=debug\n" {
+		t.Errorf("app.conf = %q, %v through the staged links", got, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "app.conf")); err != nil || link != "..data/app.conf" {
+		t.Errorf("app.conf links to %q, %v, want ..data/app.conf", link, err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "app.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0440 {
+		t.Errorf("app.conf mode = %v, want 0440", info.Mode().Perm())
+	}
+	dir, err := os.Stat(filepath.Join(dst, "..data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Mode().Perm() != 0755 {
+		t.Errorf("data dir mode = %v, want 0755", dir.Mode().Perm())
+	}
+}
+
+func TestBuildExt4ConfigImage(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	src := writeConfigSource(t)
+	staging := t.TempDir()
+	size, files, err := stageConfigFiles(src, staging, VolumeSpec{UID: os.Getuid(), GID: os.Getgid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.ext4")
+	label := configImageLabel("vol0-config")
+	if err := buildExt4ConfigImage(path, label, staging, size, files); err != nil {
+		t.Fatalf("buildExt4ConfigImage() error = %v", err)
+	}
+
+	// The label is at offset 0x78 of the superblock, which starts at 1024
+	image, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(label) != 16 {
+		t.Errorf("label %q is %d bytes, want 16", label, len(label))
+	}
+	if got := bytes.TrimRight(image[1024+0x78:1024+0x78+16], "\x00"); string(got) != label {
+		t.Errorf("image label = %q, want %q", got, label)
+	}
+	if int64(len(image)) != configImageMinSize {
+		t.Errorf("image size = %d, want %d", len(image), configImageMinSize)
+	}
+}
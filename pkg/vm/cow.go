@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// Rootfs copy-on-write modes.
+const (
+	// RootfsCoWAuto reflinks where the filesystem supports it and falls
+	// back to a sparse copy elsewhere.
+	RootfsCoWAuto = "auto"
+
+	// RootfsCoWReflink only reflinks, failing on filesystems without
+	// support (e.g. ext4) rather than silently copying.
+	RootfsCoWReflink = "reflink"
+
+	// RootfsCoWCopy always makes a sparse copy.
+	RootfsCoWCopy = "copy"
+
+	// RootfsCoWNone attaches the base image directly, so every sandbox
+	// using the image writes to the same file.
+	RootfsCoWNone = "none"
+)
+
+// ficlone is the FICLONE ioctl, which makes dst share src's extents.
+const ficlone = 0x40049409
+
+// errNoReflink is returned when the filesystem can't reflink.
+var errNoReflink = errors.New("filesystem does not support reflinks")
+
+// RootfsCoWConfig configures per-sandbox copy-on-write root filesystems.
+type RootfsCoWConfig struct {
+	// Mode is one of the RootfsCoW* modes.
+	Mode string
+
+	// Dir holds the per-sandbox layers. Reflinks only work within one
+	// filesystem, so it should live next to the converted images. It also
+	// holds the overlay drives of read-only root images.
+	Dir string
+
+	// OverlaySizeMB is the size of the writable drive sandboxes booting a
+	// read-only root image (erofs or squashfs) get. 0 means
+	// DefaultOverlaySizeMB.
+	OverlaySizeMB int64
+}
+
+// DefaultRootfsCoWConfig returns sensible defaults.
+func DefaultRootfsCoWConfig() RootfsCoWConfig {
+	return RootfsCoWConfig{
+		Mode:          RootfsCoWAuto,
+		Dir:           "/var/lib/fc-cri/cow",
+		OverlaySizeMB: DefaultOverlaySizeMB,
+	}
+}
+
+// rootfsLayerPath returns the writable layer of a sandbox.
+func (m *Manager) rootfsLayerPath(sandboxID string) string {
+	return filepath.Join(m.config.RootfsCoW.Dir, sandboxID+".ext4")
+}
+
+// prepareRootfs gives a sandbox a private writable copy of its root drive
+// and returns the path to attach, so the converted base image stays
+// pristine and isn't shared with other sandboxes using the same image.
+// Read-only drives are attached as is. Read-only root images are attached
+// as is too, with the path of an overlay drive to attach after them.
+func (m *Manager) prepareRootfs(sandbox *domain.Sandbox, drive domain.DriveConfig) (rootfs, overlay string, err error) {
+	if readOnlyImageType(drive.PathOnHost) != "" {
+		overlay, err := m.prepareOverlay(sandbox)
+		if err != nil {
+			return "", "", err
+		}
+		return drive.PathOnHost, overlay, nil
+	}
+
+	if drive.IsReadOnly || m.sharesRootfs(drive) {
+		return drive.PathOnHost, "", nil
+	}
+	mode := m.config.RootfsCoW.Mode
+
+	layer := m.rootfsLayerPath(sandbox.ID)
+	if err := os.MkdirAll(filepath.Dir(layer), 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create rootfs layer dir: %w", err)
+	}
+	if err := cloneFile(drive.PathOnHost, layer, mode); err != nil {
+		return "", "", fmt.Errorf("failed to create rootfs layer: %w", err)
+	}
+	// Reserve the layer's space now rather than fail the guest's writes
+	if err := m.prealloc.allocate(layer, VolumeTypeRootfs); err != nil {
+		os.Remove(layer)
+		return "", "", err
+	}
+
+	sandbox.RootfsPath = layer
+	return layer, "", nil
+}
+
+// sharesRootfs reports whether sandboxes booting from a drive would all
+// write to the image itself rather than to layers of their own.
+func (m *Manager) sharesRootfs(drive domain.DriveConfig) bool {
+	mode := m.config.RootfsCoW.Mode
+	return !drive.IsReadOnly && (mode == "" || mode == RootfsCoWNone) && readOnlyImageType(drive.PathOnHost) == ""
+}
+
+// releaseRootfs removes a sandbox's writable layer or overlay drive, if it
+// has one.
+func (m *Manager) releaseRootfs(sandbox *domain.Sandbox) {
+	if sandbox.RootfsPath == "" || sandbox.RootfsPath == sandbox.VMConfig.RootDrive.PathOnHost {
+		return
+	}
+	if err := os.Remove(sandbox.RootfsPath); err != nil && !os.IsNotExist(err) {
+		m.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to remove rootfs layer")
+	}
+	sandbox.RootfsPath = ""
+}
+
+// cloneFile creates dst as a copy of src that shares nothing writable with
+// it, by reflink or sparse copy depending on mode.
+func cloneFile(src, dst, mode string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	if mode != RootfsCoWCopy {
+		err = reflink(out, in)
+		if err == nil || mode == RootfsCoWReflink {
+			return err
+		}
+		if !errors.Is(err, errNoReflink) {
+			return err
+		}
+	}
+	return sparseCopy(out, in)
+}
+
+// reflink makes dst share src's data blocks; blocks are copied only when
+// either file is written.
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EINVAL, syscall.EXDEV:
+		return errNoReflink
+	default:
+		return fmt.Errorf("reflink failed: %w", errno)
+	}
+}
+
+// sparseCopy copies src to dst, leaving holes where src has zeroes so the
+// copy takes no more space than the data in the image.
+func sparseCopy(dst, src *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := dst.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// A trailing hole isn't written, so set the size explicitly
+	return dst.Truncate(info.Size())
+}
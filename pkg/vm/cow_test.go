@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func writeTestImage(t *testing.T, dir string) (string, []byte) {
+	t.Helper()
+
+	// Data, a hole, more data and a trailing hole
+	data := make([]byte, 3<<20)
+	copy(data, "superblock")
+	copy(data[2<<20:], "inode table")
+
+	path := filepath.Join(dir, "image.ext4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestCloneFile(t *testing.T) {
+	for _, mode := range []string{RootfsCoWAuto, RootfsCoWCopy} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			src, data := writeTestImage(t, dir)
+			dst := filepath.Join(dir, "layer.ext4")
+
+			if err := cloneFile(src, dst, mode); err != nil {
+				t.Fatalf("cloneFile() error = %v", err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("layer content differs from image")
+			}
+
+			// Writes to the layer leave the image untouched
+			if err := os.WriteFile(dst, []byte("dirty"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if orig, _ := os.ReadFile(src); !bytes.Equal(orig, data) {
+				t.Error("writing the layer changed the image")
+			}
+		})
+	}
+}
+
+func TestCloneFile_MissingSource(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "layer.ext4")
+
+	if err := cloneFile(filepath.Join(dir, "missing.ext4"), dst, RootfsCoWAuto); err == nil {
+		t.Fatal("expected error for missing image")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("failed clone left a layer behind")
+	}
+}
+
+func TestPrepareRootfs(t *testing.T) {
+	dir := t.TempDir()
+	image, _ := writeTestImage(t, dir)
+
+	m := &Manager{
+		config: ManagerConfig{RootfsCoW: RootfsCoWConfig{Mode: RootfsCoWCopy, Dir: filepath.Join(dir, "cow")}},
+		log:    logrus.NewEntry(logrus.New()),
+	}
+	drive := domain.DriveConfig{DriveID: "rootfs", PathOnHost: image, IsRoot: true}
+
+	sandbox := domain.NewSandbox("sb-1")
+	path, _, err := m.prepareRootfs(sandbox, drive)
+	if err != nil {
+		t.Fatalf("prepareRootfs() error = %v", err)
+	}
+	if path == image || path != sandbox.RootfsPath {
+		t.Fatalf("path = %s, RootfsPath = %s, want a layer", path, sandbox.RootfsPath)
+	}
+
+	sandbox.VMConfig.RootDrive = drive
+	m.releaseRootfs(sandbox)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("layer not removed on release")
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Errorf("image removed on release: %v", err)
+	}
+
+	// Read-only drives are shared
+	drive.IsReadOnly = true
+	if path, _, err := m.prepareRootfs(domain.NewSandbox("sb-2"), drive); err != nil || path != image {
+		t.Errorf("read-only prepareRootfs() = %s, %v, want %s", path, err, image)
+	}
+}
+
+func TestReadOnlyImageType(t *testing.T) {
+	dir := t.TempDir()
+	erofs := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(erofs[erofsSuperblockOffset:], erofsMagic)
+	images := map[string][]byte{
+		"erofs":    erofs,
+		"squashfs": append([]byte("hsqs"), make([]byte, 4092)...),
+		"":         make([]byte, 4096),
+	}
+	for want, data := range images {
+		path := filepath.Join(dir, "image-"+want)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readOnlyImageType(path); got != want {
+			t.Errorf("readOnlyImageType(%s) = %q, want %q", want, got, want)
+		}
+	}
+	if got := readOnlyImageType(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("readOnlyImageType(missing) = %q", got)
+	}
+}
+
+func TestPrepareRootfs_ReadOnlyImage(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "image.squashfs")
+	if err := os.WriteFile(image, append([]byte("hsqs"), make([]byte, 4092)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{
+		config: ManagerConfig{RootfsCoW: RootfsCoWConfig{Mode: RootfsCoWCopy, Dir: filepath.Join(dir, "cow"), OverlaySizeMB: 16}},
+		log:    logrus.NewEntry(logrus.New()),
+	}
+	drive := domain.DriveConfig{DriveID: "rootfs", PathOnHost: image, IsRoot: true}
+
+	sandbox := domain.NewSandbox("sb-1")
+	rootfs, overlay, err := m.prepareRootfs(sandbox, drive)
+	if err != nil {
+		t.Fatalf("prepareRootfs() error = %v", err)
+	}
+	if rootfs != image {
+		t.Errorf("rootfs = %s, want the image itself", rootfs)
+	}
+	if overlay == "" || overlay != sandbox.RootfsPath {
+		t.Fatalf("overlay = %s, RootfsPath = %s, want an overlay drive", overlay, sandbox.RootfsPath)
+	}
+	if info, err := os.Stat(overlay); err != nil || info.Size() != 16<<20 {
+		t.Fatalf("overlay drive: %v, %v", info, err)
+	}
+
+	sandbox.VMConfig.RootDrive = drive
+	m.releaseRootfs(sandbox)
+	if _, err := os.Stat(overlay); !os.IsNotExist(err) {
+		t.Error("overlay drive not removed on release")
+	}
+}
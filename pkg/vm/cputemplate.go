@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// staticCPUTemplates are the CPU templates built into Firecracker. Which of
+// them a host supports depends on its CPU vendor and Firecracker version.
+var staticCPUTemplates = map[string]bool{
+	"C3":   true,
+	"T2":   true,
+	"T2S":  true,
+	"T2CL": true,
+	"T2A":  true,
+	"V1N1": true,
+}
+
+// cpuConfigHandlerName names the init handler that applies custom CPU
+// templates.
+const cpuConfigHandlerName = "fc-cri.PutCPUConfig"
+
+// CPUTemplateConfig configures CPU templates, which normalize the CPU
+// features guests see across a heterogeneous fleet so snapshots stay
+// portable.
+type CPUTemplateConfig struct {
+	// Default is the template for VMs that don't ask for one. Empty leaves
+	// the host CPU's features as they are.
+	Default string
+
+	// Dir holds custom CPUID/MSR templates, as <name>.json files in
+	// Firecracker's custom CPU template format.
+	Dir string
+}
+
+// DefaultCPUTemplateConfig returns the default CPU template configuration.
+func DefaultCPUTemplateConfig() CPUTemplateConfig {
+	return CPUTemplateConfig{
+		Dir: "/etc/fc-cri/cpu-templates",
+	}
+}
+
+// ValidateCPUTemplateName checks that a template name is a static template
+// or could name a custom one.
+func ValidateCPUTemplateName(name string) error {
+	if name == "" || staticCPUTemplates[name] {
+		return nil
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid CPU template name %q", name)
+	}
+	return nil
+}
+
+// staticCPUTemplate returns a template name as a Firecracker static CPU
+// template, or empty if it names a custom template.
+func staticCPUTemplate(name string) models.CPUTemplate {
+	if !staticCPUTemplates[name] {
+		return ""
+	}
+	return models.CPUTemplate(name)
+}
+
+// customCPUTemplatePath returns the file of a custom CPU template.
+func (m *Manager) customCPUTemplatePath(name string) string {
+	return filepath.Join(m.config.CPUTemplates.Dir, name+".json")
+}
+
+// applyCPUTemplate sets up a VM to boot with a CPU template. Static
+// templates are part of the machine configuration; custom ones are loaded
+// from the templates directory and sent to Firecracker before boot.
+func (m *Manager) applyCPUTemplate(name string, fcConfig *firecracker.Config) ([]firecracker.Opt, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if err := ValidateCPUTemplateName(name); err != nil {
+		return nil, err
+	}
+	if template := staticCPUTemplate(name); template != "" {
+		fcConfig.MachineCfg.CPUTemplate = template
+		return nil, nil
+	}
+
+	template, err := os.ReadFile(m.customCPUTemplatePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("unknown CPU template %q", name)
+		}
+		return nil, fmt.Errorf("failed to read CPU template: %w", err)
+	}
+	if !json.Valid(template) {
+		return nil, fmt.Errorf("CPU template %s is not valid JSON", name)
+	}
+
+	handler := firecracker.Handler{
+		Name: cpuConfigHandlerName,
+		Fn: func(ctx context.Context, machine *firecracker.Machine) error {
+			return putCPUConfig(ctx, machine.Cfg.SocketPath, template)
+		},
+	}
+	return []firecracker.Opt{func(machine *firecracker.Machine) {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName, handler)
+	}}, nil
+}
+
+// putCPUConfig sends a custom CPU template to Firecracker. The SDK has no
+// call for it, so it goes to the API socket directly.
+func putCPUConfig(ctx context.Context, socketPath string, template []byte) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost/cpu-config", bytes.NewReader(template))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to set CPU template: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to set CPU template: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateCPUTemplateName(t *testing.T) {
+	for _, name := range []string{"", "T2", "T2S", "C3", "graviton-baseline"} {
+		if err := ValidateCPUTemplateName(name); err != nil {
+			t.Errorf("ValidateCPUTemplateName(%q) error = %v", name, err)
+		}
+	}
+	for _, name := range []string{".", "..", "../etc/passwd", `a\b`} {
+		if err := ValidateCPUTemplateName(name); err == nil {
+			t.Errorf("ValidateCPUTemplateName(%q) accepted", name)
+		}
+	}
+}
+
+func TestApplyCPUTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fleet.json"), []byte(`{"cpuid_modifiers": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{cpuid`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultManagerConfig()
+	config.CPUTemplates.Dir = dir
+	m := &Manager{config: config, log: logrus.NewEntry(logrus.New())}
+
+	// Static templates go into the machine configuration
+	var fcConfig firecracker.Config
+	opts, err := m.applyCPUTemplate("T2S", &fcConfig)
+	if err != nil || len(opts) != 0 || fcConfig.MachineCfg.CPUTemplate != "T2S" {
+		t.Errorf("applyCPUTemplate(T2S) = %d opts, %v; template %q", len(opts), err, fcConfig.MachineCfg.CPUTemplate)
+	}
+
+	// Custom templates are sent by an init handler
+	fcConfig = firecracker.Config{}
+	opts, err = m.applyCPUTemplate("fleet", &fcConfig)
+	if err != nil || len(opts) != 1 || fcConfig.MachineCfg.CPUTemplate != "" {
+		t.Fatalf("applyCPUTemplate(fleet) = %d opts, %v; template %q", len(opts), err, fcConfig.MachineCfg.CPUTemplate)
+	}
+	machine, err := firecracker.NewMachine(context.Background(), firecracker.Config{DisableValidation: true}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !machine.Handlers.FcInit.Has(cpuConfigHandlerName) {
+		t.Error("custom CPU template handler was not installed")
+	}
+
+	for _, name := range []string{"missing", "broken", "../fleet"} {
+		if _, err := m.applyCPUTemplate(name, &firecracker.Config{}); err == nil {
+			t.Errorf("applyCPUTemplate(%q) succeeded", name)
+		}
+	}
+}
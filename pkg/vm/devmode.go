@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// Environment the dev mode agent is started with (see cmd/fc-agent).
+const (
+	devAgentSocketEnv  = "FC_AGENT_DEV_SOCKET"
+	devAgentCmdlineEnv = "FC_AGENT_CMDLINE"
+)
+
+// DevModeConfig runs VMs without KVM, for developing and testing the
+// runtime on machines without /dev/kvm. Each "VM" is a host process running
+// the guest agent, which serves the agent protocol on the VM's vsock path,
+// so the shim, pool and agent protocol work end-to-end. Nothing is
+// isolated: never enable it in production.
+type DevModeConfig struct {
+	// Enabled replaces Firecracker with agent processes.
+	Enabled bool
+
+	// AgentBinary is the fc-agent binary dev VMs run.
+	AgentBinary string
+
+	// StartTimeout bounds how long a dev VM's agent has to start listening.
+	StartTimeout time.Duration
+}
+
+// DefaultDevModeConfig returns sensible defaults.
+func DefaultDevModeConfig() DevModeConfig {
+	return DevModeConfig{
+		Enabled:      false,
+		AgentBinary:  "/usr/local/bin/fc-agent",
+		StartTimeout: 10 * time.Second,
+	}
+}
+
+// validate checks that dev VMs can be started.
+func (c DevModeConfig) validate() error {
+	if _, err := exec.LookPath(c.AgentBinary); err != nil {
+		return fmt.Errorf("dev mode agent binary: %w", err)
+	}
+	return nil
+}
+
+// createDevVM starts the agent of a dev VM as a host process. The agent
+// runs its containers under the sandbox directory, and any kernel or MMDS
+// settings of the config are ignored.
+func (m *Manager) createDevVM(sandbox *domain.Sandbox, config domain.VMConfig) (*domain.Sandbox, error) {
+	sandboxDir := filepath.Join(m.config.RuntimeDir, sandbox.ID)
+
+	// There is no VMM to serve metadata from
+	config.MMDS = nil
+
+	cmdline, err := expandKernelArgs(config.KernelArgs, kernelArgValues(sandbox, config))
+	if err != nil {
+		removeSandboxDir(sandboxDir)
+		return nil, err
+	}
+	cmdline += " fcagent.container_root=" + filepath.Join(sandboxDir, "containers")
+	if m.config.Agent.Auth {
+		key, err := issueAgentKey(sandboxDir)
+		if err != nil {
+			removeSandboxDir(sandboxDir)
+			return nil, err
+		}
+		sandbox.AgentKey = key
+		cmdline += " " + agentKeyArg(key)
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(sandboxDir, "agent.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		removeSandboxDir(sandboxDir)
+		return nil, fmt.Errorf("failed to create agent log: %w", err)
+	}
+
+	cmd := exec.Command(m.config.DevMode.AgentBinary)
+	cmd.Env = append(os.Environ(),
+		devAgentSocketEnv+"="+sandbox.VsockPath,
+		devAgentCmdlineEnv+"="+cmdline,
+	)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Signals for the shim must not reach the agent
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		removeSandboxDir(sandboxDir)
+		return nil, fmt.Errorf("failed to start dev VM agent: %w", err)
+	}
+
+	// Reap the agent, or it lingers as a zombie that still looks alive
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		logFile.Close()
+		close(exited)
+		m.vmmExited(sandbox, nil)
+	}()
+
+	if err := waitForSocket(sandbox.VsockPath, exited, m.config.DevMode.StartTimeout); err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		removeSandboxDir(sandboxDir)
+		return nil, fmt.Errorf("dev VM agent did not start: %w", err)
+	}
+
+	sandbox.VMConfig = config
+	sandbox.PID = cmd.Process.Pid
+	pidFile := filepath.Join(sandboxDir, "firecracker.pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(sandbox.PID)), 0644); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to write VMM pid file")
+	}
+	sandbox.State = domain.SandboxReady
+	sandbox.StartedAt = time.Now()
+
+	m.mu.Lock()
+	m.sandboxes[sandbox.ID] = sandbox
+	m.mu.Unlock()
+
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"pid":        sandbox.PID,
+	}).Info("Dev VM started")
+
+	return sandbox, nil
+}
+
+// waitForSocket waits for a Unix socket to appear, giving up early if the
+// process that should create it exits.
+func waitForSocket(path string, exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("process exited")
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for %s", path)
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopDevVM stops the agent process of a dev VM.
+func (m *Manager) stopDevVM(sandbox *domain.Sandbox) error {
+	if err := stopProcess(sandbox.PID, 10*time.Second); err != nil {
+		m.log.WithError(err).Warn("Failed to stop dev VM")
+	}
+	sandbox.State = domain.SandboxStopped
+	sandbox.FinishedAt = time.Now()
+	return nil
+}
+
+// signalDevVM pauses or resumes the agent process of a dev VM.
+func signalDevVM(sandbox *domain.Sandbox, sig syscall.Signal) error {
+	if err := syscall.Kill(sandbox.PID, sig); err != nil {
+		return fmt.Errorf("failed to signal dev VM %s: %w", sandbox.ID, err)
+	}
+	return nil
+}
+
+// adoptDevVM re-attaches to a dev VM left running by a previous shim.
+func (m *Manager) adoptDevVM(sandbox *domain.Sandbox) error {
+	if _, err := os.Stat(sandbox.VsockPath); err != nil {
+		return fmt.Errorf("sandbox %s: agent socket missing: %w", sandbox.ID, err)
+	}
+	sandbox.State = domain.SandboxReady
+	sandbox.Recovered = true
+
+	m.mu.Lock()
+	m.sandboxes[sandbox.ID] = sandbox
+	m.mu.Unlock()
+
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"pid":        sandbox.PID,
+	}).Info("Adopted running dev VM")
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+)
+
+// ErrFDExhausted is returned by CreateVM when file descriptor usage is too
+// close to the node or shim limit to safely start another VM.
+var ErrFDExhausted = errors.New("file descriptors nearly exhausted")
+
+// fileNrPath reports node-wide file handle usage.
+var fileNrPath = "/proc/sys/fs/file-nr"
+
+// FDLimitConfig configures file descriptor limits and admission.
+type FDLimitConfig struct {
+	// VMMMaxOpenFiles is the RLIMIT_NOFILE applied to each Firecracker
+	// process. Zero leaves the inherited limit in place.
+	VMMMaxOpenFiles uint64
+
+	// AdmissionThreshold is the fraction (0.0-1.0) of the node-wide or
+	// shim file descriptor limit above which new VMs are refused. Zero
+	// disables the check.
+	AdmissionThreshold float64
+}
+
+// DefaultFDLimitConfig returns sensible defaults.
+func DefaultFDLimitConfig() FDLimitConfig {
+	return FDLimitConfig{
+		VMMMaxOpenFiles:    4096,
+		AdmissionThreshold: 0.9,
+	}
+}
+
+// FDUsage is a point-in-time view of file descriptor usage.
+type FDUsage struct {
+	// NodeUsed and NodeMax are the node-wide allocated and maximum file
+	// handles from /proc/sys/fs/file-nr.
+	NodeUsed uint64
+	NodeMax  uint64
+
+	// ShimUsed and ShimMax are the open FDs and soft RLIMIT_NOFILE of
+	// this process.
+	ShimUsed uint64
+	ShimMax  uint64
+
+	// VMMUsed is the total open FDs across all managed VMMs.
+	VMMUsed uint64
+}
+
+// FDUsage reports current file descriptor usage.
+func (m *Manager) FDUsage() (FDUsage, error) {
+	var usage FDUsage
+
+	nodeUsed, nodeMax, err := readFileNr()
+	if err != nil {
+		return usage, err
+	}
+	usage.NodeUsed, usage.NodeMax = nodeUsed, nodeMax
+
+	usage.ShimUsed = countFDs(os.Getpid())
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+		usage.ShimMax = rlim.Cur
+	}
+
+	for _, sandbox := range m.ListSandboxes() {
+		usage.VMMUsed += countFDs(sandbox.PID)
+	}
+
+	return usage, nil
+}
+
+// CheckAdmission reports whether a new VM may be created, refusing with
+// ErrFDExhausted when FD usage is above the admission threshold.
+func (m *Manager) CheckAdmission() error {
+	threshold := m.config.FDLimits.AdmissionThreshold
+	if threshold <= 0 {
+		return nil
+	}
+
+	usage, err := m.FDUsage()
+	if err != nil {
+		// Don't block VM creation because /proc is unreadable
+		m.log.WithError(err).Debug("Failed to read FD usage")
+		return nil
+	}
+
+	if usage.NodeMax > 0 && float64(usage.NodeUsed) >= threshold*float64(usage.NodeMax) {
+		return fmt.Errorf("%w: node has %d of %d file handles in use", ErrFDExhausted, usage.NodeUsed, usage.NodeMax)
+	}
+	if usage.ShimMax > 0 && float64(usage.ShimUsed) >= threshold*float64(usage.ShimMax) {
+		return fmt.Errorf("%w: shim has %d of %d file descriptors open", ErrFDExhausted, usage.ShimUsed, usage.ShimMax)
+	}
+
+	return nil
+}
+
+// recordFDUsage exports current file descriptor usage as metrics.
+func (m *Manager) recordFDUsage() {
+	usage, err := m.FDUsage()
+	if err != nil {
+		return
+	}
+	metrics.Global().SetFDUsage(
+		int64(usage.NodeUsed), int64(usage.NodeMax),
+		int64(usage.ShimUsed), int64(usage.ShimMax),
+		int64(usage.VMMUsed))
+}
+
+// applyVMMFDLimit sets RLIMIT_NOFILE on a running VMM process.
+func (m *Manager) applyVMMFDLimit(pid int) error {
+	limit := m.config.FDLimits.VMMMaxOpenFiles
+	if limit == 0 || pid <= 0 {
+		return nil
+	}
+	return prlimitNoFile(pid, limit)
+}
+
+// prlimitNoFile sets both the soft and hard RLIMIT_NOFILE of another process.
+func prlimitNoFile(pid int, limit uint64) error {
+	rlim := syscall.Rlimit{Cur: limit, Max: limit}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,
+		uintptr(pid), uintptr(syscall.RLIMIT_NOFILE),
+		uintptr(unsafe.Pointer(&rlim)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("prlimit(%d, RLIMIT_NOFILE, %d): %w", pid, limit, errno)
+	}
+	return nil
+}
+
+// readFileNr parses /proc/sys/fs/file-nr ("allocated unused max").
+func readFileNr() (used, max uint64, err error) {
+	data, err := os.ReadFile(fileNrPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %w", fileNrPath, err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, 0, fmt.Errorf("unexpected %s format: %q", fileNrPath, data)
+	}
+
+	allocated, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse %s: %w", fileNrPath, err)
+	}
+	unused, _ := strconv.ParseUint(fields[1], 10, 64)
+	max, err = strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse %s: %w", fileNrPath, err)
+	}
+
+	return allocated - unused, max, nil
+}
+
+// countFDs returns the number of open file descriptors of a process, or 0
+// if they can't be listed.
+func countFDs(pid int) uint64 {
+	if pid <= 0 {
+		return 0
+	}
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	return uint64(len(entries))
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeFileNr(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file-nr")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file-nr: %v", err)
+	}
+	orig := fileNrPath
+	fileNrPath = path
+	t.Cleanup(func() { fileNrPath = orig })
+}
+
+func TestReadFileNr(t *testing.T) {
+	writeFileNr(t, "9500\t0\t10000\n")
+
+	used, max, err := readFileNr()
+	if err != nil {
+		t.Fatalf("readFileNr failed: %v", err)
+	}
+	if used != 9500 || max != 10000 {
+		t.Errorf("readFileNr() = %d, %d, want 9500, 10000", used, max)
+	}
+
+	writeFileNr(t, "garbage")
+	if _, _, err := readFileNr(); err == nil {
+		t.Error("readFileNr accepted malformed input")
+	}
+}
+
+func TestManager_FDAdmission(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+
+	mgr, err := NewManager(config, log)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	writeFileNr(t, "100\t0\t10000\n")
+	if err := mgr.CheckAdmission(); err != nil {
+		t.Errorf("CheckAdmission() at 1%% = %v, want nil", err)
+	}
+
+	writeFileNr(t, "9500\t0\t10000\n")
+	err = mgr.CheckAdmission()
+	if !errors.Is(err, ErrFDExhausted) {
+		t.Fatalf("CheckAdmission() at 95%% = %v, want ErrFDExhausted", err)
+	}
+	if !strings.Contains(err.Error(), "9500 of 10000") {
+		t.Errorf("Error %q does not report usage", err)
+	}
+
+	// Admission disabled
+	mgr.config.FDLimits.AdmissionThreshold = 0
+	if err := mgr.CheckAdmission(); err != nil {
+		t.Errorf("CheckAdmission() disabled = %v, want nil", err)
+	}
+}
+
+func TestPrlimitNoFile(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start child process: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	if err := prlimitNoFile(cmd.Process.Pid, 256); err != nil {
+		t.Fatalf("prlimitNoFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "limits"))
+	if err != nil {
+		t.Skipf("Cannot read limits: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Max open files") {
+			fields := strings.Fields(line)
+			if fields[3] != "256" || fields[4] != "256" {
+				t.Errorf("Max open files = %s/%s, want 256/256", fields[3], fields[4])
+			}
+			return
+		}
+	}
+	t.Error("Max open files not found in limits")
+}
+
+func TestCountFDs(t *testing.T) {
+	if n := countFDs(syscall.Getpid()); n == 0 {
+		t.Error("countFDs(self) = 0, want > 0")
+	}
+	if n := countFDs(0); n != 0 {
+		t.Errorf("countFDs(0) = %d, want 0", n)
+	}
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// anyOtherNamespace in VMConfig.AvoidNamespaces avoids VMs used by any
+// namespace but the workload's own.
+const anyOtherNamespace = "*"
+
+// Generation identifies what a VM boots with: its kernel, initrd and root
+// drive (by path, size and modification time), its boot configuration, and
+// an operator-set epoch. Replacing a kernel or rootfs image, or bumping the
+// epoch, changes the generation, so VMs booted from the old one are retired
+// instead of being handed out again.
+func Generation(config domain.VMConfig, epoch string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "epoch=%s\n", epoch)
+	fmt.Fprintf(h, "vcpus=%d memory=%d smt=%t\n", config.VcpuCount, config.MemoryMB, config.SMTEnabled)
+	fmt.Fprintf(h, "args=%s\n", config.KernelArgs)
+	if config.CPUTemplate != "" {
+		fmt.Fprintf(h, "cpu_template=%s\n", config.CPUTemplate)
+	}
+	if config.Balloon {
+		fmt.Fprintln(h, "balloon")
+	}
+	writeFileVersion(h, "kernel", config.KernelPath)
+	writeFileVersion(h, "initrd", config.InitrdPath)
+	writeFileVersion(h, "rootfs", config.RootDrive.PathOnHost)
+	if config.MMDS != nil {
+		// MMDS carries the metadata of the pod it was populated for
+		fmt.Fprintf(h, "mmds=%s\n", config.MMDS.Version)
+	}
+	if customNetwork(config) {
+		// The network was set up for the pod: its host ports are forwarded
+		// to the VM, its routes and search domains applied, or further
+		// networks attached
+		fmt.Fprintln(h, "custom_network")
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// writeFileVersion adds the identity of a boot file to a generation hash.
+func writeFileVersion(w io.Writer, name, path string) {
+	if path == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s=%s", name, path)
+	if info, err := os.Stat(path); err == nil {
+		fmt.Fprintf(w, " size=%d mtime=%d", info.Size(), info.ModTime().UnixNano())
+	}
+	fmt.Fprintln(w)
+}
+
+// sameBoot reports whether two VM configs boot the same kernel, initrd,
+// kernel arguments and CPU template, agree on having MMDS and a custom
+// network and keep their sandbox directory in the same runtime directory class.
+// Those can't be changed once a VM is running.
+func sameBoot(a, b domain.VMConfig) bool {
+	return a.KernelPath == b.KernelPath && a.InitrdPath == b.InitrdPath && a.KernelArgs == b.KernelArgs &&
+		a.CPUTemplate == b.CPUTemplate && (a.MMDS != nil) == (b.MMDS != nil) && a.RuntimeDirClass == b.RuntimeDirClass &&
+		customNetwork(a) == customNetwork(b)
+}
+
+// customNetwork reports whether a VM's network is set up for its pod, with
+// host ports, routes, search domains or additional networks, rather than
+// being interchangeable.
+func customNetwork(config domain.VMConfig) bool {
+	return len(config.PortMappings) > 0 ||
+		config.CNIConfig != nil && (len(config.CNIConfig.Routes) > 0 || len(config.CNIConfig.DNSSearch) > 0 ||
+			len(config.CNIConfig.Networks) > 0)
+}
+
+// sameShape reports whether two VM configs have the same vCPUs, memory and
+// SMT setting and boot the same way, so a VM booted with one can serve the
+// other.
+func sameShape(a, b domain.VMConfig) bool {
+	return a.VcpuCount == b.VcpuCount && a.MemoryMB == b.MemoryMB && a.SMTEnabled == b.SMTEnabled && sameBoot(a, b)
+}
+
+// canReuse reports whether a pooled VM may be handed to a workload, given
+// the namespaces the workload asked to avoid.
+func canReuse(sandbox *domain.Sandbox, config domain.VMConfig) bool {
+	for _, used := range sandbox.UsedBy {
+		for _, avoid := range config.AvoidNamespaces {
+			if avoid == used || (avoid == anyOtherNamespace && used != config.Namespace) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// recordUse notes the namespace of a workload a VM is handed to.
+func recordUse(sandbox *domain.Sandbox, config domain.VMConfig) {
+	if config.Namespace == "" {
+		return
+	}
+	for _, ns := range sandbox.UsedBy {
+		if ns == config.Namespace {
+			return
+		}
+	}
+	sandbox.UsedBy = append(sandbox.UsedBy, config.Namespace)
+}
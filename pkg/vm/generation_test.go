@@ -0,0 +1,178 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestGeneration(t *testing.T) {
+	kernel := filepath.Join(t.TempDir(), "vmlinux")
+	if err := os.WriteFile(kernel, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := domain.DefaultVMConfig()
+	config.KernelPath = kernel
+	base := Generation(config, "")
+
+	if got := Generation(config, ""); got != base {
+		t.Errorf("Generation is not stable: %s != %s", got, base)
+	}
+
+	// Placement doesn't affect what the VM boots
+	placed := config
+	placed.Namespace = "tenant-a"
+	placed.AvoidNamespaces = []string{"*"}
+	if got := Generation(placed, ""); got != base {
+		t.Error("Generation changed with workload placement")
+	}
+
+	if Generation(config, "2") == base {
+		t.Error("Generation did not change with the epoch")
+	}
+
+	bigger := config
+	bigger.MemoryMB *= 2
+	if Generation(bigger, "") == base {
+		t.Error("Generation did not change with the VM size")
+	}
+
+	templated := config
+	templated.CPUTemplate = "T2S"
+	if Generation(templated, "") == base {
+		t.Error("Generation did not change with the CPU template")
+	}
+
+	ballooned := config
+	ballooned.Balloon = true
+	if Generation(ballooned, "") == base {
+		t.Error("Generation did not change with the balloon")
+	}
+
+	// Replacing the kernel image retires VMs booted from the old one
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(kernel, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if Generation(config, "") == base {
+		t.Error("Generation did not change with the kernel image")
+	}
+}
+
+func TestCanReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		usedBy []string
+		ns     string
+		avoid  []string
+		want   bool
+	}{
+		{"fresh VM", nil, "tenant-a", []string{"*"}, true},
+		{"no constraints", []string{"tenant-b"}, "tenant-a", nil, true},
+		{"avoided namespace", []string{"tenant-b"}, "tenant-a", []string{"tenant-b"}, false},
+		{"other namespace", []string{"tenant-c"}, "tenant-a", []string{"tenant-b"}, true},
+		{"any other namespace", []string{"tenant-b"}, "tenant-a", []string{"*"}, false},
+		{"own namespace", []string{"tenant-a"}, "tenant-a", []string{"*"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sandbox := domain.NewSandbox("sb")
+			sandbox.UsedBy = tt.usedBy
+			config := domain.VMConfig{Namespace: tt.ns, AvoidNamespaces: tt.avoid}
+			if got := canReuse(sandbox, config); got != tt.want {
+				t.Errorf("canReuse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanResize(t *testing.T) {
+	boot := domain.DefaultVMConfig()
+	boot.VcpuCount, boot.MemoryMB, boot.Balloon = 4, 4096, true
+
+	tests := []struct {
+		name     string
+		vcpus    int64
+		memoryMB int64
+		want     bool
+	}{
+		{"smaller", 1, 512, true},
+		{"same size", 4, 4096, true},
+		{"more vCPUs", 8, 512, false},
+		{"more memory", 1, 8192, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workload := domain.DefaultVMConfig()
+			workload.VcpuCount, workload.MemoryMB = tt.vcpus, tt.memoryMB
+			if got := canResize(boot, workload); got != tt.want {
+				t.Errorf("canResize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	noBalloon := boot
+	noBalloon.Balloon = false
+	if canResize(noBalloon, domain.DefaultVMConfig()) {
+		t.Error("canResize() = true for a VM without a balloon")
+	}
+}
+
+func TestSameBoot(t *testing.T) {
+	base := domain.DefaultVMConfig()
+
+	other := base
+	other.MemoryMB *= 2
+	other.Namespace = "tenant-a"
+	if !sameBoot(base, other) {
+		t.Error("sameBoot() = false for configs that only differ in sizing")
+	}
+
+	other.KernelPath = "/var/lib/fc-cri/kernels/6.1-minimal/vmlinux"
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true for different kernels")
+	}
+
+	other = base
+	other.CPUTemplate = "T2S"
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true for different CPU templates")
+	}
+
+	other = base
+	other.MMDS = &domain.MMDSConfig{}
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true when only one config has MMDS")
+	}
+
+	// Pooled VMs were networked without the workload's host ports
+	other = base
+	other.PortMappings = []domain.PortMapping{{HostPort: 8080, ContainerPort: 80}}
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true when only one config has host ports")
+	}
+	if Generation(other, "") == Generation(base, "") {
+		t.Error("Generation did not change with host ports")
+	}
+
+	// Or without its routes and search domains
+	other = base
+	other.CNIConfig = &domain.CNIConfig{DNSSearch: []string{"corp.example.com"}}
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true when only one config has search domains")
+	}
+	other.CNIConfig = &domain.CNIConfig{Networks: []string{"storage"}}
+	if sameBoot(base, other) {
+		t.Error("sameBoot() = true when only one config has additional networks")
+	}
+	other.CNIConfig = &domain.CNIConfig{}
+	if !sameBoot(base, other) {
+		t.Error("sameBoot() = false for an empty CNI config")
+	}
+}
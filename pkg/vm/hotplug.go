@@ -30,6 +30,9 @@ type HotplugManager struct {
 
 	// Track attached drives per sandbox
 	attachedDrives map[string][]AttachedDrive
+
+	// Allocates the emptyDir images
+	prealloc *preallocator
 }
 
 // AttachedDrive represents a drive that has been hot-attached to a VM.
@@ -37,6 +40,7 @@ type AttachedDrive struct {
 	DriveID    string
 	PathOnHost string
 	MountPoint string // Mount point inside the guest
+	Label      string // Filesystem label the agent finds the drive by
 	IsReadOnly bool
 	AttachedAt time.Time
 }
@@ -65,6 +69,13 @@ type HotplugConfig struct {
 	// MountPoint is where the agent should mount this drive inside the guest.
 	// If empty, the drive is attached but not automatically mounted.
 	MountPoint string
+
+	// Label is the filesystem label of the drive, which the agent finds
+	// it by. Only set for images the runtime builds.
+	Label string
+
+	// Filesystem is the filesystem the agent mounts the drive as.
+	Filesystem string
 }
 
 // DriveRateLimiter configures I/O rate limiting for a drive.
@@ -82,12 +93,16 @@ type DriveRateLimiter struct {
 	OpsBurst int64
 }
 
-// NewHotplugManager creates a new hotplug manager.
-func NewHotplugManager(log *logrus.Entry) *HotplugManager {
-	return &HotplugManager{
+// NewHotplugManager creates a new hotplug manager. prealloc sets how the
+// emptyDir images it creates are allocated.
+func NewHotplugManager(prealloc PreallocConfig, log *logrus.Entry) *HotplugManager {
+	h := &HotplugManager{
 		log:            log.WithField("component", "hotplug"),
 		attachedDrives: make(map[string][]AttachedDrive),
 	}
+	h.prealloc = newPreallocator(prealloc, h.log)
+	h.prealloc.check(volumesDir, VolumeTypeEmptyDir)
+	return h
 }
 
 // AttachDrive hot-attaches a drive to a running VM.
@@ -152,6 +167,7 @@ func (h *HotplugManager) AttachDrive(ctx context.Context, sandbox *domain.Sandbo
 		DriveID:    config.DriveID,
 		PathOnHost: config.PathOnHost,
 		MountPoint: config.MountPoint,
+		Label:      config.Label,
 		IsReadOnly: config.IsReadOnly,
 		AttachedAt: time.Now(),
 	}
@@ -344,6 +360,9 @@ func (h *HotplugManager) patchDriveViaAPI(ctx context.Context, sandbox *domain.S
 // Volume Types and Helpers
 // =============================================================================
 
+// volumesDir holds the images of the volumes the runtime creates.
+const volumesDir = "/run/fc-cri/volumes"
+
 // VolumeType represents the type of volume being attached.
 type VolumeType string
 
@@ -383,6 +402,18 @@ type VolumeSpec struct {
 
 	// SizeBytes is the size for dynamically created volumes.
 	SizeBytes int64
+
+	// Filesystem is the filesystem of the image built for a secret or
+	// configmap volume: "ext4" (the default) or "erofs".
+	Filesystem string
+
+	// UID and GID own the files of a secret or configmap volume.
+	UID int
+	GID int
+
+	// FileMode is the mode of the files of a secret or configmap volume.
+	// Zero keeps the modes of the source files.
+	FileMode os.FileMode
 }
 
 // PrepareVolumes prepares all volumes for a container and returns hotplug configs.
@@ -428,13 +459,17 @@ func (h *HotplugManager) prepareVolume(ctx context.Context, sandboxID string, vo
 		config.CacheType = "Unsafe"
 
 	case VolumeTypeSecret, VolumeTypeConfigMap:
-		// These are typically small and read-only
-		// Create a small ext4 image with the content
-		configPath, err := h.createConfigImage(sandboxID, vol.Name, vol.Source)
+		// Small and read-only: an image of the files of their own
+		configPath, label, err := h.createConfigImage(sandboxID, config.DriveID, vol)
 		if err != nil {
 			return config, err
 		}
 		config.PathOnHost = configPath
+		config.Label = label
+		config.Filesystem = vol.Filesystem
+		if config.Filesystem == "" {
+			config.Filesystem = "ext4"
+		}
 		config.IsReadOnly = true
 
 	default:
@@ -449,14 +484,14 @@ func (h *HotplugManager) createEmptyDirImage(sandboxID, name string, sizeBytes i
 		sizeBytes = 100 * 1024 * 1024 // Default 100MB
 	}
 
-	dir := filepath.Join("/run/fc-cri/volumes", sandboxID)
+	dir := filepath.Join(volumesDir, sandboxID)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", err
 	}
 
 	path := filepath.Join(dir, name+".ext4")
 
-	// Create sparse file
+	// Create sparse file, then allocate it as configured
 	f, err := os.Create(path)
 	if err != nil {
 		return "", err
@@ -466,6 +501,10 @@ func (h *HotplugManager) createEmptyDirImage(sandboxID, name string, sizeBytes i
 		return "", err
 	}
 	f.Close()
+	if err := h.prealloc.allocate(path, VolumeTypeEmptyDir); err != nil {
+		os.Remove(path)
+		return "", err
+	}
 
 	// Format as ext4 (requires mkfs.ext4)
 	// In production, pre-create formatted images and copy them
@@ -475,22 +514,8 @@ func (h *HotplugManager) createEmptyDirImage(sandboxID, name string, sizeBytes i
 	return path, nil
 }
 
-func (h *HotplugManager) createConfigImage(sandboxID, name, sourcePath string) (string, error) {
-	dir := filepath.Join("/run/fc-cri/volumes", sandboxID)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", err
-	}
-
-	path := filepath.Join(dir, name+".ext4")
-
-	// For secrets/configmaps, create a small image and populate it
-	// This is simplified - in production, use proper image creation
-
-	return path, nil
-}
-
 // CleanupVolumes removes all volume images for a sandbox.
 func (h *HotplugManager) CleanupVolumes(sandboxID string) error {
-	dir := filepath.Join("/run/fc-cri/volumes", sandboxID)
+	dir := filepath.Join(volumesDir, sandboxID)
 	return os.RemoveAll(dir)
 }
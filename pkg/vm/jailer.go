@@ -21,7 +21,9 @@
 //	│   └── vsock (if enabled)
 //	├── run/
 //	│   └── firecracker.socket
+//	├── vsock.sock
 //	├── kernel -> /var/lib/fc-cri/vmlinux (bind mount)
+//	├── initrd -> /path/to/initrd (bind mount, if any)
 //	└── rootfs.ext4 -> /path/to/rootfs (bind mount or copy)
 package vm
 
@@ -88,8 +90,9 @@ type JailerConfig struct {
 	// Daemonize controls whether the jailer daemonizes.
 	Daemonize bool
 
-	// SeccompLevel sets the seccomp filter level: 0=disabled, 1=basic, 2=advanced.
-	SeccompLevel int
+	// Seccomp selects the seccomp filters. A custom filter is bind mounted
+	// into the chroot.
+	Seccomp SeccompConfig
 
 	// ResourceLimits contains default resource limits.
 	ResourceLimits JailerResourceLimits
@@ -129,7 +132,6 @@ func DefaultJailerConfig() JailerConfig {
 		CgroupVersion:     "2",
 		CgroupParent:      "fc-cri.slice",
 		Daemonize:         true,
-		SeccompLevel:      2,
 		ResourceLimits: JailerResourceLimits{
 			MaxOpenFiles: 2048,
 			MaxProcesses: 100,
@@ -147,9 +149,12 @@ type JailedVM struct {
 	// ChrootDir is the chroot directory for this VM.
 	ChrootDir string
 
-	// SocketPath is the path to the API socket inside the chroot.
+	// SocketPath is the host path of the API socket inside the chroot.
 	SocketPath string
 
+	// VsockPath is the host path of the vsock socket inside the chroot.
+	VsockPath string
+
 	// PID is the jailer process ID.
 	PID int
 
@@ -191,6 +196,11 @@ func NewJailerManager(config JailerConfig, log *logrus.Entry) (*JailerManager, e
 		if err := os.MkdirAll(cgroupPath, 0755); err != nil {
 			log.WithError(err).Warn("Failed to create cgroup parent")
 		}
+		// Controllers are enabled in the parent; a cgroup that has them
+		// enabled for its children can't hold the VMM itself
+		if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.subtree_control"), []byte(cgroupControllers), 0644); err != nil {
+			log.WithError(err).Warn("Failed to enable cgroup controllers")
+		}
 	}
 
 	return &JailerManager{
@@ -214,11 +224,8 @@ func (jm *JailerManager) CreateJailedVM(ctx context.Context, sandboxID string, v
 		return nil, nil, fmt.Errorf("failed to setup chroot: %w", err)
 	}
 
-	// Setup device nodes
-	if err := jm.setupDevices(chrootDir); err != nil {
-		_ = jm.cleanupChroot(chrootDir)
-		return nil, nil, fmt.Errorf("failed to setup devices: %w", err)
-	}
+	// Device nodes (/dev/kvm, /dev/net/tun, ...) are created by the jailer
+	// itself, which refuses to start if they already exist
 
 	// Bind mount kernel
 	kernelDest := filepath.Join(chrootDir, "kernel")
@@ -227,6 +234,24 @@ func (jm *JailerManager) CreateJailedVM(ctx context.Context, sandboxID string, v
 		return nil, nil, fmt.Errorf("failed to bind mount kernel: %w", err)
 	}
 
+	// Bind mount initrd
+	if vmConfig.InitrdPath != "" {
+		initrdDest := filepath.Join(chrootDir, "initrd")
+		if err := jm.bindMount(vmConfig.InitrdPath, initrdDest); err != nil {
+			_ = jm.cleanupChroot(chrootDir)
+			return nil, nil, fmt.Errorf("failed to bind mount initrd: %w", err)
+		}
+	}
+
+	// Bind mount the seccomp filter
+	if jm.config.Seccomp.Level() == SeccompCustom {
+		filterDest := filepath.Join(chrootDir, jailedSeccompFilter)
+		if err := jm.bindMount(jm.config.Seccomp.FilterPath, filterDest); err != nil {
+			_ = jm.cleanupChroot(chrootDir)
+			return nil, nil, fmt.Errorf("failed to bind mount seccomp filter: %w", err)
+		}
+	}
+
 	// Bind mount or copy rootfs
 	if vmConfig.RootDrive.PathOnHost != "" {
 		rootfsDest := filepath.Join(chrootDir, "rootfs.ext4")
@@ -234,13 +259,20 @@ func (jm *JailerManager) CreateJailedVM(ctx context.Context, sandboxID string, v
 			_ = jm.cleanupChroot(chrootDir)
 			return nil, nil, fmt.Errorf("failed to bind mount rootfs: %w", err)
 		}
+		// Firecracker runs unprivileged and must be able to write the drive
+		if !vmConfig.RootDrive.IsReadOnly {
+			if err := os.Chown(rootfsDest, jm.config.UID, jm.config.GID); err != nil {
+				jm.log.WithError(err).Warn("Failed to chown rootfs")
+			}
+		}
 	}
 
 	// Create the jailed VM object
 	jailedVM := &JailedVM{
 		ID:         sandboxID,
 		ChrootDir:  chrootDir,
-		SocketPath: filepath.Join(chrootDir, "run", "firecracker.socket"),
+		SocketPath: GetJailedSocketPath(jm.config.ChrootBaseDir, sandboxID),
+		VsockPath:  GetJailedVsockPath(jm.config.ChrootBaseDir, sandboxID),
 		Config:     jm.config,
 	}
 
@@ -268,34 +300,43 @@ func (jm *JailerManager) CreateJailedVM(ctx context.Context, sandboxID string, v
 
 // GetJailerArgs returns the command-line arguments for the jailer.
 func (jm *JailerManager) GetJailerArgs(jailedVM *JailedVM, vmConfig domain.VMConfig) []string {
+	return jailerArgs(jm.config, jailedVM)
+}
+
+func jailerArgs(config JailerConfig, jailedVM *JailedVM) []string {
 	args := []string{
 		"--id", jailedVM.ID,
-		"--exec-file", jm.config.FirecrackerBinary,
-		"--uid", strconv.Itoa(jm.config.UID),
-		"--gid", strconv.Itoa(jm.config.GID),
-		"--chroot-base-dir", jm.config.ChrootBaseDir,
+		"--exec-file", config.FirecrackerBinary,
+		"--uid", strconv.Itoa(config.UID),
+		"--gid", strconv.Itoa(config.GID),
+		"--chroot-base-dir", config.ChrootBaseDir,
 	}
 
 	// NUMA pinning
-	if jm.config.NumaNode >= 0 {
-		args = append(args, "--numa-node", strconv.Itoa(jm.config.NumaNode))
+	if config.NumaNode >= 0 {
+		args = append(args, "--numa-node", strconv.Itoa(config.NumaNode))
 	}
 
 	// Cgroup configuration
-	if jm.config.CgroupVersion == "2" {
+	if config.CgroupVersion == "2" {
 		args = append(args, "--cgroup-version", "2")
 	}
-	if jm.config.CgroupParent != "" {
-		args = append(args, "--parent-cgroup", jm.config.CgroupParent)
+	if config.CgroupParent != "" {
+		args = append(args, "--parent-cgroup", config.CgroupParent)
 	}
 
 	// Network namespace
-	if jm.config.NetNS != "" {
-		args = append(args, "--netns", jm.config.NetNS)
+	if config.NetNS != "" {
+		args = append(args, "--netns", config.NetNS)
+	}
+
+	// Resource limits
+	if limit := config.ResourceLimits.MaxOpenFiles; limit > 0 {
+		args = append(args, "--resource-limit", "no-file="+strconv.FormatUint(limit, 10))
 	}
 
 	// Daemonize
-	if jm.config.Daemonize {
+	if config.Daemonize {
 		args = append(args, "--daemonize")
 	}
 
@@ -308,13 +349,42 @@ func (jm *JailerManager) GetJailerArgs(jailedVM *JailedVM, vmConfig domain.VMCon
 	)
 
 	// Seccomp
-	if jm.config.SeccompLevel > 0 {
-		args = append(args, "--seccomp-level", strconv.Itoa(jm.config.SeccompLevel))
-	}
+	args = append(args, config.Seccomp.args(jailedSeccompFilter)...)
 
 	return args
 }
 
+// Command returns the jailer command for a jailed VM, for the SDK to run in
+// place of Firecracker. The jailer never daemonizes here: it execs
+// Firecracker in the same process, which the SDK then supervises like an
+// unjailed VMM.
+func (jm *JailerManager) Command(jailedVM *JailedVM) *exec.Cmd {
+	config := jm.config
+	config.Daemonize = false
+
+	cmd := exec.Command(config.JailerBinary, jailerArgs(config, jailedVM)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// Keep the VM running if the shim's process group is signalled
+		Setsid: true,
+	}
+	return cmd
+}
+
+// adoptJailedVM tracks a jailed VM left running by a previous shim
+// process, so DestroyJailedVM cleans up its chroot.
+func (jm *JailerManager) adoptJailedVM(sandboxID string) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.jailedVMs[sandboxID] = &JailedVM{
+		ID:         sandboxID,
+		ChrootDir:  filepath.Join(jm.config.ChrootBaseDir, "firecracker", sandboxID, "root"),
+		SocketPath: GetJailedSocketPath(jm.config.ChrootBaseDir, sandboxID),
+		VsockPath:  GetJailedVsockPath(jm.config.ChrootBaseDir, sandboxID),
+		CgroupPath: jm.cgroupPath(sandboxID),
+		Config:     jm.config,
+	}
+}
+
 // StartJailedVM starts the jailer with Firecracker.
 func (jm *JailerManager) StartJailedVM(ctx context.Context, jailedVM *JailedVM, vmConfig domain.VMConfig) error {
 	args := jm.GetJailerArgs(jailedVM, vmConfig)
@@ -421,49 +491,6 @@ func (jm *JailerManager) setupChrootDir(chrootDir string) error {
 	return nil
 }
 
-func (jm *JailerManager) setupDevices(chrootDir string) error {
-	devices := []struct {
-		path  string
-		mode  uint32
-		major uint32
-		minor uint32
-	}{
-		// /dev/null
-		{filepath.Join(chrootDir, "dev", "null"), syscall.S_IFCHR | 0666, 1, 3},
-		// /dev/zero
-		{filepath.Join(chrootDir, "dev", "zero"), syscall.S_IFCHR | 0666, 1, 5},
-		// /dev/urandom
-		{filepath.Join(chrootDir, "dev", "urandom"), syscall.S_IFCHR | 0666, 1, 9},
-		// /dev/kvm
-		{filepath.Join(chrootDir, "dev", "kvm"), syscall.S_IFCHR | 0660, 10, 232},
-		// /dev/net/tun
-		{filepath.Join(chrootDir, "dev", "net", "tun"), syscall.S_IFCHR | 0660, 10, 200},
-	}
-
-	for _, dev := range devices {
-		// Remove if exists
-		os.Remove(dev.path)
-
-		// Create device node
-		devNum := int(dev.major<<8 | dev.minor)
-		if err := syscall.Mknod(dev.path, dev.mode, devNum); err != nil {
-			// Try bind mount as fallback (for unprivileged setup)
-			srcPath := strings.TrimPrefix(dev.path, chrootDir)
-			if err := jm.bindMount(srcPath, dev.path); err != nil {
-				jm.log.WithFields(logrus.Fields{
-					"path":  dev.path,
-					"error": err,
-				}).Warn("Failed to create device node")
-			}
-		}
-
-		// Set ownership
-		_ = os.Chown(dev.path, jm.config.UID, jm.config.GID)
-	}
-
-	return nil
-}
-
 func (jm *JailerManager) bindMount(src, dst string) error {
 	// Create destination file/directory
 	srcInfo, err := os.Stat(src)
@@ -504,8 +531,17 @@ func (jm *JailerManager) setupCgroup(jailedVM *JailedVM) error {
 	return jm.setupCgroupV1(jailedVM)
 }
 
+// cgroupPath returns the cgroup of a VM; with cgroups v1, the one in the cpu
+// hierarchy.
+func (jm *JailerManager) cgroupPath(sandboxID string) string {
+	if jm.config.CgroupVersion == "2" {
+		return filepath.Join("/sys/fs/cgroup", jm.config.CgroupParent, sandboxID)
+	}
+	return filepath.Join("/sys/fs/cgroup/cpu", jm.config.CgroupParent, sandboxID)
+}
+
 func (jm *JailerManager) setupCgroupV2(jailedVM *JailedVM) error {
-	cgroupPath := filepath.Join("/sys/fs/cgroup", jm.config.CgroupParent, jailedVM.ID)
+	cgroupPath := jm.cgroupPath(jailedVM.ID)
 
 	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
 		return fmt.Errorf("failed to create cgroup: %w", err)
@@ -533,10 +569,6 @@ func (jm *JailerManager) setupCgroupV2(jailedVM *JailedVM) error {
 			[]byte(strconv.FormatUint(limits.MaxMemoryBytes, 10)), 0644)
 	}
 
-	// Enable controllers
-	_ = os.WriteFile(filepath.Join(cgroupPath, "cgroup.subtree_control"),
-		[]byte("+cpu +memory +io"), 0644)
-
 	return nil
 }
 
@@ -577,7 +609,7 @@ func (jm *JailerManager) setupCgroupV1(jailedVM *JailedVM) error {
 		}
 	}
 
-	jailedVM.CgroupPath = filepath.Join("/sys/fs/cgroup/cpu", jm.config.CgroupParent, jailedVM.ID)
+	jailedVM.CgroupPath = jm.cgroupPath(jailedVM.ID)
 	return nil
 }
 
@@ -585,12 +617,10 @@ func (jm *JailerManager) cleanupChroot(chrootDir string) error {
 	// Unmount any bind mounts first
 	mounts := []string{
 		filepath.Join(chrootDir, "kernel"),
+		filepath.Join(chrootDir, "initrd"),
+		filepath.Join(chrootDir, jailedSeccompFilter),
 		filepath.Join(chrootDir, "rootfs.ext4"),
-		filepath.Join(chrootDir, "dev", "kvm"),
-		filepath.Join(chrootDir, "dev", "net", "tun"),
-		filepath.Join(chrootDir, "dev", "null"),
-		filepath.Join(chrootDir, "dev", "zero"),
-		filepath.Join(chrootDir, "dev", "urandom"),
+		filepath.Join(chrootDir, jailedOverlayDrive),
 	}
 
 	for _, mount := range mounts {
@@ -604,25 +634,40 @@ func (jm *JailerManager) cleanupChroot(chrootDir string) error {
 }
 
 func (jm *JailerManager) buildJailedConfig(jailedVM *JailedVM, vmConfig domain.VMConfig) firecracker.Config {
-	// Paths are relative to chroot
-	return firecracker.Config{
+	// Paths are relative to chroot, except the API socket, which the SDK
+	// connects to from the host
+	fcConfig := firecracker.Config{
 		SocketPath:      jailedVM.SocketPath,
 		KernelImagePath: "/kernel",
 		KernelArgs:      vmConfig.KernelArgs,
-		Drives: []models.Drive{
-			{
-				DriveID:      firecracker.String("rootfs"),
-				PathOnHost:   firecracker.String("/rootfs.ext4"),
-				IsRootDevice: firecracker.Bool(true),
-				IsReadOnly:   firecracker.Bool(vmConfig.RootDrive.IsReadOnly),
-			},
-		},
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:  firecracker.Int64(vmConfig.VcpuCount),
 			MemSizeMib: firecracker.Int64(vmConfig.MemoryMB),
 			Smt:        firecracker.Bool(vmConfig.SMTEnabled),
+			// Custom CPU templates are sent by a machine handler, see applyCPUTemplate
+			CPUTemplate: staticCPUTemplate(vmConfig.CPUTemplate),
 		},
+		VsockDevices: []firecracker.VsockDevice{
+			{
+				Path: "/vsock.sock",
+				CID:  vmConfig.VsockCID,
+			},
+		},
+	}
+	if vmConfig.InitrdPath != "" {
+		fcConfig.InitrdPath = "/initrd"
+	}
+	if vmConfig.RootDrive.PathOnHost != "" {
+		fcConfig.Drives = []models.Drive{
+			{
+				DriveID:      firecracker.String(vmConfig.RootDrive.DriveID),
+				PathOnHost:   firecracker.String("/rootfs.ext4"),
+				IsRootDevice: firecracker.Bool(vmConfig.RootDrive.IsRoot),
+				IsReadOnly:   firecracker.Bool(vmConfig.RootDrive.IsReadOnly),
+			},
+		}
 	}
+	return fcConfig
 }
 
 // =============================================================================
@@ -673,3 +718,75 @@ func CheckJailerPrerequisites(config JailerConfig) error {
 func GetJailedSocketPath(baseDir, sandboxID string) string {
 	return filepath.Join(baseDir, "firecracker", sandboxID, "root", "run", "firecracker.socket")
 }
+
+// GetJailedVsockPath returns the host path of a jailed VM's vsock socket.
+func GetJailedVsockPath(baseDir, sandboxID string) string {
+	return filepath.Join(baseDir, "firecracker", sandboxID, "root", "vsock.sock")
+}
+
+// jail prepares a sandbox's chroot and rewrites the host paths in fcConfig
+// to the paths Firecracker sees inside it. The sandbox directory gets links
+// to the jailed sockets, so tools looking in the runtime dir find them. The
+// returned option launches Firecracker through the jailer.
+func (m *Manager) jail(ctx context.Context, sandbox *domain.Sandbox, config domain.VMConfig, fcConfig *firecracker.Config) (firecracker.Opt, error) {
+	// Jail the drive actually attached, i.e. the sandbox's writable layer
+	config.RootDrive.PathOnHost = ""
+	if len(fcConfig.Drives) > 0 {
+		config.RootDrive.PathOnHost = firecracker.StringValue(fcConfig.Drives[0].PathOnHost)
+		config.RootDrive.IsReadOnly = firecracker.BoolValue(fcConfig.Drives[0].IsReadOnly)
+	}
+	config.VsockCID = sandbox.VsockCID
+
+	jailedVM, jailedConfig, err := m.jailer.CreateJailedVM(ctx, sandbox.ID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The overlay drive of a read-only root image follows the root drive
+	if len(fcConfig.Drives) > 1 {
+		overlay := fcConfig.Drives[1]
+		dest := filepath.Join(jailedVM.ChrootDir, jailedOverlayDrive)
+		if err := m.jailer.bindMount(firecracker.StringValue(overlay.PathOnHost), dest); err != nil {
+			_ = m.jailer.DestroyJailedVM(ctx, sandbox.ID)
+			return nil, fmt.Errorf("failed to bind mount overlay drive: %w", err)
+		}
+		if err := os.Chown(dest, m.jailer.config.UID, m.jailer.config.GID); err != nil {
+			m.log.WithError(err).Warn("Failed to chown overlay drive")
+		}
+		overlay.PathOnHost = firecracker.String(jailedOverlayDrive)
+		jailedConfig.Drives = append(jailedConfig.Drives, overlay)
+	}
+
+	fcConfig.SocketPath = jailedConfig.SocketPath
+	fcConfig.KernelImagePath = jailedConfig.KernelImagePath
+	fcConfig.InitrdPath = jailedConfig.InitrdPath
+	fcConfig.Drives = jailedConfig.Drives
+	fcConfig.VsockDevices = jailedConfig.VsockDevices
+	// The SDK checks paths on the host, where the chroot paths don't exist
+	fcConfig.DisableValidation = true
+	sandbox.VsockPath = jailedVM.VsockPath
+
+	sandboxDir := filepath.Join(m.config.RuntimeDir, sandbox.ID)
+	links := map[string]string{
+		filepath.Join(sandboxDir, "firecracker.sock"): jailedVM.SocketPath,
+		filepath.Join(sandboxDir, "vsock.sock"):       jailedVM.VsockPath,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			_ = m.jailer.DestroyJailedVM(ctx, sandbox.ID)
+			return nil, fmt.Errorf("failed to link jailed socket: %w", err)
+		}
+	}
+
+	return firecracker.WithProcessRunner(m.jailer.Command(jailedVM)), nil
+}
+
+// releaseJail removes the chroot of a jailed VM.
+func (m *Manager) releaseJail(ctx context.Context, sandboxID string, config domain.VMConfig) {
+	if m.jailer == nil || !config.JailerEnabled {
+		return
+	}
+	if err := m.jailer.DestroyJailedVM(ctx, sandboxID); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to clean up jail")
+	}
+}
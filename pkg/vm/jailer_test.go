@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBuildJailedConfig(t *testing.T) {
+	jm := &JailerManager{config: DefaultJailerConfig(), log: logrus.NewEntry(logrus.New())}
+	jailedVM := &JailedVM{
+		ID:         "sb-1",
+		SocketPath: GetJailedSocketPath("/srv/jailer", "sb-1"),
+	}
+
+	config := domain.DefaultVMConfig()
+	config.KernelPath = "/var/lib/fc-cri/vmlinux"
+	config.InitrdPath = "/var/lib/fc-cri/initrd"
+	config.VsockCID = 7
+	config.RootDrive = domain.DriveConfig{
+		DriveID:    "rootfs",
+		PathOnHost: "/var/lib/fc-cri/cow/sb-1.ext4",
+		IsRoot:     true,
+	}
+
+	fcConfig := jm.buildJailedConfig(jailedVM, config)
+	if fcConfig.SocketPath != "/srv/jailer/firecracker/sb-1/root/run/firecracker.socket" {
+		t.Errorf("SocketPath = %s, want the host path inside the chroot", fcConfig.SocketPath)
+	}
+	if fcConfig.KernelImagePath != "/kernel" || fcConfig.InitrdPath != "/initrd" {
+		t.Errorf("kernel = %s, initrd = %s, want chroot paths", fcConfig.KernelImagePath, fcConfig.InitrdPath)
+	}
+	if len(fcConfig.Drives) != 1 || firecracker.StringValue(fcConfig.Drives[0].PathOnHost) != "/rootfs.ext4" {
+		t.Errorf("Drives = %+v, want /rootfs.ext4", fcConfig.Drives)
+	}
+	if len(fcConfig.VsockDevices) != 1 || fcConfig.VsockDevices[0].Path != "/vsock.sock" || fcConfig.VsockDevices[0].CID != 7 {
+		t.Errorf("VsockDevices = %+v, want /vsock.sock with CID 7", fcConfig.VsockDevices)
+	}
+
+	// No drive or initrd, nothing to translate
+	config.InitrdPath = ""
+	config.RootDrive = domain.DriveConfig{}
+	fcConfig = jm.buildJailedConfig(jailedVM, config)
+	if fcConfig.InitrdPath != "" || len(fcConfig.Drives) != 0 {
+		t.Errorf("initrd = %q, drives = %+v, want none", fcConfig.InitrdPath, fcConfig.Drives)
+	}
+}
+
+func TestJailerCommand(t *testing.T) {
+	config := DefaultJailerConfig()
+	config.Daemonize = true
+	jm := &JailerManager{config: config, log: logrus.NewEntry(logrus.New())}
+
+	cmd := jm.Command(&JailedVM{ID: "sb-1"})
+	if cmd.Path != config.JailerBinary {
+		t.Errorf("Path = %s, want %s", cmd.Path, config.JailerBinary)
+	}
+	var separator bool
+	for _, arg := range cmd.Args {
+		switch arg {
+		case "--daemonize":
+			t.Error("jailer daemonizes, so the SDK can't supervise Firecracker")
+		case "--":
+			separator = true
+		case "--api-sock":
+			if !separator {
+				t.Error("--api-sock passed to the jailer instead of Firecracker")
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// Variables kernel arguments may use, as ${name}. They are expanded for
+// each VM when it boots, so networking and agent parameters can be passed
+// on the command line instead of being baked into the rootfs:
+//
+//	ip=${guest_ip}::${gateway}:${netmask}::eth0:off agent.cid=${cid}
+//
+// Variables without a value for a VM, like guest_ip for VMs without CNI
+// networking, expand to nothing.
+const (
+	KernelArgSandboxID = "sandbox_id"
+	KernelArgCID       = "cid"
+	KernelArgGuestIP   = "guest_ip"
+	KernelArgGateway   = "gateway"
+	KernelArgNetmask   = "netmask"
+	KernelArgPrefixLen = "prefix_len"
+	KernelArgGuestMAC  = "guest_mac"
+	KernelArgVcpus     = "vcpus"
+	KernelArgMemoryMB  = "memory_mb"
+	KernelArgAgentPort = "agent_port"
+)
+
+var kernelArgVariables = map[string]bool{
+	KernelArgSandboxID: true,
+	KernelArgCID:       true,
+	KernelArgGuestIP:   true,
+	KernelArgGateway:   true,
+	KernelArgNetmask:   true,
+	KernelArgPrefixLen: true,
+	KernelArgGuestMAC:  true,
+	KernelArgVcpus:     true,
+	KernelArgMemoryMB:  true,
+	KernelArgAgentPort: true,
+}
+
+// ValidateKernelArgs checks that a kernel command line only uses known
+// variables, so a typo fails at startup rather than when a VM boots.
+func ValidateKernelArgs(cmdline string) error {
+	_, err := expandKernelArgs(cmdline, nil)
+	return err
+}
+
+// kernelArgValues returns the values of the kernel argument variables for
+// a VM. Called once the sandbox's network is set up.
+func kernelArgValues(sandbox *domain.Sandbox, config domain.VMConfig) map[string]string {
+	values := map[string]string{
+		KernelArgSandboxID: sandbox.ID,
+		KernelArgCID:       strconv.FormatUint(uint64(sandbox.VsockCID), 10),
+		KernelArgVcpus:     strconv.FormatInt(config.VcpuCount, 10),
+		KernelArgMemoryMB:  strconv.FormatInt(config.MemoryMB, 10),
+		KernelArgAgentPort: strconv.FormatUint(uint64(AgentPort(config)), 10),
+	}
+	if sandbox.IP != nil {
+		values[KernelArgGuestIP] = sandbox.IP.String()
+	}
+	if sandbox.Gateway != nil {
+		values[KernelArgGateway] = sandbox.Gateway.String()
+	}
+	if sandbox.Netmask != nil {
+		values[KernelArgNetmask] = net.IP(sandbox.Netmask).String()
+		ones, _ := sandbox.Netmask.Size()
+		values[KernelArgPrefixLen] = strconv.Itoa(ones)
+	}
+	if sandbox.NetworkNamespace != "" {
+		values[KernelArgGuestMAC] = sandboxMAC(sandbox)
+	}
+	return values
+}
+
+// expandKernelArgs replaces the ${name} variables in a kernel command line
+// with their values. A "$" not followed by "{" is left alone.
+func expandKernelArgs(cmdline string, values map[string]string) (string, error) {
+	var b strings.Builder
+	rest := cmdline
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		b.WriteString(rest[:i])
+		end := strings.IndexByte(rest[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("kernel args: unterminated variable in %q", rest[i:])
+		}
+		name := rest[i+2 : i+end]
+		if !kernelArgVariables[name] {
+			return "", fmt.Errorf("kernel args: unknown variable ${%s} (known: %s)", name, strings.Join(knownKernelArgs(), ", "))
+		}
+		b.WriteString(values[name])
+		rest = rest[i+end+1:]
+	}
+}
+
+func knownKernelArgs() []string {
+	names := make([]string, 0, len(kernelArgVariables))
+	for name := range kernelArgVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestExpandKernelArgs(t *testing.T) {
+	sandbox := domain.NewSandbox("sb1")
+	sandbox.VsockCID = 7
+	sandbox.NetworkNamespace = "/var/run/netns/sb1"
+	sandbox.IP = net.ParseIP("10.88.0.5")
+	sandbox.Netmask = net.CIDRMask(16, 32)
+	sandbox.Gateway = net.ParseIP("10.88.0.1")
+	config := domain.DefaultVMConfig()
+	config.VcpuCount = 2
+	config.MemoryMB = 512
+	values := kernelArgValues(sandbox, config)
+
+	got, err := expandKernelArgs("console=ttyS0 ip=${guest_ip}::${gateway}:${netmask}::eth0:off agent.cid=${cid} mem=${memory_mb}M", values)
+	if err != nil {
+		t.Fatalf("expandKernelArgs() error = %v", err)
+	}
+	want := "console=ttyS0 ip=10.88.0.5::10.88.0.1:255.255.0.0::eth0:off agent.cid=7 mem=512M"
+	if got != want {
+		t.Errorf("expandKernelArgs() = %q, want %q", got, want)
+	}
+
+	got, _ = expandKernelArgs("addr=${guest_ip}/${prefix_len} mac=${guest_mac} port=${agent_port} id=${sandbox_id}", values)
+	want = "addr=10.88.0.5/16 mac=" + guestMAC("sb1") + " port=1024 id=sb1"
+	if got != want {
+		t.Errorf("expandKernelArgs() = %q, want %q", got, want)
+	}
+
+	// Command lines without variables, or with a bare $, are left alone
+	for _, cmdline := range []string{"console=ttyS0 reboot=k", "init=/bin/sh$ x=$1"} {
+		if got, err := expandKernelArgs(cmdline, values); err != nil || got != cmdline {
+			t.Errorf("expandKernelArgs(%q) = %q, %v", cmdline, got, err)
+		}
+	}
+}
+
+func TestExpandKernelArgs_NoNetwork(t *testing.T) {
+	sandbox := domain.NewSandbox("sb1")
+	got, err := expandKernelArgs("ip=${guest_ip} mac=${guest_mac}", kernelArgValues(sandbox, domain.DefaultVMConfig()))
+	if err != nil {
+		t.Fatalf("expandKernelArgs() error = %v", err)
+	}
+	if got != "ip= mac=" {
+		t.Errorf("expandKernelArgs() without networking = %q, want empty values", got)
+	}
+}
+
+func TestValidateKernelArgs(t *testing.T) {
+	if err := ValidateKernelArgs("console=ttyS0 agent.cid=${cid}"); err != nil {
+		t.Errorf("ValidateKernelArgs() error = %v", err)
+	}
+	err := ValidateKernelArgs("ip=${guest_addr}")
+	if err == nil || !strings.Contains(err.Error(), "${guest_addr}") {
+		t.Errorf("ValidateKernelArgs() with an unknown variable error = %v", err)
+	}
+	if err := ValidateKernelArgs("ip=${guest_ip"); err == nil {
+		t.Error("ValidateKernelArgs() with an unterminated variable should fail")
+	}
+}
@@ -0,0 +1,286 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// A kernel built without virtio_blk, virtio_net, vsock or overlayfs boots,
+// but its VMs fail later in ways that are hard to trace back to it. The
+// first VM booted from each kernel is asked by its agent which features the
+// kernel has; the answer is recorded for the kernel's path, size and
+// modification time, so a replaced kernel is checked again without hashing
+// it on every boot. VMs of a kernel that lacks a required feature are
+// refused before they boot, so the pool never fills with them.
+
+// StageKernelCheck is the startup stage checking a new kernel's features.
+const StageKernelCheck = "kernel_check"
+
+// Kernel features the agent reports.
+const (
+	KernelFeatureVirtioBlk = "virtio_blk"
+	KernelFeatureVirtioNet = "virtio_net"
+	KernelFeatureVsock     = "vsock"
+	KernelFeatureOverlay   = "overlay"
+)
+
+// KnownKernelFeatures are the features that can be required.
+var KnownKernelFeatures = []string{
+	KernelFeatureVirtioBlk, KernelFeatureVirtioNet, KernelFeatureVsock, KernelFeatureOverlay,
+}
+
+// ErrKernelFeatures is returned for VMs of kernels that lack a required
+// feature.
+var ErrKernelFeatures = errors.New("kernel lacks required features")
+
+// KernelCheckConfig configures the check of the kernels VMs boot.
+type KernelCheckConfig struct {
+	// Required are the features a kernel must have, from
+	// KnownKernelFeatures. Empty disables the check.
+	Required []string
+
+	// Dir records the features of each kernel checked.
+	Dir string
+}
+
+// DefaultKernelCheckConfig returns the default kernel check, requiring
+// every known feature.
+func DefaultKernelCheckConfig() KernelCheckConfig {
+	return KernelCheckConfig{
+		Required: append([]string(nil), KnownKernelFeatures...),
+		Dir:      "/var/lib/fc-cri/kernel-features",
+	}
+}
+
+// ValidateKernelFeatures checks a list of required kernel features.
+func ValidateKernelFeatures(features []string) error {
+	for _, f := range features {
+		if !containsString(KnownKernelFeatures, f) {
+			return fmt.Errorf("unknown kernel feature %q (must be one of %s)", f, strings.Join(KnownKernelFeatures, ", "))
+		}
+	}
+	return nil
+}
+
+// Validate checks the kernel check configuration.
+func (c KernelCheckConfig) Validate() error {
+	if err := ValidateKernelFeatures(c.Required); err != nil {
+		return err
+	}
+	if len(c.Required) > 0 && c.Dir == "" {
+		return fmt.Errorf("the kernel check needs a directory to record kernels in")
+	}
+	return nil
+}
+
+// KernelRecord is what the check found about a kernel.
+type KernelRecord struct {
+	Path      string    `json:"path"`
+	Version   string    `json:"version"` // Size and modification time
+	Release   string    `json:"release"`
+	Features  []string  `json:"features"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Missing returns the required features the kernel lacks.
+func (r *KernelRecord) Missing(required []string) []string {
+	var missing []string
+	for _, f := range required {
+		if !containsString(r.Features, f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// kernelChecker records the features of the kernels VMs boot.
+type kernelChecker struct {
+	config KernelCheckConfig
+	log    *logrus.Entry
+
+	mu      sync.Mutex
+	records map[string]*KernelRecord // by kernelKey
+}
+
+func newKernelChecker(config KernelCheckConfig, log *logrus.Entry) *kernelChecker {
+	return &kernelChecker{
+		config:  config,
+		log:     log,
+		records: make(map[string]*KernelRecord),
+	}
+}
+
+// kernelKey identifies a kernel file as of its size and modification time.
+func kernelKey(path string) (key, version string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to stat kernel: %w", err)
+	}
+	version = fmt.Sprintf("size=%d mtime=%d", info.Size(), info.ModTime().UnixNano())
+	sum := sha256.Sum256([]byte(path + "\x00" + version))
+	return hex.EncodeToString(sum[:]), version, nil
+}
+
+// lookup returns a kernel's key and its record, nil if it hasn't been
+// checked yet.
+func (k *kernelChecker) lookup(path string) (string, *KernelRecord, error) {
+	key, _, err := kernelKey(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if record, ok := k.records[key]; ok {
+		return key, record, nil
+	}
+	data, err := os.ReadFile(k.recordPath(key))
+	if os.IsNotExist(err) {
+		return key, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read kernel record: %w", err)
+	}
+	var record KernelRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		// Checked again, and the record rewritten
+		k.log.WithError(err).WithField("kernel", path).Warn("Ignoring unreadable kernel record")
+		return key, nil, nil
+	}
+	k.records[key] = &record
+	return key, &record, nil
+}
+
+// admit refuses a kernel recorded to lack required features. A kernel not
+// checked yet is admitted, for its first VM to check it.
+func (k *kernelChecker) admit(path string) error {
+	if k == nil || len(k.config.Required) == 0 || path == "" {
+		return nil
+	}
+	_, record, err := k.lookup(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // Booting reports the missing kernel
+	}
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return nil
+	}
+	if missing := record.Missing(k.config.Required); len(missing) > 0 {
+		return fmt.Errorf("%w: kernel %s (%s) has no %s", ErrKernelFeatures, path, record.Release, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// record stores the features a kernel's first VM reported.
+func (k *kernelChecker) record(key string, record *KernelRecord) error {
+	sort.Strings(record.Features)
+	k.mu.Lock()
+	k.records[key] = record
+	k.mu.Unlock()
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(k.config.Dir, 0755); err != nil {
+		return err
+	}
+	// Written whole, for the shims of the node to read
+	tmp := k.recordPath(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.recordPath(key))
+}
+
+func (k *kernelChecker) recordPath(key string) string {
+	return filepath.Join(k.config.Dir, key+".json")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKernel asks the agent of a VM booted from a kernel that hasn't been
+// checked yet for the kernel's features, and records them. A kernel that
+// lacks a required feature fails the VM's startup, and later VMs of it are
+// refused by admit. Agents without the kernel_features feature can't tell;
+// their kernels stay unchecked.
+func (m *Manager) checkKernel(ctx context.Context, sandbox *domain.Sandbox) error {
+	k := m.kernels
+	path := sandbox.VMConfig.KernelPath
+	if k == nil || len(k.config.Required) == 0 || path == "" {
+		return nil
+	}
+	key, record, err := k.lookup(path)
+	if err != nil {
+		return &StartupError{SandboxID: sandbox.ID, Stage: StageKernelCheck, Attempts: 1, Err: err}
+	}
+	log := m.log.WithFields(logrus.Fields{"sandbox_id": sandbox.ID, "kernel": path})
+
+	if record == nil {
+		startup := m.config.Startup
+		client := agent.NewClient(log)
+		client.SetAuthKey(sandbox.AgentKey)
+		err := runStage(ctx, sandbox.ID, StageAgentConnect, startup.AgentAttempts, startup.RetryDelay, m.log,
+			func() error {
+				connectCtx, cancel := context.WithTimeout(ctx, startup.AgentTimeout)
+				defer cancel()
+				return client.Connect(connectCtx, sandbox.VsockPath, sandbox.VsockCID, AgentPort(sandbox.VMConfig))
+			}, nil)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if !client.Supports(agent.FeatureKernel) {
+			log.Warn("Guest agent can't report kernel features, kernel left unchecked")
+			return nil
+		}
+		features, err := client.GetKernelFeatures(ctx)
+		if err != nil {
+			return &StartupError{SandboxID: sandbox.ID, Stage: StageKernelCheck, Attempts: 1, Err: err}
+		}
+		_, version, _ := kernelKey(path)
+		record = &KernelRecord{
+			Path:      path,
+			Version:   version,
+			Release:   features.Release,
+			Features:  features.Features,
+			CheckedAt: time.Now(),
+		}
+		if err := k.record(key, record); err != nil {
+			log.WithError(err).Warn("Failed to save kernel record, the kernel is checked again by the next shim")
+		}
+		log.WithFields(logrus.Fields{
+			"release":  record.Release,
+			"features": record.Features,
+		}).Info("Checked kernel features")
+	}
+
+	if missing := record.Missing(k.config.Required); len(missing) > 0 {
+		return &StartupError{SandboxID: sandbox.ID, Stage: StageKernelCheck, Attempts: 1,
+			Err: fmt.Errorf("%w: kernel %s (%s) has no %s", ErrKernelFeatures, path, record.Release, strings.Join(missing, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestKernelCheckConfigValidate(t *testing.T) {
+	if err := DefaultKernelCheckConfig().Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	if err := (KernelCheckConfig{}).Validate(); err != nil {
+		t.Errorf("disabled check: %v", err)
+	}
+	if err := (KernelCheckConfig{Required: []string{"btrfs"}, Dir: "/tmp"}).Validate(); err == nil {
+		t.Error("unknown feature accepted")
+	}
+	if err := (KernelCheckConfig{Required: []string{KernelFeatureVsock}}).Validate(); err == nil {
+		t.Error("check without a directory accepted")
+	}
+}
+
+func TestKernelChecker(t *testing.T) {
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "vmlinux")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := KernelCheckConfig{Required: KnownKernelFeatures, Dir: filepath.Join(dir, "records")}
+	k := newKernelChecker(config, logrus.NewEntry(logrus.New()))
+
+	// Unchecked kernels boot, for their first VM to check them
+	key, record, err := k.lookup(kernel)
+	if err != nil || record != nil {
+		t.Fatalf("lookup() = %v, %v; want no record", record, err)
+	}
+	if err := k.admit(kernel); err != nil {
+		t.Errorf("admit() unchecked kernel: %v", err)
+	}
+
+	err = k.record(key, &KernelRecord{Path: kernel, Release: "6.1.102", Features: []string{"vsock", "virtio_net", "virtio_blk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.admit(kernel); !errors.Is(err, ErrKernelFeatures) {
+		t.Errorf("admit() kernel without overlay = %v, want ErrKernelFeatures", err)
+	}
+
+	// The record is shared with the other shims of the node
+	other := newKernelChecker(config, logrus.NewEntry(logrus.New()))
+	_, shared, err := other.lookup(kernel)
+	if err != nil || shared == nil || shared.Release != "6.1.102" {
+		t.Fatalf("lookup() by another checker = %+v, %v", shared, err)
+	}
+	if missing := shared.Missing(KnownKernelFeatures); len(missing) != 1 || missing[0] != KernelFeatureOverlay {
+		t.Errorf("Missing() = %v, want [overlay]", missing)
+	}
+	relaxed := newKernelChecker(KernelCheckConfig{Required: []string{KernelFeatureVsock}, Dir: config.Dir}, logrus.NewEntry(logrus.New()))
+	if err := relaxed.admit(kernel); err != nil {
+		t.Errorf("admit() without overlay required: %v", err)
+	}
+
+	// A replaced kernel is checked again
+	if err := os.WriteFile(kernel, []byte("rebuilt kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(kernel, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.admit(kernel); err != nil {
+		t.Errorf("admit() replaced kernel: %v", err)
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/trace"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,6 +31,35 @@ type Manager struct {
 	// Locks for individual sandboxes to prevent concurrent state changes
 	sandboxMu    sync.Mutex
 	sandboxLocks map[string]*sync.Mutex
+
+	// Fault injection for resilience testing (nil when disabled)
+	chaos *chaos
+
+	// Launches VMs in a chroot (nil when the jailer is disabled)
+	jailer *JailerManager
+
+	// Allocates the rootfs layers
+	prealloc *preallocator
+
+	// Sets up CNI networking for VMs (nil boots them without a network)
+	network domain.NetworkService
+
+	// Sandboxes whose network setup timed out, by ID (see pendingnet.go)
+	pendingNetworks map[string]*pendingNetwork
+
+	// Done once the manager is closed, which stops its background work
+	ctx        context.Context
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+
+	// Called when a VMM exits unexpectedly (see OnVMMExit)
+	exitHandlers []func(sandbox *domain.Sandbox)
+
+	// Where destroyed VMs' usage is recorded (nil when not recorded)
+	usage UsageSink
+
+	// Features of the kernels VMs boot
+	kernels *kernelChecker
 }
 
 // ManagerConfig holds configuration for the VM manager.
@@ -37,6 +70,10 @@ type ManagerConfig struct {
 	// RuntimeDir is the directory for runtime state (sockets, etc.).
 	RuntimeDir string
 
+	// RuntimeDirClasses are other bases for sandbox directories, by class
+	// name, which VM configs select with RuntimeDirClass.
+	RuntimeDirClasses map[string]string
+
 	// DefaultKernelPath is the default kernel to use.
 	DefaultKernelPath string
 
@@ -48,6 +85,63 @@ type ManagerConfig struct {
 
 	// EnableJailer controls whether to use the jailer.
 	EnableJailer bool
+
+	// Jailer configures the chroot, user and cgroups of jailed VMs. Its
+	// Enabled and binary paths are taken from the fields above.
+	Jailer JailerConfig
+
+	// Chaos configures fault injection for testing. Disabled by default.
+	Chaos ChaosConfig
+
+	// FDLimits configures per-VMM file descriptor limits and admission.
+	FDLimits FDLimitConfig
+
+	// RootfsCoW configures the per-sandbox writable rootfs layers.
+	RootfsCoW RootfsCoWConfig
+
+	// Prealloc configures how the rootfs layers are allocated.
+	Prealloc PreallocConfig
+
+	// Agent configures the guest agent through the kernel command line.
+	Agent AgentBootConfig
+
+	// CPUTemplates configures the CPU templates VMs boot with.
+	CPUTemplates CPUTemplateConfig
+
+	// Seccomp selects the seccomp filters Firecracker runs with.
+	Seccomp SeccompConfig
+
+	// Cgroup configures the per-sandbox cgroup each VMM runs in.
+	Cgroup CgroupConfig
+
+	// DevMode runs VMs as agent processes, on hosts without KVM.
+	DevMode DevModeConfig
+
+	// DefaultNetRateLimit limits the network traffic of VMs that don't set
+	// their own limit. nil leaves it unlimited.
+	DefaultNetRateLimit *domain.NetRateLimit
+
+	// Startup configures the retries of the stages of bringing up a VM.
+	Startup StartupConfig
+
+	// GuestShutdownTimeout is how long the agent of a VM being stopped
+	// gets to stop its containers before the guest's filesystems are
+	// synced and the VMM shut down. Zero stops VMs without asking the
+	// agent.
+	GuestShutdownTimeout time.Duration
+
+	// CaptureVMMLogs routes Firecracker's own log into the manager's
+	// logger, tagged component=vmm, instead of the stdout it shares with
+	// the shim.
+	CaptureVMMLogs bool
+
+	// UsageSink is where the usage of destroyed VMs is recorded, for
+	// chargeback: a JSON lines file or an http(s) URL (see NewUsageSink).
+	// Empty records nothing.
+	UsageSink string
+
+	// KernelCheck refuses kernels that lack features the runtime needs.
+	KernelCheck KernelCheckConfig
 }
 
 // DefaultManagerConfig returns a sensible default configuration.
@@ -59,6 +153,18 @@ func DefaultManagerConfig() ManagerConfig {
 		DefaultKernelArgs: "console=ttyS0 reboot=k panic=1 pci=off quiet",
 		JailerBinary:      "/usr/bin/jailer",
 		EnableJailer:      false, // Start simple, add jailer later
+		Jailer:            DefaultJailerConfig(),
+		FDLimits:          DefaultFDLimitConfig(),
+		RootfsCoW:         DefaultRootfsCoWConfig(),
+		Prealloc:          DefaultPreallocConfig(),
+		Agent:             DefaultAgentBootConfig(),
+		CPUTemplates:      DefaultCPUTemplateConfig(),
+		Cgroup:            DefaultCgroupConfig(),
+		DevMode:           DefaultDevModeConfig(),
+		Startup:           DefaultStartupConfig(),
+		KernelCheck:       DefaultKernelCheckConfig(),
+
+		GuestShutdownTimeout: DefaultGuestShutdownTimeout,
 	}
 }
 
@@ -69,13 +175,99 @@ func NewManager(config ManagerConfig, log *logrus.Entry) (*Manager, error) {
 		return nil, fmt.Errorf("failed to create runtime dir: %w", err)
 	}
 
-	return &Manager{
+	if err := ValidateRuntimeDirClasses(config.RuntimeDirClasses); err != nil {
+		return nil, err
+	}
+	for name, base := range config.RuntimeDirClasses {
+		if err := os.MkdirAll(base, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create runtime dir of class %s: %w", name, err)
+		}
+	}
+	if err := config.Seccomp.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Prealloc.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Agent.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.KernelCheck.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateKernelArgs(config.DefaultKernelArgs); err != nil {
+		return nil, err
+	}
+
+	// Dev VMs are plain processes: there is no VMM to jail or limit
+	if config.DevMode.Enabled {
+		if config.EnableJailer {
+			return nil, fmt.Errorf("the jailer can't be used in dev mode")
+		}
+		if err := config.DevMode.validate(); err != nil {
+			return nil, err
+		}
+		config.Cgroup.Enabled = false
+		log.WithField("component", "vm-manager").Warn("Dev mode enabled: VMs run as unisolated host processes")
+	}
+
+	m := &Manager{
 		config:       config,
 		log:          log.WithField("component", "vm-manager"),
 		sandboxes:    make(map[string]*domain.Sandbox),
 		cidCounter:   3, // CIDs start at 3 (0=hypervisor, 1=reserved, 2=host)
 		sandboxLocks: make(map[string]*sync.Mutex),
-	}, nil
+		chaos:        newChaos(config.Chaos, log),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.prealloc = newPreallocator(config.Prealloc, m.log)
+	m.kernels = newKernelChecker(config.KernelCheck, m.log)
+	if config.UsageSink != "" {
+		sink, err := NewUsageSink(config.UsageSink)
+		if err != nil {
+			return nil, err
+		}
+		m.usage = sink
+	}
+	if mode := config.RootfsCoW.Mode; mode != "" && mode != RootfsCoWNone {
+		m.prealloc.check(config.RootfsCoW.Dir, VolumeTypeRootfs)
+	}
+
+	// VMs still run without cgroups on hosts that can't provide them
+	if config.Cgroup.Enabled {
+		if err := config.Cgroup.initCgroups(); err != nil {
+			m.log.WithError(err).Warn("Per-VM cgroups unavailable, VMs run without host resource limits")
+			m.config.Cgroup.Enabled = false
+		}
+	}
+
+	if config.EnableJailer {
+		jailerConfig := config.Jailer
+		jailerConfig.Enabled = true
+		jailerConfig.JailerBinary = config.JailerBinary
+		jailerConfig.FirecrackerBinary = config.FirecrackerBinary
+		jailerConfig.Seccomp = config.Seccomp
+		if config.Cgroup.Parent != "" {
+			jailerConfig.CgroupParent = config.Cgroup.Parent
+		}
+		jailer, err := NewJailerManager(jailerConfig, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up jailer: %w", err)
+		}
+		m.jailer = jailer
+	}
+
+	return m, nil
+}
+
+// Close stops the manager's background work and waits for it to end.
+// Networks still pending after a CNI plugin timeout are torn down; VMs are
+// left running.
+func (m *Manager) Close() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.background.Wait()
 }
 
 // getSandboxLock gets a mutex for a specific sandbox ID.
@@ -88,11 +280,66 @@ func (m *Manager) getSandboxLock(id string) *sync.Mutex {
 	return m.sandboxLocks[id]
 }
 
-// CreateVM creates and starts a new Firecracker microVM.
+// withDefaults fills in the manager's default kernel, agent parameters, CPU
+// template and network rate limit for a VM config.
+func (m *Manager) withDefaults(config domain.VMConfig) domain.VMConfig {
+	if config.KernelPath == "" {
+		config.KernelPath = m.config.DefaultKernelPath
+	}
+	if config.KernelArgs == "" {
+		config.KernelArgs = m.config.DefaultKernelArgs
+	}
+	config.KernelArgs = withAgentArgs(config.KernelArgs, m.config.Agent)
+	if config.CPUTemplate == "" {
+		config.CPUTemplate = m.config.CPUTemplates.Default
+	}
+	if config.NetRateLimit == nil {
+		config.NetRateLimit = m.config.DefaultNetRateLimit
+	}
+	return config
+}
+
+// CreateVM creates and starts a new Firecracker microVM. A VM with CNI
+// networking is brought up in stages (see startup.go); a failure is a
+// *StartupError naming the stage. Creations that fail transiently are
+// torn down and tried again with a fresh sandbox ID, with backoff.
 func (m *Manager) CreateVM(ctx context.Context, config domain.VMConfig) (*domain.Sandbox, error) {
-	// Generate unique sandbox ID
-	sandboxID := generateID()
-	sandbox := domain.NewSandbox(sandboxID)
+	return createWithRetry(ctx, m.config.Startup, m.log, func() (*domain.Sandbox, error) {
+		return m.createVM(ctx, config)
+	})
+}
+
+func (m *Manager) createVM(ctx context.Context, config domain.VMConfig) (_ *domain.Sandbox, err error) {
+	createStart := time.Now()
+	if err := m.chaos.createFault(); err != nil {
+		return nil, err
+	}
+
+	// Each VMM holds FDs for its sockets, drives and taps; refuse new VMs
+	// before the node runs out rather than failing randomly later
+	if err := m.CheckAdmission(); err != nil {
+		metrics.Global().RecordFDAdmissionReject()
+		return nil, err
+	}
+
+	// A sandbox whose network setup timed out and was completed in the
+	// background is reused: CNI knows its network by its ID
+	sandbox, err := m.takePendingNetwork(config)
+	if err != nil {
+		return nil, err
+	}
+	if sandbox == nil {
+		sandbox = domain.NewSandbox(generateID())
+	} else {
+		// Failures before the network would have been set up must not
+		// leak the adopted one's namespace, lease and MACs
+		defer func() {
+			if err != nil {
+				m.teardownNetwork(ctx, sandbox)
+			}
+		}()
+	}
+	sandboxID := sandbox.ID
 
 	m.log.WithField("sandbox_id", sandboxID).Info("Creating VM")
 
@@ -103,28 +350,51 @@ func (m *Manager) CreateVM(ctx context.Context, config domain.VMConfig) (*domain
 	m.mu.Unlock()
 
 	// Setup paths
-	sandboxDir := filepath.Join(m.config.RuntimeDir, sandboxID)
-	if err := os.MkdirAll(sandboxDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create sandbox dir: %w", err)
+	sandboxDir, err := m.makeSandboxDir(sandbox, config.RuntimeDirClass)
+	if err != nil {
+		return nil, err
 	}
+	// Failed attempts remove their sandbox dir, and the trace with it
+	defer func() {
+		trace.Record(sandboxDir, trace.PhaseVMCreate, createStart, err)
+	}()
 
 	socketPath := filepath.Join(sandboxDir, "firecracker.sock")
 	vsockPath := filepath.Join(sandboxDir, "vsock.sock")
 	sandbox.VsockPath = vsockPath
 
-	// Apply defaults
-	if config.KernelPath == "" {
-		config.KernelPath = m.config.DefaultKernelPath
+	config = m.withDefaults(config)
+
+	if m.config.DevMode.Enabled {
+		return m.createDevVM(sandbox, config)
 	}
-	if config.KernelArgs == "" {
-		config.KernelArgs = m.config.DefaultKernelArgs
+
+	// Kernels found to lack required features are refused before booting
+	if err := m.kernels.admit(config.KernelPath); err != nil {
+		removeSandboxDir(sandboxDir)
+		return nil, err
+	}
+
+	// The VM boots with the tap CNI creates
+	networkStart := time.Now()
+	err = m.setupNetwork(ctx, sandbox, config)
+	trace.Record(sandboxDir, trace.PhaseNetwork, networkStart, err)
+	if err != nil {
+		removeSandboxDir(sandboxDir)
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			m.teardownNetwork(ctx, sandbox)
+		}
+	}()
 
 	// Build Firecracker configuration
 	fcConfig := firecracker.Config{
 		SocketPath:      socketPath,
 		KernelImagePath: config.KernelPath,
 		KernelArgs:      config.KernelArgs,
+		InitrdPath:      config.InitrdPath,
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:  firecracker.Int64(config.VcpuCount),
 			MemSizeMib: firecracker.Int64(config.MemoryMB),
@@ -137,33 +407,129 @@ func (m *Manager) CreateVM(ctx context.Context, config domain.VMConfig) (*domain
 				CID:  uint32(sandbox.VsockCID),
 			},
 		},
+		// The SDK runs Firecracker with --no-seccomp unless told otherwise
+		Seccomp: m.config.Seccomp.sdkConfig(),
+	}
+	attachNetwork(sandbox, &fcConfig)
+	// Only now are the sandbox's address and CID known
+	if fcConfig.KernelArgs, err = expandKernelArgs(fcConfig.KernelArgs, kernelArgValues(sandbox, config)); err != nil {
+		removeSandboxDir(sandboxDir)
+		return nil, err
+	}
+	if m.config.CaptureVMMLogs {
+		captureVMMLog(sandboxDir, sandboxID, m.log, &fcConfig)
+	}
+
+	// Only holders of the VM's key may talk to its agent
+	if m.config.Agent.Auth {
+		key, err := issueAgentKey(sandboxDir)
+		if err != nil {
+			removeSandboxDir(sandboxDir)
+			return nil, err
+		}
+		sandbox.AgentKey = key
+		fcConfig.KernelArgs += " " + agentKeyArg(key)
 	}
 
-	// Add root drive if specified
+	// Add root drive if specified, writing to a layer of its own
 	if config.RootDrive.PathOnHost != "" {
+		rootfsStart := time.Now()
+		rootfsPath, overlayPath, err := m.prepareRootfs(sandbox, config.RootDrive)
+		trace.Record(sandboxDir, trace.PhaseRootfsAttach, rootfsStart, err)
+		if err != nil {
+			removeSandboxDir(sandboxDir)
+			return nil, err
+		}
 		fcConfig.Drives = []models.Drive{
 			{
 				DriveID:      firecracker.String(config.RootDrive.DriveID),
-				PathOnHost:   firecracker.String(config.RootDrive.PathOnHost),
+				PathOnHost:   firecracker.String(rootfsPath),
 				IsRootDevice: firecracker.Bool(config.RootDrive.IsRoot),
-				IsReadOnly:   firecracker.Bool(config.RootDrive.IsReadOnly),
+				IsReadOnly:   firecracker.Bool(config.RootDrive.IsReadOnly || overlayPath != ""),
 			},
 		}
+		// Read-only root images are written through an overlay
+		if overlayPath != "" {
+			fcConfig.Drives = append(fcConfig.Drives, models.Drive{
+				DriveID:      firecracker.String(overlayDriveID),
+				PathOnHost:   firecracker.String(overlayPath),
+				IsRootDevice: firecracker.Bool(false),
+				IsReadOnly:   firecracker.Bool(false),
+			})
+			fcConfig.KernelArgs += " " + overlayArg + overlayDevice
+		}
+	}
+
+	// Expose the metadata service if requested
+	if config.MMDS != nil {
+		if err := m.configureMMDS(ctx, sandboxID, config.MMDS, &fcConfig); err != nil {
+			m.releaseRootfs(sandbox)
+			removeSandboxDir(sandboxDir)
+			return nil, err
+		}
+	}
+	applyNetRateLimit(config.NetRateLimit, &fcConfig)
+
+	cpuTemplateOpts, err := m.applyCPUTemplate(config.CPUTemplate, &fcConfig)
+	if err != nil {
+		m.releaseRootfs(sandbox)
+		m.releaseMMDS(sandboxID, config.MMDS)
+		removeSandboxDir(sandboxDir)
+		return nil, err
 	}
 
 	// Create the machine
 	machineOpts := []firecracker.Opt{
-		firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())),
+		firecracker.WithLogger(m.log.WithField("sandbox_id", sandboxID)),
+	}
+	machineOpts = append(machineOpts, cpuTemplateOpts...)
+	machineOpts = append(machineOpts, balloonOpts(config)...)
+
+	// Run Firecracker in a chroot, as an unprivileged user
+	if m.jailer != nil {
+		jailerOpt, err := m.jail(ctx, sandbox, config, &fcConfig)
+		if err != nil {
+			m.releaseRootfs(sandbox)
+			m.releaseMMDS(sandboxID, config.MMDS)
+			removeSandboxDir(sandboxDir)
+			return nil, fmt.Errorf("failed to jail VM: %w", err)
+		}
+		machineOpts = append(machineOpts, jailerOpt)
+		config.JailerEnabled = true
 	}
 
+	// Limit and account the VMM's host resources
+	if err := m.createCgroup(sandboxID, config); err != nil {
+		m.releaseJail(ctx, sandboxID, config)
+		m.releaseRootfs(sandbox)
+		m.releaseMMDS(sandboxID, config.MMDS)
+		m.removeCgroup(sandboxID, config)
+		return nil, err
+	}
+	machineOpts = append(machineOpts, m.cgroupOpts(sandboxID, config)...)
+
 	machine, err := firecracker.NewMachine(ctx, fcConfig, machineOpts...)
 	if err != nil {
+		m.removeCgroup(sandboxID, config)
+		m.releaseJail(ctx, sandboxID, config)
+		m.releaseRootfs(sandbox)
+		m.releaseMMDS(sandboxID, config.MMDS)
 		return nil, fmt.Errorf("failed to create machine: %w", err)
 	}
 
 	// Start the VM
-	if err := machine.Start(ctx); err != nil {
-		return nil, fmt.Errorf("failed to start machine: %w", err)
+	bootStart := time.Now()
+	err = machine.Start(ctx)
+	trace.Record(sandboxDir, trace.PhaseBoot, bootStart, err)
+	if err != nil {
+		_ = machine.StopVMM()
+		m.removeCgroup(sandboxID, config)
+		m.releaseJail(ctx, sandboxID, config)
+		m.releaseRootfs(sandbox)
+		m.releaseMMDS(sandboxID, config.MMDS)
+		// A retry starts over in a sandbox dir of its own
+		removeSandboxDir(sandboxDir)
+		return nil, &StartupError{SandboxID: sandboxID, Stage: StageVMBoot, Attempts: 1, Err: err}
 	}
 
 	// Update sandbox state
@@ -171,6 +537,14 @@ func (m *Manager) CreateVM(ctx context.Context, config domain.VMConfig) (*domain
 	sandbox.VMConfig = config
 	pid, _ := machine.PID()
 	sandbox.PID = pid
+	// For fcctl, which inspects the VMM process
+	pidFile := filepath.Join(sandboxDir, "firecracker.pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to write VMM pid file")
+	}
+	if err := m.applyVMMFDLimit(pid); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to set VMM file descriptor limit")
+	}
 	sandbox.State = domain.SandboxReady
 	sandbox.StartedAt = time.Now()
 
@@ -179,6 +553,24 @@ func (m *Manager) CreateVM(ctx context.Context, config domain.VMConfig) (*domain
 	m.sandboxes[sandboxID] = sandbox
 	m.mu.Unlock()
 
+	m.recordFDUsage()
+	go m.watchVMM(sandbox)
+
+	// Only now does eth0 exist in the guest
+	guestNetworkStart := time.Now()
+	err = m.pushGuestNetwork(ctx, sandbox)
+	trace.Record(sandboxDir, trace.PhaseGuestNetwork, guestNetworkStart, err)
+	if err != nil {
+		_ = m.DestroyVM(ctx, sandbox)
+		return nil, err
+	}
+
+	// The first VM of a kernel checks it has the features VMs need
+	if err := m.checkKernel(ctx, sandbox); err != nil {
+		_ = m.DestroyVM(ctx, sandbox)
+		return nil, err
+	}
+
 	m.log.WithFields(logrus.Fields{
 		"sandbox_id": sandboxID,
 		"pid":        sandbox.PID,
@@ -200,10 +592,30 @@ func (m *Manager) StopVM(ctx context.Context, sandbox *domain.Sandbox) error {
 func (m *Manager) stopVM(ctx context.Context, sandbox *domain.Sandbox) error {
 	m.log.WithField("sandbox_id", sandbox.ID).Info("Stopping VM")
 
+	if m.config.DevMode.Enabled {
+		return m.stopDevVM(sandbox)
+	}
 	if sandbox.VM == nil {
 		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
 	}
 
+	// Containers get to exit and the guest to flush its writes first
+	if err := m.quiesceGuest(ctx, sandbox); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to shut down guest agent, stopping VM anyway")
+	}
+
+	// Recovered VMs were not started by this process, so the SDK cannot
+	// signal or wait on them. Fall back to the recorded PID.
+	if sandbox.Recovered {
+		_ = sandbox.VM.Shutdown(ctx)
+		if err := stopProcess(sandbox.PID, 10*time.Second); err != nil {
+			m.log.WithError(err).Warn("Failed to stop recovered VM")
+		}
+		sandbox.State = domain.SandboxStopped
+		sandbox.FinishedAt = time.Now()
+		return nil
+	}
+
 	// Try graceful shutdown first
 	if err := sandbox.VM.Shutdown(ctx); err != nil {
 		m.log.WithError(err).Warn("Graceful shutdown failed, forcing stop")
@@ -232,6 +644,9 @@ func (m *Manager) DestroyVM(ctx context.Context, sandbox *domain.Sandbox) error
 
 	m.log.WithField("sandbox_id", sandbox.ID).Info("Destroying VM")
 
+	// The guest's usage can only be read while it runs
+	guest := m.guestUsage(ctx, sandbox)
+
 	// Stop the VM if running
 	if sandbox.State == domain.SandboxReady {
 		if err := m.stopVM(ctx, sandbox); err != nil {
@@ -239,6 +654,9 @@ func (m *Manager) DestroyVM(ctx context.Context, sandbox *domain.Sandbox) error
 		}
 	}
 
+	// The host's, until its cgroup and tap are removed
+	m.recordUsage(ctx, sandbox, guest)
+
 	// Close agent connection if open
 	if sandbox.AgentConn != nil {
 		sandbox.AgentConn.Close()
@@ -246,9 +664,14 @@ func (m *Manager) DestroyVM(ctx context.Context, sandbox *domain.Sandbox) error
 
 	// Clean up sandbox directory
 	sandboxDir := filepath.Join(m.config.RuntimeDir, sandbox.ID)
-	if err := os.RemoveAll(sandboxDir); err != nil {
+	if err := removeSandboxDir(sandboxDir); err != nil {
 		m.log.WithError(err).Warn("Failed to clean up sandbox directory")
 	}
+	m.removeCgroup(sandbox.ID, sandbox.VMConfig)
+	m.releaseJail(ctx, sandbox.ID, sandbox.VMConfig)
+	m.releaseRootfs(sandbox)
+	m.releaseMMDS(sandbox.ID, sandbox.VMConfig.MMDS)
+	m.teardownNetwork(ctx, sandbox)
 
 	// Remove from tracking
 	m.mu.Lock()
@@ -260,6 +683,8 @@ func (m *Manager) DestroyVM(ctx context.Context, sandbox *domain.Sandbox) error
 	delete(m.sandboxLocks, sandbox.ID)
 	m.sandboxMu.Unlock()
 
+	m.recordFDUsage()
+
 	return nil
 }
 
@@ -269,6 +694,9 @@ func (m *Manager) PauseVM(ctx context.Context, sandbox *domain.Sandbox) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if m.config.DevMode.Enabled {
+		return signalDevVM(sandbox, syscall.SIGSTOP)
+	}
 	if sandbox.VM == nil {
 		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
 	}
@@ -281,12 +709,78 @@ func (m *Manager) ResumeVM(ctx context.Context, sandbox *domain.Sandbox) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if m.config.DevMode.Enabled {
+		return signalDevVM(sandbox, syscall.SIGCONT)
+	}
 	if sandbox.VM == nil {
 		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
 	}
 	return sandbox.VM.ResumeVM(ctx)
 }
 
+// AdoptVM re-attaches to a VM that is still running from a previous shim
+// process. The sandbox must carry the ID, PID, vsock CID and VM config that
+// were recorded when the VM was created.
+func (m *Manager) AdoptVM(ctx context.Context, sandbox *domain.Sandbox) error {
+	if !processAlive(sandbox.PID) {
+		return fmt.Errorf("sandbox %s: VMM process %d is not running", sandbox.ID, sandbox.PID)
+	}
+	if m.config.DevMode.Enabled {
+		return m.adoptDevVM(sandbox)
+	}
+
+	socketPath := filepath.Join(m.config.RuntimeDir, sandbox.ID, "firecracker.sock")
+	if sandbox.VMConfig.JailerEnabled {
+		if m.jailer == nil {
+			return fmt.Errorf("sandbox %s was jailed, but the jailer is disabled", sandbox.ID)
+		}
+		socketPath = GetJailedSocketPath(m.jailer.config.ChrootBaseDir, sandbox.ID)
+		m.jailer.adoptJailedVM(sandbox.ID)
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		return fmt.Errorf("sandbox %s: API socket missing: %w", sandbox.ID, err)
+	}
+
+	// The machine is never started; it only provides an API client bound
+	// to the existing socket.
+	machine, err := firecracker.NewMachine(ctx, firecracker.Config{
+		SocketPath:        socketPath,
+		DisableValidation: true,
+	}, firecracker.WithLogger(m.log.WithField("sandbox_id", sandbox.ID)))
+	if err != nil {
+		return fmt.Errorf("failed to attach to VM: %w", err)
+	}
+
+	if _, err := machine.DescribeInstanceInfo(ctx); err != nil {
+		return fmt.Errorf("sandbox %s: API not responding: %w", sandbox.ID, err)
+	}
+
+	sandbox.VM = machine
+	sandbox.State = domain.SandboxReady
+	sandbox.Recovered = true
+	if m.config.CaptureVMMLogs {
+		resumeVMMLog(filepath.Join(m.config.RuntimeDir, sandbox.ID), sandbox.ID, m.log)
+	}
+
+	m.mu.Lock()
+	m.sandboxes[sandbox.ID] = sandbox
+	// Never hand out a CID that is already in use by an adopted VM
+	if sandbox.VsockCID >= m.cidCounter {
+		m.cidCounter = sandbox.VsockCID + 1
+	}
+	m.mu.Unlock()
+
+	go m.watchAdoptedVMM(sandbox)
+
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"pid":        sandbox.PID,
+		"cid":        sandbox.VsockCID,
+	}).Info("Adopted running VM")
+
+	return nil
+}
+
 // GetSandbox retrieves a sandbox by ID.
 func (m *Manager) GetSandbox(id string) (*domain.Sandbox, bool) {
 	m.mu.RLock()
@@ -307,6 +801,121 @@ func (m *Manager) ListSandboxes() []*domain.Sandbox {
 	return result
 }
 
+// adoptedPollInterval is how often the VMM of an adopted VM, which this
+// process can't wait on, is checked for having exited.
+const adoptedPollInterval = time.Second
+
+// OnVMMExit registers fn to be called when the VMM of a running sandbox
+// exits unexpectedly, e.g. because it crashed or was killed. The sandbox is
+// already marked stopped; fn is expected to destroy it. fn is called from a
+// background goroutine.
+func (m *Manager) OnVMMExit(fn func(sandbox *domain.Sandbox)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exitHandlers = append(m.exitHandlers, fn)
+}
+
+// watchVMM waits for the VMM of a sandbox to exit (see vmmExited).
+func (m *Manager) watchVMM(sandbox *domain.Sandbox) {
+	machine := sandbox.VM
+	_ = machine.Wait(context.Background())
+	m.vmmExited(sandbox, machine)
+}
+
+// watchAdoptedVMM polls for the VMM of an adopted sandbox to exit (see
+// vmmExited), until the sandbox is destroyed.
+func (m *Manager) watchAdoptedVMM(sandbox *domain.Sandbox) {
+	ticker := time.NewTicker(adoptedPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.mu.RLock()
+		_, tracked := m.sandboxes[sandbox.ID]
+		m.mu.RUnlock()
+		if !tracked {
+			return
+		}
+		if !processAlive(sandbox.PID) {
+			m.vmmExited(sandbox, nil)
+			return
+		}
+	}
+}
+
+// vmmExited marks a sandbox whose VMM exited while it was running as
+// stopped and reports it to the exit handlers. Stops and destroys hold the
+// sandbox lock until the sandbox is marked stopped, so exits they cause are
+// not reported. machine is the VMM that exited, if the SDK started it; the
+// exit of one a reboot has replaced is not reported either.
+func (m *Manager) vmmExited(sandbox *domain.Sandbox, machine *firecracker.Machine) {
+	m.mu.RLock()
+	_, tracked := m.sandboxes[sandbox.ID]
+	m.mu.RUnlock()
+	if !tracked {
+		return
+	}
+
+	mu := m.getSandboxLock(sandbox.ID)
+	mu.Lock()
+	if sandbox.State != domain.SandboxReady || (machine != nil && sandbox.VM != machine) {
+		mu.Unlock()
+		return
+	}
+	sandbox.State = domain.SandboxStopped
+	sandbox.FinishedAt = time.Now()
+	mu.Unlock()
+
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"pid":        sandbox.PID,
+	}).Warn("VMM exited unexpectedly")
+	metrics.Global().RecordComponentEvent(metrics.ComponentVMM, metrics.EventUnexpectedExit)
+
+	m.mu.RLock()
+	handlers := m.exitHandlers
+	m.mu.RUnlock()
+	for _, fn := range handlers {
+		fn(sandbox)
+	}
+}
+
+// stopped reports whether the VMM of a sandbox has stopped or exited.
+func (m *Manager) stopped(sandbox *domain.Sandbox) bool {
+	mu := m.getSandboxLock(sandbox.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	return sandbox.State == domain.SandboxStopped
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// stopProcess sends SIGTERM to a process and escalates to SIGKILL if it has
+// not exited within the timeout.
+func stopProcess(pid int, timeout time.Duration) error {
+	if !processAlive(pid) {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
 // generateID creates a unique identifier.
 func generateID() string {
 	// In production, use uuid or similar
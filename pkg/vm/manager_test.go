@@ -3,6 +3,7 @@ package vm
 import (
 	"context"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 	"time"
@@ -136,3 +137,73 @@ func TestManager_DestroyVM_Cleanup(t *testing.T) {
 		t.Error("Sandbox was not removed from manager map")
 	}
 }
+
+func TestManager_VMMExit(t *testing.T) {
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+	mgr, err := NewManager(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	exited := make(chan *domain.Sandbox, 2)
+	mgr.OnVMMExit(func(sandbox *domain.Sandbox) { exited <- sandbox })
+
+	// Exits caused by stopping the VM are not reported
+	stopped := domain.NewSandbox("stopped-sb")
+	stopped.State = domain.SandboxStopped
+	mgr.sandboxes[stopped.ID] = stopped
+	mgr.vmmExited(stopped, nil)
+
+	// A VMM dying under a running sandbox is
+	crashed := domain.NewSandbox("crashed-sb")
+	crashed.State = domain.SandboxReady
+	mgr.sandboxes[crashed.ID] = crashed
+	mgr.vmmExited(crashed, nil)
+
+	select {
+	case sandbox := <-exited:
+		if sandbox != crashed {
+			t.Fatalf("reported exit of %s, want crashed-sb", sandbox.ID)
+		}
+	default:
+		t.Fatal("exit of a running sandbox was not reported")
+	}
+	if len(exited) != 0 {
+		t.Error("exit of a stopped sandbox was reported")
+	}
+	if !mgr.stopped(crashed) || crashed.FinishedAt.IsZero() {
+		t.Errorf("crashed sandbox state = %v, finished at %v, want stopped", crashed.State, crashed.FinishedAt)
+	}
+}
+
+func TestManager_WatchAdoptedVMM(t *testing.T) {
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+	mgr, err := NewManager(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	exited := make(chan *domain.Sandbox, 1)
+	mgr.OnVMMExit(func(sandbox *domain.Sandbox) { exited <- sandbox })
+
+	// Stands in for a VMM left running by a previous shim
+	cmd := exec.Command("sleep", "0.2")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can't start a process: %v", err)
+	}
+	go func() { _ = cmd.Wait() }()
+
+	sandbox := domain.NewSandbox("adopted-sb")
+	sandbox.State = domain.SandboxReady
+	sandbox.PID = cmd.Process.Pid
+	mgr.sandboxes[sandbox.ID] = sandbox
+	go mgr.watchAdoptedVMM(sandbox)
+
+	select {
+	case <-exited:
+	case <-time.After(5 * adoptedPollInterval):
+		t.Fatal("exit of an adopted VMM was not reported")
+	}
+}
@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+)
+
+const (
+	// defaultMMDSAddress is the link-local address guests reach MMDS at.
+	defaultMMDSAddress = "169.254.169.254"
+
+	// MMDS versions accepted in domain.MMDSConfig.
+	MMDSVersionV1 = "V1"
+	MMDSVersionV2 = "V2"
+
+	// MMDSTapPrefix names the host taps created for MMDS interfaces. Tap
+	// names are limited to 15 characters.
+	MMDSTapPrefix = "fcmd"
+	maxTapNameLen = 15
+)
+
+// ValidateMMDSConfig checks an MMDS configuration.
+func ValidateMMDSConfig(config *domain.MMDSConfig) error {
+	if config == nil {
+		return nil
+	}
+	switch config.Version {
+	case "", MMDSVersionV1, MMDSVersionV2:
+	default:
+		return fmt.Errorf("invalid MMDS version %q (must be %s or %s)", config.Version, MMDSVersionV1, MMDSVersionV2)
+	}
+	if config.Address != "" {
+		if ip := net.ParseIP(config.Address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid MMDS address %q: must be IPv4", config.Address)
+		}
+	}
+	if len(config.TapDevice) > maxTapNameLen {
+		return fmt.Errorf("invalid MMDS tap device %q: longer than %d characters", config.TapDevice, maxTapNameLen)
+	}
+	return nil
+}
+
+// MMDSTapName returns the tap created for a sandbox's MMDS interface.
+// fcctl gc uses it to tell the taps of live sandboxes from leftovers.
+func MMDSTapName(sandboxID string) string {
+	suffix := strings.TrimPrefix(sandboxID, "fc-")
+	if n := maxTapNameLen - len(MMDSTapPrefix); len(suffix) > n {
+		suffix = suffix[len(suffix)-n:]
+	}
+	return MMDSTapPrefix + suffix
+}
+
+// mmdsMAC returns a stable, locally administered MAC for a sandbox's MMDS
+// interface, which the guest agent uses to find the interface.
+func mmdsMAC(sandboxID string) string {
+	h := sha256.Sum256([]byte(sandboxID))
+	return fmt.Sprintf("06:00:%02x:%02x:%02x:%02x", h[0], h[1], h[2], h[3])
+}
+
+// configureMMDS adds the MMDS interface to a VM's Firecracker config, and
+// tells the guest agent where to find it through the kernel command line.
+func (m *Manager) configureMMDS(ctx context.Context, sandboxID string, config *domain.MMDSConfig, fcConfig *firecracker.Config) error {
+	if err := ValidateMMDSConfig(config); err != nil {
+		return err
+	}
+
+	tap := config.TapDevice
+	if tap == "" {
+		tap = MMDSTapName(sandboxID)
+		tapConfig := network.TAPConfig{Name: tap, NetNS: fcConfig.NetNS}
+		if m.jailer != nil {
+			// The jailed Firecracker opens the tap as the jailer's user
+			tapConfig.OwnerID, tapConfig.GroupID = m.jailer.config.UID, m.jailer.config.GID
+		}
+		if err := network.CreateTAP(tapConfig); err != nil {
+			return fmt.Errorf("failed to create MMDS tap: %w", err)
+		}
+	}
+
+	address := config.Address
+	if address == "" {
+		address = defaultMMDSAddress
+	}
+	version := firecracker.MMDSv2
+	if config.Version == MMDSVersionV1 {
+		version = firecracker.MMDSv1
+	}
+	mac := mmdsMAC(sandboxID)
+
+	fcConfig.NetworkInterfaces = append(fcConfig.NetworkInterfaces, firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  mac,
+			HostDevName: tap,
+		},
+		AllowMMDS: true,
+	})
+	fcConfig.MmdsAddress = net.ParseIP(address)
+	fcConfig.MmdsVersion = version
+	fcConfig.KernelArgs += fmt.Sprintf(" fc_cri.mmds_addr=%s fc_cri.mmds_mac=%s", address, mac)
+	return nil
+}
+
+// releaseMMDS removes the tap created for a sandbox's MMDS interface.
+func (m *Manager) releaseMMDS(sandboxID string, config *domain.MMDSConfig) {
+	if config == nil || config.TapDevice != "" {
+		return
+	}
+	tap := MMDSTapName(sandboxID)
+	if output, err := exec.Command("ip", "link", "delete", tap).CombinedOutput(); err != nil {
+		m.log.WithError(err).WithField("tap", tap).Debugf("Failed to delete MMDS tap: %s", output)
+	}
+}
+
+// SetMetadata replaces the metadata a sandbox's guest reads from MMDS.
+func (m *Manager) SetMetadata(ctx context.Context, sandbox *domain.Sandbox, metadata domain.InstanceMetadata) error {
+	if sandbox.VMConfig.MMDS == nil {
+		return fmt.Errorf("sandbox %s has no MMDS", sandbox.ID)
+	}
+	if sandbox.VM == nil {
+		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
+	}
+	if err := sandbox.VM.SetMetadata(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to set metadata: %w", err)
+	}
+	return nil
+}
+
+// UpdateMetadata merges a patch into a sandbox's MMDS metadata, following
+// JSON merge patch rules.
+func (m *Manager) UpdateMetadata(ctx context.Context, sandbox *domain.Sandbox, patch interface{}) error {
+	if sandbox.VMConfig.MMDS == nil {
+		return fmt.Errorf("sandbox %s has no MMDS", sandbox.ID)
+	}
+	if sandbox.VM == nil {
+		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
+	}
+	if err := sandbox.VM.UpdateMetadata(ctx, patch); err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	return nil
+}
+
+// SandboxMetadata builds the MMDS document for a sandbox from its pod
+// identity and the given environment.
+func SandboxMetadata(sandbox *domain.Sandbox, uid string, env map[string]string) domain.InstanceMetadata {
+	return domain.InstanceMetadata{
+		SandboxID: sandbox.ID,
+		Pod: domain.PodMetadata{
+			Name:        sandbox.Name,
+			Namespace:   sandbox.Namespace,
+			UID:         uid,
+			Labels:      sandbox.Labels,
+			Annotations: sandbox.Annotations,
+		},
+		Env: env,
+	}
+}
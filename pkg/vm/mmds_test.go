@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestValidateMMDSConfig(t *testing.T) {
+	valid := []*domain.MMDSConfig{
+		nil,
+		{},
+		{Version: MMDSVersionV1, Address: "169.254.170.2"},
+		{Version: MMDSVersionV2, TapDevice: "tap-mmds0"},
+	}
+	for _, config := range valid {
+		if err := ValidateMMDSConfig(config); err != nil {
+			t.Errorf("ValidateMMDSConfig(%+v) = %v", config, err)
+		}
+	}
+
+	invalid := []*domain.MMDSConfig{
+		{Version: "v3"},
+		{Address: "not-an-ip"},
+		{Address: "fe80::1"},
+		{TapDevice: "a-very-long-tap-name"},
+	}
+	for _, config := range invalid {
+		if err := ValidateMMDSConfig(config); err == nil {
+			t.Errorf("ValidateMMDSConfig(%+v) accepted", config)
+		}
+	}
+}
+
+func TestMMDSTapName(t *testing.T) {
+	tests := map[string]string{
+		"fc-abc": "fcmdabc",
+		"abc":    "fcmdabc",
+		// Long IDs keep their end, where sandboxes created in a row differ
+		"fc-1700000000000000000": "fcmd00000000000",
+	}
+	for id, want := range tests {
+		name := MMDSTapName(id)
+		if name != want || len(name) > maxTapNameLen || !strings.HasPrefix(name, MMDSTapPrefix) {
+			t.Errorf("MMDSTapName(%q) = %q, want %q", id, name, want)
+		}
+	}
+	if MMDSTapName("fc-1700000000000000000") == MMDSTapName("fc-1700000000000000001") {
+		t.Error("MMDSTapName() collides for neighbouring IDs")
+	}
+}
+
+func TestMMDSMAC(t *testing.T) {
+	mac := mmdsMAC("fc-1")
+	if mac != mmdsMAC("fc-1") {
+		t.Error("mmdsMAC() is not stable")
+	}
+	if mac == mmdsMAC("fc-2") {
+		t.Error("mmdsMAC() collides")
+	}
+	// Locally administered, unicast
+	if !strings.HasPrefix(mac, "06:00:") || len(mac) != 17 {
+		t.Errorf("mmdsMAC() = %q", mac)
+	}
+}
+
+func TestSandboxMetadata(t *testing.T) {
+	sandbox := domain.NewSandbox("fc-1")
+	sandbox.Name = "web-0"
+	sandbox.Namespace = "shop"
+	sandbox.Labels = map[string]string{"app": "web"}
+
+	md := SandboxMetadata(sandbox, "uid-1", map[string]string{"PORT": "8080"})
+	if md.SandboxID != "fc-1" || md.Pod.Name != "web-0" || md.Pod.Namespace != "shop" || md.Pod.UID != "uid-1" {
+		t.Errorf("SandboxMetadata() = %+v", md)
+	}
+	if md.Pod.Labels["app"] != "web" || md.Env["PORT"] != "8080" {
+		t.Errorf("SandboxMetadata() = %+v", md)
+	}
+}
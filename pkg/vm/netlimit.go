@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// rateLimiterRefill is how long a token bucket takes to refill, so bucket
+// sizes are the per-second rates.
+const rateLimiterRefill = time.Second
+
+// trafficRateLimiter builds the Firecracker rate limiter for one direction
+// of traffic, or nil if it is unlimited.
+func trafficRateLimiter(limit domain.TrafficLimit) *models.RateLimiter {
+	if limit.IsZero() {
+		return nil
+	}
+
+	limiter := &models.RateLimiter{}
+	if limit.BytesPerSec > 0 {
+		limiter.Bandwidth = tokenBucket(limit.BytesPerSec)
+	}
+	if limit.PacketsPerSec > 0 {
+		limiter.Ops = tokenBucket(limit.PacketsPerSec)
+	}
+	return limiter
+}
+
+// tokenBucket builds a bucket refilling at the given rate per second.
+func tokenBucket(perSec int64) *models.TokenBucket {
+	bucket := firecracker.TokenBucketBuilder{}.
+		WithBucketSize(perSec).
+		WithRefillDuration(rateLimiterRefill).
+		Build()
+	return &bucket
+}
+
+// applyNetRateLimit sets a VM's rate limits on each of its network
+// interfaces.
+func applyNetRateLimit(limit *domain.NetRateLimit, fcConfig *firecracker.Config) {
+	if limit == nil {
+		return
+	}
+	rx, tx := trafficRateLimiter(limit.RX), trafficRateLimiter(limit.TX)
+	for i := range fcConfig.NetworkInterfaces {
+		fcConfig.NetworkInterfaces[i].InRateLimiter = rx
+		fcConfig.NetworkInterfaces[i].OutRateLimiter = tx
+	}
+}
@@ -0,0 +1,40 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestTrafficRateLimiter(t *testing.T) {
+	if trafficRateLimiter(domain.TrafficLimit{}) != nil {
+		t.Error("trafficRateLimiter() limited unlimited traffic")
+	}
+
+	limiter := trafficRateLimiter(domain.TrafficLimit{BytesPerSec: 12_500_000})
+	if limiter == nil || limiter.Bandwidth == nil || limiter.Ops != nil {
+		t.Fatalf("trafficRateLimiter() = %+v, want bandwidth only", limiter)
+	}
+	if *limiter.Bandwidth.Size != 12_500_000 || *limiter.Bandwidth.RefillTime != 1000 {
+		t.Errorf("bandwidth bucket = %d per %dms", *limiter.Bandwidth.Size, *limiter.Bandwidth.RefillTime)
+	}
+
+	limiter = trafficRateLimiter(domain.TrafficLimit{PacketsPerSec: 5000})
+	if limiter == nil || limiter.Bandwidth != nil || limiter.Ops == nil || *limiter.Ops.Size != 5000 {
+		t.Errorf("trafficRateLimiter() = %+v, want 5000 packets/s", limiter)
+	}
+}
+
+func TestApplyNetRateLimit(t *testing.T) {
+	fcConfig := firecracker.Config{
+		NetworkInterfaces: firecracker.NetworkInterfaces{{}, {}},
+	}
+	applyNetRateLimit(&domain.NetRateLimit{TX: domain.TrafficLimit{BytesPerSec: 1000}}, &fcConfig)
+
+	for i, iface := range fcConfig.NetworkInterfaces {
+		if iface.InRateLimiter != nil || iface.OutRateLimiter == nil {
+			t.Errorf("interface %d: rx = %v, tx = %v, want tx only", i, iface.InRateLimiter, iface.OutRateLimiter)
+		}
+	}
+}
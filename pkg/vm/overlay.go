@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// Read-only root images, such as erofs and squashfs, can't be written even
+// through a copy-on-write layer. Sandboxes booting one get a writable ext4
+// drive of their own instead, which the agent mounts as the upper layer of
+// an overlay over the root.
+const (
+	// overlayDriveID is the drive ID of the overlay drive.
+	overlayDriveID = "overlay"
+
+	// overlayDevice is the overlay drive in the guest: the drive after
+	// the root drive.
+	overlayDevice = "/dev/vdb"
+
+	// overlayArg passes the overlay drive to the agent. Kept in sync with
+	// cmdlineOverlay in the agent.
+	overlayArg = agentArgPrefix + "overlay="
+
+	// jailedOverlayDrive is where the overlay drive is found inside a jail.
+	jailedOverlayDrive = "/overlay.ext4"
+
+	// DefaultOverlaySizeMB is the size of overlay drives. They are sparse,
+	// so this bounds what a sandbox can write rather than what it takes.
+	DefaultOverlaySizeMB = 4096
+)
+
+// Superblock magic numbers of read-only root image filesystems.
+var (
+	squashfsMagic = []byte("hsqs")
+	erofsMagic    = uint32(0xE0F5E1E2)
+)
+
+// erofsSuperblockOffset is where the erofs superblock starts.
+const erofsSuperblockOffset = 1024
+
+// readOnlyImageType returns the filesystem of a root image if it's one that
+// can only be mounted read-only, "erofs" or "squashfs", and "" otherwise.
+func readOnlyImageType(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	header := make([]byte, erofsSuperblockOffset+4)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, squashfsMagic):
+		return "squashfs"
+	case len(header) == erofsSuperblockOffset+4 &&
+		binary.LittleEndian.Uint32(header[erofsSuperblockOffset:]) == erofsMagic:
+		return "erofs"
+	}
+	return ""
+}
+
+// overlayLayerPath returns the overlay drive of a sandbox.
+func (m *Manager) overlayLayerPath(sandboxID string) string {
+	return filepath.Join(m.config.RootfsCoW.Dir, sandboxID+".overlay.ext4")
+}
+
+// prepareOverlay creates the empty overlay drive of a sandbox booting a
+// read-only root image. It lives next to the rootfs layers and is removed
+// with them.
+func (m *Manager) prepareOverlay(sandbox *domain.Sandbox) (string, error) {
+	if m.config.RootfsCoW.Dir == "" {
+		return "", fmt.Errorf("read-only root images need a directory for overlay drives")
+	}
+	path := m.overlayLayerPath(sandbox.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create overlay drive dir: %w", err)
+	}
+
+	sizeMB := m.config.RootfsCoW.OverlaySizeMB
+	if sizeMB <= 0 {
+		sizeMB = DefaultOverlaySizeMB
+	}
+	if err := createOverlayDrive(path, sizeMB); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to create overlay drive: %w", err)
+	}
+	if err := m.prealloc.allocate(path, VolumeTypeRootfs); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	sandbox.RootfsPath = path
+	return path, nil
+}
+
+// createOverlayDrive creates a sparse ext4 image of sizeMB.
+func createOverlayDrive(path string, sizeMB int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(sizeMB << 20)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("mkfs.ext4", "-F", "-q", "-L", overlayDriveID, path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: %w: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// A CNI plugin that hangs fails a VM's network setup with a
+// *network.PluginTimeoutError once the plugin timeout passes, rather than
+// holding up the creation. The sandbox isn't given up: its network is left
+// pending and set up again in the background, and the next creation of a VM
+// with the same network config adopts it once its network is ready, with
+// the addresses CNI gave it. Creations that come while it is still pending
+// fail with ErrNetworkPending, so a retried creation doesn't run the hung
+// plugin again for another sandbox.
+
+// ErrNetworkPending is the failure of creating a VM whose network would be
+// that of a sandbox whose network setup is still being retried.
+var ErrNetworkPending = errors.New("network setup of a previous sandbox is still pending after a CNI plugin timeout")
+
+// pendingNetwork is a sandbox whose network setup timed out.
+type pendingNetwork struct {
+	sandbox *domain.Sandbox
+	config  domain.VMConfig
+	since   time.Time
+	ready   bool // Its network is set up and its taps exist
+}
+
+// matches reports whether a VM created with config would get the pending
+// sandbox's network.
+func (p *pendingNetwork) matches(config domain.VMConfig) bool {
+	return reflect.DeepEqual(p.config.CNIConfig, config.CNIConfig) &&
+		reflect.DeepEqual(p.config.PortMappings, config.PortMappings)
+}
+
+// parkNetwork leaves the network of a sandbox whose setup timed out pending,
+// and starts retrying it.
+func (m *Manager) parkNetwork(sandbox *domain.Sandbox, config domain.VMConfig) {
+	p := &pendingNetwork{sandbox: sandbox, config: config, since: time.Now()}
+	m.mu.Lock()
+	if m.pendingNetworks == nil {
+		m.pendingNetworks = make(map[string]*pendingNetwork)
+	}
+	m.pendingNetworks[sandbox.ID] = p
+	m.mu.Unlock()
+
+	m.log.WithField("sandbox_id", sandbox.ID).Warn("CNI plugin timed out, retrying network setup in the background")
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		m.completeNetwork(p)
+	}()
+}
+
+// takePendingNetwork returns the sandbox whose network was completed in the
+// background for a VM created with config, removing it from the pending
+// ones. It returns ErrNetworkPending if such a network is still pending, and
+// nil if there is none.
+func (m *Manager) takePendingNetwork(config domain.VMConfig) (*domain.Sandbox, error) {
+	if m.network == nil || config.NetworkMode != "cni" {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := false
+	for id, p := range m.pendingNetworks {
+		if !p.matches(config) {
+			continue
+		}
+		if p.ready {
+			delete(m.pendingNetworks, id)
+			return p.sandbox, nil
+		}
+		pending = true
+	}
+	if pending {
+		return nil, ErrNetworkPending
+	}
+	return nil, nil
+}
+
+// PendingNetworks returns the IDs of the sandboxes whose network setup is
+// being retried in the background, or is complete but not yet adopted.
+func (m *Manager) PendingNetworks() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.pendingNetworks))
+	for id := range m.pendingNetworks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// completeNetwork sets the network of a pending sandbox up again every
+// PendingNetworkInterval until it succeeds, then waits for a creation to
+// adopt it. A network neither completed nor adopted within
+// PendingNetworkTTL, or by the time the manager is closed, is torn down.
+func (m *Manager) completeNetwork(p *pendingNetwork) {
+	startup := m.config.Startup
+	log := m.log.WithField("sandbox_id", p.sandbox.ID)
+	ticker := time.NewTicker(startup.PendingNetworkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.mu.Lock()
+			_, parked := m.pendingNetworks[p.sandbox.ID]
+			delete(m.pendingNetworks, p.sandbox.ID)
+			m.mu.Unlock()
+			if parked {
+				log.Info("Manager closed, tearing down pending network")
+				m.teardownNetwork(context.Background(), p.sandbox)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		_, parked := m.pendingNetworks[p.sandbox.ID]
+		ready := p.ready
+		expired := time.Since(p.since) > startup.PendingNetworkTTL
+		if parked && expired {
+			delete(m.pendingNetworks, p.sandbox.ID)
+		}
+		m.mu.Unlock()
+
+		switch {
+		case !parked:
+			// Adopted by a creation
+			return
+		case expired:
+			log.WithField("ready", ready).Warn("Giving up on pending network")
+			m.teardownNetwork(context.Background(), p.sandbox)
+			return
+		case ready:
+			continue
+		}
+
+		// Each plugin is bounded by the plugin timeout, and closing the
+		// manager
+		ctx := m.ctx
+		p.sandbox.PortMappings = p.config.PortMappings
+		err := m.network.Setup(ctx, p.sandbox, p.config.CNIConfig)
+		if err == nil {
+			err = waitForTaps(ctx, p.sandbox, startup.TapTimeout)
+		}
+		if err != nil {
+			log.WithError(err).Debug("Pending network setup failed again")
+			m.teardownNetwork(context.Background(), p.sandbox)
+			continue
+		}
+
+		m.mu.Lock()
+		p.ready = true
+		m.mu.Unlock()
+		log.WithFields(logrus.Fields{
+			"ip":      p.sandbox.IP,
+			"pending": time.Since(p.since).Round(time.Second),
+		}).Info("Completed pending network setup")
+	}
+}
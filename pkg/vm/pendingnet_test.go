@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+// hungNetwork is a network service whose CNI plugin always times out.
+type hungNetwork struct {
+	mu        sync.Mutex
+	setups    int
+	teardowns int
+}
+
+func (n *hungNetwork) Setup(ctx context.Context, sandbox *domain.Sandbox, config *domain.CNIConfig) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.setups++
+	return fmt.Errorf("CNI AddNetworkList failed: %w", &network.PluginTimeoutError{Plugin: "bridge", Command: "ADD", Timeout: time.Second})
+}
+
+func (n *hungNetwork) Teardown(ctx context.Context, sandbox *domain.Sandbox) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.teardowns++
+	return nil
+}
+
+func (n *hungNetwork) GetIP(ctx context.Context, sandboxID string) (net.IP, error) {
+	return nil, errors.New("no IP")
+}
+
+func (n *hungNetwork) counts() (setups, teardowns int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setups, n.teardowns
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newPendingNetManager returns a manager setting networks up with network,
+// closed when the test ends.
+func newPendingNetManager(t *testing.T, network domain.NetworkService, startup StartupConfig) *Manager {
+	t.Helper()
+	m := &Manager{config: ManagerConfig{Startup: startup}, log: logrus.NewEntry(logrus.New()), network: network}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestManager_PendingNetwork(t *testing.T) {
+	hung := &hungNetwork{}
+	startup := DefaultStartupConfig()
+	startup.RetryDelay = time.Millisecond
+	startup.PendingNetworkInterval = 5 * time.Millisecond
+	startup.PendingNetworkTTL = time.Hour
+	m := newPendingNetManager(t, hung, startup)
+	config := domain.VMConfig{NetworkMode: "cni", PortMappings: []domain.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}}
+	sandbox := domain.NewSandbox("fc-1")
+
+	// A plugin timeout fails the setup right away, retryably
+	err := m.setupNetwork(context.Background(), sandbox, config)
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) || startupErr.Stage != StageNetworkSetup || startupErr.Attempts != 1 {
+		t.Fatalf("setupNetwork() error = %v, want a network setup failure after 1 attempt", err)
+	}
+	if !network.IsPluginTimeout(err) || ClassifyError(err) != ErrorTransient {
+		t.Errorf("setupNetwork() error = %v (%s), want a transient plugin timeout", err, ClassifyError(err))
+	}
+	if ids := m.PendingNetworks(); len(ids) != 1 || ids[0] != "fc-1" {
+		t.Fatalf("PendingNetworks() = %v, want [fc-1]", ids)
+	}
+
+	// Creations that would get its network wait for it; others don't
+	if _, err := m.takePendingNetwork(config); !errors.Is(err, ErrNetworkPending) || ClassifyError(err) != ErrorTransient {
+		t.Errorf("takePendingNetwork() error = %v, want ErrNetworkPending", err)
+	}
+	if sandbox, err := m.takePendingNetwork(domain.VMConfig{NetworkMode: "cni"}); sandbox != nil || err != nil {
+		t.Errorf("takePendingNetwork() of another network = %v, %v, want nothing", sandbox, err)
+	}
+	if sandbox, err := m.takePendingNetwork(domain.VMConfig{PortMappings: config.PortMappings}); sandbox != nil || err != nil {
+		t.Errorf("takePendingNetwork() without CNI = %v, %v, want nothing", sandbox, err)
+	}
+
+	// The setup is retried in the background
+	waitFor(t, "a background retry", func() bool {
+		setups, _ := hung.counts()
+		return setups >= 3
+	})
+
+	// Once complete, the next creation adopts the sandbox
+	m.mu.Lock()
+	m.pendingNetworks["fc-1"].ready = true
+	m.mu.Unlock()
+	adopted, err := m.takePendingNetwork(config)
+	if err != nil || adopted != sandbox {
+		t.Fatalf("takePendingNetwork() = %v, %v, want the pending sandbox", adopted, err)
+	}
+	if ids := m.PendingNetworks(); len(ids) != 0 {
+		t.Errorf("PendingNetworks() after adoption = %v, want none", ids)
+	}
+}
+
+func TestManager_PendingNetworkExpires(t *testing.T) {
+	hung := &hungNetwork{}
+	startup := DefaultStartupConfig()
+	startup.PendingNetworkInterval = 5 * time.Millisecond
+	startup.PendingNetworkTTL = 20 * time.Millisecond
+	m := newPendingNetManager(t, hung, startup)
+	config := domain.VMConfig{NetworkMode: "cni"}
+
+	if err := m.setupNetwork(context.Background(), domain.NewSandbox("fc-1"), config); !network.IsPluginTimeout(err) {
+		t.Fatalf("setupNetwork() error = %v, want a plugin timeout", err)
+	}
+	waitFor(t, "the pending network to expire", func() bool { return len(m.PendingNetworks()) == 0 })
+	if _, err := m.takePendingNetwork(config); err != nil {
+		t.Errorf("takePendingNetwork() after expiry error = %v", err)
+	}
+
+	// Without a TTL, a timed-out setup is given up like any other
+	m.config.Startup.PendingNetworkTTL = 0
+	if err := m.setupNetwork(context.Background(), domain.NewSandbox("fc-2"), config); !network.IsPluginTimeout(err) {
+		t.Fatalf("setupNetwork() error = %v, want a plugin timeout", err)
+	}
+	if ids := m.PendingNetworks(); len(ids) != 0 {
+		t.Errorf("PendingNetworks() without a TTL = %v, want none", ids)
+	}
+}
+
+func TestManager_CloseTearsDownPendingNetwork(t *testing.T) {
+	hung := &hungNetwork{}
+	startup := DefaultStartupConfig()
+	startup.PendingNetworkInterval = time.Hour
+	startup.PendingNetworkTTL = time.Hour
+	m := newPendingNetManager(t, hung, startup)
+	sandbox := domain.NewSandbox("fc-1")
+
+	if err := m.setupNetwork(context.Background(), sandbox, domain.VMConfig{NetworkMode: "cni"}); !network.IsPluginTimeout(err) {
+		t.Fatalf("setupNetwork() error = %v, want a plugin timeout", err)
+	}
+	// Completed, but never adopted
+	m.mu.Lock()
+	sandbox.NetworkNamespace = "/var/run/netns/fc-1"
+	m.pendingNetworks["fc-1"].ready = true
+	m.mu.Unlock()
+	_, before := hung.counts()
+
+	// Close waits for the retries to stop
+	m.Close()
+	if ids := m.PendingNetworks(); len(ids) != 0 {
+		t.Errorf("PendingNetworks() after Close() = %v, want none", ids)
+	}
+	if _, after := hung.counts(); after != before+1 {
+		t.Errorf("Close() tore down %d networks, want 1", after-before)
+	}
+}
+
+func TestManager_CreateVMReleasesAdoptedNetwork(t *testing.T) {
+	hung := &hungNetwork{}
+	startup := DefaultStartupConfig()
+	startup.PendingNetworkInterval = time.Hour
+	startup.PendingNetworkTTL = time.Hour
+	m := newPendingNetManager(t, hung, startup)
+	m.config.RuntimeDir = t.TempDir()
+	config := domain.VMConfig{NetworkMode: "cni"}
+	sandbox := domain.NewSandbox("fc-1")
+
+	if err := m.setupNetwork(context.Background(), sandbox, config); !network.IsPluginTimeout(err) {
+		t.Fatalf("setupNetwork() error = %v, want a plugin timeout", err)
+	}
+	m.mu.Lock()
+	sandbox.NetworkNamespace = "/var/run/netns/fc-1"
+	m.pendingNetworks["fc-1"].ready = true
+	m.mu.Unlock()
+	_, before := hung.counts()
+
+	// The creation adopting it fails before its network would be set up
+	config.RuntimeDirClass = "missing"
+	if _, err := m.createVM(context.Background(), config); err == nil || !strings.Contains(err.Error(), "unknown runtime dir class") {
+		t.Fatalf("createVM() error = %v, want an unknown runtime dir class", err)
+	}
+	if _, after := hung.counts(); after != before+1 {
+		t.Errorf("createVM() tore down %d networks, want the adopted one", after-before)
+	}
+	if sandbox.NetworkNamespace != "" {
+		t.Errorf("adopted sandbox still has network namespace %s", sandbox.NetworkNamespace)
+	}
+}
@@ -3,16 +3,29 @@ package vm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/trace"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 )
 
+// ErrPoolDraining is returned by Acquire once the pool has started draining
+// or has been closed.
+var ErrPoolDraining = errors.New("vm pool is draining")
+
+// DefaultBucketName names the pool bucket that keeps VMs booted with
+// PoolConfig.DefaultVMConfig warm.
+const DefaultBucketName = "default"
+
 // Pool implements domain.VMPool for pre-warming Firecracker VMs.
 // This is critical for achieving <50ms container start times.
 //
@@ -26,20 +39,36 @@ type Pool struct {
 	config  PoolConfig
 	log     *logrus.Entry
 
-	// Pool of ready VMs
-	available chan *domain.Sandbox
+	// Pools of ready VMs, one per shape. The default bucket comes first.
+	buckets []*bucket
+
+	// base verifies the root drive VMs are warmed from.
+	base *baseVerifier
 
 	// Tracking
-	inUse map[string]*domain.Sandbox
+	inUse    map[string]*domain.Sandbox
+	released chan struct{} // Signalled whenever an in-use VM is given back
+
+	// States of the VMs in the pool, and the VMs it retired last
+	vms     map[string]*PoolVM
+	retired []PoolVM
+
+	// healthCheck probes pooled VMs; tests replace it.
+	healthCheck func(*domain.Sandbox) error
 
 	// Statistics
 	stats poolStats
 
+	// belowMinSince is when the buckets last fell short of their minimum
+	// sizes, or zero while they hold them.
+	belowMinSince time.Time
+
 	// Lifecycle
-	ctx     context.Context
-	cancel  context.CancelFunc
-	warmSem *semaphore.Weighted // Limit concurrent warming
-	closed  bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	warmSem  *semaphore.Weighted // Limit concurrent warming
+	draining bool
+	closed   bool
 }
 
 type poolStats struct {
@@ -48,6 +77,25 @@ type poolStats struct {
 	poolMisses  int64
 }
 
+// bucket holds the ready VMs of one shape.
+type bucket struct {
+	name      string
+	config    domain.VMConfig
+	minSize   int
+	maxSize   int
+	resizable bool
+
+	// idleMemoryMB is the memory the bucket's idle VMs are ballooned down
+	// to, or zero if they keep all of it.
+	idleMemoryMB int64
+
+	available chan *domain.Sandbox
+
+	// Statistics
+	hits   int64
+	misses int64
+}
+
 // PoolConfig configures the VM pool behavior.
 type PoolConfig struct {
 	// MaxSize is the maximum number of pre-warmed VMs to maintain.
@@ -67,6 +115,65 @@ type PoolConfig struct {
 
 	// ReplenishInterval is how often to check and refill the pool.
 	ReplenishInterval time.Duration
+
+	// ShutdownTimeout is how long Drain waits for in-use VMs to be released
+	// before force-killing them.
+	ShutdownTimeout time.Duration
+
+	// DrainConcurrency limits how many VMs are destroyed in parallel while
+	// draining.
+	DrainConcurrency int
+
+	// Generation is an epoch mixed into every VM's generation. Changing it
+	// retires all pooled VMs, e.g. after a guest agent update.
+	Generation string
+
+	// MaxReuse is how many times a VM may be returned to the pool for
+	// another workload. Zero means no limit.
+	MaxReuse int
+
+	// Buckets are pools of VMs of other shapes, kept warm alongside the
+	// default bucket of DefaultVMConfig VMs sized by MinSize and MaxSize.
+	Buckets []PoolBucket
+
+	// Resizable makes the default bucket resizable, see PoolBucket.
+	Resizable bool
+
+	// IdleMemoryMB is the memory left to VMs while they wait in the pool.
+	// Their balloons take the rest until they are acquired. Zero leaves
+	// idle VMs all of their memory.
+	IdleMemoryMB int64
+
+	// BaseRootfsSHA256 is the expected SHA-256 of the root drive pooled VMs
+	// boot from. Empty takes it from a <rootfs>.sha256 file next to the
+	// image, if there is one. No VM is warmed from an image that doesn't
+	// match.
+	BaseRootfsSHA256 string
+}
+
+// PoolBucket configures a partition of the pool that keeps VMs of one
+// shape warm, so workloads needing more than the default VM still start
+// from the pool.
+type PoolBucket struct {
+	// Name identifies the bucket in logs and metrics.
+	Name string
+
+	// VcpuCount, MemoryMB and KernelPath are the shape of the bucket's
+	// VMs. Zero values take DefaultVMConfig's.
+	VcpuCount  int64
+	MemoryMB   int64
+	KernelPath string
+
+	// MinSize is the number of VMs to keep warm.
+	MinSize int
+
+	// MaxSize is the maximum number of VMs the bucket holds.
+	MaxSize int
+
+	// Resizable boots the bucket's VMs with a memory balloon, so they also
+	// serve smaller workloads: on acquire, the balloon takes the memory the
+	// workload didn't ask for and the guest takes surplus vCPUs offline.
+	Resizable bool
 }
 
 // DefaultPoolConfig returns sensible defaults for the pool.
@@ -78,63 +185,361 @@ func DefaultPoolConfig() PoolConfig {
 		WarmConcurrency:   2,
 		DefaultVMConfig:   domain.DefaultVMConfig(),
 		ReplenishInterval: 10 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+		DrainConcurrency:  4,
 	}
 }
 
+// DrainReport summarizes the outcome of a pool drain.
+type DrainReport struct {
+	// IdleDestroyed is the number of pre-warmed VMs that were destroyed.
+	IdleDestroyed int
+
+	// Released is the number of in-use VMs released before the deadline.
+	Released int
+
+	// ForceKilled lists the in-use sandboxes destroyed at the deadline.
+	ForceKilled []string
+
+	// Errors is the number of VMs that failed to be destroyed.
+	Errors int
+
+	// Duration is how long the drain took.
+	Duration time.Duration
+}
+
 // NewPool creates a new VM pool.
 func NewPool(manager *Manager, config PoolConfig, log *logrus.Entry) (*Pool, error) {
+	buckets, err := newBuckets(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.BaseRootfsSHA256 != "" && !checksum.ValidSHA256(config.BaseRootfsSHA256) {
+		return nil, fmt.Errorf("invalid base rootfs SHA-256 %q", config.BaseRootfsSHA256)
+	}
+
+	log = log.WithField("component", "vm-pool")
+	base := newBaseVerifier(config.BaseRootfsSHA256, log)
+	for _, b := range buckets {
+		drive := b.config.RootDrive
+		if drive.PathOnHost == "" {
+			continue
+		}
+		// Every warm VM writing to the same image would corrupt it
+		if manager.sharesRootfs(drive) {
+			return nil, fmt.Errorf("pool bucket %s: pooled VMs would share writable rootfs %s, enable rootfs copy-on-write", b.name, drive.PathOnHost)
+		}
+		if err := base.verify(drive.PathOnHost); err != nil {
+			return nil, fmt.Errorf("pool bucket %s: %w", b.name, err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	pool := &Pool{
-		manager:   manager,
-		config:    config,
-		log:       log.WithField("component", "vm-pool"),
-		available: make(chan *domain.Sandbox, config.MaxSize),
-		inUse:     make(map[string]*domain.Sandbox),
-		ctx:       ctx,
-		cancel:    cancel,
-		warmSem:   semaphore.NewWeighted(int64(config.WarmConcurrency)),
+		manager:  manager,
+		config:   config,
+		log:      log,
+		buckets:  buckets,
+		base:     base,
+		inUse:    make(map[string]*domain.Sandbox),
+		released: make(chan struct{}, 1),
+		vms:      make(map[string]*PoolVM),
+		ctx:      ctx,
+		cancel:   cancel,
+		warmSem:  semaphore.NewWeighted(int64(config.WarmConcurrency)),
 	}
+	pool.healthCheck = pool.checkHealth
 
 	// Start background workers
 	go pool.replenishLoop()
 	go pool.cleanupLoop()
+	if c := manager.chaos; c != nil && c.config.KillWarmInterval > 0 {
+		go pool.chaosLoop(c)
+	}
 
 	return pool, nil
 }
 
+// newBuckets returns the default bucket followed by the configured ones.
+func newBuckets(config PoolConfig) ([]*bucket, error) {
+	defaultConfig := config.DefaultVMConfig
+	defaultConfig.Balloon = config.Resizable
+	buckets := []*bucket{{
+		name:      DefaultBucketName,
+		config:    defaultConfig,
+		minSize:   config.MinSize,
+		maxSize:   config.MaxSize,
+		resizable: config.Resizable,
+		available: make(chan *domain.Sandbox, config.MaxSize),
+	}}
+
+	shapes := map[string]string{bucketShape(config.DefaultVMConfig): DefaultBucketName}
+	for _, b := range config.Buckets {
+		if b.Name == "" {
+			return nil, fmt.Errorf("pool bucket has no name")
+		}
+		if b.MinSize < 0 || b.MaxSize < b.MinSize {
+			return nil, fmt.Errorf("pool bucket %s: min size %d must be between 0 and max size %d", b.Name, b.MinSize, b.MaxSize)
+		}
+		for _, existing := range buckets {
+			if existing.name == b.Name {
+				return nil, fmt.Errorf("duplicate pool bucket %s", b.Name)
+			}
+		}
+
+		vmConfig := config.DefaultVMConfig
+		if b.VcpuCount > 0 {
+			vmConfig.VcpuCount = b.VcpuCount
+		}
+		if b.MemoryMB > 0 {
+			vmConfig.MemoryMB = b.MemoryMB
+		}
+		if b.KernelPath != "" {
+			vmConfig.KernelPath = b.KernelPath
+		}
+		vmConfig.Balloon = b.Resizable
+		shape := bucketShape(vmConfig)
+		if other, ok := shapes[shape]; ok {
+			return nil, fmt.Errorf("pool buckets %s and %s have the same shape", other, b.Name)
+		}
+		shapes[shape] = b.Name
+
+		buckets = append(buckets, &bucket{
+			name:      b.Name,
+			config:    vmConfig,
+			minSize:   b.MinSize,
+			maxSize:   b.MaxSize,
+			resizable: b.Resizable,
+			available: make(chan *domain.Sandbox, b.MaxSize),
+		})
+	}
+	// Idle VMs are ballooned down if that leaves them less memory
+	for _, b := range buckets {
+		if config.IdleMemoryMB > 0 && config.IdleMemoryMB < b.config.MemoryMB {
+			b.idleMemoryMB = config.IdleMemoryMB
+			b.config.Balloon = true
+		}
+	}
+
+	return buckets, nil
+}
+
+// bucketShape describes the shape of a bucket's VMs.
+func bucketShape(config domain.VMConfig) string {
+	return fmt.Sprintf("%d vCPU/%d MiB/%s", config.VcpuCount, config.MemoryMB, config.KernelPath)
+}
+
+// bucketFor returns the bucket whose VMs fit a workload, or nil if none
+// does. A bucket of the workload's shape is preferred; failing that, the
+// smallest resizable bucket its VMs can be sized down from.
+func (p *Pool) bucketFor(config domain.VMConfig) *bucket {
+	config = p.manager.withDefaults(config)
+
+	var smallest *bucket
+	for _, b := range p.buckets {
+		boot := p.manager.withDefaults(b.config)
+		if sameShape(config, boot) {
+			return b
+		}
+		if b.resizable && canResize(boot, config) &&
+			(smallest == nil || boot.MemoryMB < smallest.config.MemoryMB ||
+				(boot.MemoryMB == smallest.config.MemoryMB && boot.VcpuCount < smallest.config.VcpuCount)) {
+			smallest = b
+		}
+	}
+	return smallest
+}
+
+// bucketForGeneration returns the bucket whose VMs are of the given
+// generation, or nil if the generation is outdated.
+func (p *Pool) bucketForGeneration(generation string) *bucket {
+	for _, b := range p.buckets {
+		if p.generation(b.config) == generation {
+			return b
+		}
+	}
+	return nil
+}
+
 // Acquire gets a pre-warmed VM from the pool, or creates a new one if empty.
 // This is the hot path - needs to be fast.
 func (p *Pool) Acquire(ctx context.Context, config domain.VMConfig) (*domain.Sandbox, error) {
+	p.mu.Lock()
+	draining := p.draining || p.closed
+	p.mu.Unlock()
+	if draining {
+		return nil, ErrPoolDraining
+	}
+
+	if err := p.manager.chaos.acquireDelay(ctx); err != nil {
+		return nil, err
+	}
+
 	atomic.AddInt64(&p.stats.totalServed, 1)
 
-	// Try to get from pool first (non-blocking)
-	select {
-	case sandbox := <-p.available:
-		atomic.AddInt64(&p.stats.poolHits, 1)
-		p.log.WithField("sandbox_id", sandbox.ID).Debug("Acquired VM from pool")
+	// Try to get from pool first (non-blocking). Pooled VMs can't be
+	// resized or rebooted, so workloads need a bucket of their shape.
+	var sandbox *domain.Sandbox
+	b := p.bucketFor(config)
+	if b != nil {
+		sandbox = p.takeAvailable(b, config)
+	}
+	if sandbox == nil {
+		// No usable VM in the pool, create fresh
+		atomic.AddInt64(&p.stats.poolMisses, 1)
+		metrics.Global().RecordPoolMiss()
+		if b != nil {
+			atomic.AddInt64(&b.misses, 1)
+			metrics.Global().RecordPoolBucketMiss(b.name)
+		}
+		p.log.WithFields(logrus.Fields{
+			"vcpus":     config.VcpuCount,
+			"memory_mb": config.MemoryMB,
+		}).Debug("No usable VM in pool, creating fresh VM")
+		return p.createFresh(ctx, config)
+	}
 
-		// Mark as in-use
+	atomic.AddInt64(&p.stats.poolHits, 1)
+	atomic.AddInt64(&b.hits, 1)
+	metrics.Global().RecordPoolHit()
+	metrics.Global().RecordPoolBucketHit(b.name)
+	p.log.WithFields(logrus.Fields{
+		"sandbox_id":  sandbox.ID,
+		"bucket":      b.name,
+		"reuse_count": sandbox.ReuseCount,
+	}).Debug("Acquired VM from pool")
+
+	// Mark as in-use
+	p.mu.Lock()
+	sandbox.FromPool = true
+	recordUse(sandbox, config)
+	p.inUse[sandbox.ID] = sandbox
+	p.mu.Unlock()
+	// The bucket may have just fallen below its minimum size
+	p.publishMetrics()
+
+	// Size the VM for this workload and customize it
+	sandboxDir := filepath.Join(p.manager.config.RuntimeDir, sandbox.ID)
+	acquireStart := time.Now()
+	err := p.resize(ctx, sandbox, b, config)
+	if err == nil {
+		rootfsStart := time.Now()
+		err = p.customizeVM(ctx, sandbox, config)
+		trace.Record(sandboxDir, trace.PhaseRootfsAttach, rootfsStart, err)
+	}
+	trace.Record(sandboxDir, trace.PhasePoolAcquire, acquireStart, err)
+	if err != nil {
+		// Failed to prepare, destroy and create fresh
+		p.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to prepare pooled VM, creating fresh VM")
 		p.mu.Lock()
-		sandbox.FromPool = true
-		p.inUse[sandbox.ID] = sandbox
+		delete(p.inUse, sandbox.ID)
 		p.mu.Unlock()
+		_ = p.manager.DestroyVM(ctx, sandbox)
+		return p.createFresh(ctx, config)
+	}
+
+	return sandbox, nil
+}
 
-		// Customize the VM for this workload
-		if err := p.customizeVM(ctx, sandbox, config); err != nil {
-			// Failed to customize, destroy and create fresh
-			_ = p.manager.DestroyVM(ctx, sandbox)
-			return p.createFresh(ctx, config)
+// resize gives an acquired VM the memory its workload needs: all of its
+// boot memory, or for resizable buckets the workload's. Surplus vCPUs of
+// VMs from resizable buckets are left for the guest agent to take offline.
+func (p *Pool) resize(ctx context.Context, sandbox *domain.Sandbox, b *bucket, config domain.VMConfig) error {
+	if !b.config.Balloon {
+		return nil
+	}
+
+	memoryMB := b.config.MemoryMB
+	if b.resizable && config.MemoryMB > 0 {
+		memoryMB = config.MemoryMB
+	}
+	if err := p.manager.ResizeVM(ctx, sandbox, b.config.MemoryMB, memoryMB); err != nil {
+		return err
+	}
+	sandbox.Resized = b.resizable
+
+	p.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"bucket":     b.name,
+		"memory_mb":  memoryMB,
+		"vcpus":      config.VcpuCount,
+	}).Debug("Resized pooled VM")
+	return nil
+}
+
+// shrinkIdle balloons a VM entering a bucket down to the bucket's idle
+// memory, so idle VMs don't hold memory no workload uses yet.
+func (p *Pool) shrinkIdle(ctx context.Context, sandbox *domain.Sandbox, b *bucket) error {
+	if b.idleMemoryMB == 0 {
+		return nil
+	}
+	return p.manager.ResizeVM(ctx, sandbox, b.config.MemoryMB, b.idleMemoryMB)
+}
+
+// takeAvailable removes the first ready VM of a bucket the workload may
+// use. Stale VMs found on the way are retired; degraded VMs and VMs the
+// workload must avoid stay pooled.
+func (p *Pool) takeAvailable(b *bucket, config domain.VMConfig) *domain.Sandbox {
+	generation := p.generation(b.config)
+
+	var avoided []*domain.Sandbox
+	defer func() {
+		for _, sandbox := range avoided {
+			select {
+			case b.available <- sandbox:
+			default:
+				go p.retire(sandbox, "bucket full")
+			}
 		}
+	}()
 
-		return sandbox, nil
+	for n := len(b.available); n > 0; n-- {
+		var sandbox *domain.Sandbox
+		select {
+		case sandbox = <-b.available:
+		default:
+			return nil
+		}
 
-	default:
-		// Pool empty, create fresh
-		atomic.AddInt64(&p.stats.poolMisses, 1)
-		p.log.Debug("Pool empty, creating fresh VM")
-		return p.createFresh(ctx, config)
+		if sandbox.Generation != generation {
+			p.log.WithFields(logrus.Fields{
+				"sandbox_id": sandbox.ID,
+				"generation": sandbox.Generation,
+				"current":    generation,
+			}).Info("Retiring pooled VM from an old generation")
+			go p.retire(sandbox, "old generation")
+			continue
+		}
+		if p.manager.stopped(sandbox) {
+			p.log.WithField("sandbox_id", sandbox.ID).Info("Discarding pooled VM whose VMM exited")
+			go p.retire(sandbox, errVMMExited.Error())
+			continue
+		}
+		if p.stateOf(sandbox.ID) != PoolVMReady || !canReuse(sandbox, config) {
+			avoided = append(avoided, sandbox)
+			continue
+		}
+
+		// Acquired VMs leave the pool's state machine
+		p.mu.Lock()
+		delete(p.vms, sandbox.ID)
+		p.mu.Unlock()
+		return sandbox
 	}
+	return nil
+}
+
+// generation returns the generation of VMs booted with the given config.
+func (p *Pool) generation(config domain.VMConfig) string {
+	return Generation(p.manager.withDefaults(config), p.config.Generation)
+}
+
+// destroyPooled destroys a VM that was taken out of the pool.
+func (p *Pool) destroyPooled(sandbox *domain.Sandbox) {
+	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
+	defer cancel()
+	_ = p.manager.DestroyVM(ctx, sandbox)
 }
 
 // Release returns a VM to the pool or destroys it.
@@ -143,12 +548,29 @@ func (p *Pool) Release(ctx context.Context, sandbox *domain.Sandbox) error {
 	defer p.mu.Unlock()
 
 	delete(p.inUse, sandbox.ID)
+	p.notifyReleased()
 
-	// Check if pool is full or VM is too old
-	poolSize := len(p.available)
+	// Don't return VMs to a pool that is shutting down
+	if p.draining || p.closed {
+		return p.manager.DestroyVM(ctx, sandbox)
+	}
+
+	// VMs go back to the bucket of their generation; VMs of none boot
+	// outdated images or were created for a workload no bucket fits
+	b := p.bucketForGeneration(sandbox.Generation)
+	if b == nil {
+		p.log.WithFields(logrus.Fields{
+			"sandbox_id": sandbox.ID,
+			"generation": sandbox.Generation,
+		}).Debug("Destroying VM from an old generation")
+		return p.manager.DestroyVM(ctx, sandbox)
+	}
+
+	// Check if the bucket is full or VM is too old
+	poolSize := len(b.available)
 	vmAge := time.Since(sandbox.CreatedAt)
 
-	if poolSize >= p.config.MaxSize || vmAge > p.config.MaxIdleTime {
+	if poolSize >= b.maxSize || vmAge > p.config.MaxIdleTime {
 		p.log.WithFields(logrus.Fields{
 			"sandbox_id": sandbox.ID,
 			"pool_size":  poolSize,
@@ -157,28 +579,86 @@ func (p *Pool) Release(ctx context.Context, sandbox *domain.Sandbox) error {
 		return p.manager.DestroyVM(ctx, sandbox)
 	}
 
+	// Retire VMs that were reused enough
+	if p.config.MaxReuse > 0 && sandbox.ReuseCount >= p.config.MaxReuse {
+		p.log.WithFields(logrus.Fields{
+			"sandbox_id":  sandbox.ID,
+			"reuse_count": sandbox.ReuseCount,
+		}).Debug("Destroying VM that reached its reuse limit")
+		return p.manager.DestroyVM(ctx, sandbox)
+	}
+
 	// Reset the VM state for reuse
+	p.track(sandbox, b, time.Now(), "released by its workload")
 	if err := p.resetVM(ctx, sandbox); err != nil {
 		p.log.WithError(err).Warn("Failed to reset VM, destroying")
+		p.transition(sandbox.ID, PoolVMRetired, "reset failed")
+		return p.manager.DestroyVM(ctx, sandbox)
+	}
+	if err := p.shrinkIdle(ctx, sandbox, b); err != nil {
+		p.log.WithError(err).Warn("Failed to balloon idle VM, destroying")
+		p.transition(sandbox.ID, PoolVMRetired, "ballooning failed")
 		return p.manager.DestroyVM(ctx, sandbox)
 	}
 
 	// Return to pool
 	sandbox.PooledAt = time.Now()
-	select {
-	case p.available <- sandbox:
-		p.log.WithField("sandbox_id", sandbox.ID).Debug("Returned VM to pool")
-	default:
+	sandbox.ReuseCount++
+	if !p.enqueue(b, sandbox) {
 		// Pool full (race condition), destroy
-		_ = p.manager.DestroyVM(ctx, sandbox)
+		return p.manager.DestroyVM(ctx, sandbox)
 	}
+	p.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"bucket":     b.name,
+	}).Debug("Returned VM to pool")
 
 	return nil
 }
 
-// Warm adds pre-warmed VMs to the pool.
+// Adopt registers a recovered sandbox as in-use so that it is released and
+// cleaned up through the pool like any other acquired VM.
+func (p *Pool) Adopt(sandbox *domain.Sandbox) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse[sandbox.ID] = sandbox
+}
+
+// Discard destroys an in-use VM without returning it to the pool.
+// Used for VMs that are known to be broken and must not be reused.
+func (p *Pool) Discard(ctx context.Context, sandbox *domain.Sandbox) error {
+	p.mu.Lock()
+	delete(p.inUse, sandbox.ID)
+	p.notifyReleased()
+	p.mu.Unlock()
+
+	p.log.WithField("sandbox_id", sandbox.ID).Info("Discarding VM")
+	return p.manager.DestroyVM(ctx, sandbox)
+}
+
+// Warm adds pre-warmed VMs to the bucket of the given shape.
 func (p *Pool) Warm(ctx context.Context, count int, config domain.VMConfig) error {
-	p.log.WithField("count", count).Info("Warming VM pool")
+	b := p.bucketFor(config)
+	if b == nil {
+		return fmt.Errorf("no pool bucket for %d vCPU, %d MiB VMs", config.VcpuCount, config.MemoryMB)
+	}
+	return p.warm(ctx, b, count)
+}
+
+// warm adds pre-warmed VMs to a bucket.
+func (p *Pool) warm(ctx context.Context, b *bucket, count int) error {
+	// The base may have been replaced since it was last verified
+	if path := b.config.RootDrive.PathOnHost; path != "" {
+		if err := p.base.verify(path); err != nil {
+			p.log.WithError(err).WithField("bucket", b.name).Error("Not warming VMs from an unverified base rootfs")
+			return err
+		}
+	}
+
+	p.log.WithFields(logrus.Fields{
+		"bucket": b.name,
+		"count":  count,
+	}).Info("Warming VM pool")
 
 	var wg sync.WaitGroup
 	errChan := make(chan error, count)
@@ -195,21 +675,46 @@ func (p *Pool) Warm(ctx context.Context, count int, config domain.VMConfig) erro
 			}
 			defer p.warmSem.Release(1)
 
-			sandbox, err := p.manager.CreateVM(ctx, config)
+			warmStart := time.Now()
+			sandbox, err := p.manager.CreateVM(ctx, b.config)
 			if err != nil {
 				errChan <- err
 				return
 			}
+			p.mu.Lock()
+			p.track(sandbox, b, warmStart, "booted")
+			p.mu.Unlock()
+			if err := p.shrinkIdle(ctx, sandbox, b); err != nil {
+				p.mu.Lock()
+				p.transition(sandbox.ID, PoolVMRetired, "ballooning failed")
+				p.mu.Unlock()
+				_ = p.manager.DestroyVM(ctx, sandbox)
+				errChan <- err
+				return
+			}
 
 			sandbox.PooledAt = time.Now()
+			sandbox.Generation = p.generation(b.config)
 
-			select {
-			case p.available <- sandbox:
-				p.log.WithField("sandbox_id", sandbox.ID).Debug("Added warmed VM to pool")
-			default:
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			if p.draining || p.closed {
+				p.transition(sandbox.ID, PoolVMRetired, "pool draining")
+				_ = p.manager.DestroyVM(ctx, sandbox)
+				return
+			}
+
+			if !p.enqueue(b, sandbox) {
 				// Pool full
 				_ = p.manager.DestroyVM(ctx, sandbox)
+				return
 			}
+			metrics.Global().RecordPoolWarmTime(time.Since(warmStart))
+			p.log.WithFields(logrus.Fields{
+				"sandbox_id": sandbox.ID,
+				"bucket":     b.name,
+			}).Debug("Added warmed VM to pool")
 		}()
 	}
 
@@ -234,14 +739,80 @@ func (p *Pool) Stats() domain.PoolStats {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	return domain.PoolStats{
-		Available:   len(p.available),
+	stats := domain.PoolStats{
 		InUse:       len(p.inUse),
-		MaxSize:     p.config.MaxSize,
 		TotalServed: atomic.LoadInt64(&p.stats.totalServed),
 		PoolHits:    atomic.LoadInt64(&p.stats.poolHits),
 		PoolMisses:  atomic.LoadInt64(&p.stats.poolMisses),
 	}
+	for _, b := range p.buckets {
+		states := p.countStates(b)
+		bucketStats := domain.PoolBucketStats{
+			Name:      b.name,
+			VcpuCount: b.config.VcpuCount,
+			MemoryMB:  b.config.MemoryMB,
+			Available: states[PoolVMReady],
+			Warming:   states[PoolVMWarming],
+			Degraded:  states[PoolVMDegraded],
+			MinSize:   b.minSize,
+			MaxSize:   b.maxSize,
+			Hits:      atomic.LoadInt64(&b.hits),
+			Misses:    atomic.LoadInt64(&b.misses),
+		}
+		if b.idleMemoryMB > 0 {
+			// Warming VMs may not be ballooned down yet
+			bucketStats.ReclaimedMB = int64(bucketStats.Available+bucketStats.Degraded) * (b.config.MemoryMB - b.idleMemoryMB)
+		}
+		generation := p.generation(b.config)
+		for _, sandbox := range p.inUse {
+			if sandbox.Generation == generation {
+				bucketStats.InUse++
+			}
+		}
+
+		stats.Available += bucketStats.Available
+		stats.Warming += bucketStats.Warming
+		stats.Degraded += bucketStats.Degraded
+		if bucketStats.Available < bucketStats.MinSize {
+			stats.ReplenishBacklog += bucketStats.MinSize - bucketStats.Available
+		}
+		stats.ReclaimedMB += bucketStats.ReclaimedMB
+		idle := int64(bucketStats.Available + bucketStats.Warming + bucketStats.Degraded)
+		stats.ReservedVCPUs += idle * bucketStats.VcpuCount
+		stats.ReservedMemoryMB += idle*bucketStats.MemoryMB - bucketStats.ReclaimedMB
+		stats.MaxSize += bucketStats.MaxSize
+		stats.Buckets = append(stats.Buckets, bucketStats)
+	}
+	return stats
+}
+
+// publishMetrics exports the pool statistics.
+func (p *Pool) publishMetrics() {
+	stats := p.Stats()
+	collector := metrics.Global()
+	collector.SetPoolStats(int64(stats.Available), int64(stats.InUse), int64(stats.MaxSize))
+	collector.SetPoolReservation(stats.ReservedVCPUs, stats.ReservedMemoryMB)
+	for _, b := range stats.Buckets {
+		collector.SetPoolBucketStats(b.Name, int64(b.Available), int64(b.InUse), int64(b.MinSize), int64(b.MaxSize))
+		collector.SetPoolBucketReclaimedMemory(b.Name, b.ReclaimedMB)
+	}
+
+	p.mu.Lock()
+	if stats.ReplenishBacklog == 0 {
+		p.belowMinSince = time.Time{}
+	} else if p.belowMinSince.IsZero() {
+		p.belowMinSince = time.Now()
+	}
+	belowMinSince := p.belowMinSince
+	p.mu.Unlock()
+	collector.SetPoolReplenishState(int64(stats.ReplenishBacklog), belowMinSince)
+}
+
+// Draining reports whether the pool has stopped handing out VMs.
+func (p *Pool) Draining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining || p.closed
 }
 
 // Close shuts down the pool and all VMs.
@@ -259,10 +830,15 @@ func (p *Pool) Close(ctx context.Context) error {
 	p.log.Info("Closing VM pool")
 
 	// Destroy all available VMs
-	close(p.available)
-	for sandbox := range p.available {
-		if err := p.manager.DestroyVM(ctx, sandbox); err != nil {
-			p.log.WithError(err).Warn("Error destroying pooled VM")
+	for _, b := range p.buckets {
+		close(b.available)
+		for sandbox := range b.available {
+			p.mu.Lock()
+			p.transition(sandbox.ID, PoolVMRetired, "pool closed")
+			p.mu.Unlock()
+			if err := p.manager.DestroyVM(ctx, sandbox); err != nil {
+				p.log.WithError(err).Warn("Error destroying pooled VM")
+			}
 		}
 	}
 
@@ -278,14 +854,176 @@ func (p *Pool) Close(ctx context.Context) error {
 	return nil
 }
 
+// Drain gracefully shuts down the pool. It stops accepting acquisitions,
+// destroys idle VMs in parallel, and waits up to ShutdownTimeout (or the
+// context deadline, if sooner) for in-use VMs to be released. VMs still in
+// use at the deadline are force-killed and listed in the report.
+func (p *Pool) Drain(ctx context.Context) (*DrainReport, error) {
+	start := time.Now()
+	report := &DrainReport{}
+
+	p.mu.Lock()
+	if p.draining || p.closed {
+		p.mu.Unlock()
+		return report, nil
+	}
+	p.draining = true
+	inUse := len(p.inUse)
+	p.mu.Unlock()
+
+	p.cancel() // Stop background loops
+
+	p.log.WithField("in_use", inUse).Info("Draining VM pool")
+
+	// Destroy idle VMs; nothing can be added to the pool while draining
+	var idle []*domain.Sandbox
+	for _, b := range p.buckets {
+	collect:
+		for {
+			select {
+			case sandbox := <-b.available:
+				p.mu.Lock()
+				p.transition(sandbox.ID, PoolVMRetired, "pool draining")
+				p.mu.Unlock()
+				idle = append(idle, sandbox)
+			default:
+				break collect
+			}
+		}
+	}
+	report.IdleDestroyed, report.Errors = p.destroyAll(ctx, idle)
+
+	// Wait for in-use VMs to be released
+	timeout := p.config.ShutdownTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+wait:
+	for {
+		p.mu.Lock()
+		remaining := len(p.inUse)
+		p.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+
+		select {
+		case <-p.released:
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	// Force-kill whatever is still in use
+	p.mu.Lock()
+	p.closed = true
+	var stuck []*domain.Sandbox
+	for id, sandbox := range p.inUse {
+		stuck = append(stuck, sandbox)
+		report.ForceKilled = append(report.ForceKilled, id)
+		delete(p.inUse, id)
+	}
+	p.mu.Unlock()
+
+	// Acquisitions racing the start of the drain can add to inUse
+	if released := inUse - len(stuck); released > 0 {
+		report.Released = released
+	}
+
+	// Use a fresh context: the caller's may already be expired, and
+	// leaking VMs is worse than overrunning the deadline.
+	killCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, killErrors := p.destroyAll(killCtx, stuck)
+	report.Errors += killErrors
+
+	report.Duration = time.Since(start)
+
+	log := p.log.WithFields(logrus.Fields{
+		"idle_destroyed": report.IdleDestroyed,
+		"released":       report.Released,
+		"force_killed":   len(report.ForceKilled),
+		"errors":         report.Errors,
+		"duration":       report.Duration,
+	})
+	if len(report.ForceKilled) > 0 {
+		log.WithField("sandbox_ids", report.ForceKilled).Warn("VM pool drained with force-killed VMs")
+	} else {
+		log.Info("VM pool drained")
+	}
+
+	if report.Errors > 0 {
+		return report, fmt.Errorf("failed to destroy %d VMs", report.Errors)
+	}
+	return report, nil
+}
+
+// destroyAll destroys the given VMs in parallel, bounded by
+// DrainConcurrency. It returns the number destroyed and the number failed.
+func (p *Pool) destroyAll(ctx context.Context, sandboxes []*domain.Sandbox) (int, int) {
+	concurrency := p.config.DrainConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := semaphore.NewWeighted(int64(concurrency))
+
+	var (
+		wg        sync.WaitGroup
+		destroyed int64
+		failed    int64
+	)
+	for _, sandbox := range sandboxes {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			// Out of time; destroy the rest serially rather than leak them
+			if err := p.manager.DestroyVM(context.Background(), sandbox); err != nil {
+				atomic.AddInt64(&failed, 1)
+			} else {
+				atomic.AddInt64(&destroyed, 1)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(sandbox *domain.Sandbox) {
+			defer wg.Done()
+			defer sem.Release(1)
+
+			if err := p.manager.DestroyVM(ctx, sandbox); err != nil {
+				p.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Error destroying VM")
+				atomic.AddInt64(&failed, 1)
+				return
+			}
+			atomic.AddInt64(&destroyed, 1)
+		}(sandbox)
+	}
+	wg.Wait()
+
+	return int(destroyed), int(failed)
+}
+
+// notifyReleased wakes a pending Drain. Must be called with p.mu held.
+func (p *Pool) notifyReleased() {
+	select {
+	case p.released <- struct{}{}:
+	default:
+	}
+}
+
 // createFresh creates a new VM outside the pool.
 func (p *Pool) createFresh(ctx context.Context, config domain.VMConfig) (*domain.Sandbox, error) {
 	sandbox, err := p.manager.CreateVM(ctx, config)
 	if err != nil {
 		return nil, err
 	}
+	sandbox.Generation = p.generation(config)
 
 	p.mu.Lock()
+	recordUse(sandbox, config)
 	p.inUse[sandbox.ID] = sandbox
 	p.mu.Unlock()
 
@@ -335,20 +1073,29 @@ func (p *Pool) replenishLoop() {
 }
 
 func (p *Pool) replenish() {
-	currentSize := len(p.available)
+	defer p.publishMetrics()
+
+	for _, b := range p.buckets {
+		// Degraded VMs don't count: they may never be handed out again
+		p.mu.Lock()
+		states := p.countStates(b)
+		p.mu.Unlock()
+		currentSize := states[PoolVMReady] + states[PoolVMWarming]
+		if currentSize >= b.minSize {
+			continue
+		}
 
-	if currentSize < p.config.MinSize {
-		needed := p.config.MinSize - currentSize
+		needed := b.minSize - currentSize
 		p.log.WithFields(logrus.Fields{
+			"bucket":  b.name,
 			"current": currentSize,
-			"min":     p.config.MinSize,
+			"min":     b.minSize,
 			"needed":  needed,
 		}).Debug("Replenishing pool")
 
 		ctx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
-		defer cancel()
-
-		_ = p.Warm(ctx, needed, p.config.DefaultVMConfig)
+		_ = p.warm(ctx, b, needed)
+		cancel()
 	}
 }
 
@@ -368,21 +1115,25 @@ func (p *Pool) cleanupLoop() {
 }
 
 func (p *Pool) cleanupIdle() {
+	for _, b := range p.buckets {
+		p.cleanupIdleBucket(b)
+		p.checkBucketHealth(b)
+	}
+}
+
+func (p *Pool) cleanupIdleBucket(b *bucket) {
 	// Drain and re-add non-expired VMs
 	var keep []*domain.Sandbox
 
 	for {
 		select {
-		case sandbox := <-p.available:
+		case sandbox := <-b.available:
 			if time.Since(sandbox.PooledAt) > p.config.MaxIdleTime {
 				p.log.WithFields(logrus.Fields{
 					"sandbox_id": sandbox.ID,
 					"idle_time":  time.Since(sandbox.PooledAt),
 				}).Debug("Removing idle VM from pool")
-
-				ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
-				_ = p.manager.DestroyVM(ctx, sandbox)
-				cancel()
+				p.retire(sandbox, "idle timeout")
 			} else {
 				keep = append(keep, sandbox)
 			}
@@ -396,12 +1147,10 @@ refill:
 	// Put non-expired VMs back
 	for _, sandbox := range keep {
 		select {
-		case p.available <- sandbox:
+		case b.available <- sandbox:
 		default:
 			// Pool somehow full, destroy
-			ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
-			_ = p.manager.DestroyVM(ctx, sandbox)
-			cancel()
+			p.retire(sandbox, "bucket full")
 		}
 	}
 }
@@ -2,6 +2,9 @@ package vm
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -45,6 +48,14 @@ func (m *MockManager) StopVM(ctx context.Context, sandbox *domain.Sandbox) error
 func (m *MockManager) PauseVM(ctx context.Context, sandbox *domain.Sandbox) error  { return nil }
 func (m *MockManager) ResumeVM(ctx context.Context, sandbox *domain.Sandbox) error { return nil }
 
+// addWarm adds a VM to a bucket as if the pool had warmed it.
+func addWarm(pool *Pool, b *bucket, sandbox *domain.Sandbox) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.track(sandbox, b, time.Now(), "booted")
+	pool.enqueue(b, sandbox)
+}
+
 func TestNewPool(t *testing.T) {
 	log := logrus.NewEntry(logrus.New())
 	config := DefaultPoolConfig()
@@ -59,8 +70,8 @@ func TestNewPool(t *testing.T) {
 		t.Fatal("Returned nil pool")
 	}
 
-	if cap(pool.available) != config.MaxSize {
-		t.Errorf("Pool capacity = %d, want %d", cap(pool.available), config.MaxSize)
+	if cap(pool.buckets[0].available) != config.MaxSize {
+		t.Errorf("Pool capacity = %d, want %d", cap(pool.buckets[0].available), config.MaxSize)
 	}
 
 	// Clean up background workers
@@ -117,7 +128,7 @@ func TestPool_Stats(t *testing.T) {
 
 	// Manually inject a sandbox into available
 	sb := domain.NewSandbox("test-sb")
-	pool.available <- sb
+	addWarm(pool, pool.buckets[0], sb)
 
 	// Manually inject a sandbox into inUse
 	pool.inUse["used-sb"] = domain.NewSandbox("used-sb")
@@ -133,6 +144,47 @@ func TestPool_Stats(t *testing.T) {
 	if stats.MaxSize != 10 {
 		t.Errorf("Stats.MaxSize = %d, want 10", stats.MaxSize)
 	}
+	// One of the minimum three VMs is warm
+	if stats.ReplenishBacklog != 2 {
+		t.Errorf("Stats.ReplenishBacklog = %d, want 2", stats.ReplenishBacklog)
+	}
+}
+
+func TestPool_BelowMinSince(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.MinSize = 1
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, config, log)
+	defer pool.Close(context.Background())
+
+	pool.publishMetrics()
+	pool.mu.Lock()
+	since := pool.belowMinSince
+	pool.mu.Unlock()
+	if since.IsZero() {
+		t.Fatal("empty pool should be below its minimum size")
+	}
+
+	// Still short: keeps counting from when it first fell short
+	pool.publishMetrics()
+	pool.mu.Lock()
+	if !pool.belowMinSince.Equal(since) {
+		t.Errorf("belowMinSince moved from %v to %v while the pool stayed short", since, pool.belowMinSince)
+	}
+	pool.mu.Unlock()
+
+	addWarm(pool, pool.buckets[0], domain.NewSandbox("warm-sb"))
+	pool.publishMetrics()
+	pool.mu.Lock()
+	if !pool.belowMinSince.IsZero() {
+		t.Errorf("belowMinSince = %v after the pool reached its minimum size, want zero", pool.belowMinSince)
+	}
+	pool.mu.Unlock()
 }
 
 func TestPool_Release(t *testing.T) {
@@ -140,3 +192,328 @@ func TestPool_Release(t *testing.T) {
 	// Skipping integration-heavy tests until refactoring.
 	t.Skip("Skipping Release test due to hard dependency on Manager")
 }
+
+func TestPool_Drain(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.ShutdownTimeout = 50 * time.Millisecond
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, config, log)
+
+	addWarm(pool, pool.buckets[0], domain.NewSandbox("idle-sb"))
+	pool.inUse["released-sb"] = domain.NewSandbox("released-sb")
+	pool.inUse["stuck-sb"] = domain.NewSandbox("stuck-sb")
+
+	// Release one VM while the drain is waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = pool.Release(context.Background(), domain.NewSandbox("released-sb"))
+	}()
+
+	report, err := pool.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	if report.IdleDestroyed != 1 {
+		t.Errorf("IdleDestroyed = %d, want 1", report.IdleDestroyed)
+	}
+	if report.Released != 1 {
+		t.Errorf("Released = %d, want 1", report.Released)
+	}
+	if len(report.ForceKilled) != 1 || report.ForceKilled[0] != "stuck-sb" {
+		t.Errorf("ForceKilled = %v, want [stuck-sb]", report.ForceKilled)
+	}
+
+	if _, err := pool.Acquire(context.Background(), domain.DefaultVMConfig()); err != ErrPoolDraining {
+		t.Errorf("Acquire after drain error = %v, want ErrPoolDraining", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Available != 0 || stats.InUse != 0 {
+		t.Errorf("Stats after drain = %+v, want empty pool", stats)
+	}
+
+	// Close after Drain is a no-op
+	if err := pool.Close(context.Background()); err != nil {
+		t.Errorf("Close after Drain failed: %v", err)
+	}
+}
+
+func TestPool_AcquireHonorsIsolation(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, config, log)
+	defer pool.Close(context.Background())
+
+	current := pool.generation(config.DefaultVMConfig)
+
+	stale := domain.NewSandbox("stale-sb")
+	stale.Generation = "old"
+	used := domain.NewSandbox("used-sb")
+	used.Generation = current
+	used.UsedBy = []string{"tenant-b"}
+	addWarm(pool, pool.buckets[0], stale)
+	addWarm(pool, pool.buckets[0], used)
+
+	// tenant-a refuses VMs tenant-b ran in; the stale VM is retired
+	workload := domain.VMConfig{Namespace: "tenant-a", AvoidNamespaces: []string{"tenant-b"}}
+	if sandbox := pool.takeAvailable(pool.buckets[0], workload); sandbox != nil {
+		t.Fatalf("takeAvailable returned %s, want none", sandbox.ID)
+	}
+	if len(pool.buckets[0].available) != 1 {
+		t.Fatalf("pool holds %d VMs, want only the avoided one", len(pool.buckets[0].available))
+	}
+
+	// Another workload may still use it
+	workload = domain.VMConfig{Namespace: "tenant-c"}
+	sandbox := pool.takeAvailable(pool.buckets[0], workload)
+	if sandbox == nil || sandbox.ID != "used-sb" {
+		t.Fatalf("takeAvailable = %v, want used-sb", sandbox)
+	}
+
+	recordUse(sandbox, workload)
+	if len(sandbox.UsedBy) != 2 || sandbox.UsedBy[1] != "tenant-c" {
+		t.Errorf("UsedBy = %v, want [tenant-b tenant-c]", sandbox.UsedBy)
+	}
+}
+
+func TestPool_ReleaseRetiresReusedVMs(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.MaxReuse = 1
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, config, log)
+	defer pool.Close(context.Background())
+
+	sandbox := domain.NewSandbox("reused-sb")
+	sandbox.Generation = pool.generation(config.DefaultVMConfig)
+
+	// The first release pools the VM for one more workload
+	pool.inUse[sandbox.ID] = sandbox
+	if err := pool.Release(context.Background(), sandbox); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if len(pool.buckets[0].available) != 1 || sandbox.ReuseCount != 1 {
+		t.Fatalf("after first release: pooled %d, reuse count %d", len(pool.buckets[0].available), sandbox.ReuseCount)
+	}
+
+	// After that it has been reused as often as allowed
+	<-pool.buckets[0].available
+	pool.inUse[sandbox.ID] = sandbox
+	if err := pool.Release(context.Background(), sandbox); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if len(pool.buckets[0].available) != 0 {
+		t.Error("VM past its reuse limit was returned to the pool")
+	}
+}
+
+func TestPool_Buckets(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.Buckets = []PoolBucket{
+		{Name: "large", VcpuCount: 2, MemoryMB: 1024, MinSize: 1, MaxSize: 2},
+	}
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, err := NewPool(mgr, config, log)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.Close(context.Background())
+
+	large := pool.buckets[1]
+	if cap(large.available) != 2 {
+		t.Errorf("large bucket capacity = %d, want 2", cap(large.available))
+	}
+
+	// Workloads are matched to the bucket of their shape
+	workload := domain.DefaultVMConfig()
+	if b := pool.bucketFor(workload); b == nil || b.name != DefaultBucketName {
+		t.Errorf("default workload matched %v, want default bucket", b)
+	}
+	workload.VcpuCount, workload.MemoryMB = 2, 1024
+	if b := pool.bucketFor(workload); b != large {
+		t.Errorf("2 vCPU/1 GiB workload matched %v, want large bucket", b)
+	}
+	workload.MemoryMB = 2048
+	if b := pool.bucketFor(workload); b != nil {
+		t.Errorf("2 vCPU/2 GiB workload matched bucket %s, want none", b.name)
+	}
+
+	// Released VMs go back to the bucket of their generation
+	sandbox := domain.NewSandbox("large-sb")
+	sandbox.Generation = pool.generation(large.config)
+	pool.inUse[sandbox.ID] = sandbox
+	if err := pool.Release(context.Background(), sandbox); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if len(large.available) != 1 || len(pool.buckets[0].available) != 0 {
+		t.Errorf("after release: large %d, default %d, want 1 and 0", len(large.available), len(pool.buckets[0].available))
+	}
+
+	stats := pool.Stats()
+	if stats.Available != 1 || stats.MaxSize != config.MaxSize+2 || len(stats.Buckets) != 2 {
+		t.Fatalf("Stats = %+v", stats)
+	}
+	if b := stats.Buckets[1]; b.Name != "large" || b.VcpuCount != 2 || b.MemoryMB != 1024 || b.Available != 1 || b.MinSize != 1 {
+		t.Errorf("large bucket stats = %+v", b)
+	}
+}
+
+func TestNewPool_InvalidBuckets(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	tests := []struct {
+		name    string
+		buckets []PoolBucket
+	}{
+		{"unnamed", []PoolBucket{{VcpuCount: 2, MaxSize: 1}}},
+		{"duplicate name", []PoolBucket{{Name: DefaultBucketName, VcpuCount: 2, MaxSize: 1}}},
+		{"min above max", []PoolBucket{{Name: "large", VcpuCount: 2, MinSize: 3, MaxSize: 1}}},
+		{"same shape", []PoolBucket{
+			{Name: "large", VcpuCount: 2, MaxSize: 1},
+			{Name: "also-large", VcpuCount: 2, MaxSize: 1},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultPoolConfig()
+			config.Buckets = tt.buckets
+			if _, err := NewPool(&Manager{}, config, log); err == nil {
+				t.Error("NewPool() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestPool_ResizableBuckets(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.Buckets = []PoolBucket{
+		{Name: "xlarge", VcpuCount: 8, MemoryMB: 8192, MaxSize: 1, Resizable: true},
+		{Name: "large", VcpuCount: 4, MemoryMB: 4096, MaxSize: 1, Resizable: true},
+		{Name: "fixed", VcpuCount: 2, MemoryMB: 1024, MaxSize: 1},
+	}
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, err := NewPool(mgr, config, log)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.Close(context.Background())
+
+	tests := []struct {
+		vcpus    int64
+		memoryMB int64
+		want     string
+	}{
+		{2, 1024, "fixed"},  // exact shape wins
+		{2, 2048, "large"},  // smallest resizable bucket that fits
+		{6, 2048, "xlarge"}, // too many vCPUs for large
+		{16, 2048, ""},      // no bucket fits
+	}
+	for _, tt := range tests {
+		workload := domain.DefaultVMConfig()
+		workload.VcpuCount, workload.MemoryMB = tt.vcpus, tt.memoryMB
+		got := ""
+		if b := pool.bucketFor(workload); b != nil {
+			got = b.name
+		}
+		if got != tt.want {
+			t.Errorf("bucketFor(%d vCPU, %d MiB) = %q, want %q", tt.vcpus, tt.memoryMB, got, tt.want)
+		}
+	}
+
+	if !pool.buckets[1].config.Balloon || pool.buckets[3].config.Balloon {
+		t.Error("only resizable buckets boot VMs with a balloon")
+	}
+}
+
+func TestPool_IdleBallooning(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	config := DefaultPoolConfig()
+	config.IdleMemoryMB = 256
+	config.Buckets = []PoolBucket{
+		{Name: "large", VcpuCount: 2, MemoryMB: 2048, MaxSize: 2},
+	}
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, err := NewPool(mgr, config, log)
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer pool.Close(context.Background())
+
+	// Default VMs are already smaller than the idle memory
+	if b := pool.buckets[0]; b.idleMemoryMB != 0 || b.config.Balloon {
+		t.Errorf("default bucket idle memory = %d, balloon %v, want neither", b.idleMemoryMB, b.config.Balloon)
+	}
+	large := pool.buckets[1]
+	if large.idleMemoryMB != 256 || !large.config.Balloon {
+		t.Fatalf("large bucket idle memory = %d, balloon %v, want 256 with a balloon", large.idleMemoryMB, large.config.Balloon)
+	}
+
+	addWarm(pool, large, domain.NewSandbox("idle-1"))
+	addWarm(pool, large, domain.NewSandbox("idle-2"))
+	stats := pool.Stats()
+	if stats.ReclaimedMB != 2*(2048-256) || stats.Buckets[1].ReclaimedMB != stats.ReclaimedMB {
+		t.Errorf("ReclaimedMB = %d (bucket %d), want %d", stats.ReclaimedMB, stats.Buckets[1].ReclaimedMB, 2*(2048-256))
+	}
+
+	// Idle VMs only hold the memory left to them
+	if stats.ReservedVCPUs != 2*2 || stats.ReservedMemoryMB != 2*256 {
+		t.Errorf("reserved = %d vCPU/%d MiB, want 4 vCPU/512 MiB", stats.ReservedVCPUs, stats.ReservedMemoryMB)
+	}
+}
+
+func TestNewPool_BaseRootfs(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	path := filepath.Join(t.TempDir(), "base.ext4")
+	if err := os.WriteFile(path, []byte("base image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultPoolConfig()
+	config.DefaultVMConfig.RootDrive = domain.DriveConfig{DriveID: "rootfs", PathOnHost: path, IsRoot: true}
+
+	// Without copy-on-write every warm VM would write to the base
+	if _, err := NewPool(&Manager{}, config, log); err == nil {
+		t.Error("NewPool() sharing a writable base succeeded, want error")
+	}
+
+	manager := &Manager{config: ManagerConfig{RootfsCoW: DefaultRootfsCoWConfig()}}
+	config.BaseRootfsSHA256 = strings.Repeat("0", 64)
+	if _, err := NewPool(manager, config, log); err == nil {
+		t.Error("NewPool() with a mismatched base succeeded, want error")
+	}
+
+	config.BaseRootfsSHA256 = "sha256:base"
+	if _, err := NewPool(manager, config, log); err == nil {
+		t.Error("NewPool() with an invalid checksum succeeded, want error")
+	}
+}
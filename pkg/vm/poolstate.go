@@ -0,0 +1,266 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// PoolVMState is where a pooled VM is in its life in the pool. Only ready
+// VMs are handed out.
+type PoolVMState string
+
+const (
+	PoolVMWarming  PoolVMState = "warming"  // Booted or released, being readied for the pool
+	PoolVMReady    PoolVMState = "ready"    // Waiting in its bucket to be acquired
+	PoolVMDegraded PoolVMState = "degraded" // Failed a health check; retired if it fails the next
+	PoolVMRetired  PoolVMState = "retired"  // Taken out of the pool to be destroyed
+)
+
+// poolTransitions are the transitions a pooled VM may make. A ready VM
+// leaves the state machine when it is acquired.
+var poolTransitions = map[PoolVMState][]PoolVMState{
+	PoolVMWarming:  {PoolVMReady, PoolVMRetired},
+	PoolVMReady:    {PoolVMDegraded, PoolVMRetired},
+	PoolVMDegraded: {PoolVMReady, PoolVMRetired},
+}
+
+const (
+	// maxPoolVMTransitions bounds the transitions kept per VM, so a VM
+	// flapping between ready and degraded doesn't grow without bound.
+	maxPoolVMTransitions = 16
+
+	// maxRetiredPoolVMs is how many retired VMs Inspect still reports.
+	maxRetiredPoolVMs = 32
+)
+
+// PoolVM is the state of a VM in the pool, as reported by Inspect.
+type PoolVM struct {
+	ID     string
+	Bucket string
+	State  PoolVMState
+	Since  time.Time // When the VM entered State
+	Reason string    // Why the VM entered State
+
+	// Transitions lists the VM's transitions, oldest first.
+	Transitions []PoolVMTransition
+}
+
+// PoolVMTransition is a pooled VM's move from one state to another.
+type PoolVMTransition struct {
+	From   PoolVMState // Empty for the VM entering the pool
+	To     PoolVMState
+	At     time.Time
+	Reason string
+}
+
+// canTransition reports whether a pooled VM may move from one state to
+// another.
+func canTransition(from, to PoolVMState) bool {
+	for _, next := range poolTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// track starts tracking a VM entering the pool in the warming state.
+// Must be called with p.mu held.
+func (p *Pool) track(sandbox *domain.Sandbox, b *bucket, since time.Time, reason string) {
+	p.vms[sandbox.ID] = &PoolVM{
+		ID:          sandbox.ID,
+		Bucket:      b.name,
+		State:       PoolVMWarming,
+		Since:       since,
+		Reason:      reason,
+		Transitions: []PoolVMTransition{{To: PoolVMWarming, At: since, Reason: reason}},
+	}
+}
+
+// transition moves a tracked VM to another state, reporting whether it
+// could. Retired VMs stop being tracked and go to the retired history.
+// Must be called with p.mu held.
+func (p *Pool) transition(id string, to PoolVMState, reason string) bool {
+	vm, ok := p.vms[id]
+	if !ok {
+		return false
+	}
+	if !canTransition(vm.State, to) {
+		p.log.WithFields(logrus.Fields{
+			"sandbox_id": id,
+			"from":       vm.State,
+			"to":         to,
+		}).Warn("Invalid pooled VM state transition")
+		return false
+	}
+
+	now := time.Now()
+	vm.Transitions = append(vm.Transitions, PoolVMTransition{From: vm.State, To: to, At: now, Reason: reason})
+	if len(vm.Transitions) > maxPoolVMTransitions {
+		vm.Transitions = vm.Transitions[len(vm.Transitions)-maxPoolVMTransitions:]
+	}
+	vm.State, vm.Since, vm.Reason = to, now, reason
+
+	if to == PoolVMRetired {
+		delete(p.vms, id)
+		p.retired = append(p.retired, *vm)
+		if len(p.retired) > maxRetiredPoolVMs {
+			p.retired = p.retired[len(p.retired)-maxRetiredPoolVMs:]
+		}
+	}
+	return true
+}
+
+// stateOf returns the state of a tracked VM, or "" if it isn't tracked.
+func (p *Pool) stateOf(id string) PoolVMState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if vm, ok := p.vms[id]; ok {
+		return vm.State
+	}
+	return ""
+}
+
+// retire retires a VM taken out of the pool and destroys it.
+func (p *Pool) retire(sandbox *domain.Sandbox, reason string) {
+	p.mu.Lock()
+	p.transition(sandbox.ID, PoolVMRetired, reason)
+	p.mu.Unlock()
+	p.destroyPooled(sandbox)
+}
+
+// enqueue makes a warming VM ready and adds it to its bucket, reporting
+// whether the bucket had room. Must be called with p.mu held.
+func (p *Pool) enqueue(b *bucket, sandbox *domain.Sandbox) bool {
+	select {
+	case b.available <- sandbox:
+		p.transition(sandbox.ID, PoolVMReady, "added to the pool")
+		return true
+	default:
+		p.transition(sandbox.ID, PoolVMRetired, "bucket full")
+		return false
+	}
+}
+
+// countStates counts the tracked VMs of a bucket in each state.
+// Must be called with p.mu held.
+func (p *Pool) countStates(b *bucket) map[PoolVMState]int {
+	counts := make(map[PoolVMState]int)
+	for _, vm := range p.vms {
+		if vm.Bucket == b.name {
+			counts[vm.State]++
+		}
+	}
+	return counts
+}
+
+// Inspect returns the state of every VM in the pool, followed by the VMs
+// it retired last, oldest first.
+func (p *Pool) Inspect() []PoolVM {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var vms []PoolVM
+	for _, b := range p.buckets {
+		for _, vm := range p.vms {
+			if vm.Bucket == b.name {
+				vms = append(vms, copyPoolVM(vm))
+			}
+		}
+	}
+	for i := range p.retired {
+		vms = append(vms, copyPoolVM(&p.retired[i]))
+	}
+	return vms
+}
+
+func copyPoolVM(vm *PoolVM) PoolVM {
+	c := *vm
+	c.Transitions = append([]PoolVMTransition(nil), vm.Transitions...)
+	return c
+}
+
+// checkHealth probes a pooled VM: its VMM must still run and its vsock
+// socket, through which the agent is reached on acquire, must exist.
+func (p *Pool) checkHealth(sandbox *domain.Sandbox) error {
+	if p.manager.stopped(sandbox) {
+		return errVMMExited
+	}
+	if sandbox.PID > 0 && !processAlive(sandbox.PID) {
+		return fmt.Errorf("VMM process %d is gone", sandbox.PID)
+	}
+	if sandbox.VsockPath != "" {
+		if _, err := os.Stat(sandbox.VsockPath); err != nil {
+			return fmt.Errorf("vsock socket: %w", err)
+		}
+	}
+	return nil
+}
+
+// errVMMExited fails the health check of a VM whose VMM is known to have
+// exited; such a VM is retired without being degraded first.
+var errVMMExited = errors.New("VMM exited")
+
+// checkBucketHealth health checks the ready and degraded VMs of a bucket.
+// A ready VM failing a check is degraded and no longer handed out; a
+// degraded VM passing one is ready again, and one failing it again is
+// retired.
+func (p *Pool) checkBucketHealth(b *bucket) {
+	// Take the VMs out of the bucket while they are checked, so none is
+	// handed out between its check and its transition
+	var checked []*domain.Sandbox
+collect:
+	for n := len(b.available); n > 0; n-- {
+		select {
+		case sandbox := <-b.available:
+			checked = append(checked, sandbox)
+		default:
+			break collect
+		}
+	}
+
+	for _, sandbox := range checked {
+		err := p.healthCheck(sandbox)
+
+		p.mu.Lock()
+		state := PoolVMReady
+		if vm, ok := p.vms[sandbox.ID]; ok {
+			state = vm.State
+		}
+		log := p.log.WithFields(logrus.Fields{
+			"sandbox_id": sandbox.ID,
+			"bucket":     b.name,
+		})
+		retire := false
+		switch {
+		case err == errVMMExited || (err != nil && state == PoolVMDegraded):
+			log.WithError(err).Info("Retiring unhealthy pooled VM")
+			p.transition(sandbox.ID, PoolVMRetired, err.Error())
+			retire = true
+		case err != nil:
+			log.WithError(err).Warn("Pooled VM failed its health check")
+			p.transition(sandbox.ID, PoolVMDegraded, err.Error())
+		case state == PoolVMDegraded:
+			log.Info("Degraded pooled VM recovered")
+			p.transition(sandbox.ID, PoolVMReady, "passed its health check")
+		}
+		if !retire {
+			select {
+			case b.available <- sandbox:
+			default:
+				p.transition(sandbox.ID, PoolVMRetired, "bucket full")
+				retire = true
+			}
+		}
+		p.mu.Unlock()
+
+		if retire {
+			p.destroyPooled(sandbox)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to PoolVMState
+		want     bool
+	}{
+		{PoolVMWarming, PoolVMReady, true},
+		{PoolVMWarming, PoolVMDegraded, false},
+		{PoolVMReady, PoolVMDegraded, true},
+		{PoolVMReady, PoolVMWarming, false},
+		{PoolVMDegraded, PoolVMReady, true},
+		{PoolVMDegraded, PoolVMRetired, true},
+		{PoolVMRetired, PoolVMReady, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestPool_HealthStates(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, DefaultPoolConfig(), log)
+	defer pool.Close(context.Background())
+
+	var healthErr error
+	pool.healthCheck = func(*domain.Sandbox) error { return healthErr }
+
+	b := pool.buckets[0]
+	sandbox := domain.NewSandbox("warm-sb")
+	sandbox.Generation = pool.generation(b.config)
+	addWarm(pool, b, sandbox)
+
+	// A failed check degrades the VM: it stays pooled but isn't handed out
+	healthErr = errors.New("agent not responding")
+	pool.checkBucketHealth(b)
+	if state := pool.stateOf(sandbox.ID); state != PoolVMDegraded {
+		t.Fatalf("state after a failed check = %q, want degraded", state)
+	}
+	if stats := pool.Stats(); stats.Available != 0 || stats.Degraded != 1 {
+		t.Errorf("Stats() = %d available, %d degraded; want 0, 1", stats.Available, stats.Degraded)
+	}
+	if got := pool.takeAvailable(b, domain.VMConfig{}); got != nil {
+		t.Fatalf("takeAvailable handed out degraded VM %s", got.ID)
+	}
+	if len(b.available) != 1 {
+		t.Fatalf("bucket holds %d VMs, want the degraded one", len(b.available))
+	}
+
+	// Passing the next check makes it ready again
+	healthErr = nil
+	pool.checkBucketHealth(b)
+	if state := pool.stateOf(sandbox.ID); state != PoolVMReady {
+		t.Fatalf("state after a passed check = %q, want ready", state)
+	}
+
+	// Failing twice in a row retires it
+	healthErr = errors.New("agent not responding")
+	pool.checkBucketHealth(b)
+	pool.checkBucketHealth(b)
+	if len(b.available) != 0 {
+		t.Fatal("retired VM left in the bucket")
+	}
+
+	vms := pool.Inspect()
+	if len(vms) != 1 || vms[0].ID != sandbox.ID || vms[0].State != PoolVMRetired {
+		t.Fatalf("Inspect() = %+v, want the retired VM", vms)
+	}
+	want := []PoolVMState{PoolVMWarming, PoolVMReady, PoolVMDegraded, PoolVMReady, PoolVMDegraded, PoolVMRetired}
+	if len(vms[0].Transitions) != len(want) {
+		t.Fatalf("transitions = %+v, want %v", vms[0].Transitions, want)
+	}
+	for i, tr := range vms[0].Transitions {
+		if tr.To != want[i] || tr.At.IsZero() {
+			t.Errorf("transition %d = %+v, want to %s", i, tr, want[i])
+		}
+	}
+}
+
+func TestPool_AcquiredVMsLeaveStateMachine(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	mgrConfig := DefaultManagerConfig()
+	mgrConfig.RuntimeDir = t.TempDir()
+	mgr, _ := NewManager(mgrConfig, log)
+
+	pool, _ := NewPool(mgr, DefaultPoolConfig(), log)
+	defer pool.Close(context.Background())
+
+	b := pool.buckets[0]
+	sandbox := domain.NewSandbox("warm-sb")
+	sandbox.Generation = pool.generation(b.config)
+	addWarm(pool, b, sandbox)
+
+	if vms := pool.Inspect(); len(vms) != 1 || vms[0].State != PoolVMReady {
+		t.Fatalf("Inspect() = %+v, want one ready VM", vms)
+	}
+	if got := pool.takeAvailable(b, domain.VMConfig{}); got == nil || got.ID != sandbox.ID {
+		t.Fatalf("takeAvailable = %v, want %s", got, sandbox.ID)
+	}
+	if vms := pool.Inspect(); len(vms) != 0 {
+		t.Errorf("Inspect() after acquire = %+v, want no VMs", vms)
+	}
+}
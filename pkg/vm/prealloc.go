@@ -0,0 +1,261 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Disk preallocation strategies.
+const (
+	// PreallocSparse leaves images sparse: blocks are allocated as the
+	// guest writes them, so space runs out late and files fragment.
+	PreallocSparse = "sparse"
+
+	// PreallocFallocate reserves the blocks of an image with fallocate(2)
+	// without writing them. Filesystems without fallocate get PreallocFull.
+	PreallocFallocate = "fallocate"
+
+	// PreallocFull writes zeroes to every unallocated block of an image.
+	PreallocFull = "full"
+)
+
+// Filesystem magic numbers, from statfs(2).
+var filesystemTypes = map[int64]string{
+	0xEF53:     "ext4", // ext2 and ext3 share it
+	0x58465342: "xfs",
+	0x9123683E: "btrfs",
+	0x01021994: "tmpfs",
+	0x794C7630: "overlay",
+	0x6969:     "nfs",
+	0x2FC12FC1: "zfs",
+	0xF2F52010: "f2fs",
+}
+
+// PreallocConfig configures how the disk images the runtime creates, such
+// as rootfs layers and emptyDir volumes, are allocated.
+type PreallocConfig struct {
+	// Default is the strategy for images nothing below matches.
+	Default string
+
+	// Filesystems overrides the strategy by the type of the filesystem
+	// holding the images, such as "xfs" or "btrfs".
+	Filesystems map[string]string
+
+	// Volumes overrides the strategy by volume type ("rootfs" or
+	// "emptydir"), over Filesystems.
+	Volumes map[string]string
+}
+
+// DefaultPreallocConfig returns sensible defaults.
+func DefaultPreallocConfig() PreallocConfig {
+	return PreallocConfig{
+		Default: PreallocSparse,
+	}
+}
+
+// Validate checks the strategies and volume types.
+func (c PreallocConfig) Validate() error {
+	valid := func(strategy string) bool {
+		return strategy == PreallocSparse || strategy == PreallocFallocate || strategy == PreallocFull
+	}
+	if c.Default != "" && !valid(c.Default) {
+		return fmt.Errorf("invalid preallocation %q (must be sparse, fallocate or full)", c.Default)
+	}
+	for fs, strategy := range c.Filesystems {
+		if !valid(strategy) {
+			return fmt.Errorf("invalid preallocation %q for filesystem %s", strategy, fs)
+		}
+	}
+	for volume, strategy := range c.Volumes {
+		if volume != string(VolumeTypeRootfs) && volume != string(VolumeTypeEmptyDir) {
+			return fmt.Errorf("invalid preallocation volume type %q (must be rootfs or emptydir)", volume)
+		}
+		if !valid(strategy) {
+			return fmt.Errorf("invalid preallocation %q for %s volumes", strategy, volume)
+		}
+	}
+	return nil
+}
+
+// strategy returns the strategy for a volume type on a filesystem.
+func (c PreallocConfig) strategy(volume VolumeType, fsType string) string {
+	if s, ok := c.Volumes[string(volume)]; ok {
+		return s
+	}
+	if s, ok := c.Filesystems[fsType]; ok {
+		return s
+	}
+	if c.Default == "" {
+		return PreallocSparse
+	}
+	return c.Default
+}
+
+// storageInfo is what the startup check found out about a directory.
+type storageInfo struct {
+	fsType    string
+	fallocate bool
+}
+
+// preallocator allocates disk images as configured for the filesystem they
+// live on.
+type preallocator struct {
+	config PreallocConfig
+	log    *logrus.Entry
+
+	mu      sync.Mutex
+	storage map[string]storageInfo
+}
+
+func newPreallocator(config PreallocConfig, log *logrus.Entry) *preallocator {
+	return &preallocator{
+		config:  config,
+		log:     log,
+		storage: make(map[string]storageInfo),
+	}
+}
+
+// check finds out the filesystem holding dir and whether it can fallocate,
+// and logs the strategy each volume type gets there. It runs at startup so
+// a strategy the filesystem can't honor shows up before the first pod.
+func (p *preallocator) check(dir string, volumes ...VolumeType) storageInfo {
+	info := p.storageOf(dir)
+	for _, volume := range volumes {
+		strategy := p.config.strategy(volume, info.fsType)
+		log := p.log.WithFields(logrus.Fields{
+			"dir":           dir,
+			"filesystem":    info.fsType,
+			"volume":        volume,
+			"preallocation": strategy,
+		})
+		if strategy == PreallocFallocate && !info.fallocate {
+			log.Warn("Filesystem can't fallocate, images are preallocated by writing zeroes")
+		} else {
+			log.Info("Disk preallocation")
+		}
+	}
+	return info
+}
+
+// storageOf returns what is known about the filesystem holding dir,
+// checking it the first time.
+func (p *preallocator) storageOf(dir string) storageInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info, ok := p.storage[dir]; ok {
+		return info
+	}
+
+	info := storageInfo{fsType: "unknown"}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		p.log.WithError(err).WithField("dir", dir).Warn("Failed to check disk image storage")
+		return info
+	}
+	if fsType, err := filesystemType(dir); err == nil {
+		info.fsType = fsType
+	}
+	info.fallocate = canFallocate(dir)
+	p.storage[dir] = info
+	return info
+}
+
+// allocate applies the strategy for a volume type to an image.
+func (p *preallocator) allocate(path string, volume VolumeType) error {
+	if p == nil {
+		return nil
+	}
+	info := p.storageOf(filepath.Dir(path))
+	strategy := p.config.strategy(volume, info.fsType)
+	if strategy == PreallocSparse {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if strategy == PreallocFallocate && info.fallocate {
+		if err := syscall.Fallocate(int(file.Fd()), 0, 0, stat.Size()); err != nil {
+			return fmt.Errorf("failed to preallocate %s: %w", path, err)
+		}
+		return nil
+	}
+	if err := fillHoles(file, stat.Size()); err != nil {
+		return fmt.Errorf("failed to preallocate %s: %w", path, err)
+	}
+	return file.Sync()
+}
+
+// filesystemType returns the type of the filesystem holding path.
+func filesystemType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	if fsType, ok := filesystemTypes[int64(st.Type)]; ok {
+		return fsType, nil
+	}
+	return fmt.Sprintf("0x%x", st.Type), nil
+}
+
+// canFallocate reports whether the filesystem holding dir supports
+// fallocate, by trying it on a temporary file.
+func canFallocate(dir string) bool {
+	file, err := os.CreateTemp(dir, ".prealloc-check-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	return syscall.Fallocate(int(file.Fd()), 0, 0, 4096) == nil
+}
+
+// fillHoles writes zeroes over the holes of a file, leaving its data as
+// is, so every block is allocated.
+func fillHoles(file *os.File, size int64) error {
+	fd := int(file.Fd())
+	zero := make([]byte, 1<<20)
+
+	for off := int64(0); off < size; {
+		hole, err := unix.Seek(fd, off, unix.SEEK_HOLE)
+		if errors.Is(err, unix.ENXIO) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hole >= size {
+			return nil
+		}
+
+		data, err := unix.Seek(fd, hole, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			data = size
+		} else if err != nil {
+			return err
+		}
+
+		for pos := hole; pos < data; {
+			n := min(int64(len(zero)), data-pos)
+			if _, err := file.WriteAt(zero[:n], pos); err != nil {
+				return err
+			}
+			pos += n
+		}
+		off = data
+	}
+	return nil
+}
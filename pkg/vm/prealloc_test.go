@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPreallocStrategy(t *testing.T) {
+	config := PreallocConfig{
+		Default:     PreallocSparse,
+		Filesystems: map[string]string{"xfs": PreallocFallocate},
+		Volumes:     map[string]string{"emptydir": PreallocFull},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	tests := []struct {
+		volume VolumeType
+		fsType string
+		want   string
+	}{
+		{VolumeTypeRootfs, "ext4", PreallocSparse},
+		{VolumeTypeRootfs, "xfs", PreallocFallocate},
+		{VolumeTypeEmptyDir, "xfs", PreallocFull},
+	}
+	for _, tt := range tests {
+		if got := config.strategy(tt.volume, tt.fsType); got != tt.want {
+			t.Errorf("strategy(%s, %s) = %s, want %s", tt.volume, tt.fsType, got, tt.want)
+		}
+	}
+
+	for _, bad := range []PreallocConfig{
+		{Default: "eager"},
+		{Filesystems: map[string]string{"ext4": "eager"}},
+		{Volumes: map[string]string{"secret": PreallocFull}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("Validate(%+v) = nil, want error", bad)
+		}
+	}
+}
+
+// allocatedBytes returns the space a file takes up on disk.
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestPreallocate(t *testing.T) {
+	for _, strategy := range []string{PreallocFallocate, PreallocFull} {
+		t.Run(strategy, func(t *testing.T) {
+			dir := t.TempDir()
+			path, data := writeTestImage(t, dir)
+			// writeTestImage writes every block; a sparse copy has holes
+			sparse := filepath.Join(dir, "sparse.ext4")
+			in, _ := os.Open(path)
+			out, _ := os.Create(sparse)
+			if err := sparseCopy(out, in); err != nil {
+				t.Fatal(err)
+			}
+			in.Close()
+			out.Close()
+			if allocatedBytes(t, sparse) >= int64(len(data)) {
+				t.Skip("filesystem doesn't support sparse files")
+			}
+
+			p := newPreallocator(PreallocConfig{Default: strategy}, logrus.NewEntry(logrus.New()))
+			if err := p.allocate(sparse, VolumeTypeEmptyDir); err != nil {
+				t.Fatalf("allocate() error = %v", err)
+			}
+			if got := allocatedBytes(t, sparse); got < int64(len(data)) {
+				t.Errorf("%d bytes allocated, want %d", got, len(data))
+			}
+			got, err := os.ReadFile(sparse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(data) {
+				t.Error("preallocation changed the image's content")
+			}
+		})
+	}
+}
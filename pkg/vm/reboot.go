@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/trace"
+	"github.com/sirupsen/logrus"
+)
+
+// CheckReboot reports why a sandbox's VM can't be rebooted in place, if it
+// can't. Rebooting needs the configuration the VMM was started with.
+func (m *Manager) CheckReboot(sandbox *domain.Sandbox) error {
+	switch {
+	case m.config.DevMode.Enabled:
+		return fmt.Errorf("dev mode VMs can't be rebooted")
+	case sandbox.VM == nil:
+		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
+	case sandbox.Recovered:
+		return fmt.Errorf("sandbox %s was adopted from a previous shim, its boot configuration is unknown", sandbox.ID)
+	case sandbox.VMConfig.JailerEnabled:
+		return fmt.Errorf("jailed VMs can't be rebooted in place")
+	case sandbox.VM.Cfg.Snapshot.MemFilePath != "" || sandbox.VM.Cfg.Snapshot.SnapshotPath != "":
+		return fmt.Errorf("sandbox %s was restored from a snapshot and has no boot configuration", sandbox.ID)
+	}
+	return nil
+}
+
+// RebootVM stops a sandbox's VM and boots it again with the configuration
+// it was first started with. The sandbox keeps its ID, directory, vsock
+// CID, tap and addresses, and the root drive and its overlay are attached
+// again, so the guest comes back with the same network identity and
+// whatever it wrote to its rootfs. Containers have to be created again.
+func (m *Manager) RebootVM(ctx context.Context, sandbox *domain.Sandbox) error {
+	mu := m.getSandboxLock(sandbox.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := m.CheckReboot(sandbox); err != nil {
+		return err
+	}
+	log := m.log.WithField("sandbox_id", sandbox.ID)
+	log.Info("Rebooting VM")
+	rebootStart := time.Now()
+
+	// Marked stopped, so the old VMM's exit is not reported
+	if sandbox.State == domain.SandboxReady {
+		if err := m.stopVM(ctx, sandbox); err != nil {
+			return err
+		}
+	}
+
+	fcConfig := sandbox.VM.Cfg
+	// Firecracker refuses to create sockets and fifos that already exist
+	for _, path := range []string{fcConfig.SocketPath, sandbox.VsockPath, fcConfig.LogFifo} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	// A resized VM was booted with a balloon, whatever its workload asked for
+	config := sandbox.VMConfig
+	config.Balloon = config.Balloon || sandbox.Resized
+	cpuTemplateOpts, err := m.applyCPUTemplate(config.CPUTemplate, &fcConfig)
+	if err != nil {
+		return err
+	}
+	machineOpts := []firecracker.Opt{
+		firecracker.WithLogger(log),
+	}
+	machineOpts = append(machineOpts, cpuTemplateOpts...)
+	machineOpts = append(machineOpts, balloonOpts(config)...)
+	machineOpts = append(machineOpts, m.cgroupOpts(sandbox.ID, config)...)
+
+	machine, err := firecracker.NewMachine(ctx, fcConfig, machineOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to create machine: %w", err)
+	}
+	sandboxDir := filepath.Join(m.config.RuntimeDir, sandbox.ID)
+	bootStart := time.Now()
+	err = machine.Start(ctx)
+	trace.Record(sandboxDir, trace.PhaseBoot, bootStart, err)
+	if err != nil {
+		_ = machine.StopVMM()
+		return &StartupError{SandboxID: sandbox.ID, Stage: StageVMBoot, Attempts: 1, Err: err}
+	}
+
+	sandbox.VM = machine
+	pid, _ := machine.PID()
+	sandbox.PID = pid
+	pidFile := filepath.Join(sandboxDir, "firecracker.pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		log.WithError(err).Warn("Failed to write VMM pid file")
+	}
+	if err := m.applyVMMFDLimit(pid); err != nil {
+		log.WithError(err).Warn("Failed to set VMM file descriptor limit")
+	}
+	sandbox.State = domain.SandboxReady
+	sandbox.StartedAt = time.Now()
+	sandbox.FinishedAt = time.Time{}
+	go m.watchVMM(sandbox)
+
+	if sandbox.Resized {
+		memoryMB := firecracker.Int64Value(fcConfig.MachineCfg.MemSizeMib)
+		if memoryMB > sandbox.VMConfig.MemoryMB && sandbox.VMConfig.MemoryMB > 0 {
+			if err := machine.UpdateBalloon(ctx, memoryMB-sandbox.VMConfig.MemoryMB); err != nil {
+				return fmt.Errorf("failed to resize VM memory: %w", err)
+			}
+		}
+	}
+
+	if err := m.pushGuestNetwork(ctx, sandbox); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"pid":      pid,
+		"duration": time.Since(rebootStart),
+	}).Info("VM rebooted")
+	return nil
+}
@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// testMachine returns a machine that is never started.
+func testMachine(t *testing.T, config firecracker.Config) *firecracker.Machine {
+	t.Helper()
+	config.DisableValidation = true
+	if config.SocketPath == "" {
+		config.SocketPath = filepath.Join(t.TempDir(), "firecracker.sock")
+	}
+	machine, err := firecracker.NewMachine(context.Background(), config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	return machine
+}
+
+func TestManager_CheckReboot(t *testing.T) {
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+	mgr, err := NewManager(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		sandbox func() *domain.Sandbox
+		wantErr string
+	}{
+		{
+			name: "booted",
+			sandbox: func() *domain.Sandbox {
+				sb := domain.NewSandbox("booted-sb")
+				sb.VM = testMachine(t, firecracker.Config{})
+				return sb
+			},
+		},
+		{
+			name:    "no VM",
+			sandbox: func() *domain.Sandbox { return domain.NewSandbox("empty-sb") },
+			wantErr: "has no VM",
+		},
+		{
+			name: "adopted",
+			sandbox: func() *domain.Sandbox {
+				sb := domain.NewSandbox("adopted-sb")
+				sb.VM = testMachine(t, firecracker.Config{})
+				sb.Recovered = true
+				return sb
+			},
+			wantErr: "previous shim",
+		},
+		{
+			name: "jailed",
+			sandbox: func() *domain.Sandbox {
+				sb := domain.NewSandbox("jailed-sb")
+				sb.VM = testMachine(t, firecracker.Config{})
+				sb.VMConfig.JailerEnabled = true
+				return sb
+			},
+			wantErr: "jailed",
+		},
+		{
+			name: "restored",
+			sandbox: func() *domain.Sandbox {
+				sb := domain.NewSandbox("restored-sb")
+				sb.VM = testMachine(t, firecracker.Config{
+					Snapshot: firecracker.SnapshotConfig{MemFilePath: "/snap/mem", SnapshotPath: "/snap/state"},
+				})
+				return sb
+			},
+			wantErr: "snapshot",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mgr.CheckReboot(tt.sandbox())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckReboot() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckReboot() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManager_VMMExitAfterReboot(t *testing.T) {
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+	mgr, err := NewManager(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	exited := make(chan *domain.Sandbox, 2)
+	mgr.OnVMMExit(func(sandbox *domain.Sandbox) { exited <- sandbox })
+
+	old := testMachine(t, firecracker.Config{})
+	sandbox := domain.NewSandbox("rebooted-sb")
+	sandbox.VM = testMachine(t, firecracker.Config{})
+	sandbox.State = domain.SandboxReady
+	mgr.sandboxes[sandbox.ID] = sandbox
+
+	// The VMM the reboot replaced exiting late says nothing about the new one
+	mgr.vmmExited(sandbox, old)
+	if len(exited) != 0 || mgr.stopped(sandbox) {
+		t.Fatal("exit of a replaced VMM was reported")
+	}
+
+	mgr.vmmExited(sandbox, sandbox.VM)
+	if len(exited) != 1 || !mgr.stopped(sandbox) {
+		t.Fatal("exit of the current VMM was not reported")
+	}
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// balloonOpts adds a memory balloon to VMs that ask for one. It starts
+// deflated, so the guest boots with all of its memory, and doesn't deflate
+// on guest OOM, so a VM sized down stays within its workload's memory.
+func balloonOpts(config domain.VMConfig) []firecracker.Opt {
+	if !config.Balloon {
+		return nil
+	}
+
+	handler := firecracker.NewCreateBalloonHandler(0, false, 0)
+	return []firecracker.Opt{func(machine *firecracker.Machine) {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName, handler)
+	}}
+}
+
+// canResize reports whether a VM booted with boot can be sized down to
+// serve a workload: it has a balloon, boots the same way and has at least
+// the vCPUs and memory the workload asks for.
+func canResize(boot, workload domain.VMConfig) bool {
+	return boot.Balloon && boot.SMTEnabled == workload.SMTEnabled && sameBoot(boot, workload) &&
+		boot.VcpuCount >= workload.VcpuCount && boot.MemoryMB >= workload.MemoryMB
+}
+
+// ResizeVM limits the guest of a VM booted with bootMemoryMB of memory and
+// a balloon to memoryMB, by inflating the balloon over the rest. Firecracker
+// can't unplug vCPUs; surplus ones are taken offline by the guest agent.
+func (m *Manager) ResizeVM(ctx context.Context, sandbox *domain.Sandbox, bootMemoryMB, memoryMB int64) error {
+	mu := m.getSandboxLock(sandbox.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Dev VMs have no balloon; their memory isn't reserved up front anyway
+	if m.config.DevMode.Enabled {
+		return nil
+	}
+	if sandbox.VM == nil {
+		return fmt.Errorf("sandbox %s has no VM", sandbox.ID)
+	}
+	if memoryMB <= 0 || memoryMB > bootMemoryMB {
+		return fmt.Errorf("cannot size a %d MiB VM to %d MiB", bootMemoryMB, memoryMB)
+	}
+
+	if err := sandbox.VM.UpdateBalloon(ctx, bootMemoryMB-memoryMB); err != nil {
+		return fmt.Errorf("failed to resize VM memory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorClass classifies why creating a VM failed, which decides whether
+// CreateVM tries again.
+type ErrorClass string
+
+const (
+	// ErrorTransient failures may not happen again: the VMM losing a race
+	// for its API socket, KVM briefly busy, an interrupted syscall, a CNI
+	// plugin timing out.
+	ErrorTransient ErrorClass = "transient"
+
+	// ErrorResource failures mean the node is out of something, such as
+	// file descriptors or memory. Trying again right away only adds load.
+	ErrorResource ErrorClass = "resource"
+
+	// ErrorPermanent failures will happen again: bad configuration, missing
+	// files, a cancelled request, or a startup stage that has already
+	// used up its own retries.
+	ErrorPermanent ErrorClass = "permanent"
+)
+
+// TransientError marks a failure as transient, whatever it wraps.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// transientMarkers are in the messages of transient failures the SDK only
+// reports as text.
+var transientMarkers = []string{
+	// The VMM exited or was slow before serving its API, which is how
+	// Firecracker failing to get KVM shows up too
+	"did not create API socket",
+}
+
+// ClassifyError returns the class of a VM creation failure.
+func ClassifyError(err error) ErrorClass {
+	var transient *TransientError
+	var startup *StartupError
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &transient), errors.Is(err, ErrChaosInjected),
+		network.IsPluginTimeout(err), errors.Is(err, ErrNetworkPending):
+		return ErrorTransient
+	case errors.Is(err, ErrFDExhausted), errors.Is(err, ErrPoolDraining):
+		return ErrorResource
+	case errors.As(err, &startup) && startup.Stage != StageVMBoot:
+		return ErrorPermanent
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.EAGAIN, syscall.EBUSY, syscall.EINTR, syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ETIMEDOUT:
+			return ErrorTransient
+		case syscall.ENOMEM, syscall.ENOSPC, syscall.EMFILE, syscall.ENFILE:
+			return ErrorResource
+		}
+		return ErrorPermanent
+	}
+
+	msg := err.Error()
+	for _, marker := range transientMarkers {
+		if strings.Contains(msg, marker) {
+			return ErrorTransient
+		}
+	}
+	return ErrorPermanent
+}
+
+// createWithRetry runs create until it succeeds, its failure isn't
+// transient, it has been tried CreateAttempts times, or ctx is done. The
+// backoff starts at RetryDelay and doubles up to CreateMaxDelay.
+func createWithRetry(ctx context.Context, startup StartupConfig, log *logrus.Entry, create func() (*domain.Sandbox, error)) (*domain.Sandbox, error) {
+	attempts := startup.CreateAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := startup.RetryDelay
+
+	for attempt := 1; ; attempt++ {
+		sandbox, err := create()
+		if err == nil {
+			if attempt > 1 {
+				metrics.Global().RecordVMCreateRetryOutcome(true)
+			}
+			return sandbox, nil
+		}
+
+		class := ClassifyError(err)
+		if class != ErrorTransient || attempt >= attempts || ctx.Err() != nil {
+			if attempt > 1 {
+				metrics.Global().RecordVMCreateRetryOutcome(false)
+			}
+			return nil, err
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warn("VM creation failed transiently, retrying")
+		metrics.Global().RecordVMCreateRetry()
+
+		select {
+		case <-ctx.Done():
+			metrics.Global().RecordVMCreateRetryOutcome(false)
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if startup.CreateMaxDelay > 0 && delay > startup.CreateMaxDelay {
+			delay = startup.CreateMaxDelay
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ""},
+		{"marked transient", &TransientError{Err: errors.New("flaky")}, ErrorTransient},
+		{"chaos", fmt.Errorf("create: %w", ErrChaosInjected), ErrorTransient},
+		{"socket race", &StartupError{Stage: StageVMBoot, Err: errors.New("Firecracker did not create API socket /run/fc-cri/fc-1/firecracker.sock: exit status 1")}, ErrorTransient},
+		{"kvm busy", &StartupError{Stage: StageVMBoot, Err: &os.SyscallError{Syscall: "ioctl", Err: syscall.EBUSY}}, ErrorTransient},
+		{"cni plugin timeout", &StartupError{Stage: StageNetworkSetup, Err: &network.PluginTimeoutError{Plugin: "bridge", Command: "ADD"}}, ErrorTransient},
+		{"network pending", fmt.Errorf("create: %w", ErrNetworkPending), ErrorTransient},
+		{"fds exhausted", fmt.Errorf("admission: %w", ErrFDExhausted), ErrorResource},
+		{"disk full", &os.PathError{Op: "fallocate", Path: "rootfs", Err: syscall.ENOSPC}, ErrorResource},
+		{"missing kernel", &os.PathError{Op: "open", Path: "vmlinux", Err: syscall.ENOENT}, ErrorPermanent},
+		{"stage out of retries", &StartupError{Stage: StageAgentConnect, Err: syscall.ECONNREFUSED}, ErrorPermanent},
+		{"bad config", errors.New("invalid CPU template"), ErrorPermanent},
+	}
+	for _, tt := range tests {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("%s: ClassifyError(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCreateWithRetry(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	ctx := context.Background()
+	startup := StartupConfig{CreateAttempts: 3, RetryDelay: time.Millisecond, CreateMaxDelay: time.Millisecond}
+	before := metrics.Global().GetSnapshot()
+
+	// Transient failures are retried until the creation succeeds
+	calls := 0
+	sandbox, err := createWithRetry(ctx, startup, log, func() (*domain.Sandbox, error) {
+		calls++
+		if calls < 3 {
+			return nil, ErrChaosInjected
+		}
+		return domain.NewSandbox("fc-1"), nil
+	})
+	if err != nil || sandbox == nil || calls != 3 {
+		t.Fatalf("createWithRetry() = %v, %v after %d calls, want success after 3", sandbox, err, calls)
+	}
+
+	// Up to CreateAttempts times
+	calls = 0
+	_, err = createWithRetry(ctx, startup, log, func() (*domain.Sandbox, error) {
+		calls++
+		return nil, ErrChaosInjected
+	})
+	if !errors.Is(err, ErrChaosInjected) || calls != 3 {
+		t.Errorf("createWithRetry() = %v after %d calls, want ErrChaosInjected after 3", err, calls)
+	}
+
+	// Other failures are returned at once
+	calls = 0
+	_, err = createWithRetry(ctx, startup, log, func() (*domain.Sandbox, error) {
+		calls++
+		return nil, ErrFDExhausted
+	})
+	if !errors.Is(err, ErrFDExhausted) || calls != 1 {
+		t.Errorf("createWithRetry() = %v after %d calls, want ErrFDExhausted after 1", err, calls)
+	}
+
+	after := metrics.Global().GetSnapshot()
+	if retries := after.VMCreateRetries - before.VMCreateRetries; retries != 4 {
+		t.Errorf("recorded %d retries, want 4", retries)
+	}
+	if after.VMCreateRetriesRecovered-before.VMCreateRetriesRecovered != 1 || after.VMCreateRetriesExhausted-before.VMCreateRetriesExhausted != 1 {
+		t.Errorf("recorded outcomes = %+v", after)
+	}
+
+	// A cancelled request isn't retried
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	calls = 0
+	_, _ = createWithRetry(cancelled, startup, log, func() (*domain.Sandbox, error) {
+		calls++
+		return nil, ErrChaosInjected
+	})
+	if calls != 1 {
+		t.Errorf("createWithRetry() with a cancelled context made %d calls, want 1", calls)
+	}
+}
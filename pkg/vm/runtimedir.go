@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+// A sandbox's directory holds its sockets, logs, trace and state. By
+// default it is <RuntimeDir>/<sandbox-id>. A VM config may name a runtime
+// directory class instead, such as a fast NVMe disk for latency-critical
+// pods or a directory per tenant; the sandbox's directory is then created
+// under the class's base and <RuntimeDir>/<sandbox-id> links to it, so
+// everything that looks a sandbox up by ID keeps finding it.
+
+// runtimeDirClassName is what a runtime directory class may be called.
+var runtimeDirClassName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidateRuntimeDirClassName checks the name of a runtime directory class.
+func ValidateRuntimeDirClassName(name string) error {
+	if !runtimeDirClassName.MatchString(name) {
+		return fmt.Errorf("invalid runtime dir class name %q (lowercase letters, digits and dashes)", name)
+	}
+	return nil
+}
+
+// ValidateRuntimeDirClasses checks runtime directory classes: their names
+// and that their bases are absolute paths.
+func ValidateRuntimeDirClasses(classes map[string]string) error {
+	for name, base := range classes {
+		if err := ValidateRuntimeDirClassName(name); err != nil {
+			return err
+		}
+		if !filepath.IsAbs(base) {
+			return fmt.Errorf("runtime dir class %s: %q is not an absolute path", name, base)
+		}
+	}
+	return nil
+}
+
+// ParseRuntimeDirClasses parses runtime directory classes written as
+// "name=/path,name=/path".
+func ParseRuntimeDirClasses(s string) (map[string]string, error) {
+	classes := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, base, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid runtime dir class %q (want name=/path)", item)
+		}
+		classes[strings.TrimSpace(name)] = strings.TrimSpace(base)
+	}
+	return classes, ValidateRuntimeDirClasses(classes)
+}
+
+// makeSandboxDir creates a sandbox's directory in the runtime directory
+// class its VM config names, records it in sandbox.Dir and returns the
+// path under RuntimeDir, which is the directory itself or a link to it.
+func (m *Manager) makeSandboxDir(sandbox *domain.Sandbox, class string) (string, error) {
+	dir := filepath.Join(m.config.RuntimeDir, sandbox.ID)
+	if class == "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create sandbox dir: %w", err)
+		}
+		sandbox.Dir = dir
+		return dir, nil
+	}
+
+	base, ok := m.config.RuntimeDirClasses[class]
+	if !ok {
+		return "", fmt.Errorf("unknown runtime dir class %q", class)
+	}
+	target := filepath.Join(base, sandbox.ID)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", fmt.Errorf("failed to create sandbox dir in class %s: %w", class, err)
+	}
+	if err := os.Symlink(target, dir); err != nil {
+		os.RemoveAll(target)
+		return "", fmt.Errorf("failed to link sandbox dir: %w", err)
+	}
+	sandbox.Dir = target
+	return dir, nil
+}
+
+// removeSandboxDir removes a sandbox's directory under RuntimeDir and, if
+// it links to a directory in a runtime directory class, that directory.
+func removeSandboxDir(dir string) error {
+	if target, err := os.Readlink(dir); err == nil {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseRuntimeDirClasses(t *testing.T) {
+	classes, err := ParseRuntimeDirClasses("nvme=/mnt/nvme/fc-cri, tenant-a=/srv/tenant-a")
+	if err != nil {
+		t.Fatalf("ParseRuntimeDirClasses() error = %v", err)
+	}
+	if len(classes) != 2 || classes["nvme"] != "/mnt/nvme/fc-cri" || classes["tenant-a"] != "/srv/tenant-a" {
+		t.Errorf("ParseRuntimeDirClasses() = %v", classes)
+	}
+
+	for _, s := range []string{"nvme", "nvme=relative/path", "NVMe=/mnt/nvme", "../x=/mnt"} {
+		if _, err := ParseRuntimeDirClasses(s); err == nil {
+			t.Errorf("ParseRuntimeDirClasses(%q) should fail", s)
+		}
+	}
+}
+
+func TestMakeSandboxDir(t *testing.T) {
+	config := DefaultManagerConfig()
+	config.RuntimeDir = t.TempDir()
+	nvme := t.TempDir()
+	config.RuntimeDirClasses = map[string]string{"nvme": nvme}
+	m := &Manager{config: config, log: logrus.NewEntry(logrus.New())}
+
+	// Without a class the directory is under the runtime directory
+	sandbox := domain.NewSandbox("sb1")
+	dir, err := m.makeSandboxDir(sandbox, "")
+	if err != nil {
+		t.Fatalf("makeSandboxDir() error = %v", err)
+	}
+	if want := filepath.Join(config.RuntimeDir, "sb1"); dir != want || sandbox.Dir != want {
+		t.Errorf("makeSandboxDir() = %q, Dir %q, want %q", dir, sandbox.Dir, want)
+	}
+
+	// With one it is in the class, linked from the runtime directory
+	sandbox = domain.NewSandbox("sb2")
+	dir, err = m.makeSandboxDir(sandbox, "nvme")
+	if err != nil {
+		t.Fatalf("makeSandboxDir() error = %v", err)
+	}
+	if sandbox.Dir != filepath.Join(nvme, "sb2") {
+		t.Errorf("Dir = %q, want it under the class", sandbox.Dir)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(sandbox.Dir, "state.json")); err != nil {
+		t.Errorf("file written through the link not in the class directory: %v", err)
+	}
+
+	if err := removeSandboxDir(dir); err != nil {
+		t.Fatalf("removeSandboxDir() error = %v", err)
+	}
+	for _, path := range []string{dir, sandbox.Dir} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+
+	if _, err := m.makeSandboxDir(domain.NewSandbox("sb3"), "ssd"); err == nil {
+		t.Error("makeSandboxDir() with an unknown class should fail")
+	}
+}
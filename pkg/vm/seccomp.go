@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Seccomp levels a VM can run at.
+const (
+	// SeccompDefault confines Firecracker with its built-in filters.
+	SeccompDefault = "default"
+
+	// SeccompCustom confines Firecracker with a filter file.
+	SeccompCustom = "custom"
+
+	// SeccompDisabled runs Firecracker without seccomp.
+	SeccompDisabled = "disabled"
+)
+
+// jailedSeccompFilter is where a custom filter is found inside a jail.
+const jailedSeccompFilter = "/seccomp.bpf"
+
+// SeccompConfig selects the seccomp filters Firecracker confines its
+// threads with.
+type SeccompConfig struct {
+	// FilterPath is a filter compiled with seccompiler-bin, passed to
+	// Firecracker with --seccomp-filter. Empty uses Firecracker's
+	// built-in filters.
+	FilterPath string
+
+	// Disabled runs Firecracker without seccomp. Only for debugging.
+	Disabled bool
+}
+
+// Level returns the seccomp level VMs run at.
+func (c SeccompConfig) Level() string {
+	switch {
+	case c.Disabled:
+		return SeccompDisabled
+	case c.FilterPath != "":
+		return SeccompCustom
+	default:
+		return SeccompDefault
+	}
+}
+
+// Validate checks that the filter file can be passed to Firecracker.
+// Firecracker only reads it when a VM boots, so a broken filter would
+// otherwise fail every VM.
+func (c SeccompConfig) Validate() error {
+	if c.FilterPath == "" {
+		return nil
+	}
+	if c.Disabled {
+		return fmt.Errorf("seccomp filter %s set, but seccomp is disabled", c.FilterPath)
+	}
+
+	info, err := os.Stat(c.FilterPath)
+	if err != nil {
+		return fmt.Errorf("seccomp filter not found: %w", err)
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("seccomp filter %s is not a compiled filter", c.FilterPath)
+	}
+	file, err := os.Open(c.FilterPath)
+	if err != nil {
+		return fmt.Errorf("seccomp filter not readable: %w", err)
+	}
+	return file.Close()
+}
+
+// sdkConfig returns the SDK's seccomp settings for an unjailed VM.
+func (c SeccompConfig) sdkConfig() firecracker.SeccompConfig {
+	return firecracker.SeccompConfig{
+		Enabled: !c.Disabled,
+		Filter:  c.FilterPath,
+	}
+}
+
+// args returns Firecracker's seccomp flags, with the filter file at
+// filterPath.
+func (c SeccompConfig) args(filterPath string) []string {
+	switch c.Level() {
+	case SeccompDisabled:
+		return []string{"--no-seccomp"}
+	case SeccompCustom:
+		return []string{"--seccomp-filter", filterPath}
+	}
+	return nil
+}
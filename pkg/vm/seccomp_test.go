@@ -0,0 +1,53 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSeccompConfig(t *testing.T) {
+	filter := filepath.Join(t.TempDir(), "firecracker.bpf")
+	if err := os.WriteFile(filter, []byte{0x01, 0x02}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.bpf")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  SeccompConfig
+		level   string
+		args    []string
+		wantErr bool
+	}{
+		{"built-in", SeccompConfig{}, SeccompDefault, nil, false},
+		{"custom", SeccompConfig{FilterPath: filter}, SeccompCustom, []string{"--seccomp-filter", "/jail/seccomp.bpf"}, false},
+		{"disabled", SeccompConfig{Disabled: true}, SeccompDisabled, []string{"--no-seccomp"}, false},
+		{"disabled with filter", SeccompConfig{FilterPath: filter, Disabled: true}, SeccompDisabled, []string{"--no-seccomp"}, true},
+		{"missing filter", SeccompConfig{FilterPath: filter + ".missing"}, SeccompCustom, []string{"--seccomp-filter", "/jail/seccomp.bpf"}, true},
+		{"empty filter", SeccompConfig{FilterPath: empty}, SeccompCustom, []string{"--seccomp-filter", "/jail/seccomp.bpf"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.Level(); got != tt.level {
+				t.Errorf("Level() = %s, want %s", got, tt.level)
+			}
+			if got := tt.config.args("/jail/seccomp.bpf"); !reflect.DeepEqual(got, tt.args) {
+				t.Errorf("args() = %v, want %v", got, tt.args)
+			}
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Unjailed VMs must not fall back to the SDK's --no-seccomp
+	if sdk := (SeccompConfig{}).sdkConfig(); !sdk.Enabled {
+		t.Error("seccomp disabled by default")
+	}
+}
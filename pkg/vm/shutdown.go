@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultGuestShutdownTimeout is how long the containers of a VM being
+	// stopped get to exit before the VMM is shut down.
+	DefaultGuestShutdownTimeout = 10 * time.Second
+
+	// guestShutdownConnectTimeout bounds connecting to the agent of a VM
+	// being stopped, so a dead agent doesn't hold up the stop.
+	guestShutdownConnectTimeout = 2 * time.Second
+
+	// guestShutdownSyncTimeout is the time the agent gets, beyond the
+	// containers' grace periods, to sync the guest's filesystems.
+	guestShutdownSyncTimeout = 5 * time.Second
+)
+
+// quiesceGuest asks the agent of a VM about to be stopped to stop its
+// containers and sync the guest's filesystems. Powering a VM off with
+// writes still in the guest's page cache loses them, and can leave the
+// filesystems on writable volumes corrupt.
+func (m *Manager) quiesceGuest(ctx context.Context, sandbox *domain.Sandbox) error {
+	timeout := m.config.GuestShutdownTimeout
+	if timeout <= 0 {
+		return nil
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, guestShutdownConnectTimeout)
+	defer cancel()
+	client := agent.NewClient(m.log.WithField("sandbox_id", sandbox.ID))
+	client.SetAuthKey(sandbox.AgentKey)
+	if err := client.Connect(connectCtx, sandbox.VsockPath, sandbox.VsockCID, AgentPort(sandbox.VMConfig)); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if !client.Supports(agent.FeatureShutdown) {
+		return fmt.Errorf("agent does not support %s", agent.FeatureShutdown)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout+guestShutdownSyncTimeout)
+	defer cancel()
+	result, err := client.Shutdown(shutdownCtx, timeout)
+	if err != nil {
+		return err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"stopped":    result.Stopped,
+		"synced":     result.Synced,
+	}).Debug("Guest ready for power-off")
+	return nil
+}
@@ -28,6 +28,8 @@ import (
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/pipeops/firecracker-cri/pkg/trace"
 	"github.com/sirupsen/logrus"
 )
 
@@ -44,6 +46,13 @@ type SnapshotManager struct {
 
 	// Golden snapshot for fast VM creation
 	goldenSnapshot *Snapshot
+
+	// rebuilding is set while a stale golden snapshot is rebuilt
+	rebuilding bool
+
+	// SHA-256 of snapshot inputs by path (see snapshotinputs.go)
+	hashMu sync.Mutex
+	hashes map[string]inputHash
 }
 
 // SnapshotConfig configures snapshot behavior.
@@ -71,6 +80,11 @@ type SnapshotConfig struct {
 
 	// CompressMemory enables memory compression for smaller snapshots.
 	CompressMemory bool
+
+	// AgentBinaryPath is the fc-agent binary installed in the golden VM's
+	// rootfs. Along with the kernel and rootfs, a new one invalidates the
+	// golden snapshot.
+	AgentBinaryPath string
 }
 
 // DefaultSnapshotConfig returns sensible defaults.
@@ -84,6 +98,7 @@ func DefaultSnapshotConfig() SnapshotConfig {
 		SnapshotType:       "Full",
 		MemoryBackend:      "File",
 		CompressMemory:     false,
+		AgentBinaryPath:    "/usr/local/bin/fc-agent",
 	}
 }
 
@@ -115,6 +130,19 @@ type Snapshot struct {
 
 	// IsGolden indicates if this is the golden base snapshot.
 	IsGolden bool `json:"is_golden"`
+
+	// Type is the Firecracker snapshot type, "Full" or "Diff".
+	Type string `json:"type,omitempty"`
+
+	// Parent is the snapshot a Diff snapshot's memory is layered on, and
+	// ParentCreatedAt when that snapshot was taken. A Diff snapshot is
+	// only valid on top of the same parent (see snapshotchain.go).
+	Parent          string    `json:"parent,omitempty"`
+	ParentCreatedAt time.Time `json:"parent_created_at,omitempty"`
+
+	// AgentKey is the key the snapshotted agent authenticates connections
+	// with. VMs restored from the snapshot keep it.
+	AgentKey []byte `json:"agent_key,omitempty"`
 }
 
 // NewSnapshotManager creates a new snapshot manager.
@@ -125,6 +153,7 @@ func NewSnapshotManager(config SnapshotConfig, vmManager *Manager, log *logrus.E
 			log:       log.WithField("component", "snapshot-manager"),
 			vmManager: vmManager,
 			snapshots: make(map[string]*Snapshot),
+			hashes:    make(map[string]inputHash),
 		}, nil
 	}
 
@@ -138,6 +167,7 @@ func NewSnapshotManager(config SnapshotConfig, vmManager *Manager, log *logrus.E
 		log:       log.WithField("component", "snapshot-manager"),
 		vmManager: vmManager,
 		snapshots: make(map[string]*Snapshot),
+		hashes:    make(map[string]inputHash),
 	}
 
 	// Load existing snapshots
@@ -149,6 +179,9 @@ func NewSnapshotManager(config SnapshotConfig, vmManager *Manager, log *logrus.E
 	if snap, ok := sm.snapshots[config.GoldenSnapshotName]; ok {
 		sm.goldenSnapshot = snap
 		log.WithField("snapshot", snap.Name).Info("Golden snapshot loaded")
+
+		// Rebuild it if the kernel, rootfs or agent changed since
+		sm.checkGolden()
 	}
 
 	return sm, nil
@@ -197,6 +230,13 @@ func (sm *SnapshotManager) CreateGoldenSnapshot(ctx context.Context) (*Snapshot,
 
 // CreateSnapshot creates a snapshot from a running VM.
 func (sm *SnapshotManager) CreateSnapshot(ctx context.Context, sandbox *domain.Sandbox, name string, isGolden bool) (*Snapshot, error) {
+	return sm.createSnapshot(ctx, sandbox, name, isGolden, nil)
+}
+
+// createSnapshot creates a snapshot from a running VM. With a parent, only
+// the memory the VM changed since it was restored from parent is saved, as
+// a Diff snapshot.
+func (sm *SnapshotManager) createSnapshot(ctx context.Context, sandbox *domain.Sandbox, name string, isGolden bool, parent *Snapshot) (*Snapshot, error) {
 	if !sm.config.Enabled {
 		return nil, fmt.Errorf("snapshots not enabled")
 	}
@@ -224,11 +264,16 @@ func (sm *SnapshotManager) CreateSnapshot(ctx context.Context, sandbox *domain.S
 		return nil, fmt.Errorf("failed to pause VM: %w", err)
 	}
 
+	snapshotType := sm.config.SnapshotType
+	if parent != nil {
+		snapshotType = "Diff"
+	}
+
 	// Create the snapshot using Firecracker API
 	snapshotParams := &models.SnapshotCreateParams{
 		MemFilePath:  firecracker.String(memPath),
 		SnapshotPath: firecracker.String(statePath),
-		SnapshotType: sm.config.SnapshotType,
+		SnapshotType: snapshotType,
 	}
 
 	// Use the machine's CreateSnapshot method
@@ -259,10 +304,25 @@ func (sm *SnapshotManager) CreateSnapshot(ctx context.Context, sandbox *domain.S
 		CreatedAt:  time.Now(),
 		SizeBytes:  totalSize,
 		IsGolden:   isGolden,
+		Type:       snapshotType,
+		AgentKey:   sandbox.AgentKey,
 		Metadata: map[string]string{
 			"source_sandbox": sandbox.ID,
 		},
 	}
+	if parent != nil {
+		snap.Parent = parent.Name
+		snap.ParentCreatedAt = parent.CreatedAt
+	}
+
+	// Record what the VM booted, so restores notice when it changes
+	inputs, err := sm.inputHashes(sandbox.VMConfig)
+	if err != nil {
+		sm.log.WithError(err).Warn("Failed to hash snapshot inputs")
+	}
+	for key, sum := range inputs {
+		snap.Metadata[key] = sum
+	}
 
 	// Save snapshot metadata
 	if err := sm.saveSnapshotMetadata(snap); err != nil {
@@ -291,11 +351,25 @@ func (sm *SnapshotManager) CreateSnapshot(ctx context.Context, sandbox *domain.S
 // RestoreFromSnapshot creates a new VM from a snapshot.
 // This is much faster than cold boot (~10ms vs ~100ms+).
 func (sm *SnapshotManager) RestoreFromSnapshot(ctx context.Context, snap *Snapshot) (*domain.Sandbox, error) {
+	return sm.restoreSnapshot(ctx, snap, sm.config.SnapshotType == "Diff")
+}
+
+// restoreSnapshot creates a new VM from a snapshot. trackDirty makes
+// Firecracker track the memory the VM changes, so Diff snapshots can be
+// taken of it.
+func (sm *SnapshotManager) restoreSnapshot(ctx context.Context, snap *Snapshot, trackDirty bool) (*domain.Sandbox, error) {
 	if !sm.config.Enabled {
 		return nil, fmt.Errorf("snapshots not enabled")
 	}
 
+	// Diff snapshots are restored from their memory stacked on their parents'
+	memPath, err := sm.memoryFile(snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare memory of snapshot %s: %w", snap.Name, err)
+	}
+
 	sm.log.WithField("snapshot", snap.Name).Info("Restoring from snapshot")
+	defer metrics.Global().TrackInFlight(metrics.InFlightSnapshotRestore)()
 
 	startTime := time.Now()
 
@@ -333,16 +407,20 @@ func (sm *SnapshotManager) RestoreFromSnapshot(ctx context.Context, snap *Snapsh
 		},
 		// Snapshot restore parameters
 		Snapshot: firecracker.SnapshotConfig{
-			MemFilePath:         snap.MemoryPath,
+			MemFilePath:         memPath,
 			SnapshotPath:        snap.StatePath,
 			ResumeVM:            true,
-			EnableDiffSnapshots: sm.config.SnapshotType == "Diff",
+			EnableDiffSnapshots: trackDirty,
 		},
+		Seccomp: sm.vmManager.config.Seccomp.sdkConfig(),
+	}
+	if sm.vmManager.config.CaptureVMMLogs {
+		captureVMMLog(sandboxDir, sandboxID, sm.log, &fcConfig)
 	}
 
 	// Create the machine with snapshot restore
 	machineOpts := []firecracker.Opt{
-		firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())),
+		firecracker.WithLogger(sm.log.WithField("sandbox_id", sandboxID)),
 	}
 
 	machine, err := firecracker.NewMachine(ctx, fcConfig, machineOpts...)
@@ -360,18 +438,32 @@ func (sm *SnapshotManager) RestoreFromSnapshot(ctx context.Context, snap *Snapsh
 	sandbox.VM = machine
 	sandbox.VMConfig = snap.VMConfig
 	sandbox.VsockPath = vsockPath
+	sandbox.Dir = sandboxDir
 	sandbox.VsockCID = cid
+	if snap.AgentKey != nil {
+		sandbox.AgentKey = snap.AgentKey
+		if err := writeAgentKey(sandboxDir, snap.AgentKey); err != nil {
+			sm.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to store agent key of restored VM")
+		}
+	}
 	pid, _ := machine.PID()
 	sandbox.PID = pid
 	sandbox.State = domain.SandboxReady
 	sandbox.StartedAt = time.Now()
 	sandbox.FromPool = true // Treat restored VMs like pooled VMs
 
+	// The guest clock stopped when the snapshot was taken
+	if err := sm.syncGuestClock(ctx, sandbox); err != nil {
+		sm.log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to synchronize clock of restored VM")
+	}
+
 	// Track in manager
 	sm.vmManager.mu.Lock()
 	sm.vmManager.sandboxes[sandboxID] = sandbox
 	sm.vmManager.mu.Unlock()
+	go sm.vmManager.watchVMM(sandbox)
 
+	trace.Record(sandboxDir, trace.PhaseSnapshotRestore, startTime, nil)
 	restoreTime := time.Since(startTime)
 	sm.log.WithFields(logrus.Fields{
 		"sandbox_id": sandboxID,
@@ -385,6 +477,11 @@ func (sm *SnapshotManager) RestoreFromSnapshot(ctx context.Context, snap *Snapsh
 // RestoreFromGolden restores a VM from the golden snapshot.
 // This is the primary method for fast VM creation.
 func (sm *SnapshotManager) RestoreFromGolden(ctx context.Context) (*domain.Sandbox, error) {
+	// A stale golden snapshot is dropped and rebuilt in the background
+	if !sm.checkGolden() {
+		return nil, fmt.Errorf("no golden snapshot available")
+	}
+
 	sm.mu.RLock()
 	golden := sm.goldenSnapshot
 	sm.mu.RUnlock()
@@ -446,6 +543,9 @@ func (sm *SnapshotManager) DeleteSnapshot(name string) error {
 
 	delete(sm.snapshots, name)
 
+	// Diff snapshots layered on it are useless now
+	sm.removeDependents(name)
+
 	sm.log.WithField("name", name).Info("Snapshot deleted")
 	return nil
 }
@@ -475,6 +575,7 @@ func (sm *SnapshotManager) Cleanup() error {
 		snapDir := filepath.Dir(oldest.MemoryPath)
 		os.RemoveAll(snapDir)
 		delete(sm.snapshots, oldest.Name)
+		sm.removeDependents(oldest.Name)
 
 		sm.log.WithField("name", oldest.Name).Info("Cleaned up old snapshot")
 	}
@@ -535,7 +636,8 @@ func (sm *SnapshotManager) saveSnapshotMetadata(snap *Snapshot) error {
 		return err
 	}
 
-	return os.WriteFile(metaPath, data, 0644)
+	// The metadata holds the agent key
+	return os.WriteFile(metaPath, data, 0600)
 }
 
 func (sm *SnapshotManager) createSnapshotViaAPI(ctx context.Context, machine *firecracker.Machine, params *models.SnapshotCreateParams) error {
@@ -579,7 +681,19 @@ func (sp *SnapshotPool) Acquire(ctx context.Context, config domain.VMConfig) (*d
 		return sandbox, nil
 	}
 
-	// Pool empty - try snapshot restore if available
+	// Pool empty - a warm snapshot of the workload's image needs no
+	// customizing at all
+	if sp.snapshotMgr != nil {
+		if snap, ok := sp.snapshotMgr.WorkloadSnapshot(config); ok {
+			sandbox, err := sp.snapshotMgr.RestoreFromSnapshot(ctx, snap)
+			if err == nil {
+				return sandbox, nil
+			}
+			sp.log.WithError(err).WithField("snapshot", snap.Name).Warn("Workload snapshot restore failed")
+		}
+	}
+
+	// Try the golden snapshot if available
 	if sp.snapshotMgr != nil && sp.snapshotMgr.HasGoldenSnapshot() {
 		sp.log.Debug("Pool empty, restoring from golden snapshot")
 		sandbox, err := sp.snapshotMgr.RestoreFromGolden(ctx)
@@ -616,8 +730,9 @@ func (sp *SnapshotPool) WarmFromSnapshot(ctx context.Context, count int) error {
 
 		sandbox.PooledAt = time.Now()
 
+		// The golden snapshot is of a default VM
 		select {
-		case sp.Pool.available <- sandbox:
+		case sp.Pool.buckets[0].available <- sandbox:
 			sp.log.WithField("sandbox_id", sandbox.ID).Debug("Added restored VM to pool")
 		default:
 			// Pool full
@@ -0,0 +1,252 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// A Diff snapshot saves only the memory pages a VM wrote since it was
+// restored from its parent. Its memory file is sparse: the pages it has
+// are data, the rest are holes. Restoring it needs the parent's memory
+// with the diff's pages written over it, so the layers of a chain are
+// stacked into one memory file, kept next to the diff for later restores.
+//
+// Workload snapshots are Diff snapshots of the golden snapshot, taken once
+// an image's rootfs is attached and its processes are running, so VMs for
+// frequently used images start already warm.
+
+const (
+	// workloadSnapshotPrefix names the workload snapshots of images.
+	workloadSnapshotPrefix = "workload-"
+
+	// mergedMemoryFile is the stacked memory of a Diff snapshot's chain.
+	mergedMemoryFile = "memory.merged"
+
+	// lseek whence values that find the data and holes of sparse files
+	seekData = 3
+	seekHole = 4
+)
+
+// WorkloadSnapshotName returns the name of the workload snapshot of VMs
+// with a configuration's rootfs and size, i.e. of one image.
+func WorkloadSnapshotName(config domain.VMConfig) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d", config.RootDrive.PathOnHost, config.VcpuCount, config.MemoryMB)))
+	return fmt.Sprintf("%s%x", workloadSnapshotPrefix, h[:6])
+}
+
+// WorkloadSnapshot returns the workload snapshot of a configuration's
+// image, if there is one that can still be restored.
+func (sm *SnapshotManager) WorkloadSnapshot(config domain.VMConfig) (*Snapshot, bool) {
+	if config.RootDrive.PathOnHost == "" {
+		return nil, false
+	}
+	snap, ok := sm.GetSnapshot(WorkloadSnapshotName(config))
+	if !ok {
+		return nil, false
+	}
+	if _, err := sm.chain(snap); err != nil {
+		sm.log.WithError(err).WithField("snapshot", snap.Name).Warn("Dropping workload snapshot")
+		sm.invalidate(snap)
+		return nil, false
+	}
+	return snap, true
+}
+
+// CreateWorkloadSnapshot restores a VM from the golden snapshot, lets
+// prepare attach the workload's rootfs and start its processes, and saves
+// the VM as a Diff snapshot layered on the golden one. The workload must
+// have the golden VM's size.
+func (sm *SnapshotManager) CreateWorkloadSnapshot(ctx context.Context, config domain.VMConfig, prepare func(context.Context, *domain.Sandbox) error) (*Snapshot, error) {
+	if !sm.checkGolden() {
+		return nil, fmt.Errorf("no golden snapshot available")
+	}
+	sm.mu.RLock()
+	golden := sm.goldenSnapshot
+	sm.mu.RUnlock()
+	if golden == nil {
+		return nil, fmt.Errorf("no golden snapshot available")
+	}
+
+	if config.RootDrive.PathOnHost == "" {
+		return nil, fmt.Errorf("workload has no rootfs")
+	}
+	if config.VcpuCount != golden.VMConfig.VcpuCount || config.MemoryMB != golden.VMConfig.MemoryMB {
+		return nil, fmt.Errorf("workload size %d vCPU/%d MiB differs from golden snapshot's %d vCPU/%d MiB",
+			config.VcpuCount, config.MemoryMB, golden.VMConfig.VcpuCount, golden.VMConfig.MemoryMB)
+	}
+
+	name := WorkloadSnapshotName(config)
+	sm.log.WithFields(logrus.Fields{
+		"name":   name,
+		"rootfs": config.RootDrive.PathOnHost,
+	}).Info("Creating workload snapshot")
+
+	// Only a VM tracking the memory it writes can be diffed
+	sandbox, err := sm.restoreSnapshot(ctx, golden, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore golden snapshot: %w", err)
+	}
+	defer func() { _ = sm.vmManager.DestroyVM(ctx, sandbox) }()
+
+	sandbox.VMConfig = config
+	if err := prepare(ctx, sandbox); err != nil {
+		return nil, fmt.Errorf("failed to prepare workload VM: %w", err)
+	}
+
+	// Replace an older snapshot of the image
+	if old, ok := sm.GetSnapshot(name); ok {
+		sm.invalidate(old)
+	}
+	return sm.createSnapshot(ctx, sandbox, name, false, golden)
+}
+
+// chain returns a snapshot and the snapshots its memory is layered on,
+// base first. It fails if a parent is gone or was taken again since.
+func (sm *SnapshotManager) chain(snap *Snapshot) ([]*Snapshot, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	chain := []*Snapshot{snap}
+	for child := snap; child.Parent != ""; {
+		parent, ok := sm.snapshots[child.Parent]
+		if !ok {
+			return nil, fmt.Errorf("base snapshot %s of %s is gone", child.Parent, child.Name)
+		}
+		if !parent.CreatedAt.Equal(child.ParentCreatedAt) {
+			return nil, fmt.Errorf("base snapshot %s of %s was taken again", child.Parent, child.Name)
+		}
+		if len(chain) > len(sm.snapshots) {
+			return nil, fmt.Errorf("snapshot %s is layered on itself", snap.Name)
+		}
+		chain = append([]*Snapshot{parent}, chain...)
+		child = parent
+	}
+	return chain, nil
+}
+
+// memoryFile returns the memory file to restore a snapshot from. Full
+// snapshots have their own; the chain of a Diff snapshot is stacked once
+// and reused.
+func (sm *SnapshotManager) memoryFile(snap *Snapshot) (string, error) {
+	chain, err := sm.chain(snap)
+	if err != nil {
+		return "", err
+	}
+	if len(chain) == 1 {
+		return snap.MemoryPath, nil
+	}
+
+	merged := filepath.Join(filepath.Dir(snap.MemoryPath), mergedMemoryFile)
+	if _, err := os.Stat(merged); err == nil {
+		return merged, nil
+	}
+
+	layers := make([]string, len(chain))
+	for i, layer := range chain {
+		layers[i] = layer.MemoryPath
+	}
+
+	// Concurrent restores each stack into their own file; the last rename
+	// wins with identical contents
+	tmp, err := os.CreateTemp(filepath.Dir(merged), mergedMemoryFile+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	err = stackMemory(tmp, layers)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), merged); err != nil {
+		return "", err
+	}
+
+	sm.log.WithFields(logrus.Fields{
+		"snapshot": snap.Name,
+		"layers":   len(layers),
+	}).Debug("Stacked snapshot memory")
+	return merged, nil
+}
+
+// stackMemory writes memory layers into dst, base first, each over the
+// ones before. Only the data of each layer is copied, so holes in a Diff
+// layer keep the memory below them, and dst stays as sparse as the base.
+func stackMemory(dst *os.File, layers []string) error {
+	if len(layers) == 0 {
+		return fmt.Errorf("no memory layers")
+	}
+	base, err := os.Stat(layers[0])
+	if err != nil {
+		return err
+	}
+	if err := dst.Truncate(base.Size()); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if err := copyData(dst, layer); err != nil {
+			return fmt.Errorf("failed to stack %s: %w", layer, err)
+		}
+	}
+	return nil
+}
+
+// copyData copies the data regions of a sparse file into dst at the same
+// offsets, skipping its holes.
+func copyData(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var offset int64
+	for {
+		start, err := src.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// No data past offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end, err := src.Seek(start, seekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.NewOffsetWriter(dst, start), io.NewSectionReader(src, start, end-start)); err != nil {
+			return err
+		}
+		offset = end
+	}
+}
+
+// removeDependents removes the snapshots layered on a snapshot, directly
+// or not. The caller holds sm.mu.
+func (sm *SnapshotManager) removeDependents(name string) {
+	for _, snap := range sm.snapshots {
+		if snap.Parent != name {
+			continue
+		}
+		delete(sm.snapshots, snap.Name)
+		if err := os.RemoveAll(filepath.Dir(snap.MemoryPath)); err != nil {
+			sm.log.WithError(err).WithField("snapshot", snap.Name).Warn("Failed to remove dependent snapshot")
+		}
+		sm.log.WithFields(logrus.Fields{
+			"name":   snap.Name,
+			"parent": name,
+		}).Info("Removed snapshot of removed parent")
+		sm.removeDependents(snap.Name)
+	}
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestStackMemory(t *testing.T) {
+	dir := t.TempDir()
+	const page = 4096
+
+	// The base is full, the diff only wrote its second and fourth pages
+	base := filepath.Join(dir, "base")
+	if err := os.WriteFile(base, bytes.Repeat([]byte{'a'}, 4*page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff := filepath.Join(dir, "diff")
+	f, err := os.Create(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(4 * page); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{page, 3 * page} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte{'b'}, page), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	out, err := os.Create(filepath.Join(dir, "merged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := stackMemory(out, []string{base, diff}); err != nil {
+		t.Fatalf("stackMemory() error = %v", err)
+	}
+
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for _, c := range "abab" {
+		want = append(want, bytes.Repeat([]byte{byte(c)}, page)...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("stackMemory() wrote the wrong pages")
+	}
+}
+
+func TestSnapshotChain(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := func(name, parent string, parentCreated time.Time) *Snapshot {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return &Snapshot{
+			Name:            name,
+			MemoryPath:      filepath.Join(dir, name, "memory"),
+			CreatedAt:       time.Now(),
+			Parent:          parent,
+			ParentCreatedAt: parentCreated,
+		}
+	}
+	golden := snapshot("golden-base", "", time.Time{})
+	workload := snapshot("workload-1", golden.Name, golden.CreatedAt)
+	nested := snapshot("workload-2", workload.Name, workload.CreatedAt)
+
+	sm := &SnapshotManager{
+		log: logrus.NewEntry(logrus.New()),
+		snapshots: map[string]*Snapshot{
+			golden.Name:   golden,
+			workload.Name: workload,
+			nested.Name:   nested,
+		},
+	}
+
+	chain, err := sm.chain(nested)
+	if err != nil || len(chain) != 3 || chain[0] != golden || chain[2] != nested {
+		t.Fatalf("chain() = %v, %v, want golden, workload-1, workload-2", chain, err)
+	}
+
+	// A retaken parent breaks the chain
+	golden.CreatedAt = golden.CreatedAt.Add(time.Second)
+	if _, err := sm.chain(workload); err == nil {
+		t.Error("chain() on a retaken parent succeeded")
+	}
+
+	// Removing a snapshot removes everything layered on it
+	sm.removeDependents(golden.Name)
+	if len(sm.snapshots) != 1 {
+		t.Errorf("removeDependents() left %d snapshots, want 1", len(sm.snapshots))
+	}
+	if _, err := os.Stat(filepath.Join(dir, nested.Name)); !os.IsNotExist(err) {
+		t.Errorf("files of dependent snapshot were kept: %v", err)
+	}
+}
+
+func TestWorkloadSnapshotName(t *testing.T) {
+	config := domain.VMConfig{VcpuCount: 1, MemoryMB: 128, RootDrive: domain.DriveConfig{PathOnHost: "/var/lib/fc-cri/images/nginx.ext4"}}
+	name := WorkloadSnapshotName(config)
+	if name != WorkloadSnapshotName(config) {
+		t.Error("WorkloadSnapshotName() is not stable")
+	}
+	bigger := config
+	bigger.MemoryMB = 256
+	if name == WorkloadSnapshotName(bigger) {
+		t.Error("WorkloadSnapshotName() ignores the VM size")
+	}
+}
@@ -0,0 +1,257 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pipeops/firecracker-cri/pkg/checksum"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// A snapshot holds the memory of a VM that booted a particular kernel and
+// rootfs and ran a particular agent. Restoring it after any of them was
+// replaced brings back the old ones, so the SHA-256 of each is recorded in
+// the snapshot's metadata and the golden snapshot is rebuilt when they no
+// longer match.
+const (
+	inputKernel = "kernel"
+	inputInitrd = "initrd"
+	inputRootfs = "rootfs"
+	inputAgent  = "agent"
+
+	// inputMetadataSuffix names the metadata keys of input hashes, e.g.
+	// "kernel_sha256".
+	inputMetadataSuffix = "_sha256"
+)
+
+// inputHash is the SHA-256 of a file, as of the size and modification time
+// it had when it was hashed.
+type inputHash struct {
+	version string
+	sum     string
+}
+
+// inputPaths returns the files a VM with the given configuration depends
+// on, by input name. Inputs the configuration doesn't use are left out.
+func (sm *SnapshotManager) inputPaths(config domain.VMConfig) map[string]string {
+	paths := make(map[string]string)
+	kernel := config.KernelPath
+	if kernel == "" && sm.vmManager != nil {
+		kernel = sm.vmManager.config.DefaultKernelPath
+	}
+	if kernel != "" {
+		paths[inputKernel] = kernel
+	}
+	if config.InitrdPath != "" {
+		paths[inputInitrd] = config.InitrdPath
+	}
+	if config.RootDrive.PathOnHost != "" {
+		paths[inputRootfs] = config.RootDrive.PathOnHost
+	}
+	if sm.config.AgentBinaryPath != "" {
+		paths[inputAgent] = sm.config.AgentBinaryPath
+	}
+	return paths
+}
+
+// inputHashes returns the SHA-256 of each input of a VM configuration, as
+// snapshot metadata. Files are only hashed again once they change, so
+// checking a snapshot costs a stat per input. A missing agent binary is
+// left out, as the agent may only exist inside the rootfs.
+func (sm *SnapshotManager) inputHashes(config domain.VMConfig) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for name, path := range sm.inputPaths(config) {
+		sum, err := sm.hashInput(path)
+		if err != nil {
+			if name == inputAgent && os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to hash %s %s: %w", name, path, err)
+		}
+		hashes[name+inputMetadataSuffix] = sum
+	}
+	return hashes, nil
+}
+
+// hashInput returns the SHA-256 of a file, from the cache while the file
+// is unchanged.
+func (sm *SnapshotManager) hashInput(path string) (string, error) {
+	version, err := inputVersion(path)
+	if err != nil {
+		return "", err
+	}
+
+	sm.hashMu.Lock()
+	cached, ok := sm.hashes[path]
+	sm.hashMu.Unlock()
+	if ok && cached.version == version {
+		return cached.sum, nil
+	}
+
+	sum, err := checksum.FileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	// A file replaced while it was hashed is hashed again next time
+	if after, err := inputVersion(path); err != nil || after != version {
+		return sum, nil
+	}
+
+	sm.hashMu.Lock()
+	sm.hashes[path] = inputHash{version: version, sum: sum}
+	sm.hashMu.Unlock()
+	return sum, nil
+}
+
+// inputVersion identifies the contents of a file by its size and
+// modification time.
+func inputVersion(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("size=%d mtime=%d", info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// staleInputs returns the inputs of a snapshot that changed since it was
+// taken. Snapshots that predate input hashes are stale as a whole.
+func (sm *SnapshotManager) staleInputs(snap *Snapshot) ([]string, error) {
+	current, err := sm.inputHashes(snap.VMConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := false
+	for key := range snap.Metadata {
+		if strings.HasSuffix(key, inputMetadataSuffix) {
+			recorded = true
+			break
+		}
+	}
+	if !recorded {
+		return []string{"unrecorded"}, nil
+	}
+
+	var stale []string
+	for key, sum := range current {
+		if snap.Metadata[key] != sum {
+			stale = append(stale, strings.TrimSuffix(key, inputMetadataSuffix))
+		}
+	}
+	for key := range snap.Metadata {
+		if _, ok := current[key]; !ok && strings.HasSuffix(key, inputMetadataSuffix) {
+			stale = append(stale, strings.TrimSuffix(key, inputMetadataSuffix))
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// checkGolden invalidates the golden snapshot if its inputs changed, and
+// starts rebuilding it. It reports whether the golden snapshot can be
+// restored.
+func (sm *SnapshotManager) checkGolden() bool {
+	sm.mu.RLock()
+	golden := sm.goldenSnapshot
+	sm.mu.RUnlock()
+	if golden == nil {
+		return false
+	}
+
+	stale, err := sm.staleInputs(golden)
+	if err != nil {
+		// Can't tell, e.g. the kernel is being replaced; the next check will
+		sm.log.WithError(err).Warn("Failed to check golden snapshot inputs")
+		return false
+	}
+	if len(stale) == 0 {
+		return true
+	}
+
+	sm.log.WithFields(logrus.Fields{
+		"snapshot": golden.Name,
+		"changed":  strings.Join(stale, ","),
+	}).Warn("Golden snapshot is stale, rebuilding it")
+	sm.invalidate(golden)
+	sm.rebuildGolden()
+	return false
+}
+
+// invalidate removes a snapshot, golden or not, and the Diff snapshots
+// layered on it.
+func (sm *SnapshotManager) invalidate(snap *Snapshot) {
+	sm.mu.Lock()
+	if sm.snapshots[snap.Name] == snap {
+		delete(sm.snapshots, snap.Name)
+		sm.removeDependents(snap.Name)
+	}
+	if sm.goldenSnapshot == snap {
+		sm.goldenSnapshot = nil
+	}
+	sm.mu.Unlock()
+
+	if err := os.RemoveAll(filepath.Dir(snap.MemoryPath)); err != nil {
+		sm.log.WithError(err).WithField("snapshot", snap.Name).Warn("Failed to remove stale snapshot")
+	}
+}
+
+// rebuildGolden creates a new golden snapshot in the background, unless a
+// rebuild is already running.
+func (sm *SnapshotManager) rebuildGolden() {
+	sm.mu.Lock()
+	if sm.rebuilding {
+		sm.mu.Unlock()
+		return
+	}
+	sm.rebuilding = true
+	sm.mu.Unlock()
+
+	go func() {
+		defer func() {
+			sm.mu.Lock()
+			sm.rebuilding = false
+			sm.mu.Unlock()
+		}()
+
+		if _, err := sm.CreateGoldenSnapshot(context.Background()); err != nil {
+			sm.log.WithError(err).Error("Failed to rebuild golden snapshot")
+			return
+		}
+		metrics.Global().RecordSnapshotRebuild()
+	}()
+}
+
+// RebuildGoldenSnapshot replaces the golden snapshot, and the Diff
+// snapshots layered on it, with a new one, e.g. after an operator updated
+// the guest image.
+func (sm *SnapshotManager) RebuildGoldenSnapshot(ctx context.Context) (*Snapshot, error) {
+	sm.mu.Lock()
+	if sm.rebuilding {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("golden snapshot rebuild already running")
+	}
+	sm.rebuilding = true
+	golden := sm.goldenSnapshot
+	sm.mu.Unlock()
+	defer func() {
+		sm.mu.Lock()
+		sm.rebuilding = false
+		sm.mu.Unlock()
+	}()
+
+	if golden != nil {
+		sm.invalidate(golden)
+	}
+	snap, err := sm.CreateGoldenSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics.Global().RecordSnapshotRebuild()
+	return snap, nil
+}
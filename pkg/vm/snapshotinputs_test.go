@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSnapshotInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, mtime time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	now := time.Now()
+	kernel := write("vmlinux", "kernel v1", now)
+	rootfs := write("rootfs.ext4", "rootfs v1", now)
+	agent := write("fc-agent", "agent v1", now)
+
+	sm := &SnapshotManager{
+		config:    SnapshotConfig{AgentBinaryPath: agent},
+		log:       logrus.NewEntry(logrus.New()),
+		snapshots: make(map[string]*Snapshot),
+		hashes:    make(map[string]inputHash),
+	}
+	config := domain.VMConfig{
+		KernelPath: kernel,
+		RootDrive:  domain.DriveConfig{PathOnHost: rootfs},
+	}
+
+	inputs, err := sm.inputHashes(config)
+	if err != nil {
+		t.Fatalf("inputHashes() error = %v", err)
+	}
+	if len(inputs) != 3 || inputs["kernel_sha256"] == "" || inputs["rootfs_sha256"] == "" || inputs["agent_sha256"] == "" {
+		t.Fatalf("inputHashes() = %v, want kernel, rootfs and agent", inputs)
+	}
+
+	snapDir := filepath.Join(dir, "golden-base")
+	if err := os.MkdirAll(snapDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	golden := &Snapshot{
+		Name:       "golden-base",
+		MemoryPath: filepath.Join(snapDir, "memory"),
+		VMConfig:   config,
+		IsGolden:   true,
+		Metadata:   inputs,
+	}
+	if stale, err := sm.staleInputs(golden); err != nil || len(stale) != 0 {
+		t.Errorf("staleInputs() of a fresh snapshot = %v, %v", stale, err)
+	}
+
+	// Snapshots without recorded inputs can't be trusted
+	if stale, _ := sm.staleInputs(&Snapshot{VMConfig: config}); !reflect.DeepEqual(stale, []string{"unrecorded"}) {
+		t.Errorf("staleInputs() without metadata = %v, want [unrecorded]", stale)
+	}
+
+	// A new agent and kernel make the snapshot stale
+	later := now.Add(time.Minute)
+	write("fc-agent", "agent v2", later)
+	write("vmlinux", "kernel v2", later)
+	if stale, err := sm.staleInputs(golden); err != nil || !reflect.DeepEqual(stale, []string{"agent", "kernel"}) {
+		t.Errorf("staleInputs() after upgrade = %v, %v, want [agent kernel]", stale, err)
+	}
+
+	// A removed agent binary is a change too
+	if err := os.Remove(agent); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := sm.staleInputs(golden); err != nil || !reflect.DeepEqual(stale, []string{"agent", "kernel"}) {
+		t.Errorf("staleInputs() without agent = %v, %v, want [agent kernel]", stale, err)
+	}
+
+	// The stale golden snapshot is dropped; snapshots aren't enabled, so
+	// the rebuild fails straight away
+	sm.snapshots[golden.Name] = golden
+	sm.goldenSnapshot = golden
+	if sm.checkGolden() {
+		t.Error("checkGolden() of a stale snapshot = true, want false")
+	}
+	if sm.HasGoldenSnapshot() {
+		t.Error("stale golden snapshot was kept")
+	}
+	if _, err := os.Stat(snapDir); !os.IsNotExist(err) {
+		t.Errorf("stale snapshot files were kept: %v", err)
+	}
+}
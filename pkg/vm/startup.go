@@ -0,0 +1,446 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+// A networked VM comes up in stages that depend on each other: CNI creates
+// the sandbox's network namespace and tap, Firecracker attaches the tap as
+// eth0 when it boots, and only then can the agent configure eth0 in the
+// guest. CreateVM runs them strictly in order, retrying each, so a guest
+// never configures eth0 before its tap exists.
+const (
+	StageNetworkSetup = "network_setup"
+	StageTapReady     = "tap_ready"
+	StageVMBoot       = "vm_boot"
+	StageAgentConnect = "agent_connect"
+	StageAgentNetwork = "agent_network"
+)
+
+// StartupConfig configures the retries of the startup stages.
+type StartupConfig struct {
+	// NetworkAttempts is how many times CNI setup is tried.
+	NetworkAttempts int
+
+	// TapTimeout is how long the tap may take to appear in the sandbox's
+	// network namespace after CNI setup.
+	TapTimeout time.Duration
+
+	// AgentAttempts is how many times connecting to the agent and pushing
+	// the network configuration are each tried.
+	AgentAttempts int
+
+	// AgentTimeout bounds each attempt to connect to the agent.
+	AgentTimeout time.Duration
+
+	// RetryDelay is the pause between attempts, doubled after each.
+	RetryDelay time.Duration
+
+	// CreateAttempts is how many times CreateVM tries to create a VM whose
+	// creation failed transiently (see ClassifyError).
+	CreateAttempts int
+
+	// CreateMaxDelay caps the pause between CreateVM attempts.
+	CreateMaxDelay time.Duration
+
+	// PendingNetworkInterval is how often the network setup of a sandbox
+	// whose CNI plugin timed out is tried again in the background.
+	PendingNetworkInterval time.Duration
+
+	// PendingNetworkTTL is how long such a sandbox's network is retried,
+	// and then kept for a creation to adopt, before it is torn down. Zero
+	// tears it down right away, like any other failed setup.
+	PendingNetworkTTL time.Duration
+}
+
+// DefaultStartupConfig returns the default startup retries.
+func DefaultStartupConfig() StartupConfig {
+	return StartupConfig{
+		NetworkAttempts: 3,
+		TapTimeout:      5 * time.Second,
+		AgentAttempts:   5,
+		AgentTimeout:    10 * time.Second,
+		RetryDelay:      200 * time.Millisecond,
+		CreateAttempts:  3,
+		CreateMaxDelay:  2 * time.Second,
+
+		PendingNetworkInterval: 10 * time.Second,
+		PendingNetworkTTL:      5 * time.Minute,
+	}
+}
+
+// StartupError is the failure of one stage of bringing up a VM.
+type StartupError struct {
+	SandboxID string
+	Stage     string
+	Attempts  int
+	Err       error
+}
+
+func (e *StartupError) Error() string {
+	return fmt.Sprintf("sandbox %s: %s failed after %d attempt(s): %v", e.SandboxID, e.Stage, e.Attempts, e.Err)
+}
+
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+// SetNetworkService makes CreateVM set up CNI networking for VMs with
+// network mode "cni". Without one, VMs boot without a network interface.
+func (m *Manager) SetNetworkService(service domain.NetworkService) {
+	m.network = service
+}
+
+// runStage runs a startup stage until it succeeds, up to attempts times,
+// backing off between attempts. undo, if set, cleans up after a failed
+// attempt. A CNI plugin timeout ends the stage at once: the plugin would
+// likely hang again, holding up the creation for another timeout.
+func runStage(ctx context.Context, sandboxID, stage string, attempts int, delay time.Duration, log *logrus.Entry, fn func() error, undo func()) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if undo != nil {
+			undo()
+		}
+		if network.IsPluginTimeout(err) {
+			return &StartupError{SandboxID: sandboxID, Stage: stage, Attempts: attempt, Err: err}
+		}
+		if attempt == attempts {
+			break
+		}
+		if ctx.Err() != nil {
+			return &StartupError{SandboxID: sandboxID, Stage: stage, Attempts: attempt, Err: ctx.Err()}
+		}
+
+		log.WithError(err).WithFields(logrus.Fields{
+			"sandbox_id": sandboxID,
+			"stage":      stage,
+			"attempt":    attempt,
+		}).Warn("Startup stage failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return &StartupError{SandboxID: sandboxID, Stage: stage, Attempts: attempt, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return &StartupError{SandboxID: sandboxID, Stage: stage, Attempts: attempts, Err: err}
+}
+
+// setupNetwork runs CNI for a sandbox and waits for its tap, so the VM can
+// be booted with it. It does nothing without a network service or for VMs
+// without CNI networking.
+func (m *Manager) setupNetwork(ctx context.Context, sandbox *domain.Sandbox, config domain.VMConfig) error {
+	if m.network == nil || config.NetworkMode != "cni" {
+		return nil
+	}
+	// Networks completed in the background (see pendingnet.go) are set up
+	if sandbox.NetworkNamespace != "" {
+		return nil
+	}
+	startup := m.config.Startup
+	sandbox.PortMappings = config.PortMappings
+
+	err := runStage(ctx, sandbox.ID, StageNetworkSetup, startup.NetworkAttempts, startup.RetryDelay, m.log,
+		func() error { return m.network.Setup(ctx, sandbox, config.CNIConfig) },
+		func() { m.teardownNetwork(ctx, sandbox) })
+	if err != nil {
+		if network.IsPluginTimeout(err) && startup.PendingNetworkTTL > 0 {
+			m.parkNetwork(sandbox, config)
+		}
+		return err
+	}
+
+	// The taps must exist before Firecracker opens them
+	err = runStage(ctx, sandbox.ID, StageTapReady, 1, 0, m.log,
+		func() error { return waitForTaps(ctx, sandbox, startup.TapTimeout) },
+		nil)
+	if err != nil {
+		m.teardownNetwork(ctx, sandbox)
+		return err
+	}
+	return nil
+}
+
+// teardownNetwork removes a sandbox's CNI networking, if it has any.
+func (m *Manager) teardownNetwork(ctx context.Context, sandbox *domain.Sandbox) {
+	if m.network == nil || sandbox.NetworkNamespace == "" {
+		return
+	}
+	if err := m.network.Teardown(ctx, sandbox); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to tear down network")
+	}
+	sandbox.NetworkNamespace = ""
+	sandbox.IP = nil
+	sandbox.Netmask = nil
+	sandbox.IPs = nil
+	sandbox.Gateway = nil
+	sandbox.Routes = nil
+	sandbox.DNS = nil
+	sandbox.DNSSearch = nil
+	sandbox.PortMappings = nil
+	sandbox.Attachment = domain.NetworkAttachment{}
+	sandbox.Networks = nil
+}
+
+const (
+	// ifnamesArg keeps the kernel's ethN interface names. Guests running
+	// udev would otherwise rename eth0 to ens3 or similar, depending on
+	// their kernel config.
+	ifnamesArg = "net.ifnames=0"
+
+	// guestMACArg passes the MAC of the sandbox's interface to the agent,
+	// which finds the interface by it rather than by name.
+	guestMACArg = "fc_cri.eth_mac="
+
+	// The sandbox's address, gateway, nameservers and search domains, which
+	// the agent configures the interface with at boot, so guests need no
+	// DHCP client.
+	guestIPArg     = "fc_cri.ip="
+	gatewayArg     = "fc_cri.gw="
+	guestDNSArg    = "fc_cri.dns="
+	guestSearchArg = "fc_cri.search="
+)
+
+// attachNetwork adds the sandbox's CNI tap to a VM's Firecracker config as
+// its first interface, eth0 in the guest, followed by the taps of its
+// additional networks, and runs Firecracker in the sandbox's network
+// namespace, where the taps are.
+func attachNetwork(sandbox *domain.Sandbox, fcConfig *firecracker.Config) {
+	if sandbox.NetworkNamespace == "" {
+		return
+	}
+	mac := sandboxMAC(sandbox)
+	sandbox.Attachment.GuestMAC = mac
+	fcConfig.NetNS = sandbox.NetworkNamespace
+	interfaces := []firecracker.NetworkInterface{{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  mac,
+			HostDevName: network.TapName,
+		},
+	}}
+	for i := range sandbox.Networks {
+		n := &sandbox.Networks[i]
+		if n.GuestMAC == "" {
+			n.GuestMAC = interfaceMAC(sandbox.ID, fmt.Sprintf("eth%d", i+1))
+		}
+		interfaces = append(interfaces, firecracker.NetworkInterface{
+			StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+				MacAddress:  n.GuestMAC,
+				HostDevName: n.TapName,
+			},
+		})
+	}
+	fcConfig.NetworkInterfaces = append(interfaces, fcConfig.NetworkInterfaces...)
+	fcConfig.KernelArgs = withNetworkArgs(fcConfig.KernelArgs, mac)
+	fcConfig.KernelArgs = withStaticNetworkArgs(fcConfig.KernelArgs, sandbox)
+}
+
+// withNetworkArgs adds the interface naming parameters to a kernel command
+// line. A net.ifnames the command line already sets is kept.
+func withNetworkArgs(cmdline, mac string) string {
+	args := []string{guestMACArg + mac}
+	hasIfnames := false
+	for _, field := range strings.Fields(cmdline) {
+		if strings.HasPrefix(field, "net.ifnames=") {
+			hasIfnames = true
+		}
+	}
+	if !hasIfnames {
+		args = append([]string{ifnamesArg}, args...)
+	}
+	return strings.TrimSpace(cmdline + " " + strings.Join(args, " "))
+}
+
+// withStaticNetworkArgs adds the sandbox's addresses, gateway, nameservers
+// and search domains to a kernel command line.
+func withStaticNetworkArgs(cmdline string, sandbox *domain.Sandbox) string {
+	addresses := guestAddresses(sandbox)
+	if len(addresses) == 0 {
+		return cmdline
+	}
+	cidrs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		cidrs = append(cidrs, address.String())
+	}
+	args := []string{guestIPArg + strings.Join(cidrs, ",")}
+	if sandbox.Gateway != nil {
+		args = append(args, gatewayArg+sandbox.Gateway.String())
+	}
+	if len(sandbox.DNS) > 0 {
+		servers := make([]string, 0, len(sandbox.DNS))
+		for _, server := range sandbox.DNS {
+			servers = append(servers, server.String())
+		}
+		args = append(args, guestDNSArg+strings.Join(servers, ","))
+	}
+	if len(sandbox.DNSSearch) > 0 {
+		args = append(args, guestSearchArg+strings.Join(sandbox.DNSSearch, ","))
+	}
+	return strings.TrimSpace(cmdline + " " + strings.Join(args, " "))
+}
+
+// guestAddresses returns the addresses of a sandbox's interface, the
+// primary first. Sandboxes set up before dual-stack support only have IP.
+func guestAddresses(sandbox *domain.Sandbox) []*net.IPNet {
+	if len(sandbox.IPs) > 0 {
+		return sandbox.IPs
+	}
+	if sandbox.IP == nil || sandbox.Netmask == nil {
+		return nil
+	}
+	return []*net.IPNet{{IP: sandbox.IP, Mask: sandbox.Netmask}}
+}
+
+// sandboxMAC returns the MAC of a sandbox's eth0: the one the network
+// service allocated, or else guestMAC's.
+func sandboxMAC(sandbox *domain.Sandbox) string {
+	if sandbox.Attachment.GuestMAC != "" {
+		return sandbox.Attachment.GuestMAC
+	}
+	return guestMAC(sandbox.ID)
+}
+
+// guestMAC returns a stable, locally administered MAC for a sandbox's eth0.
+func guestMAC(sandboxID string) string {
+	return interfaceMAC(sandboxID, "eth0")
+}
+
+// interfaceMAC returns a stable, locally administered MAC for a guest
+// interface of a sandbox whose network service allocated none. It has the
+// prefix the service would have given the interface.
+func interfaceMAC(sandboxID, guestIf string) string {
+	prefix := network.AdditionalMACPrefix
+	if guestIf == "eth0" {
+		prefix = network.GuestMACPrefix
+	}
+	h := sha256.Sum256([]byte(guestIf + "/" + sandboxID))
+	return fmt.Sprintf("%s:%02x:%02x:%02x:%02x", prefix, h[0], h[1], h[2], h[3])
+}
+
+// waitForTaps waits for the taps of a sandbox's networks to appear in its
+// network namespace, each for up to timeout.
+func waitForTaps(ctx context.Context, sandbox *domain.Sandbox, timeout time.Duration) error {
+	if err := waitForTap(ctx, sandbox.NetworkNamespace, network.TapName, timeout); err != nil {
+		return err
+	}
+	for _, n := range sandbox.Networks {
+		if err := waitForTap(ctx, sandbox.NetworkNamespace, n.TapName, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForTap waits for a tap to appear in a network namespace.
+func waitForTap(ctx context.Context, netns, tap string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := exec.CommandContext(ctx, "ip", "-netns", filepath.Base(netns), "link", "show", tap).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tap %s did not appear in %s: %s", tap, netns, strings.TrimSpace(string(output)))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// pushGuestNetwork connects to a freshly booted VM's agent, confirms the
+// static address it configured at boot and installs the sandbox's routes
+// on eth0. eth0 may still be coming up in the guest, so every step is
+// retried.
+func (m *Manager) pushGuestNetwork(ctx context.Context, sandbox *domain.Sandbox) error {
+	if len(sandbox.Routes) == 0 && sandbox.IP == nil {
+		return nil
+	}
+	startup := m.config.Startup
+
+	client := agent.NewClient(m.log.WithField("sandbox_id", sandbox.ID))
+	client.SetAuthKey(sandbox.AgentKey)
+	err := runStage(ctx, sandbox.ID, StageAgentConnect, startup.AgentAttempts, startup.RetryDelay, m.log,
+		func() error {
+			connectCtx, cancel := context.WithTimeout(ctx, startup.AgentTimeout)
+			defer cancel()
+			return client.Connect(connectCtx, sandbox.VsockPath, sandbox.VsockCID, AgentPort(sandbox.VMConfig))
+		}, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Applying the kernel command line's address again is a no-op, but
+	// turns a guest that failed to apply it into a startup error
+	if addresses := guestAddresses(sandbox); len(addresses) > 0 && client.Supports(agent.FeatureNetwork) {
+		err := runStage(ctx, sandbox.ID, StageAgentNetwork, startup.AgentAttempts, startup.RetryDelay, m.log,
+			func() error {
+				return client.ConfigureNetwork(ctx, addresses, sandbox.Gateway, sandbox.DNS, sandbox.DNSSearch)
+			}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sandbox.DNSSearch) > 0 && !client.Supports(agent.FeatureDNSSearch) {
+		m.log.WithField("sandbox_id", sandbox.ID).Warn("Guest agent can't set DNS search domains, they don't apply")
+	}
+	if err := m.pushAdditionalNetworks(ctx, client, sandbox); err != nil {
+		return err
+	}
+
+	if len(sandbox.Routes) == 0 {
+		return nil
+	}
+	if !client.Supports(agent.FeatureRoutes) {
+		m.log.WithField("sandbox_id", sandbox.ID).Warn("Guest agent can't set routes, only the default route applies")
+		return nil
+	}
+	return runStage(ctx, sandbox.ID, StageAgentNetwork, startup.AgentAttempts, startup.RetryDelay, m.log,
+		func() error { return client.SetRoutes(ctx, sandbox.Routes) }, nil)
+}
+
+// pushAdditionalNetworks configures the guest interfaces of a sandbox's
+// additional networks, which the kernel command line doesn't describe. A
+// pod that asked for networks its guest can't configure fails to start.
+func (m *Manager) pushAdditionalNetworks(ctx context.Context, client *agent.Client, sandbox *domain.Sandbox) error {
+	if len(sandbox.Networks) == 0 {
+		return nil
+	}
+	if !client.Supports(agent.FeatureInterfaces) {
+		return &StartupError{SandboxID: sandbox.ID, Stage: StageAgentNetwork, Attempts: 1,
+			Err: fmt.Errorf("guest agent can't configure additional networks")}
+	}
+	startup := m.config.Startup
+	for _, n := range sandbox.Networks {
+		n := n
+		err := runStage(ctx, sandbox.ID, StageAgentNetwork, startup.AgentAttempts, startup.RetryDelay, m.log,
+			func() error { return client.ConfigureInterface(ctx, n.GuestMAC, n.IPs, n.Routes) }, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRunStage(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	ctx := context.Background()
+
+	// Succeeds on the third attempt, cleaning up after each failure
+	calls, undos := 0, 0
+	err := runStage(ctx, "sb", StageNetworkSetup, 3, 0, log,
+		func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("no IPs left")
+			}
+			return nil
+		},
+		func() { undos++ })
+	if err != nil || calls != 3 || undos != 2 {
+		t.Errorf("runStage() = %v after %d calls and %d undos, want success after 3 and 2", err, calls, undos)
+	}
+
+	// Failures name the stage and keep the cause
+	cause := errors.New("connection refused")
+	err = runStage(ctx, "sb", StageAgentConnect, 2, 0, log, func() error { return cause }, nil)
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) {
+		t.Fatalf("runStage() error = %v, want a StartupError", err)
+	}
+	if startupErr.Stage != StageAgentConnect || startupErr.Attempts != 2 || !errors.Is(err, cause) {
+		t.Errorf("runStage() error = %+v", startupErr)
+	}
+
+	// A cancelled context stops the retries
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	calls = 0
+	err = runStage(cancelled, "sb", StageAgentNetwork, 5, 0, log, func() error { calls++; return cause }, nil)
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("runStage() with cancelled context = %v after %d calls, want canceled after 1", err, calls)
+	}
+}
+
+func TestGuestMAC(t *testing.T) {
+	mac := guestMAC("fc-123")
+	if mac != guestMAC("fc-123") {
+		t.Error("guestMAC() is not stable")
+	}
+	if mac == guestMAC("fc-456") || mac == mmdsMAC("fc-123") {
+		t.Error("guestMAC() collides with another interface")
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatalf("guestMAC() = %q: %v", mac, err)
+	}
+	if hw[0]&0x02 == 0 || hw[0]&0x01 != 0 {
+		t.Errorf("guestMAC() = %s, want a locally administered unicast address", mac)
+	}
+}
+
+func TestAttachNetworkAdditional(t *testing.T) {
+	sandbox := &domain.Sandbox{
+		ID:               "fc-123",
+		NetworkNamespace: "/var/run/netns/fc-123",
+		Networks: []domain.AdditionalNetwork{
+			{Name: "storage", IfName: "net1", TapName: "tap1"},
+			{Name: "backup", IfName: "net2", TapName: "tap2"},
+		},
+	}
+	mmds := firecracker.NetworkInterface{StaticConfiguration: &firecracker.StaticNetworkConfiguration{HostDevName: "mmds0"}}
+	fcConfig := firecracker.Config{NetworkInterfaces: []firecracker.NetworkInterface{mmds}}
+	attachNetwork(sandbox, &fcConfig)
+
+	// eth0, then eth1 and eth2 in the order of the networks, then MMDS
+	var taps []string
+	for _, iface := range fcConfig.NetworkInterfaces {
+		taps = append(taps, iface.StaticConfiguration.HostDevName)
+	}
+	if strings.Join(taps, ",") != "tap0,tap1,tap2,mmds0" {
+		t.Errorf("interfaces = %v, want [tap0 tap1 tap2 mmds0]", taps)
+	}
+	seen := map[string]bool{sandbox.Attachment.GuestMAC: true}
+	for i, n := range sandbox.Networks {
+		if n.GuestMAC == "" || seen[n.GuestMAC] {
+			t.Errorf("network %s has MAC %q, want a distinct one", n.Name, n.GuestMAC)
+		}
+		seen[n.GuestMAC] = true
+		if got := fcConfig.NetworkInterfaces[i+1].StaticConfiguration.MacAddress; got != n.GuestMAC {
+			t.Errorf("interface %d MAC = %s, want %s", i+1, got, n.GuestMAC)
+		}
+		// Only eth0 has the prefix the rootfs's udev rule names eth0
+		if strings.HasPrefix(n.GuestMAC, network.GuestMACPrefix) {
+			t.Errorf("network %s has MAC %s, with eth0's prefix", n.Name, n.GuestMAC)
+		}
+	}
+}
+
+func TestAttachNetworkAllocatedMACs(t *testing.T) {
+	sandbox := &domain.Sandbox{
+		ID:               "fc-123",
+		NetworkNamespace: "/var/run/netns/fc-123",
+		Attachment:       domain.NetworkAttachment{GuestMAC: "02:fc:12:34:56:78"},
+		Networks:         []domain.AdditionalNetwork{{Name: "storage", TapName: "tap1", GuestMAC: "02:fd:12:34:56:78"}},
+	}
+	var fcConfig firecracker.Config
+	attachNetwork(sandbox, &fcConfig)
+
+	// The MACs the network service allocated are kept
+	var macs []string
+	for _, iface := range fcConfig.NetworkInterfaces {
+		macs = append(macs, iface.StaticConfiguration.MacAddress)
+	}
+	if strings.Join(macs, ",") != "02:fc:12:34:56:78,02:fd:12:34:56:78" {
+		t.Errorf("interface MACs = %v, want the allocated ones", macs)
+	}
+	if !strings.Contains(fcConfig.KernelArgs, guestMACArg+"02:fc:12:34:56:78") {
+		t.Errorf("kernel args = %q, want the allocated eth0 MAC", fcConfig.KernelArgs)
+	}
+}
+
+func TestWithNetworkArgs(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    string
+	}{
+		{"console=ttyS0 quiet", "console=ttyS0 quiet net.ifnames=0 fc_cri.eth_mac=02:fc:00:00:00:01"},
+		{"", "net.ifnames=0 fc_cri.eth_mac=02:fc:00:00:00:01"},
+		// Images that want predictable names keep them; the agent goes by MAC
+		{"console=ttyS0 net.ifnames=1", "console=ttyS0 net.ifnames=1 fc_cri.eth_mac=02:fc:00:00:00:01"},
+	}
+	for _, tt := range tests {
+		if got := withNetworkArgs(tt.cmdline, "02:fc:00:00:00:01"); got != tt.want {
+			t.Errorf("withNetworkArgs(%q) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestWithStaticNetworkArgs(t *testing.T) {
+	sandbox := domain.NewSandbox("sb1")
+	if got := withStaticNetworkArgs("console=ttyS0", sandbox); got != "console=ttyS0" {
+		t.Errorf("withStaticNetworkArgs() without an address = %q", got)
+	}
+
+	sandbox.IP = net.ParseIP("10.88.0.5")
+	sandbox.Netmask = net.CIDRMask(16, 32)
+	sandbox.Gateway = net.ParseIP("10.88.0.1")
+	sandbox.DNS = []net.IP{net.ParseIP("10.96.0.10"), net.ParseIP("1.1.1.1")}
+	sandbox.DNSSearch = []string{"default.svc.cluster.local", "corp.example.com"}
+	want := "console=ttyS0 fc_cri.ip=10.88.0.5/16 fc_cri.gw=10.88.0.1 fc_cri.dns=10.96.0.10,1.1.1.1" +
+		" fc_cri.search=default.svc.cluster.local,corp.example.com"
+	if got := withStaticNetworkArgs("console=ttyS0", sandbox); got != want {
+		t.Errorf("withStaticNetworkArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestWithStaticNetworkArgs_DualStack(t *testing.T) {
+	sandbox := domain.NewSandbox("sb1")
+	_, v4, _ := net.ParseCIDR("10.88.0.0/16")
+	_, v6, _ := net.ParseCIDR("fd00:fc::/64")
+	sandbox.IPs = []*net.IPNet{
+		{IP: net.ParseIP("10.88.0.5"), Mask: v4.Mask},
+		{IP: net.ParseIP("fd00:fc::5"), Mask: v6.Mask},
+	}
+	sandbox.IP, sandbox.Netmask = sandbox.IPs[0].IP, sandbox.IPs[0].Mask
+	want := "console=ttyS0 fc_cri.ip=10.88.0.5/16,fd00:fc::5/64"
+	if got := withStaticNetworkArgs("console=ttyS0", sandbox); got != want {
+		t.Errorf("withStaticNetworkArgs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// timeSyncTimeout bounds connecting to a restored VM's agent and setting
+// its clock, so a stuck agent doesn't hold up the restore.
+const timeSyncTimeout = 2 * time.Second
+
+// syncGuestClock sets the clock of a VM just resumed from a snapshot to the
+// host's. The guest resumes with the wall clock it had when the snapshot
+// was taken, and kvmclock only keeps the monotonic clock going, so TLS and
+// token expiry checks in the guest would see the snapshot's time.
+func (sm *SnapshotManager) syncGuestClock(ctx context.Context, sandbox *domain.Sandbox) error {
+	ctx, cancel := context.WithTimeout(ctx, timeSyncTimeout)
+	defer cancel()
+
+	client := agent.NewClient(sm.log.WithField("sandbox_id", sandbox.ID))
+	client.SetAuthKey(sandbox.AgentKey)
+	if err := client.Connect(ctx, sandbox.VsockPath, sandbox.VsockCID, AgentPort(sandbox.VMConfig)); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if !client.Supports(agent.FeatureTimeSync) {
+		return fmt.Errorf("agent does not support %s", agent.FeatureTimeSync)
+	}
+
+	offset, err := client.SyncTime(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sm.log.WithFields(logrus.Fields{
+		"sandbox_id": sandbox.ID,
+		"offset_ms":  offset.Milliseconds(),
+	}).Debug("Guest clock synchronized")
+	return nil
+}
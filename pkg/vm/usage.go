@@ -0,0 +1,236 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/agent"
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+	"github.com/pipeops/firecracker-cri/pkg/network"
+	"github.com/sirupsen/logrus"
+)
+
+// When a VM is destroyed, the manager records what it used over its life,
+// for usage-based chargeback. The guest's view comes from the agent before
+// the VM stops; the host's from the VMM's cgroup and tap once it has
+// exited, before they are removed.
+
+// usageTimeout bounds asking the agent of a VM being destroyed for its
+// usage, and writing the record to an HTTP sink.
+const usageTimeout = 5 * time.Second
+
+// UsageRecord is the resource usage of a VM over its life.
+type UsageRecord struct {
+	SandboxID string `json:"sandbox_id"`
+
+	// The pod the VM ran, empty for pooled VMs that never ran one. A VM
+	// the pool reused ran several, whose namespaces are UsedBy.
+	Namespace string   `json:"namespace,omitempty"`
+	Pod       string   `json:"pod,omitempty"`
+	UsedBy    []string `json:"used_by,omitempty"`
+	FromPool  bool     `json:"from_pool"`
+
+	VCPUs           int64     `json:"vcpus"`
+	MemoryMB        int64     `json:"memory_mb"`
+	StartedAt       time.Time `json:"started_at"`
+	EndedAt         time.Time `json:"ended_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+
+	// Host usage of the VMM, from its cgroup
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	MemoryPeakBytes uint64  `json:"memory_peak_bytes,omitempty"`
+	ReadBytes       uint64  `json:"read_bytes"`
+	WriteBytes      uint64  `json:"write_bytes"`
+
+	// Usage of the guest's containers, from the agent
+	GuestCPUSeconds float64 `json:"guest_cpu_seconds"`
+	GuestReadBytes  uint64  `json:"guest_read_bytes"`
+	GuestWriteBytes uint64  `json:"guest_write_bytes"`
+
+	// Traffic of the guest on the sandbox network, from its tap
+	NetRXBytes uint64 `json:"net_rx_bytes"`
+	NetTXBytes uint64 `json:"net_tx_bytes"`
+
+	// Missing names the sources that couldn't be read: "cgroup", "agent"
+	// or "network". Their fields are zero.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// UsageSink is where usage records are written.
+type UsageSink interface {
+	WriteUsage(ctx context.Context, record *UsageRecord) error
+}
+
+// NewUsageSink returns the sink a target names: an http:// or https:// URL
+// records are POSTed to as JSON, or a file, as a path or file:// URL,
+// records are appended to as JSON lines.
+func NewUsageSink(target string) (UsageSink, error) {
+	switch {
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return &httpUsageSink{url: target, client: &http.Client{Timeout: usageTimeout}}, nil
+	case strings.HasPrefix(target, "file://"):
+		target = strings.TrimPrefix(target, "file://")
+	}
+	if !filepath.IsAbs(target) {
+		return nil, fmt.Errorf("invalid usage sink %q (must be an absolute path or an http(s) URL)", target)
+	}
+	return &fileUsageSink{path: target}, nil
+}
+
+// fileUsageSink appends records to a JSON lines file. Each record is a
+// single append, so the shims of a node can share the file.
+type fileUsageSink struct {
+	path string
+}
+
+func (s *fileUsageSink) WriteUsage(ctx context.Context, record *UsageRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// httpUsageSink POSTs each record as JSON.
+type httpUsageSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpUsageSink) WriteUsage(ctx context.Context, record *UsageRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("usage sink returned %s", resp.Status)
+	}
+	return nil
+}
+
+// guestUsage asks the agent of a VM about to be destroyed for its
+// containers' usage, nil if it can't tell.
+func (m *Manager) guestUsage(ctx context.Context, sandbox *domain.Sandbox) *domain.PodStats {
+	if m.usage == nil || sandbox.State != domain.SandboxReady {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, usageTimeout)
+	defer cancel()
+	client := agent.NewClient(m.log.WithField("sandbox_id", sandbox.ID))
+	client.SetAuthKey(sandbox.AgentKey)
+	if err := client.Connect(ctx, sandbox.VsockPath, sandbox.VsockCID, AgentPort(sandbox.VMConfig)); err != nil {
+		return nil
+	}
+	defer client.Close()
+	if !client.Supports(agent.FeaturePodStats) {
+		return nil
+	}
+	stats, err := client.GetPodStats(ctx)
+	if err != nil {
+		return nil
+	}
+	return stats
+}
+
+// recordUsage writes the usage record of a VM whose VMM has exited. A
+// record that can't be written is logged, not retried.
+func (m *Manager) recordUsage(ctx context.Context, sandbox *domain.Sandbox, guest *domain.PodStats) {
+	if m.usage == nil {
+		return
+	}
+	host, _ := m.CgroupStats(sandbox)
+	record := usageRecord(sandbox, host, guest, time.Now())
+	if sandbox.NetworkNamespace != "" {
+		var err error
+		if record.NetRXBytes, record.NetTXBytes, err = network.TAPTraffic(sandbox.NetworkNamespace, network.TapName); err != nil {
+			record.Missing = append(record.Missing, "network")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, usageTimeout)
+	defer cancel()
+	if err := m.usage.WriteUsage(ctx, record); err != nil {
+		m.log.WithError(err).WithField("sandbox_id", sandbox.ID).Warn("Failed to write usage record")
+		return
+	}
+	m.log.WithFields(logrus.Fields{
+		"sandbox_id":  sandbox.ID,
+		"cpu_seconds": record.CPUSeconds,
+		"missing":     record.Missing,
+	}).Debug("Usage recorded")
+}
+
+// usageRecord builds the usage record of a VM from its cgroup's and its
+// agent's stats, either of which may be nil.
+func usageRecord(sandbox *domain.Sandbox, host *CgroupStats, guest *domain.PodStats, end time.Time) *UsageRecord {
+	started := sandbox.StartedAt
+	if started.IsZero() {
+		started = sandbox.CreatedAt
+	}
+	record := &UsageRecord{
+		SandboxID: sandbox.ID,
+		Namespace: sandbox.Namespace,
+		Pod:       sandbox.Name,
+		UsedBy:    sandbox.UsedBy,
+		FromPool:  sandbox.FromPool,
+		VCPUs:     sandbox.VMConfig.VcpuCount,
+		MemoryMB:  sandbox.VMConfig.MemoryMB,
+		StartedAt: started,
+		EndedAt:   end,
+	}
+	if !started.IsZero() {
+		record.DurationSeconds = end.Sub(started).Seconds()
+	}
+
+	if host != nil {
+		record.CPUSeconds = float64(host.CPUUsageUsec) / 1e6
+		record.MemoryPeakBytes = host.MemoryPeakBytes
+		record.ReadBytes = host.IOReadBytes
+		record.WriteBytes = host.IOWriteBytes
+	} else {
+		record.Missing = append(record.Missing, "cgroup")
+	}
+
+	if guest != nil {
+		var total domain.ContainerStats
+		for _, stats := range guest.Containers {
+			if stats != nil {
+				total.Add(stats)
+			}
+		}
+		record.GuestCPUSeconds = float64(total.CPUUsage) / 1e9
+		record.GuestReadBytes = total.ReadBytes
+		record.GuestWriteBytes = total.WriteBytes
+	} else {
+		record.Missing = append(record.Missing, "agent")
+	}
+	return record
+}
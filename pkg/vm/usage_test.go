@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pipeops/firecracker-cri/pkg/domain"
+)
+
+func TestUsageRecord(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sandbox := &domain.Sandbox{
+		ID:        "sb-1",
+		Namespace: "team-a",
+		Name:      "web",
+		UsedBy:    []string{"team-a"},
+		FromPool:  true,
+		StartedAt: start,
+		VMConfig:  domain.VMConfig{VcpuCount: 2, MemoryMB: 512},
+	}
+	host := &CgroupStats{CPUUsageUsec: 2500000, MemoryPeakBytes: 268435456, IOReadBytes: 4096, IOWriteBytes: 8192}
+	guest := &domain.PodStats{Containers: map[string]*domain.ContainerStats{
+		"a": {CPUUsage: 1500000000, ReadBytes: 100, WriteBytes: 200},
+		"b": {CPUUsage: 500000000, ReadBytes: 1, WriteBytes: 2},
+	}}
+
+	record := usageRecord(sandbox, host, guest, start.Add(90*time.Second))
+	want := &UsageRecord{
+		SandboxID:       "sb-1",
+		Namespace:       "team-a",
+		Pod:             "web",
+		UsedBy:          []string{"team-a"},
+		FromPool:        true,
+		VCPUs:           2,
+		MemoryMB:        512,
+		StartedAt:       start,
+		EndedAt:         start.Add(90 * time.Second),
+		DurationSeconds: 90,
+		CPUSeconds:      2.5,
+		MemoryPeakBytes: 268435456,
+		ReadBytes:       4096,
+		WriteBytes:      8192,
+		GuestCPUSeconds: 2,
+		GuestReadBytes:  101,
+		GuestWriteBytes: 202,
+	}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("usageRecord() = %+v, want %+v", record, want)
+	}
+}
+
+func TestUsageRecordMissing(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sandbox := &domain.Sandbox{ID: "sb-1", CreatedAt: created}
+
+	record := usageRecord(sandbox, nil, nil, created.Add(time.Minute))
+	if !reflect.DeepEqual(record.Missing, []string{"cgroup", "agent"}) {
+		t.Errorf("Missing = %v, want [cgroup agent]", record.Missing)
+	}
+	// A VM that never started is billed from its creation
+	if record.DurationSeconds != 60 {
+		t.Errorf("DurationSeconds = %v, want 60", record.DurationSeconds)
+	}
+}
+
+func TestNewUsageSink(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    UsageSink
+		wantErr bool
+	}{
+		{target: "/var/log/usage.jsonl", want: &fileUsageSink{path: "/var/log/usage.jsonl"}},
+		{target: "file:///var/log/usage.jsonl", want: &fileUsageSink{path: "/var/log/usage.jsonl"}},
+		{target: "usage.jsonl", wantErr: true},
+		{target: "ftp://billing/usage", wantErr: true},
+	}
+	for _, tt := range tests {
+		sink, err := NewUsageSink(tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewUsageSink(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if tt.want != nil && !reflect.DeepEqual(sink, tt.want) {
+			t.Errorf("NewUsageSink(%q) = %+v, want %+v", tt.target, sink, tt.want)
+		}
+	}
+
+	sink, err := NewUsageSink("https://billing.example.com/usage")
+	if err != nil {
+		t.Fatalf("NewUsageSink() error = %v", err)
+	}
+	if s, ok := sink.(*httpUsageSink); !ok || s.url != "https://billing.example.com/usage" {
+		t.Errorf("NewUsageSink() = %+v, want an HTTP sink", sink)
+	}
+}
+
+func TestFileUsageSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage", "usage.jsonl")
+	sink := &fileUsageSink{path: path}
+	for _, id := range []string{"sb-1", "sb-2"} {
+		if err := sink.WriteUsage(context.Background(), &UsageRecord{SandboxID: id}); err != nil {
+			t.Fatalf("WriteUsage() error = %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, record.SandboxID)
+	}
+	if !reflect.DeepEqual(ids, []string{"sb-1", "sb-2"}) {
+		t.Errorf("records = %v, want [sb-1 sb-2]", ids)
+	}
+}
+
+func TestHTTPUsageSink(t *testing.T) {
+	var got UsageRecord
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request = %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := NewUsageSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteUsage(context.Background(), &UsageRecord{SandboxID: "sb-1", CPUSeconds: 1.5}); err != nil {
+		t.Fatalf("WriteUsage() error = %v", err)
+	}
+	if got.SandboxID != "sb-1" || got.CPUSeconds != 1.5 {
+		t.Errorf("received %+v", got)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.WriteUsage(context.Background(), &UsageRecord{SandboxID: "sb-2"}); err == nil {
+		t.Error("WriteUsage() succeeded on a 500 response")
+	}
+}
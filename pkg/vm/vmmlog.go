@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+)
+
+// vmmLogFifo is the fifo, in the sandbox dir, a VMM whose log is captured
+// writes it to.
+const vmmLogFifo = "vmm.log.fifo"
+
+// captureVMMLog has Firecracker write its log to a fifo the SDK copies into
+// log, instead of to the stdout it shares with the shim.
+func captureVMMLog(sandboxDir, sandboxID string, log *logrus.Entry, fcConfig *firecracker.Config) {
+	fcConfig.LogFifo = filepath.Join(sandboxDir, vmmLogFifo)
+	fcConfig.LogLevel = "Info"
+	fcConfig.FifoLogWriter = newVMMLogWriter(sandboxID, log)
+}
+
+// resumeVMMLog copies the log of an adopted VMM into log again. The fifo
+// outlives the shim that created it, so a restarted shim picks up where it
+// left off.
+func resumeVMMLog(sandboxDir, sandboxID string, log *logrus.Entry) {
+	fifo, err := os.OpenFile(filepath.Join(sandboxDir, vmmLogFifo), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("sandbox_id", sandboxID).Warn("Failed to resume VMM log")
+		}
+		return
+	}
+	go func() {
+		defer fifo.Close()
+		_, _ = io.Copy(newVMMLogWriter(sandboxID, log), fifo)
+	}()
+}
+
+// vmmLogWriter logs each line Firecracker writes, at the level it logged it
+// at. Lines look like:
+//
+//	2024-01-02T15:04:05.000000000 [fc-1234:main:WARN:src/vmm/src/lib.rs:123] message
+type vmmLogWriter struct {
+	log *logrus.Entry
+	buf []byte
+}
+
+func newVMMLogWriter(sandboxID string, log *logrus.Entry) *vmmLogWriter {
+	return &vmmLogWriter{log: log.WithFields(logrus.Fields{
+		"component":  "vmm",
+		"sandbox_id": sandboxID,
+	})}
+}
+
+// Write logs the complete lines in p, keeping a trailing partial line for
+// the next write. It is only called from the goroutine copying the fifo.
+func (w *vmmLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(w.buf[:i])); line != "" {
+			w.log.Log(vmmLogLevel(line), line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// vmmLogLevel returns the level of a Firecracker log line.
+func vmmLogLevel(line string) logrus.Level {
+	switch {
+	case strings.Contains(line, ":ERROR:"):
+		return logrus.ErrorLevel
+	case strings.Contains(line, ":WARN:"):
+		return logrus.WarnLevel
+	case strings.Contains(line, ":DEBUG:"), strings.Contains(line, ":TRACE:"):
+		return logrus.DebugLevel
+	}
+	return logrus.InfoLevel
+}
@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestVMMLogWriter(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	w := newVMMLogWriter("fc-1", logrus.NewEntry(logger))
+
+	// Lines may arrive split across writes
+	writes := []string{
+		"2024-01-02T15:04:05.000000000 [fc-1:main:INFO:src/firecracker/src/main.rs:1] Running Firecracker\n2024-01-02T15:04:05.1",
+		"00000000 [fc-1:fc_vmm:WARN:src/vmm/src/lib.rs:2] vCPU paused\n\n",
+		"2024-01-02T15:04:05.200000000 [fc-1:fc_vmm:ERROR:src/vmm/src/lib.rs:3] ",
+	}
+	for _, p := range writes {
+		if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("logged %d entries, want 2: %+v", len(entries), entries)
+	}
+	if entries[0].Level != logrus.InfoLevel || entries[1].Level != logrus.WarnLevel {
+		t.Errorf("levels = %s, %s", entries[0].Level, entries[1].Level)
+	}
+	for _, e := range entries {
+		if e.Data["component"] != "vmm" || e.Data["sandbox_id"] != "fc-1" {
+			t.Errorf("entry fields = %v", e.Data)
+		}
+	}
+	if entries[1].Message != "2024-01-02T15:04:05.100000000 [fc-1:fc_vmm:WARN:src/vmm/src/lib.rs:2] vCPU paused" {
+		t.Errorf("message = %q", entries[1].Message)
+	}
+}
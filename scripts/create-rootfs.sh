@@ -3,7 +3,7 @@
 #
 # This script creates an ext4 filesystem image containing:
 # - Alpine Linux base system
-# - runc for container execution
+# - runc (or crun, with OCI_RUNTIME=crun) for container execution
 # - fc-agent for host communication
 #
 # Usage: ./create-rootfs.sh [output_path] [size_mb]
@@ -14,6 +14,12 @@ OUTPUT_PATH="${1:-/var/lib/fc-cri/rootfs/base.ext4}"
 SIZE_MB="${2:-256}"
 ALPINE_VERSION="3.19"
 ALPINE_MIRROR="https://dl-cdn.alpinelinux.org/alpine"
+OCI_RUNTIME="${OCI_RUNTIME:-runc}"
+
+case "$OCI_RUNTIME" in
+    runc|crun) ;;
+    *) echo "OCI_RUNTIME must be runc or crun, not $OCI_RUNTIME" >&2; exit 1 ;;
+esac
 
 WORK_DIR=$(mktemp -d)
 MOUNT_DIR="$WORK_DIR/mnt"
@@ -91,6 +97,14 @@ auto eth0
 iface eth0 inet dhcp
 EOF
 
+# The host boots VMs with net.ifnames=0, so the sandbox interface is eth0.
+# Images that run udev also get it pinned by its MAC (02:fc:...), in case
+# their kernel command line asks for predictable names.
+sudo mkdir -p "$MOUNT_DIR/etc/udev/rules.d"
+sudo bash -c "cat > $MOUNT_DIR/etc/udev/rules.d/70-fc-net.rules" <<'EOF'
+SUBSYSTEM=="net", ACTION=="add", ATTR{address}=="02:fc:*", NAME="eth0"
+EOF
+
 # Set hostname
 echo "fc-vm" | sudo tee "$MOUNT_DIR/etc/hostname" > /dev/null
 
@@ -102,7 +116,7 @@ sudo chroot "$MOUNT_DIR" /bin/sh -c "
 
     # Install essential packages
     apk add --no-cache \
-        runc \
+        $OCI_RUNTIME \
         iptables \
         ip6tables \
         iproute2 \
@@ -125,7 +139,7 @@ else
 fi
 
 # Create required directories
-sudo mkdir -p "$MOUNT_DIR/run/runc"
+sudo mkdir -p "$MOUNT_DIR/run/$OCI_RUNTIME"
 sudo mkdir -p "$MOUNT_DIR/run/fc-agent"
 sudo mkdir -p "$MOUNT_DIR/var/lib/containers"
 
@@ -172,6 +186,6 @@ echo "Size: $ACTUAL_SIZE (sparse: ${SIZE_MB}MB)"
 echo ""
 echo "Contents:"
 echo "  - Alpine Linux ${ALPINE_VERSION}"
-echo "  - runc container runtime"
+echo "  - $OCI_RUNTIME container runtime"
 echo "  - fc-agent (if built)"
 echo "  - Network utilities"